@@ -0,0 +1,2321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"server_app/internal/accounting"
+	"server_app/internal/admin"
+	"server_app/internal/arbiter"
+	"server_app/internal/auth"
+	"server_app/internal/bridge"
+	"server_app/internal/buildinfo"
+	"server_app/internal/capture"
+	"server_app/internal/conformance"
+	"server_app/internal/deadletter"
+	"server_app/internal/devices"
+	"server_app/internal/display"
+	"server_app/internal/epaper"
+	"server_app/internal/etchsketch"
+	"server_app/internal/events"
+	"server_app/internal/federation"
+	"server_app/internal/inbox"
+	"server_app/internal/jobs"
+	"server_app/internal/messaging"
+	"server_app/internal/migration"
+	"server_app/internal/mood"
+	"server_app/internal/notify"
+	"server_app/internal/ota"
+	"server_app/internal/rules"
+	"server_app/internal/scenes"
+	"server_app/internal/telemetry"
+	"server_app/internal/timeline"
+	"server_app/internal/weather"
+	"server_app/internal/wsrelay"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budget analyzer defaults (overridable per request via query params)
+const (
+	defaultHeartbeatInterval = 60 * time.Second
+	defaultDailyByteBudget   = 1 << 20 // 1 MiB per device per day
+	forecastDaysPublished    = 3
+)
+
+// Register routes served by the local admin interface
+func register_admin_routes() {
+	admin.Handle("/devices", handle_admin_devices)
+	admin.Handle("/devices/", handle_admin_device)
+	admin.Handle("/maintenance/rebuild-devices", handle_admin_rebuild_devices)
+	admin.Handle("/telemetry", handle_admin_telemetry)
+	admin.Handle("/telemetry/anomalies", handle_admin_telemetry_anomalies)
+	admin.Handle("/rules", handle_admin_rules)
+	admin.Handle("/weather/mood", handle_admin_weather_mood)
+	admin.Handle("/weather/", handle_admin_weather)
+	admin.Handle("/accounting", handle_admin_accounting)
+	admin.Handle("/mqtt/status", handle_admin_mqtt_status)
+	admin.Handle("/mqtt/capture", handle_admin_mqtt_capture)
+	admin.Handle("/mqtt/publish", handle_admin_mqtt_publish)
+	admin.Handle("/inbox", handle_admin_inbox)
+	admin.Handle("/deadletter", handle_admin_deadletter)
+	admin.Handle("/deadletter/", handle_admin_deadletter_entry)
+	admin.Handle("/jobs", handle_admin_jobs)
+	admin.Handle("/jobs/", handle_admin_job)
+	admin.Handle("/conformance", handle_admin_conformance)
+	admin.Handle("/conformance/", handle_admin_conformance_session)
+	admin.Handle("/topic-migration", handle_admin_topic_migration)
+	admin.Handle("/federation", handle_admin_federation)
+	admin.Handle("/bridge", handle_admin_bridge)
+	admin.Handle("/notify", handle_admin_notify)
+	admin.Handle("/notify/test", handle_admin_notify_test)
+	admin.Handle("/scenes", handle_admin_scenes)
+	admin.Handle("/scenes/", handle_admin_scene)
+	admin.Handle("/channels", handle_admin_channels)
+	admin.Handle("/channels/", handle_admin_channel)
+	admin.Handle("/firmware", handle_admin_firmware)
+	admin.Handle("/firmware/", handle_admin_firmware_release)
+	admin.Handle("/timeline", handle_admin_timeline)
+	admin.Handle("/healthz", handle_admin_healthz)
+	admin.Handle("/readyz", handle_admin_readyz)
+
+	// WebSocket relay for browser clients (/mqtt/ws), limited to the configured topics
+	configMutex.RLock()
+	relayTopics := runtimeConfig.WSRelayTopics
+	configMutex.RUnlock()
+	if len(relayTopics) > 0 {
+		admin.Handle("/mqtt/ws", wsrelay.Handler(relayTopics))
+	}
+	admin.Handle("/etchsketch/timelapse.gif", handle_admin_etchsketch_timelapse)
+	admin.Handle("/etchsketch/replay", handle_admin_etchsketch_replay)
+	admin.Handle("/etchsketch/draw", handle_admin_etchsketch_draw)
+	admin.Handle("/etchsketch/devices", handle_admin_etchsketch_devices)
+	admin.Handle("/etchsketch/", handle_admin_etchsketch_png)
+	admin.Handle("/etchsketch/guest", handle_admin_etchsketch_guest)
+	admin.Handle("/etchsketch/pixels", handle_admin_etchsketch_pixels)
+	admin.Handle("/etchsketch/clear", handle_admin_etchsketch_clear)
+	admin.Handle("/etchsketch/text", handle_admin_etchsketch_text)
+	admin.Handle("/display/image", handle_admin_display_image)
+	admin.Handle("/events", events.Handler)
+	admin.Handle("/etchsketch/undo", handle_admin_etchsketch_undo)
+	admin.Handle("/etchsketch/palette", handle_admin_etchsketch_palette)
+	admin.Handle("/etchsketch/frame", handle_admin_etchsketch_frame)
+	admin.Handle("/etchsketch/submissions", handle_admin_etchsketch_submissions)
+	admin.Handle("/etchsketch/submissions/", handle_admin_etchsketch_submission)
+	admin.Handle("/auth/", auth.Handler)
+}
+
+// Require sign-in for the admin interface when identity providers are configured. Health
+// probes, guest canvas submissions, the canvas snapshot (for embedding in dashboards) and
+// the login routes stay open; maintenance, device keys and protocol tooling need the admin role.
+func configure_admin_auth(cfg auth.Config) error {
+	if err := auth.Configure(cfg); err != nil {
+		return err
+	}
+	for _, prefix := range []string{"/auth/", "/healthz", "/readyz", "/etchsketch/guest", "/etchsketch/" + canvas_room() + ".png"} {
+		auth.Public(prefix)
+	}
+	for _, pattern := range []string{"/maintenance", "/devices/*/key", "/topic-migration", "/conformance", "/jobs", "/firmware", "/deadletter", "/mqtt/capture", "/mqtt/publish"} {
+		auth.Restrict(pattern, auth.RoleAdmin)
+	}
+	admin.Use(auth.Middleware)
+	if auth.Enabled() {
+		fmt.Printf("Admin interface requires sign-in\n")
+	}
+	return nil
+}
+
+// Guest frame as submitted by the web editor
+type GuestFrame struct {
+	Source string     `json:"source"`
+	Red    [16]uint16 `json:"red"`
+	Green  [16]uint16 `json:"green"`
+	Blue   [16]uint16 `json:"blue"`
+}
+
+// /etchsketch/guest
+//
+//	POST submits a frame from an untrusted source. Frames matching the canvas blocklist
+//	are rejected (422) or quarantined (202). With guestModeration enabled the frame is
+//	queued for approval (202), otherwise it is applied immediately (200).
+func handle_admin_etchsketch_guest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	var frame GuestFrame
+	if err := admin.ReadJSON(r, &frame); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if frame.Source == "" {
+		frame.Source = r.RemoteAddr
+	}
+
+	if stencil, blocked := match_blocklist_window(frame.Red, frame.Green, frame.Blue); blocked {
+		if quarantine_blocked_frame(frame.Source, stencil, frame.Red, frame.Green, frame.Blue) {
+			admin.WriteJSON(w, http.StatusAccepted, map[string]string{"status": "quarantined"})
+			return
+		}
+		admin.WriteError(w, http.StatusUnprocessableEntity, "frame matches blocked content")
+		return
+	}
+
+	configMutex.RLock()
+	moderated := runtimeConfig.GuestModeration
+	configMutex.RUnlock()
+
+	if moderated {
+		sub := etchsketchManager.QueueSubmission(frame.Source, frame.Red, frame.Green, frame.Blue, guest_submission_ttl())
+		admin.WriteJSON(w, http.StatusAccepted, sub)
+		return
+	}
+	if err := etchsketchManager.PublishFrame(frame.Red, frame.Green, frame.Blue); err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Pixel edits as sent by admin tools
+type PixelEdits struct {
+	Source  string                   `json:"source"`
+	Updates []etchsketch.PixelUpdate `json:"updates"`
+}
+
+// /etchsketch/pixels
+//
+//	POST applies pixel updates ({"updates": [{"x", "y", "color", "op": "set|clear|toggle"}]})
+//	to the shared canvas and broadcasts the result. Edits producing a frame that matches the
+//	canvas blocklist are not applied (422), though they may be quarantined for moderation.
+func handle_admin_etchsketch_pixels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	var edits PixelEdits
+	if err := admin.ReadJSON(r, &edits); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	frame, _ := etchsketchManager.GetFrame()
+	for i, u := range edits.Updates {
+		if err := u.Validate(); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "update %d: %v", i, err)
+			return
+		}
+		if !frame.Contains(int(u.X), int(u.Y)) {
+			admin.WriteError(w, http.StatusBadRequest, "update %d: pixel (%d,%d) is outside the %dx%d canvas", i, u.X, u.Y, frame.Width, frame.Height)
+			return
+		}
+	}
+	if edits.Source == "" {
+		edits.Source = r.RemoteAddr
+	}
+
+	applied, err := apply_pixel_updates(edits.Source, edits.Updates)
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if !applied {
+		admin.WriteError(w, http.StatusUnprocessableEntity, "edit produces blocked content")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// /etchsketch/clear
+//
+//	POST blanks the shared canvas and broadcasts the empty frame
+func handle_admin_etchsketch_clear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	if err := etchsketchManager.Clear(); err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Result of drawing text on the canvas
+type TextResult struct {
+	Pixels  int  `json:"pixels"`  // Pixel updates applied
+	Clipped bool `json:"clipped"` // Part of the text fell off the canvas
+}
+
+// /etchsketch/text
+//
+//	POST draws a short string ({"text", "x", "y", "color", "center", "background"}) on the
+//	shared canvas with the 3x5 font, as pixel updates from source "text". Lines are separated
+//	by "\n". Text matching the canvas blocklist is not drawn (422).
+func handle_admin_etchsketch_text(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	var text etchsketch.Text
+	if err := admin.ReadJSON(r, &text); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := text.Validate(); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	frame, _ := etchsketchManager.GetFrame()
+	updates, clipped := text.Updates(frame.Width, frame.Height)
+	if len(updates) == 0 {
+		admin.WriteError(w, http.StatusBadRequest, "text is entirely outside the %dx%d canvas", frame.Width, frame.Height)
+		return
+	}
+
+	applied, err := apply_pixel_updates("text", updates)
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if !applied {
+		admin.WriteError(w, http.StatusUnprocessableEntity, "text produces blocked content")
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, TextResult{Pixels: len(updates), Clipped: clipped})
+}
+
+// /display/image
+//
+//	POST pushes an image (PNG, JPEG or GIF; the request body, or the "image" field of a
+//	multipart form) to the shared canvas, scaled to the canvas size. ?colors=16 uses the
+//	16-color palette (16x16 canvas only, default 8); ?dither=off maps each pixel to the
+//	nearest color instead of dithering. Images matching the canvas blocklist are not
+//	pushed (422).
+func handle_admin_display_image(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	colors, err := query_int(r.URL.Query().Get("colors"), 8)
+	if err != nil || (colors != 8 && colors != etchsketch.PaletteSize) {
+		admin.WriteError(w, http.StatusBadRequest, "colors must be 8 or 16")
+		return
+	}
+	opts := DisplayOptions{Colors: colors, Dither: r.URL.Query().Get("dither") != "off"}
+
+	body := io.Reader(r.Body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	img, err := display.Decode(body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, display.ErrTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		admin.WriteError(w, status, "%v", err)
+		return
+	}
+
+	if err := push_display_image("admin upload", img, opts); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrImageBlocked) {
+			status = http.StatusUnprocessableEntity
+		} else if errors.Is(err, ErrPaletteCanvasSize) {
+			status = http.StatusBadRequest
+		}
+		admin.WriteError(w, status, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// /etchsketch/devices
+//
+//	GET lists the sequence number each device last reported or was sent, and how many
+//	frames it is behind the canvas
+func handle_admin_etchsketch_devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, etchsketchManager.DeviceSequences())
+}
+
+// /etchsketch/undo
+//
+//	GET  returns how many canvas changes can be undone
+//	POST reverts the last change and broadcasts the restored frame (409 when there is none)
+func handle_admin_etchsketch_undo(w http.ResponseWriter, r *http.Request) {
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, map[string]int{"available": etchsketchManager.UndoAvailable()})
+
+	case http.MethodPost:
+		err := etchsketchManager.Undo()
+		if errors.Is(err, etchsketch.ErrNothingToUndo) {
+			admin.WriteError(w, http.StatusConflict, "%v", err)
+			return
+		}
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /etchsketch/frame
+//
+//	GET  returns the whole canvas ({"width", "height", "rows"}, one channel-bits digit 0-7
+//	     per pixel) with its sequence number
+//	POST replaces the whole canvas with a frame of its size and broadcasts it. Frames whose
+//	     16x16 window matches the canvas blocklist are not applied (422).
+func handle_admin_etchsketch_frame(w http.ResponseWriter, r *http.Request) {
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		frame, seq := etchsketchManager.GetFrame()
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"seq": seq, "frame": frame})
+
+	case http.MethodPost:
+		var frame etchsketch.Frame
+		if err := admin.ReadJSON(r, &frame); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if current, _ := etchsketchManager.GetFrame(); frame.Width != current.Width || frame.Height != current.Height {
+			admin.WriteError(w, http.StatusBadRequest, "frame is %dx%d, canvas is %dx%d", frame.Width, frame.Height, current.Width, current.Height)
+			return
+		}
+		applied, err := apply_canvas_frame(r.RemoteAddr, frame)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		if !applied {
+			admin.WriteError(w, http.StatusUnprocessableEntity, "frame matches blocked content")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// Canvas in palette mode
+type PaletteView struct {
+	Palette []string                `json:"palette"` // Colors by index, "#rrggbb"
+	Seq     uint16                  `json:"seq"`
+	Pixels  etchsketch.PaletteFrame `json:"pixels"` // Palette index per pixel, [row][column]
+}
+
+// /etchsketch/palette
+//
+//	GET  returns the palette and the canvas as palette indexes
+//	POST sets pixels to palette indexes ({"updates": [{"x", "y", "index"}]}) and broadcasts
+//	     the result. Edits producing a blocked frame are not applied (422).
+func handle_admin_etchsketch_palette(w http.ResponseWriter, r *http.Request) {
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		frame, seq := etchsketchManager.GetPaletteState()
+		view := PaletteView{Seq: seq, Pixels: frame}
+		for _, c := range etchsketch.Palette {
+			view.Palette = append(view.Palette, fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))
+		}
+		admin.WriteJSON(w, http.StatusOK, view)
+
+	case http.MethodPost:
+		var body struct {
+			Source  string                     `json:"source"`
+			Updates []etchsketch.PaletteUpdate `json:"updates"`
+		}
+		if err := admin.ReadJSON(r, &body); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		for i, u := range body.Updates {
+			if err := u.Validate(); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, "update %d: %v", i, err)
+				return
+			}
+		}
+		if body.Source == "" {
+			body.Source = r.RemoteAddr
+		}
+		applied, err := apply_palette_updates(body.Source, body.Updates)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		if !applied {
+			admin.WriteError(w, http.StatusUnprocessableEntity, "edit produces blocked content")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /etchsketch/submissions
+//
+//	GET lists guest frames awaiting moderation, oldest first
+func handle_admin_etchsketch_submissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, etchsketchManager.PendingSubmissions())
+}
+
+// /etchsketch/submissions/<id>/approve
+// /etchsketch/submissions/<id>/reject
+//
+//	POST applies the guest frame to the shared canvas, or discards it
+func handle_admin_etchsketch_submission(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/etchsketch/submissions/")
+	if len(parts) != 2 || (parts[1] != "approve" && parts[1] != "reject") {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+
+	var err error
+	if parts[1] == "approve" {
+		err = etchsketchManager.ApproveSubmission(parts[0])
+	} else {
+		err = etchsketchManager.RejectSubmission(parts[0])
+	}
+	if errors.Is(err, etchsketch.ErrUnknownSubmission) {
+		admin.WriteError(w, http.StatusNotFound, "submission %s not found", parts[0])
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /mqtt/status
+//
+//	GET returns configured brokers, the active one, and failover counts
+func handle_admin_mqtt_status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, messaging.Status())
+}
+
+// Topic migration progress as reported by /topic-migration
+type TopicMigrationStatus struct {
+	Migration *migration.State `json:"migration,omitempty"` // Latest migration (absent if none ever ran)
+	Pending   []string         `json:"pending"`             // Devices not yet heard on the new namespace
+	Namespace string           `json:"namespace"`           // Namespace currently published to
+	Serving   []string         `json:"serving"`             // Namespaces currently subscribed
+}
+
+// /topic-migration
+//
+//	GET returns the latest topic migration and which devices have not moved yet.
+//	Migrations are started with a "topic_migration" job (see /jobs).
+func handle_admin_topic_migration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	current, previous, dual := messaging.TopicNamespace()
+	status := TopicMigrationStatus{Pending: []string{}, Namespace: current, Serving: []string{current}}
+	if dual {
+		status.Serving = append(status.Serving, previous)
+	}
+	if state, exists := migration.Current(); exists {
+		status.Migration = &state
+		if state.Phase == migration.PhaseTransition {
+			status.Pending = append(status.Pending, migration.Pending()...)
+		}
+	}
+	admin.WriteJSON(w, http.StatusOK, status)
+}
+
+// /timeline
+//
+//	GET returns timeline events, newest first. Filters:
+//	    from, to   RFC3339 times; since a duration back from now (e.g. 24h) instead of from
+//	    type       comma-separated event types (alert, canvas, device, firmware, health, rule, scene, server)
+//	    device     one device
+//	    limit      most events returned (default 200, up to 5000)
+func handle_admin_timeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := timeline.Filter{Device: query.Get("device")}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				admin.WriteError(w, http.StatusBadRequest, "invalid %s: expected RFC3339 time, got %q", bound.name, v)
+				return
+			}
+			*bound.dst = t
+		}
+	}
+	if v := query.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			admin.WriteError(w, http.StatusBadRequest, "invalid since: expected a duration such as 24h, got %q", v)
+			return
+		}
+		filter.From = time.Now().Add(-d)
+	}
+	var err error
+	if filter.Types, err = timeline.ParseTypes(query.Get("type")); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if filter.Limit, err = query_int(query.Get("limit"), timeline.DefaultLimit); err != nil || filter.Limit > timeline.MaxLimit {
+		admin.WriteError(w, http.StatusBadRequest, "invalid limit: expected 1-%d", timeline.MaxLimit)
+		return
+	}
+
+	events, truncated := timeline.Query(filter)
+	if events == nil {
+		events = []timeline.Event{}
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"events":    events,
+		"truncated": truncated, // More events matched; narrow the range or raise limit
+		"counts":    timeline.Counts(),
+	})
+}
+
+// /federation
+//
+//	GET returns the federated canvas state and each peer link
+func handle_admin_federation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, federation.GetStatus())
+}
+
+// /bridge
+//
+//	GET returns the cloud bridge connection and how many messages it forwarded each way
+func handle_admin_bridge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, bridge.GetStatus())
+}
+
+// Alerting state as reported by /notify
+type NotifyStatus struct {
+	Channels []string        `json:"channels"` // Enabled channels
+	Active   []notify.Active `json:"active"`   // Conditions holding now, oldest first
+}
+
+// /notify
+//
+//	GET returns the enabled alert channels and the alert conditions currently holding
+func handle_admin_notify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	channels, active := notify.Status()
+	admin.WriteJSON(w, http.StatusOK, NotifyStatus{Channels: channels, Active: active})
+}
+
+// /notify/test
+//
+//	POST sends a test alert to every enabled channel and returns "ok" or the error per
+//	channel (502 if any failed)
+func handle_admin_notify_test(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	results := notify.Test()
+	if len(results) == 0 {
+		admin.WriteError(w, http.StatusConflict, "no notify channels configured")
+		return
+	}
+	status := http.StatusOK
+	report := make(map[string]string, len(results))
+	for name, err := range results {
+		report[name] = "ok"
+		if err != nil {
+			report[name] = err.Error()
+			status = http.StatusBadGateway
+		}
+	}
+	admin.WriteJSON(w, status, report)
+}
+
+// Scene definitions and recent activations as reported by /scenes
+type ScenesStatus struct {
+	Scenes []scenes.Scene `json:"scenes"`
+	Runs   []scenes.Run   `json:"runs"` // Newest first
+}
+
+// /scenes
+//
+//	GET returns the scenes defined in config.json and their recent activations
+func handle_admin_scenes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, ScenesStatus{Scenes: scenes.List(), Runs: scenes.Runs()})
+}
+
+// /scenes/<name>/activate
+//
+//	POST applies the scene to all its targets and returns the run; 502 with the run if a
+//	target failed and the targets were restored, 409 if the scene could not start (e.g. an
+//	unknown or pending target)
+func handle_admin_scene(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/scenes/")
+	if len(parts) != 2 || parts[1] != "activate" {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	run, err := activate_scene(parts[0], "api")
+	switch {
+	case errors.Is(err, errUnknownScene):
+		admin.WriteError(w, http.StatusNotFound, "scene %s not found", parts[0])
+	case err != nil && run.RolledBack:
+		admin.WriteJSON(w, http.StatusBadGateway, run)
+	case err != nil:
+		admin.WriteJSON(w, http.StatusConflict, run)
+	default:
+		admin.WriteJSON(w, http.StatusOK, run)
+	}
+}
+
+// /channels
+//
+//	GET lists the custom MSG_GENERIC channels and their field schemas
+func handle_admin_channels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, messaging.Channels())
+}
+
+// /channels/<name>
+//
+//	POST sends {"<field>": value, ...} to every active device advertising the
+//	"channel:<name>" capability and returns the devices it went to
+func handle_admin_channel(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/channels/")
+	if len(parts) != 1 {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var values map[string]interface{}
+	if err := admin.ReadJSON(r, &values); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	sent, err := broadcast_channel_data(parts[0], values)
+	if err != nil {
+		write_channel_error(w, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string][]string{"devices": sent})
+}
+
+// Firmware versions as reported by /firmware
+type FirmwareStatus struct {
+	Default  uint16        `json:"default"` // deviceVersion: offered to hardware types without a release
+	Releases []ota.Release `json:"releases"`
+}
+
+// /firmware
+//
+//	GET returns the default firmware version and the latest release per hardware type
+func handle_admin_firmware(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, FirmwareStatus{Default: ota.Default(), Releases: ota.Releases()})
+}
+
+// Release offered to devices of a hardware type; false when the type has none of its own
+// and its devices get the default version
+func firmware_release(hardwareType string) (ota.Release, bool) {
+	for _, release := range ota.Releases() {
+		if release.HardwareType == hardwareType {
+			return release, true
+		}
+	}
+	return ota.Release{HardwareType: hardwareType, Version: ota.Default()}, false
+}
+
+// /firmware/<hw_type>
+//
+//	GET returns the version offered to devices of the hardware type
+//	PUT {"version": 7, "notes": "..."} sets the type's latest release; devices are told on
+//	their next heartbeat, or right away by an ota_rollout job
+//	DELETE removes the type's release so its devices get the default version again
+func handle_admin_firmware_release(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/firmware/")
+	if len(parts) != 1 {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	hardwareType := parts[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		release, own := firmware_release(hardwareType)
+		if !own {
+			// No release of its own: its devices get the default
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"hw_type": hardwareType, "version": release.Version, "default": true})
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, release)
+	case http.MethodPut:
+		var req struct {
+			Version uint16 `json:"version"`
+			Notes   string `json:"notes"`
+		}
+		if err := admin.ReadJSON(r, &req); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		release, err := ota.Publish(hardwareType, req.Version, req.Notes)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		fmt.Printf("Firmware %d released for %s\n", release.Version, hardwareType)
+		timeline.Record(timeline.TypeFirmware, "", fmt.Sprintf("firmware %d released for %s", release.Version, hardwareType),
+			map[string]interface{}{"hw_type": hardwareType, "version": release.Version, "notes": release.Notes})
+		admin.WriteJSON(w, http.StatusOK, release)
+	case http.MethodDelete:
+		if !ota.Remove(hardwareType) {
+			admin.WriteError(w, http.StatusNotFound, "no release for hardware type %s", hardwareType)
+			return
+		}
+		fmt.Printf("Firmware release for %s removed\n", hardwareType)
+		timeline.Record(timeline.TypeFirmware, "", "firmware release removed for "+hardwareType,
+			map[string]interface{}{"hw_type": hardwareType, "version": ota.Default()})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /devices/<id>/channels/<name>
+//
+//	POST validates {"<field>": value, ...} against the channel schema and sends it to the
+//	device (which must advertise the "channel:<name>" capability)
+func handle_admin_device_channel(w http.ResponseWriter, r *http.Request, deviceName string, channelName string) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var values map[string]interface{}
+	if err := admin.ReadJSON(r, &values); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	msg, err := send_channel_data(deviceName, channelName, values)
+	if err != nil {
+		if errors.Is(err, devices.ErrUnknownDevice) {
+			write_device_error(w, deviceName, err)
+			return
+		}
+		write_channel_error(w, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]string{"message": hex.EncodeToString(msg)})
+}
+
+func write_channel_error(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownChannel):
+		admin.WriteError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, errChannelUnsupported):
+		admin.WriteError(w, http.StatusNotImplemented, "%v", err)
+	default:
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+	}
+}
+
+// /healthz
+//
+//	GET reports liveness: 200 while every background task keeps running, 503 once one stalls.
+//	Includes the composite subsystem status as last evaluated.
+func handle_admin_healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	write_health(w, with_build(r, liveness_report()))
+}
+
+// /readyz
+//
+//	GET re-evaluates subsystem health and reports readiness: 200 while the composite status
+//	is ok or degraded, 503 once a subsystem has failed. Includes the weather fetch history.
+func handle_admin_readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	write_health(w, with_build(r, readiness_report()))
+}
+
+// The health routes are public; the commit and Go version are shown to signed-in callers only
+func with_build(r *http.Request, report HealthReport) HealthReport {
+	if auth.SignedIn(r) {
+		build := buildinfo.Get()
+		report.Build = &build
+	}
+	return report
+}
+
+func write_health(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	admin.WriteJSON(w, status, report)
+}
+
+// /accounting?month=2006-01
+//
+//	GET returns per-tenant usage totals (weather API call share, messages, storage)
+//	for the month (default: current) plus the per-device breakdown
+func handle_admin_accounting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().Format("2006-01")
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid month %q, expected YYYY-MM", month)
+		return
+	}
+
+	configMutex.RLock()
+	tenants := runtimeConfig.Tenants
+	configMutex.RUnlock()
+
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"month":            month,
+		"available_months": accounting.Months(),
+		"tenants":          accounting.Summarize(month, tenants),
+		"devices":          accounting.DeviceUsage(month),
+	})
+}
+
+// Stored weather for a zipcode as reported by /weather/<zipcode>
+type WeatherStatus struct {
+	Zipcode         string               `json:"zipcode"`
+	CurrentTemp     *int8                `json:"current_temp,omitempty"` // Unset until current weather is stored
+	Condition       string               `json:"condition,omitempty"`
+	Humidity        uint8                `json:"humidity,omitempty"`   // Percent
+	WindSpeed       *float64             `json:"wind_speed,omitempty"` // mph
+	WindDir         string               `json:"wind_dir,omitempty"`   // Compass point the wind blows from
+	CurrentUpdated  string               `json:"current_updated,omitempty"`
+	Forecast        []WeatherForecastDay `json:"forecast"`
+	ForecastUpdated string               `json:"forecast_updated,omitempty"`
+	Untrusted       bool                 `json:"untrusted,omitempty"` // Stored while the server clock was not trusted
+}
+
+// One forecast day as sent to devices
+type WeatherForecastDay struct {
+	HighTemp int8  `json:"high_temp"`
+	LowTemp  int8  `json:"low_temp"` // Overnight low
+	Precip   uint8 `json:"precip"`
+	Moon     uint8 `json:"moon"`
+}
+
+// Fetch current weather and the forecast for a zipcode now and publish them to its devices
+func refresh_weather(zipcode string) {
+	fetch_weather("current_weather", zipcode)
+	fetch_weather("forecast_weather", zipcode)
+	publish_weather("current_weather", zipcode)
+	publish_weather("forecast_weather", zipcode)
+}
+
+// /weather/<zipcode>[/refresh]
+//
+//	GET returns the weather stored for the zipcode
+//	POST /refresh fetches current weather and the forecast now, publishes them to the
+//	zipcode's devices and returns the stored weather
+func handle_admin_weather(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/weather/")
+	if len(parts) < 1 || len(parts) > 2 || (len(parts) == 2 && parts[1] != "refresh") {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	zipcode := parts[0]
+	method := http.MethodGet
+	if len(parts) == 2 {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	if len(parts) == 2 {
+		refresh_weather(zipcode)
+	}
+	status, exists := weather_status(zipcode)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "no weather stored for zipcode %s", zipcode)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, status)
+}
+
+// Forecast days reported by the admin APIs (everything stored, up to the weather API's 8)
+const adminForecastDays = 8
+
+// Stored weather for a zipcode as reported by the REST and gRPC admin APIs; false when
+// nothing is stored for it
+func weather_status(zipcode string) (WeatherStatus, bool) {
+	data, exists := weather.GetStoredWeatherData(zipcode)
+	if !exists {
+		return WeatherStatus{}, false
+	}
+	status := WeatherStatus{
+		Zipcode:         zipcode,
+		CurrentUpdated:  data.CurrentWeatherUpdated,
+		Forecast:        []WeatherForecastDay{},
+		ForecastUpdated: data.ForecastWeatherUpdated,
+		Untrusted:       data.CurrentWeatherUntrusted || data.ForecastWeatherUntrusted,
+	}
+	if current, err := weather.GetCurrentConditions(zipcode); err == nil {
+		status.CurrentTemp = &current.Temp
+		status.Condition, status.Humidity = current.Condition, current.Humidity
+		status.WindSpeed = current.WindSpeed
+		if current.WindDeg != nil {
+			status.WindDir = messaging.CompassName(messaging.CompassPoint(*current.WindDeg))
+		}
+	}
+	if days, err := weather.GetForecastDays(zipcode, adminForecastDays); err == nil {
+		for _, d := range days {
+			status.Forecast = append(status.Forecast, WeatherForecastDay{HighTemp: d.HighTemp, LowTemp: d.LowTemp, Precip: d.Precip, Moon: d.Moon})
+		}
+	}
+	return status, true
+}
+
+// /weather/mood
+//
+//	GET returns the condition -> ambient light mapping table
+//	PUT replaces it with a JSON array of {"condition","color","animation","period_ms"}
+//	(condition "*" is the fallback; changes apply from the next current weather publish)
+func handle_admin_weather_mood(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, mood.Mappings())
+
+	case http.MethodPut:
+		var mappings []mood.Mapping
+		if err := admin.ReadJSON(r, &mappings); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if err := mood.SetMappings(mappings); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, mood.Mappings())
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /etchsketch/timelapse.gif?from=<RFC3339>&to=<RFC3339>&scale=8&fps=4
+//
+//	GET renders recorded canvas frames in the time range as an animated GIF
+//	(omitted bounds are open; scale is pixels per canvas cell)
+func handle_admin_etchsketch_timelapse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+
+	query := r.URL.Query()
+	var from, to time.Time
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				admin.WriteError(w, http.StatusBadRequest, "invalid %s: expected RFC3339 time, got %q", bound.name, v)
+				return
+			}
+			*bound.dst = t
+		}
+	}
+	scale, err := query_int(query.Get("scale"), 8)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid scale: %v", err)
+		return
+	}
+	fps, err := query_int(query.Get("fps"), 4)
+	if err != nil || fps == 0 {
+		admin.WriteError(w, http.StatusBadRequest, "invalid fps: expected positive integer")
+		return
+	}
+
+	frames, err := etchsketchManager.RecordedFrames(from, to)
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if len(frames) == 0 {
+		admin.WriteError(w, http.StatusNotFound, "no frames recorded in the requested range")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := etchsketch.RenderTimelapseGIF(&buf, frames, scale, time.Second/time.Duration(fps)); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Disposition", `attachment; filename="etchsketch_timelapse.gif"`)
+	w.Write(buf.Bytes())
+}
+
+// Name of the canvas room in snapshot URLs: the federation room, or "shared" without federation
+func canvas_room() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	if runtimeConfig.Federation.Enabled() {
+		return runtimeConfig.Federation.Room
+	}
+	return "shared"
+}
+
+// /etchsketch/<room>.png?scale=16
+//
+//	GET renders the current canvas as a PNG with the canvas palette (scale is pixels per
+//	canvas cell, default 16). The room is the federation room, or "shared".
+func handle_admin_etchsketch_png(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/etchsketch/")
+	if len(parts) != 1 || !strings.HasSuffix(parts[0], ".png") {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	if room := strings.TrimSuffix(parts[0], ".png"); room != canvas_room() {
+		admin.WriteError(w, http.StatusNotFound, "unknown canvas room %q", room)
+		return
+	}
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	scale, err := query_int(r.URL.Query().Get("scale"), 16)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid scale: %v", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := etchsketchManager.RenderPNG(&buf, scale); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store") // Live drawing
+	w.Write(buf.Bytes())
+}
+
+// Replay request; omitted times are open bounds
+type ReplayRequest struct {
+	Topic           string    `json:"topic"`
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	Speed           float64   `json:"speed"`           // 2 = twice as fast as drawn (default 1)
+	MaxPauseSeconds float64   `json:"maxPauseSeconds"` // Longer gaps are shortened to this (default 2)
+}
+
+// /etchsketch/replay
+//
+//	GET    returns the status of the current or last replay (null if none)
+//	POST   plays recorded pixel edits in the time range on a topic ({"topic", "from", "to",
+//	       "speed", "maxPauseSeconds"}): a clear, then each batch spaced as drawn (409 while
+//	       another replay runs)
+//	DELETE stops the running replay
+func handle_admin_etchsketch_replay(w http.ResponseWriter, r *http.Request) {
+	if etchsketchManager == nil {
+		admin.WriteError(w, http.StatusServiceUnavailable, "etchsketch not initialized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, etchsketchManager.Replay())
+
+	case http.MethodPost:
+		var req ReplayRequest
+		if err := admin.ReadJSON(r, &req); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if req.Speed < 0 || req.MaxPauseSeconds < 0 {
+			admin.WriteError(w, http.StatusBadRequest, "speed and maxPauseSeconds must not be negative")
+			return
+		}
+		opts := etchsketch.ReplayOptions{
+			Topic:    req.Topic,
+			From:     req.From,
+			To:       req.To,
+			Speed:    req.Speed,
+			MaxPause: time.Duration(req.MaxPauseSeconds * float64(time.Second)),
+		}
+		// Strokes are published one by one, not through the coalescing canvas batcher
+		status, err := etchsketchManager.StartReplay(opts, mqttPublisher.PublishWithPolicy)
+		if errors.Is(err, etchsketch.ErrReplayRunning) {
+			admin.WriteError(w, http.StatusConflict, "%v", err)
+			return
+		}
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusAccepted, status)
+
+	case http.MethodDelete:
+		if !etchsketchManager.StopReplay() {
+			admin.WriteError(w, http.StatusNotFound, "no replay running")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /rules
+//
+//	GET returns configured telemetry rules and whether each is triggered
+//	(rules are edited in config.json and picked up on the next config reload)
+func handle_admin_rules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, rules.Status())
+}
+
+// /telemetry[?device=<id>&metric=<name>&since=24h]
+//
+//	GET returns the latest reading of every metric from every device, or with device and
+//	metric the readings over the since window (default 24h; SQLite storage only)
+func handle_admin_telemetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	query := r.URL.Query()
+	device, metric := query.Get("device"), query.Get("metric")
+	if device == "" && metric == "" {
+		admin.WriteJSON(w, http.StatusOK, telemetry.LatestAll())
+		return
+	}
+	if device == "" || metric == "" {
+		admin.WriteError(w, http.StatusBadRequest, "history needs both device and metric")
+		return
+	}
+	window := 24 * time.Hour
+	if s := query.Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			admin.WriteError(w, http.StatusBadRequest, "invalid since %q", s)
+			return
+		}
+		window = d
+	}
+	readings, err := telemetry.History(device, metric, time.Now().Add(-window))
+	if errors.Is(err, telemetry.ErrNoHistory) {
+		admin.WriteError(w, http.StatusNotImplemented, "%v", err)
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, readings)
+}
+
+// /telemetry/anomalies
+//
+//	GET returns recently raised telemetry anomalies, newest last
+func handle_admin_telemetry_anomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, telemetry.RecentAnomalies())
+}
+
+// /maintenance/rebuild-devices
+//
+//	POST replays the full device event log to rebuild device state and snapshot
+func handle_admin_rebuild_devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	replayed, err := devices.RebuildProjection()
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]int{
+		"events_replayed": replayed,
+		"devices":         len(devices.GetAllDevices()),
+	})
+}
+
+// /devices
+//
+//	GET lists all known devices including hardware metadata
+func handle_admin_devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	all := devices.GetAllDevices()
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	admin.WriteJSON(w, http.StatusOK, all)
+}
+
+// Dispatch /devices/<id>[/<resource>] routes
+func handle_admin_device(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/devices/")
+	if len(parts) == 1 {
+		handle_admin_device_info(w, r, parts[0])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "notifications" {
+		handle_admin_device_notification(w, r, parts[0], parts[2])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "channels" {
+		handle_admin_device_channel(w, r, parts[0], parts[2])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "emulate" && parts[2] == "screen.png" {
+		handle_admin_device_emulate_screen(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+
+	switch parts[1] {
+	case "config":
+		handle_admin_device_config(w, r, parts[0])
+	case "budget":
+		handle_admin_device_budget(w, r, parts[0])
+	case "approve":
+		handle_admin_device_approve(w, r, parts[0])
+	case "events":
+		handle_admin_device_events(w, r, parts[0])
+	case "calibration":
+		handle_admin_device_calibration(w, r, parts[0])
+	case "quiet-hours":
+		handle_admin_device_quiet_hours(w, r, parts[0])
+	case "key":
+		handle_admin_device_key(w, r, parts[0])
+	case "reported-config":
+		handle_admin_device_reported_config(w, r, parts[0])
+	case "notifications":
+		handle_admin_device_notifications(w, r, parts[0])
+	case "emulate":
+		handle_admin_device_emulate(w, r, parts[0])
+	default:
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+	}
+}
+
+// /devices/<id>/emulate
+//
+//	GET returns what the device should be displaying, decoded from the messages sent to it
+//	    ?format=text renders it as plain text
+func handle_admin_device_emulate(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+
+	view := emulate_device(device)
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, view.Text())
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, view)
+}
+
+// /devices/<id>/emulate/screen.png
+//
+//	GET returns the last complete e-paper screen sent to the device
+func handle_admin_device_emulate_screen(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+
+	screen := emulate_device(device).Screen
+	if screen == nil {
+		admin.WriteError(w, http.StatusNotFound, "no complete screen sent to %s since startup", deviceName)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, epaper.BitmapImage(screen.bitmap, screen.Width, screen.Height)); err != nil {
+		fmt.Printf("Admin: screen preview for %s failed: %v\n", deviceName, err)
+	}
+}
+
+// /devices/<id>
+//
+//	GET    returns the device record including hardware metadata
+//	DELETE forgets the device (rejects a pending registration)
+func handle_admin_device_info(w http.ResponseWriter, r *http.Request, deviceName string) {
+	switch r.Method {
+	case http.MethodGet:
+		device, exists := devices.GetDevice(deviceName)
+		if !exists {
+			admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, device)
+
+	case http.MethodDelete:
+		if err := remove_device(deviceName); err != nil {
+			write_device_error(w, deviceName, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// NotificationRequest is a text notification sent through the admin interface
+type NotificationRequest struct {
+	Text            string `json:"text"`
+	Priority        int    `json:"priority"`         // Optional; defaults to the "text" source priority
+	DurationSeconds int    `json:"duration_seconds"` // Display time (default 10)
+	TTLSeconds      int    `json:"ttl_seconds"`      // Drop if not shown within this long (0 = keep waiting)
+}
+
+// /devices/<id>/notifications
+//
+//	GET  returns the notification showing on the device and those waiting, next first
+//	POST queues a text notification {"text","priority","duration_seconds","ttl_seconds"}
+//	     (devices with the notifications capability)
+func handle_admin_device_notifications(w http.ResponseWriter, r *http.Request, deviceName string) {
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, arbiter.Get(deviceName))
+
+	case http.MethodPost:
+		if !device.Metadata.HasCapability(capabilityNotifications) {
+			admin.WriteError(w, http.StatusNotImplemented, "device %s does not show notifications", deviceName)
+			return
+		}
+		var body NotificationRequest
+		if err := admin.ReadJSON(r, &body); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if body.Text == "" || body.Priority < 0 || body.DurationSeconds < 0 || body.DurationSeconds > 0xFFFF || body.TTLSeconds < 0 {
+			admin.WriteError(w, http.StatusBadRequest, "notification needs text and non-negative priority, duration_seconds (max 65535) and ttl_seconds")
+			return
+		}
+		if body.DurationSeconds == 0 {
+			body.DurationSeconds = 10
+		}
+		n, err := submit_text_notification(deviceName, notificationSourceText, "", body.Text, body.Priority,
+			time.Duration(body.DurationSeconds)*time.Second, time.Duration(body.TTLSeconds)*time.Second)
+		if errors.Is(err, arbiter.ErrQueueFull) {
+			admin.WriteError(w, http.StatusTooManyRequests, "%v", err)
+			return
+		}
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusAccepted, n)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /devices/<id>/notifications/<notification_id>
+//
+//	DELETE withdraws a notification; cancelling the one showing moves on to the next
+func handle_admin_device_notification(w http.ResponseWriter, r *http.Request, deviceName string, idStr string) {
+	if r.Method != http.MethodDelete {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid notification id %q", idStr)
+		return
+	}
+	if err := arbiter.Cancel(deviceName, id); err != nil {
+		admin.WriteError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /devices/<id>/events?limit=50
+//
+//	GET returns the device's most recent events, newest first
+func handle_admin_device_events(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	limit, err := query_int(r.URL.Query().Get("limit"), 50)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid limit: %v", err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, devices.RecentEvents(deviceName, limit))
+}
+
+// /devices/<id>/calibration
+//
+//	GET    returns the device's LED panel calibration (null if none)
+//	PUT    sets {"gamma","max_brightness","red_gain","green_gain","blue_gain"}
+//	DELETE clears it; the device then only receives the shared uncorrected frame
+func handle_admin_device_calibration(w http.ResponseWriter, r *http.Request, deviceName string) {
+	var calibration *devices.Calibration
+	switch r.Method {
+	case http.MethodGet:
+		device, exists := devices.GetDevice(deviceName)
+		if !exists {
+			admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, device.Calibration)
+		return
+
+	case http.MethodPut:
+		calibration = &devices.Calibration{}
+		if err := admin.ReadJSON(r, calibration); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if err := calibration.Validate(); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+	case http.MethodDelete:
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	if err := devices.SetCalibration(deviceName, calibration); err != nil {
+		write_device_error(w, deviceName, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, calibration)
+}
+
+// /devices/<id>/quiet-hours
+//
+//	GET    returns the device's quiet hours (null if none), whether they are in effect, and
+//	       whether the device also ignores shared topics during them
+//	PUT    sets {"start": "23:00", "end": "07:00"} in the device's local time
+//	DELETE clears them; held updates are sent right away
+func handle_admin_device_quiet_hours(w http.ResponseWriter, r *http.Request, deviceName string) {
+	var quiet *devices.QuietHours
+	switch r.Method {
+	case http.MethodGet:
+		device, exists := devices.GetDevice(deviceName)
+		if !exists {
+			admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"quiet_hours": device.QuietHours,
+			"active":      device_quiet(deviceName),
+			// Without the capability shared weather and canvas updates still reach the device
+			"shared_topics_quiet": device.Metadata.HasCapability(capabilityQuietHours),
+		})
+		return
+
+	case http.MethodPut:
+		quiet = &devices.QuietHours{}
+		if err := admin.ReadJSON(r, quiet); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if err := quiet.Validate(); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+	case http.MethodDelete:
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	if err := devices.SetQuietHours(deviceName, quiet); err != nil {
+		write_device_error(w, deviceName, err)
+		return
+	}
+	// Start or end them now rather than at the next check
+	if device, exists := devices.GetDevice(deviceName); exists {
+		check_quiet_hours(*device)
+	}
+	admin.WriteJSON(w, http.StatusOK, quiet)
+}
+
+// Key body for PUT /devices/<id>/key (and the POST response)
+type DeviceKey struct {
+	Key string `json:"key"` // Hex encoded AES key (16, 24 or 32 bytes)
+}
+
+// /devices/<id>/key
+//
+//	GET    reports whether the device has a payload encryption key
+//	POST   generates a new key and returns it (once) for provisioning onto the device
+//	PUT    sets {"key": "<hex>"}
+//	DELETE clears it; sensitive payloads are then sent in the clear
+func handle_admin_device_key(w http.ResponseWriter, r *http.Request, deviceName string) {
+	var key []byte
+	switch r.Method {
+	case http.MethodGet:
+		if _, exists := devices.GetDevice(deviceName); !exists {
+			admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]bool{"encrypted": devices.HasKey(deviceName)})
+		return
+
+	case http.MethodPost:
+		var err error
+		if key, err = devices.GenerateKey(); err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+
+	case http.MethodPut:
+		var body DeviceKey
+		if err := admin.ReadJSON(r, &body); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		var err error
+		if key, err = hex.DecodeString(body.Key); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "key must be hex: %v", err)
+			return
+		}
+
+	case http.MethodDelete:
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	if err := devices.SetKey(deviceName, key); err != nil {
+		if errors.Is(err, devices.ErrUnknownDevice) {
+			write_device_error(w, deviceName, err)
+		} else if errors.Is(err, devices.ErrKeyUnprotected) {
+			admin.WriteError(w, http.StatusConflict, "%v", err)
+		} else {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		}
+		return
+	}
+	if r.Method == http.MethodPost {
+		admin.WriteJSON(w, http.StatusOK, DeviceKey{Key: hex.EncodeToString(key)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /devices/<id>/approve
+//
+//	POST approves a pending device and immediately serves its bootup (weather, config, version)
+func handle_admin_device_approve(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	device, err := approve_device(deviceName)
+	if err != nil {
+		write_device_error(w, deviceName, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, device)
+}
+
+// Approve a pending device and serve its bootup right away if it is online
+func approve_device(deviceName string) (*devices.Device, error) {
+	approved, err := devices.Approve(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	device, _ := devices.GetDevice(deviceName)
+	if approved && device.Active {
+		go serve_device(device.Name, device.Zipcode)
+	}
+	return device, nil
+}
+
+// Forget a device (or reject a pending registration) along with its queued notifications
+// and alert conditions
+func remove_device(deviceName string) error {
+	if err := devices.Remove(deviceName); err != nil {
+		return err
+	}
+	arbiter.Forget(deviceName)
+	clear_device_alerts(deviceName)
+	return nil
+}
+
+// /devices/<id>/config
+//
+//	GET   returns the stored config
+//	PUT   replaces the config with the JSON object in the body
+//	PATCH merges the JSON object into the config (empty value deletes a key)
+//
+// Any change is pushed to the device immediately.
+func handle_admin_device_config(w http.ResponseWriter, r *http.Request, deviceName string) {
+	switch r.Method {
+	case http.MethodGet:
+		config, err := devices.GetConfig(deviceName)
+		if err != nil {
+			write_device_error(w, deviceName, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, config)
+
+	case http.MethodPut, http.MethodPatch:
+		var body map[string]string
+		if err := admin.ReadJSON(r, &body); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		if err := change_device_config(deviceName, body, r.Method == http.MethodPut); err != nil {
+			var tooLarge configTooLargeError
+			if errors.As(err, &tooLarge) {
+				admin.WriteError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			write_device_error(w, deviceName, err)
+			return
+		}
+
+		config, _ := devices.GetConfig(deviceName)
+		admin.WriteJSON(w, http.StatusOK, config)
+
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// A config that could never be delivered to the device in a single message
+type configTooLargeError struct {
+	size  int
+	limit int
+}
+
+func (e configTooLargeError) Error() string {
+	return fmt.Sprintf("config payload would be %d bytes, exceeds maximum of %d", e.size, e.limit)
+}
+
+// Merge changes into a device's config (empty value deletes a key), or replace it, and push
+// any change to the device immediately. Configs too large to deliver are rejected.
+func change_device_config(deviceName string, body map[string]string, replace bool) error {
+	proposed := body
+	if !replace {
+		current, err := devices.GetConfig(deviceName)
+		if err != nil {
+			return err
+		}
+		proposed = devices.MergeConfig(current, body)
+	}
+	if n, limit := messaging.ConfigPairsPayloadLen(proposed), config_payload_limit(deviceName); n > limit {
+		return configTooLargeError{size: n, limit: limit}
+	}
+
+	var changed bool
+	var err error
+	if replace {
+		changed, err = devices.SetConfig(deviceName, body)
+	} else {
+		changed, err = devices.UpdateConfig(deviceName, body)
+	}
+	if err != nil {
+		return err
+	}
+	if changed {
+		publish_device_config(deviceName)
+	}
+	return nil
+}
+
+// /devices/<id>/reported-config
+//
+//	GET asks the device for the config it currently holds (devices with the replies capability)
+func handle_admin_device_reported_config(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+	if !device.Metadata.HasCapability(capabilityReplies) {
+		admin.WriteError(w, http.StatusNotImplemented, "device %s does not answer requests", deviceName)
+		return
+	}
+
+	id := inbox.NextID()
+	reply, err := inbox.Call(deviceName, deviceTopic(deviceName), messaging.EncodeConfigRead(id), messaging.MSG_CONFIG_READ, id, inbox.DefaultOptions)
+	if errors.Is(err, inbox.ErrTimeout) {
+		admin.WriteError(w, http.StatusGatewayTimeout, "%v", err)
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, http.StatusBadGateway, "%v", err)
+		return
+	}
+	entries, err := messaging.DecodeDeviceConfig(reply.Data)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadGateway, "malformed config reply: %v", err)
+		return
+	}
+	config := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key, value, _ := strings.Cut(entry, "=")
+		config[key] = value
+	}
+	admin.WriteJSON(w, http.StatusOK, config)
+}
+
+// /mqtt/capture
+//
+//	GET returns whether MQTT traffic is being captured, where to and how much so far
+//	POST {"filter": "weather/#"} starts capturing (empty filter = the configured one, or
+//	"#"), replacing a running capture
+//	DELETE stops capturing
+func handle_admin_mqtt_capture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Filter string `json:"filter"`
+		}
+		if r.ContentLength != 0 {
+			if err := admin.ReadJSON(r, &req); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+		}
+		if err := capture.Start(req.Filter); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	case http.MethodDelete:
+		capture.Stop()
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, capture.GetStatus())
+}
+
+// /mqtt/publish
+//
+//	POST {"topic": "...", "text": "..."} or {"topic": "...", "hex": "1103..."} publishes a
+//	message (default topic: the test topic, which the server only logs); "retain" and
+//	"qos" (0 or 1) are optional
+func handle_admin_mqtt_publish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var req struct {
+		Topic  string `json:"topic"`
+		Text   string `json:"text"`
+		Hex    string `json:"hex"`
+		QoS    byte   `json:"qos"`
+		Retain bool   `json:"retain"`
+	}
+	if err := admin.ReadJSON(r, &req); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if req.Topic == "" {
+		req.Topic = TopicTest
+	}
+	if strings.ContainsAny(req.Topic, "+#") {
+		admin.WriteError(w, http.StatusBadRequest, "topic %q must not contain wildcards", req.Topic)
+		return
+	}
+	if req.QoS > 1 {
+		admin.WriteError(w, http.StatusBadRequest, "qos must be 0 or 1")
+		return
+	}
+	payload := []byte(req.Text)
+	if req.Hex != "" {
+		if req.Text != "" {
+			admin.WriteError(w, http.StatusBadRequest, "set text or hex, not both")
+			return
+		}
+		var err error
+		if payload, err = hex.DecodeString(strings.ReplaceAll(req.Hex, " ", "")); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "invalid hex: %v", err)
+			return
+		}
+	}
+
+	if !messaging.PublishRaw(req.Topic, req.QoS, req.Retain, payload) {
+		admin.WriteError(w, http.StatusBadGateway, "broker did not accept the publish to %s (queued if disconnected)", req.Topic)
+		return
+	}
+	fmt.Printf("Admin published %d bytes to %s\n", len(payload), req.Topic)
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"topic": req.Topic, "bytes": len(payload)})
+}
+
+// /inbox
+//
+//	GET lists requests still waiting for a device reply
+func handle_admin_inbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, inbox.Pending())
+}
+
+// Undecodable messages as reported by /deadletter
+type DeadLetterStatus struct {
+	Total   uint64                  `json:"total"`  // Since startup
+	Counts  []deadletter.TopicCount `json:"counts"` // Per topic, since startup
+	Entries []deadletter.Entry      `json:"entries"`
+}
+
+// /deadletter?topic=<topic>&limit=50
+//
+//	GET returns failure counts per topic and the kept messages (raw payload in hex), newest
+//	first, optionally only those from one topic
+//	DELETE drops the kept messages; counts keep running
+func handle_admin_deadletter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, err := query_int(r.URL.Query().Get("limit"), 50)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "invalid limit: %v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, DeadLetterStatus{
+			Total:   deadletter.Total(),
+			Counts:  deadletter.Counts(),
+			Entries: deadletter.Entries(r.URL.Query().Get("topic"), limit),
+		})
+	case http.MethodDelete:
+		deadletter.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /deadletter/<id>[/raw]
+//
+//	GET returns one kept message; /raw returns its payload bytes as application/octet-stream
+func handle_admin_deadletter_entry(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/deadletter/")
+	if len(parts) < 1 || len(parts) > 2 || (len(parts) == 2 && parts[1] != "raw") {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid dead letter id %q", parts[0])
+		return
+	}
+	entry, ok := deadletter.Get(id)
+	if !ok {
+		admin.WriteError(w, http.StatusNotFound, "dead letter %d not found", id)
+		return
+	}
+	if len(parts) == 1 {
+		admin.WriteJSON(w, http.StatusOK, entry)
+		return
+	}
+	raw, _ := hex.DecodeString(entry.Payload)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(raw)
+}
+
+// Job submission body
+type JobRequest struct {
+	Kind        string            `json:"kind"`
+	Params      map[string]string `json:"params"`
+	MaxAttempts int               `json:"maxAttempts"`
+}
+
+// /jobs
+//
+//	GET lists queued, running and recently finished jobs, newest first
+//	POST queues a job: {"kind": "config_push|ota_rollout|backup", "params": {...}}
+func handle_admin_jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, jobs.List())
+	case http.MethodPost:
+		var req JobRequest
+		if err := admin.ReadJSON(r, &req); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		job, err := jobs.Submit(req.Kind, req.Params, req.MaxAttempts)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusAccepted, job)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// /jobs/<id>
+//
+//	GET returns the job's state and progress
+//	DELETE cancels the job (a running job stops after its current step)
+func handle_admin_job(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/jobs/")
+	if len(parts) != 1 {
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+		return
+	}
+	id := parts[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		job, exists := jobs.Get(id)
+		if !exists {
+			admin.WriteError(w, http.StatusNotFound, "job %s not found", id)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, job)
+	case http.MethodDelete:
+		job, err := jobs.Cancel(id)
+		switch {
+		case errors.Is(err, jobs.ErrUnknownJob):
+			admin.WriteError(w, http.StatusNotFound, "job %s not found", id)
+		case errors.Is(err, jobs.ErrFinished):
+			admin.WriteError(w, http.StatusConflict, "job %s already %s", id, job.State)
+		default:
+			admin.WriteJSON(w, http.StatusAccepted, job)
+		}
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// Conformance run request
+type ConformanceRequest struct {
+	Device string `json:"device"`
+	Topic  string `json:"topic"` // Optional; defaults to the device's own topic
+}
+
+// Decoded fields per case name, as reported by the firmware under test
+type ConformanceResults struct {
+	Results map[string]map[string]string `json:"results"`
+}
+
+// /conformance
+//
+//	POST starts a protocol conformance run: every server message type is sent with known
+//	payloads to the device's topic, in the order of the returned session's cases
+func handle_admin_conformance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var req ConformanceRequest
+	if err := admin.ReadJSON(r, &req); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if req.Device == "" {
+		admin.WriteError(w, http.StatusBadRequest, "device is required")
+		return
+	}
+	if req.Topic == "" {
+		req.Topic = deviceTopic(req.Device)
+	}
+
+	session := conformance.Start(req.Device, req.Topic)
+	go publish_conformance_sequence(session)
+	admin.WriteJSON(w, http.StatusAccepted, session)
+}
+
+// /conformance/<id>
+//
+//	GET returns the session, with its report once results were submitted
+//
+// /conformance/<id>/results
+//
+//	POST grades decoded fields ({"results": {"<case>": {"<field>": "<value>"}}}) and returns
+//	the conformance report; the device then gets its normal time, version and config back
+func handle_admin_conformance_session(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/conformance/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		session, exists := conformance.Get(parts[0])
+		if !exists {
+			admin.WriteError(w, http.StatusNotFound, "conformance session %s not found", parts[0])
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, session)
+	case len(parts) == 2 && parts[1] == "results" && r.Method == http.MethodPost:
+		var body ConformanceResults
+		if err := admin.ReadJSON(r, &body); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		report, err := conformance.Grade(parts[0], body.Results)
+		if err != nil {
+			admin.WriteError(w, http.StatusNotFound, "conformance session %s not found", parts[0])
+			return
+		}
+		fmt.Printf("Conformance session %s for %s: %d passed, %d failed, %d missing\n",
+			report.Session, report.Device, report.Passed, report.Failed, report.Missing)
+		restore_device_after_conformance(report.Device)
+		admin.WriteJSON(w, http.StatusOK, report)
+	case len(parts) == 1 || len(parts) == 2 && parts[1] == "results":
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	default:
+		admin.WriteError(w, http.StatusNotFound, "unknown route %s", r.URL.Path)
+	}
+}
+
+func write_device_error(w http.ResponseWriter, deviceName string, err error) {
+	if errors.Is(err, devices.ErrUnknownDevice) {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+	admin.WriteError(w, http.StatusInternalServerError, "%v", err)
+}
+
+// /devices/<id>/budget?heartbeat=60s&etch_frames=0&daily_budget=1048576
+//
+//	GET returns worst-case message sizes and daily byte volume for the device
+func handle_admin_device_budget(w http.ResponseWriter, r *http.Request, deviceName string) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	heartbeat := defaultHeartbeatInterval
+	if v := query.Get("heartbeat"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			admin.WriteError(w, http.StatusBadRequest, "invalid heartbeat interval %q", v)
+			return
+		}
+		heartbeat = d
+	}
+	etchFrames, err := query_int(query.Get("etch_frames"), 0)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid etch_frames: %v", err)
+		return
+	}
+	dailyBudget, err := query_int(query.Get("daily_budget"), defaultDailyByteBudget)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid daily_budget: %v", err)
+		return
+	}
+
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		admin.WriteError(w, http.StatusNotFound, "device %s not found", deviceName)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, device_message_budget(device, heartbeat, etchFrames, dailyBudget))
+}
+
+// Build the worst-case outbound message set for a device from the server's publish schedule
+func device_message_budget(device *devices.Device, heartbeat time.Duration, etchFrames int, dailyBudget int) messaging.BudgetReport {
+	const minutesPerDay = 24 * 60
+	weatherTopic := TopicWeatherPrefix + "/" + device.Zipcode
+	forecast := messaging.EncodeForecast(make([]messaging.ForecastDay, forecastDaysPublished))
+	frame := len(etchsketch.NewCanvas().EncodeFullFrame()) - 2
+
+	msgs := []messaging.MessageBudget{
+		messaging.NewMessageBudget("current_weather", weatherTopic, 0,
+			len(messaging.EncodeCurrentWeather(0))-2, minutesPerDay/WeatherUpdateInterval),
+		messaging.NewMessageBudget("forecast_weather", weatherTopic, 0,
+			len(forecast)-2, minutesPerDay/ForecastUpdateInterval),
+		// Version is re-sent on every heartbeat
+		messaging.NewMessageBudget("version", deviceTopic(device.Name), 1,
+			len(messaging.EncodeVersion(0))-2, int(24*time.Hour/heartbeat)),
+		messaging.NewMessageBudget("etch_frame", TopicEtchSketch, 0, frame, etchFrames),
+	}
+	if len(device.Config) > 0 {
+		msgs = append(msgs, messaging.NewMessageBudget("device_config", deviceTopic(device.Name), 1,
+			messaging.ConfigPairsPayloadLen(device.Config), 1))
+	}
+
+	return messaging.AnalyzeBudget(device.Name, msgs, dailyBudget)
+}
+
+func query_int(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected non-negative integer, got %q", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/health"
+	"server_app/internal/jobs"
+	"server_app/internal/notify"
+	"server_app/internal/weather"
+	"time"
+)
+
+// Alerts to people over the notify channels (email, Telegram, Slack), as opposed to
+// notifications shown on the displays
+
+// How often alert conditions are checked
+const alertCheckInterval = 1 * time.Minute
+
+// Report offline devices and failing weather fetches to notify; its rules decide when
+// each channel is alerted
+func task_alerts() {
+	health.Register("alerts", alertCheckInterval)
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	started := time.Now()
+
+	for range ticker.C {
+		health.Beat("alerts")
+		check_device_alerts()
+		check_weather_alert(started)
+	}
+}
+
+func check_device_alerts() {
+	for _, device := range devices.GetAllDevices() {
+		if device.Pending {
+			continue
+		}
+		label := device.ID
+		if device.Name != "" && device.Name != device.ID {
+			label = fmt.Sprintf("%s (%s)", device.Name, device.ID)
+		}
+		if !device.Active && !device.OfflineSince.IsZero() {
+			notify.Condition(notify.DeviceOffline, device.ID, device.OfflineSince, "Device "+label+" is offline",
+				fmt.Sprintf("Offline since %s (%d minutes).", device.OfflineSince.Format(time.RFC1123), int(time.Since(device.OfflineSince)/time.Minute)))
+		} else {
+			notify.Clear(notify.DeviceOffline, device.ID, "Device "+label+" is offline", "The device is back online.")
+		}
+	}
+}
+
+// Weather is failing while fetches fail and none has succeeded since the given time
+func check_weather_alert(started time.Time) {
+	if server_idle() {
+		return // No fetches are made, so the last outcome is left as it was
+	}
+	fetch := weather.GetFetchStatus()
+	if fetch.ConsecutiveFailures == 0 {
+		notify.Clear(notify.WeatherFailing, "", "Weather API failing", "Weather fetches are succeeding again.")
+		return
+	}
+	since := fetch.LastSuccess
+	if since.IsZero() {
+		since = started
+	}
+	notify.Condition(notify.WeatherFailing, "", since, "Weather API failing",
+		fmt.Sprintf("%d consecutive fetch failures, last success %s.", fetch.ConsecutiveFailures, format_health_time(fetch.LastSuccess)))
+}
+
+// Resolve the alert conditions of a device that was removed; it won't be checked again
+func clear_device_alerts(deviceName string) {
+	notify.Clear(notify.DeviceOffline, deviceName, "Device "+deviceName+" is offline", "The device was removed.")
+}
+
+// Alert on OTA rollout jobs that failed with no attempts left, including rollouts that
+// reached some devices but not others
+func alert_job_finished(job jobs.Job) {
+	if job.Kind != "ota_rollout" || job.State != jobs.StateFailed {
+		return
+	}
+	notify.Fire(notify.OTAFailed, job.ID, "OTA rollout failed",
+		fmt.Sprintf("Job %s stopped after %d of %d devices (%d attempts): %s", job.ID, job.Done, job.Total, job.Attempts, job.Error))
+}
@@ -9,6 +9,13 @@ set PROJECT_NAME=server_app
 set TARGET_OS=linux
 set TARGET_ARCH=arm64
 
+REM Server version stamped into the binary (shown at startup and in /healthz)
+if "%VERSION%"=="" (
+    for /f %%v in ('git describe --tags --always --dirty 2^>nul') do set VERSION=%%v
+)
+if "%VERSION%"=="" set VERSION=dev
+set LDFLAGS=-X server_app/internal/buildinfo.Version=%VERSION%
+
 if "%1"=="" (
     set BUILD_TYPE=both
 ) else (
@@ -17,6 +24,7 @@ if "%1"=="" (
 
 echo === Connected Devices Server Build Script ===
 echo Target: %TARGET_OS%/%TARGET_ARCH%
+echo Version: %VERSION%
 echo.
 
 REM Clean previous builds
@@ -33,7 +41,7 @@ if "%BUILD_TYPE%"=="debug" (goto build_debug) else if "%BUILD_TYPE%"=="both" (go
 echo Building DEBUG version...
 set GOOS=%TARGET_OS%
 set GOARCH=%TARGET_ARCH%
-go build -tags debug -o "%PROJECT_NAME%_debug" -v
+go build -tags debug -ldflags "%LDFLAGS%" -o "%PROJECT_NAME%_debug" -v
 if errorlevel 1 (
     echo [FAILED] Debug build failed
     exit /b 1
@@ -50,7 +58,7 @@ if "%BUILD_TYPE%"=="debug" (goto end) else if "%BUILD_TYPE%"=="both" (
 
 set GOOS=%TARGET_OS%
 set GOARCH=%TARGET_ARCH%
-go build -o "%PROJECT_NAME%" -v
+go build -ldflags "%LDFLAGS%" -o "%PROJECT_NAME%" -v
 if errorlevel 1 (
     echo [FAILED] Production build failed
     exit /b 1
@@ -9,11 +9,16 @@ PROJECT_NAME="server_app"
 TARGET_OS="linux"
 TARGET_ARCH="arm64"
 
+# Server version stamped into the binary (shown at startup and in /healthz)
+VERSION="${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}"
+LDFLAGS="-X server_app/internal/buildinfo.Version=$VERSION"
+
 # Default to building both
 BUILD_TYPE="${1:-both}"
 
 echo "=== Connected Devices Server Build Script ==="
 echo "Target: $TARGET_OS/$TARGET_ARCH"
+echo "Version: $VERSION"
 echo ""
 
 # Clean previous builds
@@ -25,7 +30,7 @@ echo ""
 # Build Debug
 if [[ "$BUILD_TYPE" == "debug" || "$BUILD_TYPE" == "both" ]]; then
     echo "Building DEBUG version..."
-    GOOS=$TARGET_OS GOARCH=$TARGET_ARCH go build -tags debug -o "${PROJECT_NAME}_debug" -v
+    GOOS=$TARGET_OS GOARCH=$TARGET_ARCH go build -tags debug -ldflags "$LDFLAGS" -o "${PROJECT_NAME}_debug" -v
     chmod +x "${PROJECT_NAME}_debug"
     SIZE=$(ls -lh "${PROJECT_NAME}_debug" | awk '{print $5}')
     echo "✓ Debug build complete: ${PROJECT_NAME}_debug ($SIZE)"
@@ -35,7 +40,7 @@ fi
 # Build Production
 if [[ "$BUILD_TYPE" == "prod" || "$BUILD_TYPE" == "both" ]]; then
     echo "Building PRODUCTION version..."
-    GOOS=$TARGET_OS GOARCH=$TARGET_ARCH go build -o "${PROJECT_NAME}" -v
+    GOOS=$TARGET_OS GOARCH=$TARGET_ARCH go build -ldflags "$LDFLAGS" -o "${PROJECT_NAME}" -v
     chmod +x "${PROJECT_NAME}"
     SIZE=$(ls -lh "${PROJECT_NAME}" | awk '{print $5}')
     echo "✓ Production build complete: ${PROJECT_NAME} ($SIZE)"
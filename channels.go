@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/messaging"
+)
+
+// Capability advertised by firmware that takes a custom channel, e.g. "channel:plant"
+const capabilityChannelPrefix = "channel:"
+
+var (
+	errUnknownChannel     = errors.New("unknown channel")
+	errChannelUnsupported = errors.New("device does not take this channel")
+)
+
+// Validate values against a custom channel's schema and send them to a device
+// Topic: <device_name>, Message Type: 0x00 (MSG_GENERIC), QoS: 1
+func send_channel_data(deviceName string, channelName string, values map[string]interface{}) ([]byte, error) {
+	channel, exists := messaging.GetChannel(channelName)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errUnknownChannel, channelName)
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if !exists || devices.IsPending(deviceName) {
+		return nil, fmt.Errorf("%w: %s", devices.ErrUnknownDevice, deviceName)
+	}
+	if !device.Metadata.HasCapability(capabilityChannelPrefix + channelName) {
+		return nil, fmt.Errorf("%w: %s does not advertise %s%s", errChannelUnsupported, deviceName, capabilityChannelPrefix, channelName)
+	}
+	msg, err := messaging.EncodeChannel(channel, values)
+	if err != nil {
+		return nil, err
+	}
+	messaging.PublishWithPolicy(deviceTopic(deviceName), msg)
+	return msg, nil
+}
+
+// Send custom channel data to every active device taking the channel; returns those sent to
+func broadcast_channel_data(channelName string, values map[string]interface{}) ([]string, error) {
+	channel, exists := messaging.GetChannel(channelName)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errUnknownChannel, channelName)
+	}
+	msg, err := messaging.EncodeChannel(channel, values)
+	if err != nil {
+		return nil, err
+	}
+	sent := []string{}
+	for _, device := range devices.GetAllDevices() {
+		if !device.Active || devices.IsPending(device.ID) || !device.Metadata.HasCapability(capabilityChannelPrefix+channelName) {
+			continue
+		}
+		messaging.PublishWithPolicy(deviceTopic(device.ID), msg)
+		sent = append(sent, device.ID)
+	}
+	return sent, nil
+}
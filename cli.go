@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"server_app/internal/devices"
+	"server_app/internal/jobs"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Admin subcommands: operate the running server through its admin HTTP API, e.g.
+//
+//	server_app devices
+//	server_app weather 60607 --refresh
+//
+// The server is found at adminAddr from config.json unless --server is given. When the
+// admin interface requires sign-in, pass an API key with --key or CDS_API_KEY.
+
+// Environment variable holding the API key for admin subcommands
+const cliKeyEnv = "CDS_API_KEY"
+
+// How often ota --wait checks on the rollout job
+const cliJobPollInterval = 2 * time.Second
+
+// Connection to the running server's admin API
+type adminClient struct {
+	base string
+	key  string
+	http *http.Client
+}
+
+// Register --server and --key on flags; the returned function builds the client once parsed
+func admin_client_flags(flags *flag.FlagSet) func() adminClient {
+	configMutex.RLock()
+	adminAddr := runtimeConfig.AdminAddr
+	configMutex.RUnlock()
+	if strings.HasPrefix(adminAddr, ":") {
+		adminAddr = "127.0.0.1" + adminAddr
+	}
+
+	server := flags.String("server", "http://"+adminAddr, "admin API base URL of the running server")
+	key := flags.String("key", os.Getenv(cliKeyEnv), "API key when sign-in is required (default $"+cliKeyEnv+")")
+	return func() adminClient {
+		return adminClient{
+			base: strings.TrimSuffix(*server, "/"),
+			key:  *key,
+			http: &http.Client{Timeout: 60 * time.Second}, // Weather refreshes wait on the weather API
+		}
+	}
+}
+
+// call sends body (if any) as JSON and decodes the JSON response into out (if any)
+func (c adminClient) call(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("server not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", apiErr.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("%s %s: HTTP %d", method, path, resp.StatusCode)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Print v as indented JSON (--json)
+func print_json(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// devices [--json]: list known devices
+func command_devices(args []string) error {
+	flags := flag.NewFlagSet("devices", flag.ContinueOnError)
+	client := admin_client_flags(flags)
+	asJSON := flags.Bool("json", false, "print the full device records as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var list []devices.Device
+	if err := client().call(http.MethodGet, "/devices", nil, &list); err != nil {
+		return err
+	}
+	if *asJSON {
+		return print_json(list)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tZIPCODE\tSTATE\tLAST SEEN\tHARDWARE\tFIRMWARE")
+	for _, device := range list {
+		state := "offline"
+		switch {
+		case device.Pending:
+			state = "pending"
+		case device.Active:
+			state = "online"
+		}
+		lastSeen := "-"
+		if !device.LastSeen.IsZero() {
+			lastSeen = device.LastSeen.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", device.ID, device.Zipcode, state, lastSeen,
+			or_dash(device.Metadata.HardwareType), or_dash(device.Metadata.Firmware))
+	}
+	tw.Flush()
+	fmt.Printf("%d device(s)\n", len(list))
+	return nil
+}
+
+// weather <zipcode> [--refresh] [--json]: show the weather stored for a zipcode
+func command_weather(args []string) error {
+	flags := flag.NewFlagSet("weather", flag.ContinueOnError)
+	client := admin_client_flags(flags)
+	refresh := flags.Bool("refresh", false, "fetch the weather now and publish it to the zipcode's devices")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("weather needs a zipcode")
+	}
+	zipcode := flags.Arg(0)
+
+	var status WeatherStatus
+	method, path := http.MethodGet, "/weather/"+zipcode
+	if *refresh {
+		method, path = http.MethodPost, path+"/refresh"
+	}
+	if err := client().call(method, path, nil, &status); err != nil {
+		return err
+	}
+	if *asJSON {
+		return print_json(status)
+	}
+
+	if status.CurrentTemp != nil {
+		fmt.Printf("Current: %d°F %s (updated %s)\n", *status.CurrentTemp, status.Condition, or_dash(status.CurrentUpdated))
+		if status.Humidity > 0 {
+			fmt.Printf("Humidity: %d%%\n", status.Humidity)
+		}
+		if status.WindSpeed != nil {
+			fmt.Printf("Wind: %.0f mph %s\n", *status.WindSpeed, status.WindDir)
+		}
+	} else {
+		fmt.Println("Current: none stored")
+	}
+	if status.Untrusted {
+		fmt.Println("Note: stored while the server clock was not trusted")
+	}
+	if len(status.Forecast) == 0 {
+		fmt.Println("Forecast: none stored")
+		return nil
+	}
+	fmt.Printf("Forecast (updated %s):\n", or_dash(status.ForecastUpdated))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  DAY\tHIGH\tLOW\tPRECIP\tMOON")
+	for i, day := range status.Forecast {
+		fmt.Fprintf(tw, "  %d\t%d°F\t%d°F\t%d%%\t%d\n", i, day.HighTemp, day.LowTemp, day.Precip, day.Moon)
+	}
+	return tw.Flush()
+}
+
+// publish [--topic <topic>] [--hex] [--qos 0|1] [--retain] <message>: publish a test message
+func command_publish(args []string) error {
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	client := admin_client_flags(flags)
+	topic := flags.String("topic", "", "topic to publish to (default: the server's test topic)")
+	isHex := flags.Bool("hex", false, "message is hex-encoded bytes, e.g. 11030262 65")
+	qos := flags.Int("qos", 0, "MQTT QoS (0 or 1)")
+	retain := flags.Bool("retain", false, "publish as a retained message")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("publish needs a message")
+	}
+	if *qos != 0 && *qos != 1 {
+		return fmt.Errorf("--qos must be 0 or 1")
+	}
+
+	message := strings.Join(flags.Args(), " ")
+	body := map[string]interface{}{"topic": *topic, "qos": *qos, "retain": *retain}
+	if *isHex {
+		body["hex"] = message
+	} else {
+		body["text"] = message
+	}
+	var result struct {
+		Topic string `json:"topic"`
+		Bytes int    `json:"bytes"`
+	}
+	if err := client().call(http.MethodPost, "/mqtt/publish", body, &result); err != nil {
+		return err
+	}
+	fmt.Printf("Published %d bytes to %s\n", result.Bytes, result.Topic)
+	return nil
+}
+
+// canvas-clear: blank the shared canvas
+func command_canvas_clear(args []string) error {
+	flags := flag.NewFlagSet("canvas-clear", flag.ContinueOnError)
+	client := admin_client_flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := client().call(http.MethodPost, "/etchsketch/clear", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("Canvas cleared")
+	return nil
+}
+
+// ota [--devices a,b] [--hw-type <type>] [--interval 10s] [--wait]: start an OTA rollout job
+func command_ota(args []string) error {
+	flags := flag.NewFlagSet("ota", flag.ContinueOnError)
+	client := admin_client_flags(flags)
+	targets := flags.String("devices", "", "comma-separated devices (default: every active device)")
+	hardwareType := flags.String("hw-type", "", "only devices of this hardware type")
+	interval := flags.Duration("interval", 0, "pause between devices (default 10s)")
+	wait := flags.Bool("wait", false, "wait for the rollout to finish")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	params := map[string]string{}
+	if *targets != "" {
+		params["devices"] = *targets
+	}
+	if *hardwareType != "" {
+		params["hw_type"] = *hardwareType
+	}
+	if *interval > 0 {
+		params["interval"] = interval.String()
+	}
+	c := client()
+	var job jobs.Job
+	if err := c.call(http.MethodPost, "/jobs", JobRequest{Kind: "ota_rollout", Params: params}, &job); err != nil {
+		return err
+	}
+	fmt.Printf("Started OTA rollout job %s\n", job.ID)
+	if !*wait {
+		return nil
+	}
+
+	for !job.Finished() {
+		time.Sleep(cliJobPollInterval)
+		if err := c.call(http.MethodGet, "/jobs/"+job.ID, nil, &job); err != nil {
+			return err
+		}
+		if job.Total > 0 {
+			fmt.Printf("  %s: %d/%d devices\n", job.State, job.Done, job.Total)
+		}
+	}
+	if job.State != jobs.StateSucceeded {
+		return fmt.Errorf("rollout %s: %s", job.State, job.Error)
+	}
+	fmt.Println("Rollout finished")
+	return nil
+}
+
+func or_dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
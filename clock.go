@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/health"
+	"server_app/internal/timeline"
+	"server_app/internal/timesync"
+	"server_app/internal/weather"
+	"time"
+)
+
+// Wait for the server clock to be trusted, up to the configured timeout, then keep
+// watching it. Without a trusted clock the server still serves devices (degraded): weather
+// is stored flagged untrusted and refetched once the clock is right. Devices get no time
+// while the clock is known to be wrong, but do get the system time when the NTP server is
+// merely unreachable after the startup wait.
+func start_clock_sync() {
+	configMutex.RLock()
+	cfg := runtimeConfig.TimeSync
+	configMutex.RUnlock()
+	if err := timesync.Configure(cfg); err != nil {
+		fmt.Printf("Warning: invalid timeSync config, using defaults: %v\n", err)
+		timesync.Configure(timesync.Config{NTPServer: cfg.NTPServer})
+	}
+
+	timesync.Wait()
+	status := timesync.GetStatus()
+	weather.SetClockTrusted(status.Trusted)
+	set_clock_health(status)
+	timesync.OnChange(clock_changed)
+	if !status.Trusted && timesync.Usable() {
+		fmt.Println("NTP server unreachable; sending devices the system time")
+	}
+
+	health.Register("clock_monitor", 30*time.Second)
+	go timesync.Monitor(func() { health.Beat("clock_monitor") })
+}
+
+func clock_changed(status timesync.Status) {
+	weather.SetClockTrusted(status.Trusted)
+	set_clock_health(status)
+
+	if !status.LastJumpAt.IsZero() && time.Since(status.LastJumpAt) < time.Minute {
+		timeline.Record(timeline.TypeServer, "", "clock jumped",
+			map[string]interface{}{"jump_ms": status.LastJumpMs, "trusted": status.Trusted})
+	} else {
+		timeline.Record(timeline.TypeServer, "", clock_summary(status), nil)
+	}
+
+	// Devices were sent no time, or a wrong one
+	if status.Trusted {
+		for _, device := range devices.GetActiveDevices() {
+			publish_time(device.ID)
+		}
+	}
+}
+
+func set_clock_health(status timesync.Status) {
+	if status.Trusted {
+		health.Set("clock", health.StateOK, "")
+	} else {
+		health.Set("clock", health.StateDegraded, status.Reason)
+	}
+}
+
+func clock_summary(status timesync.Status) string {
+	if status.Trusted {
+		return "clock trusted (" + status.Source + ")"
+	}
+	return "clock not trusted: " + status.Reason
+}
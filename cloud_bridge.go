@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/bridge"
+	"server_app/internal/devices"
+	"strings"
+)
+
+// Mirror the topics listed in config.json to the cloud broker, if one is configured
+func start_cloud_bridge() {
+	configMutex.RLock()
+	cfg := runtimeConfig.Bridge
+	configMutex.RUnlock()
+	if !cfg.Enabled() {
+		return
+	}
+	bridge.SetProtectedTopics(bridge_protected_topic)
+	if err := bridge.Start(cfg); err != nil {
+		fmt.Printf("Warning: cloud bridge not started: %v\n", err)
+	}
+}
+
+// Local topics a cloud client must not publish to: everything the server handles or sends
+// devices (commands, config, OTA, weather, canvas), and every device's own topic
+func bridge_protected_topic(topic string) bool {
+	switch topic {
+	case TopicBootup, TopicHeartbeat, TopicOffline, TopicTelemetry, TopicTimeRequest,
+		TopicServerStatus, TopicServerPresence, TopicServerHealth, TopicControl,
+		TopicDeviceQuery, TopicDeviceStatus, TopicTest, TopicEtchSketch:
+		return true
+	}
+	for _, prefix := range []string{TopicWeatherPrefix, TopicReplyPrefix, TopicControl} {
+		if strings.HasPrefix(topic, prefix+"/") {
+			return true
+		}
+	}
+	for _, device := range devices.GetAllDevices() {
+		if topic == deviceTopic(device.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"server_app/internal/devices"
+	"server_app/internal/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage files (separate for debug/prod builds)
+type storagePaths struct {
+	Devices      string
+	Weather      string
+	Mood         string
+	Accounting   string
+	Jobs         string
+	Migration    string
+	Alerts       string
+	OfflineAlert string // Devices with an outstanding offline webhook alert
+	Firmware     string
+	PublishQueue string
+	Timeline     string
+	SQLite       string
+	Backups      string
+	StorageSalt  string // Salt for the storage encryption key
+	Lock         string // Held by the running server (see lock_data_dir)
+}
+
+func get_storage_paths() storagePaths {
+	if IsDebugBuild {
+		return storagePaths{
+			Devices:      "./data/devices_debug.json",
+			Weather:      "./data/weather_debug.json",
+			Mood:         "./data/weather_mood_debug.json",
+			Accounting:   "./data/accounting_debug.json",
+			Jobs:         "./data/jobs_debug.json",
+			Migration:    "./data/topic_migration_debug.json",
+			Alerts:       "./data/alerts_debug.json",
+			OfflineAlert: "./data/offline_alerts_debug.json",
+			Firmware:     "./data/firmware_debug.json",
+			PublishQueue: "./data/publish_queue_debug.json",
+			Timeline:     "./data/timeline_debug.jsonl",
+			SQLite:       "./data/storage_debug.db",
+			Backups:      "./data/backups_debug",
+			StorageSalt:  "./data/storage_salt_debug",
+			Lock:         "./data/server_debug.lock",
+		}
+	}
+	return storagePaths{
+		Devices:      "./data/devices.json",
+		Weather:      "./data/weather.json",
+		Mood:         "./data/weather_mood.json",
+		Accounting:   "./data/accounting.json",
+		Jobs:         "./data/jobs.json",
+		Migration:    "./data/topic_migration.json",
+		Alerts:       "./data/alerts.json",
+		OfflineAlert: "./data/offline_alerts.json",
+		Firmware:     "./data/firmware.json",
+		PublishQueue: "./data/publish_queue.json",
+		Timeline:     "./data/timeline.jsonl",
+		SQLite:       "./data/storage.db",
+		Backups:      "./data/backups",
+		StorageSalt:  "./data/storage_salt",
+		Lock:         "./data/server.lock",
+	}
+}
+
+// Stores by the name they have in exports (the same for debug and production builds)
+func (p storagePaths) stores() map[string]string {
+	return map[string]string{
+		"devices":         p.Devices,
+		"weather":         p.Weather,
+		"weather_mood":    p.Mood,
+		"accounting":      p.Accounting,
+		"jobs":            p.Jobs,
+		"topic_migration": p.Migration,
+		"alerts":          p.Alerts,
+		"offline_alerts":  p.OfflineAlert,
+		"firmware":        p.Firmware,
+		"publish_queue":   p.PublishQueue,
+	}
+}
+
+// Apply the storage settings from config.json to every store opened afterwards. SQLite
+// keeps them all in one database and imports the JSON files on first use; memory (and
+// --dry-run) starts from the JSON files and writes nothing.
+// Returns whether SQLite is in use.
+func open_storage_backend(paths storagePaths) bool {
+	configMutex.RLock()
+	storageBackend := runtimeConfig.StorageBackend
+	flushSeconds, flushChanges := runtimeConfig.StorageFlushSeconds, runtimeConfig.StorageFlushChanges
+	keyFile := runtimeConfig.StorageKeyFile
+	configMutex.RUnlock()
+	storage.SetWriteCoalescing(time.Duration(flushSeconds)*time.Second, flushChanges)
+	storage.SetBackupDir(paths.Backups) // Searched for intact copies of corrupt storage files
+	inMemory := dryRun || storageBackend == "memory"
+	saltFile := paths.StorageSalt
+	if inMemory {
+		saltFile = "" // Nothing is written, so a salt for this run only
+	}
+	configure_storage_encryption(keyFile, saltFile)
+	if inMemory {
+		storage.UseMemory()
+		return false
+	}
+	stores := make([]string, 0, len(paths.stores()))
+	for _, path := range paths.stores() {
+		stores = append(stores, path)
+	}
+	storage.EncryptCopies(stores) // Backups and .corrupt copies from before the key was set
+	if storageBackend != "sqlite" {
+		return false
+	}
+	if err := storage.UseSQLite(paths.SQLite); err != nil {
+		fmt.Printf("Warning: failed to open SQLite storage: %v (using JSON files)\n", err)
+		return false
+	}
+	if storage.Encrypting() {
+		fmt.Println("Note: storage encryption covers JSON files only, not the SQLite database")
+	}
+	return true
+}
+
+// Environment variable holding the storage encryption key
+const storageKeyEnv = "CDS_STORAGE_KEY"
+
+// Shortest storage key accepted without a warning
+const minStorageKeyLen = 16
+
+// Set the storage encryption key from the environment or the key file, salted from
+// saltFile ("" = a salt for this run only). Without a readable key, encrypted files stay
+// locked (never overwritten) rather than being replaced.
+func configure_storage_encryption(keyFile string, saltFile string) {
+	secret := []byte(strings.TrimSpace(os.Getenv(storageKeyEnv)))
+	source := storageKeyEnv
+	if len(secret) == 0 && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			fmt.Printf("ERROR: failed to read storage key: %v (encrypted storage files stay locked)\n", err)
+			return
+		}
+		secret, source = bytes.TrimSpace(data), keyFile
+	}
+	if len(secret) == 0 {
+		return
+	}
+	if len(secret) < minStorageKeyLen {
+		fmt.Printf("Warning: storage key from %s is only %d characters; use a random one of %d or more\n", source, len(secret), minStorageKeyLen)
+	}
+	if err := storage.SetEncryptionKey(secret, saltFile); err != nil {
+		fmt.Printf("ERROR: failed to set storage key: %v\n", err)
+		return
+	}
+	fmt.Printf("Storage encryption enabled (key from %s)\n", source)
+}
+
+// Set by --dry-run: serve as usual but keep storage in memory and write nothing to ./data
+var dryRun bool
+
+// Subcommands run instead of the server, e.g. `server_app export --out backup.json`;
+// the admin subcommands (cli.go) talk to a running server instead
+// Returns the exit code.
+func run_command(args []string) int {
+	var err error
+	switch args[0] {
+	case "export":
+		err = command_export(args[1:])
+	case "import":
+		err = command_import(args[1:])
+	case "devices":
+		err = command_devices(args[1:])
+	case "weather":
+		err = command_weather(args[1:])
+	case "publish":
+		err = command_publish(args[1:])
+	case "canvas-clear":
+		err = command_canvas_clear(args[1:])
+	case "ota":
+		err = command_ota(args[1:])
+	default:
+		fmt.Printf("Unknown command %q (commands: export, import, devices, weather, publish, canvas-clear, ota)\n", args[0])
+		return 2
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("%s failed: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// export --out <file>: write every store to one versioned file
+func command_export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "file to write the export to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("export needs --out <file>")
+	}
+	release, err := check_server_stopped()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	paths := get_storage_paths()
+	open_storage_backend(paths)
+	// Fold device events logged since the last snapshot into it, as on shutdown
+	if err := devices.InitStorage(paths.Devices); err != nil {
+		return fmt.Errorf("failed to load devices: %v", err)
+	}
+	if err := devices.Checkpoint(); err != nil {
+		return err
+	}
+
+	export := storage.Export{Build: build_name(), Stores: make(map[string]map[string]json.RawMessage)}
+	keys := 0
+	for name, path := range paths.stores() {
+		store, err := storage.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", name, err)
+		}
+		dump, err := store.Dump()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		export.Stores[name] = dump
+		keys += len(dump)
+	}
+	if err := storage.WriteExport(*out, export); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d keys from %d stores to %s\n", keys, len(export.Stores), *out)
+	return nil
+}
+
+// import --in <file> [--force]: replace the stores in an export with its contents
+func command_import(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := flags.String("in", "", "export file to restore")
+	force := flags.Bool("force", false, "replace stores that already hold data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("import needs --in <file>")
+	}
+	export, err := storage.ReadExport(*in)
+	if err != nil {
+		return err
+	}
+	release, err := check_server_stopped()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if export.Build != "" && export.Build != build_name() {
+		fmt.Printf("Note: importing a %s build export into a %s build\n", export.Build, build_name())
+	}
+
+	paths := get_storage_paths()
+	open_storage_backend(paths)
+	if storage.InMemory() {
+		return fmt.Errorf("storageBackend is \"memory\", nothing would be written")
+	}
+	stores := paths.stores()
+
+	// Check every store before changing any
+	targets := make(map[string]*storage.Manager)
+	var names, occupied []string
+	for name := range export.Stores {
+		path, known := stores[name]
+		if !known {
+			fmt.Printf("Warning: skipping unknown store %s\n", name)
+			continue
+		}
+		store, err := storage.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", name, err)
+		}
+		targets[name] = store
+		names = append(names, name)
+		if len(store.GetAll()) > 0 {
+			occupied = append(occupied, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(occupied)
+	if len(occupied) > 0 && !*force {
+		return fmt.Errorf("stores already hold data: %s (use --force to replace them)", strings.Join(occupied, ", "))
+	}
+
+	for _, name := range names {
+		dump := export.Stores[name]
+		if name == "devices" {
+			if err := devices.PrepareImport(paths.Devices, dump); err != nil {
+				return err
+			}
+		}
+		if err := targets[name].Restore(dump); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+		fmt.Printf("Imported %s: %d keys\n", name, len(dump))
+	}
+	fmt.Printf("Imported %s (exported %s)\n", *in, export.Created.Format(time.RFC3339))
+	return nil
+}
+
+// The data directory is locked by a running server
+var errDataDirLocked = errors.New("data directory is locked by a running server")
+
+// Releases the running server's data directory lock; kept so the lock file stays open
+var dataDirUnlock func()
+
+// Refuse to touch storage files a running server would overwrite. The data directory lock
+// is held until release is called, so a server can't start while the command runs.
+func check_server_stopped() (func(), error) {
+	release, err := lock_data_dir(get_storage_paths().Lock)
+	if errors.Is(err, errDataDirLocked) {
+		return nil, fmt.Errorf("a server is using the data directory; stop it first")
+	}
+	return release, err
+}
+
+func build_name() string {
+	if IsDebugBuild {
+		return "debug"
+	}
+	return "production"
+}
@@ -5,11 +5,20 @@ package main
 
 // Debug configuration - prefixes topics to avoid interfering with production
 const (
-	TopicBootup        = "debug_dev_bootup"
-	TopicHeartbeat     = "debug_dev_heartbeat"
-	TopicOffline       = "debug_device_offline"
-	TopicTest          = "debug_test_msg"
-	TopicWeatherPrefix = "debug_weather"
+	TopicBootup         = "debug_dev_bootup"
+	TopicHeartbeat      = "debug_dev_heartbeat"
+	TopicOffline        = "debug_device_offline"
+	TopicTelemetry      = "debug_dev_telemetry"
+	TopicTimeRequest    = "debug_dev_time"
+	TopicServerStatus   = "debug_server_status"          // Broadcasts to all devices (e.g. planned shutdown)
+	TopicServerPresence = "debug_server/status"          // Retained "online"/"offline" (Last Will)
+	TopicServerHealth   = "debug_server/health"          // Retained JSON composite health
+	TopicControl        = "debug_server_control"         // Admin commands (text)
+	TopicDeviceQuery    = "debug_server_control/query"   // Device ID or "all"; answered on TopicDeviceStatus
+	TopicDeviceStatus   = "debug_server_control/devices" // JSON device status reports
+	TopicTest           = "debug_test_msg"
+	TopicWeatherPrefix  = "debug_weather"
+	TopicReplyPrefix    = "debug_dev_reply" // Device outbox: <prefix>/<device_name>
 	// Etch Sketch shared canvas topic (debug isolated)
 	TopicEtchSketch = "debug_etch_sketch"
 	IsDebugBuild    = true
@@ -19,4 +28,31 @@ const (
 	WeatherValidityPeriod  = 35  // Consider weather valid if updated within 35 minutes
 	ForecastUpdateInterval = 360 // Fetch forecast every 6 hours (12 * 30min)
 	ForecastValidityPeriod = 370 // Consider forecast valid if updated within ~6 hours
+
+	// Degraded weather: serve cached data up to these ages (flagged stale) before trying nearby zipcodes
+	WeatherStaleLimit        = 180  // Current weather up to 3 hours old
+	ForecastStaleLimit       = 1440 // Forecast up to a day old
+	WeatherNeighborRadiusKm  = 40.0 // Nearby zipcodes considered for substitute data
+	InterpolatedTempInterval = 1    // Interpolated temperature for opted-in devices every minute
+	WeatherWarmupWindow      = 1440 // On startup, refresh expired weather for devices seen in the last day
+
+	// Device persistence timing (in minutes)
+	DeviceCheckpointInterval = 5 // Summarize heartbeats and snapshot device state every 5 minutes
+
+	// Household summary timing (in minutes)
+	HouseholdSummaryInterval = 5  // Publish household summary to hub displays every 5 minutes
+	HouseholdReadingMaxAge   = 30 // Ignore telemetry older than 30 minutes in the summary
+
+	// Holiday theming timing (in minutes)
+	HolidayCheckInterval = 1 // Check for a holiday theme change every minute
+
+	// Clock timing
+	DSTCheckInterval   = 1  // Look for upcoming DST changes every minute (minutes)
+	DSTNoticeLookahead = 24 // Notify devices this many hours before their offset changes
+
+	// MQTT client certificate rotation (in minutes)
+	CertWatchInterval = 1 // Check the client certificate files for changes every minute
+
+	// Config push timing (in minutes)
+	ConfigReconcileInterval = 10 // Full config reconciliation for every device every 10 minutes
 )
@@ -5,11 +5,20 @@ package main
 
 // Production configuration
 const (
-	TopicBootup        = "dev_bootup"
-	TopicHeartbeat     = "dev_heartbeat"
-	TopicOffline       = "device_offline"
-	TopicTest          = "test_msg"
-	TopicWeatherPrefix = "weather"
+	TopicBootup         = "dev_bootup"
+	TopicHeartbeat      = "dev_heartbeat"
+	TopicOffline        = "device_offline"
+	TopicTelemetry      = "dev_telemetry"
+	TopicTimeRequest    = "dev_time"
+	TopicServerStatus   = "server_status"          // Broadcasts to all devices (e.g. planned shutdown)
+	TopicServerPresence = "server/status"          // Retained "online"/"offline" (Last Will)
+	TopicServerHealth   = "server/health"          // Retained JSON composite health
+	TopicControl        = "server_control"         // Admin commands (text)
+	TopicDeviceQuery    = "server_control/query"   // Device ID or "all"; answered on TopicDeviceStatus
+	TopicDeviceStatus   = "server_control/devices" // JSON device status reports
+	TopicTest           = "test_msg"
+	TopicWeatherPrefix  = "weather"
+	TopicReplyPrefix    = "dev_reply" // Device outbox: <prefix>/<device_name>
 	// Etch Sketch shared canvas topic
 	TopicEtchSketch = "etch_sketch"
 	IsDebugBuild    = false
@@ -19,4 +28,31 @@ const (
 	WeatherValidityPeriod  = 35  // Consider weather valid if updated within 35 minutes
 	ForecastUpdateInterval = 360 // Fetch forecast every 6 hours (12 * 30min)
 	ForecastValidityPeriod = 370 // Consider forecast valid if updated within ~6 hours
+
+	// Degraded weather: serve cached data up to these ages (flagged stale) before trying nearby zipcodes
+	WeatherStaleLimit        = 180  // Current weather up to 3 hours old
+	ForecastStaleLimit       = 1440 // Forecast up to a day old
+	WeatherNeighborRadiusKm  = 40.0 // Nearby zipcodes considered for substitute data
+	InterpolatedTempInterval = 5    // Interpolated temperature for opted-in devices every 5 minutes
+	WeatherWarmupWindow      = 1440 // On startup, refresh expired weather for devices seen in the last day
+
+	// Device persistence timing (in minutes)
+	DeviceCheckpointInterval = 5 // Summarize heartbeats and snapshot device state every 5 minutes
+
+	// Household summary timing (in minutes)
+	HouseholdSummaryInterval = 5  // Publish household summary to hub displays every 5 minutes
+	HouseholdReadingMaxAge   = 30 // Ignore telemetry older than 30 minutes in the summary
+
+	// Holiday theming timing (in minutes)
+	HolidayCheckInterval = 15 // Check for a holiday theme change every 15 minutes
+
+	// Clock timing
+	DSTCheckInterval   = 60 // Look for upcoming DST changes every hour (minutes)
+	DSTNoticeLookahead = 24 // Notify devices this many hours before their offset changes
+
+	// MQTT client certificate rotation (in minutes)
+	CertWatchInterval = 1 // Check the client certificate files for changes every minute
+
+	// Config push timing (in minutes)
+	ConfigReconcileInterval = 1440 // Full config reconciliation for every device once a day
 )
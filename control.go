@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/capture"
+	"server_app/internal/devices"
+	"server_app/internal/faults"
+	"strings"
+)
+
+// Handle text admin commands published to the control topic
+// Format: "<command> [args...]", e.g. "fault publish_drop=30 storage_delay=2s"
+func handle_control_message(payload []byte) {
+	fields := strings.Fields(string(payload))
+	if len(fields) == 0 {
+		fmt.Println("Control: empty command")
+		return
+	}
+
+	command, args := fields[0], fields[1:]
+	fmt.Printf("Control command: %s %v\n", command, args)
+
+	switch command {
+	case "fault":
+		handle_fault_command(args)
+	case "capture":
+		handle_capture_command(args)
+	case "rebuild_devices":
+		if _, err := devices.RebuildProjection(); err != nil {
+			fmt.Printf("Control: %v\n", err)
+		}
+	default:
+		fmt.Printf("Control: unknown command %q\n", command)
+	}
+}
+
+// capture                    show capture status
+// capture on [filter]        capture MQTT traffic matching filter (default configured/"#")
+// capture off                stop capturing
+func handle_capture_command(args []string) {
+	// Subscribing waits for the broker, which can't answer while this MQTT handler runs
+	switch {
+	case len(args) == 0:
+		fmt.Printf("MQTT capture: %+v\n", capture.GetStatus())
+	case args[0] == "on" && len(args) <= 2:
+		filter := ""
+		if len(args) == 2 {
+			filter = args[1]
+		}
+		go func() {
+			if err := capture.Start(filter); err != nil {
+				fmt.Printf("Control: %v\n", err)
+			}
+		}()
+	case args[0] == "off" && len(args) == 1:
+		go capture.Stop()
+	default:
+		fmt.Printf("Control: usage: capture [on [filter]|off]\n")
+	}
+}
+
+// fault                      show active faults
+// fault reset                clear all faults
+// fault key=value [...]      set publish_drop=<pct>, storage_delay=<duration>, weather_500=<pct>
+func handle_fault_command(args []string) {
+	if !faults.Enabled {
+		fmt.Printf("Control: %v\n", faults.ErrDisabled)
+		return
+	}
+
+	if len(args) == 0 {
+		fmt.Printf("Active faults: %+v\n", faults.Get())
+		return
+	}
+	if len(args) == 1 && args[0] == "reset" {
+		faults.Reset()
+		fmt.Println("Fault injection reset")
+		return
+	}
+
+	settings, err := faults.Parse(faults.Get(), args)
+	if err != nil {
+		fmt.Printf("Control: %v\n", err)
+		return
+	}
+	if err := faults.Set(settings); err != nil {
+		fmt.Printf("Control: %v\n", err)
+	}
+}
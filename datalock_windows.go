@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ERROR_SHARING_VIOLATION: another process has the file open
+const errorSharingViolation syscall.Errno = 32
+
+// Take the exclusive lock on the data directory (see storagePaths.Lock): the file is opened
+// without sharing, so a second open fails until the process holding it exits
+func lock_data_dir(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, errDataDirLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() { syscall.CloseHandle(h) }, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"server_app/internal/devices"
+	"server_app/internal/messaging"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device status over MQTT, for systems already on the broker that shouldn't need the admin
+// API. Publishing a device ID to TopicDeviceQuery gets its JSON report on TopicDeviceStatus;
+// publishing "all" gets an array of every device's report there. Both topics sit under
+// TopicControl, so the broker ACL that guards admin commands guards device locations and
+// firmware too.
+
+// Device IDs a query may name; anything else is ignored rather than echoed back
+var deviceQueryID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Device status as reported over MQTT
+type DeviceStatusReport struct {
+	ID             string    `json:"id"`
+	Found          bool      `json:"found"`
+	Active         bool      `json:"active"`
+	Pending        bool      `json:"pending,omitempty"`
+	LastSeen       time.Time `json:"last_seen,omitempty"`
+	Zipcode        string    `json:"zipcode,omitempty"`
+	HardwareType   string    `json:"hw_type,omitempty"`
+	Firmware       string    `json:"firmware,omitempty"`        // As reported at bootup
+	LatestFirmware uint16    `json:"latest_firmware,omitempty"` // Offered to the device's hardware type
+}
+
+// Answer a status query: [device ID | "all"] as text
+func handle_device_query(payload []byte) {
+	query := strings.TrimSpace(string(payload))
+	if query != "all" && !deviceQueryID.MatchString(query) {
+		fmt.Printf("Ignoring device status query %q\n", query)
+		return
+	}
+
+	var data []byte
+	var err error
+	if query == "all" {
+		all := devices.GetAllDevices()
+		sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+		reports := make([]DeviceStatusReport, 0, len(all))
+		for _, device := range all {
+			reports = append(reports, device_status_report(&device))
+		}
+		data, err = json.Marshal(reports)
+	} else {
+		device, _ := devices.GetDevice(query)
+		report := device_status_report(device)
+		report.ID = query
+		data, err = json.Marshal(report)
+	}
+	if err != nil {
+		fmt.Printf("Error encoding device status: %v\n", err)
+		return
+	}
+	// QoS 0: waiting for an acknowledgement here would hold up other incoming messages
+	messaging.PublishQoS0(TopicDeviceStatus, data)
+}
+
+// Status report for a device (nil = unknown)
+func device_status_report(device *devices.Device) DeviceStatusReport {
+	if device == nil {
+		return DeviceStatusReport{}
+	}
+	return DeviceStatusReport{
+		ID:             device.ID,
+		Found:          true,
+		Active:         device.Active,
+		Pending:        device.Pending,
+		LastSeen:       device.LastSeen,
+		Zipcode:        device.Zipcode,
+		HardwareType:   device.Metadata.HardwareType,
+		Firmware:       device.Metadata.Firmware,
+		LatestFirmware: device_firmware_version(device.ID),
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"server_app/internal/display"
+	"server_app/internal/etchsketch"
+	"server_app/internal/health"
+	"time"
+)
+
+// How often the image drop directory is checked for new files
+const displayDropInterval = 5 * time.Second
+
+// Errors from push_display_image for images that can't be shown as requested
+var (
+	ErrImageBlocked      = errors.New("image produces blocked content")
+	ErrPaletteCanvasSize = errors.New("16-color images need a 16x16 canvas")
+)
+
+// How an image is reduced for the matrices
+type DisplayOptions struct {
+	Colors int  // 8 (channel colors, any canvas size) or 16 (palette, 16x16 canvas only)
+	Dither bool // Floyd-Steinberg error diffusion instead of nearest color
+}
+
+// Scale and dither an image to the shared canvas and broadcast it like a device drawing
+func push_display_image(source string, img image.Image, opts DisplayOptions) error {
+	if etchsketchManager == nil {
+		return fmt.Errorf("etchsketch not initialized")
+	}
+	canvas, _ := etchsketchManager.GetFrame()
+	var applied bool
+	var err error
+	if opts.Colors == etchsketch.PaletteSize {
+		if canvas.Width != 16 || canvas.Height != 16 {
+			return fmt.Errorf("%w (canvas is %dx%d)", ErrPaletteCanvasSize, canvas.Width, canvas.Height)
+		}
+		applied, err = apply_palette_frame(source, display.ToPaletteFrame(img, opts.Dither))
+	} else {
+		applied, err = apply_canvas_frame(source, display.ToFrame(img, canvas.Width, canvas.Height, opts.Dither))
+	}
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrImageBlocked
+	}
+	fmt.Printf("Display: pushed image from %s (%dx%d, %d colors)\n", source, canvas.Width, canvas.Height, opts.Colors)
+	return nil
+}
+
+// Push images dropped into the displayDropDir directory, dithered to 8 colors
+func task_display_drop(dir string) {
+	health.Register("display_drop", displayDropInterval)
+	ticker := time.NewTicker(displayDropInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("display_drop")
+		_, err := display.ScanDir(dir, func(name string, img image.Image) error {
+			return push_display_image("file "+name, img, DisplayOptions{Colors: 8, Dither: true})
+		})
+		if err != nil {
+			fmt.Printf("Display: failed to scan %s: %v\n", dir, err)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/etchsketch"
+	"server_app/internal/messaging"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device emulation: what a device should be showing, rebuilt by decoding the messages the
+// server sent on the topics the device listens to, in the order they went out. When a
+// physical display differs from its emulated view the firmware is at fault; when the view
+// is already wrong the server is.
+
+// DeviceView is the emulated state of a device's display
+type DeviceView struct {
+	Device       string             `json:"device"`
+	Online       bool               `json:"online"`
+	Topics       []string           `json:"topics"`
+	Weather      *ViewWeather       `json:"weather,omitempty"`
+	Forecast     *ViewForecast      `json:"forecast,omitempty"`
+	Config       map[string]string  `json:"config,omitempty"` // As last sent (full config plus deltas)
+	Indicators   map[string]bool    `json:"indicators,omitempty"`
+	Household    *ViewHousehold     `json:"household,omitempty"`
+	Mood         *ViewMood          `json:"mood,omitempty"`
+	Notification *ViewNotification  `json:"notification,omitempty"` // Only while it is showing
+	Screen       *ViewScreen        `json:"screen,omitempty"`
+	Canvas       *ViewCanvas        `json:"canvas,omitempty"`
+	Clock        *ViewClock         `json:"clock,omitempty"`
+	Version      *uint16            `json:"offered_version,omitempty"` // Firmware version last offered (0x10)
+	Shutdown     *time.Time         `json:"server_back_at,omitempty"`  // Announced downtime still running
+	QuietUntil   *time.Time         `json:"quiet_until,omitempty"`     // In quiet hours: shared weather and canvas updates ignored
+	Channels     map[string]ViewRaw `json:"channels,omitempty"`        // Latest custom channel data by channel
+	Messages     []ViewMessage      `json:"messages"`                  // Everything decoded, oldest first
+}
+
+type ViewWeather struct {
+	Temp        int8      `json:"temp"`
+	Condition   string    `json:"condition,omitempty"` // From 0x2E messages
+	Humidity    *uint8    `json:"humidity,omitempty"`  // From 0x2E messages, when reported
+	Wind        string    `json:"wind,omitempty"`      // From 0x2E messages, when reported, e.g. "12 mph NW"
+	Flags       uint8     `json:"flags,omitempty"`
+	Unavailable bool      `json:"unavailable,omitempty"` // Shows a dash
+	At          time.Time `json:"at"`
+}
+
+type ViewForecast struct {
+	Days        []ViewForecastDay `json:"days"`
+	Flags       uint8             `json:"flags,omitempty"`
+	Unavailable bool              `json:"unavailable,omitempty"`
+	At          time.Time         `json:"at"`
+}
+
+// Field names as in messaging.ForecastDay
+type ViewForecastDay struct {
+	HighTemp int8
+	LowTemp  *int8 `json:",omitempty"` // From 0x2F messages
+	Precip   uint8
+	Moon     uint8
+}
+
+type ViewHousehold struct {
+	messaging.HouseholdSummary
+	At time.Time `json:"at"`
+}
+
+type ViewMood struct {
+	messaging.WeatherMood
+	At time.Time `json:"at"`
+}
+
+type ViewNotification struct {
+	Text     string    `json:"text"`
+	Priority uint8     `json:"priority"`
+	Until    time.Time `json:"until"`
+}
+
+// ViewScreen is the last complete e-paper screen
+type ViewScreen struct {
+	ID     uint16    `json:"id"`
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	At     time.Time `json:"at"`
+	bitmap []byte
+}
+
+// ViewCanvas is the canvas as the device last received it. Format says which message it came
+// from: "frame" (shared 0x21, top-left 16x16 only), "chunks" (shared 0x29 whole frame),
+// "calibrated" (0x22), "palette" (0x27), "rle" (0x2C) or "server" when nothing was sent.
+type ViewCanvas struct {
+	Seq        uint16     `json:"seq"`
+	Format     string     `json:"format"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Calibrated bool       `json:"calibrated"` // Per-device corrected frame rather than the shared one
+	Levels     []uint8    `json:"levels,omitempty"`
+	Palette    []string   `json:"palette,omitempty"` // Palette indexes as hex digits, for palette frames
+	Art        []string   `json:"art"`
+	At         *time.Time `json:"at,omitempty"` // Unset when nothing was sent and the server's frame is shown
+}
+
+// personal reports whether the canvas came on the device's own topic; shared frames do not
+// replace it, the server sends the device its own copy of every change
+func (c *ViewCanvas) personal() bool {
+	return c != nil && (c.Format == "calibrated" || c.Format == "palette" || c.Format == "rle")
+}
+
+type ViewClock struct {
+	Time        time.Time  `json:"time"` // Last time sync, as sent
+	At          time.Time  `json:"at"`
+	ChangeAt    *time.Time `json:"change_at,omitempty"` // Announced UTC offset change
+	ChangeNotes string     `json:"change_notes,omitempty"`
+}
+
+type ViewRaw struct {
+	Values map[string]interface{} `json:"values"`
+	At     time.Time              `json:"at"`
+}
+
+type ViewMessage struct {
+	At          time.Time `json:"at"`
+	Topic       string    `json:"topic"`
+	Description string    `json:"description"`
+}
+
+// Topics a device listens to
+func device_view_topics(device *devices.Device) []string {
+	topics := []string{deviceTopic(device.Name), TopicServerStatus}
+	if device.Zipcode != "" {
+		topics = append(topics, TopicWeatherPrefix+"/"+device.Zipcode)
+	}
+	if etchsketchTopic != "" {
+		topics = append(topics, etchsketchTopic)
+	}
+	return topics
+}
+
+// Rebuild a device's display from the messages sent to it
+func emulate_device(device *devices.Device) DeviceView {
+	now := time.Now()
+	view := DeviceView{Device: device.Name, Online: device.Active, Topics: device_view_topics(device), Messages: []ViewMessage{}}
+
+	var sent []messaging.SentMessage
+	for _, topic := range view.Topics {
+		sent = append(sent, messaging.Sent(topic)...)
+	}
+	sort.SliceStable(sent, func(i, j int) bool { return sent[i].At.Before(sent[j].At) })
+
+	screens := make(map[uint16]map[uint8][]byte) // Chunks of screens still arriving
+	var frames etchsketch.FrameAssembler         // Chunks of large canvas frames still arriving
+	for _, m := range sent {
+		data := m.Data
+		if len(data) == 0 {
+			view.Messages = append(view.Messages, ViewMessage{At: m.At, Topic: m.Topic, Description: "retained message cleared"})
+			continue
+		}
+		if data[0] == messaging.MSG_ENCRYPTED {
+			if _, payload, err := messaging.DecodeMessage(data); err == nil {
+				if opened, err := devices.DecryptFrom(device.Name, payload); err == nil {
+					data = opened
+				}
+			}
+		}
+		view.Messages = append(view.Messages, ViewMessage{At: m.At, Topic: m.Topic, Description: messaging.Describe(data)})
+		msgType, payload, err := messaging.DecodeMessage(data)
+		if err != nil {
+			continue
+		}
+		if view.QuietUntil != nil && m.Topic != deviceTopic(device.Name) && m.Topic != TopicServerStatus {
+			continue // Ignored until the server catches the device up on its own topic
+		}
+		view.apply(m, msgType, payload, screens, &frames)
+	}
+
+	if view.Notification != nil && now.After(view.Notification.Until) {
+		view.Notification = nil
+	}
+	if view.Shutdown != nil && now.After(*view.Shutdown) {
+		view.Shutdown = nil
+	}
+	// Devices draw on the shared canvas themselves; when no frame was sent (or it fell out of
+	// the history) they show the server's current frame
+	if view.Canvas == nil && etchsketchManager != nil {
+		f, seq := etchsketchManager.GetFrame()
+		view.Canvas = &ViewCanvas{Seq: seq, Format: "server", Width: f.Width, Height: f.Height, Art: etchsketch.FormatFrameArt(f)}
+	}
+	return view
+}
+
+// apply updates the view with one decoded message; decode errors are already in Messages.
+// Config reads (0x19) only ask the device for its config and change nothing on the display.
+func (view *DeviceView) apply(m messaging.SentMessage, msgType uint8, payload []byte, screens map[uint16]map[uint8][]byte, frames *etchsketch.FrameAssembler) {
+	switch msgType {
+	case messaging.MSG_CURRENT_WEATHER:
+		if temp, flags, err := messaging.DecodeCurrentWeather(payload); err == nil {
+			view.Weather = &ViewWeather{Temp: temp, Flags: flags, At: m.At}
+		}
+	case messaging.MSG_CURRENT_WEATHER_V2:
+		if w, flags, err := messaging.DecodeCurrentWeatherV2(payload); err == nil {
+			view.Weather = &ViewWeather{Temp: w.Temp, Condition: messaging.ConditionName(w.Condition), Flags: flags, At: m.At}
+			if w.Humidity != messaging.WEATHER_READING_UNKNOWN {
+				view.Weather.Humidity = &w.Humidity
+			}
+			if w.WindSpeed != messaging.WEATHER_READING_UNKNOWN {
+				view.Weather.Wind = fmt.Sprintf("%d mph %s", w.WindSpeed, messaging.CompassName(w.WindDir))
+			}
+		}
+	case messaging.MSG_FORECAST_WEATHER:
+		if days, flags, err := messaging.DecodeForecast(payload); err == nil {
+			view.Forecast = &ViewForecast{Days: make([]ViewForecastDay, len(days)), Flags: flags, At: m.At}
+			for i, d := range days {
+				view.Forecast.Days[i] = ViewForecastDay{HighTemp: d.HighTemp, Precip: d.Precip, Moon: d.Moon}
+			}
+		}
+	case messaging.MSG_FORECAST_WEATHER_V2:
+		if days, flags, err := messaging.DecodeForecastV2(payload); err == nil {
+			view.Forecast = &ViewForecast{Days: make([]ViewForecastDay, len(days)), Flags: flags, At: m.At}
+			for i, d := range days {
+				low := d.LowTemp
+				view.Forecast.Days[i] = ViewForecastDay{HighTemp: d.HighTemp, LowTemp: &low, Precip: d.Precip, Moon: d.Moon}
+			}
+		}
+	case messaging.MSG_WEATHER_UNAVAILABLE:
+		weatherType, err := messaging.DecodeWeatherUnavailable(payload)
+		if err != nil {
+			return
+		}
+		if weatherType == messaging.MSG_CURRENT_WEATHER {
+			view.Weather = &ViewWeather{Unavailable: true, At: m.At}
+		} else if weatherType == messaging.MSG_FORECAST_WEATHER {
+			view.Forecast = &ViewForecast{Unavailable: true, At: m.At}
+		}
+	case messaging.MSG_DEVICE_CONFIG, messaging.MSG_CONFIG_DELTA:
+		strs, err := messaging.DecodeDeviceConfig(payload)
+		if err != nil {
+			return
+		}
+		if msgType == messaging.MSG_DEVICE_CONFIG || view.Config == nil {
+			view.Config = make(map[string]string)
+		}
+		for _, s := range strs {
+			key, value, _ := strings.Cut(s, "=")
+			if value == "" && msgType == messaging.MSG_CONFIG_DELTA {
+				delete(view.Config, key)
+			} else {
+				view.Config[key] = value
+			}
+		}
+	case messaging.MSG_INDICATOR:
+		if id, on, err := messaging.DecodeIndicator(payload); err == nil {
+			if view.Indicators == nil {
+				view.Indicators = make(map[string]bool)
+			}
+			view.Indicators[strconv.Itoa(int(id))] = on
+		}
+	case messaging.MSG_HOUSEHOLD_SUMMARY:
+		if h, err := messaging.DecodeHouseholdSummary(payload); err == nil {
+			view.Household = &ViewHousehold{HouseholdSummary: h, At: m.At}
+		}
+	case messaging.MSG_WEATHER_MOOD:
+		if mood, err := messaging.DecodeWeatherMood(payload); err == nil {
+			view.Mood = &ViewMood{WeatherMood: mood, At: m.At}
+		}
+	case messaging.MSG_NOTIFICATION:
+		if priority, duration, text, err := messaging.DecodeNotification(payload); err == nil {
+			view.Notification = &ViewNotification{Text: text, Priority: priority, Until: m.At.Add(duration)}
+		}
+	case messaging.MSG_SCREEN_CHUNK:
+		c, err := messaging.DecodeScreenChunk(payload)
+		if err != nil {
+			return
+		}
+		chunks := screens[c.ScreenID]
+		if chunks == nil {
+			chunks = make(map[uint8][]byte)
+			screens[c.ScreenID] = chunks
+		}
+		chunks[c.Index] = c.Data
+		if len(chunks) < int(c.Count) {
+			return
+		}
+		var bitmap []byte
+		for i := 0; i < int(c.Count); i++ {
+			bitmap = append(bitmap, chunks[uint8(i)]...)
+		}
+		delete(screens, c.ScreenID)
+		if len(bitmap) == messaging.ScreenBitmapSize(int(c.Width), int(c.Height)) {
+			view.Screen = &ViewScreen{ID: c.ScreenID, Width: int(c.Width), Height: int(c.Height), At: m.At, bitmap: bitmap}
+		}
+	case messaging.MSG_TYPE_ETCH_CALIBRATED_FRAME:
+		if len(payload) != 101 {
+			return
+		}
+		seq, red, green, blue, err := etchsketch.DecodeFullFrame(payload[:98])
+		if err == nil {
+			view.Canvas = &ViewCanvas{Seq: seq, Format: "calibrated", Width: 16, Height: 16, Calibrated: true,
+				Levels: []uint8{payload[98], payload[99], payload[100]}, Art: etchsketch.FormatArt(red, green, blue), At: &m.At}
+		}
+	case messaging.MSG_TYPE_ETCH_PALETTE_FRAME:
+		seq, f, err := etchsketch.DecodePaletteFrame(payload)
+		if err != nil {
+			return
+		}
+		indexes := make([]string, 16)
+		for y, row := range f {
+			for _, index := range row {
+				indexes[y] += strconv.FormatUint(uint64(index), 16)
+			}
+		}
+		red, green, blue := f.Channels()
+		view.Canvas = &ViewCanvas{Seq: seq, Format: "palette", Width: 16, Height: 16, Palette: indexes,
+			Art: etchsketch.FormatArt(red, green, blue), At: &m.At}
+	case messaging.MSG_TYPE_ETCH_RLE_FRAME:
+		if seq, f, err := etchsketch.DecodeRLEFrame(payload); err == nil {
+			view.Canvas = &ViewCanvas{Seq: seq, Format: "rle", Width: f.Width, Height: f.Height, Art: etchsketch.FormatFrameArt(f), At: &m.At}
+		}
+	case messaging.MSG_TYPE_ETCH_UPDATE_FRAME:
+		if view.Canvas.personal() {
+			return // The device draws its own copy
+		}
+		if seq, red, green, blue, err := etchsketch.DecodeFullFrame(payload); err == nil {
+			view.Canvas = &ViewCanvas{Seq: seq, Format: "frame", Width: 16, Height: 16, Art: etchsketch.FormatArt(red, green, blue), At: &m.At}
+		}
+	case messaging.MSG_TYPE_ETCH_FRAME_CHUNK:
+		if view.Canvas.personal() {
+			return
+		}
+		c, err := etchsketch.DecodeFrameChunk(payload)
+		if err != nil {
+			return
+		}
+		if f, complete := frames.Add(c); complete {
+			view.Canvas = &ViewCanvas{Seq: c.Seq, Format: "chunks", Width: f.Width, Height: f.Height, Art: etchsketch.FormatFrameArt(f), At: &m.At}
+		}
+	case messaging.MSG_VERSION:
+		if version, err := messaging.DecodeVersion(payload); err == nil {
+			view.Version = &version
+		}
+	case messaging.MSG_TIME:
+		if t, err := messaging.DecodeTime(payload); err == nil {
+			if view.Clock == nil {
+				view.Clock = &ViewClock{}
+			}
+			view.Clock.Time, view.Clock.At = t, m.At
+		}
+	case messaging.MSG_CLOCK_CHANGE:
+		if at, err := messaging.DecodeClockChange(payload); err == nil {
+			if view.Clock == nil {
+				view.Clock = &ViewClock{}
+			}
+			view.Clock.ChangeAt = &at
+			view.Clock.ChangeNotes = messaging.Describe(m.Data)
+		}
+	case messaging.MSG_QUIET_HOURS:
+		if until, err := messaging.DecodeQuietHours(payload); err == nil {
+			view.QuietUntil = nil
+			if !until.IsZero() {
+				view.QuietUntil = &until
+			}
+		}
+	case messaging.MSG_SERVER_SHUTDOWN:
+		if downtime, err := messaging.DecodeServerShutdown(payload); err == nil {
+			back := m.At.Add(downtime)
+			view.Shutdown = &back
+		}
+	case messaging.MSG_GENERIC:
+		if c, values, err := messaging.DecodeChannel(payload); err == nil {
+			if view.Channels == nil {
+				view.Channels = make(map[string]ViewRaw)
+			}
+			view.Channels[c.Name] = ViewRaw{Values: values, At: m.At}
+		}
+	default:
+		return
+	}
+}
+
+// Render the emulated view as text, roughly laid out like a display
+func (view DeviceView) Text() string {
+	var b strings.Builder
+	state := "offline"
+	if view.Online {
+		state = "online"
+	}
+	fmt.Fprintf(&b, "%s (%s)\n", view.Device, state)
+	if view.Shutdown != nil {
+		fmt.Fprintf(&b, "Server away until %s\n", view.Shutdown.Format("15:04:05"))
+	}
+	if view.QuietUntil != nil {
+		fmt.Fprintf(&b, "Quiet hours until %s\n", view.QuietUntil.Format("15:04"))
+	}
+	if n := view.Notification; n != nil {
+		fmt.Fprintf(&b, "[NOTIFICATION p%d until %s] %s\n", n.Priority, n.Until.Format("15:04:05"), n.Text)
+	}
+	switch w := view.Weather; {
+	case w == nil:
+		b.WriteString("Weather: (nothing sent)\n")
+	case w.Unavailable:
+		b.WriteString("Weather: -\n")
+	default:
+		fmt.Fprintf(&b, "Weather: %d°", w.Temp)
+		if w.Condition != "" {
+			fmt.Fprintf(&b, " %s", w.Condition)
+		}
+		if w.Humidity != nil {
+			fmt.Fprintf(&b, " %d%%", *w.Humidity)
+		}
+		if w.Wind != "" {
+			fmt.Fprintf(&b, " wind %s", w.Wind)
+		}
+		fmt.Fprintf(&b, "%s\n", weather_flag_marks(w.Flags))
+	}
+	if f := view.Forecast; f != nil {
+		if f.Unavailable {
+			b.WriteString("Forecast: -\n")
+		} else {
+			b.WriteString("Forecast:")
+			for _, d := range f.Days {
+				if d.LowTemp != nil {
+					fmt.Fprintf(&b, " %d°/%d°/%d%%", d.HighTemp, *d.LowTemp, d.Precip)
+				} else {
+					fmt.Fprintf(&b, " %d°/%d%%", d.HighTemp, d.Precip)
+				}
+			}
+			b.WriteString(weather_flag_marks(f.Flags) + "\n")
+		}
+	}
+	if len(view.Indicators) > 0 {
+		ids := make([]string, 0, len(view.Indicators))
+		for id := range view.Indicators {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		b.WriteString("Indicators:")
+		for _, id := range ids {
+			mark := "off"
+			if view.Indicators[id] {
+				mark = "ON"
+			}
+			fmt.Fprintf(&b, " %s=%s", id, mark)
+		}
+		b.WriteString("\n")
+	}
+	if len(view.Config) > 0 {
+		keys := make([]string, 0, len(view.Config))
+		for key := range view.Config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("Config:")
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%s", key, view.Config[key])
+		}
+		b.WriteString("\n")
+	}
+	if m := view.Mood; m != nil {
+		fmt.Fprintf(&b, "Light: rgb(%d,%d,%d) animation %d\n", m.R, m.G, m.B, m.Animation)
+	}
+	if s := view.Screen; s != nil {
+		fmt.Fprintf(&b, "Screen: %d (%dx%d) from %s\n", s.ID, s.Width, s.Height, s.At.Format("15:04:05"))
+	}
+	if view.Version != nil {
+		fmt.Fprintf(&b, "Offered firmware: %d\n", *view.Version)
+	}
+	if c := view.Canvas; c != nil {
+		fmt.Fprintf(&b, "Canvas seq %d (%s, %dx%d):\n", c.Seq, c.Format, c.Width, c.Height)
+		for _, row := range c.Art {
+			b.WriteString("  " + row + "\n")
+		}
+	}
+	return b.String()
+}
+
+func weather_flag_marks(flags uint8) string {
+	var marks []string
+	if flags&messaging.WEATHER_FLAG_STALE != 0 {
+		marks = append(marks, "stale")
+	}
+	if flags&messaging.WEATHER_FLAG_NEIGHBOR != 0 {
+		marks = append(marks, "neighbor")
+	}
+	if flags&messaging.WEATHER_FLAG_INTERPOLATED != 0 {
+		marks = append(marks, "interpolated")
+	}
+	if len(marks) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(marks, ", ") + ")"
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/epaper"
+	"server_app/internal/health"
+	"server_app/internal/holiday"
+	"server_app/internal/messaging"
+	"server_app/internal/weather"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capability advertised by e-paper displays that take server-rendered screens
+const capabilityEPaper = "epaper"
+
+// Device config keys for e-paper displays, with their defaults
+const (
+	configKeyEPaperSize    = "epaper_size"    // "<width>x<height>" in pixels
+	configKeyEPaperWidgets = "epaper_widgets" // Comma-separated, top to bottom
+	configKeyEPaperClock   = "epaper_clock"   // Minutes the clock is rounded down to
+
+	defaultEPaperSize      = "296x128"
+	defaultEPaperWidgets   = "clock,weather"
+	defaultEPaperClockStep = 15
+)
+
+// Calendar widget: holidays this many days ahead, at most this many
+const (
+	epaperCalendarDays   = 30
+	epaperCalendarEvents = 3
+)
+
+// Last screen pushed to each e-paper display
+type epaperScreen struct {
+	id   uint16
+	hash [sha256.Size]byte
+}
+
+var (
+	epaperMu      sync.Mutex
+	epaperScreens = make(map[string]epaperScreen)
+)
+
+// Render every e-paper display's screen once a minute; only changed screens are sent
+func task_epaper() {
+	health.Register("epaper", time.Minute)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("epaper")
+		if server_idle() {
+			continue
+		}
+		for _, device := range devices.GetActiveDevices() {
+			if !device.Pending && device.Metadata.HasCapability(capabilityEPaper) && !device_quiet(device.Name) {
+				publish_epaper_screen(device.Name, false)
+			}
+		}
+	}
+}
+
+// Render a display's screen and push it when it differs from the last one sent (or force)
+// Topic: <device_name>, Message Type: 0x23 (MSG_SCREEN_CHUNK) x chunk count, QoS: 1
+func publish_epaper_screen(deviceName string, force bool) {
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		return
+	}
+	width, height, err := parse_epaper_size(device.Config[configKeyEPaperSize])
+	if err != nil {
+		fmt.Printf("E-paper %s: %v\n", deviceName, err)
+		return
+	}
+	widgets := device.Config[configKeyEPaperWidgets]
+	if widgets == "" {
+		widgets = defaultEPaperWidgets
+	}
+
+	canvas, err := epaper.Render(width, height, strings.Split(widgets, ","), epaper_content(device))
+	if err != nil {
+		fmt.Printf("E-paper %s: %v\n", deviceName, err)
+		return
+	}
+	bitmap := canvas.Dither()
+	hash := sha256.Sum256(bitmap)
+
+	epaperMu.Lock()
+	last, sent := epaperScreens[deviceName]
+	epaperMu.Unlock()
+	if sent && last.hash == hash && !force {
+		return
+	}
+
+	id := last.id + 1
+	chunks, err := messaging.EncodeScreenChunks(id, width, height, bitmap, device_protocol_version(deviceName))
+	if err != nil {
+		fmt.Printf("E-paper %s: %v\n", deviceName, err)
+		return
+	}
+	fmt.Printf("Publishing screen %d (%dx%d, %d chunk(s)) to topic %s\n", id, width, height, len(chunks), deviceTopic(deviceName))
+	for _, chunk := range chunks {
+		if !messaging.PublishWithPolicy(deviceTopic(deviceName), chunk) {
+			return // Next tick retries the whole screen
+		}
+	}
+
+	epaperMu.Lock()
+	epaperScreens[deviceName] = epaperScreen{id: id, hash: hash}
+	epaperMu.Unlock()
+}
+
+// Screen contents for a display: local time (rounded to its clock step), weather, holidays
+func epaper_content(device *devices.Device) epaper.Content {
+	loc := time.Local
+	if zoneLoc, err := weather.Location(device.Zipcode); err == nil {
+		loc = zoneLoc
+	}
+	step := defaultEPaperClockStep
+	if s, err := strconv.Atoi(device.Config[configKeyEPaperClock]); err == nil && s > 0 {
+		step = s
+	}
+	now := time.Now().In(loc)
+	now = now.Truncate(time.Minute).Add(-time.Duration(now.Minute()%step) * time.Minute)
+	content := epaper.Content{Now: now, Weather: epaper_weather(device.Zipcode, device.Config[configKeyFeelsLike] == "true")}
+
+	for _, dated := range holiday.Upcoming(now, epaperCalendarDays) {
+		if len(content.Events) == epaperCalendarEvents {
+			break
+		}
+		content.Events = append(content.Events, epaper.Event{Date: dated.Date, Name: dated.Holiday.Name})
+	}
+	return content
+}
+
+// Weather for the weather widget; stale data is shown (marked) up to the stale limit
+func epaper_weather(zip string, feelsLike bool) *epaper.Weather {
+	age, ok := weather_age("current_weather", zip)
+	if !ok || age > time.Duration(WeatherStaleLimit)*time.Minute {
+		return nil
+	}
+	current, err := weather.GetCurrentConditions(zip)
+	if err != nil {
+		return nil
+	}
+	temp := current.Temp
+	if feelsLike {
+		temp = current.FeelsLike
+	}
+	w := &epaper.Weather{
+		Temp:      int(temp),
+		Condition: weather_condition(zip),
+		Stale:     !is_weather_valid("current_weather", zip),
+	}
+	if days, err := weather.GetForecastDays(zip, 3); err == nil {
+		for _, day := range days {
+			w.Forecast = append(w.Forecast, epaper.ForecastDay{High: int(day.HighTemp), Precip: int(day.Precip)})
+		}
+	}
+	return w
+}
+
+func parse_epaper_size(size string) (int, int, error) {
+	if size == "" {
+		size = defaultEPaperSize
+	}
+	parts := strings.Split(size, "x")
+	if len(parts) == 2 {
+		width, errW := strconv.Atoi(parts[0])
+		height, errH := strconv.Atoi(parts[1])
+		if errW == nil && errH == nil && width > 0 && height > 0 && width <= 2048 && height <= 2048 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid %s %q, expected <width>x<height>", configKeyEPaperSize, size)
+}
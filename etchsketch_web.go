@@ -0,0 +1,25 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"server_app/internal/admin"
+)
+
+// Browser client for the shared canvas (draws through the admin API)
+//
+//go:embed web/etchsketch.html
+var etchsketchPage []byte
+
+// /etchsketch/draw
+//
+//	GET serves the browser drawing page: it shows the live canvas and sends pixel edits
+//	through /etchsketch/pixels like any other client
+func handle_admin_etchsketch_draw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(etchsketchPage)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/federation"
+)
+
+// Connect the shared canvas to the peers in config.json, if any
+func start_canvas_federation() {
+	configMutex.RLock()
+	cfg := runtimeConfig.Federation
+	configMutex.RUnlock()
+	if !cfg.Enabled() {
+		return
+	}
+	if err := federation.Start(cfg, allow_federated_frame, apply_federated_frame); err != nil {
+		fmt.Printf("Warning: canvas federation not started: %v\n", err)
+	}
+}
+
+// Check a frame drawn on a peer's side before federation keeps or forwards it. The content
+// filter applies to peers' frames like to our own devices' frames.
+func allow_federated_frame(origin string, f federation.Frame) bool {
+	if stencil, blocked := match_blocklist_window(f.Red, f.Green, f.Blue); blocked {
+		quarantine_blocked_frame("federation:"+origin, stencil, f.Red, f.Green, f.Blue)
+		return false
+	}
+	return true
+}
+
+// Put an allowed frame drawn on a peer's side on our canvas and devices
+func apply_federated_frame(origin string, f federation.Frame) {
+	if err := etchsketchManager.PublishFrame(f.Red, f.Green, f.Blue); err != nil {
+		fmt.Printf("Error publishing federated canvas frame: %v\n", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"server_app/internal/auth"
+	"server_app/internal/devices"
+	"server_app/internal/grpcapi/adminv1"
+	"server_app/internal/jobs"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The cds.admin.v1 gRPC service: device, weather and OTA operations for integrations that
+// want typed RPCs, backed by the same code as the REST admin routes
+type grpcAdminServer struct {
+	adminv1.UnimplementedAdminServiceServer
+}
+
+// Serve the gRPC admin API on addr in the background, with the admin interface's sign-in
+func start_grpc_admin(addr string) {
+	if addr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("Warning: gRPC admin API disabled: %v\n", err)
+		return
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpc_admin_auth))
+	adminv1.RegisterAdminServiceServer(server, &grpcAdminServer{})
+	go func() {
+		fmt.Printf("gRPC admin API listening on %s\n", addr)
+		if err := server.Serve(listener); err != nil {
+			fmt.Printf("gRPC admin API stopped: %v\n", err)
+		}
+	}()
+}
+
+// Admin route each RPC stands for. A gRPC caller needs the role the admin interface
+// requires for it, so routes restricted in configure_admin_auth restrict their RPCs too.
+// RPCs missing here need the admin role.
+var grpcAdminRoutes = map[string]struct{ method, path string }{
+	"ListDevices":        {http.MethodGet, "/devices"},
+	"GetDevice":          {http.MethodGet, "/devices/{name}"},
+	"ApproveDevice":      {http.MethodPost, "/devices/{name}/approve"},
+	"RemoveDevice":       {http.MethodDelete, "/devices/{name}"},
+	"GetDeviceConfig":    {http.MethodGet, "/devices/{name}/config"},
+	"UpdateDeviceConfig": {http.MethodPut, "/devices/{name}/config"},
+	"GetWeather":         {http.MethodGet, "/weather/{zipcode}"},
+	"RefreshWeather":     {http.MethodPost, "/weather/{zipcode}/refresh"},
+	"GetFirmwareVersion": {http.MethodGet, "/firmware"},
+	"StartOTARollout":    {http.MethodPost, "/jobs"},
+	"GetJob":             {http.MethodGet, "/jobs/{id}"},
+}
+
+// Least role allowed to call a cds.admin.v1 method
+func grpc_admin_role(method string) auth.Role {
+	route, exists := grpcAdminRoutes[method]
+	if !exists {
+		return auth.RoleAdmin
+	}
+	return auth.Required(route.method, route.path)
+}
+
+// Check gRPC callers like admin HTTP requests: an API key ("x-api-key" or "authorization:
+// Bearer" metadata) with the role the RPC's admin route needs (see grpcAdminRoutes)
+func grpc_admin_auth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !auth.Enabled() {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{}
+	for _, key := range []string{"authorization", "x-api-key"} {
+		for _, v := range md.Get(key) {
+			header.Add(key, v)
+		}
+	}
+	id, ok, err := auth.AuthenticateHeaders(header)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "sign in required")
+	}
+
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	need := grpc_admin_role(method)
+	if !id.Role.Allows(need) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s requires the %s role", method, need)
+	}
+	if need != auth.RoleViewer {
+		fmt.Printf("Admin: gRPC %s by %s (%s)\n", method, id.Name, id.Provider)
+	}
+	return handler(ctx, req)
+}
+
+// Map errors from the device registry to gRPC status codes
+func grpc_device_error(deviceName string, err error) error {
+	var tooLarge configTooLargeError
+	switch {
+	case errors.Is(err, devices.ErrUnknownDevice):
+		return status.Errorf(codes.NotFound, "device %s not found", deviceName)
+	case errors.As(err, &tooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func grpc_timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func grpc_device(d devices.Device) *adminv1.Device {
+	return &adminv1.Device{
+		Id:           d.ID,
+		Name:         d.Name,
+		Zipcode:      d.Zipcode,
+		LastSeen:     grpc_timestamp(d.LastSeen),
+		Active:       d.Active,
+		Pending:      d.Pending,
+		Config:       d.Config,
+		HardwareType: d.Metadata.HardwareType,
+		Firmware:     d.Metadata.Firmware,
+		Capabilities: d.Metadata.Capabilities,
+		Protocol:     uint32(d.Metadata.Protocol),
+		OfflineSince: grpc_timestamp(d.OfflineSince),
+	}
+}
+
+func grpc_job(j jobs.Job) *adminv1.Job {
+	return &adminv1.Job{
+		Id:       j.ID,
+		Kind:     j.Kind,
+		State:    j.State,
+		Done:     int32(j.Done),
+		Total:    int32(j.Total),
+		Attempts: int32(j.Attempts),
+		Error:    j.Error,
+		Created:  grpc_timestamp(j.Created),
+		Updated:  grpc_timestamp(j.Updated),
+	}
+}
+
+func (s *grpcAdminServer) ListDevices(ctx context.Context, req *adminv1.ListDevicesRequest) (*adminv1.ListDevicesResponse, error) {
+	all := devices.GetAllDevices()
+	resp := &adminv1.ListDevicesResponse{Devices: make([]*adminv1.Device, 0, len(all))}
+	for _, d := range all {
+		resp.Devices = append(resp.Devices, grpc_device(d))
+	}
+	return resp, nil
+}
+
+func (s *grpcAdminServer) GetDevice(ctx context.Context, req *adminv1.GetDeviceRequest) (*adminv1.Device, error) {
+	device, exists := devices.GetDevice(req.Name)
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "device %s not found", req.Name)
+	}
+	return grpc_device(*device), nil
+}
+
+func (s *grpcAdminServer) ApproveDevice(ctx context.Context, req *adminv1.ApproveDeviceRequest) (*adminv1.Device, error) {
+	device, err := approve_device(req.Name)
+	if err != nil {
+		return nil, grpc_device_error(req.Name, err)
+	}
+	return grpc_device(*device), nil
+}
+
+func (s *grpcAdminServer) RemoveDevice(ctx context.Context, req *adminv1.RemoveDeviceRequest) (*adminv1.RemoveDeviceResponse, error) {
+	if err := remove_device(req.Name); err != nil {
+		return nil, grpc_device_error(req.Name, err)
+	}
+	return &adminv1.RemoveDeviceResponse{}, nil
+}
+
+func (s *grpcAdminServer) GetDeviceConfig(ctx context.Context, req *adminv1.GetDeviceConfigRequest) (*adminv1.DeviceConfig, error) {
+	config, err := devices.GetConfig(req.Name)
+	if err != nil {
+		return nil, grpc_device_error(req.Name, err)
+	}
+	return &adminv1.DeviceConfig{Name: req.Name, Config: config}, nil
+}
+
+func (s *grpcAdminServer) UpdateDeviceConfig(ctx context.Context, req *adminv1.UpdateDeviceConfigRequest) (*adminv1.DeviceConfig, error) {
+	if err := change_device_config(req.Name, req.Config, req.Replace); err != nil {
+		return nil, grpc_device_error(req.Name, err)
+	}
+	config, _ := devices.GetConfig(req.Name)
+	return &adminv1.DeviceConfig{Name: req.Name, Config: config}, nil
+}
+
+// Stored weather for a zipcode in the gRPC form (see weather_status)
+func grpc_weather(zipcode string) (*adminv1.Weather, error) {
+	if zipcode == "" {
+		return nil, status.Error(codes.InvalidArgument, "zipcode is required")
+	}
+	w, exists := weather_status(zipcode)
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "no weather stored for zipcode %s", zipcode)
+	}
+	resp := &adminv1.Weather{Zipcode: zipcode, Condition: w.Condition}
+	if w.CurrentTemp != nil {
+		resp.HasCurrent = true
+		resp.CurrentTemp = int32(*w.CurrentTemp)
+	}
+	if t, err := time.Parse(time.RFC3339, w.CurrentUpdated); err == nil {
+		resp.CurrentUpdated = timestamppb.New(t)
+	}
+	for _, d := range w.Forecast {
+		// high_temp is unsigned; sub-zero highs read 0 there, as on devices before protocol v4
+		high := uint32(0)
+		if d.HighTemp > 0 {
+			high = uint32(d.HighTemp)
+		}
+		resp.Forecast = append(resp.Forecast, &adminv1.ForecastDay{HighTemp: high, SignedHighTemp: int32(d.HighTemp), LowTemp: int32(d.LowTemp), Precip: uint32(d.Precip), Moon: uint32(d.Moon)})
+	}
+	if t, err := time.Parse(time.RFC3339, w.ForecastUpdated); err == nil {
+		resp.ForecastUpdated = timestamppb.New(t)
+	}
+	return resp, nil
+}
+
+func (s *grpcAdminServer) GetWeather(ctx context.Context, req *adminv1.GetWeatherRequest) (*adminv1.Weather, error) {
+	return grpc_weather(req.Zipcode)
+}
+
+func (s *grpcAdminServer) RefreshWeather(ctx context.Context, req *adminv1.RefreshWeatherRequest) (*adminv1.Weather, error) {
+	if req.Zipcode == "" {
+		return nil, status.Error(codes.InvalidArgument, "zipcode is required")
+	}
+	refresh_weather(req.Zipcode)
+	return grpc_weather(req.Zipcode)
+}
+
+func (s *grpcAdminServer) GetFirmwareVersion(ctx context.Context, req *adminv1.GetFirmwareVersionRequest) (*adminv1.FirmwareVersion, error) {
+	release, own := firmware_release(req.HwType)
+	resp := &adminv1.FirmwareVersion{Code: uint32(release.Version), HwType: req.HwType, Notes: release.Notes, IsDefault: !own}
+	if !own {
+		configMutex.RLock()
+		resp.Version = runtimeConfig.DeviceVersion
+		configMutex.RUnlock()
+	}
+	return resp, nil
+}
+
+func (s *grpcAdminServer) StartOTARollout(ctx context.Context, req *adminv1.StartOTARolloutRequest) (*adminv1.Job, error) {
+	params := map[string]string{}
+	if len(req.Devices) > 0 {
+		params["devices"] = strings.Join(req.Devices, ",")
+	}
+	if req.HwType != "" {
+		params["hw_type"] = req.HwType
+	}
+	if req.IntervalSeconds > 0 {
+		params["interval"] = strconv.FormatUint(uint64(req.IntervalSeconds), 10) + "s"
+	}
+	job, err := jobs.Submit("ota_rollout", params, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return grpc_job(job), nil
+}
+
+func (s *grpcAdminServer) GetJob(ctx context.Context, req *adminv1.GetJobRequest) (*adminv1.Job, error) {
+	job, exists := jobs.Get(req.Id)
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "job %s not found", req.Id)
+	}
+	return grpc_job(job), nil
+}
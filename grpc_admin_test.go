@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"server_app/internal/auth"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func call_grpc_admin(key string, method string) error {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", key))
+	info := &grpc.UnaryServerInfo{FullMethod: "/cds.admin.v1.AdminService/" + method}
+	_, err := grpc_admin_auth(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// RPCs get the role their admin routes need: jobs and firmware are for admins only
+func TestGRPCAdminRoles(t *testing.T) {
+	err := configure_admin_auth(auth.Config{APIKeys: []auth.APIKey{
+		{Name: "viewer", Key: "viewer-key-0123456789", Role: auth.RoleViewer},
+		{Name: "operator", Key: "operator-key-0123456789", Role: auth.RoleOperator},
+		{Name: "admin", Key: "admin-key-0123456789", Role: auth.RoleAdmin},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		key     string
+		method  string
+		allowed bool
+	}{
+		{"viewer-key-0123456789", "GetDevice", true},
+		{"viewer-key-0123456789", "ApproveDevice", false},
+		{"viewer-key-0123456789", "GetJob", false},
+		{"operator-key-0123456789", "UpdateDeviceConfig", true},
+		{"operator-key-0123456789", "StartOTARollout", false},
+		{"operator-key-0123456789", "GetJob", false},
+		{"operator-key-0123456789", "GetFirmwareVersion", false},
+		{"operator-key-0123456789", "SomeNewMethod", false},
+		{"admin-key-0123456789", "StartOTARollout", true},
+		{"admin-key-0123456789", "GetJob", true},
+	}
+	for _, c := range cases {
+		err := call_grpc_admin(c.key, c.method)
+		if c.allowed && err != nil {
+			t.Errorf("%s refused for %s: %v", c.method, c.key, err)
+		}
+		if !c.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s by %s: got %v, want PermissionDenied", c.method, c.key, err)
+		}
+	}
+}
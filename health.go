@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server_app/internal/buildinfo"
+	"server_app/internal/health"
+	"server_app/internal/messaging"
+	"server_app/internal/storage"
+	"server_app/internal/timeline"
+	"server_app/internal/timesync"
+	"server_app/internal/weather"
+	"strings"
+	"time"
+)
+
+// Directory holding every storage file; the storage check makes sure it still accepts writes
+const dataDir = "./data"
+
+// How often subsystem health is re-evaluated
+const healthEvalInterval = 30 * time.Second
+
+// Consecutive failed weather API calls after which weather fails outright, once the
+// cached data is also too old to serve
+const weatherFailureLimit = 3
+
+// Health as reported by /healthz and /readyz
+type HealthReport struct {
+	OK      bool                 `json:"ok"`
+	Build   *buildinfo.Info      `json:"build,omitempty"` // Signed-in callers only (see with_build)
+	Status  health.Composite     `json:"status"`
+	Tasks   []health.Task        `json:"tasks"`
+	Weather *weather.FetchStatus `json:"weather,omitempty"`
+
+	// Corrupt storage files found at startup
+	StorageRecoveries []storage.Recovery `json:"storage_recoveries,omitempty"`
+
+	// Schema version of each storage file, and any migrations run at startup
+	StorageSchemas []storage.SchemaStatus `json:"storage_schemas,omitempty"`
+
+	// Set while periodic device work is suspended (idle mode)
+	Idle *IdleStatus `json:"idle,omitempty"`
+
+	// Whether the server clock is trusted, and its last NTP check
+	Clock *timesync.Status `json:"clock,omitempty"`
+}
+
+// Alive: background tasks are still running
+func liveness_report() HealthReport {
+	return HealthReport{OK: len(health.Stalled()) == 0, Status: health.Status(), Tasks: health.Tasks(), StorageRecoveries: storage.Recoveries(), Idle: idle_status()}
+}
+
+// Ready to serve devices: no subsystem has failed (degraded ones still serve)
+func readiness_report() HealthReport {
+	evaluate_health()
+	status := health.Status()
+	fetch := weather.GetFetchStatus()
+	clock := timesync.GetStatus()
+	return HealthReport{OK: status.State != health.StateFailed, Status: status, Tasks: health.Tasks(), Weather: &fetch,
+		StorageRecoveries: storage.Recoveries(), StorageSchemas: storage.Schemas(), Idle: idle_status(), Clock: &clock}
+}
+
+// Re-evaluate subsystem health every so often; subsystems driven by events (devices)
+// update themselves
+func task_health() {
+	health.OnChange(func(status health.Composite) {
+		publish_server_health(status)
+		timeline.Record(timeline.TypeHealth, "", "health "+status.Summary(), nil)
+		go log_health_change(status)
+	})
+	evaluate_health()
+	publish_server_health(health.Status())
+
+	ticker := time.NewTicker(healthEvalInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		evaluate_health()
+	}
+}
+
+func evaluate_health() {
+	evaluate_messaging_health()
+	evaluate_weather_health()
+
+	if etchsketchManager == nil {
+		health.Set("etchsketch", health.StateFailed, "canvas not initialized")
+	} else {
+		health.Set("etchsketch", health.StateOK, "")
+	}
+
+	if err := check_storage(); err != nil {
+		health.Set("storage", health.StateFailed, err.Error())
+	} else if reason := storage_recovery_summary(); reason != "" {
+		health.Set("storage", health.StateDegraded, reason) // Until restart, so it gets noticed
+	} else {
+		health.Set("storage", health.StateOK, "")
+	}
+
+	if stalled := health.Stalled(); len(stalled) > 0 {
+		health.Set("tasks", health.StateFailed, "stalled: "+strings.Join(stalled, ", "))
+	} else {
+		health.Set("tasks", health.StateOK, "")
+	}
+}
+
+func evaluate_messaging_health() {
+	status := messaging.Status()
+	switch {
+	case !status.Connected:
+		reason := "not connected"
+		if status.LastError != "" {
+			reason += ": " + status.LastError
+		}
+		health.Set("messaging", health.StateFailed, reason)
+	case status.Queued > 0:
+		health.Set("messaging", health.StateDegraded, fmt.Sprintf("%d publish(es) waiting to replay", status.Queued))
+	default:
+		health.Set("messaging", health.StateOK, "")
+	}
+}
+
+// Failed fetches degrade weather while cached data can still be served (flagged stale),
+// and fail it once repeated failures leave nothing fresh enough
+func evaluate_weather_health() {
+	fetch := weather.GetFetchStatus()
+	staleLimit := time.Duration(WeatherStaleLimit) * time.Minute
+	switch {
+	case fetch.ConsecutiveFailures == 0:
+		health.Set("weather", health.StateOK, "")
+	case fetch.ConsecutiveFailures >= weatherFailureLimit && time.Since(fetch.LastSuccess) > staleLimit:
+		health.Set("weather", health.StateFailed, fmt.Sprintf("%d consecutive fetch failures, no success in %v", fetch.ConsecutiveFailures, staleLimit))
+	default:
+		health.Set("weather", health.StateDegraded, fmt.Sprintf("%d consecutive fetch failure(s)", fetch.ConsecutiveFailures))
+	}
+}
+
+// Composite summary plus the broker and weather details behind it, for healthcheck pings
+func health_diagnostics(status health.Composite) string {
+	lines := []string{status.Summary()}
+	broker := messaging.Status()
+	line := fmt.Sprintf("mqtt: connected=%v broker=%s queued=%d", broker.Connected, broker.Active, broker.Queued)
+	if broker.LastError != "" {
+		line += " last_error=" + broker.LastError
+	}
+	lines = append(lines, line)
+	fetch := weather.GetFetchStatus()
+	lines = append(lines, fmt.Sprintf("weather: consecutive_failures=%d last_success=%s last_failure=%s",
+		fetch.ConsecutiveFailures, format_health_time(fetch.LastSuccess), format_health_time(fetch.LastFailure)))
+	return strings.Join(lines, "\n")
+}
+
+func format_health_time(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Describe corrupt and undecryptable storage files found at startup ("" = none)
+func storage_recovery_summary() string {
+	var parts []string
+	for _, file := range storage.LockedFiles() {
+		parts = append(parts, fmt.Sprintf("%s cannot be decrypted with the storage key, not written", filepath.Base(file)))
+	}
+	for _, schema := range storage.Schemas() {
+		if schema.Error != "" {
+			parts = append(parts, fmt.Sprintf("%s not migrated (%s), not written", filepath.Base(schema.File), schema.Error))
+		}
+	}
+	for _, rec := range storage.Recoveries() {
+		outcome := "no intact copy, started empty"
+		if rec.Source != "" {
+			outcome = "recovered from " + rec.Source
+		}
+		parts = append(parts, fmt.Sprintf("%s was corrupt, %s", filepath.Base(rec.File), outcome))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Write and remove a scratch file next to the storage files
+func check_storage() error {
+	if storage.InMemory() {
+		return nil // Nothing is written there
+	}
+	f, err := os.CreateTemp(dataDir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("write failed: %v", err)
+	}
+	return nil
+}
+
+// Publish the composite status whenever it changes
+// Topic: server/health, JSON (retained)
+func publish_server_health(status health.Composite) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		fmt.Printf("Error encoding server health: %v\n", err)
+		return
+	}
+	messaging.PublishRetained(TopicServerHealth, data)
+}
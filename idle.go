@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/timeline"
+	"sync"
+	"time"
+)
+
+// Idle mode: with no device active for runtimeConfig.IdleAfterMinutes (the vacation house in
+// winter) the server stops weather fetching and the other periodic device work, and only
+// listens for devices. The first bootup (or a device coming back online) resumes everything.
+
+// IdleStatus is reported by /healthz and /readyz while idle
+type IdleStatus struct {
+	Since        time.Time `json:"since"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+var (
+	idleMu       sync.Mutex
+	idleSince    time.Time // Zero while awake
+	lastActivity = time.Now()
+)
+
+// Whether periodic device work is suspended; tasks check this each tick and skip the work
+// (still beating their health, so they never look stalled)
+func server_idle() bool {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	return !idleSince.IsZero()
+}
+
+func idle_status() *IdleStatus {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	if idleSince.IsZero() {
+		return nil
+	}
+	return &IdleStatus{Since: idleSince, LastActivity: lastActivity}
+}
+
+// Resume periodic work after a device shows up
+func wake_from_idle(deviceName string) {
+	idleMu.Lock()
+	lastActivity = time.Now()
+	since := idleSince
+	idleSince = time.Time{}
+	idleMu.Unlock()
+	if since.IsZero() {
+		return
+	}
+	fmt.Printf("Leaving idle mode: %s is back after %v\n", deviceName, time.Since(since).Round(time.Minute))
+	timeline.Record(timeline.TypeServer, deviceName, "left idle mode",
+		map[string]interface{}{"idle_minutes": int(time.Since(since) / time.Minute)})
+}
+
+// Enter idle mode once no device has been active for the configured period
+func task_idle_monitor() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		configMutex.RLock()
+		after := time.Duration(runtimeConfig.IdleAfterMinutes) * time.Minute
+		configMutex.RUnlock()
+		if after <= 0 || server_idle() {
+			continue
+		}
+
+		last := last_device_activity()
+		if time.Since(last) < after {
+			continue
+		}
+		if len(devices.GetActiveDevices()) > 0 {
+			continue
+		}
+
+		idleMu.Lock()
+		idleSince = time.Now()
+		idleMu.Unlock()
+		fmt.Printf("Entering idle mode: no device active since %s, suspending weather fetches and periodic device updates\n",
+			last.Format(time.RFC3339))
+		timeline.Record(timeline.TypeServer, "", "entered idle mode",
+			map[string]interface{}{"last_activity": last.Format(time.RFC3339)})
+	}
+}
+
+// Latest of the last device heartbeat/bootup and the last wake (or startup)
+func last_device_activity() time.Time {
+	idleMu.Lock()
+	last := lastActivity
+	idleMu.Unlock()
+	for _, device := range devices.GetAllDevices() {
+		if device.LastSeen.After(last) {
+			last = device.LastSeen
+		}
+	}
+	return last
+}
@@ -0,0 +1,215 @@
+package accounting
+
+import (
+	"fmt"
+	"server_app/internal/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage is one device's resource consumption within a month
+type Usage struct {
+	WeatherCalls float64 `json:"weather_calls"` // Share of weather API calls (a call is split across devices in the zipcode)
+	MessagesIn   int     `json:"messages_in"`
+	MessagesOut  int     `json:"messages_out"` // Messages the broker delivered to the device (shared topics count per device)
+	BytesIn      int64   `json:"bytes_in"`
+	BytesOut     int64   `json:"bytes_out"`
+	StorageBytes int64   `json:"storage_bytes"` // Bytes appended to persistent storage on the device's behalf
+}
+
+func (u *Usage) add(o Usage) {
+	u.WeatherCalls += o.WeatherCalls
+	u.MessagesIn += o.MessagesIn
+	u.MessagesOut += o.MessagesOut
+	u.BytesIn += o.BytesIn
+	u.BytesOut += o.BytesOut
+	u.StorageBytes += o.StorageBytes
+}
+
+// TenantSummary totals usage for one tenant (household) in a month
+type TenantSummary struct {
+	Tenant       string   `json:"tenant"`
+	Devices      []string `json:"devices"`
+	Usage        Usage    `json:"usage"`
+	WeatherShare float64  `json:"weather_share"` // Fraction of the month's weather API calls (for splitting the bill)
+}
+
+// Tenant name used for devices not assigned to any tenant
+const Unassigned = "unassigned"
+
+// Version of the stored layout (see storage.Migrate)
+const schemaVersion = 1
+
+var (
+	mu    sync.Mutex
+	usage = make(map[string]map[string]*Usage) // month ("2006-01") -> device -> usage
+	store *storage.Manager
+	dirty bool
+)
+
+func monthKey(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// InitStorage loads monthly usage saved by previous runs
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.New(dataFilePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Migrate(schemaVersion, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for month := range store.GetAll() {
+		var devs map[string]*Usage
+		if _, err := store.GetTyped(month, &devs); err != nil {
+			fmt.Printf("Warning: failed to load accounting for %s: %v\n", month, err)
+			continue
+		}
+		usage[month] = devs
+	}
+	return nil
+}
+
+// current returns the device's usage record for this month. Caller holds mu.
+func current(device string) *Usage {
+	month := monthKey(time.Now())
+	devs, exists := usage[month]
+	if !exists {
+		devs = make(map[string]*Usage)
+		usage[month] = devs
+	}
+	u, exists := devs[device]
+	if !exists {
+		u = &Usage{}
+		devs[device] = u
+	}
+	dirty = true
+	return u
+}
+
+// NoteWeatherCall splits one weather API call across the devices it was made for
+func NoteWeatherCall(deviceIDs []string) {
+	if len(deviceIDs) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	share := 1 / float64(len(deviceIDs))
+	for _, id := range deviceIDs {
+		current(id).WeatherCalls += share
+	}
+}
+
+// NoteMessageIn counts a message received from a device
+func NoteMessageIn(device string, size int) {
+	mu.Lock()
+	defer mu.Unlock()
+	u := current(device)
+	u.MessagesIn++
+	u.BytesIn += int64(size)
+}
+
+// NoteMessageOut counts a message delivered to a device
+func NoteMessageOut(device string, size int) {
+	mu.Lock()
+	defer mu.Unlock()
+	u := current(device)
+	u.MessagesOut++
+	u.BytesOut += int64(size)
+}
+
+// NoteStorage counts bytes written to persistent storage for a device
+func NoteStorage(device string, size int) {
+	mu.Lock()
+	defer mu.Unlock()
+	current(device).StorageBytes += int64(size)
+}
+
+// Flush persists usage if anything changed since the last flush
+func Flush() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if !dirty || store == nil {
+		return nil
+	}
+
+	data := make(map[string]interface{}, len(usage))
+	for month, devs := range usage {
+		data[month] = devs
+	}
+	if err := store.Replace(data); err != nil {
+		return err
+	}
+	dirty = false
+	return nil
+}
+
+// Months lists months with recorded usage, newest first
+func Months() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	months := make([]string, 0, len(usage))
+	for month := range usage {
+		months = append(months, month)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(months)))
+	return months
+}
+
+// DeviceUsage returns a copy of every device's usage for a month ("2006-01")
+func DeviceUsage(month string) map[string]Usage {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make(map[string]Usage, len(usage[month]))
+	for device, u := range usage[month] {
+		result[device] = *u
+	}
+	return result
+}
+
+// Summarize totals a month's usage per tenant; tenants maps tenant -> device IDs.
+// Devices with usage but no tenant are reported under Unassigned.
+func Summarize(month string, tenants map[string][]string) []TenantSummary {
+	devs := DeviceUsage(month)
+
+	owner := make(map[string]string)
+	for tenant, ids := range tenants {
+		for _, id := range ids {
+			owner[id] = tenant
+		}
+	}
+
+	byTenant := make(map[string]*TenantSummary)
+	var totalCalls float64
+	for device, u := range devs {
+		tenant, ok := owner[device]
+		if !ok {
+			tenant = Unassigned
+		}
+		s, exists := byTenant[tenant]
+		if !exists {
+			s = &TenantSummary{Tenant: tenant}
+			byTenant[tenant] = s
+		}
+		s.Devices = append(s.Devices, device)
+		s.Usage.add(u)
+		totalCalls += u.WeatherCalls
+	}
+
+	result := make([]TenantSummary, 0, len(byTenant))
+	for _, s := range byTenant {
+		sort.Strings(s.Devices)
+		if totalCalls > 0 {
+			s.WeatherShare = s.Usage.WeatherCalls / totalCalls
+		}
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Tenant < result[j].Tenant })
+	return result
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Local HTTP admin interface. Routes are registered by the owning packages
+// (or main) before Start is called.
+var mux = http.NewServeMux()
+
+// Wrappers applied to every request, outermost first (e.g. authentication)
+var middleware []func(http.Handler) http.Handler
+
+// Handle registers a handler for an admin route
+func Handle(pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, handler)
+}
+
+// Use wraps all admin routes in mw. Call before Start.
+func Use(mw func(http.Handler) http.Handler) {
+	middleware = append(middleware, mw)
+}
+
+// Start serves the admin interface on addr in the background
+func Start(addr string) {
+	if addr == "" {
+		fmt.Println("Admin interface disabled (no address configured)")
+		return
+	}
+	var handler http.Handler = mux
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	go func() {
+		fmt.Printf("Admin interface listening on %s\n", addr)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Printf("Admin interface stopped: %v\n", err)
+		}
+	}()
+}
+
+// WriteJSON writes v as a JSON response with the given status code
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Admin: failed to write response: %v\n", err)
+	}
+}
+
+// WriteError writes a JSON error body with the given status code
+func WriteError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	WriteJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// ReadJSON decodes the request body into v
+func ReadJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return nil
+}
+
+// PathParts splits the request path below prefix into its non-empty segments
+// e.g. PathParts("/devices/dev0/config", "/devices/") returns ["dev0", "config"]
+func PathParts(path string, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
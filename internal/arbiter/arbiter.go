@@ -0,0 +1,270 @@
+package arbiter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-device display arbitration. Subsystems that want a device's display for a while (a
+// text message, a rule alert) submit a notification instead of publishing directly. Each
+// device shows one notification at a time: the rest wait in priority order, and a strictly
+// higher priority preempts the one showing, which resumes afterwards with its remaining time.
+
+// Common priorities; sources may use any value in between
+const (
+	PriorityLow      = 10
+	PriorityNormal   = 50
+	PriorityHigh     = 80
+	PriorityCritical = 100
+)
+
+const (
+	maxPending = 32              // Per device
+	minResume  = 2 * time.Second // Preempted notifications with less left are dropped
+)
+
+var (
+	ErrUnknownNotification = errors.New("unknown notification")
+	ErrQueueFull           = errors.New("notification queue full")
+)
+
+// Notification is a request for a device's display
+type Notification struct {
+	ID       uint64        `json:"id"`
+	Device   string        `json:"device"`
+	Source   string        `json:"source"`        // Subsystem asking for the display, e.g. "text" or "rule"
+	Key      string        `json:"key,omitempty"` // A pending notification with the same key is replaced
+	Priority int           `json:"priority"`
+	Duration time.Duration `json:"duration"`          // How long the display is held
+	Summary  string        `json:"summary,omitempty"` // Human-readable content for the admin API
+	Queued   time.Time     `json:"queued"`
+	Expires  time.Time     `json:"expires,omitempty"` // Dropped if not shown by then
+	Shown    time.Time     `json:"shown,omitempty"`
+	Until    time.Time     `json:"until,omitempty"` // End of the display while showing
+
+	// Message builds what is sent to the device when the notification gets the display,
+	// given the time it will be held (less than Duration when resuming after preemption)
+	Message func(held time.Duration) ([]byte, error) `json:"-"`
+}
+
+// Queue is a device's notification showing now and those waiting, next first
+type Queue struct {
+	Active  *Notification  `json:"active"`
+	Pending []Notification `json:"pending"`
+}
+
+type display struct {
+	active  *Notification
+	pending []*Notification
+	timer   *time.Timer
+}
+
+var (
+	mu       sync.Mutex
+	displays = make(map[string]*display)
+	nextID   uint64
+	show     func(device string, msg []byte)
+)
+
+// OnShow sets where messages go when a notification gets a device's display
+func OnShow(fn func(device string, msg []byte)) {
+	mu.Lock()
+	defer mu.Unlock()
+	show = fn
+}
+
+// Submit queues n for its device and shows it right away if the display is free or n
+// outranks the notification showing. A pending notification with the same key is replaced,
+// so a repeating alert never stacks up behind itself.
+func Submit(n Notification) (Notification, error) {
+	if n.Device == "" || n.Message == nil || n.Duration <= 0 {
+		return Notification{}, fmt.Errorf("notification needs a device, a message and a duration")
+	}
+
+	mu.Lock()
+	d := displays[n.Device]
+	if d == nil {
+		d = &display{}
+		displays[n.Device] = d
+	}
+	now := time.Now()
+	d.dropExpired(now)
+
+	replaced := false
+	for i, p := range d.pending {
+		if n.Key != "" && p.Key == n.Key {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			replaced = true
+			break
+		}
+	}
+	if !replaced && len(d.pending) >= maxPending {
+		mu.Unlock()
+		return Notification{}, ErrQueueFull
+	}
+
+	nextID++
+	n.ID = nextID
+	n.Queued = now
+	n.Shown, n.Until = time.Time{}, time.Time{}
+	d.insert(&n, false)
+
+	var out showing
+	if d.active == nil || n.Priority > d.active.Priority {
+		out = d.advance(now)
+	}
+	mu.Unlock()
+	out.send()
+	return n, nil
+}
+
+// Cancel withdraws a notification. Cancelling the one showing hands the display to the
+// next in line; with none left the device returns to its normal display when its time is up.
+func Cancel(device string, id uint64) error {
+	mu.Lock()
+	d := displays[device]
+	if d == nil {
+		mu.Unlock()
+		return ErrUnknownNotification
+	}
+	if d.active != nil && d.active.ID == id {
+		d.stop()
+		d.active = nil
+		out := d.advance(time.Now())
+		mu.Unlock()
+		out.send()
+		return nil
+	}
+	defer mu.Unlock()
+	for i, p := range d.pending {
+		if p.ID == id {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return nil
+		}
+	}
+	return ErrUnknownNotification
+}
+
+// Get returns a device's notification queue
+func Get(device string) Queue {
+	mu.Lock()
+	defer mu.Unlock()
+	q := Queue{Pending: []Notification{}}
+	d := displays[device]
+	if d == nil {
+		return q
+	}
+	d.dropExpired(time.Now())
+	if d.active != nil {
+		active := *d.active
+		q.Active = &active
+	}
+	for _, p := range d.pending {
+		q.Pending = append(q.Pending, *p)
+	}
+	return q
+}
+
+// Forget drops everything queued for a device (e.g. when it is removed)
+func Forget(device string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d := displays[device]; d != nil {
+		d.stop()
+		delete(displays, device)
+	}
+}
+
+// insert adds n behind pending notifications of higher priority, and behind those of the
+// same priority unless first (a preempted notification resumes before its peers)
+func (d *display) insert(n *Notification, first bool) {
+	i := sort.Search(len(d.pending), func(i int) bool {
+		return d.pending[i].Priority < n.Priority || (first && d.pending[i].Priority == n.Priority)
+	})
+	d.pending = append(d.pending, nil)
+	copy(d.pending[i+1:], d.pending[i:])
+	d.pending[i] = n
+}
+
+func (d *display) dropExpired(now time.Time) {
+	kept := d.pending[:0]
+	for _, p := range d.pending {
+		if p.Expires.IsZero() || now.Before(p.Expires) {
+			kept = append(kept, p)
+		}
+	}
+	d.pending = kept
+}
+
+func (d *display) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+// showing is a message to send once mu is released: show publishes and may block for a
+// while, which must not hold up every other device's notifications
+type showing struct {
+	fn     func(device string, msg []byte)
+	device string
+	msg    []byte
+}
+
+func (s showing) send() {
+	if s.fn != nil {
+		s.fn(s.device, s.msg)
+	}
+}
+
+// advance makes the first pending notification active, putting back any one it preempts,
+// and returns its message for the caller to send after releasing mu. Caller holds mu.
+func (d *display) advance(now time.Time) showing {
+	d.dropExpired(now)
+	if len(d.pending) == 0 {
+		return showing{}
+	}
+	next := d.pending[0]
+	d.pending = d.pending[1:]
+
+	if d.active != nil {
+		d.stop()
+		preempted := d.active
+		if left := preempted.Until.Sub(now); left >= minResume {
+			preempted.Duration = left
+			preempted.Shown, preempted.Until = time.Time{}, time.Time{}
+			d.insert(preempted, true)
+		}
+		d.active = nil
+	}
+
+	msg, err := next.Message(next.Duration)
+	if err != nil {
+		fmt.Printf("Notifications: dropping %s notification %d for %s: %v\n", next.Source, next.ID, next.Device, err)
+		return d.advance(now)
+	}
+	next.Shown = now
+	next.Until = now.Add(next.Duration)
+	d.active = next
+	device, id := next.Device, next.ID
+	d.timer = time.AfterFunc(next.Duration, func() { finish(device, id) })
+	return showing{fn: show, device: device, msg: msg}
+}
+
+// finish ends a notification whose time is up and shows the next one
+func finish(device string, id uint64) {
+	mu.Lock()
+	d := displays[device]
+	if d == nil || d.active == nil || d.active.ID != id {
+		mu.Unlock()
+		return
+	}
+	d.timer = nil
+	d.active = nil
+	out := d.advance(time.Now())
+	mu.Unlock()
+	out.send()
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPIKeys(t *testing.T) {
+	for _, keys := range [][]APIKey{
+		{{Name: "script", Key: "too-short", Role: RoleViewer}},
+		{{Name: "script", Key: "0123456789abcdef", Role: "owner"}},
+		{{Key: "0123456789abcdef", Role: RoleViewer}},
+		{{Name: "a", Key: "0123456789abcdef", Role: RoleViewer}, {Name: "a", Key: "fedcba9876543210", Role: RoleAdmin}},
+	} {
+		if _, err := newAPIKeys(keys); err == nil {
+			t.Errorf("accepted %+v", keys)
+		}
+	}
+}
+
+func TestAPIKeyAuthenticate(t *testing.T) {
+	keys, err := newAPIKeys([]APIKey{{Name: "script", Key: "0123456789abcdef", Role: RoleOperator}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		header, value string
+		ok, err       bool
+	}{
+		{"X-API-Key", "0123456789abcdef", true, false},
+		{"Authorization", "Bearer 0123456789abcdef", true, false},
+		{"Authorization", "bearer 0123456789abcdef", true, false},
+		{"X-API-Key", "0123456789abcdeX", false, true},
+		{"Authorization", "Bearer a.b.c", false, false}, // An ID token, left to OIDC
+		{"Authorization", "Basic 0123456789abcdef", false, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		r.Header.Set(c.header, c.value)
+		id, ok, err := keys.Authenticate(r)
+		if ok != c.ok || (err != nil) != c.err {
+			t.Errorf("%s: %s: got ok %v, err %v", c.header, c.value, ok, err)
+		}
+		if ok && (id.Name != "script" || id.Role != RoleOperator) {
+			t.Errorf("%s: got identity %+v", c.header, id)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	mu.Lock()
+	saved := restricted
+	restricted = nil
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		restricted = saved
+		mu.Unlock()
+	}()
+	Restrict("/devices/*/key", RoleAdmin)
+
+	cases := []struct {
+		method, path string
+		want         Role
+	}{
+		{http.MethodGet, "/devices", RoleViewer},
+		{http.MethodHead, "/devices/lamp", RoleViewer},
+		{http.MethodPost, "/devices/lamp/approve", RoleOperator},
+		{http.MethodGet, "/devices/lamp/key", RoleAdmin},
+		{http.MethodPut, "/devices/lamp/key/", RoleAdmin},
+		{http.MethodGet, "/devices/key", RoleViewer},
+	}
+	for _, c := range cases {
+		if got := Required(c.method, c.path); got != c.want {
+			t.Errorf("%s %s: got %s, want %s", c.method, c.path, got, c.want)
+		}
+	}
+	if !RoleAdmin.Allows(RoleOperator) || RoleViewer.Allows(RoleOperator) || Role("owner").Valid() {
+		t.Error("role ranks out of order")
+	}
+}
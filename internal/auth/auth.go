@@ -0,0 +1,476 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"server_app/internal/admin"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sign-in for the admin API and dashboard. Identity providers are pluggable: local API keys
+// for scripts, and OpenID Connect (e.g. Google accounts) for people, who get a session
+// cookie after logging in. Every identity carries a role that limits what it may do.
+// With no providers configured the admin interface stays open, as before.
+
+// Role is what an identity may do; each role includes the ones below it
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Read-only (GET)
+	RoleOperator Role = "operator" // Also changes devices, the canvas, scenes, ...
+	RoleAdmin    Role = "admin"    // Everything, including restricted routes
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether r includes need
+func (r Role) Allows(need Role) bool {
+	return r.rank() >= need.rank()
+}
+
+// Identity is an authenticated caller
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"` // Stable ID within the provider
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Role     Role   `json:"role"`
+}
+
+// Provider authenticates requests carrying its own kind of credentials (e.g. a bearer
+// token). ok is false when the request has none of its credentials; err is set when it
+// has them but they are invalid.
+type Provider interface {
+	Name() string
+	Authenticate(r *http.Request) (id Identity, ok bool, err error)
+}
+
+// LoginProvider additionally signs people in through a browser redirect
+type LoginProvider interface {
+	Provider
+	// LoginURL is where the browser is sent; state and nonce must come back unchanged
+	LoginURL(state string, nonce string) (string, error)
+	// Finish completes a login from the provider's callback request
+	Finish(r *http.Request, nonce string) (Identity, error)
+}
+
+// Config is the "auth" section of config.json
+type Config struct {
+	SessionHours int          `json:"sessionHours"` // Login lifetime (0 = 12)
+	APIKeys      []APIKey     `json:"apiKeys"`
+	OIDC         []OIDCConfig `json:"oidc"`
+}
+
+const (
+	defaultSessionLifetime = 12 * time.Hour
+	loginTimeout           = 10 * time.Minute // Time allowed at the provider's login page
+	sessionCookie          = "cds_session"
+)
+
+var (
+	mu         sync.Mutex
+	providers  []Provider
+	sessionTTL = defaultSessionLifetime
+	sessions   = make(map[string]*session)
+	logins     = make(map[string]*login) // By state
+	public     []string
+	restricted []restriction
+)
+
+type session struct {
+	identity Identity
+	expires  time.Time
+}
+
+type login struct {
+	provider string
+	nonce    string
+	next     string
+	expires  time.Time
+}
+
+type restriction struct {
+	pattern []string
+	role    Role
+}
+
+// Configure sets up the identity providers. OIDC providers contact their issuer on first use.
+func Configure(cfg Config) error {
+	var list []Provider
+	if len(cfg.APIKeys) > 0 {
+		keys, err := newAPIKeys(cfg.APIKeys)
+		if err != nil {
+			return err
+		}
+		list = append(list, keys)
+	}
+	names := map[string]bool{apiKeysProvider: len(cfg.APIKeys) > 0}
+	for _, oc := range cfg.OIDC {
+		p, err := newOIDC(oc)
+		if err != nil {
+			return err
+		}
+		if names[p.Name()] {
+			return fmt.Errorf("duplicate identity provider %s", p.Name())
+		}
+		names[p.Name()] = true
+		list = append(list, p)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	providers = list
+	sessionTTL = defaultSessionLifetime
+	if cfg.SessionHours > 0 {
+		sessionTTL = time.Duration(cfg.SessionHours) * time.Hour
+	}
+	return nil
+}
+
+// Enabled reports whether any provider is configured, i.e. whether requests need to sign in
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(providers) > 0
+}
+
+// Public lets requests below prefix through without signing in
+func Public(prefix string) {
+	mu.Lock()
+	defer mu.Unlock()
+	public = append(public, prefix)
+}
+
+// Restrict requires at least role for paths matching pattern and anything below it,
+// whatever the method. "*" matches one path segment, e.g. "/devices/*/key".
+func Restrict(pattern string, role Role) {
+	mu.Lock()
+	defer mu.Unlock()
+	restricted = append(restricted, restriction{pattern: splitPath(pattern), role: role})
+}
+
+// Middleware authenticates admin requests and checks the caller's role: viewers may read,
+// operators may also make changes, and restricted routes need the role given to Restrict.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() || isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, ok, err := authenticate(r)
+		if err != nil {
+			admin.WriteError(w, http.StatusUnauthorized, "%v", err)
+			return
+		}
+		if !ok {
+			admin.WriteError(w, http.StatusUnauthorized, "sign in required")
+			return
+		}
+		if need := required(r); !id.Role.Allows(need) {
+			admin.WriteError(w, http.StatusForbidden, "%s requires the %s role", r.URL.Path, need)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			fmt.Printf("Admin: %s %s by %s (%s)\n", r.Method, r.URL.Path, id.display(), id.Provider)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// AuthenticateHeaders checks credentials passed as headers outside an HTTP request (e.g.
+// gRPC metadata): an API key or bearer token. ok is false when there are none.
+func AuthenticateHeaders(h http.Header) (id Identity, ok bool, err error) {
+	return authenticate(&http.Request{Header: h})
+}
+
+type identityKey struct{}
+
+// FromRequest returns the identity a request was made with; false if auth is disabled
+func FromRequest(r *http.Request) (Identity, bool) {
+	id, ok := r.Context().Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// SignedIn reports whether r comes from a signed-in caller, or auth is disabled. Public
+// routes use it to keep details for signed-in callers only.
+func SignedIn(r *http.Request) bool {
+	if !Enabled() {
+		return true
+	}
+	if _, ok := FromRequest(r); ok {
+		return true
+	}
+	_, ok, _ := authenticate(r)
+	return ok
+}
+
+func (id Identity) display() string {
+	if id.Email != "" {
+		return id.Email
+	}
+	if id.Name != "" {
+		return id.Name
+	}
+	return id.Subject
+}
+
+func isPublic(path string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, prefix := range public {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// required returns the least role allowed to make request r
+func required(r *http.Request) Role {
+	return Required(r.Method, r.URL.Path)
+}
+
+// Required returns the least role allowed to make a method request to path, e.g. for
+// callers reaching the same operation another way (gRPC)
+func Required(method string, path string) Role {
+	need := RoleOperator
+	if method == http.MethodGet || method == http.MethodHead {
+		need = RoleViewer
+	}
+	parts := splitPath(path)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, rule := range restricted {
+		if matchPath(rule.pattern, parts) && !need.Allows(rule.role) {
+			need = rule.role
+		}
+	}
+	return need
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// matchPath reports whether path is pattern or below it
+func matchPath(pattern []string, path []string) bool {
+	if len(path) < len(pattern) {
+		return false
+	}
+	for i, seg := range pattern {
+		if seg != "*" && seg != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate finds the caller from a session cookie or a provider's credentials
+func authenticate(r *http.Request) (Identity, bool, error) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		mu.Lock()
+		s := sessions[c.Value]
+		if s != nil && time.Now().After(s.expires) {
+			delete(sessions, c.Value)
+			s = nil
+		}
+		mu.Unlock()
+		if s != nil {
+			return s.identity, true, nil
+		}
+	}
+
+	mu.Lock()
+	list := append([]Provider(nil), providers...)
+	mu.Unlock()
+	var firstErr error
+	for _, p := range list {
+		id, ok, err := p.Authenticate(r)
+		if ok {
+			return id, true, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return Identity{}, false, firstErr
+}
+
+// Handler serves the sign-in routes below /auth/:
+//
+//	GET  /auth/providers           lists the providers people can log in with
+//	GET  /auth/login/<provider>    starts a login (?next=/path to return to afterwards)
+//	GET  /auth/callback/<provider> completes it and sets the session cookie
+//	GET  /auth/me                  returns the caller's identity
+//	POST /auth/logout              ends the session
+func Handler(w http.ResponseWriter, r *http.Request) {
+	parts := admin.PathParts(r.URL.Path, "/auth/")
+	switch {
+	case len(parts) == 1 && parts[0] == "providers" && r.Method == http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, loginProviderNames())
+	case len(parts) == 2 && parts[0] == "login" && r.Method == http.MethodGet:
+		startLogin(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "callback" && r.Method == http.MethodGet:
+		finishLogin(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "me" && r.Method == http.MethodGet:
+		if !Enabled() {
+			admin.WriteError(w, http.StatusNotFound, "sign-in is not enabled")
+			return
+		}
+		id, ok, err := authenticate(r)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("not signed in")
+			}
+			admin.WriteError(w, http.StatusUnauthorized, "%v", err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, id)
+	case len(parts) == 1 && parts[0] == "logout" && r.Method == http.MethodPost:
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			mu.Lock()
+			delete(sessions, c.Value)
+			mu.Unlock()
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.WriteError(w, http.StatusNotFound, "unknown auth route %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func loginProviderNames() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := []string{}
+	for _, p := range providers {
+		if _, ok := p.(LoginProvider); ok {
+			names = append(names, p.Name())
+		}
+	}
+	return names
+}
+
+func loginProvider(name string) LoginProvider {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range providers {
+		if lp, ok := p.(LoginProvider); ok && p.Name() == name {
+			return lp
+		}
+	}
+	return nil
+}
+
+func startLogin(w http.ResponseWriter, r *http.Request, name string) {
+	p := loginProvider(name)
+	if p == nil {
+		admin.WriteError(w, http.StatusNotFound, "unknown login provider %s", name)
+		return
+	}
+	state, nonce := randomToken(), randomToken()
+	target, err := p.LoginURL(state, nonce)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadGateway, "%v", err)
+		return
+	}
+
+	now := time.Now()
+	mu.Lock()
+	for s, l := range logins {
+		if now.After(l.expires) {
+			delete(logins, s)
+		}
+	}
+	logins[state] = &login{provider: name, nonce: nonce, next: localPath(r.URL.Query().Get("next")), expires: now.Add(loginTimeout)}
+	mu.Unlock()
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func finishLogin(w http.ResponseWriter, r *http.Request, name string) {
+	state := r.URL.Query().Get("state")
+	mu.Lock()
+	l := logins[state]
+	delete(logins, state)
+	mu.Unlock()
+	if l == nil || l.provider != name || time.Now().After(l.expires) {
+		admin.WriteError(w, http.StatusBadRequest, "login expired or not started here; try again")
+		return
+	}
+	p := loginProvider(name)
+	if p == nil {
+		admin.WriteError(w, http.StatusNotFound, "unknown login provider %s", name)
+		return
+	}
+	id, err := p.Finish(r, l.nonce)
+	if err != nil {
+		fmt.Printf("Auth: %s login failed: %v\n", name, err)
+		admin.WriteError(w, http.StatusForbidden, "%v", err)
+		return
+	}
+
+	token := randomToken()
+	mu.Lock()
+	expires := time.Now().Add(sessionTTL)
+	for t, s := range sessions {
+		if time.Now().After(s.expires) {
+			delete(sessions, t)
+		}
+	}
+	sessions[token] = &session{identity: id, expires: expires}
+	mu.Unlock()
+	fmt.Printf("Auth: %s signed in via %s as %s\n", id.display(), name, id.Role)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode, // Not sent on cross-site POSTs
+	})
+	http.Redirect(w, r, l.next, http.StatusFound)
+}
+
+// localPath keeps post-login redirects on this server
+func localPath(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || next == "" || u.IsAbs() || u.Host != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/auth/me"
+	}
+	return next
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("auth: no randomness: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig is an OpenID Connect identity provider, e.g. Google:
+//
+//	{"name": "google", "issuer": "https://accounts.google.com",
+//	 "clientId": "...", "clientSecret": "...",
+//	 "redirectUrl": "https://home.example.net/auth/callback/google",
+//	 "roles": {"alex@gmail.com": "admin", "@example.net": "viewer"}}
+//
+// Roles map verified email addresses, or "@domain" for a whole domain, to roles; anyone
+// else gets DefaultRole, and with none is refused.
+type OIDCConfig struct {
+	Name         string          `json:"name"`
+	Issuer       string          `json:"issuer"`
+	ClientID     string          `json:"clientId"`
+	ClientSecret string          `json:"clientSecret"`
+	RedirectURL  string          `json:"redirectUrl"` // This server's /auth/callback/<name> as the browser reaches it
+	Scopes       []string        `json:"scopes"`      // Requested in addition to openid (default email, profile)
+	Roles        map[string]Role `json:"roles"`
+	DefaultRole  Role            `json:"defaultRole"`
+}
+
+const (
+	oidcTimeout     = 10 * time.Second
+	discoveryMaxAge = 24 * time.Hour
+	keysMinRefresh  = time.Minute // Unknown signing keys refetch the key set at most this often
+	tokenLeeway     = time.Minute // Allowed clock difference with the issuer
+)
+
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	discovered time.Time
+	authURL    string
+	tokenURL   string
+	keysURL    string
+	keys       map[string]*rsa.PublicKey // By key ID
+	keysLoaded time.Time
+}
+
+func newOIDC(cfg OIDCConfig) (*oidcProvider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC provider needs a name, issuer, clientId and redirectUrl")
+	}
+	if cfg.DefaultRole != "" && !cfg.DefaultRole.Valid() {
+		return nil, fmt.Errorf("OIDC provider %s has unknown default role %q", cfg.Name, cfg.DefaultRole)
+	}
+	roles := make(map[string]Role, len(cfg.Roles))
+	for who, role := range cfg.Roles {
+		if !role.Valid() {
+			return nil, fmt.Errorf("OIDC provider %s maps %s to unknown role %q", cfg.Name, who, role)
+		}
+		roles[strings.ToLower(who)] = role
+	}
+	cfg.Roles = roles
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.cfg.Name
+}
+
+// Authenticate accepts an ID token from this issuer as a bearer token
+func (p *oidcProvider) Authenticate(r *http.Request) (Identity, bool, error) {
+	token := bearerToken(r)
+	if token == "" || !isJWT(token) {
+		return Identity{}, false, nil
+	}
+	claims, err := p.verify(token)
+	if err != nil {
+		if err == errOtherIssuer {
+			return Identity{}, false, nil // Another provider's token
+		}
+		return Identity{}, false, err
+	}
+	id, err := p.identity(claims)
+	if err != nil {
+		return Identity{}, false, err
+	}
+	return id, true, nil
+}
+
+func (p *oidcProvider) LoginURL(state string, nonce string) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {"openid " + strings.Join(p.cfg.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return p.authURL + sep + q.Encode(), nil
+}
+
+func (p *oidcProvider) Finish(r *http.Request, nonce string) (Identity, error) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return Identity{}, fmt.Errorf("%s refused the login: %s", p.cfg.Name, e)
+	}
+	code := q.Get("code")
+	if code == "" {
+		return Identity{}, fmt.Errorf("missing authorization code")
+	}
+	if err := p.discover(); err != nil {
+		return Identity{}, err
+	}
+
+	// Exchange the code for an ID token
+	p.mu.Lock()
+	tokenURL := p.tokenURL
+	p.mu.Unlock()
+	resp, err := p.client.PostForm(tokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("token exchange failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return Identity{}, fmt.Errorf("token response has no ID token")
+	}
+
+	claims, err := p.verify(tokens.IDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims.Nonce != nonce {
+		return Identity{}, fmt.Errorf("ID token nonce does not match the login")
+	}
+	return p.identity(claims)
+}
+
+// idClaims are the ID token claims used here
+type idClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      audience    `json:"aud"`
+	Expires       int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Some issuers send a string
+	Name          string      `json:"name"`
+}
+
+// audience is a single audience or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// identity maps verified claims to a role
+func (p *oidcProvider) identity(c idClaims) (Identity, error) {
+	id := Identity{Provider: p.cfg.Name, Subject: c.Subject, Name: c.Name}
+	verified := c.EmailVerified == true || c.EmailVerified == "true"
+	if c.Email != "" && verified {
+		id.Email = strings.ToLower(c.Email)
+		if role, ok := p.cfg.Roles[id.Email]; ok {
+			id.Role = role
+		} else if at := strings.LastIndex(id.Email, "@"); at >= 0 {
+			id.Role = p.cfg.Roles[id.Email[at:]]
+		}
+	}
+	if id.Role == "" {
+		id.Role = p.cfg.DefaultRole
+	}
+	if id.Role == "" {
+		who := c.Email
+		if who == "" {
+			who = c.Subject
+		}
+		return Identity{}, fmt.Errorf("%s is not allowed to sign in", who)
+	}
+	return id, nil
+}
+
+var errOtherIssuer = fmt.Errorf("token from another issuer")
+
+// verify checks an ID token's RS256 signature against the issuer's keys and its claims
+func (p *oidcProvider) verify(token string) (idClaims, error) {
+	var c idClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return c, fmt.Errorf("malformed ID token header: %v", err)
+	}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return c, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != p.cfg.Issuer {
+		return c, errOtherIssuer
+	}
+	if header.Alg != "RS256" {
+		return c, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return c, fmt.Errorf("malformed ID token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return c, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return c, fmt.Errorf("invalid ID token signature")
+	}
+
+	now := time.Now()
+	if c.Expires == 0 || now.After(time.Unix(c.Expires, 0).Add(tokenLeeway)) {
+		return c, fmt.Errorf("ID token expired")
+	}
+	if c.IssuedAt != 0 && time.Unix(c.IssuedAt, 0).After(now.Add(tokenLeeway)) {
+		return c, fmt.Errorf("ID token issued in the future")
+	}
+	for _, aud := range c.Audience {
+		if aud == p.cfg.ClientID {
+			return c, nil
+		}
+	}
+	return c, fmt.Errorf("ID token is for another client")
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// discover looks up the issuer's endpoints, at most once a day
+func (p *oidcProvider) discover() error {
+	p.mu.Lock()
+	fresh := !p.discovered.IsZero() && time.Since(p.discovered) < discoveryMaxAge
+	p.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		KeysURL  string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return fmt.Errorf("%s discovery failed: %v", p.cfg.Name, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.cfg.Issuer || doc.AuthURL == "" || doc.TokenURL == "" || doc.KeysURL == "" {
+		return fmt.Errorf("%s discovery document is incomplete or for issuer %q", p.cfg.Name, doc.Issuer)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authURL, p.tokenURL, p.keysURL = doc.AuthURL, doc.TokenURL, doc.KeysURL
+	p.discovered = time.Now()
+	return nil
+}
+
+// key returns the issuer's signing key, refetching the key set for an unknown key ID
+// (issuers rotate keys)
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key := p.keys[kid]
+	stale := time.Since(p.keysLoaded) >= keysMinRefresh
+	p.mu.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	keysURL := p.keysURL
+	p.mu.Unlock()
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(keysURL, &set); err != nil {
+		return nil, fmt.Errorf("%s signing keys unavailable: %v", p.cfg.Name, err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.keysLoaded = time.Now()
+	if key = keys[kid]; key == nil {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
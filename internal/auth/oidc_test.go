@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://issuer.example"
+
+// testProvider has its signing key already loaded, so it never contacts the issuer
+func testProvider(t *testing.T) (*oidcProvider, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newOIDC(OIDCConfig{
+		Name: "test", Issuer: testIssuer + "/", ClientID: "cds", RedirectURL: "https://home.example/auth/callback/test",
+		Roles: map[string]Role{"Alex@Example.net": RoleAdmin, "@example.net": RoleViewer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.keys = map[string]*rsa.PublicKey{"k1": &key.PublicKey}
+	p.keysLoaded = time.Now()
+	return p, key
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func claims(changes map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss": testIssuer, "sub": "1234", "aud": []string{"other", "cds"},
+		"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+		"email": "alex@example.net", "email_verified": true,
+	}
+	for k, v := range changes {
+		c[k] = v
+	}
+	return c
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p, key := testProvider(t)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	if _, err := p.verify(signToken(t, key, "k1", claims(nil))); err != nil {
+		t.Errorf("valid token refused: %v", err)
+	}
+	if _, err := p.verify(signToken(t, key, "k1", claims(map[string]interface{}{"iss": "https://elsewhere"}))); err != errOtherIssuer {
+		t.Errorf("token from another issuer: got %v", err)
+	}
+
+	cases := map[string]string{
+		"wrong key":      signToken(t, other, "k1", claims(nil)),
+		"expired":        signToken(t, key, "k1", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"no expiry":      signToken(t, key, "k1", claims(map[string]interface{}{"exp": 0})),
+		"future":         signToken(t, key, "k1", claims(map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()})),
+		"other audience": signToken(t, key, "k1", claims(map[string]interface{}{"aud": "other"})),
+		"unknown key":    signToken(t, key, "k2", claims(nil)),
+		"malformed":      "a.b.c",
+	}
+	for name, token := range cases {
+		if _, err := p.verify(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	p, key := testProvider(t)
+	cases := []struct {
+		changes map[string]interface{}
+		role    Role
+	}{
+		{nil, RoleAdmin},
+		{map[string]interface{}{"email": "sam@example.net"}, RoleViewer},
+		{map[string]interface{}{"email": "sam@example.net", "email_verified": "true"}, RoleViewer},
+		{map[string]interface{}{"email": "sam@example.net", "email_verified": false}, ""},
+		{map[string]interface{}{"email": "sam@elsewhere.net"}, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		r.Header.Set("Authorization", "Bearer "+signToken(t, key, "k1", claims(c.changes)))
+		id, ok, err := p.Authenticate(r)
+		if c.role == "" {
+			if ok || err == nil {
+				t.Errorf("%v: signed in as %+v", c.changes, id)
+			}
+		} else if !ok || err != nil || id.Role != c.role {
+			t.Errorf("%v: got %+v, %v (%v), want role %s", c.changes, id, ok, err, c.role)
+		}
+	}
+
+	// API keys are not ID tokens
+	r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	if _, ok, err := p.Authenticate(r); ok || err != nil {
+		t.Errorf("API key handled by OIDC: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,372 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"server_app/internal/messaging"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Mirrors selected topics between the local broker and a cloud broker (AWS IoT, HiveMQ
+// Cloud, ...) over a separate outbound connection, so device status can be followed from
+// anywhere without exposing the local broker. Cloud topics are the local ones under a
+// prefix (e.g. "weather/97201" <-> "home/cds/weather/97201").
+//
+// Inbound topics must be named exactly (no wildcards), and topics the server treats as
+// device commands or device traffic (set with SetProtectedTopics) are never bridged inward,
+// so cloud clients can't drive devices or the server through the local broker.
+//
+// A topic bridged both ways would bounce forever: every message forwarded is remembered
+// briefly, and the copy coming back from the other broker is dropped instead of forwarded.
+
+// Directions a topic is bridged in
+const (
+	DirectionOut  = "out"  // Local to cloud (default)
+	DirectionIn   = "in"   // Cloud to local
+	DirectionBoth = "both" // Both ways
+)
+
+// Config selects the cloud broker and the topics to mirror
+type Config struct {
+	MQTT   messaging.Config `json:"mqtt"`   // Cloud broker URL(s) and credentials; TLS is on unless disabled
+	Prefix string           `json:"prefix"` // Prepended to local topics on the cloud broker, e.g. "home/cds/"
+	Topics []Topic          `json:"topics"`
+}
+
+// Topic is a local topic filter to mirror
+type Topic struct {
+	Filter    string `json:"filter"`    // MQTT wildcards allowed for "out" only
+	Direction string `json:"direction"` // "out", "in" or "both" ("" = out)
+	QoS       byte   `json:"qos"`       // 0 or 1
+	Retain    bool   `json:"retain"`    // Publish to the cloud retained (so status is there on subscribe)
+}
+
+// Status of the bridge as reported to the admin interface
+type Status struct {
+	Enabled   bool      `json:"enabled"`
+	Connected bool      `json:"connected"`
+	Broker    string    `json:"broker,omitempty"`
+	Sent      uint64    `json:"sent"`     // Messages forwarded to the cloud
+	Received  uint64    `json:"received"` // Messages forwarded from the cloud
+	Looped    uint64    `json:"looped"`   // Echoes of forwarded messages dropped
+	LastError string    `json:"last_error,omitempty"`
+	ErrorTime time.Time `json:"error_time,omitempty"`
+}
+
+const (
+	echoWindow     = 30 * time.Second // Forwarded messages are recognized coming back this long
+	forwardBuffer  = 256              // Messages queued per direction before new ones are dropped
+	publishTimeout = 10 * time.Second
+)
+
+type message struct {
+	topic    string
+	payload  []byte
+	retained bool // Inbound: as received from the cloud broker
+	rule     Topic
+}
+
+var (
+	mu     sync.Mutex
+	config Config
+	cloud  MQTT.Client
+	status Status
+	// Hashes of recently forwarded messages, per destination
+	sentCloud = make(map[uint64]time.Time)
+	sentLocal = make(map[uint64]time.Time)
+	// Latest message per topic for retained topics, sent again on every connect so the
+	// cloud has current status even if it changed while disconnected
+	latest   = make(map[string]message)
+	outbound = make(chan message, forwardBuffer)
+	inbound  = make(chan message, forwardBuffer)
+	// Local topics that must not be published to from the cloud
+	protected func(topic string) bool
+)
+
+// SetProtectedTopics registers which local topics may never be bridged inward (device
+// command, config and OTA topics, server control). Checked at Start and per message,
+// since device topics appear as devices boot.
+func SetProtectedTopics(fn func(topic string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	protected = fn
+}
+
+// isProtected reports whether a local topic may not be published to from the cloud
+func isProtected(topic string) bool {
+	mu.Lock()
+	fn := protected
+	mu.Unlock()
+	return fn != nil && fn(topic)
+}
+
+// Enabled reports whether a cloud broker and topics to mirror are configured
+func (c Config) Enabled() bool {
+	return len(c.MQTT.Brokers) > 0 && len(c.Topics) > 0
+}
+
+// Validate checks the config
+func (c Config) Validate() error {
+	if err := c.MQTT.Validate(); err != nil {
+		return err
+	}
+	if c.MQTT.InMemory() {
+		return fmt.Errorf("the bridge needs a network broker")
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, "/") {
+		return fmt.Errorf("bridge prefix %q must end with /", c.Prefix)
+	}
+	for _, t := range c.Topics {
+		if t.Filter == "" {
+			return fmt.Errorf("bridge topic needs a filter")
+		}
+		switch t.Direction {
+		case "", DirectionOut, DirectionIn, DirectionBoth:
+		default:
+			return fmt.Errorf("bridge topic %s has unknown direction %q", t.Filter, t.Direction)
+		}
+		if t.QoS > 1 {
+			return fmt.Errorf("bridge topic %s qos must be 0 or 1", t.Filter)
+		}
+		if t.inbound() && strings.ContainsAny(t.Filter, "+#") {
+			return fmt.Errorf("bridge topic %s is bridged inward and must name one topic, without wildcards", t.Filter)
+		}
+	}
+	return nil
+}
+
+func (t Topic) inbound() bool {
+	return t.Direction == DirectionIn || t.Direction == DirectionBoth
+}
+
+// Start connects to the cloud broker and begins mirroring
+func Start(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	for _, t := range c.Topics {
+		if t.inbound() && isProtected(t.Filter) {
+			return fmt.Errorf("bridge topic %s carries device or server commands and can't be bridged inward", t.Filter)
+		}
+	}
+
+	opts := MQTT.NewClientOptions()
+	for _, broker := range c.MQTT.Brokers {
+		opts.AddBroker(broker)
+	}
+	clientID := c.MQTT.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "cds-bridge-" + hostname
+	}
+	opts.SetClientID(clientID)
+	if c.MQTT.TLSEnabled() {
+		tlsConfig, err := c.MQTT.ClientTLSConfig()
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if c.MQTT.Username != "" {
+		opts.SetUsername(c.MQTT.Username)
+		opts.SetPassword(c.MQTT.Password)
+	}
+	opts.SetCleanSession(true)
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectTimeout(10 * time.Second)
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		fmt.Printf("Bridge: lost cloud broker connection: %v\n", err)
+		noteError(err)
+	})
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		mu.Lock()
+		status.Broker = redact(broker)
+		mu.Unlock()
+		return tlsCfg
+	})
+	opts.OnConnect = func(client MQTT.Client) {
+		fmt.Printf("Bridge: connected to cloud broker %s\n", GetStatus().Broker)
+		subscribeCloud(client)
+		mu.Lock()
+		for _, m := range latest {
+			enqueue(outbound, m)
+		}
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	config = c
+	status.Enabled = true
+	cloud = MQTT.NewClient(opts)
+	client := cloud
+	mu.Unlock()
+
+	go forwardOut()
+	go forwardIn()
+	for _, t := range c.Topics {
+		if t.Direction == "" || t.Direction == DirectionOut || t.Direction == DirectionBoth {
+			rule := t
+			messaging.Tap(t.Filter, func(topic string, payload []byte) {
+				enqueue(outbound, message{topic: topic, payload: append([]byte(nil), payload...), rule: rule})
+			})
+		}
+	}
+
+	// With connect retry paho keeps trying in the background
+	go func() {
+		token := client.Connect()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			fmt.Printf("Bridge: cloud broker connect error: %v\n", err)
+			noteError(err)
+		}
+	}()
+	fmt.Printf("Bridge: mirroring %d topic filter(s) under %q\n", len(c.Topics), c.Prefix)
+	return nil
+}
+
+// GetStatus returns the bridge's connection and counters
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	s := status
+	if cloud != nil {
+		s.Connected = cloud.IsConnectionOpen()
+	}
+	return s
+}
+
+// Subscribe on the cloud broker to every topic bridged inward (again after each reconnect)
+func subscribeCloud(client MQTT.Client) {
+	mu.Lock()
+	prefix, topics := config.Prefix, config.Topics
+	mu.Unlock()
+	for _, t := range topics {
+		if !t.inbound() {
+			continue
+		}
+		rule := t
+		token := client.Subscribe(prefix+t.Filter, t.QoS, func(_ MQTT.Client, m MQTT.Message) {
+			local := strings.TrimPrefix(m.Topic(), prefix)
+			enqueue(inbound, message{topic: local, payload: append([]byte(nil), m.Payload()...), retained: m.Retained(), rule: rule})
+		})
+		token.Wait()
+		if err := token.Error(); err != nil {
+			fmt.Printf("Bridge: failed to subscribe to %s on the cloud broker: %v\n", prefix+t.Filter, err)
+			noteError(err)
+		}
+	}
+}
+
+func enqueue(queue chan message, m message) {
+	select {
+	case queue <- m:
+	default:
+		fmt.Printf("Bridge: queue full, dropped message on %s\n", m.topic)
+	}
+}
+
+// Forward local messages to the cloud, skipping ones that just came from there
+func forwardOut() {
+	for m := range outbound {
+		if isEcho(sentLocal, m) {
+			continue
+		}
+		mu.Lock()
+		client, prefix := cloud, config.Prefix
+		remember(sentCloud, m)
+		if m.rule.Retain {
+			latest[m.topic] = m
+		}
+		mu.Unlock()
+		if !client.IsConnectionOpen() {
+			continue // Retained topics are sent on connect; other messages are only live updates
+		}
+		token := client.Publish(prefix+m.topic, m.rule.QoS, m.rule.Retain, m.payload)
+		if !token.WaitTimeout(publishTimeout) {
+			noteError(fmt.Errorf("publish to %s timed out", prefix+m.topic))
+			continue
+		}
+		if err := token.Error(); err != nil {
+			noteError(err)
+			continue
+		}
+		mu.Lock()
+		status.Sent++
+		mu.Unlock()
+	}
+}
+
+// Forward cloud messages to the local broker, skipping ones that just went there
+func forwardIn() {
+	for m := range inbound {
+		if isEcho(sentCloud, m) {
+			continue
+		}
+		if m.topic != m.rule.Filter || isProtected(m.topic) {
+			fmt.Printf("Bridge: dropped cloud message for protected topic %s\n", m.topic)
+			continue
+		}
+		mu.Lock()
+		remember(sentLocal, m)
+		status.Received++
+		mu.Unlock()
+		messaging.PublishRaw(m.topic, m.rule.QoS, m.retained, m.payload)
+	}
+}
+
+func messageHash(m message) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.topic))
+	h.Write([]byte{0})
+	h.Write(m.payload)
+	return h.Sum64()
+}
+
+// remember records a forwarded message and forgets expired ones. Caller holds mu.
+func remember(sent map[uint64]time.Time, m message) {
+	now := time.Now()
+	for hash, at := range sent {
+		if now.Sub(at) > echoWindow {
+			delete(sent, hash)
+		}
+	}
+	sent[messageHash(m)] = now
+}
+
+// isEcho reports (and forgets) a message recently forwarded to where m came from
+func isEcho(sent map[uint64]time.Time, m message) bool {
+	hash := messageHash(m)
+	mu.Lock()
+	defer mu.Unlock()
+	at, exists := sent[hash]
+	if !exists || time.Since(at) > echoWindow {
+		return false
+	}
+	delete(sent, hash)
+	status.Looped++
+	return true
+}
+
+func noteError(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	status.LastError = err.Error()
+	status.ErrorTime = time.Now()
+}
+
+// redact drops credentials from a broker URL for logs and status
+func redact(u *url.URL) string {
+	c := *u
+	c.User = nil
+	return c.String()
+}
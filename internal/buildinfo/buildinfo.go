@@ -0,0 +1,60 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// The server's own version. Version is stamped at link time:
+//
+//	go build -ldflags "-X server_app/internal/buildinfo.Version=1.4.0"
+//
+// and the commit and build state come from the Go toolchain's VCS stamping.
+
+// Version of the server ("dev" when not stamped)
+var Version = "dev"
+
+// Info describes the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	CommitAt  string `json:"commit_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the running binary's build information
+func Get() Info {
+	info := Info{Version: Version, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range build.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.CommitAt = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// String is the version with a short commit, e.g. "1.4.0 (3f2a9c1d0b7e, modified)"
+func (i Info) String() string {
+	s := i.Version
+	if i.Commit != "" {
+		commit := i.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if i.Modified {
+			commit += ", modified"
+		}
+		s += " (" + commit + ")"
+	}
+	return s
+}
@@ -0,0 +1,192 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"server_app/internal/logfile"
+	"server_app/internal/messaging"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic capture: while on, every message matching a wildcard filter is written to a
+// rotating file with a timestamp, the topic, a decoded summary and a hex dump, so protocol
+// issues can be reproduced without running mosquitto_sub by hand. Messages the server
+// publishes on subscribed topics are echoed back by the broker and captured too.
+
+// Config for traffic capture
+type Config struct {
+	Enabled   bool   `json:"enabled"`   // Capture from startup
+	Filter    string `json:"filter"`    // MQTT filter to capture ("" = "#")
+	MaxSizeMB int    `json:"maxSizeMB"` // Rotate the file once it reaches this size (0 = 10)
+	MaxFiles  int    `json:"maxFiles"`  // Rotated files kept (0 = 3)
+}
+
+// Status of the capture
+type Status struct {
+	Active   bool      `json:"active"`
+	Filter   string    `json:"filter,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Messages uint64    `json:"messages"` // Captured since started
+	Bytes    uint64    `json:"bytes"`    // Payload bytes captured since started
+}
+
+const (
+	defaultFilter    = "#"
+	defaultMaxSizeMB = 10
+	defaultMaxFiles  = 3
+)
+
+var (
+	mu     sync.Mutex
+	dir    string
+	name   string
+	config Config
+	writer *logfile.Writer
+	cancel func()
+	status Status
+)
+
+// Configure sets where capture files go and the defaults Start uses. With captureDir ""
+// nothing may be written and Start fails.
+func Configure(captureDir string, fileName string, c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	dir, name, config = captureDir, fileName, c
+}
+
+// Start captures messages matching filter ("" = configured filter), replacing any running capture
+func Start(filter string) error {
+	mu.Lock()
+	if filter == "" {
+		filter = config.Filter
+	}
+	if filter == "" {
+		filter = defaultFilter
+	}
+	maxSizeMB, maxFiles := config.MaxSizeMB, config.MaxFiles
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+	captureDir, fileName := dir, name
+	mu.Unlock()
+
+	if captureDir == "" {
+		return fmt.Errorf("capture files are disabled")
+	}
+	if err := validFilter(filter); err != nil {
+		return err
+	}
+	w, err := logfile.Open(captureDir, fileName, int64(maxSizeMB)<<20, maxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %v", err)
+	}
+	Stop()
+
+	mu.Lock()
+	writer = w
+	status = Status{Active: true, Filter: filter, File: captureDir + "/" + fileName, Started: time.Now()}
+	fmt.Fprintf(writer, "# %s capture started, filter %s\n", status.Started.Format(time.RFC3339Nano), filter)
+	mu.Unlock()
+
+	// Subscribing and unsubscribing wait on the broker, which can't deliver while a
+	// message handler is blocked on mu, so taps are added and removed without holding it
+	stop := messaging.Tap(filter, func(topic string, payload []byte) { write(w, topic, payload) })
+	mu.Lock()
+	if writer == w {
+		cancel = stop
+		stop = nil
+	}
+	mu.Unlock()
+	if stop != nil {
+		stop() // Stopped while subscribing
+		return nil
+	}
+	fmt.Printf("Capturing MQTT traffic on %s to %s\n", filter, captureDir+"/"+fileName)
+	return nil
+}
+
+// Stop ends the capture, if running
+func Stop() {
+	mu.Lock()
+	stop := cancel
+	cancel = nil
+	if writer != nil {
+		fmt.Fprintf(writer, "# %s capture stopped\n", time.Now().Format(time.RFC3339Nano))
+		writer.Close()
+		writer = nil
+		fmt.Printf("MQTT capture stopped after %d message(s)\n", status.Messages)
+	}
+	status.Active = false
+	mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// GetStatus returns the capture status
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	return status
+}
+
+// write appends one message, unless the capture it was tapped for has been stopped
+func write(w *logfile.Writer, topic string, payload []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s (%d bytes) %s\n", time.Now().Format(time.RFC3339Nano), topic, len(payload), summary(payload))
+	for _, line := range strings.Split(strings.TrimRight(hex.Dump(payload), "\n"), "\n") {
+		if line != "" {
+			b.WriteString("    " + line + "\n")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if writer != w {
+		return
+	}
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		fmt.Printf("Warning: failed to write MQTT capture: %v\n", err)
+		return
+	}
+	status.Messages++
+	status.Bytes += uint64(len(payload))
+}
+
+// summary decodes binary protocol messages; other payloads (JSON bootups, LWT names) are
+// shown as text when printable
+func summary(payload []byte) string {
+	if _, _, err := messaging.DecodeMessage(payload); err == nil {
+		return messaging.Describe(payload)
+	}
+	text := string(payload)
+	for _, r := range text {
+		if r < 0x20 || r == 0x7F || r == 0xFFFD {
+			return "(undecodable)"
+		}
+	}
+	if len(text) > 120 {
+		text = text[:120] + "..."
+	}
+	return fmt.Sprintf("%q", text)
+}
+
+// validFilter checks MQTT wildcard placement: "+" fills a whole level, "#" only ends the filter
+func validFilter(filter string) error {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1,
+			level != "#" && level != "+" && strings.ContainsAny(level, "#+"):
+			return fmt.Errorf("invalid MQTT filter %q", filter)
+		}
+	}
+	return nil
+}
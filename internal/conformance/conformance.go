@@ -0,0 +1,239 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"server_app/internal/etchsketch"
+	"server_app/internal/messaging"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Protocol conformance runs for firmware CI: the server sends a device every message type
+// with known payloads, the device (or its test harness) submits the fields it decoded per
+// case, and the server grades them against the values it encoded.
+
+var ErrUnknownSession = errors.New("unknown conformance session")
+
+// Sessions are forgotten this long after they start
+const sessionTTL = time.Hour
+
+// Case is one scripted message and the fields a correct decoder reports for it.
+// Field values are decimal integers, "true"/"false", or the raw string.
+type Case struct {
+	Name    string            `json:"name"`
+	Type    uint8             `json:"type"`
+	Fields  []string          `json:"fields"` // Fields to report for the case
+	Message []byte            `json:"-"`
+	Expect  map[string]string `json:"-"`
+}
+
+// Session is one conformance run against a device
+type Session struct {
+	ID      string    `json:"id"`
+	Device  string    `json:"device"`
+	Topic   string    `json:"topic"`
+	Started time.Time `json:"started"`
+	Cases   []Case    `json:"cases"` // In the order the messages are sent
+	Report  *Report   `json:"report,omitempty"`
+}
+
+// Mismatch is one field decoded differently from what was sent
+type Mismatch struct {
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"` // "" if the field was not reported
+}
+
+// CaseResult grades one case
+type CaseResult struct {
+	Name       string     `json:"name"`
+	Passed     bool       `json:"passed"`
+	Missing    bool       `json:"missing,omitempty"` // No result submitted for the case
+	Mismatches []Mismatch `json:"mismatches,omitempty"`
+}
+
+// Report is the graded outcome of a session
+type Report struct {
+	Session    string       `json:"session"`
+	Device     string       `json:"device"`
+	Conformant bool         `json:"conformant"`
+	Passed     int          `json:"passed"`
+	Failed     int          `json:"failed"`
+	Missing    int          `json:"missing"`
+	Cases      []CaseResult `json:"cases"`
+}
+
+var (
+	mu       sync.Mutex
+	sessions = make(map[string]*Session)
+	nextID   uint64
+)
+
+// Cases returns the scripted messages, one or more per server → device message type
+func Cases() []Case {
+	cases := []Case{
+		{Name: "current_weather", Message: messaging.EncodeCurrentWeather(-5),
+			Expect: fields("temp", -5, "flags", 0)},
+		{Name: "current_weather_flagged", Message: messaging.WithWeatherFlags(messaging.EncodeCurrentWeather(72), messaging.WEATHER_FLAG_STALE|messaging.WEATHER_FLAG_INTERPOLATED),
+			Expect: fields("temp", 72, "flags", 5)},
+		{Name: "current_weather_v2", Message: messaging.EncodeCurrentWeatherV2(messaging.CurrentWeatherV2{Temp: -5, Condition: messaging.WEATHER_COND_SNOW, Humidity: 85, WindSpeed: 12, WindDir: 14}),
+			Expect: fields("temp", -5, "condition", 7, "humidity", 85, "wind_speed", 12, "wind_dir", 14, "flags", 0)},
+		{Name: "forecast", Message: messaging.EncodeForecast([]messaging.ForecastDay{{HighTemp: 81, Precip: 20, Moon: 3}, {HighTemp: 64, Precip: 90, Moon: 4}, {HighTemp: 70, Precip: 0, Moon: 5}}),
+			Expect: fields("days", 3, "day0_high", 81, "day0_precip", 20, "day0_moon", 3,
+				"day1_high", 64, "day1_precip", 90, "day1_moon", 4, "day2_high", 70, "day2_precip", 0, "day2_moon", 5, "flags", 0)},
+		{Name: "forecast_v2", Message: messaging.EncodeForecastV2([]messaging.ForecastDayV2{{HighTemp: -2, LowTemp: -15, Precip: 40, Moon: 0}, {HighTemp: 28, LowTemp: 9, Precip: 0, Moon: 2}}),
+			Expect: fields("days", 2, "day0_high", -2, "day0_low", -15, "day0_precip", 40, "day0_moon", 0,
+				"day1_high", 28, "day1_low", 9, "day1_precip", 0, "day1_moon", 2, "flags", 0)},
+		{Name: "weather_unavailable", Message: messaging.EncodeWeatherUnavailable(messaging.MSG_FORECAST_WEATHER),
+			Expect: fields("weather_type", 2)},
+		{Name: "version", Message: messaging.EncodeVersion(513),
+			Expect: fields("version", 513)},
+		{Name: "indicator", Message: messaging.EncodeIndicator(3, true),
+			Expect: fields("id", 3, "on", true)},
+		{Name: "household_summary", Message: messaging.EncodeHouseholdSummary(messaging.HouseholdSummary{OnlineDevices: 4, HasTemps: true, MinIndoorTemp: -3, MaxIndoorTemp: 24}),
+			Expect: fields("online", 4, "has_temps", true, "has_doors", false, "min_temp", -3, "max_temp", 24)},
+		{Name: "weather_mood", Message: messaging.EncodeWeatherMood(10, 120, 250, 2, 1500),
+			Expect: fields("r", 10, "g", 120, "b", 250, "animation", 2, "period_ms", 1500)},
+		{Name: "config_read", Message: messaging.EncodeConfigRead(0x1234),
+			Expect: fields("request_id", 0x1234)},
+		{Name: "time", Message: messaging.EncodeTime(time.Unix(1700000000, 0).In(time.FixedZone("", -6*3600))),
+			Expect: fields("epoch", 1700000000, "utc_offset_minutes", -360)},
+		{Name: "clock_change", Message: messaging.EncodeClockChange(time.Unix(1793516400, 0), -6*3600),
+			Expect: fields("epoch", 1793516400, "utc_offset_minutes", -360)},
+		{Name: "server_shutdown", Message: messaging.EncodeServerShutdown(2 * time.Minute),
+			Expect: fields("downtime_seconds", 120)},
+	}
+
+	config, _ := messaging.EncodeConfigPairs(map[string]string{"brightness": "40", "theme": "none"})
+	delta, _ := messaging.EncodeConfigDelta(map[string]string{"theme": ""})
+	cases = append(cases,
+		Case{Name: "device_config", Message: config, Expect: fields("count", 2, "str0", "brightness=40", "str1", "theme=none")},
+		Case{Name: "config_delta", Message: delta, Expect: fields("count", 1, "str0", "theme=")},
+	)
+
+	// Canvas frames: a diagonal in red, a box outline in green, one lit row in blue
+	var red, green, blue [16]uint16
+	for i := 0; i < 16; i++ {
+		red[i] = 1 << uint(i)
+		green[i] = 0x8001
+	}
+	green[0], green[15] = 0xFFFF, 0xFFFF
+	blue[7] = 0x0FF0
+	canvas := etchsketch.NewCanvas()
+	canvas.SetState(4242, red, green, blue)
+	frameFields := fields("seq", 4242, "red0", 1, "red15", 0x8000, "green0", 0xFFFF, "green1", 0x8001, "blue7", 0x0FF0, "blue8", 0)
+	cases = append(cases,
+		Case{Name: "etch_frame", Message: canvas.EncodeFullFrame(), Expect: frameFields},
+		Case{Name: "etch_calibrated_frame", Message: etchsketch.EncodeCalibratedFrame(4242, red, green, blue, [3]uint8{255, 180, 0}),
+			Expect: fields("seq", 4242, "red0", 1, "green0", 0xFFFF, "blue7", 0, "red_level", 255, "green_level", 180, "blue_level", 0)},
+	)
+
+	// E-paper screen: a 16x2 bitmap in one chunk
+	screen, _ := messaging.EncodeScreenChunks(77, 16, 2, []byte{0xF0, 0x0F, 0x81, 0x18}, messaging.PROTOCOL_V1)
+	cases = append(cases, Case{Name: "screen_chunk", Message: screen[0],
+		Expect: fields("screen_id", 77, "width", 16, "height", 2, "chunk_index", 0, "chunk_count", 1,
+			"byte0", 0xF0, "byte1", 0x0F, "byte2", 0x81, "byte3", 0x18)})
+
+	notification, _ := messaging.EncodeNotification(80, 20*time.Second, "Door open")
+	cases = append(cases, Case{Name: "notification", Message: notification,
+		Expect: fields("priority", 80, "duration_seconds", 20, "text", "Door open")})
+
+	for i := range cases {
+		cases[i].Type = cases[i].Message[0]
+		for field := range cases[i].Expect {
+			cases[i].Fields = append(cases[i].Fields, field)
+		}
+		sort.Strings(cases[i].Fields)
+	}
+	return cases
+}
+
+// fields builds an expectation map from alternating names and values
+func fields(kv ...interface{}) map[string]string {
+	m := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		m[kv[i].(string)] = fmt.Sprint(kv[i+1])
+	}
+	return m
+}
+
+// Start opens a session for device whose messages go to topic
+func Start(device string, topic string) Session {
+	mu.Lock()
+	defer mu.Unlock()
+
+	expireLocked()
+	nextID++
+	s := &Session{
+		ID:      strconv.FormatUint(nextID, 10),
+		Device:  device,
+		Topic:   topic,
+		Started: time.Now(),
+		Cases:   Cases(),
+	}
+	sessions[s.ID] = s
+	return *s
+}
+
+// Get returns a session by id
+func Get(id string) (Session, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	expireLocked()
+	s, exists := sessions[id]
+	if !exists {
+		return Session{}, false
+	}
+	return *s, true
+}
+
+// Grade compares the decoded fields submitted per case name with what was sent
+func Grade(id string, results map[string]map[string]string) (Report, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	expireLocked()
+	s, exists := sessions[id]
+	if !exists {
+		return Report{}, ErrUnknownSession
+	}
+
+	report := Report{Session: s.ID, Device: s.Device}
+	for _, c := range s.Cases {
+		result := CaseResult{Name: c.Name}
+		got, submitted := results[c.Name]
+		if !submitted {
+			result.Missing = true
+			report.Missing++
+			report.Cases = append(report.Cases, result)
+			continue
+		}
+
+		for _, field := range c.Fields {
+			if got[field] != c.Expect[field] {
+				result.Mismatches = append(result.Mismatches, Mismatch{Field: field, Expected: c.Expect[field], Got: got[field]})
+			}
+		}
+		result.Passed = len(result.Mismatches) == 0
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Cases = append(report.Cases, result)
+	}
+	report.Conformant = report.Failed == 0 && report.Missing == 0
+	s.Report = &report
+	return report, nil
+}
+
+// expireLocked drops sessions past their TTL. Caller holds mu.
+func expireLocked() {
+	for id, s := range sessions {
+		if time.Since(s.Started) > sessionTTL {
+			delete(sessions, id)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package deadletter
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages the server received but could not decode. A malformed payload otherwise leaves
+// only a one-line log, so the raw bytes are kept here (the most recent Capacity messages)
+// to debug device encoders from what was actually sent, and failures are counted per topic.
+
+// Entry is one undecodable message
+type Entry struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Topic     string    `json:"topic"`
+	Device    string    `json:"device,omitempty"` // When known from the topic
+	Error     string    `json:"error"`
+	Size      int       `json:"size"`
+	Payload   string    `json:"payload"`             // Hex, at most MaxPayload bytes
+	Truncated bool      `json:"truncated,omitempty"` // Payload was cut at MaxPayload bytes
+}
+
+// TopicCount is the number of undecodable messages seen on a topic since startup
+type TopicCount struct {
+	Topic string    `json:"topic"`
+	Count uint64    `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+const (
+	// Entries kept; older ones are dropped (counts are kept regardless)
+	Capacity = 200
+	// Payload bytes kept per entry
+	MaxPayload = 1024
+)
+
+var (
+	mu      sync.Mutex
+	entries []Entry // Oldest first
+	nextID  = uint64(1)
+	counts  = make(map[string]*TopicCount)
+)
+
+// Record stores a message that failed to decode with err
+func Record(topic string, device string, payload []byte, err error) {
+	e := Entry{Time: time.Now(), Topic: topic, Device: device, Size: len(payload)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	kept := payload
+	if len(kept) > MaxPayload {
+		kept, e.Truncated = kept[:MaxPayload], true
+	}
+	e.Payload = hex.EncodeToString(kept)
+
+	mu.Lock()
+	defer mu.Unlock()
+	e.ID = nextID
+	nextID++
+	entries = append(entries, e)
+	if len(entries) > Capacity {
+		entries = append([]Entry(nil), entries[len(entries)-Capacity:]...)
+	}
+	c := counts[topic]
+	if c == nil {
+		c = &TopicCount{Topic: topic}
+		counts[topic] = c
+	}
+	c.Count++
+	c.Last = e.Time
+}
+
+// Entries returns kept messages, newest first; topic "" matches every topic, limit 0 = all
+func Entries(topic string, limit int) []Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	list := []Entry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if topic != "" && entries[i].Topic != topic {
+			continue
+		}
+		list = append(list, entries[i])
+		if limit > 0 && len(list) == limit {
+			break
+		}
+	}
+	return list
+}
+
+// Get returns a kept message by ID
+func Get(id uint64) (Entry, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Counts returns the failures seen per topic since startup, by topic
+func Counts() []TopicCount {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]TopicCount, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Topic < list[j].Topic })
+	return list
+}
+
+// Total returns the number of undecodable messages seen since startup
+func Total() uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+	var total uint64
+	for _, c := range counts {
+		total += c.Count
+	}
+	return total
+}
+
+// Clear drops the kept messages; counts keep running
+func Clear() {
+	mu.Lock()
+	defer mu.Unlock()
+	entries = nil
+}
@@ -0,0 +1,69 @@
+package devices
+
+import (
+	"fmt"
+	"math"
+)
+
+// Calibration corrects a device's LED panel so shared drawings look the same everywhere
+// Gains balance the channels against each other; MaxBrightness caps overall output.
+type Calibration struct {
+	Gamma         float64 `json:"gamma"`          // Panel gamma (1.0 = linear)
+	MaxBrightness uint8   `json:"max_brightness"` // Brightness of a fully lit channel at gain 1.0
+	RedGain       float64 `json:"red_gain"`       // 0.0-1.0
+	GreenGain     float64 `json:"green_gain"`     // 0.0-1.0
+	BlueGain      float64 `json:"blue_gain"`      // 0.0-1.0
+}
+
+// Validate checks calibration values are in range
+func (c Calibration) Validate() error {
+	if c.Gamma <= 0 || c.Gamma > 5 {
+		return fmt.Errorf("gamma must be in (0, 5], got %g", c.Gamma)
+	}
+	if c.MaxBrightness < 1 {
+		return fmt.Errorf("max_brightness must be 1-255 (0 blanks the panel)")
+	}
+	for _, g := range []float64{c.RedGain, c.GreenGain, c.BlueGain} {
+		if g < 0 || g > 1 {
+			return fmt.Errorf("channel gains must be in [0, 1], got %g", g)
+		}
+	}
+	return nil
+}
+
+// ChannelLevels returns the PWM level (0-255) the device should drive for each lit channel
+func (c Calibration) ChannelLevels() [3]uint8 {
+	var levels [3]uint8
+	for i, gain := range []float64{c.RedGain, c.GreenGain, c.BlueGain} {
+		intensity := float64(c.MaxBrightness) / 255 * gain
+		levels[i] = uint8(math.Round(255 * math.Pow(intensity, c.Gamma)))
+	}
+	return levels
+}
+
+// SetCalibration stores (or with nil, clears) a device's display calibration
+func SetCalibration(deviceID string, calibration *Calibration) error {
+	if calibration != nil {
+		if err := calibration.Validate(); err != nil {
+			return err
+		}
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, exists := manager.devices[deviceID]; !exists {
+		return ErrUnknownDevice
+	}
+	manager.record(Event{Type: EventCalibrationChanged, DeviceID: deviceID, Calibration: copyCalibration(calibration)})
+	fmt.Printf("Device %s calibration updated\n", deviceID)
+	return nil
+}
+
+func copyCalibration(c *Calibration) *Calibration {
+	if c == nil {
+		return nil
+	}
+	copied := *c
+	return &copied
+}
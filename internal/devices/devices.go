@@ -2,75 +2,210 @@ package devices
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"server_app/internal/accounting"
 	"server_app/internal/storage"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// ErrUnknownDevice is returned when an operation targets a device that has never registered
+var ErrUnknownDevice = errors.New("unknown device")
+
+// ErrTooManyPending is returned by RegisterDevice for a new device while MaxPendingDevices
+// devices already await approval
+var ErrTooManyPending = errors.New("too many devices awaiting approval")
+
+// Devices awaiting approval at once. Bootups from further new devices are refused until
+// some are approved or rejected, so unknown clients can't grow the registry without bound.
+const MaxPendingDevices = 100
+
 type Device struct {
-	ID       string    // Device identifier from bootup message
-	Name     string    // Human-readable device name
-	Zipcode  string    // Single zipcode this device is associated with
-	LastSeen time.Time // Last time we heard from this device
-	Active   bool      // Whether device is currently active
+	ID       string            `json:"id"`        // Device identifier from bootup message
+	Name     string            `json:"name"`      // Human-readable device name
+	Zipcode  string            `json:"zipcode"`   // Single zipcode this device is associated with
+	LastSeen time.Time         `json:"last_seen"` // Last time we heard from this device
+	Active   bool              `json:"active"`    // Whether device is currently active
+	Config   map[string]string `json:"config"`    // Key/value settings pushed to the device
+	Metadata Metadata          `json:"metadata"`  // Hardware details reported at bootup
+	Pending  bool              `json:"pending"`   // Awaiting admin approval; no weather/config is sent
+
+	OfflineSince time.Time    `json:"offline_since,omitempty"` // When the device went inactive (zero while active)
+	Stats        Stats        `json:"stats"`                   // Connection counters derived from the event log
+	Calibration  *Calibration `json:"calibration,omitempty"`   // LED panel correction for canvas frames (nil = none)
+	QuietHours   *QuietHours  `json:"quiet_hours,omitempty"`   // Nightly window without non-critical updates (nil = none)
+	Key          []byte       `json:"-"`                       // Pre-shared payload encryption key (nil = none)
+	Encrypted    bool         `json:"encrypted"`               // Whether a key is set (the key itself is never listed)
 }
 
 type DeviceData struct {
-	DeviceID string `json:"device_id"`
-	Name     string `json:"name"`
-	Zipcode  string `json:"zipcode"`
-	Active   bool   `json:"active"`
-	LastSeen string `json:"last_seen"`
+	DeviceID string            `json:"device_id"`
+	Name     string            `json:"name"`
+	Zipcode  string            `json:"zipcode"`
+	Active   bool              `json:"active"`
+	LastSeen string            `json:"last_seen"`
+	Config   map[string]string `json:"config,omitempty"`
+	Metadata Metadata          `json:"metadata"`
+	Pending  bool              `json:"pending,omitempty"`
+
+	OfflineSince string       `json:"offline_since,omitempty"`
+	Stats        Stats        `json:"stats"`
+	Calibration  *Calibration `json:"calibration,omitempty"`
+	QuietHours   *QuietHours  `json:"quiet_hours,omitempty"`
+	Key          []byte       `json:"key,omitempty"`
 }
 
 type DeviceManager struct {
-	mu      sync.RWMutex
-	devices map[string]*Device
-	store   *storage.Manager
+	mu                sync.RWMutex
+	devices           map[string]*Device
+	store             *storage.TypedManager[DeviceData] // Snapshot of the projection
+	log               *eventLog                         // Events applied since (and before) the snapshot
+	snapshotSeq       uint64                            // Last event included in the snapshot
+	pendingHeartbeats map[string]*heartbeatBatch        // Heartbeats not yet summarized in the log
+	history           map[string][]Event                // Most recent events per device, oldest first
 }
 
+// Event history tuning
+const (
+	maxHistoryPerDevice   = 200             // Events kept in memory per device for queries
+	heartbeatGapThreshold = 5 * time.Minute // Silence longer than this is logged as a heartbeat gap
+)
+
+// When set, devices seen for the first time are registered as pending until approved
+var requireApproval bool
+
+// Called on its own goroutine when an approved device comes online or goes offline
+var onPresence func(name string, online bool)
+
+var onEvent func(Event)
+
 var manager = &DeviceManager{
-	devices: make(map[string]*Device),
+	devices:           make(map[string]*Device),
+	pendingHeartbeats: make(map[string]*heartbeatBatch),
+	history:           make(map[string][]Event),
+}
+
+// Reserved snapshot key holding snapshot bookkeeping rather than a device
+const snapshotKey = "_snapshot"
+
+// Version of the stored device layout; bump it and add a migration when DeviceData changes.
+// Events in the log still decode into the new DeviceData, so keep old fields readable there.
+const schemaVersion = 1
+
+// Upgrades of the snapshot from older layouts, e.g. Zipcode -> Zipcodes:
+//
+//	{From: 1, Description: "zipcode list", Apply: storage.MigrateObjects(func(id string, d map[string]interface{}) error {
+//		if id != snapshotKey {
+//			d["zipcodes"] = []interface{}{d["zipcode"]}
+//		}
+//		return nil
+//	})}
+var migrations []storage.Migration
+
+type snapshotInfo struct {
+	Seq uint64 `json:"seq"`
+}
+
+func eventLogPath(dataFilePath string) string {
+	return strings.TrimSuffix(dataFilePath, filepath.Ext(dataFilePath)) + "_events.jsonl"
+}
+
+// PrepareImport readies device data restored from an export for the store at dataFilePath.
+// The snapshot's position refers to the event log it came from, so it is dropped and the
+// local event log is moved aside; InitStorage then starts a new log from the imported
+// devices.
+func PrepareImport(dataFilePath string, data map[string]json.RawMessage) error {
+	delete(data, snapshotKey)
+	logPath := eventLogPath(dataFilePath)
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		return nil
+	}
+	aside := logPath + ".replaced-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(logPath, aside); err != nil {
+		return fmt.Errorf("failed to move event log aside: %v", err)
+	}
+	fmt.Printf("Moved device event log to %s\n", aside)
+	return nil
 }
 
-// InitStorage initializes device storage
+// InitStorage loads the device snapshot and replays newer events from the event log
+// The event log lives next to the snapshot, e.g. devices.json -> devices_events.jsonl
 func InitStorage(dataFilePath string) error {
 	var err error
-	manager.store, err = storage.New(dataFilePath)
+	manager.store, err = storage.NewTyped[DeviceData](dataFilePath)
 	if err != nil {
 		return err
 	}
+	if err := manager.store.Migrate(schemaVersion, migrations); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
 
-	// Load devices from persistent storage into memory
-	allData := manager.store.GetAll()
-	for key, val := range allData {
-		var deviceData DeviceData
-		if err := reconvertToDeviceData(val, &deviceData); err != nil {
-			fmt.Printf("Warning: failed to load device %s: %v\n", key, err)
-			continue
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	// Load devices from the last snapshot into memory
+	var info snapshotInfo
+	if _, err := manager.store.GetTyped(snapshotKey, &info); err == nil {
+		manager.snapshotSeq = info.Seq
+	}
+	for key, deviceData := range manager.store.GetAll() {
+		if key != snapshotKey {
+			manager.devices[key] = deviceFromData(deviceData)
 		}
+	}
 
-		lastSeen, _ := time.Parse(time.RFC3339, deviceData.LastSeen)
-		manager.devices[key] = &Device{
-			ID:       deviceData.DeviceID,
-			Name:     deviceData.Name,
-			Zipcode:  deviceData.Zipcode,
-			LastSeen: lastSeen,
-			Active:   deviceData.Active,
+	manager.log, err = openEventLog(eventLogPath(dataFilePath))
+	if err != nil {
+		return err
+	}
+
+	// Seed history for devices stored before the event log existed
+	if manager.log.lastSeq() == 0 && len(manager.devices) > 0 {
+		for id, device := range manager.devices {
+			data := device.toData()
+			manager.record(Event{Type: EventImported, DeviceID: id, State: &data})
 		}
+		fmt.Printf("Imported %d devices into new event log\n", len(manager.devices))
 	}
 
-	fmt.Printf("Loaded %d devices from storage\n", len(manager.devices))
+	// Replay the whole log for query history; only events newer than the snapshot change state
+	replayed := 0
+	manager.history = make(map[string][]Event)
+	err = manager.log.replay(0, func(e Event) {
+		manager.remember(e)
+		if e.Seq > manager.snapshotSeq {
+			applyEvent(manager.devices, e)
+			replayed++
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay device events: %v", err)
+	}
+	// Never reuse sequence numbers already covered by the snapshot (e.g. log deleted by hand)
+	if manager.log.seq < manager.snapshotSeq {
+		manager.log.seq = manager.snapshotSeq
+	}
+
+	fmt.Printf("Loaded %d devices from storage (%d events replayed)\n", len(manager.devices), replayed)
 	return nil
 }
 
-// RegisterDevice sets device as active on bootup message and saves to persistent storage
-// Uses deviceName as the unique device ID
-func RegisterDevice(deviceName string, zipcode string) {
+// RegisterDevice sets device as active on bootup message and records a registered event
+// Uses deviceName as the unique device ID. Empty metadata (older firmware) keeps what was stored.
+// New devices are refused with ErrTooManyPending while MaxPendingDevices await approval.
+func RegisterDevice(deviceName string, zipcode string, metadata Metadata) error {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 
+	if _, exists := manager.devices[deviceName]; !exists && requireApproval && manager.pendingCount() >= MaxPendingDevices {
+		return ErrTooManyPending
+	}
+
 	var storedZipcode string
 
 	// Check if we have stored data for this device
@@ -85,26 +220,42 @@ func RegisterDevice(deviceName string, zipcode string) {
 		// First time seeing this device, use provided zipcode
 		storedZipcode = zipcode
 		fmt.Printf("Device %s registered with zipcode: %s\n", deviceName, storedZipcode)
+		if requireApproval {
+			fmt.Printf("Device %s is pending approval\n", deviceName)
+		}
 	}
 
-	if device, exists := manager.devices[deviceName]; exists {
-		// Device already in memory, update it
-		device.Active = true
-		device.LastSeen = time.Now()
-		device.Zipcode = storedZipcode
-	} else {
-		// New device in memory
-		manager.devices[deviceName] = &Device{
-			ID:       deviceName,
-			Name:     deviceName,
-			Zipcode:  storedZipcode,
-			LastSeen: time.Now(),
-			Active:   true,
-		}
+	var previousFirmware string
+	bootups := 1
+	if storedDevice, exists := manager.devices[deviceName]; exists {
+		previousFirmware = storedDevice.Metadata.Firmware
+		bootups = storedDevice.Stats.Bootups + 1
+	}
+
+	e := Event{Type: EventRegistered, DeviceID: deviceName, Zipcode: storedZipcode, Pending: requireApproval, Bootups: bootups}
+	if !metadata.IsEmpty() {
+		e.Metadata = &metadata
 	}
+	manager.flushHeartbeats(deviceName)
+	manager.record(e)
 
-	// Update in persistent storage
-	saveDeviceToStorage(deviceName)
+	if previousFirmware != "" && metadata.Firmware != "" && metadata.Firmware != previousFirmware {
+		fmt.Printf("Device %s firmware updated from %s to %s\n", deviceName, previousFirmware, metadata.Firmware)
+		manager.record(Event{Type: EventFirmwareUpdated, DeviceID: deviceName,
+			Firmware: metadata.Firmware, PreviousFirmware: previousFirmware})
+	}
+	return nil
+}
+
+// pendingCount returns the number of devices awaiting approval. Caller holds mu.
+func (dm *DeviceManager) pendingCount() int {
+	count := 0
+	for _, device := range dm.devices {
+		if device.Pending {
+			count++
+		}
+	}
+	return count
 }
 
 // SetInactive marks device as inactive (e.g., on LWT)
@@ -112,28 +263,87 @@ func SetInactive(deviceID string) {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 
-	if device, exists := manager.devices[deviceID]; exists {
-		device.Active = false
+	if _, exists := manager.devices[deviceID]; exists {
+		manager.flushHeartbeats(deviceID)
+		manager.record(Event{Type: EventOffline, DeviceID: deviceID, Reason: "lwt"})
 		fmt.Printf("Device %s set to inactive (LWT triggered)\n", deviceID)
-		saveDeviceToStorage(deviceID)
 	}
 }
 
+// ExpireStale marks active devices inactive when nothing was heard for longer than timeout
+// Returns the IDs of devices that were expired
+func ExpireStale(timeout time.Duration) []string {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	var expired []string
+	for id, device := range manager.devices {
+		if !device.Active || time.Since(device.LastSeen) <= timeout {
+			continue
+		}
+		manager.flushHeartbeats(id)
+		manager.record(Event{Type: EventOffline, DeviceID: id, Reason: "heartbeat_timeout"})
+		fmt.Printf("Device %s set to inactive (no heartbeat for %v)\n", id, time.Since(device.LastSeen).Round(time.Second))
+		expired = append(expired, id)
+	}
+	return expired
+}
+
 // Heartbeat updates last seen time for a device
 func Heartbeat(deviceID string) {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 
 	if device, exists := manager.devices[deviceID]; exists {
-		device.LastSeen = time.Now()
-		// If it was marked inactive and we get a heartbeat, reactivate it
+		now := time.Now()
+
+		// If it was marked inactive and we get a heartbeat, reactivate it (recorded right away)
 		if !device.Active {
-			device.Active = true
+			manager.flushHeartbeats(deviceID)
+			manager.record(Event{Type: EventReactivated, DeviceID: deviceID, Time: now})
 			fmt.Printf("Device %s reactivated by heartbeat\n", deviceID)
+			return
 		}
-		saveDeviceToStorage(deviceID)
+
+		if gap := now.Sub(device.LastSeen); !device.LastSeen.IsZero() && gap > heartbeatGapThreshold {
+			manager.flushHeartbeats(deviceID)
+			manager.record(Event{Type: EventHeartbeatGap, DeviceID: deviceID, Time: now, GapSeconds: int64(gap / time.Second)})
+			fmt.Printf("Device %s heartbeat gap of %v\n", deviceID, gap.Round(time.Second))
+		}
+
+		// Heartbeats only touch memory; they are summarized in the log at the next checkpoint
+		batch, exists := manager.pendingHeartbeats[deviceID]
+		if !exists {
+			batch = &heartbeatBatch{}
+			manager.pendingHeartbeats[deviceID] = batch
+		}
+		batch.count++
+		if gap := now.Sub(device.LastSeen); !device.LastSeen.IsZero() && gap <= heartbeatGapThreshold {
+			batch.intervalCount++
+			batch.intervalSeconds += gap.Seconds()
+		}
+		device.LastSeen = now
 	}
-} // GetActiveDevices returns list of all active devices
+}
+
+// RecentEvents returns up to limit of the most recent events for a device, newest first
+func RecentEvents(deviceID string, limit int) []Event {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	events := manager.history[deviceID]
+	if limit <= 0 || limit > len(events) {
+		limit = len(events)
+	}
+
+	result := make([]Event, 0, limit)
+	for i := len(events) - 1; i >= len(events)-limit; i-- {
+		result = append(result, redactKey(events[i]))
+	}
+	return result
+}
+
+// GetActiveDevices returns list of all active devices
 func GetActiveDevices() []Device {
 	manager.mu.RLock()
 	defer manager.mu.RUnlock()
@@ -147,27 +357,47 @@ func GetActiveDevices() []Device {
 	return active
 }
 
+// RecentZipcodes returns zipcodes of approved devices heard from since the given time,
+// whether or not they are currently marked active (e.g. right after a server restart)
+func RecentZipcodes(since time.Time) []string {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	zipcodeMap := make(map[string]bool)
+	for _, device := range manager.devices {
+		if !device.Pending && device.Zipcode != "" && device.LastSeen.After(since) {
+			zipcodeMap[device.Zipcode] = true
+		}
+	}
+
+	zipcodes := make([]string, 0, len(zipcodeMap))
+	for zipcode := range zipcodeMap {
+		zipcodes = append(zipcodes, zipcode)
+	}
+	return zipcodes
+}
+
 // IsZipcodeActive checks if any active device is associated with a zipcode
 func IsZipcodeActive(zipcode string) bool {
 	manager.mu.RLock()
 	defer manager.mu.RUnlock()
 
 	for _, device := range manager.devices {
-		if device.Active && device.Zipcode == zipcode {
+		if device.Active && !device.Pending && device.Zipcode == zipcode {
 			return true
 		}
 	}
 	return false
 }
 
-// GetActiveZipcodes returns unique zipcodes for all active devices
+// GetActiveZipcodes returns unique zipcodes for all active, approved devices
 func GetActiveZipcodes() []string {
 	manager.mu.RLock()
 	defer manager.mu.RUnlock()
 
 	zipcodeMap := make(map[string]bool)
 	for _, device := range manager.devices {
-		if device.Active {
+		if device.Active && !device.Pending {
 			zipcodeMap[device.Zipcode] = true
 		}
 	}
@@ -186,17 +416,149 @@ func GetDevice(deviceID string) (*Device, bool) {
 
 	device, exists := manager.devices[deviceID]
 	if exists {
-		return &Device{
-			ID:       device.ID,
-			Name:     device.Name,
-			Zipcode:  device.Zipcode,
-			LastSeen: device.LastSeen,
-			Active:   device.Active,
-		}, true
+		d := *device
+		d.Config = copyConfig(device.Config)
+		d.Calibration = copyCalibration(device.Calibration)
+		d.QuietHours = copyQuietHours(device.QuietHours)
+		d.Key = nil
+		return &d, true
 	}
 	return nil, false
 }
 
+// GetAllDevices returns a snapshot of every known device
+func GetAllDevices() []Device {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	all := make([]Device, 0, len(manager.devices))
+	for _, device := range manager.devices {
+		d := *device
+		d.Config = copyConfig(device.Config)
+		d.Calibration = copyCalibration(device.Calibration)
+		d.QuietHours = copyQuietHours(device.QuietHours)
+		d.Key = nil
+		all = append(all, d)
+	}
+	return all
+}
+
+// SetApprovalRequired controls whether new devices must be approved before being served
+func SetApprovalRequired(required bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	requireApproval = required
+}
+
+// OnPresenceChange registers a callback for approved devices coming online or going offline
+func OnPresenceChange(fn func(name string, online bool)) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	onPresence = fn
+}
+
+// OnEvent registers a callback for every event recorded in the event log. It runs with the
+// device manager locked, so it must not call back into this package.
+func OnEvent(fn func(Event)) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	onEvent = fn
+}
+
+// IsPending reports whether a device is registered but awaiting approval
+func IsPending(deviceID string) bool {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	device, exists := manager.devices[deviceID]
+	return exists && device.Pending
+}
+
+// Approve allows a pending device to receive weather and config
+// Returns false if the device was already approved
+func Approve(deviceID string) (bool, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	device, exists := manager.devices[deviceID]
+	if !exists {
+		return false, ErrUnknownDevice
+	}
+	if !device.Pending {
+		return false, nil
+	}
+	manager.record(Event{Type: EventApproved, DeviceID: deviceID})
+	fmt.Printf("Device %s approved\n", deviceID)
+	return true, nil
+}
+
+// Remove forgets a device (e.g. rejecting a pending registration)
+// The device registers again as new on its next bootup
+func Remove(deviceID string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, exists := manager.devices[deviceID]; !exists {
+		return ErrUnknownDevice
+	}
+	delete(manager.pendingHeartbeats, deviceID)
+	manager.record(Event{Type: EventRemoved, DeviceID: deviceID})
+	fmt.Printf("Device %s removed\n", deviceID)
+	return nil
+}
+
+// GetConfig returns a copy of the key/value config stored for a device
+func GetConfig(deviceID string) (map[string]string, error) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	device, exists := manager.devices[deviceID]
+	if !exists {
+		return nil, ErrUnknownDevice
+	}
+	return copyConfig(device.Config), nil
+}
+
+// SetConfig replaces a device's config and persists it
+// Returns true if the stored config actually changed
+func SetConfig(deviceID string, config map[string]string) (bool, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	device, exists := manager.devices[deviceID]
+	if !exists {
+		return false, ErrUnknownDevice
+	}
+	if configEqual(device.Config, config) {
+		return false, nil
+	}
+
+	manager.record(Event{Type: EventConfigChanged, DeviceID: deviceID, Config: copyConfig(config)})
+	fmt.Printf("Device %s config replaced (%d keys)\n", deviceID, len(device.Config))
+	return true, nil
+}
+
+// UpdateConfig merges changes into a device's config; an empty value deletes the key
+// Returns true if the stored config actually changed
+func UpdateConfig(deviceID string, changes map[string]string) (bool, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	device, exists := manager.devices[deviceID]
+	if !exists {
+		return false, ErrUnknownDevice
+	}
+
+	merged := MergeConfig(device.Config, changes)
+	if configEqual(device.Config, merged) {
+		return false, nil
+	}
+
+	manager.record(Event{Type: EventConfigChanged, DeviceID: deviceID, Config: merged})
+	fmt.Printf("Device %s config updated (%d keys)\n", deviceID, len(device.Config))
+	return true, nil
+}
+
 // PrintStatus prints status of all known devices
 func PrintStatus() {
 	manager.mu.RLock()
@@ -208,42 +570,290 @@ func PrintStatus() {
 		return
 	}
 
-	for id, device := range manager.devices {
+	ids := make([]string, 0, len(manager.devices))
+	for id := range manager.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		device := manager.devices[id]
 		status := "ACTIVE"
-		if !device.Active {
+		switch {
+		case device.Pending:
+			status = "PENDING"
+		case !device.Active:
 			status = "INACTIVE"
 		}
 		fmt.Printf("Device: %s (%s) | Status: %s | Last Seen: %v ago | Zipcode: %s\n",
 			id, device.Name, status, time.Since(device.LastSeen).Round(time.Second), device.Zipcode)
+		st := device.Stats
+		fmt.Printf("    Bootups: %d | LWT: %d | Timeouts: %d | Avg Heartbeat: %.0fs | Longest Offline: %v\n",
+			st.Bootups, st.LWTEvents, st.HeartbeatTimeouts, st.AvgHeartbeatIntervalSec,
+			(time.Duration(st.LongestOfflineGapSec) * time.Second).String())
 	}
 	fmt.Println("====================")
 }
 
+// Checkpoint summarizes pending heartbeats into the event log and writes a new snapshot
+// Called periodically and on shutdown
+func Checkpoint() error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for deviceID := range manager.pendingHeartbeats {
+		manager.flushHeartbeats(deviceID)
+	}
+	if err := manager.writeSnapshot(); err != nil {
+		return err
+	}
+	return manager.compactLog()
+}
+
+// compactLog starts a new event log once the current one is large, so it doesn't grow
+// forever. The new log opens with an imported event per device carrying the state just
+// snapshotted, so a projection rebuild still starts from the full state. Caller holds mu.
+func (dm *DeviceManager) compactLog() error {
+	if dm.log == nil || !dm.log.full() {
+		return nil
+	}
+	ids := make([]string, 0, len(dm.devices))
+	for id := range dm.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	now := time.Now()
+	base := make([]Event, 0, len(ids))
+	for _, id := range ids {
+		data := dm.devices[id].toData()
+		base = append(base, Event{Time: now, Type: EventImported, DeviceID: id, State: &data})
+	}
+
+	if err := dm.log.compact(base); err != nil {
+		return fmt.Errorf("failed to compact device event log: %v", err)
+	}
+	fmt.Printf("Compacted device event log to %d devices (previous log kept as %s.1)\n", len(base), dm.log.path)
+	return dm.writeSnapshot()
+}
+
+// RebuildProjection discards in-memory device state and rebuilds it by replaying the
+// full event log from the beginning, then writes a fresh snapshot
+// Returns the number of events replayed
+func RebuildProjection() (int, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.log == nil {
+		return 0, fmt.Errorf("device storage not initialized")
+	}
+	for deviceID := range manager.pendingHeartbeats {
+		manager.flushHeartbeats(deviceID)
+	}
+
+	rebuilt := make(map[string]*Device)
+	manager.history = make(map[string][]Event)
+	replayed := 0
+	err := manager.log.replay(0, func(e Event) {
+		applyEvent(rebuilt, e)
+		manager.remember(e)
+		replayed++
+	})
+	if err != nil {
+		return replayed, fmt.Errorf("failed to replay device events: %v", err)
+	}
+
+	manager.devices = rebuilt
+	fmt.Printf("Rebuilt device projection: %d devices from %d events\n", len(rebuilt), replayed)
+	manager.snapshotSeq = 0 // force a snapshot write
+	return replayed, manager.writeSnapshot()
+}
+
 // Private helper functions
 
-func saveDeviceToStorage(deviceID string) {
-	if manager.store == nil {
+// record appends an event to the log and applies it to the projection. Caller holds mu.
+func (dm *DeviceManager) record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if dm.log != nil {
+		n, err := dm.log.append(&e)
+		if err != nil {
+			fmt.Printf("Warning: failed to record %s event for %s: %v\n", e.Type, e.DeviceID, err)
+		}
+		// Pending devices get no accounting records until they are approved
+		if device, exists := dm.devices[e.DeviceID]; !e.Pending && (!exists || !device.Pending) {
+			accounting.NoteStorage(e.DeviceID, n)
+		}
+	}
+	before, known := dm.devices[e.DeviceID]
+	wasOnline := known && before.Active && !before.Pending
+	if e.Type == EventConfigChanged {
+		var previous map[string]string
+		if known {
+			previous = before.Config
+		}
+		e.ChangedKeys = changedConfigKeys(previous, e.Config)
+	}
+	applyEvent(dm.devices, e)
+	dm.remember(e)
+	if onEvent != nil {
+		onEvent(e)
+	}
+
+	if after, exists := dm.devices[e.DeviceID]; exists && onPresence != nil {
+		if online := after.Active && !after.Pending; online != wasOnline {
+			go onPresence(after.Name, online)
+		}
+	}
+}
+
+// remember adds an event to the bounded per-device query history. Caller holds mu.
+func (dm *DeviceManager) remember(e Event) {
+	events := append(dm.history[e.DeviceID], e)
+	if len(events) > maxHistoryPerDevice {
+		events = events[len(events)-maxHistoryPerDevice:]
+	}
+	dm.history[e.DeviceID] = events
+}
+
+// flushHeartbeats records a summary of pending heartbeats for a device. Caller holds mu.
+func (dm *DeviceManager) flushHeartbeats(deviceID string) {
+	batch := dm.pendingHeartbeats[deviceID]
+	device, exists := dm.devices[deviceID]
+	delete(dm.pendingHeartbeats, deviceID)
+	if batch == nil || batch.count == 0 || !exists {
 		return
 	}
+	dm.record(Event{Type: EventHeartbeatSummary, DeviceID: deviceID, Time: device.LastSeen,
+		Heartbeats: batch.count, Intervals: batch.intervalCount, IntervalSeconds: batch.intervalSeconds})
+}
+
+// heartbeatBatch accumulates heartbeats between checkpoints
+type heartbeatBatch struct {
+	count           int
+	intervalCount   int     // Intervals between consecutive heartbeats (gaps excluded)
+	intervalSeconds float64 // Sum of those intervals
+}
+
+// writeSnapshot persists the whole projection in a single write. Caller holds mu.
+func (dm *DeviceManager) writeSnapshot() error {
+	if dm.store == nil || dm.log == nil {
+		return nil
+	}
+	seq := dm.log.lastSeq()
+	if seq == dm.snapshotSeq {
+		return nil // nothing new since last snapshot
+	}
 
-	device := manager.devices[deviceID]
-	data := DeviceData{
-		DeviceID: device.ID,
-		Name:     device.Name,
-		Zipcode:  device.Zipcode,
-		Active:   device.Active,
-		LastSeen: device.LastSeen.Format(time.RFC3339),
+	data := make(map[string]interface{}, len(dm.devices)+1)
+	for id, device := range dm.devices {
+		data[id] = device.toData()
 	}
+	data[snapshotKey] = snapshotInfo{Seq: seq}
 
-	if err := manager.store.Set(deviceID, data); err != nil {
-		fmt.Printf("Warning: failed to save device %s to storage: %v\n", deviceID, err)
+	if err := dm.store.Replace(data); err != nil {
+		return fmt.Errorf("failed to write device snapshot: %v", err)
+	}
+	if err := dm.store.Flush(); err != nil { // A checkpoint is on disk when it reports success
+		return fmt.Errorf("failed to write device snapshot: %v", err)
 	}
+	dm.snapshotSeq = seq
+	return nil
 }
 
-func reconvertToDeviceData(val interface{}, target *DeviceData) error {
-	jsonData, err := json.Marshal(val)
-	if err != nil {
-		return err
+func (d *Device) toData() DeviceData {
+	return DeviceData{
+		DeviceID: d.ID,
+		Name:     d.Name,
+		Zipcode:  d.Zipcode,
+		Active:   d.Active,
+		LastSeen: d.LastSeen.Format(time.RFC3339),
+		Config:   copyConfig(d.Config),
+		Metadata: d.Metadata,
+		Pending:  d.Pending,
+
+		OfflineSince: formatOptionalTime(d.OfflineSince),
+		Stats:        d.Stats,
+		Calibration:  copyCalibration(d.Calibration),
+		QuietHours:   copyQuietHours(d.QuietHours),
+		Key:          copyKey(d.Key),
+	}
+}
+
+func deviceFromData(data DeviceData) *Device {
+	lastSeen, _ := time.Parse(time.RFC3339, data.LastSeen)
+	offlineSince, _ := time.Parse(time.RFC3339, data.OfflineSince)
+	return &Device{
+		ID:       data.DeviceID,
+		Name:     data.Name,
+		Zipcode:  data.Zipcode,
+		LastSeen: lastSeen,
+		Active:   data.Active,
+		Config:   data.Config,
+		Metadata: data.Metadata,
+		Pending:  data.Pending,
+
+		OfflineSince: offlineSince,
+		Stats:        data.Stats,
+		Calibration:  copyCalibration(data.Calibration),
+		QuietHours:   copyQuietHours(data.QuietHours),
+		Key:          copyKey(data.Key),
+		Encrypted:    data.Key != nil,
+	}
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// MergeConfig returns current with changes applied; an empty value deletes the key
+func MergeConfig(current map[string]string, changes map[string]string) map[string]string {
+	merged := copyConfig(current)
+	for key, value := range changes {
+		if value == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// DiffConfig returns the changes that turn from into to, in MergeConfig form
+// (removed keys map to an empty value)
+func DiffConfig(from map[string]string, to map[string]string) map[string]string {
+	changes := make(map[string]string)
+	for key, value := range to {
+		if old, ok := from[key]; !ok || old != value {
+			changes[key] = value
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			changes[key] = ""
+		}
+	}
+	return changes
+}
+
+func copyConfig(config map[string]string) map[string]string {
+	result := make(map[string]string, len(config))
+	for k, v := range config {
+		result[k] = v
+	}
+	return result
+}
+
+func configEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
 	}
-	return json.Unmarshal(jsonData, target)
+	return true
 }
@@ -0,0 +1,292 @@
+package devices
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"server_app/internal/storage"
+	"sync"
+)
+
+// eventLog is an append-only JSON-lines file of device events
+type eventLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	seq    uint64  // Sequence number of the last appended event
+	size   int64   // Bytes in the file
+	memory []Event // Events appended while storage is in memory only (the file is not written)
+}
+
+// Size at which a checkpoint starts a new log (see compact)
+const maxEventLogBytes = 8 << 20
+
+func openEventLog(path string) (*eventLog, error) {
+	if storage.InMemory() {
+		// Read what is there, but leave the file alone
+		l := &eventLog{path: path}
+		if err := l.replay(0, func(e Event) { l.seq = e.Seq }); err != nil {
+			return nil, fmt.Errorf("failed to read event log: %v", err)
+		}
+		return l, nil
+	}
+
+	if err := repairTail(path); err != nil {
+		return nil, fmt.Errorf("failed to repair event log: %v", err)
+	}
+
+	if storage.Encrypting() {
+		if err := encryptLog(path); err != nil {
+			return nil, fmt.Errorf("failed to encrypt event log: %v", err)
+		}
+	}
+
+	l := &eventLog{path: path}
+	if err := l.replay(0, func(e Event) { l.seq = e.Seq }); err != nil {
+		return nil, fmt.Errorf("failed to read event log: %v", err)
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// append assigns the next sequence number to e and writes it durably, returning the bytes written
+func (l *eventLog) append(e *Event) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if l.file == nil {
+		l.memory = append(l.memory, *e)
+		l.seq = e.Seq
+		return 0, nil
+	}
+	line, err := encodeEvent(e)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := l.file.Write(line); err != nil {
+		return 0, fmt.Errorf("failed to append event: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync event log: %v", err)
+	}
+	l.seq = e.Seq
+	l.size += int64(len(line))
+	return len(line), nil
+}
+
+// encodeEvent returns e as one log line, encrypted when a storage key is set
+func encodeEvent(e *Event) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+	if line, err = storage.EncryptLine(line); err != nil {
+		return nil, fmt.Errorf("failed to encrypt event: %v", err)
+	}
+	return append(line, '\n'), nil
+}
+
+// full reports whether the file has grown past maxEventLogBytes
+func (l *eventLog) full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file != nil && l.size >= maxEventLogBytes
+}
+
+// compact starts a new log holding only base, events that restore the current state,
+// numbered after the last appended event. The old log is kept as <path>.1, replacing
+// the one kept by the previous compaction.
+func (l *eventLog) compact(base []Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out bytes.Buffer
+	seq := l.seq
+	for i := range base {
+		seq++
+		base[i].Seq = seq
+		line, err := encodeEvent(&base[i])
+		if err != nil {
+			return err
+		}
+		out.Write(line)
+	}
+
+	tmp := l.path + ".tmp"
+	if err := writeSynced(tmp, out.Bytes()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write compacted event log: %v", err)
+	}
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		os.Remove(tmp)
+		if reopenErr := l.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return fmt.Errorf("failed to move event log aside: %v", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("failed to replace event log: %v", err)
+	}
+	l.seq = seq
+	return l.open()
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay calls fn for every event with Seq greater than afterSeq, in log order
+func (l *eventLog) replay(afterSeq uint64, fn func(Event)) error {
+	if err := l.replayFile(afterSeq, fn); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	memory := append([]Event(nil), l.memory...)
+	l.mu.Unlock()
+	for _, e := range memory {
+		if e.Seq > afterSeq {
+			fn(e)
+		}
+	}
+	return nil
+}
+
+func (l *eventLog) replayFile(afterSeq uint64, fn func(Event)) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, err := storage.DecryptLine(scanner.Bytes())
+		if errors.Is(err, storage.ErrKey) {
+			return fmt.Errorf("line %d is %v", lineNum, err) // Not corrupt; skipping it would lose history
+		}
+		var e Event
+		if err == nil {
+			err = json.Unmarshal(line, &e)
+		}
+		if err != nil {
+			fmt.Printf("Warning: skipping corrupt device event at line %d: %v\n", lineNum, err)
+			continue
+		}
+		if e.Seq > afterSeq {
+			fn(e)
+		}
+	}
+	return scanner.Err()
+}
+
+// lastSeq returns the sequence number of the last appended event
+func (l *eventLog) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// repairTail truncates a partially written final line left by a crash mid-append
+func repairTail(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	fmt.Printf("Warning: truncating %d bytes of incomplete event at end of %s\n", len(data)-keep, path)
+	return os.Truncate(path, int64(keep))
+}
+
+// encryptLog rewrites a log that still has plaintext lines (written before a storage key
+// was set) or lines of the first encrypted format with every line encrypted
+func encryptLog(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var out bytes.Buffer
+	plaintext := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !storage.IsEncryptedLine(line) {
+			plaintext++
+			if line, err = storage.DecryptLine(line); err != nil { // Lines of the first encrypted format
+				return err
+			}
+			if line, err = storage.EncryptLine(line); err != nil {
+				return err
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if plaintext == 0 {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Encrypted %d device events in %s\n", plaintext, path)
+	return nil
+}
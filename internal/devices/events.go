@@ -0,0 +1,168 @@
+package devices
+
+import (
+	"sort"
+	"time"
+)
+
+// EventType identifies a change recorded in the device event log
+type EventType string
+
+const (
+	EventRegistered       EventType = "registered"        // Bootup message received
+	EventHeartbeatSummary EventType = "heartbeat_summary" // Heartbeats received since the last summary
+	EventOffline          EventType = "offline"           // LWT received or heartbeat timed out (see Reason)
+	EventConfigChanged    EventType = "config_changed"    // Config replaced (full config recorded)
+	EventImported         EventType = "imported"          // Device state carried over from a pre-event-log snapshot
+	EventApproved         EventType = "approved"          // Pending device approved by admin
+	EventRemoved          EventType = "removed"           // Device forgotten (e.g. registration rejected)
+	EventHeartbeatGap     EventType = "heartbeat_gap"     // Heartbeat arrived after an unusually long silence
+	EventReactivated      EventType = "reactivated"       // Inactive device came back via heartbeat
+	EventFirmwareUpdated  EventType = "firmware_updated"  // Bootup reported a different firmware version
+
+	EventCalibrationChanged EventType = "calibration_changed" // Display calibration set or cleared
+	EventKeyChanged         EventType = "key_changed"         // Payload encryption key set or cleared
+	EventQuietHoursChanged  EventType = "quiet_hours_changed" // Quiet hours set or cleared
+)
+
+// Event is one entry in the append-only device event log
+type Event struct {
+	Seq              uint64            `json:"seq"`
+	Time             time.Time         `json:"time"`
+	Type             EventType         `json:"type"`
+	DeviceID         string            `json:"device_id"`
+	Zipcode          string            `json:"zipcode,omitempty"`
+	Metadata         *Metadata         `json:"metadata,omitempty"`
+	Config           map[string]string `json:"config,omitempty"`
+	Heartbeats       int               `json:"heartbeats,omitempty"`
+	Intervals        int               `json:"intervals,omitempty"`
+	IntervalSeconds  float64           `json:"interval_seconds,omitempty"`
+	Pending          bool              `json:"pending,omitempty"`
+	Bootups          int               `json:"bootups,omitempty"` // Bootups of the device including this one
+	GapSeconds       int64             `json:"gap_seconds,omitempty"`
+	Reason           string            `json:"reason,omitempty"`
+	Firmware         string            `json:"firmware,omitempty"`
+	PreviousFirmware string            `json:"previous_firmware,omitempty"`
+	State            *DeviceData       `json:"state,omitempty"`
+	Calibration      *Calibration      `json:"calibration,omitempty"`
+	Key              []byte            `json:"key,omitempty"`
+	QuietHours       *QuietHours       `json:"quiet_hours,omitempty"`
+
+	// Config keys added, changed or removed by a config_changed event; set for OnEvent
+	// callbacks, not logged
+	ChangedKeys []string `json:"-"`
+}
+
+// applyEvent folds an event into a device projection
+// Events carry absolute values so replaying one already in a snapshot is harmless.
+func applyEvent(devs map[string]*Device, e Event) {
+	device, exists := devs[e.DeviceID]
+
+	switch e.Type {
+	case EventRegistered:
+		if !exists {
+			device = &Device{ID: e.DeviceID, Name: e.DeviceID, Pending: e.Pending}
+			devs[e.DeviceID] = device
+		}
+		if e.Bootups > 0 {
+			device.Stats.Bootups = e.Bootups
+		} else {
+			device.Stats.Bootups++ // Logged before events carried the count
+		}
+		device.Stats.noteBackOnline(device.OfflineSince, e.Time)
+		device.Zipcode = e.Zipcode
+		device.Active = true
+		device.LastSeen = e.Time
+		device.OfflineSince = time.Time{}
+		if e.Metadata != nil && !e.Metadata.IsEmpty() {
+			device.Metadata = *e.Metadata
+		}
+
+	case EventHeartbeatSummary, EventReactivated:
+		if exists {
+			device.Stats.noteHeartbeats(e.Heartbeats, e.Intervals, e.IntervalSeconds)
+			device.Stats.noteBackOnline(device.OfflineSince, e.Time)
+			device.Active = true
+			device.LastSeen = e.Time
+			device.OfflineSince = time.Time{}
+		}
+
+	case EventHeartbeatGap:
+		if exists {
+			device.Stats.noteOfflineGap(e.GapSeconds)
+		}
+
+	case EventOffline:
+		if exists {
+			if e.Reason == "heartbeat_timeout" {
+				device.Stats.HeartbeatTimeouts++
+			} else {
+				device.Stats.LWTEvents++
+			}
+			device.Active = false
+			device.OfflineSince = e.Time
+		}
+
+	case EventConfigChanged:
+		if exists {
+			device.Config = copyConfig(e.Config)
+		}
+
+	case EventCalibrationChanged:
+		if exists {
+			device.Calibration = copyCalibration(e.Calibration)
+		}
+
+	case EventQuietHoursChanged:
+		if exists {
+			device.QuietHours = copyQuietHours(e.QuietHours)
+		}
+
+	case EventKeyChanged:
+		if exists {
+			device.Key = copyKey(e.Key)
+			device.Encrypted = e.Key != nil
+		}
+
+	case EventApproved:
+		if exists {
+			device.Pending = false
+		}
+
+	case EventRemoved:
+		delete(devs, e.DeviceID)
+
+	case EventImported:
+		if e.State != nil {
+			devs[e.DeviceID] = deviceFromData(*e.State)
+		}
+	}
+}
+
+// redactKey strips key material from an event before it leaves the package
+func redactKey(e Event) Event {
+	e.Key = nil
+	if e.State != nil {
+		state := *e.State
+		state.Key = nil
+		e.State = &state
+	}
+	return e
+}
+
+// changedConfigKeys returns the keys that differ between two configs, sorted
+func changedConfigKeys(before map[string]string, after map[string]string) []string {
+	var keys []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok || old != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+package devices
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"server_app/internal/messaging"
+	"server_app/internal/storage"
+)
+
+// KeySize is the length of generated pre-shared keys (AES-128)
+const KeySize = 16
+
+// ErrKeyUnprotected is returned by SetKey while storage encryption is off: keys are kept
+// in the device event log and snapshot, which would hold them in plain text
+var ErrKeyUnprotected = errors.New("storage encryption is off, so device keys would be stored in plain text")
+
+// GenerateKey returns a new random pre-shared key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return key, nil
+}
+
+// SetKey stores (or with nil, clears) a device's pre-shared payload encryption key.
+// Keys are only stored encrypted (or in memory only); see ErrKeyUnprotected.
+func SetKey(deviceID string, key []byte) error {
+	if key != nil && len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+	if key != nil && !storage.Encrypting() && !storage.InMemory() {
+		return ErrKeyUnprotected
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, exists := manager.devices[deviceID]; !exists {
+		return ErrUnknownDevice
+	}
+	manager.record(Event{Type: EventKeyChanged, DeviceID: deviceID, Key: copyKey(key)})
+	if key == nil {
+		fmt.Printf("Device %s encryption key cleared\n", deviceID)
+	} else {
+		fmt.Printf("Device %s encryption key set\n", deviceID)
+	}
+	return nil
+}
+
+// HasKey reports whether a device has a pre-shared key
+func HasKey(deviceID string) bool {
+	_, ok := deviceKey(deviceID)
+	return ok
+}
+
+// EncryptFor wraps msg in an AES-GCM envelope for the device's pre-shared key.
+// Devices without a key get msg unchanged, so callers can use it for every sensitive payload.
+func EncryptFor(deviceID string, msg []byte) ([]byte, error) {
+	key, ok := deviceKey(deviceID)
+	if !ok {
+		return msg, nil
+	}
+	return messaging.Seal(key, msg)
+}
+
+// DecryptFrom opens an envelope payload sent by the device
+func DecryptFrom(deviceID string, payload []byte) ([]byte, error) {
+	key, ok := deviceKey(deviceID)
+	if !ok {
+		return nil, fmt.Errorf("device %s has no encryption key", deviceID)
+	}
+	return messaging.Open(key, payload)
+}
+
+func deviceKey(deviceID string) ([]byte, bool) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	device, exists := manager.devices[deviceID]
+	if !exists || device.Key == nil {
+		return nil, false
+	}
+	return copyKey(device.Key), true
+}
+
+func copyKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+	return append([]byte(nil), key...)
+}
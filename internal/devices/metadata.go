@@ -0,0 +1,123 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Metadata describes device hardware reported in the bootup handshake
+// Used to decide which OTA image a device should receive
+type Metadata struct {
+	HardwareType string   `json:"hw_type,omitempty"`
+	MAC          string   `json:"mac,omitempty"`
+	ChipRevision string   `json:"chip_rev,omitempty"`
+	FlashSize    string   `json:"flash_size,omitempty"`
+	Firmware     string   `json:"fw,omitempty"`
+	DisplayName  string   `json:"display_name,omitempty"` // JSON bootup "name" when it differs from "id"
+	Capabilities []string `json:"caps,omitempty"`
+	Protocol     uint8    `json:"proto,omitempty"` // Binary protocol version (0 = not reported, treated as 1)
+}
+
+// IsEmpty reports whether no metadata fields were reported
+func (m Metadata) IsEmpty() bool {
+	return m.HardwareType == "" && m.MAC == "" && m.ChipRevision == "" && m.FlashSize == "" &&
+		m.Firmware == "" && m.DisplayName == "" && len(m.Capabilities) == 0 && m.Protocol == 0
+}
+
+// HasCapability reports whether the device advertised a capability in its JSON bootup
+func (m Metadata) HasCapability(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// BootupPayload is the JSON bootup format, sent as a raw MQTT payload starting with '{'
+// instead of the binary MSG_DEVICE_CONFIG message. New fields can be added without
+// breaking firmware that still sends the legacy format.
+type BootupPayload struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Zip          string   `json:"zip"`
+	Firmware     string   `json:"fw"`
+	Capabilities []string `json:"caps"`
+	HardwareType string   `json:"hw"`
+	MAC          string   `json:"mac"`
+	ChipRevision string   `json:"chip_rev"`
+	FlashSize    string   `json:"flash"`
+	Protocol     uint8    `json:"proto"`
+}
+
+// IsJSONBootup reports whether a bootup payload uses the JSON format
+func IsJSONBootup(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == '{'
+}
+
+// ParseBootupJSON parses a JSON bootup payload into the device ID, zipcode and metadata.
+// The device ID (used for its MQTT topic) is "id", falling back to "name".
+func ParseBootupJSON(payload []byte) (string, string, Metadata, error) {
+	var p BootupPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", "", Metadata{}, fmt.Errorf("invalid JSON bootup payload: %w", err)
+	}
+
+	id := strings.TrimSpace(p.ID)
+	name := strings.TrimSpace(p.Name)
+	if id == "" {
+		id = name
+	}
+	m := Metadata{
+		HardwareType: strings.TrimSpace(p.HardwareType),
+		MAC:          strings.ToUpper(strings.TrimSpace(p.MAC)),
+		ChipRevision: strings.TrimSpace(p.ChipRevision),
+		FlashSize:    strings.TrimSpace(p.FlashSize),
+		Firmware:     strings.TrimSpace(p.Firmware),
+		Capabilities: p.Capabilities,
+		Protocol:     p.Protocol,
+	}
+	if name != id {
+		m.DisplayName = name
+	}
+	return id, strings.TrimSpace(p.Zip), m, nil
+}
+
+// ParseMetadata parses optional "key=value" bootup strings (after device name and zipcode)
+// Keys: hw, mac, chip_rev, flash, fw, proto. Unknown keys are skipped so newer firmware stays compatible.
+func ParseMetadata(fields []string) Metadata {
+	var m Metadata
+	for _, field := range fields {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			fmt.Printf("Warning: ignoring malformed bootup field %q\n", field)
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "hw":
+			m.HardwareType = value
+		case "mac":
+			m.MAC = strings.ToUpper(value)
+		case "chip_rev":
+			m.ChipRevision = value
+		case "flash":
+			m.FlashSize = value
+		case "fw":
+			m.Firmware = value
+		case "proto":
+			version, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				fmt.Printf("Warning: ignoring invalid protocol version %q\n", value)
+				continue
+			}
+			m.Protocol = uint8(version)
+		default:
+			fmt.Printf("Note: ignoring unknown bootup field %q\n", key)
+		}
+	}
+	return m
+}
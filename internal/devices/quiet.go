@@ -0,0 +1,93 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietHours is a daily window in the device's local time during which the server holds
+// back non-critical updates (weather refreshes, canvas frames). The window may cross
+// midnight, e.g. 23:00-07:00.
+type QuietHours struct {
+	Start string `json:"start"` // "HH:MM"
+	End   string `json:"end"`   // "HH:MM"
+}
+
+// Validate checks both times parse and differ
+func (q QuietHours) Validate() error {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return fmt.Errorf("invalid quiet hours start: %v", err)
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return fmt.Errorf("invalid quiet hours end: %v", err)
+	}
+	if start == end {
+		return fmt.Errorf("quiet hours start and end must differ")
+	}
+	return nil
+}
+
+// Contains reports whether t (in the device's local time) falls inside the window
+func (q QuietHours) Contains(t time.Time) bool {
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end // Crosses midnight
+}
+
+// NextEnd returns the end of the window containing or following t, in t's location
+func (q QuietHours) NextEnd(t time.Time) time.Time {
+	end, err := parseClock(q.End)
+	if err != nil {
+		return t
+	}
+	at := time.Date(t.Year(), t.Month(), t.Day(), end/60, end%60, 0, 0, t.Location())
+	if !at.After(t) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at
+}
+
+// parseClock returns minutes after midnight for "HH:MM"
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// SetQuietHours stores (or with nil, clears) a device's quiet hours
+func SetQuietHours(deviceID string, quiet *QuietHours) error {
+	if quiet != nil {
+		if err := quiet.Validate(); err != nil {
+			return err
+		}
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, exists := manager.devices[deviceID]; !exists {
+		return ErrUnknownDevice
+	}
+	manager.record(Event{Type: EventQuietHoursChanged, DeviceID: deviceID, QuietHours: copyQuietHours(quiet)})
+	fmt.Printf("Device %s quiet hours updated\n", deviceID)
+	return nil
+}
+
+func copyQuietHours(q *QuietHours) *QuietHours {
+	if q == nil {
+		return nil
+	}
+	copied := *q
+	return &copied
+}
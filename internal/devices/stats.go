@@ -0,0 +1,39 @@
+package devices
+
+import "time"
+
+// Stats are per-device connection counters, derived from the event log
+// so they survive restarts and are reproduced by a projection rebuild
+type Stats struct {
+	Bootups                 int     `json:"bootups"`
+	LWTEvents               int     `json:"lwt_events"`
+	HeartbeatTimeouts       int     `json:"heartbeat_timeouts"`
+	Heartbeats              int     `json:"heartbeats"`
+	HeartbeatIntervals      int     `json:"heartbeat_intervals"`
+	HeartbeatIntervalSec    float64 `json:"heartbeat_interval_sec"` // Sum over HeartbeatIntervals
+	AvgHeartbeatIntervalSec float64 `json:"avg_heartbeat_interval_sec"`
+	LongestOfflineGapSec    int64   `json:"longest_offline_gap_sec"`
+}
+
+func (s *Stats) noteHeartbeats(count int, intervals int, intervalSec float64) {
+	s.Heartbeats += count
+	s.HeartbeatIntervals += intervals
+	s.HeartbeatIntervalSec += intervalSec
+	if s.HeartbeatIntervals > 0 {
+		s.AvgHeartbeatIntervalSec = s.HeartbeatIntervalSec / float64(s.HeartbeatIntervals)
+	}
+}
+
+// noteBackOnline records the gap for a device returning after going offline at offlineSince
+func (s *Stats) noteBackOnline(offlineSince time.Time, now time.Time) {
+	if offlineSince.IsZero() || now.Before(offlineSince) {
+		return
+	}
+	s.noteOfflineGap(int64(now.Sub(offlineSince) / time.Second))
+}
+
+func (s *Stats) noteOfflineGap(gapSec int64) {
+	if gapSec > s.LongestOfflineGapSec {
+		s.LongestOfflineGapSec = gapSec
+	}
+}
@@ -0,0 +1,212 @@
+package display
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Decoders for Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"server_app/internal/etchsketch"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Image push: pictures uploaded through the admin API or dropped into a directory are
+// scaled to the LED matrix, reduced to the colors it can show and published as canvas
+// frames, like a drawing from a device.
+
+// Largest image file accepted
+const MaxImageBytes = 8 << 20
+
+// Largest image Decode accepts, in pixels. A small compressed file can declare huge
+// dimensions, and decoding allocates them all up front.
+const MaxImagePixels = 16 << 20
+
+// ErrTooLarge is returned by Decode for images over MaxImageBytes or MaxImagePixels
+var ErrTooLarge = errors.New("image too large")
+
+// Decode reads a PNG, JPEG or GIF (first frame)
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxImageBytes {
+		return nil, fmt.Errorf("%w (limit %d MB)", ErrTooLarge, MaxImageBytes>>20)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxImagePixels {
+		return nil, fmt.Errorf("%w (%dx%d, limit %d megapixels)", ErrTooLarge, cfg.Width, cfg.Height, MaxImagePixels>>20)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	return img, nil
+}
+
+// Fit scales img to fit width x height, keeping its aspect ratio and centering it on black.
+// Each output pixel is the average of the source pixels it covers, so fine detail blends
+// instead of dropping out.
+func Fit(img image.Image, width int, height int) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	b := img.Bounds()
+	if b.Empty() {
+		return out
+	}
+	w, h := width, b.Dy()*width/b.Dx()
+	if h > height {
+		w, h = b.Dx()*height/b.Dy(), height
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	left, top := (width-w)/2, (height-h)/2
+
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					// Transparent areas blend toward black like the letterbox
+					r += uint64(cr) * uint64(ca) / 0xFFFF
+					g += uint64(cg) * uint64(ca) / 0xFFFF
+					bl += uint64(cb) * uint64(ca) / 0xFFFF
+					n++
+				}
+			}
+			out.SetRGBA(left+x, top+y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 255})
+		}
+	}
+	return out
+}
+
+// Reduce maps img onto the first colors of etchsketch.Palette, with Floyd-Steinberg error
+// diffusion when dither is set (otherwise each pixel takes the nearest color)
+func Reduce(img image.Image, colors int, dither bool) *image.Paletted {
+	palette := make(color.Palette, colors)
+	for i := range palette {
+		palette[i] = etchsketch.Palette[i]
+	}
+	out := image.NewPaletted(img.Bounds(), palette)
+	if dither {
+		draw.FloydSteinberg.Draw(out, out.Bounds(), img, img.Bounds().Min)
+	} else {
+		draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	return out
+}
+
+// ToFrame converts an image to a canvas frame of the given size in the 8 channel colors
+func ToFrame(img image.Image, width int, height int, dither bool) etchsketch.Frame {
+	reduced := Reduce(Fit(img, width, height), 8, dither)
+	frame := etchsketch.NewFrame(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Indexes 0-7 of the palette are the channel bits
+			frame.SetPixel(x, y, reduced.ColorIndexAt(x, y))
+		}
+	}
+	return frame
+}
+
+// ToPaletteFrame converts an image to a 16x16 frame in the 16 palette colors
+func ToPaletteFrame(img image.Image, dither bool) etchsketch.PaletteFrame {
+	reduced := Reduce(Fit(img, 16, 16), etchsketch.PaletteSize, dither)
+	var frame etchsketch.PaletteFrame
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			frame[y][x] = reduced.ColorIndexAt(x, y)
+		}
+	}
+	return frame
+}
+
+// Files in a drop directory are left alone until unchanged for this long, so a copy in
+// progress is not read half-written
+const dropSettle = 2 * time.Second
+
+// Image file extensions picked up from a drop directory
+var dropExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true}
+
+// ScanDir pushes each image file in dir, oldest first, then moves it into dir/done, or
+// dir/failed if it could not be decoded or pushed. Returns the number of images pushed.
+func ScanDir(dir string, push func(name string, img image.Image) error) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	type dropped struct {
+		name    string
+		modTime time.Time
+	}
+	var files []dropped
+	for _, e := range entries {
+		if e.IsDir() || !dropExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < dropSettle {
+			continue
+		}
+		files = append(files, dropped{name: e.Name(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	pushed := 0
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		dest := "done"
+		if err := pushFile(path, f.name, push); err != nil {
+			fmt.Printf("Display: failed to push %s: %v\n", path, err)
+			dest = "failed"
+		} else {
+			pushed++
+		}
+		if err := os.MkdirAll(filepath.Join(dir, dest), 0755); err != nil {
+			return pushed, err
+		}
+		if err := os.Rename(path, filepath.Join(dir, dest, f.name)); err != nil {
+			return pushed, err
+		}
+	}
+	return pushed, nil
+}
+
+func pushFile(path string, name string, push func(name string, img image.Image) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	img, err := Decode(file)
+	if err != nil {
+		return err
+	}
+	return push(name, img)
+}
@@ -0,0 +1,129 @@
+package epaper
+
+import "image"
+
+// Gray levels for drawing; anything between black and white is dithered
+const (
+	Black = 0
+	White = 255
+)
+
+// Canvas is a grayscale drawing surface reduced to 1 bit per pixel by Dither
+type Canvas struct {
+	Width  int
+	Height int
+	pix    []uint8
+}
+
+// NewCanvas returns a white canvas
+func NewCanvas(width int, height int) *Canvas {
+	c := &Canvas{Width: width, Height: height, pix: make([]uint8, width*height)}
+	for i := range c.pix {
+		c.pix[i] = White
+	}
+	return c
+}
+
+// Set paints one pixel; points off the canvas are ignored
+func (c *Canvas) Set(x int, y int, gray uint8) {
+	if x < 0 || y < 0 || x >= c.Width || y >= c.Height {
+		return
+	}
+	c.pix[y*c.Width+x] = gray
+}
+
+// FillRect paints a w x h rectangle with its top left corner at x, y
+func (c *Canvas) FillRect(x int, y int, w int, h int, gray uint8) {
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			c.Set(x+dx, y+dy, gray)
+		}
+	}
+}
+
+// FillCircle paints a disc of radius r centered on cx, cy
+func (c *Canvas) FillCircle(cx int, cy int, r int, gray uint8) {
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			if dx*dx+dy*dy <= r*r {
+				c.Set(cx+dx, cy+dy, gray)
+			}
+		}
+	}
+}
+
+// Text draws s with its top left corner at x, y, each font pixel a scale x scale block
+func (c *Canvas) Text(x int, y int, s string, scale int, gray uint8) {
+	for _, r := range s {
+		rows := glyph(r)
+		for gy, bits := range rows {
+			for gx := 0; gx < glyphWidth; gx++ {
+				if bits&(1<<uint(glyphWidth-1-gx)) != 0 {
+					c.FillRect(x+gx*scale, y+gy*scale, scale, scale, gray)
+				}
+			}
+		}
+		x += (glyphWidth + glyphSpacing) * scale
+	}
+}
+
+// FitScale returns the largest scale (at least 1) at which s fits in w x h
+func FitScale(s string, w int, h int) int {
+	scale := 1
+	for TextWidth(s, scale+1) <= w && TextHeight(scale+1) <= h {
+		scale++
+	}
+	return scale
+}
+
+// Dither reduces the canvas to a packed 1-bit bitmap (1 = black) with Floyd-Steinberg
+// error diffusion, so gray areas come out as even dot patterns
+func (c *Canvas) Dither() []byte {
+	errs := make([]int, len(c.pix))
+	for i, p := range c.pix {
+		errs[i] = int(p)
+	}
+	stride := (c.Width + 7) / 8
+	bitmap := make([]byte, stride*c.Height)
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			i := y*c.Width + x
+			old := errs[i]
+			out := White
+			if old < 128 {
+				out = Black
+				bitmap[y*stride+x/8] |= 0x80 >> uint(x%8)
+			}
+			diff := old - out
+			if x+1 < c.Width {
+				errs[i+1] += diff * 7 / 16
+			}
+			if y+1 < c.Height {
+				if x > 0 {
+					errs[i+c.Width-1] += diff * 3 / 16
+				}
+				errs[i+c.Width] += diff * 5 / 16
+				if x+1 < c.Width {
+					errs[i+c.Width+1] += diff * 1 / 16
+				}
+			}
+		}
+	}
+	return bitmap
+}
+
+// BitmapImage expands a packed bitmap back into an image, e.g. for previews
+func BitmapImage(bitmap []byte, width int, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	stride := (width + 7) / 8
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gray := uint8(White)
+			if bitmap[y*stride+x/8]&(0x80>>uint(x%8)) != 0 {
+				gray = Black
+			}
+			img.Pix[y*img.Stride+x] = gray
+		}
+	}
+	return img
+}
@@ -0,0 +1,185 @@
+package epaper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Widgets a screen can be composed of, stacked top to bottom in the configured order
+const (
+	WidgetClock    = "clock"
+	WidgetWeather  = "weather"
+	WidgetCalendar = "calendar"
+)
+
+// Content is what the widgets show
+type Content struct {
+	Now     time.Time // Local time
+	Weather *Weather  // nil = no usable weather
+	Events  []Event   // Upcoming calendar entries, soonest first
+}
+
+// Weather shown by the weather widget
+type Weather struct {
+	Temp      int
+	Condition string // e.g. "Clouds"; "" = unknown
+	Stale     bool   // Cached data past its validity
+	Forecast  []ForecastDay
+}
+
+// ForecastDay is one day of the weather widget's forecast row
+type ForecastDay struct {
+	High   int
+	Precip int // Percent
+}
+
+// Event is one calendar entry
+type Event struct {
+	Date time.Time
+	Name string
+}
+
+// Padding around widget content, in pixels
+const padding = 4
+
+// Render composes the widgets onto a width x height canvas, each getting an equal band
+func Render(width int, height int, widgets []string, content Content) (*Canvas, error) {
+	if len(widgets) == 0 {
+		return nil, fmt.Errorf("no widgets configured")
+	}
+	c := NewCanvas(width, height)
+	for i, name := range widgets {
+		top := height * i / len(widgets)
+		bottom := height * (i + 1) / len(widgets)
+		if i > 0 {
+			c.FillRect(0, top, width, 1, Black)
+			top++
+		}
+		band := band{c: c, x: padding, y: top + padding, w: width - 2*padding, h: bottom - top - 2*padding}
+		switch name {
+		case WidgetClock:
+			band.clock(content.Now)
+		case WidgetWeather:
+			band.weather(content.Weather)
+		case WidgetCalendar:
+			band.calendar(content.Now, content.Events)
+		default:
+			return nil, fmt.Errorf("unknown widget %q", name)
+		}
+	}
+	return c, nil
+}
+
+// band is the area of the canvas given to one widget
+type band struct {
+	c          *Canvas
+	x, y, w, h int
+}
+
+// Large time with the date underneath
+func (b band) clock(now time.Time) {
+	date := strings.ToUpper(now.Format("Mon Jan 2"))
+	dateScale := FitScale(date, b.w, b.h/4)
+	timeText := now.Format("15:04")
+	timeScale := FitScale(timeText, b.w, b.h-TextHeight(dateScale)-padding)
+
+	timeY := b.y
+	b.c.Text(b.x+(b.w-TextWidth(timeText, timeScale))/2, timeY, timeText, timeScale, Black)
+	dateY := timeY + TextHeight(timeScale) + padding
+	b.c.Text(b.x+(b.w-TextWidth(date, dateScale))/2, dateY, date, dateScale, Black)
+}
+
+// Shade of the condition icon, so conditions differ even on a 1-bit panel
+var conditionShades = map[string]uint8{
+	"Clear":        230,
+	"Snow":         200,
+	"Clouds":       150,
+	"Mist":         170,
+	"Fog":          170,
+	"Drizzle":      110,
+	"Rain":         80,
+	"Thunderstorm": 30,
+}
+
+// Temperature beside a condition icon, forecast highs/precipitation below
+func (b band) weather(w *Weather) {
+	if w == nil {
+		text := "NO WEATHER"
+		scale := FitScale(text, b.w, b.h)
+		b.c.Text(b.x+(b.w-TextWidth(text, scale))/2, b.y+(b.h-TextHeight(scale))/2, text, scale, Black)
+		return
+	}
+
+	forecastH := 0
+	if len(w.Forecast) > 0 {
+		forecastH = b.h / 3
+	}
+	mainH := b.h - forecastH
+
+	// Condition icon: a disc shaded by condition, dithered on the panel
+	r := mainH / 2
+	if r > b.w/6 {
+		r = b.w / 6
+	}
+	shade, known := conditionShades[w.Condition]
+	if !known {
+		shade = 128
+	}
+	b.c.FillCircle(b.x+r, b.y+mainH/2, r, Black)
+	b.c.FillCircle(b.x+r, b.y+mainH/2, r-1, shade)
+
+	temp := fmt.Sprintf("%d°", w.Temp)
+	if w.Stale {
+		temp += "?"
+	}
+	textX := b.x + 2*r + padding
+	textW := b.w - 2*r - padding
+	condition := strings.ToUpper(w.Condition)
+	condScale := 1
+	if condition != "" {
+		condScale = FitScale(condition, textW, mainH/4)
+	}
+	tempScale := FitScale(temp, textW, mainH-TextHeight(condScale)-padding)
+	b.c.Text(textX, b.y, temp, tempScale, Black)
+	if condition != "" {
+		b.c.Text(textX, b.y+TextHeight(tempScale)+padding, condition, condScale, Black)
+	}
+
+	if forecastH == 0 {
+		return
+	}
+	colW := b.w / len(w.Forecast)
+	for i, day := range w.Forecast {
+		text := fmt.Sprintf("%d° %d%%", day.High, day.Precip)
+		scale := FitScale(text, colW-2*padding, forecastH-padding)
+		x := b.x + i*colW + (colW-TextWidth(text, scale))/2
+		b.c.Text(x, b.y+mainH+padding, text, scale, Black)
+	}
+}
+
+// Today's date on a shaded header, then upcoming events
+func (b band) calendar(now time.Time, events []Event) {
+	header := strings.ToUpper(now.Format("Monday, January 2"))
+	lineH := b.h / 4
+	headerScale := FitScale(header, b.w-2*padding, lineH-2)
+	b.c.FillRect(b.x, b.y, b.w, TextHeight(headerScale)+2*padding, 220)
+	b.c.Text(b.x+padding, b.y+padding, header, headerScale, Black)
+
+	y := b.y + TextHeight(headerScale) + 3*padding
+	if len(events) == 0 {
+		events = []Event{{Name: "No upcoming events"}}
+	}
+	for _, e := range events {
+		line := strings.ToUpper(e.Name)
+		if !e.Date.IsZero() {
+			line = strings.ToUpper(e.Date.Format("Jan 2")) + " " + line
+		}
+		scale := FitScale(line, b.w, lineH-padding)
+		if y+TextHeight(scale) > b.y+b.h {
+			return
+		}
+		b.c.Text(b.x, y, line, scale, Black)
+		y += TextHeight(scale) + padding
+	}
+}
@@ -0,0 +1,64 @@
+package etchsketch
+
+import "fmt"
+
+// ParseArt converts up to 16 rows of up to 16 color letters into canvas channels
+// Letters: R, G, B, Y (red+green), M (red+blue), C (green+blue), W (all); '.' or ' ' is off.
+func ParseArt(rows []string) ([16]uint16, [16]uint16, [16]uint16, error) {
+	var red, green, blue [16]uint16
+	if len(rows) > 16 {
+		return red, green, blue, fmt.Errorf("art has %d rows, maximum is 16", len(rows))
+	}
+	for y, row := range rows {
+		if len(row) > 16 {
+			return red, green, blue, fmt.Errorf("art row %d has %d columns, maximum is 16", y, len(row))
+		}
+		for x, c := range row {
+			bit := uint16(1) << x
+			switch c {
+			case 'R':
+				red[y] |= bit
+			case 'G':
+				green[y] |= bit
+			case 'B':
+				blue[y] |= bit
+			case 'Y':
+				red[y] |= bit
+				green[y] |= bit
+			case 'M':
+				red[y] |= bit
+				blue[y] |= bit
+			case 'C':
+				green[y] |= bit
+				blue[y] |= bit
+			case 'W':
+				red[y] |= bit
+				green[y] |= bit
+				blue[y] |= bit
+			case '.', ' ':
+			default:
+				return red, green, blue, fmt.Errorf("art row %d has invalid color %q", y, c)
+			}
+		}
+	}
+	return red, green, blue, nil
+}
+
+// FormatArt converts canvas channels into 16 rows of color letters (the reverse of ParseArt)
+func FormatArt(red [16]uint16, green [16]uint16, blue [16]uint16) []string {
+	return FormatFrameArt(NewFrame(16, 16).WithWindow(red, green, blue))
+}
+
+// FormatFrameArt converts a frame of any canvas size into rows of color letters
+func FormatFrameArt(f Frame) []string {
+	letters := [8]byte{'.', 'R', 'G', 'Y', 'B', 'M', 'C', 'W'} // Indexed by red | green<<1 | blue<<2
+	rows := make([]string, f.Height)
+	for y := range rows {
+		row := make([]byte, f.Width)
+		for x := range row {
+			row[x] = letters[f.Pixel(x, y)]
+		}
+		rows[y] = string(row)
+	}
+	return rows
+}
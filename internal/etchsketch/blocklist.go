@@ -0,0 +1,120 @@
+package etchsketch
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Stencil is a blocked shape matched anywhere on the canvas, ignoring color.
+// Each pattern row uses 'X' for a lit pixel, '-' for an unlit pixel and '.' for don't care.
+type Stencil struct {
+	Name    string   `json:"name"`
+	Pattern []string `json:"pattern"`
+}
+
+// compiled stencil: per-row masks of pixels that must be lit / must be unlit
+type stencilMask struct {
+	name   string
+	width  int
+	height int
+	lit    []uint16
+	unlit  []uint16
+}
+
+var (
+	blocklistMu sync.RWMutex
+	blocklist   []stencilMask
+)
+
+func compileStencil(s Stencil) (stencilMask, error) {
+	if s.Name == "" {
+		return stencilMask{}, fmt.Errorf("stencil requires a name")
+	}
+	if len(s.Pattern) == 0 || len(s.Pattern) > 16 {
+		return stencilMask{}, fmt.Errorf("stencil %s must have 1-16 rows", s.Name)
+	}
+
+	m := stencilMask{name: s.Name, height: len(s.Pattern), width: len(s.Pattern[0])}
+	if m.width == 0 || m.width > 16 {
+		return stencilMask{}, fmt.Errorf("stencil %s rows must be 1-16 columns", s.Name)
+	}
+	var anyLit bool
+	for y, row := range s.Pattern {
+		if len(row) != m.width {
+			return stencilMask{}, fmt.Errorf("stencil %s row %d has %d columns, expected %d", s.Name, y, len(row), m.width)
+		}
+		var lit, unlit uint16
+		for x, c := range row {
+			switch c {
+			case 'X':
+				lit |= 1 << x
+				anyLit = true
+			case '-':
+				unlit |= 1 << x
+			case '.':
+			default:
+				return stencilMask{}, fmt.Errorf("stencil %s has invalid character %q", s.Name, c)
+			}
+		}
+		m.lit = append(m.lit, lit)
+		m.unlit = append(m.unlit, unlit)
+	}
+	if !anyLit {
+		return stencilMask{}, fmt.Errorf("stencil %s has no lit pixels", s.Name)
+	}
+	return m, nil
+}
+
+// SetBlocklist replaces the blocked stencils; the previous list is kept if any stencil is invalid
+func SetBlocklist(stencils []Stencil) error {
+	compiled := make([]stencilMask, 0, len(stencils))
+	for _, s := range stencils {
+		m, err := compileStencil(s)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, m)
+	}
+
+	blocklistMu.Lock()
+	blocklist = compiled
+	blocklistMu.Unlock()
+	return nil
+}
+
+// MatchBlocklist returns the name of the first blocked stencil found in a 16x16 frame
+func MatchBlocklist(red [16]uint16, green [16]uint16, blue [16]uint16) (string, bool) {
+	return MatchBlocklistFrame(NewFrame(16, 16).WithWindow(red, green, blue))
+}
+
+// MatchBlocklistFrame returns the name of the first blocked stencil found anywhere on a
+// frame of any canvas size
+func MatchBlocklistFrame(f Frame) (string, bool) {
+	lit := make([]uint64, f.Height)
+	for y := range lit {
+		lit[y] = f.Red[y] | f.Green[y] | f.Blue[y]
+	}
+
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	for _, m := range blocklist {
+		for oy := 0; oy+m.height <= f.Height; oy++ {
+			for ox := 0; ox+m.width <= f.Width; ox++ {
+				if m.matchesAt(lit, ox, oy) {
+					return m.name, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func (m stencilMask) matchesAt(lit []uint64, ox int, oy int) bool {
+	for y := 0; y < m.height; y++ {
+		row := uint16(lit[oy+y] >> ox)
+		if row&m.lit[y] != m.lit[y] || row&m.unlit[y] != 0 {
+			return false
+		}
+	}
+	return true
+}
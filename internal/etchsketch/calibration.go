@@ -0,0 +1,28 @@
+package etchsketch
+
+import "encoding/binary"
+
+// EncodeCalibratedFrame encodes a frame for one device's panel
+// Returns byte array: [type(0x22)][length(101)][seq][red[16]][green[16]][blue[16]][levels[3]]
+// A channel whose level is 0 is cleared so the device does not light it at all.
+func EncodeCalibratedFrame(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16, levels [3]uint8) []byte {
+	msg := make([]byte, 103) // 2-byte header + 101-byte payload
+	msg[0] = 0x22            // MSG_TYPE_ETCH_CALIBRATED_FRAME
+	msg[1] = 101             // Payload length
+
+	binary.BigEndian.PutUint16(msg[2:4], seq)
+
+	offset := 4
+	for c, channel := range [3][16]uint16{red, green, blue} {
+		for i := 0; i < 16; i++ {
+			row := channel[i]
+			if levels[c] == 0 {
+				row = 0
+			}
+			binary.LittleEndian.PutUint16(msg[offset:offset+2], row)
+			offset += 2
+		}
+	}
+	copy(msg[offset:], levels[:])
+	return msg
+}
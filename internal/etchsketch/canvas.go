@@ -5,31 +5,42 @@ import (
 	"sync"
 )
 
-// Canvas represents the shared 16x16 drawing canvas with 3 color channels
+// Canvas represents the shared drawing canvas (16x16 unless sized otherwise) with 3 color channels
 type Canvas struct {
 	mu       sync.RWMutex
-	red      [16]uint16 // Bitmask for each row (16 columns per row)
-	green    [16]uint16
-	blue     [16]uint16
-	sequence uint16 // Monotonically increasing sequence number
+	frame    Frame         // Bitmask for each row per channel
+	colors   PaletteFrame  // Palette index per pixel of the 16x16 window (see palette.go)
+	sequence uint16        // Monotonically increasing sequence number
+	history  []canvasState // Earlier states for undo, oldest first (see undo.go)
 }
 
-// NewCanvas creates a new empty canvas
+// NewCanvas creates a new empty 16x16 canvas
 func NewCanvas() *Canvas {
+	return NewSizedCanvas(16, 16)
+}
+
+// NewSizedCanvas creates a new empty canvas of the given size (see CheckCanvasSize)
+func NewSizedCanvas(width int, height int) *Canvas {
 	return &Canvas{
-		red:      [16]uint16{},
-		green:    [16]uint16{},
-		blue:     [16]uint16{},
+		frame:    NewFrame(width, height),
 		sequence: 0,
 	}
 }
 
-// GetState returns a deep copy of the current canvas state and sequence number
+// GetState returns a deep copy of the canvas's 16x16 window and the sequence number
 func (c *Canvas) GetState() (red [16]uint16, green [16]uint16, blue [16]uint16, seq uint16) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.red, c.green, c.blue, c.sequence
+	red, green, blue = c.frame.Window()
+	return red, green, blue, c.sequence
+}
+
+// GetFrame returns a copy of the whole canvas and the sequence number
+func (c *Canvas) GetFrame() (Frame, uint16) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.frame.Clone(), c.sequence
 }
 
 // GetSequence returns the current sequence number
@@ -39,17 +50,29 @@ func (c *Canvas) GetSequence() uint16 {
 	return c.sequence
 }
 
-// SetState replaces the entire canvas state and sequence number
+// SetState replaces the canvas's 16x16 window and the sequence number
+// Palette colors are kept for pixels whose channels did not change.
 func (c *Canvas) SetState(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.sequence = seq
-	c.red = red
-	c.green = green
-	c.blue = blue
+	c.commitLocked(seq, c.frame.WithWindow(red, green, blue), c.colors.MergeChannels(red, green, blue))
+}
+
+// SetFrame replaces the whole canvas (same size) and the sequence number
+func (c *Canvas) SetFrame(seq uint16, f Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commitLocked(seq, f.Clone(), c.colors.MergeChannels(f.Window()))
+}
+
+// Size returns the canvas dimensions
+func (c *Canvas) Size() (width int, height int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.frame.Width, c.frame.Height
 }
 
-// EncodeFullFrame encodes the full canvas state as a frame message
+// EncodeFullFrame encodes the canvas's 16x16 window as a frame message
 // Returns byte array: [type(0x21)][length(98)][seq][red[16]][green[16]][blue[16]]
 func (c *Canvas) EncodeFullFrame() []byte {
 	c.mu.RLock()
@@ -61,23 +84,24 @@ func (c *Canvas) EncodeFullFrame() []byte {
 
 	// Encode sequence number (big-endian)
 	binary.BigEndian.PutUint16(msg[2:4], c.sequence)
+	red, green, blue := c.frame.Window()
 
 	// Encode red channel (16 x uint16) using native endianness (little-endian)
 	offset := 4
 	for i := 0; i < 16; i++ {
-		binary.LittleEndian.PutUint16(msg[offset:offset+2], c.red[i])
+		binary.LittleEndian.PutUint16(msg[offset:offset+2], red[i])
 		offset += 2
 	}
 
 	// Encode green channel (16 x uint16) using native endianness (little-endian)
 	for i := 0; i < 16; i++ {
-		binary.LittleEndian.PutUint16(msg[offset:offset+2], c.green[i])
+		binary.LittleEndian.PutUint16(msg[offset:offset+2], green[i])
 		offset += 2
 	}
 
 	// Encode blue channel (16 x uint16) using native endianness (little-endian)
 	for i := 0; i < 16; i++ {
-		binary.LittleEndian.PutUint16(msg[offset:offset+2], c.blue[i])
+		binary.LittleEndian.PutUint16(msg[offset:offset+2], blue[i])
 		offset += 2
 	}
 
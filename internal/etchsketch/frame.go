@@ -0,0 +1,356 @@
+package etchsketch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Canvas sizes: the shared canvas can be larger than the 16x16 of the original protocol
+// (e.g. for 32x32 matrix panels). The 1-bit frame (0x21), palette frames, calibrated frames,
+// moderation, federation and recordings all work on the top-left 16x16 window (the
+// blocklist checks the whole canvas); whole frames of larger canvases travel as chunked
+// frame messages (0x29).
+
+// Canvas size limits (a row is a uint64 bitmask)
+const (
+	MinCanvasSize = 16
+	MaxCanvasSize = 64
+)
+
+// Frame is a canvas image of any size: a bitmask per row for each color channel,
+// bit N of a row is column N
+type Frame struct {
+	Width  int
+	Height int
+	Red    []uint64
+	Green  []uint64
+	Blue   []uint64
+}
+
+// NewFrame creates a blank frame
+func NewFrame(width int, height int) Frame {
+	return Frame{
+		Width:  width,
+		Height: height,
+		Red:    make([]uint64, height),
+		Green:  make([]uint64, height),
+		Blue:   make([]uint64, height),
+	}
+}
+
+// CheckCanvasSize reports whether a canvas can have these dimensions
+func CheckCanvasSize(width int, height int) error {
+	if width < MinCanvasSize || width > MaxCanvasSize || height < MinCanvasSize || height > MaxCanvasSize {
+		return fmt.Errorf("canvas size %dx%d out of range (%d-%d per side)", width, height, MinCanvasSize, MaxCanvasSize)
+	}
+	return nil
+}
+
+// Clone returns a copy that shares no rows with f
+func (f Frame) Clone() Frame {
+	c := NewFrame(f.Width, f.Height)
+	copy(c.Red, f.Red)
+	copy(c.Green, f.Green)
+	copy(c.Blue, f.Blue)
+	return c
+}
+
+// Equal reports whether two frames have the same size and pixels
+func (f Frame) Equal(o Frame) bool {
+	if f.Width != o.Width || f.Height != o.Height {
+		return false
+	}
+	for y := 0; y < f.Height; y++ {
+		if f.Red[y] != o.Red[y] || f.Green[y] != o.Green[y] || f.Blue[y] != o.Blue[y] {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether the pixel is on the frame
+func (f Frame) Contains(x int, y int) bool {
+	return x >= 0 && y >= 0 && x < f.Width && y < f.Height
+}
+
+// Pixel returns the channel bits (ColorRed, ...) of a pixel
+func (f Frame) Pixel(x int, y int) uint8 {
+	bit := uint64(1) << x
+	var bits uint8
+	if f.Red[y]&bit != 0 {
+		bits |= ColorRed
+	}
+	if f.Green[y]&bit != 0 {
+		bits |= ColorGreen
+	}
+	if f.Blue[y]&bit != 0 {
+		bits |= ColorBlue
+	}
+	return bits
+}
+
+// SetPixel sets the channel bits of a pixel (f's rows are changed in place)
+func (f Frame) SetPixel(x int, y int, bits uint8) {
+	bit := uint64(1) << x
+	for _, ch := range []struct {
+		mask uint8
+		rows []uint64
+	}{{ColorRed, f.Red}, {ColorGreen, f.Green}, {ColorBlue, f.Blue}} {
+		if bits&ch.mask != 0 {
+			ch.rows[y] |= bit
+		} else {
+			ch.rows[y] &^= bit
+		}
+	}
+}
+
+// Window returns the top-left 16x16 area in the original frame layout
+func (f Frame) Window() (red [16]uint16, green [16]uint16, blue [16]uint16) {
+	for y := 0; y < 16 && y < f.Height; y++ {
+		red[y] = uint16(f.Red[y])
+		green[y] = uint16(f.Green[y])
+		blue[y] = uint16(f.Blue[y])
+	}
+	return red, green, blue
+}
+
+// WithWindow returns a copy of f with the top-left 16x16 area replaced
+func (f Frame) WithWindow(red [16]uint16, green [16]uint16, blue [16]uint16) Frame {
+	c := f.Clone()
+	for y := 0; y < 16 && y < c.Height; y++ {
+		c.Red[y] = c.Red[y]&^0xFFFF | uint64(red[y])
+		c.Green[y] = c.Green[y]&^0xFFFF | uint64(green[y])
+		c.Blue[y] = c.Blue[y]&^0xFFFF | uint64(blue[y])
+	}
+	return c
+}
+
+// Apply returns a copy of f with the pixel updates applied in order; updates off the
+// frame are skipped
+func (f Frame) Apply(updates []PixelUpdate) Frame {
+	c := f.Clone()
+	for _, u := range updates {
+		if u.Validate() != nil || !c.Contains(int(u.X), int(u.Y)) {
+			continue
+		}
+		color := u.Color
+		if u.Op == PixelClear && color == 0 {
+			color = ColorAll
+		}
+		bits := c.Pixel(int(u.X), int(u.Y))
+		switch u.Op {
+		case PixelSet:
+			bits |= color
+		case PixelClear:
+			bits &^= color
+		case PixelToggle:
+			bits ^= color
+		}
+		c.SetPixel(int(u.X), int(u.Y), bits)
+	}
+	return c
+}
+
+// frameJSON shows a frame as one string per row, one channel-bits digit (0-7) per pixel
+type frameJSON struct {
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	Rows   []string `json:"rows"`
+}
+
+func (f Frame) MarshalJSON() ([]byte, error) {
+	out := frameJSON{Width: f.Width, Height: f.Height, Rows: make([]string, f.Height)}
+	for y := 0; y < f.Height; y++ {
+		var row strings.Builder
+		for x := 0; x < f.Width; x++ {
+			row.WriteByte('0' + f.Pixel(x, y))
+		}
+		out.Rows[y] = row.String()
+	}
+	return json.Marshal(out)
+}
+
+func (f *Frame) UnmarshalJSON(data []byte) error {
+	var in frameJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if err := CheckCanvasSize(in.Width, in.Height); err != nil {
+		return err
+	}
+	if len(in.Rows) != in.Height {
+		return fmt.Errorf("frame has %d rows, expected %d", len(in.Rows), in.Height)
+	}
+	frame := NewFrame(in.Width, in.Height)
+	for y, row := range in.Rows {
+		if len(row) != in.Width {
+			return fmt.Errorf("row %d has %d pixels, expected %d", y, len(row), in.Width)
+		}
+		for x := 0; x < len(row); x++ {
+			if row[x] < '0' || row[x] > '7' {
+				return fmt.Errorf("row %d: pixel %d is %q, expected channel bits 0-7", y, x, row[x])
+			}
+			frame.SetPixel(x, y, row[x]-'0')
+		}
+	}
+	*f = frame
+	return nil
+}
+
+// Bytes of one channel: width*height bits, pixel (x, y) at bit y*width+x, least
+// significant bit first (a 16-wide row is the little-endian uint16 of the 1-bit frame)
+func channelBytes(width int, height int) int {
+	return (width*height + 7) / 8
+}
+
+// Frame bytes per chunk message: 255-byte payload minus the 6-byte chunk header
+const frameChunkData = 249
+
+// EncodeFrameChunks encodes a whole frame as chunk messages, sent in order
+// Returns byte arrays: [type(0x29)][length][seq][width][height][chunk_index][chunk_count][data]
+// The chunks' data concatenated is the red, green and blue channel bitsets in turn.
+func EncodeFrameChunks(seq uint16, f Frame) [][]byte {
+	per := channelBytes(f.Width, f.Height)
+	data := make([]byte, 3*per)
+	for c, rows := range [][]uint64{f.Red, f.Green, f.Blue} {
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				if rows[y]&(uint64(1)<<x) != 0 {
+					i := y*f.Width + x
+					data[c*per+i/8] |= 1 << (i % 8)
+				}
+			}
+		}
+	}
+
+	count := (len(data) + frameChunkData - 1) / frameChunkData
+	msgs := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		part := data[i*frameChunkData:]
+		if len(part) > frameChunkData {
+			part = part[:frameChunkData]
+		}
+		msg := make([]byte, 8, 8+len(part))
+		msg[0] = 0x29 // MSG_TYPE_ETCH_FRAME_CHUNK
+		msg[1] = byte(6 + len(part))
+		binary.BigEndian.PutUint16(msg[2:4], seq)
+		msg[4] = byte(f.Width)
+		msg[5] = byte(f.Height)
+		msg[6] = byte(i)
+		msg[7] = byte(count)
+		msg = append(msg, part...)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// FrameChunk is one decoded chunk message
+type FrameChunk struct {
+	Seq    uint16
+	Width  int
+	Height int
+	Index  int
+	Count  int
+	Data   []byte
+}
+
+// DecodeFrameChunk parses a frame chunk message payload
+func DecodeFrameChunk(payload []byte) (FrameChunk, error) {
+	if len(payload) < 6 {
+		return FrameChunk{}, ErrInvalidPayload
+	}
+	c := FrameChunk{
+		Seq:    binary.BigEndian.Uint16(payload[0:2]),
+		Width:  int(payload[2]),
+		Height: int(payload[3]),
+		Index:  int(payload[4]),
+		Count:  int(payload[5]),
+		Data:   payload[6:],
+	}
+	if err := CheckCanvasSize(c.Width, c.Height); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if c.Count != (3*channelBytes(c.Width, c.Height)+frameChunkData-1)/frameChunkData || c.Index >= c.Count {
+		return c, fmt.Errorf("%w: chunk %d of %d for a %dx%d frame", ErrInvalidPayload, c.Index, c.Count, c.Width, c.Height)
+	}
+	return c, nil
+}
+
+// Incomplete chunked frames are dropped after this long
+const frameAssemblyTimeout = 10 * time.Second
+
+type frameAssembly struct {
+	chunks  [][]byte
+	missing int
+	started time.Time
+}
+
+// frameAssembler collects the chunks of frames until they are complete
+type frameAssembler struct {
+	mu      sync.Mutex
+	pending map[string]*frameAssembly // By seq and size
+}
+
+// FrameAssembler collects chunked frames (0x29) outside the manager, e.g. when replaying
+// the messages sent to a device
+type FrameAssembler struct {
+	a frameAssembler
+}
+
+// Add stores a chunk and returns the frame once all its chunks arrived
+func (a *FrameAssembler) Add(c FrameChunk) (Frame, bool) {
+	return a.a.add(c)
+}
+
+// add stores a chunk and returns the frame once all its chunks arrived
+func (a *frameAssembler) add(c FrameChunk) (Frame, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for key, p := range a.pending {
+		if now.Sub(p.started) > frameAssemblyTimeout {
+			delete(a.pending, key)
+		}
+	}
+	if a.pending == nil {
+		a.pending = make(map[string]*frameAssembly)
+	}
+
+	key := fmt.Sprintf("%d/%dx%d", c.Seq, c.Width, c.Height)
+	p, exists := a.pending[key]
+	if !exists {
+		p = &frameAssembly{chunks: make([][]byte, c.Count), missing: c.Count, started: now}
+		a.pending[key] = p
+	}
+	if p.chunks[c.Index] == nil {
+		p.chunks[c.Index] = append([]byte(nil), c.Data...)
+		p.missing--
+	}
+	if p.missing > 0 {
+		return Frame{}, false
+	}
+	delete(a.pending, key)
+
+	var data []byte
+	for _, chunk := range p.chunks {
+		data = append(data, chunk...)
+	}
+	per := channelBytes(c.Width, c.Height)
+	if len(data) != 3*per {
+		fmt.Printf("EtchSketch: dropping chunked frame seq=%d: %d bytes, expected %d\n", c.Seq, len(data), 3*per)
+		return Frame{}, false
+	}
+	f := NewFrame(c.Width, c.Height)
+	for ch, rows := range [][]uint64{f.Red, f.Green, f.Blue} {
+		for i := 0; i < c.Width*c.Height; i++ {
+			if data[ch*per+i/8]&(1<<(i%8)) != 0 {
+				rows[i/c.Width] |= uint64(1) << (i % c.Width)
+			}
+		}
+	}
+	return f, true
+}
@@ -0,0 +1,132 @@
+package etchsketch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FrameRecord is one recorded full-frame canvas state
+type FrameRecord struct {
+	Time  time.Time  `json:"time"`
+	Seq   uint16     `json:"seq"`
+	Red   [16]uint16 `json:"red"`
+	Green [16]uint16 `json:"green"`
+	Blue  [16]uint16 `json:"blue"`
+}
+
+func (r FrameRecord) recordedAt() time.Time { return r.Time }
+
+// Records kept in a recording file
+type timed interface {
+	recordedAt() time.Time
+}
+
+// A recording file is rotated to <path>.1 (replacing the one before) once it grows past this,
+// so a recording keeps between one and two files' worth of the most recent entries
+const maxRecordingBytes = 8 << 20
+
+// recorder appends records (every applied frame, every stroke) to a JSON-lines file
+type recorder[T timed] struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func openRecorder[T timed](path string) (*recorder[T], error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %v", err)
+	}
+	r := &recorder[T]{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder[T]) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open recording %s: %v", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open recording %s: %v", r.path, err)
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *recorder[T]) record(rec T) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size >= maxRecordingBytes {
+		if err := r.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(append(line, '\n'))
+	r.size += int64(n)
+	return err
+}
+
+// rotateLocked moves the full file to <path>.1 and starts a new one. Caller holds mu.
+func (r *recorder[T]) rotateLocked() error {
+	r.file.Close()
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		fmt.Printf("EtchSketch: failed to rotate recording %s: %v\n", r.path, err)
+	}
+	return r.open()
+}
+
+// read returns recorded entries with from <= time <= to (zero bounds are open), streaming
+// the rotated file and then the current one line by line
+func (r *recorder[T]) read(from time.Time, to time.Time) ([]T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []T
+	for _, path := range []string{r.path + ".1", r.path} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result, err = scanRecords(f, from, to, result)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func scanRecords[T timed](f *os.File, from time.Time, to time.Time, result []T) ([]T, error) {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec T
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // torn line from a crash mid-write
+		}
+		at := rec.recordedAt()
+		if (!from.IsZero() && at.Before(from)) || (!to.IsZero() && at.After(to)) {
+			continue
+		}
+		result = append(result, rec)
+	}
+	return result, scanner.Err()
+}
@@ -1,66 +1,282 @@
 package etchsketch
 
 import (
+	"errors"
 	"fmt"
 	"sync"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"time"
 )
 
+// ErrUnknownSubmission is returned when a moderation queue entry does not exist (or expired)
+var ErrUnknownSubmission = errors.New("unknown submission")
+
 // Manager handles incoming etchsketch messages and broadcasts updates
 type Manager struct {
 	mu          sync.RWMutex
 	canvas      *Canvas
-	client      MQTT.Client
+	publish     PublishFunc
 	topic       string
 	lastSeenSeq uint16
-	deviceIDs   map[string]bool // Track connected devices
+	deviceIDs   map[string]bool        // Track connected devices
+	recorder    *recorder[FrameRecord] // Optional history of applied frames (nil = not recording)
+	onFrame     func(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16)
+
+	// Canvases larger than 16x16: whole frames go out as chunk messages, which must not be
+	// coalesced like single frames (nil = not sent)
+	publishChunks PublishFunc
+	chunksNeeded  func(topic string, f Frame, seq uint16) bool // nil = always
+	chunks        frameAssembler
+
+	// Pixel edit batches for replay (nil = not recording), and the replay running, if any
+	strokes     *recorder[StrokeRecord]
+	strokeFrame Frame // Canvas as of the last recorded stroke
+	replay      *replayRun
+
+	// Sequence numbers devices reported, and recent broadcasts (see resync.go)
+	deviceSeqs map[string]*DeviceSeq
+	broadcasts []broadcast
+
+	// Guest frames held for moderation
+	submissions    map[string]*Submission
+	nextSubmission uint64
+
+	// Held through read-modify-write edits (EditFrame, EditPalette) so concurrent pixel edits
+	// each build on the other's result instead of one silently dropping the other
+	editMu sync.Mutex
+
+	// Held while a change is applied to the canvas, so a server-originated change takes
+	// the next sequence number without another change slipping in (see applyNext)
+	seqMu sync.Mutex
 }
 
+// PublishFunc sends a message on a topic and reports whether the broker accepted it
+// (QoS and retain are up to the publisher, e.g. messaging.PublishWithPolicy)
+type PublishFunc func(topic string, data []byte) bool
+
 // NewManager creates a new etchsketch manager
-func NewManager(client MQTT.Client, topic string) *Manager {
+func NewManager(publish PublishFunc, topic string) *Manager {
 	return &Manager{
 		canvas:      NewCanvas(),
-		client:      client,
+		publish:     publish,
 		topic:       topic,
 		lastSeenSeq: 0,
 		deviceIDs:   make(map[string]bool),
+		submissions: make(map[string]*Submission),
+		deviceSeqs:  make(map[string]*DeviceSeq),
 	}
 }
 
 // HandleSyncRequest handles a device requesting the full canvas state
-// Publishes the current retained frame with QoS 0 per protocol specification
+// Publishes the current frame on the shared topic (QoS 0, retained per protocol specification),
+// followed by the whole frame in chunks when the canvas is larger than 16x16
 func (m *Manager) HandleSyncRequest(deviceID string) error {
 	frame := m.canvas.EncodeFullFrame()
-
-	// Shared view frames use QoS 0 per protocol specification, but should be retained
-	token := m.client.Publish(m.topic, 0, true, frame)
-	if !token.WaitTimeout(5000) {
-		return fmt.Errorf("publish timeout for sync request from device %s", deviceID)
-	}
-	if token.Error() != nil {
-		return fmt.Errorf("failed to publish sync frame to device %s: %w", deviceID, token.Error())
+	whole, seq := m.canvas.GetFrame()
+	m.noteBroadcast(seq, whole)
+	if err := m.sendFrame(m.topic, frame, whole, seq); err != nil {
+		return fmt.Errorf("failed to publish sync frame to device %s: %v", deviceID, err)
 	}
 
 	fmt.Printf("Published full frame to %s (seq=%d)\n", deviceID, m.canvas.GetSequence())
 	return nil
 }
 
-// Removed legacy incremental update handler (pixel-level updates) —
-// protocol now uses full-frame publish by devices.
+// publisherFor returns how frames of f's canvas are sent: canvases larger than 16x16 send
+// the 0x21 frame on the unbatched chunk path, so it can't arrive after the chunks that
+// follow it or after a later frame's chunks
+func (m *Manager) publisherFor(f Frame) PublishFunc {
+	if m.publishChunks != nil && (f.Width > 16 || f.Height > 16) {
+		return m.publishChunks
+	}
+	return m.publish
+}
+
+// sendFrame publishes the encoded 0x21 frame on topic, followed by the chunks of the whole
+// frame for canvases larger than 16x16
+func (m *Manager) sendFrame(topic string, frame []byte, whole Frame, seq uint16) error {
+	publish := m.publisherFor(whole)
+	if !publish(topic, frame) {
+		return fmt.Errorf("frame not accepted")
+	}
+	if m.publishChunks == nil || (whole.Width <= 16 && whole.Height <= 16) {
+		return nil
+	}
+	if m.chunksNeeded != nil && !m.chunksNeeded(topic, whole, seq) {
+		return nil
+	}
+	for _, chunk := range EncodeFrameChunks(seq, whole) {
+		if !publish(topic, chunk) {
+			return fmt.Errorf("frame chunks not accepted")
+		}
+	}
+	return nil
+}
 
 // HandleFullFrameUpdate ingests a full-frame update published by a device
 // The server does not republish this frame; it only updates its local state
 func (m *Manager) HandleFullFrameUpdate(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
 	m.canvas.SetState(seq, red, green, blue)
+	m.frameApplied(seq, red, green, blue)
+}
+
+// frameApplied records a frame just applied to the canvas and runs the callback
+func (m *Manager) frameApplied(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
 	m.lastSeenSeq = seq
 	fmt.Printf("EtchSketch: applied full frame (seq=%d)\n", seq)
+
+	if m.recorder != nil {
+		rec := FrameRecord{Time: time.Now(), Seq: seq, Red: red, Green: green, Blue: blue}
+		if err := m.recorder.record(rec); err != nil {
+			fmt.Printf("EtchSketch: failed to record frame: %v\n", err)
+		}
+	}
+	m.recordChange()
+	if m.onFrame != nil {
+		m.onFrame(seq, red, green, blue)
+	}
+}
+
+// OnFrameApplied registers a callback run after every frame is applied to the canvas
+func (m *Manager) OnFrameApplied(fn func(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16)) {
+	m.onFrame = fn
+}
+
+// PublishFrame applies a server-originated frame (e.g. an approved guest drawing)
+// with the next sequence number and broadcasts it retained to all devices
+func (m *Manager) PublishFrame(red [16]uint16, green [16]uint16, blue [16]uint16) error {
+	m.applyNext(func(seq uint16) error {
+		m.canvas.SetState(seq, red, green, blue)
+		return nil
+	})
+	return m.HandleSyncRequest("all devices")
+}
+
+// applyNext runs apply with the sequence number after the canvas's, then reports the
+// applied canvas. Concurrent server changes each get their own number, in order.
+func (m *Manager) applyNext(apply func(seq uint16) error) error {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+	seq := m.canvas.GetSequence() + 1
+	if err := apply(seq); err != nil {
+		return err
+	}
+	red, green, blue, _ := m.canvas.GetState()
+	m.frameApplied(seq, red, green, blue)
+	return nil
+}
+
+// SetSize replaces the canvas with an empty one of the given size (call before use).
+// Whole frames of canvases larger than 16x16 are published in chunks with publishChunks.
+func (m *Manager) SetSize(width int, height int, publishChunks PublishFunc) error {
+	if err := CheckCanvasSize(width, height); err != nil {
+		return err
+	}
+	m.canvas = NewSizedCanvas(width, height)
+	m.publishChunks = publishChunks
+	fmt.Printf("EtchSketch: canvas is %dx%d\n", width, height)
+	return nil
+}
+
+// SetChunksNeeded registers a check run before a whole frame's chunks are published on a
+// topic, so they can be left out when every device there gets the frame another way (RLE)
+func (m *Manager) SetChunksNeeded(fn func(topic string, f Frame, seq uint16) bool) {
+	m.chunksNeeded = fn
+}
+
+// GetFrame returns a copy of the whole canvas and its sequence number
+func (m *Manager) GetFrame() (Frame, uint16) {
+	return m.canvas.GetFrame()
+}
+
+// EditFrame runs fn with the current whole canvas while holding the edit lock; fn applies
+// its change (e.g. through PublishCanvasFrame) before the next edit reads the canvas
+func (m *Manager) EditFrame(fn func(current Frame) (bool, error)) (bool, error) {
+	m.editMu.Lock()
+	defer m.editMu.Unlock()
+	current, _ := m.canvas.GetFrame()
+	return fn(current)
+}
+
+// PublishCanvasFrame applies a whole server-originated frame (the canvas's size) with the
+// next sequence number and broadcasts it to all devices
+func (m *Manager) PublishCanvasFrame(f Frame) error {
+	if width, height := m.canvas.Size(); f.Width != width || f.Height != height {
+		return fmt.Errorf("frame is %dx%d, canvas is %dx%d", f.Width, f.Height, width, height)
+	}
+	m.applyNext(func(seq uint16) error {
+		m.canvas.SetFrame(seq, f)
+		return nil
+	})
+	return m.HandleSyncRequest("all devices")
+}
+
+// HandleFrameChunk collects a chunk of a whole frame sent by a device and returns the frame
+// once all its chunks arrived. Frames of another size than the canvas are dropped, and so
+// are the server's own broadcasts coming back.
+func (m *Manager) HandleFrameChunk(c FrameChunk) (Frame, bool) {
+	f, complete := m.chunks.add(c)
+	if !complete {
+		return Frame{}, false
+	}
+	if !m.acceptDeviceFrame(c.Seq, f) {
+		return Frame{}, false
+	}
+	return f, true
+}
+
+// acceptDeviceFrame reports whether a whole frame from a device matches the canvas size
+// and is not one of the server's own broadcasts
+func (m *Manager) acceptDeviceFrame(seq uint16, f Frame) bool {
+	if width, height := m.canvas.Size(); f.Width != width || f.Height != height {
+		fmt.Printf("EtchSketch: dropping %dx%d frame (seq=%d), canvas is %dx%d\n", f.Width, f.Height, seq, width, height)
+		return false
+	}
+	return !m.isFrameEcho(seq, f)
+}
+
+// HandleCanvasFrameUpdate ingests a whole frame published by a device in chunks or RLE. Devices
+// with the large canvas already have it, so only the 16x16 window is published, for the rest.
+func (m *Manager) HandleCanvasFrameUpdate(seq uint16, f Frame) error {
+	m.seqMu.Lock()
+	m.canvas.SetFrame(seq, f)
+	red, green, blue := f.Window()
+	m.frameApplied(seq, red, green, blue)
+	m.seqMu.Unlock()
+	m.noteBroadcast(seq, f)
+	if !m.publisherFor(f)(m.topic, m.canvas.EncodeFullFrame()) {
+		return fmt.Errorf("failed to publish frame window (seq=%d)", seq)
+	}
+	return nil
+}
+
+// EnableRecording appends every applied frame to path for later time-lapse export
+func (m *Manager) EnableRecording(path string) error {
+	recorder, err := openRecorder[FrameRecord](path)
+	if err != nil {
+		return err
+	}
+	m.recorder = recorder
+	fmt.Printf("EtchSketch: recording frames to %s\n", path)
+	return nil
+}
+
+// RecordedFrames returns frames recorded between from and to (zero bounds are open)
+func (m *Manager) RecordedFrames(from time.Time, to time.Time) ([]FrameRecord, error) {
+	if m.recorder == nil {
+		return nil, fmt.Errorf("frame recording is not enabled")
+	}
+	return m.recorder.read(from, to)
 }
 
 // RegisterDevice tracks a device as connected to the etchsketch view
 func (m *Manager) RegisterDevice(deviceID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.deviceIDs[deviceID] {
+		return
+	}
 	m.deviceIDs[deviceID] = true
 	fmt.Printf("Registered device %s for etchsketch\n", deviceID)
 }
@@ -69,6 +285,9 @@ func (m *Manager) RegisterDevice(deviceID string) {
 func (m *Manager) UnregisterDevice(deviceID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if !m.deviceIDs[deviceID] {
+		return
+	}
 	delete(m.deviceIDs, deviceID)
 	fmt.Printf("Unregistered device %s from etchsketch\n", deviceID)
 }
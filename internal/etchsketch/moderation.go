@@ -0,0 +1,99 @@
+package etchsketch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Submission is a guest frame waiting for moderator approval
+type Submission struct {
+	ID        string     `json:"id"`
+	Source    string     `json:"source"`
+	Submitted time.Time  `json:"submitted"`
+	Expires   time.Time  `json:"expires"`
+	Red       [16]uint16 `json:"red"`
+	Green     [16]uint16 `json:"green"`
+	Blue      [16]uint16 `json:"blue"`
+}
+
+// QueueSubmission holds a guest frame until it is approved, rejected or expires after ttl
+func (m *Manager) QueueSubmission(source string, red [16]uint16, green [16]uint16, blue [16]uint16, ttl time.Duration) Submission {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expireSubmissionsLocked()
+	m.nextSubmission++
+	now := time.Now()
+	sub := Submission{
+		ID:        strconv.FormatUint(m.nextSubmission, 10),
+		Source:    source,
+		Submitted: now,
+		Expires:   now.Add(ttl),
+		Red:       red,
+		Green:     green,
+		Blue:      blue,
+	}
+	m.submissions[sub.ID] = &sub
+	fmt.Printf("EtchSketch: queued guest submission %s from %s for moderation\n", sub.ID, source)
+	return sub
+}
+
+// PendingSubmissions returns unexpired guest submissions, oldest first
+func (m *Manager) PendingSubmissions() []Submission {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expireSubmissionsLocked()
+	result := make([]Submission, 0, len(m.submissions))
+	for _, sub := range m.submissions {
+		result = append(result, *sub)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Submitted.Before(result[j].Submitted) })
+	return result
+}
+
+// ApproveSubmission applies a queued guest frame to the shared canvas and broadcasts it
+func (m *Manager) ApproveSubmission(id string) error {
+	sub, err := m.takeSubmission(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("EtchSketch: approved guest submission %s from %s\n", sub.ID, sub.Source)
+	return m.PublishFrame(sub.Red, sub.Green, sub.Blue)
+}
+
+// RejectSubmission discards a queued guest frame
+func (m *Manager) RejectSubmission(id string) error {
+	sub, err := m.takeSubmission(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("EtchSketch: rejected guest submission %s from %s\n", sub.ID, sub.Source)
+	return nil
+}
+
+func (m *Manager) takeSubmission(id string) (*Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expireSubmissionsLocked()
+	sub, exists := m.submissions[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSubmission, id)
+	}
+	delete(m.submissions, id)
+	return sub, nil
+}
+
+// Unreviewed submissions are dropped once their expiry passes (caller holds m.mu)
+func (m *Manager) expireSubmissionsLocked() {
+	now := time.Now()
+	for id, sub := range m.submissions {
+		if now.After(sub.Expires) {
+			delete(m.submissions, id)
+			fmt.Printf("EtchSketch: guest submission %s from %s expired unreviewed\n", id, sub.Source)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package etchsketch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/color"
+)
+
+// Palette mode: alongside the three 1-bit channels the canvas keeps a 4-bit palette index
+// per pixel, so RGB LED matrices can draw with 16 colors. Devices advertising the palette
+// capability get palette frames on their own topic; everyone else keeps getting 1-bit
+// frames, with each palette color reduced to the channels it is closest to.
+
+// Colors in a palette
+const PaletteSize = 16
+
+// Palette holds the colors of the palette indexes. Indexes 0-7 are the 1-bit channel
+// combinations (index = channel bits, see ColorRed), so 1-bit frames map onto it unchanged.
+var Palette = [PaletteSize]color.RGBA{
+	{0, 0, 0, 255},       // 0 off
+	{255, 0, 0, 255},     // 1 red
+	{0, 255, 0, 255},     // 2 green
+	{255, 255, 0, 255},   // 3 yellow (red+green)
+	{0, 0, 255, 255},     // 4 blue
+	{255, 0, 255, 255},   // 5 magenta (red+blue)
+	{0, 255, 255, 255},   // 6 cyan (green+blue)
+	{255, 255, 255, 255}, // 7 white (all channels)
+	{255, 136, 0, 255},   // 8 orange
+	{255, 128, 192, 255}, // 9 pink
+	{128, 0, 255, 255},   // 10 purple
+	{136, 68, 0, 255},    // 11 brown
+	{128, 128, 128, 255}, // 12 gray
+	{0, 128, 0, 255},     // 13 dark green
+	{96, 160, 255, 255},  // 14 sky blue
+	{0, 0, 128, 255},     // 15 navy
+}
+
+// PaletteFrame is a palette index per pixel, [row][column]
+type PaletteFrame [16][16]uint8
+
+// ChannelBits returns the 1-bit channels closest to a palette color: a channel is lit
+// when its component is at least half brightness
+func ChannelBits(index uint8) uint8 {
+	c := Palette[index%PaletteSize]
+	var bits uint8
+	if c.R >= 128 {
+		bits |= ColorRed
+	}
+	if c.G >= 128 {
+		bits |= ColorGreen
+	}
+	if c.B >= 128 {
+		bits |= ColorBlue
+	}
+	return bits
+}
+
+// Channels reduces the frame to 1-bit channels
+func (f PaletteFrame) Channels() (red [16]uint16, green [16]uint16, blue [16]uint16) {
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			bits := ChannelBits(f[y][x])
+			bit := uint16(1) << x
+			if bits&ColorRed != 0 {
+				red[y] |= bit
+			}
+			if bits&ColorGreen != 0 {
+				green[y] |= bit
+			}
+			if bits&ColorBlue != 0 {
+				blue[y] |= bit
+			}
+		}
+	}
+	return red, green, blue
+}
+
+// MergeChannels returns the palette frame for a new 1-bit frame: pixels whose channels did
+// not change keep their palette color, changed pixels take the matching index 0-7
+func (f PaletteFrame) MergeChannels(red [16]uint16, green [16]uint16, blue [16]uint16) PaletteFrame {
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			bit := uint16(1) << x
+			var bits uint8
+			if red[y]&bit != 0 {
+				bits |= ColorRed
+			}
+			if green[y]&bit != 0 {
+				bits |= ColorGreen
+			}
+			if blue[y]&bit != 0 {
+				bits |= ColorBlue
+			}
+			if ChannelBits(f[y][x]) != bits {
+				f[y][x] = bits
+			}
+		}
+	}
+	return f
+}
+
+// PaletteUpdate sets one pixel to a palette index
+type PaletteUpdate struct {
+	X     uint8 `json:"x"`
+	Y     uint8 `json:"y"`
+	Index uint8 `json:"index"`
+}
+
+// Validate checks the pixel is on the canvas and the index is in the palette
+func (u PaletteUpdate) Validate() error {
+	if u.X > 15 || u.Y > 15 {
+		return fmt.Errorf("pixel (%d,%d) is outside the 16x16 canvas", u.X, u.Y)
+	}
+	if u.Index >= PaletteSize {
+		return fmt.Errorf("palette index %d out of range (0-%d)", u.Index, PaletteSize-1)
+	}
+	return nil
+}
+
+// ApplyPaletteUpdates returns the frame with the updates applied in order
+func ApplyPaletteUpdates(f PaletteFrame, updates []PaletteUpdate) PaletteFrame {
+	for _, u := range updates {
+		if u.Validate() == nil {
+			f[u.Y][u.X] = u.Index
+		}
+	}
+	return f
+}
+
+// EncodePaletteFrame encodes a palette frame, two pixels per byte (high nibble = even column)
+// Returns byte array: [type(0x27)][length(130)][seq][indexes[128]]
+func EncodePaletteFrame(seq uint16, f PaletteFrame) []byte {
+	msg := make([]byte, 132) // 2-byte header + 130-byte payload
+	msg[0] = 0x27            // MSG_TYPE_ETCH_PALETTE_FRAME
+	msg[1] = 130             // Payload length
+
+	binary.BigEndian.PutUint16(msg[2:4], seq)
+	offset := 4
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x += 2 {
+			msg[offset] = f[y][x]<<4 | f[y][x+1]&0x0F
+			offset++
+		}
+	}
+	return msg
+}
+
+// DecodePaletteFrame parses a palette frame payload
+func DecodePaletteFrame(payload []byte) (uint16, PaletteFrame, error) {
+	var f PaletteFrame
+	if len(payload) != 130 {
+		return 0, f, ErrInvalidPayload
+	}
+	seq := binary.BigEndian.Uint16(payload[0:2])
+	offset := 2
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x += 2 {
+			f[y][x] = payload[offset] >> 4
+			f[y][x+1] = payload[offset] & 0x0F
+			offset++
+		}
+	}
+	return seq, f, nil
+}
+
+// EncodePaletteUpdates encodes palette pixel updates, split into messages as needed
+// Returns byte arrays: [type(0x28)][length][count][x][y][index]...
+func EncodePaletteUpdates(updates []PaletteUpdate) [][]byte {
+	var msgs [][]byte
+	for start := 0; start < len(updates); start += MaxPixelUpdates {
+		end := start + MaxPixelUpdates
+		if end > len(updates) {
+			end = len(updates)
+		}
+		batch := updates[start:end]
+		msg := make([]byte, 3, 3+3*len(batch))
+		msg[0] = 0x28 // MSG_TYPE_ETCH_PALETTE_PIXELS
+		msg[1] = byte(1 + 3*len(batch))
+		msg[2] = byte(len(batch))
+		for _, u := range batch {
+			msg = append(msg, u.X, u.Y, u.Index)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// DecodePaletteUpdates parses a palette pixel update message payload
+func DecodePaletteUpdates(payload []byte) ([]PaletteUpdate, error) {
+	if len(payload) < 1 || len(payload) != 1+3*int(payload[0]) {
+		return nil, ErrInvalidPayload
+	}
+	updates := make([]PaletteUpdate, payload[0])
+	for i := range updates {
+		b := payload[1+3*i:]
+		updates[i] = PaletteUpdate{X: b[0], Y: b[1], Index: b[2]}
+		if err := updates[i].Validate(); err != nil {
+			return nil, fmt.Errorf("%w: update %d: %v", ErrInvalidPayload, i, err)
+		}
+	}
+	return updates, nil
+}
+
+// GetPaletteState returns the canvas as palette indexes and its sequence number
+func (c *Canvas) GetPaletteState() (PaletteFrame, uint16) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.colors, c.sequence
+}
+
+// SetPaletteState replaces the canvas's 16x16 window with a palette frame; the 1-bit channels
+// follow from it
+func (c *Canvas) SetPaletteState(seq uint16, f PaletteFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commitLocked(seq, c.frame.WithWindow(f.Channels()), f)
+}
+
+// GetPaletteState returns the canvas as palette indexes and its sequence number
+func (m *Manager) GetPaletteState() (PaletteFrame, uint16) {
+	return m.canvas.GetPaletteState()
+}
+
+// EditPalette is EditFrame for palette edits: fn gets the current palette frame
+func (m *Manager) EditPalette(fn func(current PaletteFrame) (bool, error)) (bool, error) {
+	m.editMu.Lock()
+	defer m.editMu.Unlock()
+	current, _ := m.canvas.GetPaletteState()
+	return fn(current)
+}
+
+// PublishPaletteFrame applies a palette frame with the next sequence number and broadcasts
+// its 1-bit reduction to all devices (palette devices get the frame itself via OnFrameApplied)
+func (m *Manager) PublishPaletteFrame(f PaletteFrame) error {
+	m.applyNext(func(seq uint16) error {
+		m.canvas.SetPaletteState(seq, f)
+		return nil
+	})
+	return m.HandleSyncRequest("all devices")
+}
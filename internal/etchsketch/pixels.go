@@ -0,0 +1,133 @@
+package etchsketch
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Pixel-level edits: devices send a batch of pixel operations instead of a full frame,
+// e.g. to erase one pixel. The server applies them to the canvas and broadcasts the
+// resulting full frame, so devices that only understand full frames stay in sync.
+
+// Color channel bits of a PixelUpdate
+const (
+	ColorRed   uint8 = 0x01
+	ColorGreen uint8 = 0x02
+	ColorBlue  uint8 = 0x04
+	ColorAll         = ColorRed | ColorGreen | ColorBlue
+)
+
+// PixelOp is what a PixelUpdate does to the channels in its color
+type PixelOp uint8
+
+const (
+	PixelSet    PixelOp = 0 // Turn the channels on (others stay as they are)
+	PixelClear  PixelOp = 1 // Turn the channels off (color 0 = every channel)
+	PixelToggle PixelOp = 2 // Flip the channels
+)
+
+var pixelOpNames = map[PixelOp]string{PixelSet: "set", PixelClear: "clear", PixelToggle: "toggle"}
+
+func (op PixelOp) String() string {
+	if name, known := pixelOpNames[op]; known {
+		return name
+	}
+	return fmt.Sprintf("op(%d)", uint8(op))
+}
+
+func (op PixelOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(op.String())
+}
+
+func (op *PixelOp) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for known, n := range pixelOpNames {
+		if n == name {
+			*op = known
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pixel operation %q (set, clear, toggle)", name)
+}
+
+// PixelUpdate is one pixel operation
+type PixelUpdate struct {
+	X     uint8   `json:"x"`
+	Y     uint8   `json:"y"`
+	Color uint8   `json:"color"` // Channel bits (ColorRed, ...)
+	Op    PixelOp `json:"op"`
+}
+
+// Validate checks the pixel can be on a canvas and the operation is known
+func (u PixelUpdate) Validate() error {
+	if u.X >= MaxCanvasSize || u.Y >= MaxCanvasSize {
+		return fmt.Errorf("pixel (%d,%d) is outside the largest canvas (%dx%d)", u.X, u.Y, MaxCanvasSize, MaxCanvasSize)
+	}
+	if u.Color&^ColorAll != 0 {
+		return fmt.Errorf("invalid color bits 0x%02X", u.Color)
+	}
+	if _, known := pixelOpNames[u.Op]; !known {
+		return fmt.Errorf("unknown pixel operation %d", uint8(u.Op))
+	}
+	return nil
+}
+
+// ApplyUpdates returns the 16x16 frame with the updates applied in order (see Frame.Apply)
+func ApplyUpdates(red [16]uint16, green [16]uint16, blue [16]uint16, updates []PixelUpdate) ([16]uint16, [16]uint16, [16]uint16) {
+	return NewFrame(16, 16).WithWindow(red, green, blue).Apply(updates).Window()
+}
+
+// Most pixel updates in one message (3 bytes each after the count byte)
+const MaxPixelUpdates = 84
+
+// EncodePixelUpdates encodes updates as pixel update messages, split as needed
+// Returns byte arrays: [type(0x25)][length][count][x][y][op<<4 | color]...
+func EncodePixelUpdates(updates []PixelUpdate) [][]byte {
+	var msgs [][]byte
+	for start := 0; start < len(updates); start += MaxPixelUpdates {
+		end := start + MaxPixelUpdates
+		if end > len(updates) {
+			end = len(updates)
+		}
+		batch := updates[start:end]
+		msg := make([]byte, 3, 3+3*len(batch))
+		msg[0] = 0x25 // MSG_TYPE_ETCH_PIXELS
+		msg[1] = byte(1 + 3*len(batch))
+		msg[2] = byte(len(batch))
+		for _, u := range batch {
+			msg = append(msg, u.X, u.Y, byte(u.Op)<<4|u.Color&0x0F)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// DecodePixelUpdates parses a pixel update message payload
+func DecodePixelUpdates(payload []byte) ([]PixelUpdate, error) {
+	if len(payload) < 1 || len(payload) != 1+3*int(payload[0]) {
+		return nil, ErrInvalidPayload
+	}
+	updates := make([]PixelUpdate, payload[0])
+	for i := range updates {
+		b := payload[1+3*i:]
+		updates[i] = PixelUpdate{X: b[0], Y: b[1], Color: b[2] & 0x0F, Op: PixelOp(b[2] >> 4)}
+		if err := updates[i].Validate(); err != nil {
+			return nil, fmt.Errorf("%w: update %d: %v", ErrInvalidPayload, i, err)
+		}
+	}
+	return updates, nil
+}
+
+// EncodeCanvasClear encodes the clear control message
+// Returns byte array: [type(0x26)][length(0)]
+func EncodeCanvasClear() []byte {
+	return []byte{0x26, 0} // MSG_TYPE_ETCH_CLEAR
+}
+
+// Clear blanks the canvas and broadcasts the empty frame with the next sequence number
+func (m *Manager) Clear() error {
+	return m.PublishCanvasFrame(NewFrame(m.canvas.Size()))
+}
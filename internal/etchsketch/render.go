@@ -0,0 +1,121 @@
+package etchsketch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"time"
+)
+
+// Palette index is the channel bitmask: bit0 = red, bit1 = green, bit2 = blue
+var framePalette = color.Palette{
+	color.RGBA{0, 0, 0, 255},       // off
+	color.RGBA{255, 0, 0, 255},     // red
+	color.RGBA{0, 255, 0, 255},     // green
+	color.RGBA{255, 255, 0, 255},   // red+green
+	color.RGBA{0, 0, 255, 255},     // blue
+	color.RGBA{255, 0, 255, 255},   // red+blue
+	color.RGBA{0, 255, 255, 255},   // green+blue
+	color.RGBA{255, 255, 255, 255}, // all channels
+}
+
+// frameImage rasterizes a canvas state, scaling each pixel to a scale x scale block
+// Row bitmask bit N is column N.
+func frameImage(red [16]uint16, green [16]uint16, blue [16]uint16, scale int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, 16*scale, 16*scale), framePalette)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			bit := uint16(1) << x
+			var idx uint8
+			if red[y]&bit != 0 {
+				idx |= 1
+			}
+			if green[y]&bit != 0 {
+				idx |= 2
+			}
+			if blue[y]&bit != 0 {
+				idx |= 4
+			}
+			if idx == 0 {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[(y*scale+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[x*scale+dx] = idx
+				}
+			}
+		}
+	}
+	return img
+}
+
+// RenderTimelapseGIF writes recorded frames as an animated GIF, one frame per record
+func RenderTimelapseGIF(w io.Writer, frames []FrameRecord, scale int, frameDelay time.Duration) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames to render")
+	}
+	if scale < 1 || scale > 64 {
+		return fmt.Errorf("scale must be 1-64, got %d", scale)
+	}
+
+	delay := int(frameDelay / (10 * time.Millisecond)) // GIF delay unit is 1/100s
+	if delay < 1 {
+		delay = 1
+	}
+
+	anim := &gif.GIF{}
+	for _, f := range frames {
+		anim.Image = append(anim.Image, frameImage(f.Red, f.Green, f.Blue, scale))
+		anim.Delay = append(anim.Delay, delay)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// Largest snapshot scale: the snapshot is public, so a request must not cost more than a
+// 1024x1024 image even on a 64x64 canvas
+const MaxSnapshotScale = 16
+
+// RenderPNG writes the canvas as a PNG, each pixel a scale x scale block. Pixels of the
+// 16x16 window show their palette colors; the rest of a larger canvas its channel colors
+// (palette indexes 0-7).
+func (c *Canvas) RenderPNG(w io.Writer, scale int) error {
+	if scale < 1 || scale > MaxSnapshotScale {
+		return fmt.Errorf("scale must be 1-%d, got %d", MaxSnapshotScale, scale)
+	}
+	c.mu.RLock()
+	frame, colors := c.frame.Clone(), c.colors
+	c.mu.RUnlock()
+
+	palette := make(color.Palette, PaletteSize)
+	for i, rgba := range Palette {
+		palette[i] = rgba
+	}
+	img := image.NewPaletted(image.Rect(0, 0, frame.Width*scale, frame.Height*scale), palette)
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			idx := frame.Pixel(x, y)
+			if x < 16 && y < 16 {
+				idx = colors[y][x]
+			}
+			if idx == 0 {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[(y*scale+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[x*scale+dx] = idx
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// RenderPNG writes the current canvas as a PNG (see Canvas.RenderPNG)
+func (m *Manager) RenderPNG(w io.Writer, scale int) error {
+	return m.canvas.RenderPNG(w, scale)
+}
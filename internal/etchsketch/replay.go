@@ -0,0 +1,226 @@
+package etchsketch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Replay: every change applied to the canvas (pixel edits, device and palette frames, image
+// pushes, undo, clears) is recorded with its time as the pixel edits that turn the previous
+// canvas into the new one, and can be played back as pixel update messages on another topic
+// to show how a drawing was made.
+
+// StrokeRecord is one recorded change: a batch of pixel edits, or a clear
+type StrokeRecord struct {
+	Time    time.Time     `json:"time"`
+	Seq     uint16        `json:"seq"`              // Canvas sequence number after the change
+	Source  string        `json:"source,omitempty"` // Only in recordings from older versions
+	Updates []PixelUpdate `json:"updates,omitempty"`
+	Clear   bool          `json:"clear,omitempty"`
+}
+
+func (r StrokeRecord) recordedAt() time.Time { return r.Time }
+
+// ErrReplayRunning is returned when a replay is started while another one is playing
+var ErrReplayRunning = errors.New("a replay is already running")
+
+// EnableStrokeRecording appends every change to the canvas to path for later replay
+func (m *Manager) EnableStrokeRecording(path string) error {
+	strokes, err := openRecorder[StrokeRecord](path)
+	if err != nil {
+		return err
+	}
+	m.strokes = strokes
+	m.strokeFrame, _ = m.canvas.GetFrame()
+	fmt.Printf("EtchSketch: recording strokes to %s\n", path)
+	return nil
+}
+
+// recordChange records the difference between the canvas and the last recorded state: a
+// clear when the canvas went blank, otherwise the pixel edits that reproduce it exactly
+func (m *Manager) recordChange() {
+	if m.strokes == nil {
+		return
+	}
+	current, seq := m.canvas.GetFrame()
+	m.mu.Lock()
+	previous := m.strokeFrame
+	m.strokeFrame = current
+	m.mu.Unlock()
+	if previous.Equal(current) {
+		return // e.g. a device echoing the broadcast
+	}
+
+	rec := StrokeRecord{Time: time.Now(), Seq: seq}
+	if current.Equal(NewFrame(current.Width, current.Height)) {
+		rec.Clear = true
+	} else {
+		rec.Updates = frameDiff(previous, current)
+	}
+	if err := m.strokes.record(rec); err != nil {
+		fmt.Printf("EtchSketch: failed to record stroke: %v\n", err)
+	}
+}
+
+// frameDiff returns pixel edits turning from into to (a different size counts as blank)
+func frameDiff(from Frame, to Frame) []PixelUpdate {
+	if from.Width != to.Width || from.Height != to.Height {
+		from = NewFrame(to.Width, to.Height)
+	}
+	var updates []PixelUpdate
+	for y := 0; y < to.Height; y++ {
+		for x := 0; x < to.Width; x++ {
+			was, is := from.Pixel(x, y), to.Pixel(x, y)
+			if off := was &^ is; off != 0 {
+				updates = append(updates, PixelUpdate{X: uint8(x), Y: uint8(y), Op: PixelClear, Color: off})
+			}
+			if on := is &^ was; on != 0 {
+				updates = append(updates, PixelUpdate{X: uint8(x), Y: uint8(y), Op: PixelSet, Color: on})
+			}
+		}
+	}
+	return updates
+}
+
+// RecordedStrokes returns strokes recorded between from and to (zero bounds are open)
+func (m *Manager) RecordedStrokes(from time.Time, to time.Time) ([]StrokeRecord, error) {
+	if m.strokes == nil {
+		return nil, fmt.Errorf("stroke recording is not enabled")
+	}
+	return m.strokes.read(from, to)
+}
+
+// ReplayOptions selects what a replay plays and how fast
+type ReplayOptions struct {
+	Topic    string    // Where the messages go; never the shared canvas topic
+	From     time.Time // Zero bounds are open
+	To       time.Time
+	Speed    float64       // 2 = twice as fast as drawn (0 = 1)
+	MaxPause time.Duration // Longer gaps between strokes are shortened to this (0 = 2s)
+}
+
+// ReplayStatus describes the current or last replay
+type ReplayStatus struct {
+	Topic    string     `json:"topic"`
+	Started  time.Time  `json:"started"`
+	Strokes  int        `json:"strokes"`
+	Played   int        `json:"played"`
+	Running  bool       `json:"running"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+type replayRun struct {
+	status ReplayStatus
+	stop   chan struct{}
+}
+
+// StartReplay plays recorded strokes on opts.Topic in the background: a clear, then each
+// batch as pixel update messages, spaced as they were drawn. publish must not coalesce
+// messages (a batcher would drop all but the last stroke).
+func (m *Manager) StartReplay(opts ReplayOptions, publish PublishFunc) (ReplayStatus, error) {
+	if opts.Topic == "" || opts.Topic == m.topic {
+		return ReplayStatus{}, fmt.Errorf("replay needs a topic other than the shared canvas topic")
+	}
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.MaxPause <= 0 {
+		opts.MaxPause = 2 * time.Second
+	}
+	strokes, err := m.RecordedStrokes(opts.From, opts.To)
+	if err != nil {
+		return ReplayStatus{}, err
+	}
+	if len(strokes) == 0 {
+		return ReplayStatus{}, fmt.Errorf("no strokes recorded in that time range")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replay != nil && m.replay.status.Running {
+		return m.replay.status, ErrReplayRunning
+	}
+	run := &replayRun{
+		status: ReplayStatus{Topic: opts.Topic, Started: time.Now(), Strokes: len(strokes), Running: true},
+		stop:   make(chan struct{}),
+	}
+	m.replay = run
+	go m.playStrokes(run, strokes, opts, publish)
+	fmt.Printf("EtchSketch: replaying %d stroke(s) on %s at %gx\n", len(strokes), opts.Topic, opts.Speed)
+	return run.status, nil
+}
+
+func (m *Manager) playStrokes(run *replayRun, strokes []StrokeRecord, opts ReplayOptions, publish PublishFunc) {
+	finish := func(err error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		run.status.Running = false
+		now := time.Now()
+		run.status.Finished = &now
+		if err != nil {
+			run.status.Error = err.Error()
+		}
+	}
+
+	if !publish(opts.Topic, EncodeCanvasClear()) {
+		finish(fmt.Errorf("failed to publish to %s", opts.Topic))
+		return
+	}
+	for i, rec := range strokes {
+		if i > 0 {
+			pause := time.Duration(float64(rec.Time.Sub(strokes[i-1].Time)) / opts.Speed)
+			if pause > opts.MaxPause {
+				pause = opts.MaxPause
+			}
+			select {
+			case <-run.stop:
+				finish(fmt.Errorf("stopped"))
+				return
+			case <-time.After(pause):
+			}
+		}
+		msgs := [][]byte{EncodeCanvasClear()}
+		if !rec.Clear {
+			msgs = EncodePixelUpdates(rec.Updates)
+		}
+		for _, msg := range msgs {
+			if !publish(opts.Topic, msg) {
+				finish(fmt.Errorf("failed to publish to %s", opts.Topic))
+				return
+			}
+		}
+		m.mu.Lock()
+		run.status.Played = i + 1
+		m.mu.Unlock()
+	}
+	finish(nil)
+	fmt.Printf("EtchSketch: replay on %s finished\n", opts.Topic)
+}
+
+// StopReplay stops the running replay; false if none is running
+func (m *Manager) StopReplay() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replay == nil || !m.replay.status.Running {
+		return false
+	}
+	select {
+	case <-m.replay.stop:
+	default:
+		close(m.replay.stop)
+	}
+	return true
+}
+
+// Replay returns the status of the current or last replay (nil = none yet)
+func (m *Manager) Replay() *ReplayStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.replay == nil {
+		return nil
+	}
+	status := m.replay.status
+	return &status
+}
@@ -0,0 +1,159 @@
+package etchsketch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sequence tracking: devices report the sequence number of the frame they show (after a
+// reconnect, or when the next frame they get skips numbers), and a device that is behind
+// gets the current frame on its own topic right away. Frames submitted on top of an older
+// canvas are rejected and the current canvas republished, so the sender ends up on the same
+// frame as everyone else without wiping strokes drawn since. The server's own broadcasts coming back on the shared topic are
+// recognized and ignored.
+
+// Broadcasts remembered for recognizing them when they come back
+const recentBroadcasts = 8
+
+// DeviceSeq is what the server knows about one device's copy of the canvas
+type DeviceSeq struct {
+	Device    string    `json:"device"`
+	Connected bool      `json:"connected"` // Registered with the canvas (booted and not offline)
+	Seq       uint16    `json:"seq"`       // Last sequence number the device reported or was sent
+	Behind    int       `json:"behind"`    // Frames it is behind the canvas
+	Reported  time.Time `json:"reported"`  // When it last reported
+	Resyncs   int       `json:"resyncs"`   // Frames sent to it because it was behind
+}
+
+type broadcast struct {
+	seq   uint16
+	frame Frame
+}
+
+// EncodeSeqReport encodes a device's sequence report (used by simulated devices)
+// Returns byte array: [type(0x2B)][length][name_len][name][seq uint16 BE]
+func EncodeSeqReport(deviceID string, seq uint16) []byte {
+	msg := []byte{0x2B, byte(3 + len(deviceID)), byte(len(deviceID))} // MSG_TYPE_ETCH_SEQ_REPORT
+	msg = append(msg, deviceID...)
+	return binary.BigEndian.AppendUint16(msg, seq)
+}
+
+// DecodeSeqReport parses a sequence report payload
+func DecodeSeqReport(payload []byte) (string, uint16, error) {
+	if len(payload) < 1 || len(payload) != 1+int(payload[0])+2 || payload[0] == 0 {
+		return "", 0, ErrInvalidPayload
+	}
+	name := string(payload[1 : 1+payload[0]])
+	return name, binary.BigEndian.Uint16(payload[1+payload[0]:]), nil
+}
+
+// behind returns how many frames seq is behind the canvas at current (0 = up to date)
+func behind(seq uint16, current uint16) int {
+	if d := int(int16(current - seq)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// NoteDeviceSeq records the sequence number a device reported and returns whether it is
+// behind the canvas
+func (m *Manager) NoteDeviceSeq(deviceID string, seq uint16) bool {
+	current := m.canvas.GetSequence()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.deviceSeqs[deviceID]
+	if d == nil {
+		d = &DeviceSeq{Device: deviceID}
+		m.deviceSeqs[deviceID] = d
+	}
+	d.Seq = seq
+	d.Reported = time.Now()
+	return behind(seq, current) > 0
+}
+
+// ResyncDevice sends the current frame to one device's topic, e.g. after it reported a gap
+func (m *Manager) ResyncDevice(deviceID string, topic string) error {
+	frame := m.canvas.EncodeFullFrame()
+	whole, seq := m.canvas.GetFrame()
+	if err := m.sendFrame(topic, frame, whole, seq); err != nil {
+		return fmt.Errorf("failed to publish frame to device %s: %v", deviceID, err)
+	}
+
+	m.mu.Lock()
+	if d := m.deviceSeqs[deviceID]; d != nil {
+		d.Seq = seq
+		d.Resyncs++
+	}
+	m.mu.Unlock()
+	fmt.Printf("EtchSketch: resynced %s to seq=%d\n", deviceID, seq)
+	return nil
+}
+
+// DeviceSequences returns what is known about each connected or reporting device's copy
+// of the canvas, by name
+func (m *Manager) DeviceSequences() []DeviceSeq {
+	current := m.canvas.GetSequence()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]DeviceSeq, 0, len(m.deviceSeqs))
+	for _, d := range m.deviceSeqs {
+		entry := *d
+		entry.Behind = behind(d.Seq, current)
+		entry.Connected = m.deviceIDs[d.Device]
+		result = append(result, entry)
+	}
+	for id := range m.deviceIDs {
+		if m.deviceSeqs[id] == nil {
+			result = append(result, DeviceSeq{Device: id, Connected: true})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// noteBroadcast remembers a frame published on the shared topic
+func (m *Manager) noteBroadcast(seq uint16, f Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.broadcasts = append(m.broadcasts, broadcast{seq: seq, frame: f})
+	if len(m.broadcasts) > recentBroadcasts {
+		m.broadcasts = m.broadcasts[len(m.broadcasts)-recentBroadcasts:]
+	}
+}
+
+// IsEcho reports whether a 16x16 frame received on the shared topic is one of the server's
+// own recent broadcasts coming back
+func (m *Manager) IsEcho(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, b := range m.broadcasts {
+		if b.seq != seq {
+			continue
+		}
+		r, g, bl := b.frame.Window()
+		if r == red && g == green && bl == blue {
+			return true
+		}
+	}
+	return false
+}
+
+// isFrameEcho is IsEcho for whole frames
+func (m *Manager) isFrameEcho(seq uint16, f Frame) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, b := range m.broadcasts {
+		if b.seq == seq && b.frame.Equal(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStale reports whether a frame a device submitted with seq was drawn on an older canvas
+// than the current one (a device draws frame N on top of N-1)
+func (m *Manager) IsStale(seq uint16) bool {
+	return int16(seq-m.canvas.GetSequence()) <= 0
+}
@@ -0,0 +1,89 @@
+package etchsketch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Run-length encoded frames: a whole canvas of any size in one message, as runs of pixels
+// with the same channel bits in row-major order. Drawings are mostly background, so a
+// 32x32 or 64x64 canvas usually fits in one 255-byte payload instead of 2-7 chunks.
+// Devices advertising the capability get them on their own topic; frames too busy to
+// fit are only sent raw.
+
+// Pixels per run (5 bits of the run byte)
+const maxRunLength = 32
+
+// RLE frame bytes available for runs: 255-byte payload minus the 4-byte header
+const maxRLERuns = 251
+
+// ErrFrameTooLarge is returned by EncodeRLEFrame when the runs don't fit in one message
+var ErrFrameTooLarge = errors.New("frame too large to run-length encode")
+
+// EncodeRLEFrame encodes a whole frame as pixel runs
+// Returns byte array: [type(0x2C)][length][seq][width][height][runs...]
+// Each run byte is (count-1)<<3 | channel bits, count 1-32
+func EncodeRLEFrame(seq uint16, f Frame) ([]byte, error) {
+	msg := make([]byte, 6, 6+maxRLERuns)
+	msg[0] = 0x2C // MSG_TYPE_ETCH_RLE_FRAME
+	binary.BigEndian.PutUint16(msg[2:4], seq)
+	msg[4] = byte(f.Width)
+	msg[5] = byte(f.Height)
+
+	run, bits := 0, uint8(0)
+	for i := 0; i < f.Width*f.Height; i++ {
+		pixel := f.Pixel(i%f.Width, i/f.Width)
+		if run > 0 && (pixel != bits || run == maxRunLength) {
+			msg = append(msg, byte(run-1)<<3|bits)
+			run = 0
+		}
+		bits = pixel
+		run++
+	}
+	msg = append(msg, byte(run-1)<<3|bits)
+
+	if len(msg)-6 > maxRLERuns {
+		return nil, fmt.Errorf("%w: %dx%d frame needs %d runs", ErrFrameTooLarge, f.Width, f.Height, len(msg)-6)
+	}
+	msg[1] = byte(len(msg) - 2)
+	return msg, nil
+}
+
+// DecodeRLEFrame parses a run-length encoded frame payload
+func DecodeRLEFrame(payload []byte) (uint16, Frame, error) {
+	if len(payload) < 5 {
+		return 0, Frame{}, ErrInvalidPayload
+	}
+	seq := binary.BigEndian.Uint16(payload[0:2])
+	width, height := int(payload[2]), int(payload[3])
+	if err := CheckCanvasSize(width, height); err != nil {
+		return seq, Frame{}, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	f := NewFrame(width, height)
+	i := 0
+	for _, b := range payload[4:] {
+		count := int(b>>3) + 1
+		if i+count > width*height {
+			return seq, Frame{}, fmt.Errorf("%w: runs cover more than %dx%d pixels", ErrInvalidPayload, width, height)
+		}
+		if bits := b & ColorAll; bits != 0 {
+			for end := i + count; i < end; i++ {
+				f.SetPixel(i%width, i/width, bits)
+			}
+		} else {
+			i += count
+		}
+	}
+	if i != width*height {
+		return seq, Frame{}, fmt.Errorf("%w: runs cover %d of %dx%d pixels", ErrInvalidPayload, i, width, height)
+	}
+	return seq, f, nil
+}
+
+// HandleRLEFrame checks a run-length encoded frame published by a device: it must match the
+// canvas size and not be one of the server's own frames coming back
+func (m *Manager) HandleRLEFrame(seq uint16, f Frame) bool {
+	return m.acceptDeviceFrame(seq, f)
+}
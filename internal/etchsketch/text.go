@@ -0,0 +1,171 @@
+package etchsketch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Text rendering: short strings drawn with a 3x5 pixel font as pixel updates, so server
+// messages ("HAPPY BDAY") reach devices like any other edit. Glyphs are 4 pixels apart
+// and lines 6 apart, so a 16-wide canvas fits 4 characters per line and 2-3 lines.
+
+// Glyph cell size including the blank column/row after each glyph
+const (
+	GlyphWidth  = 4
+	GlyphHeight = 6
+)
+
+// font holds the 3x5 glyphs, one string per row, '#' lit. Lowercase letters are drawn
+// as uppercase.
+var font = map[rune][5]string{
+	'A':  {"###", "#.#", "###", "#.#", "#.#"},
+	'B':  {"##.", "#.#", "##.", "#.#", "##."},
+	'C':  {"###", "#..", "#..", "#..", "###"},
+	'D':  {"##.", "#.#", "#.#", "#.#", "##."},
+	'E':  {"###", "#..", "##.", "#..", "###"},
+	'F':  {"###", "#..", "##.", "#..", "#.."},
+	'G':  {"###", "#..", "#.#", "#.#", "###"},
+	'H':  {"#.#", "#.#", "###", "#.#", "#.#"},
+	'I':  {"###", ".#.", ".#.", ".#.", "###"},
+	'J':  {"..#", "..#", "..#", "#.#", "###"},
+	'K':  {"#.#", "#.#", "##.", "#.#", "#.#"},
+	'L':  {"#..", "#..", "#..", "#..", "###"},
+	'M':  {"#.#", "###", "###", "#.#", "#.#"},
+	'N':  {"##.", "#.#", "#.#", "#.#", "#.#"},
+	'O':  {"###", "#.#", "#.#", "#.#", "###"},
+	'P':  {"###", "#.#", "###", "#..", "#.."},
+	'Q':  {"###", "#.#", "#.#", "###", "..#"},
+	'R':  {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S':  {"###", "#..", "###", "..#", "###"},
+	'T':  {"###", ".#.", ".#.", ".#.", ".#."},
+	'U':  {"#.#", "#.#", "#.#", "#.#", "###"},
+	'V':  {"#.#", "#.#", "#.#", "#.#", ".#."},
+	'W':  {"#.#", "#.#", "###", "###", "#.#"},
+	'X':  {"#.#", "#.#", ".#.", "#.#", "#.#"},
+	'Y':  {"#.#", "#.#", ".#.", ".#.", ".#."},
+	'Z':  {"###", "..#", ".#.", "#..", "###"},
+	'0':  {"###", "#.#", "#.#", "#.#", "###"},
+	'1':  {".#.", "##.", ".#.", ".#.", "###"},
+	'2':  {"###", "..#", "###", "#..", "###"},
+	'3':  {"###", "..#", ".##", "..#", "###"},
+	'4':  {"#.#", "#.#", "###", "..#", "..#"},
+	'5':  {"###", "#..", "###", "..#", "###"},
+	'6':  {"###", "#..", "###", "#.#", "###"},
+	'7':  {"###", "..#", "..#", ".#.", ".#."},
+	'8':  {"###", "#.#", "###", "#.#", "###"},
+	'9':  {"###", "#.#", "###", "..#", "###"},
+	' ':  {"...", "...", "...", "...", "..."},
+	'!':  {".#.", ".#.", ".#.", "...", ".#."},
+	'?':  {"###", "..#", ".##", "...", ".#."},
+	'.':  {"...", "...", "...", "...", ".#."},
+	',':  {"...", "...", "...", ".#.", "#.."},
+	':':  {"...", ".#.", "...", ".#.", "..."},
+	'\'': {".#.", ".#.", "...", "...", "..."},
+	'-':  {"...", "...", "###", "...", "..."},
+	'+':  {"...", ".#.", "###", ".#.", "..."},
+	'=':  {"...", "###", "...", "###", "..."},
+	'/':  {"..#", "..#", ".#.", "#..", "#.."},
+	'#':  {"#.#", "###", "#.#", "###", "#.#"},
+	'<':  {"..#", ".#.", "#..", ".#.", "..#"},
+	'>':  {"#..", ".#.", "..#", ".#.", "#.."},
+	'*':  {"...", "#.#", ".#.", "#.#", "..."},
+	'(':  {".#.", "#..", "#..", "#..", ".#."},
+	')':  {".#.", "..#", "..#", "..#", ".#."},
+	'%':  {"#.#", "..#", ".#.", "#..", "#.#"},
+	'&':  {".#.", "#.#", ".#.", "#.#", ".##"},
+	'@':  {"###", "#.#", "#.#", "#..", "###"},
+	'$':  {".##", "##.", ".#.", ".##", "##."},
+	'_':  {"...", "...", "...", "...", "###"},
+	'"':  {"#.#", "#.#", "...", "...", "..."},
+	'^':  {".#.", "#.#", "...", "...", "..."},
+	'~':  {"...", "..#", "###", "#..", "..."},
+}
+
+// Text describes a string to draw on the canvas
+type Text struct {
+	Text       string `json:"text"`       // Lines separated by "\n"
+	X          int    `json:"x"`          // Left edge of the first glyph
+	Y          int    `json:"y"`          // Top edge of the first line
+	Color      uint8  `json:"color"`      // Channel bits (ColorRed, ...); 0 = white
+	Center     bool   `json:"center"`     // Center the lines on the canvas instead of using X/Y
+	Background bool   `json:"background"` // Clear the unlit pixels of each glyph cell
+}
+
+// TextSize returns the pixels a string needs (the blank column/row after the last glyph
+// and line excluded)
+func TextSize(text string) (width int, height int) {
+	lines := strings.Split(text, "\n")
+	for _, line := range lines {
+		if w := len([]rune(line))*GlyphWidth - 1; w > width {
+			width = w
+		}
+	}
+	return width, len(lines)*GlyphHeight - 1
+}
+
+// Validate checks every character has a glyph and the color is valid
+func (t Text) Validate() error {
+	if strings.TrimSpace(t.Text) == "" {
+		return fmt.Errorf("text is empty")
+	}
+	for _, r := range strings.ToUpper(t.Text) {
+		if _, ok := font[r]; !ok && r != '\n' {
+			return fmt.Errorf("no glyph for %q", r)
+		}
+	}
+	if t.Color > ColorAll {
+		return fmt.Errorf("invalid color %d", t.Color)
+	}
+	return nil
+}
+
+// Updates returns the pixel updates drawing the text on a canvas of the given size, and
+// whether any of it falls off the canvas (those pixels are left out)
+func (t Text) Updates(width int, height int) ([]PixelUpdate, bool) {
+	color := t.Color
+	if color == 0 {
+		color = ColorAll
+	}
+	lines := strings.Split(strings.ToUpper(t.Text), "\n")
+	_, textHeight := TextSize(t.Text)
+	top := t.Y
+	if t.Center {
+		top = (height - textHeight) / 2
+	}
+
+	var updates []PixelUpdate
+	clipped := false
+	plot := func(x int, y int, op PixelOp, bits uint8) {
+		if x < 0 || y < 0 || x >= width || y >= height {
+			clipped = clipped || op == PixelSet
+			return
+		}
+		updates = append(updates, PixelUpdate{X: uint8(x), Y: uint8(y), Op: op, Color: bits})
+	}
+	for row, line := range lines {
+		glyphs := []rune(line)
+		left := t.X
+		if t.Center {
+			left = (width - (len(glyphs)*GlyphWidth - 1)) / 2
+		}
+		y := top + row*GlyphHeight
+		for i, r := range glyphs {
+			glyph := font[r]
+			x := left + i*GlyphWidth
+			for gy := 0; gy < GlyphHeight; gy++ {
+				for gx := 0; gx < GlyphWidth; gx++ {
+					if gy < 5 && gx < 3 && glyph[gy][gx] == '#' {
+						if color != ColorAll {
+							// Lit pixels take the text color rather than mixing with the drawing
+							plot(x+gx, y+gy, PixelClear, ColorAll&^color)
+						}
+						plot(x+gx, y+gy, PixelSet, color)
+					} else if t.Background {
+						plot(x+gx, y+gy, PixelClear, ColorAll)
+					}
+				}
+			}
+		}
+	}
+	return updates, clipped
+}
@@ -0,0 +1,72 @@
+package etchsketch
+
+import "errors"
+
+// Changes the canvas keeps for undo; older ones are forgotten
+const UndoDepth = 32
+
+// ErrNothingToUndo is returned by Undo when the canvas has no earlier state left
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// canvasState is the canvas as it was before one applied change
+type canvasState struct {
+	frame  Frame
+	colors PaletteFrame
+}
+
+// commitLocked makes frame and colors the canvas state with seq, keeping the previous state
+// for undo if anything changed (a frame coming back unchanged, e.g. a device echoing the
+// broadcast, is not a change). Caller holds mu.
+func (c *Canvas) commitLocked(seq uint16, frame Frame, colors PaletteFrame) {
+	if !frame.Equal(c.frame) || colors != c.colors {
+		c.history = append(c.history, canvasState{frame: c.frame, colors: c.colors})
+		if len(c.history) > UndoDepth {
+			c.history = append(c.history[:0:0], c.history[len(c.history)-UndoDepth:]...)
+		}
+	}
+	c.sequence = seq
+	c.frame = frame
+	c.colors = colors
+}
+
+// Undo restores the state before the last change with sequence number seq
+func (c *Canvas) Undo(seq uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.history) == 0 {
+		return ErrNothingToUndo
+	}
+	last := c.history[len(c.history)-1]
+	c.history = c.history[:len(c.history)-1]
+	c.sequence = seq
+	c.frame = last.frame
+	c.colors = last.colors
+	return nil
+}
+
+// UndoDepthAvailable returns how many changes can be undone
+func (c *Canvas) UndoDepthAvailable() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.history)
+}
+
+// Undo reverts the last change to the canvas and broadcasts the result with the next
+// sequence number. The undo itself cannot be undone.
+func (m *Manager) Undo() error {
+	if err := m.applyNext(m.canvas.Undo); err != nil {
+		return err
+	}
+	return m.HandleSyncRequest("all devices")
+}
+
+// UndoAvailable returns how many changes to the canvas can be undone
+func (m *Manager) UndoAvailable() int {
+	return m.canvas.UndoDepthAvailable()
+}
+
+// EncodeUndo encodes the undo control message
+// Returns byte array: [type(0x2A)][length(0)]
+func EncodeUndo() []byte {
+	return []byte{0x2A, 0} // MSG_TYPE_ETCH_UNDO
+}
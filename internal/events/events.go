@@ -0,0 +1,145 @@
+package events
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live server events for the dashboard and third-party tools, streamed as JSON text frames
+// over a WebSocket on the admin interface:
+//
+//	<- {"type":"device_online","time":"...","device":"kitchen"}
+//	<- {"type":"canvas_updated","time":"...","data":{"seq":42}}
+//
+// Clients only listen; ?types=device_online,device_offline limits the stream to those
+// types. Events are not stored: a client sees what happens while it is connected.
+
+// Event types
+const (
+	DeviceOnline     = "device_online"
+	DeviceOffline    = "device_offline"
+	WeatherFetched   = "weather_fetched"
+	MessagePublished = "message_published"
+	CanvasUpdated    = "canvas_updated"
+)
+
+// Event is one thing that happened on the server
+type Event struct {
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Device string      `json:"device,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Events buffered per subscriber before it is considered too slow and events are dropped
+const sendBuffer = 256
+
+type subscriber struct {
+	types map[string]bool // nil = all
+	send  chan Event
+}
+
+var (
+	mu          sync.Mutex
+	subscribers = make(map[*subscriber]bool)
+)
+
+// Publish hands an event to every subscriber that wants its type. It never blocks:
+// subscribers that fall behind miss events.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for s := range subscribers {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+		select {
+		case s.send <- e:
+		default:
+		}
+	}
+}
+
+// Subscribers returns how many clients are listening (publishers can skip building
+// costly events when nobody is)
+func Subscribers() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(subscribers)
+}
+
+// Subscribe returns a channel receiving events of the given types (none = all) and a
+// function that ends the subscription and closes the channel
+func Subscribe(types ...string) (<-chan Event, func()) {
+	s := &subscriber{send: make(chan Event, sendBuffer)}
+	if len(types) > 0 {
+		s.types = make(map[string]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	mu.Lock()
+	subscribers[s] = true
+	mu.Unlock()
+
+	var once sync.Once
+	return s.send, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subscribers, s)
+			close(s.send)
+			mu.Unlock()
+		})
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// Handler upgrades requests to the event stream
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var types []string
+	if q := r.URL.Query().Get("types"); q != "" {
+		types = strings.Split(q, ",")
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("Events: upgrade failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	stream, cancel := Subscribe(types...)
+	defer cancel()
+	fmt.Printf("Events: client connected from %s\n", r.RemoteAddr)
+
+	// The client sends nothing; reading notices when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case e := <-stream:
+			if err := conn.WriteJSON(e); err != nil {
+				fmt.Printf("Events: client %s disconnected\n", r.RemoteAddr)
+				return
+			}
+		case <-gone:
+			fmt.Printf("Events: client %s disconnected\n", r.RemoteAddr)
+			return
+		}
+	}
+}
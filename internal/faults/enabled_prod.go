@@ -0,0 +1,7 @@
+//go:build !debug
+// +build !debug
+
+package faults
+
+// Enabled reports whether fault injection is compiled in (debug builds only)
+const Enabled = false
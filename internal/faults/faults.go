@@ -0,0 +1,121 @@
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDisabled is returned when faults are configured in a build without fault injection
+var ErrDisabled = errors.New("fault injection is only available in debug builds")
+
+// Settings describes the faults currently being injected
+type Settings struct {
+	PublishDropPercent  int           `json:"publish_drop_pct"`    // Percent of publishes silently dropped
+	StorageWriteDelay   time.Duration `json:"storage_write_delay"` // Delay added before every storage write
+	WeatherErrorPercent int           `json:"weather_error_pct"`   // Percent of weather fetches failing with 500
+}
+
+var (
+	mu      sync.RWMutex
+	current Settings
+)
+
+// Set replaces the active fault settings
+func Set(s Settings) error {
+	if !Enabled {
+		return ErrDisabled
+	}
+	if s.PublishDropPercent < 0 || s.PublishDropPercent > 100 {
+		return fmt.Errorf("publish_drop must be 0-100, got %d", s.PublishDropPercent)
+	}
+	if s.WeatherErrorPercent < 0 || s.WeatherErrorPercent > 100 {
+		return fmt.Errorf("weather_500 must be 0-100, got %d", s.WeatherErrorPercent)
+	}
+	if s.StorageWriteDelay < 0 {
+		return fmt.Errorf("storage_delay must not be negative")
+	}
+
+	mu.Lock()
+	current = s
+	mu.Unlock()
+	fmt.Printf("Fault injection: publish_drop=%d%% storage_delay=%s weather_500=%d%%\n",
+		s.PublishDropPercent, s.StorageWriteDelay, s.WeatherErrorPercent)
+	return nil
+}
+
+// Get returns the active fault settings
+func Get() Settings {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Reset disables all injected faults
+func Reset() {
+	mu.Lock()
+	current = Settings{}
+	mu.Unlock()
+}
+
+// Parse applies "key=value" arguments on top of base
+// Keys: publish_drop=<pct>, storage_delay=<duration>, weather_500=<pct>
+func Parse(base Settings, args []string) (Settings, error) {
+	s := base
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return base, fmt.Errorf("expected key=value, got %q", arg)
+		}
+
+		var err error
+		switch key {
+		case "publish_drop":
+			s.PublishDropPercent, err = strconv.Atoi(value)
+		case "storage_delay":
+			s.StorageWriteDelay, err = time.ParseDuration(value)
+		case "weather_500":
+			s.WeatherErrorPercent, err = strconv.Atoi(value)
+		default:
+			return base, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return base, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	return s, nil
+}
+
+// DropPublish reports whether the current publish should be dropped
+func DropPublish() bool {
+	if !Enabled {
+		return false
+	}
+	return roll(Get().PublishDropPercent)
+}
+
+// DelayStorageWrite blocks for the configured storage write delay
+func DelayStorageWrite() {
+	if !Enabled {
+		return
+	}
+	if delay := Get().StorageWriteDelay; delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// FailWeatherFetch reports whether the current weather fetch should fail
+func FailWeatherFetch() bool {
+	if !Enabled {
+		return false
+	}
+	return roll(Get().WeatherErrorPercent)
+}
+
+func roll(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
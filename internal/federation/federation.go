@@ -0,0 +1,440 @@
+package federation
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Canvas federation: servers with their own brokers and fleets share one etchsketch
+// picture. Each server sends every frame drawn on its side to its peers over HTTPS, signed
+// with the secret configured for that link. Servers keep their own sequence numbers for
+// their devices; across servers frames are ordered by a hybrid clock (wall-clock
+// milliseconds, bumped past any clock seen), with the origin name breaking ties, and the
+// latest frame wins. A peer that receives a stale frame answers with its own, so both
+// sides converge on every exchange.
+
+// Endpoint on the federation listener
+const canvasPath = "/federation/canvas"
+
+// Link tuning
+const (
+	maxClockSkew   = 5 * time.Minute // Signed requests older or newer than this are refused
+	syncInterval   = 5 * time.Minute // Current frame re-sent to peers so a restarted peer catches up
+	retryMin       = 1 * time.Second // Backoff after a failed send, doubled up to retryMax
+	retryMax       = 1 * time.Minute
+	maxUpdateBody  = 16 * 1024 // Bytes accepted per request
+	requestTimeout = 10 * time.Second
+)
+
+// Request headers
+const (
+	headerPeer      = "X-Federation-Peer"
+	headerTime      = "X-Federation-Time"
+	headerSignature = "X-Federation-Signature"
+)
+
+// Peer is another server sharing the canvas room
+type Peer struct {
+	Name   string `json:"name"`   // The peer's federation name
+	URL    string `json:"url"`    // Base URL of its federation listener, e.g. https://friend.example:8443
+	Secret string `json:"secret"` // Shared secret configured on both sides of this link
+}
+
+// Config enables federation (read at startup only)
+type Config struct {
+	Name       string `json:"name"`       // This server's name as peers know it
+	Room       string `json:"room"`       // Canvas room shared with peers; both sides must agree
+	ListenAddr string `json:"listenAddr"` // Listener for peers, e.g. ":8443" ("" = send only)
+	TLSCert    string `json:"tlsCert"`    // Serve HTTPS with this certificate and key (recommended)
+	TLSKey     string `json:"tlsKey"`
+	Peers      []Peer `json:"peers"`
+}
+
+// Enabled reports whether federation is configured
+func (c Config) Enabled() bool {
+	return c.Name != "" && c.Room != "" && len(c.Peers) > 0
+}
+
+// Frame is the shared canvas picture
+type Frame struct {
+	Red   [16]uint16 `json:"red"`
+	Green [16]uint16 `json:"green"`
+	Blue  [16]uint16 `json:"blue"`
+}
+
+// Update carries a frame between servers
+type Update struct {
+	Room   string `json:"room"`
+	Origin string `json:"origin"` // Server the frame was drawn on
+	Clock  uint64 `json:"clock"`  // Hybrid clock; 0 = no frame yet (asks the peer for its own)
+	Frame  Frame  `json:"frame"`
+}
+
+// Response answers an update; a stale update is answered with the receiver's current frame
+type Response struct {
+	Accepted bool    `json:"accepted"`
+	Current  *Update `json:"current,omitempty"`
+}
+
+// PeerStatus describes a link
+type PeerStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	LastSent    time.Time `json:"last_sent,omitempty"`
+	LastHeard   time.Time `json:"last_heard,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"failures"` // Consecutive failed sends
+	PendingSend bool      `json:"pending_send"`
+}
+
+// Status describes the federated canvas
+type Status struct {
+	Name   string       `json:"name"`
+	Room   string       `json:"room"`
+	Clock  uint64       `json:"clock"`
+	Origin string       `json:"origin,omitempty"` // Server that drew the current frame
+	Peers  []PeerStatus `json:"peers"`
+}
+
+type link struct {
+	peer    Peer
+	wake    chan struct{}
+	pending bool // Current frame not yet delivered
+	status  PeerStatus
+}
+
+var (
+	mu     sync.Mutex
+	config Config
+	clock  uint64
+	origin string
+	frame  Frame
+	links  = make(map[string]*link)
+	allow  func(origin string, f Frame) bool
+	apply  func(origin string, f Frame)
+	// Clock of the last frame refused per origin, so a peer re-sending it is not checked again
+	refused = make(map[string]uint64)
+	client  = &http.Client{Timeout: requestTimeout}
+)
+
+// Start opens the listener and the links to peers. allowFrame checks a frame drawn on server
+// origin before it is stored or passed on to other peers; applyFrame then puts it on the
+// local canvas.
+func Start(cfg Config, allowFrame func(origin string, f Frame) bool, applyFrame func(origin string, f Frame)) error {
+	if !cfg.Enabled() {
+		return fmt.Errorf("federation needs a name, a room and at least one peer")
+	}
+	for _, p := range cfg.Peers {
+		if p.Name == "" || p.URL == "" || p.Secret == "" {
+			return fmt.Errorf("federation peer needs a name, url and secret")
+		}
+		if !strings.HasPrefix(p.URL, "https://") {
+			fmt.Printf("Warning: federation link to %s is not using HTTPS\n", p.Name)
+		}
+	}
+
+	mu.Lock()
+	config, allow, apply = cfg, allowFrame, applyFrame
+	for _, p := range cfg.Peers {
+		l := &link{peer: p, wake: make(chan struct{}, 1), pending: true, status: PeerStatus{Name: p.Name, URL: p.URL}}
+		links[p.Name] = l
+		go l.run()
+		l.signal() // Introduce ourselves; a peer with a frame answers with it
+	}
+	mu.Unlock()
+
+	if cfg.ListenAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc(canvasPath, handleCanvas)
+		server := &http.Server{Addr: cfg.ListenAddr, Handler: mux, ReadHeaderTimeout: requestTimeout}
+		go func() {
+			var err error
+			if cfg.TLSCert != "" {
+				fmt.Printf("Federation listening on %s (HTTPS)\n", cfg.ListenAddr)
+				err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+			} else {
+				fmt.Printf("Federation listening on %s\n", cfg.ListenAddr)
+				err = server.ListenAndServe()
+			}
+			fmt.Printf("Federation listener stopped: %v\n", err)
+		}()
+	}
+	fmt.Printf("Federation: room %s as %s with %d peer(s)\n", cfg.Room, cfg.Name, len(cfg.Peers))
+	return nil
+}
+
+// NoteLocalFrame shares a frame applied to the local canvas. Frames that only repeat the
+// current picture (including frames just received from a peer) are not sent.
+func NoteLocalFrame(f Frame) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(links) == 0 || f == frame {
+		return
+	}
+	clock = nextClock(clock)
+	origin = config.Name
+	frame = f
+	for _, l := range links {
+		l.pending = true
+		l.signal()
+	}
+}
+
+// GetStatus returns the federation state and links
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	status := Status{Name: config.Name, Room: config.Room, Clock: clock, Origin: origin, Peers: []PeerStatus{}}
+	for _, l := range links {
+		s := l.status
+		s.PendingSend = l.pending
+		status.Peers = append(status.Peers, s)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].Name < status.Peers[j].Name })
+	return status
+}
+
+// nextClock returns a clock value after c, tracking wall time
+func nextClock(c uint64) uint64 {
+	now := uint64(time.Now().UnixMilli())
+	if now > c {
+		return now
+	}
+	return c + 1
+}
+
+// newer reports whether u supersedes the current frame. Caller holds mu.
+func newer(u Update) bool {
+	if u.Clock != clock {
+		return u.Clock > clock
+	}
+	return u.Origin > origin
+}
+
+// receive applies u if it is newer than the current frame and allowed, else returns the
+// current frame
+func receive(from string, u Update) Response {
+	mu.Lock()
+	if l := links[from]; l != nil {
+		l.status.LastHeard = time.Now()
+	}
+	if u.Clock == 0 || !newer(u) || refused[u.Origin] == u.Clock {
+		return rejectLocked()
+	}
+	check := allow
+	mu.Unlock()
+
+	// Refused frames are neither kept nor forwarded, so they cannot reach other peers either
+	if check != nil && !check(u.Origin, u.Frame) {
+		mu.Lock()
+		refused[u.Origin] = u.Clock
+		fmt.Printf("Federation: refused frame from %s via %s (clock %d)\n", u.Origin, from, u.Clock)
+		return rejectLocked()
+	}
+
+	mu.Lock()
+	if !newer(u) {
+		return rejectLocked() // Something newer arrived while checking
+	}
+	clock, origin, frame = u.Clock, u.Origin, u.Frame
+	// Pass it on to the other peers (a chain of rooms converges as well)
+	for name, l := range links {
+		if name != from && name != u.Origin {
+			l.pending = true
+			l.signal()
+		}
+	}
+	fn := apply
+	mu.Unlock()
+
+	fmt.Printf("Federation: applied frame from %s via %s (clock %d)\n", u.Origin, from, u.Clock)
+	if fn != nil {
+		fn(u.Origin, u.Frame)
+	}
+	return Response{Accepted: true}
+}
+
+// rejectLocked releases mu and answers with the current frame, if any. Caller holds mu.
+func rejectLocked() Response {
+	var current *Update
+	if clock > 0 {
+		current = &Update{Room: config.Room, Origin: origin, Clock: clock, Frame: frame}
+	}
+	mu.Unlock()
+	return Response{Accepted: false, Current: current}
+}
+
+func handleCanvas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxUpdateBody+1))
+	if err != nil || len(body) > maxUpdateBody {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	from := r.Header.Get(headerPeer)
+	mu.Lock()
+	l := links[from]
+	room := config.Room
+	mu.Unlock()
+	if l == nil || !verify(l.peer.Secret, r.Header.Get(headerTime), r.Header.Get(headerSignature), body) {
+		fmt.Printf("Federation: refused unauthenticated update claiming to be from %q (%s)\n", from, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var u Update
+	if err := json.Unmarshal(body, &u); err != nil {
+		http.Error(w, "invalid update", http.StatusBadRequest)
+		return
+	}
+	if u.Room != room {
+		http.Error(w, fmt.Sprintf("room %q is not shared here", u.Room), http.StatusConflict)
+		return
+	}
+
+	resp, _ := json.Marshal(receive(from, u))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// sign returns the signature of a request body sent at unix time ts
+func sign(secret string, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'\n'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret string, ts string, signature string, body []byte) bool {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return false
+	}
+	want, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	got, _ := hex.DecodeString(sign(secret, ts, body))
+	return hmac.Equal(got, want)
+}
+
+func (l *link) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the current frame to the peer whenever it changes, retrying with backoff,
+// and periodically even when nothing changed
+func (l *link) run() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	backoff := retryMin
+
+	for {
+		select {
+		case <-l.wake:
+		case <-ticker.C:
+			mu.Lock()
+			l.pending = true
+			mu.Unlock()
+		}
+
+		for {
+			mu.Lock()
+			if !l.pending {
+				mu.Unlock()
+				break
+			}
+			l.pending = false
+			u := Update{Room: config.Room, Origin: origin, Clock: clock, Frame: frame}
+			if u.Origin == "" {
+				u.Origin = config.Name
+			}
+			mu.Unlock()
+
+			resp, err := l.send(u)
+			mu.Lock()
+			if err != nil {
+				l.pending = true
+				l.status.Failures++
+				l.status.LastError = err.Error()
+				failures := l.status.Failures
+				mu.Unlock()
+				if failures == 1 || failures%10 == 0 {
+					fmt.Printf("Federation: send to %s failed (%d in a row): %v\n", l.peer.Name, failures, err)
+				}
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > retryMax {
+					backoff = retryMax
+				}
+				continue
+			}
+			l.status.Failures = 0
+			l.status.LastError = ""
+			l.status.LastSent = time.Now()
+			mu.Unlock()
+			backoff = retryMin
+
+			// The peer had something newer: take it
+			if !resp.Accepted && resp.Current != nil {
+				receive(l.peer.Name, *resp.Current)
+			}
+		}
+	}
+}
+
+func (l *link) send(u Update) (Response, error) {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return Response{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(l.peer.URL, "/")+canvasPath, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	mu.Lock()
+	name := config.Name
+	mu.Unlock()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerPeer, name)
+	req.Header.Set(headerTime, ts)
+	req.Header.Set(headerSignature, sign(l.peer.Secret, ts, body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 256))
+		return Response{}, fmt.Errorf("peer returned status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var resp Response
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxUpdateBody)).Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("invalid response: %v", err)
+	}
+	return resp, nil
+}
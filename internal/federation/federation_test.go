@@ -0,0 +1,65 @@
+package federation
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"room":"home"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sign("s3cret", now, body)
+
+	if !verify("s3cret", now, signature, body) {
+		t.Error("valid signature refused")
+	}
+	if verify("other", now, signature, body) {
+		t.Error("signature accepted with the wrong secret")
+	}
+	if verify("s3cret", now, signature, []byte(`{"room":"away"}`)) {
+		t.Error("signature accepted for a changed body")
+	}
+	if verify("s3cret", now, "zz", body) {
+		t.Error("malformed signature accepted")
+	}
+
+	old := strconv.FormatInt(time.Now().Add(-maxClockSkew-time.Minute).Unix(), 10)
+	if verify("s3cret", old, sign("s3cret", old, body), body) {
+		t.Error("signature accepted outside the allowed clock skew (replay)")
+	}
+}
+
+// Updates from unknown peers or with a bad signature are refused before they are read
+func TestHandleCanvasRefusesUnsigned(t *testing.T) {
+	mu.Lock()
+	links = map[string]*link{"friend": {peer: Peer{Name: "friend", Secret: "s3cret"}}}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		links = make(map[string]*link)
+		mu.Unlock()
+	}()
+
+	body := []byte(`{"room":"home"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, c := range []struct {
+		peer, secret string
+	}{
+		{"friend", "wrong"},
+		{"stranger", "s3cret"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, canvasPath, bytes.NewReader(body))
+		req.Header.Set(headerPeer, c.peer)
+		req.Header.Set(headerTime, now)
+		req.Header.Set(headerSignature, sign(c.secret, now, body))
+		rec := httptest.NewRecorder()
+		handleCanvas(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("peer %s signing with %q: got %d, want 401", c.peer, c.secret, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+// Package adminv1 is the generated code for the cds.admin.v1 gRPC service (admin.proto)
+package adminv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
@@ -0,0 +1,76 @@
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Background task liveness: each long-running loop beats once per iteration, and a task
+// that misses several beats in a row is reported as stalled (blocked or exited)
+
+// Beats a task may miss before it counts as stalled
+const missedBeats = 3
+
+// Task is the liveness of one background loop
+type Task struct {
+	Name     string    `json:"name"`
+	Interval string    `json:"interval"` // Expected time between beats
+	LastBeat time.Time `json:"last_beat"`
+	Stalled  bool      `json:"stalled"`
+}
+
+type task struct {
+	interval time.Duration
+	lastBeat time.Time
+}
+
+var (
+	mu    sync.Mutex
+	tasks = make(map[string]*task)
+)
+
+// Register starts tracking a task expected to beat every interval
+func Register(name string, interval time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	tasks[name] = &task{interval: interval, lastBeat: time.Now()}
+}
+
+// Beat records that a task completed an iteration
+func Beat(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t, exists := tasks[name]; exists {
+		t.lastBeat = time.Now()
+	}
+}
+
+// Tasks returns every registered task, by name
+func Tasks() []Task {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	list := make([]Task, 0, len(tasks))
+	for name, t := range tasks {
+		list = append(list, Task{
+			Name:     name,
+			Interval: t.interval.String(),
+			LastBeat: t.lastBeat,
+			Stalled:  now.Sub(t.lastBeat) > missedBeats*t.interval,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Stalled returns the names of tasks that stopped beating
+func Stalled() []string {
+	var names []string
+	for _, t := range Tasks() {
+		if t.Stalled {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,116 @@
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-subsystem health. Each subsystem is ok, degraded (still serving, with a reason) or
+// failed; the composite status is the worst of them.
+
+// State of a subsystem or the whole server
+type State string
+
+const (
+	StateOK       State = "ok"
+	StateDegraded State = "degraded"
+	StateFailed   State = "failed"
+)
+
+var stateRank = map[State]int{StateOK: 0, StateDegraded: 1, StateFailed: 2}
+
+// Subsystem is one subsystem's current state
+type Subsystem struct {
+	Name   string    `json:"name"`
+	State  State     `json:"state"`
+	Reason string    `json:"reason,omitempty"` // Why it is not ok
+	Since  time.Time `json:"since"`            // When it entered State
+}
+
+// Composite is the server status aggregated over every subsystem
+type Composite struct {
+	State      State       `json:"state"`
+	Subsystems []Subsystem `json:"subsystems"`
+}
+
+var (
+	subsystemsMu sync.Mutex
+	subsystems   = make(map[string]*Subsystem)
+	changeHook   func(Composite)
+)
+
+// OnChange registers a callback for changes of the composite state
+func OnChange(fn func(Composite)) {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	changeHook = fn
+}
+
+// Set records a subsystem's state. Reason is kept only while the state is not ok.
+func Set(name string, state State, reason string) {
+	if state == StateOK {
+		reason = ""
+	}
+	subsystemsMu.Lock()
+	before := compositeLocked().State
+	s, exists := subsystems[name]
+	if exists && s.State == state && s.Reason == reason {
+		subsystemsMu.Unlock()
+		return
+	}
+	if !exists || s.State != state {
+		if exists || state != StateOK {
+			fmt.Printf("Health: %s %s%s\n", name, state, reasonSuffix(reason))
+		}
+		subsystems[name] = &Subsystem{Name: name, State: state, Reason: reason, Since: time.Now()}
+	} else {
+		s.Reason = reason
+	}
+	after := compositeLocked()
+	hook := changeHook
+	subsystemsMu.Unlock()
+
+	if hook != nil && after.State != before {
+		hook(after)
+	}
+}
+
+// Status returns the composite status and every subsystem, by name
+func Status() Composite {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	return compositeLocked()
+}
+
+// compositeLocked aggregates the subsystems. Caller holds subsystemsMu.
+func compositeLocked() Composite {
+	c := Composite{State: StateOK, Subsystems: make([]Subsystem, 0, len(subsystems))}
+	for _, s := range subsystems {
+		c.Subsystems = append(c.Subsystems, *s)
+		if stateRank[s.State] > stateRank[c.State] {
+			c.State = s.State
+		}
+	}
+	sort.Slice(c.Subsystems, func(i, j int) bool { return c.Subsystems[i].Name < c.Subsystems[j].Name })
+	return c
+}
+
+// Summary is a one-line description of the composite status, e.g. for ping payloads
+func (c Composite) Summary() string {
+	line := string(c.State)
+	for _, s := range c.Subsystems {
+		if s.State != StateOK {
+			line += fmt.Sprintf("; %s %s%s", s.Name, s.State, reasonSuffix(s.Reason))
+		}
+	}
+	return line
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " (" + reason + ")"
+}
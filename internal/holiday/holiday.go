@@ -0,0 +1,179 @@
+package holiday
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Holiday is a themed day; Theme is the name sent to displays and used to pick canvas art
+type Holiday struct {
+	Name  string `json:"name"`
+	Theme string `json:"theme"`
+}
+
+// Custom is a household-specific date from config.json
+// Date is "MM-DD" (every year) or "YYYY-MM-DD" (one year only).
+type Custom struct {
+	Name  string `json:"name"`
+	Date  string `json:"date"`
+	Theme string `json:"theme"`
+}
+
+type customDate struct {
+	holiday Holiday
+	year    int // 0 = every year
+	month   time.Month
+	day     int
+}
+
+var (
+	mu      sync.RWMutex
+	builtin bool
+	custom  []customDate
+)
+
+// SetCalendar replaces the calendar; the previous one is kept if any custom date is invalid
+func SetCalendar(useBuiltin bool, dates []Custom) error {
+	parsed := make([]customDate, 0, len(dates))
+	for _, c := range dates {
+		d, err := parseCustom(c)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	builtin = useBuiltin
+	custom = parsed
+	return nil
+}
+
+// Enabled reports whether any holidays are configured
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return builtin || len(custom) > 0
+}
+
+func parseCustom(c Custom) (customDate, error) {
+	if c.Name == "" || c.Theme == "" {
+		return customDate{}, fmt.Errorf("custom holiday requires name and theme")
+	}
+	d := customDate{holiday: Holiday{Name: c.Name, Theme: c.Theme}}
+	if t, err := time.Parse("2006-01-02", c.Date); err == nil {
+		d.year, d.month, d.day = t.Year(), t.Month(), t.Day()
+		return d, nil
+	}
+	// Parse against a leap year so "02-29" is accepted
+	t, err := time.Parse("2006-01-02", "2024-"+c.Date)
+	if err != nil {
+		return customDate{}, fmt.Errorf("custom holiday %s: date must be MM-DD or YYYY-MM-DD, got %q", c.Name, c.Date)
+	}
+	d.month, d.day = t.Month(), t.Day()
+	return d, nil
+}
+
+// On returns the holiday falling on the given local date. Custom dates win over built-in ones.
+func On(day time.Time) (Holiday, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	year, month, dom := day.Date()
+	for _, c := range custom {
+		if c.month == month && c.day == dom && (c.year == 0 || c.year == year) {
+			return c.holiday, true
+		}
+	}
+	if builtin {
+		for _, b := range builtinHolidays(year) {
+			if b.month == month && b.day == dom {
+				return b.holiday, true
+			}
+		}
+	}
+	return Holiday{}, false
+}
+
+type datedHoliday struct {
+	holiday Holiday
+	month   time.Month
+	day     int
+}
+
+// US national holidays plus popular themed days
+func builtinHolidays(year int) []datedHoliday {
+	fixed := func(name string, theme string, month time.Month, day int) datedHoliday {
+		return datedHoliday{Holiday{name, theme}, month, day}
+	}
+	nth := func(name string, theme string, month time.Month, weekday time.Weekday, n int) datedHoliday {
+		return datedHoliday{Holiday{name, theme}, month, nthWeekday(year, month, weekday, n)}
+	}
+	easterMonth, easterDay := easter(year)
+
+	return []datedHoliday{
+		fixed("New Year's Day", "new_year", time.January, 1),
+		nth("Martin Luther King Jr. Day", "mlk_day", time.January, time.Monday, 3),
+		fixed("Valentine's Day", "valentines", time.February, 14),
+		nth("Presidents' Day", "presidents_day", time.February, time.Monday, 3),
+		fixed("St. Patrick's Day", "st_patricks", time.March, 17),
+		fixed("Easter", "easter", easterMonth, easterDay),
+		nth("Memorial Day", "memorial_day", time.May, time.Monday, -1),
+		fixed("Juneteenth", "juneteenth", time.June, 19),
+		fixed("Independence Day", "independence_day", time.July, 4),
+		nth("Labor Day", "labor_day", time.September, time.Monday, 1),
+		fixed("Halloween", "halloween", time.October, 31),
+		fixed("Veterans Day", "veterans_day", time.November, 11),
+		nth("Thanksgiving", "thanksgiving", time.November, time.Thursday, 4),
+		fixed("Christmas Eve", "christmas", time.December, 24),
+		fixed("Christmas", "christmas", time.December, 25),
+		fixed("New Year's Eve", "new_year", time.December, 31),
+	}
+}
+
+// nthWeekday returns the day of month of the nth weekday (n = -1 for the last one)
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) int {
+	if n < 0 {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		return last.Day() - (int(last.Weekday())-int(weekday)+7)%7
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return 1 + (int(weekday)-int(first.Weekday())+7)%7 + (n-1)*7
+}
+
+// easter computes Western Easter Sunday (anonymous Gregorian algorithm)
+func easter(year int) (time.Month, int) {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Month(month), day
+}
+
+// Dated is a holiday on a specific local date
+type Dated struct {
+	Date    time.Time
+	Holiday Holiday
+}
+
+// Upcoming returns the holidays from the local date of from through the following days-1 days
+func Upcoming(from time.Time, days int) []Dated {
+	var list []Dated
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for i := 0; i < days; i++ {
+		day := start.AddDate(0, 0, i)
+		if h, ok := On(day); ok {
+			list = append(list, Dated{Date: day, Holiday: h})
+		}
+	}
+	return list
+}
@@ -0,0 +1,184 @@
+package inbox
+
+import (
+	"errors"
+	"fmt"
+	"server_app/internal/messaging"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Requests are published to a device's inbox topic (<device_name>) and answered with
+// MSG_REPLY on its outbox topic; the inbox tracks each unanswered request, republishing
+// it until a reply arrives or the retries run out.
+
+var (
+	ErrTimeout    = errors.New("no reply from device")
+	ErrSuperseded = errors.New("superseded by a newer request")
+	ErrRejected   = errors.New("device rejected request")
+)
+
+// Options controls how long to wait for a reply and how often to resend
+type Options struct {
+	Timeout time.Duration // Wait per attempt
+	Retries int           // Resends after the first attempt
+}
+
+// DefaultOptions suits small QoS 1 requests to devices on a home network
+var DefaultOptions = Options{Timeout: 10 * time.Second, Retries: 2}
+
+// Outstanding describes a request still waiting for its reply
+type Outstanding struct {
+	Device    string    `json:"device"`
+	Type      uint8     `json:"type"`
+	ID        uint16    `json:"id"`
+	Attempts  int       `json:"attempts"`
+	FirstSent time.Time `json:"first_sent"`
+}
+
+// Requests are matched to replies by device, request message type and request id
+type key struct {
+	device  string
+	msgType uint8
+	id      uint16
+}
+
+type request struct {
+	key
+	topic     string
+	msg       []byte
+	opts      Options
+	attempts  int
+	firstSent time.Time
+	timer     *time.Timer
+	done      func(messaging.Reply, error)
+}
+
+var (
+	mu      sync.Mutex
+	pending = make(map[key]*request)
+	nextID  uint16
+)
+
+// NextID returns a request id for message types that carry one (never 0)
+func NextID() uint16 {
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	if nextID == 0 {
+		nextID = 1
+	}
+	return nextID
+}
+
+// Send publishes msg to topic and calls done with the device's reply, or with an error once
+// all attempts time out. msgType and id are what the reply will name: the request's message
+// type (the inner type if msg is encrypted) and the request id encoded in msg (0 if it has none).
+// An unanswered request with the same device, type and id is superseded.
+func Send(device string, topic string, msg []byte, msgType uint8, id uint16, opts Options, done func(messaging.Reply, error)) {
+	if len(msg) == 0 {
+		done(messaging.Reply{}, fmt.Errorf("empty message"))
+		return
+	}
+	req := &request{
+		key:       key{device: device, msgType: msgType, id: id},
+		topic:     topic,
+		msg:       msg,
+		opts:      opts,
+		attempts:  1,
+		firstSent: time.Now(),
+		done:      done,
+	}
+
+	mu.Lock()
+	previous := pending[req.key]
+	if previous != nil {
+		previous.timer.Stop()
+	}
+	pending[req.key] = req
+	req.timer = time.AfterFunc(opts.Timeout, func() { expire(req) })
+	mu.Unlock()
+
+	if previous != nil {
+		previous.done(messaging.Reply{}, ErrSuperseded)
+	}
+	messaging.PublishWithPolicy(topic, msg)
+}
+
+// Call is Send that blocks until the reply (or final timeout)
+func Call(device string, topic string, msg []byte, msgType uint8, id uint16, opts Options) (messaging.Reply, error) {
+	type result struct {
+		reply messaging.Reply
+		err   error
+	}
+	ch := make(chan result, 1)
+	Send(device, topic, msg, msgType, id, opts, func(reply messaging.Reply, err error) {
+		ch <- result{reply, err}
+	})
+	r := <-ch
+	return r.reply, r.err
+}
+
+// HandleReply completes the request a device reply answers
+// Returns false if nothing was waiting for it (late or duplicate reply).
+func HandleReply(device string, reply messaging.Reply) bool {
+	k := key{device: device, msgType: reply.To, id: reply.ID}
+	mu.Lock()
+	req, exists := pending[k]
+	if exists {
+		req.timer.Stop()
+		delete(pending, k)
+	}
+	mu.Unlock()
+	if !exists {
+		return false
+	}
+
+	if reply.Status != messaging.REPLY_OK {
+		req.done(reply, fmt.Errorf("%w: %s answered 0x%02X with status %d", ErrRejected, device, reply.To, reply.Status))
+		return true
+	}
+	req.done(reply, nil)
+	return true
+}
+
+// Pending lists unanswered requests, oldest first
+func Pending() []Outstanding {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make([]Outstanding, 0, len(pending))
+	for _, req := range pending {
+		result = append(result, Outstanding{
+			Device:    req.device,
+			Type:      req.msgType,
+			ID:        req.id,
+			Attempts:  req.attempts,
+			FirstSent: req.firstSent,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].FirstSent.Before(result[j].FirstSent) })
+	return result
+}
+
+// Resend or give up on a request whose attempt went unanswered
+func expire(req *request) {
+	mu.Lock()
+	if pending[req.key] != req {
+		mu.Unlock()
+		return
+	}
+	if req.attempts > req.opts.Retries {
+		delete(pending, req.key)
+		mu.Unlock()
+		fmt.Printf("Inbox: %s did not answer 0x%02X (id %d) after %d attempts\n", req.device, req.msgType, req.id, req.attempts)
+		req.done(messaging.Reply{}, ErrTimeout)
+		return
+	}
+	req.attempts++
+	req.timer = time.AfterFunc(req.opts.Timeout, func() { expire(req) })
+	mu.Unlock()
+
+	fmt.Printf("Inbox: no reply from %s to 0x%02X (id %d), resending (attempt %d)\n", req.device, req.msgType, req.id, req.attempts)
+	messaging.PublishWithPolicy(req.topic, req.msg)
+}
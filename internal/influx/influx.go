@@ -0,0 +1,253 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics export in InfluxDB line protocol. Points are buffered as they happen and written
+// in batches by Flush, to InfluxDB 2.x (/api/v2/write), 1.x (/write) or anything else that
+// accepts line protocol over HTTP. Points that fail to write are kept for the next flush,
+// up to a limit, so a short outage of the database loses nothing.
+
+// Config for the export
+type Config struct {
+	URL             string `json:"url"`             // Write endpoint including its query, e.g. http://influx:8086/api/v2/write?org=home&bucket=cds ("" = disabled)
+	Token           string `json:"token"`           // Sent as "Authorization: Token <token>" ("" = none)
+	IntervalSeconds int    `json:"intervalSeconds"` // Between flushes (0 = 60)
+}
+
+// Point is one line of line protocol
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{} // float64, int, int64, bool or string
+	Time        time.Time
+}
+
+const (
+	defaultInterval = 60 * time.Second
+	maxBuffered     = 50000 // Oldest points are dropped past this
+	batchSize       = 5000  // Lines per write request
+)
+
+var (
+	mu        sync.Mutex
+	config    Config
+	precision time.Duration
+	buffer    []Point
+	dropped   int // Points dropped since the last successful flush
+	client    = &http.Client{Timeout: 15 * time.Second}
+)
+
+// Precisions accepted in the URL's "precision" parameter (InfluxDB 1.x and 2.x spellings)
+var precisions = map[string]time.Duration{
+	"": time.Nanosecond, "ns": time.Nanosecond, "n": time.Nanosecond,
+	"us": time.Microsecond, "u": time.Microsecond,
+	"ms": time.Millisecond, "s": time.Second,
+}
+
+// Configure sets the endpoint; timestamps follow the URL's precision parameter
+func Configure(c Config) error {
+	var p time.Duration
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid influx url %q", c.URL)
+		}
+		var known bool
+		if p, known = precisions[u.Query().Get("precision")]; !known {
+			return fmt.Errorf("unsupported influx precision %q", u.Query().Get("precision"))
+		}
+	}
+	if c.IntervalSeconds < 0 {
+		return fmt.Errorf("influx intervalSeconds must not be negative")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	precision = p
+	if c.URL == "" {
+		buffer = nil
+	}
+	return nil
+}
+
+// Enabled reports whether an endpoint is configured
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return config.URL != ""
+}
+
+// Interval returns the time between flushes
+func Interval() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	if config.IntervalSeconds == 0 {
+		return defaultInterval
+	}
+	return time.Duration(config.IntervalSeconds) * time.Second
+}
+
+// Add buffers points for the next flush (a no-op while disabled)
+func Add(points ...Point) {
+	mu.Lock()
+	defer mu.Unlock()
+	if config.URL == "" {
+		return
+	}
+	now := time.Now()
+	for _, p := range points {
+		if p.Time.IsZero() {
+			p.Time = now
+		}
+		buffer = append(buffer, p)
+	}
+	if over := len(buffer) - maxBuffered; over > 0 {
+		buffer = append([]Point(nil), buffer[over:]...)
+		dropped += over
+	}
+}
+
+// Flush writes the buffered points and returns how many were written. On failure the
+// unwritten points stay buffered, except batches the server rejects as malformed.
+func Flush() (int, error) {
+	mu.Lock()
+	target, token, p := config.URL, config.Token, precision
+	pending := buffer
+	buffer = nil
+	lost := dropped
+	dropped = 0
+	mu.Unlock()
+
+	if target == "" || len(pending) == 0 {
+		return 0, nil
+	}
+	if lost > 0 {
+		fmt.Printf("Influx: dropped %d point(s) while the endpoint was unreachable\n", lost)
+	}
+
+	written := 0
+	for written < len(pending) {
+		end := written + batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		var body bytes.Buffer
+		for _, point := range pending[written:end] {
+			if line := Line(point, p); line != "" {
+				body.WriteString(line)
+				body.WriteByte('\n')
+			}
+		}
+		if body.Len() == 0 {
+			written = end
+			continue
+		}
+		rejected, err := write(target, token, body.Bytes())
+		if err != nil && !rejected {
+			mu.Lock()
+			buffer = append(pending[written:], buffer...)
+			mu.Unlock()
+			return written, err
+		}
+		if err != nil {
+			fmt.Printf("Warning: influx rejected %d point(s): %v\n", end-written, err)
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// write posts one batch; rejected is set when retrying the same data can't succeed
+func write(target string, token string, body []byte) (rejected bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // The URL may carry credentials
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	var msg [256]byte
+	n, _ := resp.Body.Read(msg[:])
+	err = fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg[:n])))
+	// Bad data is rejected with 400 (or 422 past the retention period); auth and server
+	// errors may clear up
+	return resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity, err
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Line renders a point in line protocol with its timestamp in units of precision, or ""
+// if it has no usable fields. Empty tag values are left out.
+func Line(p Point, precision time.Duration) string {
+	var fields []string
+	for key, value := range p.Fields {
+		var v string
+		switch value := value.(type) {
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v = strconv.FormatFloat(value, 'f', -1, 64)
+		case int:
+			v = strconv.Itoa(value) + "i"
+		case int64:
+			v = strconv.FormatInt(value, 10) + "i"
+		case bool:
+			v = strconv.FormatBool(value)
+		case string:
+			v = `"` + stringEscaper.Replace(value) + `"`
+		default:
+			continue
+		}
+		fields = append(fields, keyEscaper.Replace(key)+"="+v)
+	}
+	if len(fields) == 0 || p.Measurement == "" {
+		return ""
+	}
+	sort.Strings(fields)
+
+	var line strings.Builder
+	line.WriteString(measurementEscaper.Replace(p.Measurement))
+	keys := make([]string, 0, len(p.Tags))
+	for key := range p.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // InfluxDB's preferred order
+	for _, key := range keys {
+		if p.Tags[key] == "" {
+			continue
+		}
+		line.WriteString("," + keyEscaper.Replace(key) + "=" + keyEscaper.Replace(p.Tags[key]))
+	}
+	line.WriteString(" " + strings.Join(fields, ","))
+	line.WriteString(" " + strconv.FormatInt(p.Time.UnixNano()/int64(precision), 10))
+	return line.String()
+}
@@ -0,0 +1,389 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server_app/internal/storage"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Persistent queue for long-running operations (bulk config pushes, rollouts, backups).
+// Jobs run one at a time in submission order. Progress is saved as the job advances, so a
+// job interrupted by a restart resumes from its last completed step.
+
+// Job states
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// Defaults
+const (
+	DefaultMaxAttempts = 3
+	retryBackoff       = 30 * time.Second // Doubled after every failed attempt
+	finishedRetention  = 7 * 24 * time.Hour
+	pollInterval       = 5 * time.Second
+)
+
+// Version of the stored layout (see storage.Migrate)
+const schemaVersion = 1
+
+var (
+	ErrUnknownJob  = errors.New("unknown job")
+	ErrUnknownKind = errors.New("unknown job kind")
+	ErrFinished    = errors.New("job already finished")
+)
+
+// Job is one queued or finished operation
+type Job struct {
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	Params      map[string]string `json:"params,omitempty"`
+	State       string            `json:"state"`
+	Done        int               `json:"done"`  // Steps completed
+	Total       int               `json:"total"` // Steps in the job (0 until the handler reports it)
+	Attempts    int               `json:"attempts"`
+	MaxAttempts int               `json:"max_attempts"`
+	Error       string            `json:"error,omitempty"`
+	Created     time.Time         `json:"created"`
+	Updated     time.Time         `json:"updated"`
+	NotBefore   time.Time         `json:"not_before,omitempty"` // Retry backoff
+}
+
+// Finished reports whether the job is in a final state
+func (j Job) Finished() bool {
+	return j.State == StateSucceeded || j.State == StateFailed || j.State == StateCancelled
+}
+
+// Run is the handle a job handler uses to read its parameters and report progress
+type Run struct {
+	id     string
+	params map[string]string
+	done   int
+}
+
+// ID returns the job's id
+func (r *Run) ID() string {
+	return r.id
+}
+
+// Param returns a job parameter ("" if unset)
+func (r *Run) Param(key string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return r.params[key]
+}
+
+// LookupParam returns a job parameter and whether it is set
+func (r *Run) LookupParam(key string) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	value, ok := r.params[key]
+	return value, ok
+}
+
+// SetParam saves a job parameter, e.g. a value resolved on the first attempt that later
+// attempts must reuse
+func (r *Run) SetParam(key string, value string) {
+	mu.Lock()
+	defer mu.Unlock()
+	params := make(map[string]string, len(r.params)+1)
+	for k, v := range r.params {
+		params[k] = v
+	}
+	params[key] = value
+	r.params = params
+	if job, exists := jobs[r.id]; exists {
+		job.Params = params
+		job.Updated = time.Now()
+		saveLocked(job)
+	}
+}
+
+// Done returns the number of steps completed by earlier attempts (the point to resume from)
+func (r *Run) Done() int {
+	return r.done
+}
+
+// Progress records completed steps out of total and saves them
+func (r *Run) Progress(done int, total int) {
+	r.done = done
+	update(r.id, func(j *Job) {
+		j.Done = done
+		j.Total = total
+	})
+}
+
+// Handler performs a job, resuming from run.Done(). It should return ctx.Err() promptly
+// once ctx is cancelled.
+type Handler func(ctx context.Context, run *Run) error
+
+var (
+	mu       sync.Mutex
+	jobs     = make(map[string]*Job)
+	handlers = make(map[string]Handler)
+	store    *storage.Manager
+	nextID   uint64
+	cancel   context.CancelFunc // Cancels the running job
+	running  string
+	wake     = make(chan struct{}, 1)
+	onFinish func(Job)
+)
+
+// Register sets the handler for a job kind
+func Register(kind string, handler Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[kind] = handler
+}
+
+// OnFinish registers a callback invoked when a run ends a job: it succeeded, failed with no
+// attempts left, or was cancelled
+func OnFinish(fn func(Job)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onFinish = fn
+}
+
+// InitStorage loads jobs saved by previous runs. Jobs that were running when the server
+// stopped are queued again to resume.
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.New(dataFilePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Migrate(schemaVersion, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id := range store.GetAll() {
+		var job Job
+		if _, err := store.GetTyped(id, &job); err != nil {
+			fmt.Printf("Warning: failed to load job %s: %v\n", id, err)
+			continue
+		}
+		if job.Finished() && time.Since(job.Updated) > finishedRetention {
+			store.Delete(id)
+			continue
+		}
+		if job.State == StateRunning {
+			fmt.Printf("Jobs: resuming %s job %s at step %d\n", job.Kind, id, job.Done)
+			job.State = StateQueued
+		}
+		jobs[id] = &job
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > nextID {
+			nextID = n
+		}
+	}
+	return nil
+}
+
+// Submit queues a job of a registered kind
+func Submit(kind string, params map[string]string, maxAttempts int) (Job, error) {
+	mu.Lock()
+	if _, exists := handlers[kind]; !exists {
+		mu.Unlock()
+		return Job{}, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	nextID++
+	now := time.Now()
+	job := &Job{
+		ID:          strconv.FormatUint(nextID, 10),
+		Kind:        kind,
+		Params:      params,
+		State:       StateQueued,
+		MaxAttempts: maxAttempts,
+		Created:     now,
+		Updated:     now,
+	}
+	jobs[job.ID] = job
+	saveLocked(job)
+	result := *job
+	mu.Unlock()
+
+	fmt.Printf("Jobs: queued %s job %s\n", kind, job.ID)
+	signal()
+	return result, nil
+}
+
+// Get returns a job by id
+func Get(id string) (Job, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	job, exists := jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns all known jobs, newest first
+func List() []Job {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, *job)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].Created.After(result[k].Created) })
+	return result
+}
+
+// Cancel stops a queued job immediately, or asks a running one to stop
+func Cancel(id string) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	job, exists := jobs[id]
+	if !exists {
+		return Job{}, ErrUnknownJob
+	}
+	if job.Finished() {
+		return *job, ErrFinished
+	}
+	if id == running && cancel != nil {
+		cancel()
+		return *job, nil
+	}
+	job.State = StateCancelled
+	job.Updated = time.Now()
+	saveLocked(job)
+	fmt.Printf("Jobs: cancelled %s job %s\n", job.Kind, id)
+	return *job, nil
+}
+
+// Start runs queued jobs in the background
+func Start() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			for runNext() {
+			}
+			select {
+			case <-wake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func signal() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// runNext runs the oldest job that is due and reports whether one ran
+func runNext() bool {
+	mu.Lock()
+	var next *Job
+	now := time.Now()
+	for _, job := range jobs {
+		if job.State != StateQueued || now.Before(job.NotBefore) {
+			continue
+		}
+		if next == nil || job.Created.Before(next.Created) {
+			next = job
+		}
+	}
+	if next == nil {
+		mu.Unlock()
+		return false
+	}
+	handler := handlers[next.Kind]
+	if handler == nil {
+		next.State = StateFailed
+		next.Error = fmt.Sprintf("no handler for job kind %s", next.Kind)
+		next.Updated = now
+		saveLocked(next)
+		finished, hook := *next, onFinish
+		mu.Unlock()
+		if hook != nil {
+			hook(finished)
+		}
+		return true
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancel, running = cancelFn, next.ID
+	next.State = StateRunning
+	next.Attempts++
+	next.Updated = now
+	saveLocked(next)
+	run := &Run{id: next.ID, params: next.Params, done: next.Done}
+	kind, id, attempt := next.Kind, next.ID, next.Attempts
+	mu.Unlock()
+
+	fmt.Printf("Jobs: running %s job %s (attempt %d)\n", kind, id, attempt)
+	err := handler(ctx, run)
+	cancelled := ctx.Err() != nil // Before cancelFn, which would make every run look cancelled
+	cancelFn()
+
+	mu.Lock()
+	cancel, running = nil, ""
+	job := jobs[id]
+	job.Updated = time.Now()
+	switch {
+	case cancelled && (err == nil || errors.Is(err, context.Canceled)):
+		job.State = StateCancelled
+		fmt.Printf("Jobs: cancelled %s job %s at step %d\n", kind, id, job.Done)
+	case err == nil:
+		job.State = StateSucceeded
+		job.Error = ""
+		fmt.Printf("Jobs: %s job %s finished\n", kind, id)
+	case job.Attempts < job.MaxAttempts:
+		job.State = StateQueued
+		job.Error = err.Error()
+		job.NotBefore = job.Updated.Add(retryBackoff << (job.Attempts - 1))
+		fmt.Printf("Jobs: %s job %s failed (attempt %d of %d), retrying at %s: %v\n",
+			kind, id, job.Attempts, job.MaxAttempts, job.NotBefore.Format(time.Kitchen), err)
+	default:
+		job.State = StateFailed
+		job.Error = err.Error()
+		fmt.Printf("Jobs: %s job %s failed: %v\n", kind, id, err)
+	}
+	saveLocked(job)
+	finished, hook := *job, onFinish
+	mu.Unlock()
+
+	if hook != nil && finished.Finished() {
+		hook(finished)
+	}
+	return true
+}
+
+func update(id string, fn func(j *Job)) {
+	mu.Lock()
+	defer mu.Unlock()
+	job, exists := jobs[id]
+	if !exists {
+		return
+	}
+	fn(job)
+	job.Updated = time.Now()
+	saveLocked(job)
+}
+
+// saveLocked persists a job. Caller holds mu.
+func saveLocked(job *Job) {
+	if store == nil {
+		return
+	}
+	if err := store.Set(job.ID, *job); err != nil {
+		fmt.Printf("Warning: failed to save job %s: %v\n", job.ID, err)
+	}
+}
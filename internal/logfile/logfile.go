@@ -0,0 +1,183 @@
+package logfile
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Writer appends to dir/name and rotates to name.1 ... name.<keep> once the file
+// would exceed maxBytes. The oldest rotated file is deleted.
+type Writer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+	stderr   bool // File descriptor 2 follows the file (see takeStderr)
+}
+
+// Open creates (or appends to) the log file, creating dir if needed
+func Open(dir string, name string, maxBytes int64, keep int) (*Writer, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("log max size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	w := &Writer{path: filepath.Join(dir, name), maxBytes: maxBytes, keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	w.file = f
+	w.size = info.Size()
+	if w.stderr {
+		redirectStderr(f) // Best effort; crash output keeps going to the rotated file otherwise
+	}
+	return nil
+}
+
+// takeStderr points file descriptor 2 at the log file, now and after each rotation, so
+// output written to it directly (the runtime's panic traces) lands in the file even when
+// the process dies right after. Returns a function pointing it back.
+func (w *Writer) takeStderr() (func() error, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	restore, err := saveStderr()
+	if err != nil {
+		return nil, err
+	}
+	if err := redirectStderr(w.file); err != nil {
+		restore()
+		return nil, err
+	}
+	w.stderr = true
+	return func() error {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.stderr = false
+		return restore()
+	}, nil
+}
+
+// Write appends p, rotating first if it would push the file past maxBytes
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Shift name.N-1 -> name.N ... name -> name.1, dropping anything past keep
+func (w *Writer) rotate() error {
+	w.file.Close()
+
+	if w.keep <= 0 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.keep))
+		for i := w.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+// Close closes the current log file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Tee mirrors everything printed to stdout/stderr into a log file
+type Tee struct {
+	stdout  *os.File
+	stderr  *os.File
+	pipe    *os.File
+	w       *Writer
+	restore func() error // Points file descriptor 2 back at the original stderr
+	done    chan struct{}
+}
+
+// TeeStdout redirects os.Stdout, os.Stderr and the log package through a pipe; each line
+// is still printed to the original stdout and is written to w prefixed with a timestamp.
+// Output written to file descriptor 2 directly, such as a panic trace, goes to w's file
+// as it is: a pipe would lose it when the process dies. Stop closes w.
+func TeeStdout(w *Writer) (*Tee, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log pipe: %w", err)
+	}
+	restore, err := w.takeStderr()
+	if err != nil {
+		r.Close()
+		pw.Close()
+		return nil, fmt.Errorf("failed to redirect stderr: %w", err)
+	}
+	t := &Tee{stdout: os.Stdout, stderr: os.Stderr, pipe: pw, w: w, restore: restore, done: make(chan struct{})}
+	os.Stdout = pw
+	os.Stderr = pw
+	log.SetOutput(pw)
+
+	go func() {
+		defer close(t.done)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				t.stdout.WriteString(line)
+				if _, werr := fmt.Fprintf(w, "%s %s", time.Now().Format("2006-01-02T15:04:05.000"), line); werr != nil {
+					fmt.Fprintf(t.stdout, "Log file write failed: %v\n", werr)
+				}
+			}
+			if err != nil {
+				r.Close()
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Stop restores stdout/stderr, waits until buffered output has been written and closes
+// the log file
+func (t *Tee) Stop() {
+	os.Stdout = t.stdout
+	os.Stderr = t.stderr
+	log.SetOutput(t.stderr)
+	t.pipe.Close()
+	<-t.done
+	if err := t.restore(); err != nil {
+		fmt.Fprintf(t.stdout, "Failed to restore stderr: %v\n", err)
+	}
+	if err := t.w.Close(); err != nil {
+		fmt.Fprintf(t.stdout, "Failed to close log file: %v\n", err)
+	}
+}
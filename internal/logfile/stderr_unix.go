@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package logfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// saveStderr keeps a copy of file descriptor 2 and returns a function restoring it
+func saveStderr() (func() error, error) {
+	saved, err := unix.Dup(2)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		defer unix.Close(saved)
+		return unix.Dup2(saved, 2)
+	}, nil
+}
+
+// redirectStderr points file descriptor 2 at f
+func redirectStderr(f *os.File) error {
+	return unix.Dup2(int(f.Fd()), 2)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package logfile
+
+import "os"
+
+// saveStderr is a no-op on Windows: the standard error handle is left alone, so crash
+// output is not captured in the log file
+func saveStderr() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func redirectStderr(f *os.File) error {
+	return nil
+}
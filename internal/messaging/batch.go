@@ -0,0 +1,186 @@
+package messaging
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batching window tuning: the window is batchRTTFactor × the smoothed broker round trip,
+// clamped to the batcher's bounds, and jumps to the upper bound while publishes are queued
+// for a reconnect (there is no point sending faster than the broker drains them).
+const (
+	batchRTTFactor = 2
+	rttSmoothing   = 0.2 // Weight of the newest sample in the round-trip average
+)
+
+// Batcher coalesces rapid publishes per topic: only the latest message on a topic is sent,
+// once the batching window after the first pending one has elapsed
+type Batcher struct {
+	name    string
+	publish func(topic string, data []byte) bool
+	min     time.Duration
+	max     time.Duration
+
+	mu        sync.Mutex
+	window    time.Duration // Window chosen for the most recent batch
+	pending   map[string][]byte
+	failed    map[string]bool // Topics whose last batch the broker did not accept
+	sent      uint64
+	coalesced uint64 // Messages replaced by a newer one before sending
+	dropped   uint64 // Batches the broker did not accept
+}
+
+// BatcherStats reports a batcher's tuned window and counters
+type BatcherStats struct {
+	Name      string  `json:"name"`
+	WindowMs  float64 `json:"window_ms"`
+	MinMs     float64 `json:"min_ms"`
+	MaxMs     float64 `json:"max_ms"`
+	Pending   int     `json:"pending"`
+	Sent      uint64  `json:"sent"`
+	Coalesced uint64  `json:"coalesced"`
+	Dropped   uint64  `json:"dropped"`
+}
+
+var (
+	batchersMu sync.Mutex
+	batchers   []*Batcher
+)
+
+// NewBatcher creates a batcher sending through publish with a window between min and max
+func NewBatcher(name string, publish func(topic string, data []byte) bool, min time.Duration, max time.Duration) *Batcher {
+	b := &Batcher{
+		name:    name,
+		publish: publish,
+		min:     min,
+		max:     max,
+		window:  min,
+		pending: make(map[string][]byte),
+		failed:  make(map[string]bool),
+	}
+	batchersMu.Lock()
+	batchers = append(batchers, b)
+	batchersMu.Unlock()
+	return b
+}
+
+// Publish queues data for topic, replacing any message still waiting on that topic; the
+// publish itself happens when the window closes. Like an unbatched publish it reports false
+// while the client is disconnected (the message goes out on reconnect), and it also reports
+// false when the topic's previous batch was not accepted, so callers see drops without
+// waiting for the window.
+func (b *Batcher) Publish(topic string, data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ok := !b.failed[topic] && client != nil && client.IsConnected()
+	if _, waiting := b.pending[topic]; waiting {
+		b.pending[topic] = data
+		b.coalesced++
+		return ok
+	}
+	b.pending[topic] = data
+	b.window = b.tune()
+	time.AfterFunc(b.window, func() { b.flush(topic) })
+	return ok
+}
+
+func (b *Batcher) flush(topic string) {
+	b.mu.Lock()
+	data, exists := b.pending[topic]
+	delete(b.pending, topic)
+	if exists {
+		b.sent++
+	}
+	b.mu.Unlock()
+
+	if !exists {
+		return
+	}
+	accepted := b.publish(topic, data)
+	b.mu.Lock()
+	if accepted {
+		delete(b.failed, topic)
+	} else {
+		b.failed[topic] = true
+		b.dropped++
+	}
+	b.mu.Unlock()
+	if !accepted {
+		fmt.Printf("Batcher %s: publish to %s failed\n", b.name, topic)
+	}
+}
+
+// tune picks the window from current broker metrics
+func (b *Batcher) tune() time.Duration {
+	if QueueLen() > 0 {
+		return b.max
+	}
+	window := batchRTTFactor * PublishRTT()
+	if window < b.min {
+		window = b.min
+	}
+	if window > b.max {
+		window = b.max
+	}
+	return window
+}
+
+// Stats returns the batcher's current window and counters
+func (b *Batcher) Stats() BatcherStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BatcherStats{
+		Name:      b.name,
+		WindowMs:  durationMs(b.window),
+		MinMs:     durationMs(b.min),
+		MaxMs:     durationMs(b.max),
+		Pending:   len(b.pending),
+		Sent:      b.sent,
+		Coalesced: b.coalesced,
+		Dropped:   b.dropped,
+	}
+}
+
+// BatcherStatsAll returns stats for every batcher, by name
+func BatcherStatsAll() []BatcherStats {
+	batchersMu.Lock()
+	all := append([]*Batcher(nil), batchers...)
+	batchersMu.Unlock()
+
+	stats := make([]BatcherStats, 0, len(all))
+	for _, b := range all {
+		stats = append(stats, b.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+var (
+	rttMu sync.Mutex
+	rtt   time.Duration // Smoothed QoS 1+ publish round trip (0 until measured)
+)
+
+// noteRTT folds one acknowledged publish's round trip into the average
+func noteRTT(d time.Duration) {
+	rttMu.Lock()
+	defer rttMu.Unlock()
+	if rtt == 0 {
+		rtt = d
+		return
+	}
+	rtt = time.Duration(rttSmoothing*float64(d) + (1-rttSmoothing)*float64(rtt))
+}
+
+// PublishRTT returns the smoothed round trip of acknowledged publishes
+func PublishRTT() time.Duration {
+	rttMu.Lock()
+	defer rttMu.Unlock()
+	return rtt
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
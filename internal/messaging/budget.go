@@ -0,0 +1,91 @@
+package messaging
+
+import "fmt"
+
+// MessageBudget describes the worst-case size and daily frequency of one outbound message
+type MessageBudget struct {
+	Name       string `json:"name"`
+	Topic      string `json:"topic"`
+	QoS        byte   `json:"qos"`
+	PayloadLen int    `json:"payload_len"` // Protocol payload bytes (excluding 2-byte header)
+	WireBytes  int    `json:"wire_bytes"`  // Full MQTT PUBLISH packet size
+	PerDay     int    `json:"per_day"`
+	DailyBytes int    `json:"daily_bytes"`
+	OverLimit  bool   `json:"over_limit"` // Payload exceeds MAX_PAYLOAD_SIZE
+}
+
+// BudgetReport summarizes a device's outbound traffic against protocol and bandwidth limits
+type BudgetReport struct {
+	Device      string          `json:"device"`
+	Messages    []MessageBudget `json:"messages"`
+	DailyBytes  int             `json:"daily_bytes"`
+	DailyBudget int             `json:"daily_budget"`
+	Warnings    []string        `json:"warnings"`
+	OK          bool            `json:"ok"`
+}
+
+// NewMessageBudget computes wire size and daily volume for a message with the given payload length
+func NewMessageBudget(name string, topic string, qos byte, payloadLen int, perDay int) MessageBudget {
+	wire := publishPacketSize(topic, qos, 2+payloadLen)
+	return MessageBudget{
+		Name:       name,
+		Topic:      topic,
+		QoS:        qos,
+		PayloadLen: payloadLen,
+		WireBytes:  wire,
+		PerDay:     perDay,
+		DailyBytes: wire * perDay,
+		OverLimit:  payloadLen > MAX_PAYLOAD_SIZE,
+	}
+}
+
+// AnalyzeBudget totals the messages and flags any that break the payload or daily byte budget
+// A dailyBudget of 0 disables the bandwidth check
+func AnalyzeBudget(device string, messages []MessageBudget, dailyBudget int) BudgetReport {
+	report := BudgetReport{
+		Device:      device,
+		Messages:    messages,
+		DailyBudget: dailyBudget,
+		Warnings:    []string{},
+	}
+
+	for _, m := range messages {
+		report.DailyBytes += m.DailyBytes
+		if m.OverLimit {
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("%s payload is %d bytes, exceeds maximum of %d", m.Name, m.PayloadLen, MAX_PAYLOAD_SIZE))
+		}
+	}
+	if dailyBudget > 0 && report.DailyBytes > dailyBudget {
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("daily volume %d bytes exceeds budget of %d", report.DailyBytes, dailyBudget))
+	}
+
+	report.OK = len(report.Warnings) == 0
+	return report
+}
+
+// ConfigPairsPayloadLen returns the payload length EncodeConfigPairs would produce,
+// without enforcing MAX_PAYLOAD_SIZE
+func ConfigPairsPayloadLen(pairs map[string]string) int {
+	n := 1 // string count
+	for k, v := range pairs {
+		n += 1 + len(k) + 1 + len(v) // length byte + "key=value"
+	}
+	return n
+}
+
+// publishPacketSize returns the size of an MQTT 3.1.1 PUBLISH packet carrying msgLen bytes
+func publishPacketSize(topic string, qos byte, msgLen int) int {
+	remaining := 2 + len(topic) + msgLen
+	if qos > 0 {
+		remaining += 2 // packet identifier
+	}
+
+	// Fixed header: 1 control byte + variable-length remaining length (1-4 bytes)
+	lenBytes := 1
+	for n := remaining; n > 127; n /= 128 {
+		lenBytes++
+	}
+	return 1 + lenBytes + remaining
+}
@@ -0,0 +1,115 @@
+package messaging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Republish unchanged bytes after this long anyway, in case a QoS 0 copy was lost
+const publishCacheMaxAge = 2 * time.Hour
+
+type cacheKey struct {
+	topic   string
+	msgType byte
+}
+
+type cacheEntry struct {
+	data []byte
+	at   time.Time
+}
+
+var (
+	cacheMu      sync.Mutex
+	publishCache = make(map[cacheKey]cacheEntry)
+)
+
+// Messages whose value MSG_WEATHER_UNAVAILABLE replaces on a display, by weather type
+var unavailableReplaces = map[byte][]byte{
+	MSG_CURRENT_WEATHER:  {MSG_CURRENT_WEATHER, MSG_CURRENT_WEATHER_V2},
+	MSG_FORECAST_WEATHER: {MSG_FORECAST_WEATHER, MSG_FORECAST_WEATHER_V2},
+}
+
+// PublishIfChanged publishes with the topic's policy unless the same bytes were the last
+// message of this type on topic. Returns true if a message was sent.
+func PublishIfChanged(topic string, data []byte) bool {
+	return publishIfChanged(topic, data, func() bool { return PublishWithPolicy(topic, data) })
+}
+
+func publishIfChanged(topic string, data []byte, send func() bool) bool {
+	if len(data) == 0 {
+		return false
+	}
+	key := cacheKey{topic, messageType(data)}
+
+	cacheMu.Lock()
+	entry, exists := publishCache[key]
+	cacheMu.Unlock()
+	if exists && string(entry.data) == string(data) && time.Since(entry.at) < publishCacheMaxAge {
+		fmt.Printf("Skipping publish to %s (type 0x%02X unchanged)\n", topic, key.msgType)
+		return false
+	}
+
+	if !send() {
+		return false
+	}
+	cacheMu.Lock()
+	publishCache[key] = cacheEntry{data: append([]byte(nil), data...), at: time.Now()}
+	forgetReplaced(topic, data)
+	cacheMu.Unlock()
+	return true
+}
+
+// forgetReplaced drops cached messages that data took off the display, so they go out again
+// even if unchanged: weather after "unavailable" showed a dash, and "unavailable" again after
+// the weather came back. Caller holds cacheMu.
+func forgetReplaced(topic string, data []byte) {
+	msgType := messageType(data)
+	if msgType == MSG_WEATHER_UNAVAILABLE {
+		if len(data) >= 3 {
+			for _, t := range unavailableReplaces[data[2]] {
+				delete(publishCache, cacheKey{topic, t})
+			}
+		}
+		return
+	}
+	for _, types := range unavailableReplaces {
+		for _, t := range types {
+			if t == msgType {
+				delete(publishCache, cacheKey{topic, MSG_WEATHER_UNAVAILABLE})
+				return
+			}
+		}
+	}
+}
+
+// LastPublished returns the last message of msgType published on topic through
+// PublishIfChanged, if it is still cached
+func LastPublished(topic string, msgType byte) ([]byte, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	entry, exists := publishCache[cacheKey{topic, msgType}]
+	if !exists {
+		return nil, false
+	}
+	return append([]byte(nil), entry.data...), true
+}
+
+// InvalidateCache forgets what was published on topic so the next publish always goes out
+// (e.g. a device just booted and has none of it)
+func InvalidateCache(topic string) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for key := range publishCache {
+		if key.topic == topic {
+			delete(publishCache, key)
+		}
+	}
+}
+
+// Devices may have missed anything published while the server was disconnected
+func clearCache() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	publishCache = make(map[cacheKey]cacheEntry)
+}
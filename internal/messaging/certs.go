@@ -0,0 +1,141 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader holds the client certificate presented on every (re)connect, so a rotated
+// certificate can be swapped in without restarting the process
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Newest modification time of the loaded files
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the key pair and reports whether it differs from the one in use.
+// On error the current certificate is kept.
+func (r *certReloader) load() (bool, error) {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return false, err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to load client certificate/key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.cert == nil || !bytes.Equal(r.cert.Certificate[0], cert.Certificate[0])
+	r.cert = &cert
+	r.modTime = modTime
+	if changed {
+		fmt.Printf("Loaded client certificate %s (expires %s)\n", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02"))
+	}
+	return changed, nil
+}
+
+// stale reports whether either file was modified after the loaded certificate
+func (r *certReloader) stale() bool {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return false // Mid-rotation (file missing); check again next time
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTime.After(r.modTime)
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadCertificates re-reads the client certificates and keys and, if any changed,
+// reconnects so the broker sees the new certificate. A certificate that fails to load
+// leaves the current one (and connection) in place.
+func ReloadCertificates() error {
+	p, ok := client.(*pahoClient)
+	if !ok || len(p.certReloaders()) == 0 {
+		return errors.New("no client certificate configured")
+	}
+	changed := false
+	for _, certs := range p.certReloaders() {
+		c, err := certs.load()
+		if err != nil {
+			return err
+		}
+		changed = changed || c
+	}
+	if !changed {
+		fmt.Println("Client certificate unchanged; keeping the current connection")
+		return nil
+	}
+
+	fmt.Println("Reconnecting to the broker with the new client certificate")
+	p.conn().Disconnect(250)
+	noteConnectionLost(errors.New("reconnecting with a new client certificate"))
+	return p.Connect()
+}
+
+// WatchCertificates reloads the client certificates whenever their files change
+func WatchCertificates(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		p, ok := client.(*pahoClient)
+		if !ok || !anyStale(p.certReloaders()) {
+			continue
+		}
+		fmt.Println("Client certificate files changed")
+		if err := ReloadCertificates(); err != nil {
+			fmt.Printf("Warning: client certificate reload failed: %v\n", err)
+		}
+	}
+}
+
+func anyStale(reloaders []*certReloader) bool {
+	for _, r := range reloaders {
+		if r.stale() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MessageHandler receives a message delivered for a subscription
+type MessageHandler func(topic string, payload []byte)
+
+// Client is the broker connection every publish and subscription goes through.
+// NewClient returns the paho implementation (or the in-memory FakeClient for mem:// brokers);
+// Connect makes a client the active one.
+type Client interface {
+	Connect() error
+	IsConnected() bool
+	Publish(topic string, qos byte, retained bool, payload []byte, timeout time.Duration) error
+	Subscribe(filter string, qos byte, handler MessageHandler) error
+	Unsubscribe(filter string) error
+}
+
+var (
+	ErrNotConnected   = errors.New("not connected")
+	ErrPublishTimeout = errors.New("publish timed out")
+)
+
+// Active connection used by the package-level publish and subscribe functions
+var client Client
+
+// NewClient creates the client for the broker(s) in cfg without connecting.
+// Messages the broker delivers without a matching route go to the router's fallback.
+func NewClient(router *Router, cfg Config) (Client, error) {
+	fmt.Println("Starting create client")
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	noteBrokers(cfg.Brokers)
+	if cfg.InMemory() {
+		fmt.Println("Using in-memory MQTT broker (messages stay inside this process)")
+		return NewFakeClient(), nil
+	}
+	return newPahoClient(router, cfg)
+}
+
+// Connect makes c the active client and connects it; routes are (re)subscribed on every connect
+func Connect(c Client) error {
+	client = c
+	return c.Connect()
+}
+
+// Publisher publishes through one client, so code handed a Publisher works the same with
+// the paho client and a FakeClient. The zero Publisher uses the active client.
+type Publisher struct {
+	c Client
+}
+
+// NewPublisher creates a Publisher sending through c
+func NewPublisher(c Client) Publisher {
+	return Publisher{c: c}
+}
+
+func (p Publisher) client() Client {
+	if p.c != nil {
+		return p.c
+	}
+	return client
+}
+
+// PublishWithPolicy is the package-level PublishWithPolicy through p's client
+func (p Publisher) PublishWithPolicy(topic string, data []byte) bool {
+	return publishWithPolicy(p.client(), topic, data)
+}
+
+// PublishIfChanged is the package-level PublishIfChanged through p's client
+func (p Publisher) PublishIfChanged(topic string, data []byte) bool {
+	return publishIfChanged(topic, data, func() bool { return p.PublishWithPolicy(topic, data) })
+}
+
+// onConnected restores subscriptions and replays queued publishes on a new connection
+func onConnected(c Client) {
+	noteConnected()
+	fmt.Printf("Connected to MQTT broker %s, subscribing to topics...\n", Status().Active)
+	publishPresence(c, PresenceOnline)
+	resubscribeAll(c)
+	go flushQueue()
+}
+
+// pahoClient is the Client backed by a real broker connection
+type pahoClient struct {
+	mu      sync.Mutex
+	mqtt    MQTT.Client
+	router  *Router
+	cfg     Config
+	brokers []*brokerConn // In priority order
+}
+
+// brokerConn is how to connect to one broker
+type brokerConn struct {
+	url   string        // As configured
+	cfg   Config        // With the broker's overrides (see Config.ForBroker)
+	tls   *tls.Config   // nil = plain TCP
+	certs *certReloader // Client certificate, if any (see ReloadCertificates)
+}
+
+func newPahoClient(router *Router, cfg Config) (*pahoClient, error) {
+	// Brokers are tried in order on every (re)connect, so the first reachable one wins
+	for _, broker := range cfg.Brokers {
+		fmt.Printf("Using MQTT broker: %s\n", broker)
+	}
+	fmt.Printf("MQTT client ID: %s\n", cfg.ClientID)
+
+	p := &pahoClient{router: router, cfg: cfg}
+	reloaders := make(map[[2]string]*certReloader) // Brokers sharing a key pair share its reloader
+	for _, broker := range cfg.Brokers {
+		b := &brokerConn{url: broker, cfg: cfg.ForBroker(broker)}
+		if b.cfg.TLSEnabled() {
+			tlsConfig, certs, err := b.cfg.tlsConfig(reloaders)
+			if err != nil {
+				return nil, fmt.Errorf("broker %s: %w", broker, err)
+			}
+			b.tls, b.certs = tlsConfig, certs
+		}
+		p.brokers = append(p.brokers, b)
+	}
+	p.mqtt = MQTT.NewClient(p.options())
+	if interval := cfg.failbackInterval(); interval > 0 && len(p.brokers) > 1 {
+		go p.watchFailback(interval)
+	}
+	return p, nil
+}
+
+// broker returns the configured broker paho is dialing, matched without credentials
+func (p *pahoClient) broker(u *url.URL) *brokerConn {
+	dialed := withoutUser(u)
+	for _, b := range p.brokers {
+		if configured, err := url.Parse(b.url); err == nil && withoutUser(configured) == dialed {
+			return b
+		}
+	}
+	return nil
+}
+
+// withoutUser formats u without its user name and password
+func withoutUser(u *url.URL) string {
+	bare := *u
+	bare.User = nil
+	return bare.String()
+}
+
+// certReloaders returns the client certificates of the brokers, each once
+func (p *pahoClient) certReloaders() []*certReloader {
+	var reloaders []*certReloader
+	for _, b := range p.brokers {
+		if b.certs != nil && !containsReloader(reloaders, b.certs) {
+			reloaders = append(reloaders, b.certs)
+		}
+	}
+	return reloaders
+}
+
+func containsReloader(list []*certReloader, r *certReloader) bool {
+	for _, v := range list {
+		if v == r {
+			return true
+		}
+	}
+	return false
+}
+
+// options builds the paho options; the Last Will carries the namespace in use when called
+func (p *pahoClient) options() *MQTT.ClientOptions {
+	opts := MQTT.NewClientOptions()
+	for _, b := range p.brokers {
+		// Credentials travel in the URL so each broker can have its own (credentials written
+		// into a configured URL are left as they are)
+		u, _ := url.Parse(b.url) // Checked by Config.Validate
+		if b.cfg.Username != "" && u.User == nil {
+			u.User = url.UserPassword(b.cfg.Username, b.cfg.Password)
+		}
+		opts.AddBroker(u.String())
+	}
+
+	opts.SetClientID(p.cfg.ClientID)
+	// Use CleanSession=true to avoid queued message backlog on server restart
+	opts.SetCleanSession(true)
+	// tune keepalive/ping timeouts
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetPingTimeout(10 * time.Second)
+
+	// Broker marks the server offline if the connection drops without a clean disconnect
+	if presenceTopic != "" {
+		opts.SetWill(wireTopic(presenceTopic), PresenceOffline, 1, true)
+	}
+
+	router := p.router
+	opts.SetDefaultPublishHandler(func(c MQTT.Client, m MQTT.Message) {
+		router.fallback(m.Topic(), m.Payload())
+	})
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectTimeout(5 * time.Second)
+
+	// Each broker gets its own TLS setup
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		b := p.broker(broker)
+		if b == nil {
+			noteConnectAttempt(withoutUser(broker))
+			return tlsCfg
+		}
+		noteConnectAttempt(b.url)
+		return b.tls
+	})
+	opts.SetConnectionLostHandler(func(c MQTT.Client, err error) {
+		noteConnectionLost(err)
+	})
+
+	// OnConnect handler — subscribes to every registered topic each time client connects
+	opts.OnConnect = func(c MQTT.Client) {
+		fmt.Printf("Session clean: %v, KeepAlive: %ds\n", opts.CleanSession, opts.KeepAlive)
+		onConnected(p)
+	}
+	return opts
+}
+
+// watchFailback returns to a higher-priority broker once it is reachable again. paho only
+// tries the brokers in order when it reconnects, so without this the server would stay on
+// a backup broker until that connection dropped.
+func (p *pahoClient) watchFailback(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !p.IsConnected() {
+			continue // paho is already trying the brokers in order
+		}
+		active := Status().Active
+		for _, b := range p.brokers {
+			if b.url == active {
+				break // Already on the best reachable broker
+			}
+			if err := probeBroker(b.url); err != nil {
+				continue
+			}
+			fmt.Printf("MQTT failback: %s is reachable again (on %s)\n", b.url, active)
+			p.reopen("failing back to " + b.url)
+			break
+		}
+	}
+}
+
+// Default ports by broker URL scheme, for probing brokers listed without one
+var defaultBrokerPorts = map[string]string{
+	"tcp": "1883", "mqtt": "1883", "ssl": "8883", "tls": "8883", "mqtts": "8883", "ws": "80", "wss": "443",
+}
+
+// probeBroker checks that a broker accepts TCP connections
+func probeBroker(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultBrokerPorts[u.Scheme])
+	}
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// conn returns the current paho connection (replaced by reopen)
+func (p *pahoClient) conn() MQTT.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mqtt
+}
+
+// reopen replaces the connection with one built from fresh options, e.g. so the Last Will
+// follows a namespace change (the broker only takes a will when connecting) or to go back
+// to the first broker. The old connection is closed cleanly, so its will is not published.
+func (p *pahoClient) reopen(reason string) {
+	p.mu.Lock()
+	old := p.mqtt
+	p.mqtt = MQTT.NewClient(p.options())
+	p.mu.Unlock()
+
+	fmt.Printf("Reconnecting to the broker: %s\n", reason)
+	old.Disconnect(250)
+	noteConnectionLost(errors.New("reconnecting: " + reason))
+	p.Connect()
+}
+
+func (p *pahoClient) Connect() error {
+	token := p.conn().Connect()
+	token.Wait()
+	// With connect retry enabled paho keeps trying in the background, so this isn't fatal
+	if token.Error() != nil {
+		log.Printf("MQTT connect error: %v\n", token.Error())
+	}
+	return nil
+}
+
+func (p *pahoClient) IsConnected() bool {
+	return p.conn().IsConnected()
+}
+
+func (p *pahoClient) Publish(topic string, qos byte, retained bool, payload []byte, timeout time.Duration) error {
+	token := p.conn().Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(timeout) {
+		return ErrPublishTimeout
+	}
+	return token.Error()
+}
+
+func (p *pahoClient) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	token := p.conn().Subscribe(filter, qos, func(c MQTT.Client, m MQTT.Message) {
+		handler(m.Topic(), m.Payload())
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (p *pahoClient) Unsubscribe(filter string) error {
+	token := p.conn().Unsubscribe(filter)
+	token.Wait()
+	return token.Error()
+}
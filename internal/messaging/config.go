@@ -0,0 +1,201 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Config selects the MQTT broker and how to authenticate to it
+// Zero values are filled from DefaultConfig, so an empty config keeps the local broker setup.
+type Config struct {
+	Brokers  []string `json:"brokers"`  // Broker URLs tried in order: tcp://, ssl://, ws:// or wss:// (mem://local = in-memory)
+	ClientID string   `json:"clientID"` // "" = go-server[-debug]-<hostname>
+	Username string   `json:"username"` // Optional broker credentials
+	Password string   `json:"password"`
+
+	TLS      *bool  `json:"tls"`      // nil = enabled
+	CAPath   string `json:"caPath"`   // "" with TLS = system roots
+	CertPath string `json:"certPath"` // Client certificate (mutual TLS); "" = none
+	KeyPath  string `json:"keyPath"`
+
+	PerBroker       map[string]BrokerSettings `json:"perBroker"`       // Overrides by broker URL (as listed in Brokers)
+	FailbackSeconds int                       `json:"failbackSeconds"` // While on a backup broker, how often to check for an earlier one (0 = 300, -1 = never)
+}
+
+// BrokerSettings overrides the credentials or TLS setup for one broker. Each group is
+// replaced whole: username or password replaces both, and any of tls, caPath, certPath
+// and keyPath replaces all four.
+type BrokerSettings struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TLS      *bool  `json:"tls"`
+	CAPath   string `json:"caPath"`
+	CertPath string `json:"certPath"`
+	KeyPath  string `json:"keyPath"`
+}
+
+// Default interval between checks for a higher-priority broker while on a backup
+const defaultFailbackSeconds = 300
+
+// DefaultConfig is the local broker with mutual TLS using ./certs
+func DefaultConfig(isDebug bool) Config {
+	hostname, _ := os.Hostname()
+	// include host in clientID to avoid collisions that cause broker to drop connections
+	clientID := "go-server-" + hostname
+	if isDebug {
+		clientID = "go-server-debug-" + hostname
+	}
+	tlsOn := true
+	return Config{
+		Brokers:  []string{"ssl://localhost:8883"},
+		ClientID: clientID,
+		TLS:      &tlsOn,
+		CAPath:   "./certs/ca.crt",
+		CertPath: "./certs/jbar_server.crt",
+		KeyPath:  "./certs/jbar_server.key",
+	}
+}
+
+// WithDefaults fills unset fields from DefaultConfig
+// Cert paths are only defaulted when TLS is left unset, so a configured TLS broker
+// without client certificates (e.g. username/password cloud broker) stays that way.
+func (c Config) WithDefaults(isDebug bool) Config {
+	def := DefaultConfig(isDebug)
+	if len(c.Brokers) == 0 {
+		c.Brokers = def.Brokers
+	}
+	if c.ClientID == "" {
+		c.ClientID = def.ClientID
+	}
+	if c.TLS == nil {
+		c.TLS = def.TLS
+		if c.CAPath == "" && c.CertPath == "" && c.KeyPath == "" {
+			c.CAPath, c.CertPath, c.KeyPath = def.CAPath, def.CertPath, def.KeyPath
+		}
+	}
+	return c
+}
+
+// ForBroker returns the config with the overrides for broker applied
+func (c Config) ForBroker(broker string) Config {
+	s, ok := c.PerBroker[broker]
+	if !ok {
+		return c
+	}
+	if s.Username != "" || s.Password != "" {
+		c.Username, c.Password = s.Username, s.Password
+	}
+	if s.TLS != nil || s.CAPath != "" || s.CertPath != "" || s.KeyPath != "" {
+		c.TLS, c.CAPath, c.CertPath, c.KeyPath = s.TLS, s.CAPath, s.CertPath, s.KeyPath
+	}
+	return c
+}
+
+// failbackInterval is how often to check for a higher-priority broker (0 = never)
+func (c Config) failbackInterval() time.Duration {
+	switch {
+	case c.FailbackSeconds < 0:
+		return 0
+	case c.FailbackSeconds == 0:
+		return defaultFailbackSeconds * time.Second
+	}
+	return time.Duration(c.FailbackSeconds) * time.Second
+}
+
+// Broker URL schemes paho can dial (ws/wss tunnel MQTT over WebSocket)
+var brokerSchemes = map[string]bool{
+	"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true, "ws": true, "wss": true,
+}
+
+// In-memory broker (mem://local) for running without a network broker
+const memScheme = "mem"
+
+// InMemory reports whether the config selects the in-memory broker
+func (c Config) InMemory() bool {
+	for _, broker := range c.Brokers {
+		if u, err := url.Parse(broker); err == nil && u.Scheme == memScheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the broker URLs
+func (c Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("no MQTT brokers configured")
+	}
+	for _, broker := range c.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid MQTT broker URL %q", broker)
+		}
+		if u.Scheme == memScheme && len(c.Brokers) > 1 {
+			return fmt.Errorf("in-memory broker %s can't be combined with other brokers", broker)
+		}
+		if !brokerSchemes[u.Scheme] && u.Scheme != memScheme {
+			return fmt.Errorf("unsupported MQTT broker scheme %q in %s", u.Scheme, broker)
+		}
+	}
+	for broker := range c.PerBroker {
+		if !containsString(c.Brokers, broker) {
+			return fmt.Errorf("perBroker entry %q is not one of the configured brokers", broker)
+		}
+	}
+	return nil
+}
+
+// TLSEnabled reports whether the connection uses TLS (default on)
+func (c Config) TLSEnabled() bool {
+	return c.TLS == nil || *c.TLS
+}
+
+// ClientTLSConfig is the TLS setup for the config's CA and client certificate, for other
+// connections than the server's own (e.g. a bridge to a cloud broker)
+func (c Config) ClientTLSConfig() (*tls.Config, error) {
+	tlsConfig, _, err := c.tlsConfig(nil)
+	return tlsConfig, err
+}
+
+// tlsConfig loads the CA and optional client certificate. The client certificate is
+// served from a reloader (nil without one) so it can be rotated while running; reloaders
+// (if not nil) holds those already created, by certificate and key path.
+func (c Config) tlsConfig(reloaders map[[2]string]*certReloader) (*tls.Config, *certReloader, error) {
+	tlsConfig := &tls.Config{
+		//InsecureSkipVerify: false, // enforce CN/SAN match
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.CAPath != "" {
+		caCert, err := os.ReadFile(c.CAPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CA cert: %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, nil, fmt.Errorf("failed to append CA cert from %s", c.CAPath)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	var certs *certReloader
+	if c.CertPath != "" || c.KeyPath != "" {
+		paths := [2]string{c.CertPath, c.KeyPath}
+		if certs = reloaders[paths]; certs == nil {
+			var err error
+			certs, err = newCertReloader(c.CertPath, c.KeyPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			if reloaders != nil {
+				reloaders[paths] = certs
+			}
+		}
+		tlsConfig.GetClientCertificate = certs.getClientCertificate
+	}
+	return tlsConfig, certs, nil
+}
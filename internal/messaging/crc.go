@@ -0,0 +1,68 @@
+package messaging
+
+import "fmt"
+
+// Protocol versions a device can report in its JSON bootup ("proto")
+const (
+	PROTOCOL_V1 = 1 // [type][len][payload]
+	PROTOCOL_V2 = 2 // [type][len][payload][crc8], CRC outside the length so the header is unchanged
+	PROTOCOL_V3 = 3 // v2 plus extended headers for payloads over 255 bytes (see EncodeExtended)
+	PROTOCOL_V4 = 4 // v3 plus signed forecast temperatures in 0x02 (see EncodeForecastFor)
+)
+
+// Resolves the lowest protocol version among the devices subscribed to a topic
+var protocolResolver func(topic string) uint8
+
+// SetProtocolResolver registers how PublishWithPolicy decides whether a topic gets CRC trailers
+func SetProtocolResolver(fn func(topic string) uint8) {
+	protocolResolver = fn
+}
+
+// CRC8 computes CRC-8/SMBUS (polynomial 0x07, init 0x00) over data
+func CRC8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// AppendCRC returns msg with its CRC-8 trailer (protocol v2)
+func AppendCRC(msg []byte) []byte {
+	out := make([]byte, len(msg)+1)
+	copy(out, msg)
+	out[len(msg)] = CRC8(msg)
+	return out
+}
+
+// CheckCRC validates the CRC trailer (exactly one byte past the payload) of a message from
+// a sender on protocol v2 or later. Messages from v1 senders carry no trailer and always pass.
+func CheckCRC(data []byte, protocol uint8) error {
+	if protocol < PROTOCOL_V2 {
+		return nil
+	}
+	_, length, headerLen, err := decodeHeader(data)
+	if err != nil || len(data) != headerLen+length+1 {
+		return nil
+	}
+	end := len(data) - 1
+	if want := CRC8(data[:end]); data[end] != want {
+		return fmt.Errorf("checksum mismatch: got 0x%02X, want 0x%02X", data[end], want)
+	}
+	return nil
+}
+
+// withProtocol adds the CRC trailer when every device on topic speaks protocol v2
+func withProtocol(topic string, data []byte) []byte {
+	if protocolResolver == nil || len(data) == 0 || protocolResolver(topic) < PROTOCOL_V2 {
+		return data
+	}
+	return AppendCRC(data)
+}
@@ -0,0 +1,62 @@
+package messaging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRC8(t *testing.T) {
+	// CRC-8/SMBUS check value
+	if got := CRC8([]byte("123456789")); got != 0xF4 {
+		t.Errorf("CRC8(123456789) = 0x%02X, want 0xF4", got)
+	}
+	msg := EncodeVersion(0x0102)
+	if got := AppendCRC(msg); !bytes.Equal(got[:len(msg)], msg) || got[len(msg)] != CRC8(msg) {
+		t.Errorf("AppendCRC: got % X", got)
+	}
+}
+
+// Only senders on protocol v2 or later have their trailers checked
+func TestCheckCRC(t *testing.T) {
+	msg := AppendCRC(EncodeIndicator(3, true))
+	corrupt := append([]byte(nil), msg...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+
+	if err := CheckCRC(msg, PROTOCOL_V2); err != nil {
+		t.Errorf("valid trailer: %v", err)
+	}
+	if err := CheckCRC(corrupt, PROTOCOL_V2); err == nil {
+		t.Error("corrupt trailer accepted from a v2 sender")
+	}
+	if err := CheckCRC(corrupt, PROTOCOL_V1); err != nil {
+		t.Errorf("v1 sender's extra byte checked: %v", err)
+	}
+	if err := CheckCRC(EncodeIndicator(3, true), PROTOCOL_V2); err != nil {
+		t.Errorf("message without trailer: %v", err)
+	}
+
+	if _, payload, err := DecodeMessageFrom(corrupt, PROTOCOL_V1); err != nil || !bytes.Equal(payload, []byte{3, 1}) {
+		t.Errorf("v1 decode: got % X (%v)", payload, err)
+	}
+	if _, _, err := DecodeMessageFrom(corrupt, PROTOCOL_V2); err == nil {
+		t.Error("DecodeMessageFrom accepted a corrupt v2 message")
+	}
+}
+
+func TestWithProtocol(t *testing.T) {
+	defer SetProtocolResolver(nil)
+	msg := EncodeVersion(7)
+
+	SetProtocolResolver(func(topic string) uint8 {
+		if topic == "v2" {
+			return PROTOCOL_V2
+		}
+		return PROTOCOL_V1
+	})
+	if got := withProtocol("v1", msg); !bytes.Equal(got, msg) {
+		t.Errorf("v1 topic: got % X, want % X", got, msg)
+	}
+	if got := withProtocol("v2", msg); !bytes.Equal(got, AppendCRC(msg)) {
+		t.Errorf("v2 topic: got % X, want a CRC trailer", got)
+	}
+}
@@ -0,0 +1,396 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Decoders for server → device messages. Each takes the payload returned by DecodeMessage,
+// so the server can validate and log its own output and simulated devices can read it.
+
+// DecodeCurrentWeather parses a 0x01 payload: [temp+50][flags (optional)]
+func DecodeCurrentWeather(payload []byte) (temp int8, flags uint8, err error) {
+	switch len(payload) {
+	case 1:
+	case 2:
+		flags = payload[1]
+	default:
+		return 0, 0, fmt.Errorf("current weather payload must be 1 or 2 bytes, got %d", len(payload))
+	}
+	return int8(payload[0] - 50), flags, nil
+}
+
+// DecodeCurrentWeatherV2 parses a 0x2E payload:
+// [temp+50][condition][humidity][wind_mph][wind_dir][flags (optional)]
+func DecodeCurrentWeatherV2(payload []byte) (w CurrentWeatherV2, flags uint8, err error) {
+	switch len(payload) {
+	case 5:
+	case 6:
+		flags = payload[5]
+	default:
+		return CurrentWeatherV2{}, 0, fmt.Errorf("current weather v2 payload must be 5 or 6 bytes, got %d", len(payload))
+	}
+	return CurrentWeatherV2{
+		Temp:      int8(payload[0] - 50),
+		Condition: payload[1],
+		Humidity:  payload[2],
+		WindSpeed: payload[3],
+		WindDir:   payload[4],
+	}, flags, nil
+}
+
+// Names of the WEATHER_COND_* codes for logs
+var conditionNames = map[uint8]string{
+	WEATHER_COND_UNKNOWN:       "unknown",
+	WEATHER_COND_CLEAR:         "clear",
+	WEATHER_COND_PARTLY_CLOUDY: "partly cloudy",
+	WEATHER_COND_CLOUDY:        "cloudy",
+	WEATHER_COND_DRIZZLE:       "drizzle",
+	WEATHER_COND_RAIN:          "rain",
+	WEATHER_COND_THUNDERSTORM:  "thunderstorm",
+	WEATHER_COND_SNOW:          "snow",
+	WEATHER_COND_FOG:           "fog",
+}
+
+// Names of the compass points returned by CompassPoint
+var compassNames = [16]string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// CompassName returns the abbreviation of a compass point (e.g. "NW"), "?" if out of range
+func CompassName(point uint8) string {
+	if int(point) < len(compassNames) {
+		return compassNames[point]
+	}
+	return "?"
+}
+
+// ConditionName returns a readable name for a WEATHER_COND_* code
+func ConditionName(code uint8) string {
+	if name, ok := conditionNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("condition %d", code)
+}
+
+// DecodeForecast parses a 0x02 payload: [numDays][day1][day2]...[flags (optional)]
+// Highs are read with the +50 offset when WEATHER_FLAG_SIGNED_TEMPS is set, which is
+// cleared from the returned flags.
+func DecodeForecast(payload []byte) (days []ForecastDay, flags uint8, err error) {
+	if len(payload) < 1 {
+		return nil, 0, fmt.Errorf("forecast payload too short: need at least 1 byte for day count")
+	}
+	numDays := int(payload[0])
+	need := 1 + numDays*3
+	switch len(payload) {
+	case need:
+	case need + 1:
+		flags = payload[need]
+	default:
+		return nil, 0, fmt.Errorf("forecast payload length %d doesn't match %d days", len(payload), numDays)
+	}
+
+	days = make([]ForecastDay, numDays)
+	for i := range days {
+		offset := 1 + i*3
+		high := int(payload[offset])
+		if flags&WEATHER_FLAG_SIGNED_TEMPS != 0 {
+			high -= 50
+		}
+		days[i] = ForecastDay{HighTemp: int8(high), Precip: payload[offset+1], Moon: payload[offset+2]}
+	}
+	return days, flags &^ WEATHER_FLAG_SIGNED_TEMPS, nil
+}
+
+// DecodeForecastV2 parses a 0x2F payload: [numDays]([high+50][low+50][precip][moon])...[flags (optional)]
+func DecodeForecastV2(payload []byte) (days []ForecastDayV2, flags uint8, err error) {
+	if len(payload) < 1 {
+		return nil, 0, fmt.Errorf("forecast v2 payload too short: need at least 1 byte for day count")
+	}
+	numDays := int(payload[0])
+	need := 1 + numDays*4
+	switch len(payload) {
+	case need:
+	case need + 1:
+		flags = payload[need]
+	default:
+		return nil, 0, fmt.Errorf("forecast v2 payload length %d doesn't match %d days", len(payload), numDays)
+	}
+
+	days = make([]ForecastDayV2, numDays)
+	for i := range days {
+		d := payload[1+i*4:]
+		days[i] = ForecastDayV2{HighTemp: int8(d[0] - 50), LowTemp: int8(d[1] - 50), Precip: d[2], Moon: d[3]}
+	}
+	return days, flags, nil
+}
+
+// DecodeWeatherUnavailable parses a 0x16 payload: [weather_type]
+func DecodeWeatherUnavailable(payload []byte) (uint8, error) {
+	if len(payload) != 1 {
+		return 0, fmt.Errorf("weather unavailable payload must be 1 byte, got %d", len(payload))
+	}
+	return payload[0], nil
+}
+
+// DecodeVersion parses a 0x10 payload: [version uint16 BE]
+func DecodeVersion(payload []byte) (uint16, error) {
+	if len(payload) != 2 {
+		return 0, fmt.Errorf("version payload must be 2 bytes, got %d", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload), nil
+}
+
+// DecodeIndicator parses a 0x13 payload: [indicator_id][state]
+func DecodeIndicator(payload []byte) (id uint8, on bool, err error) {
+	if len(payload) != 2 {
+		return 0, false, fmt.Errorf("indicator payload must be 2 bytes, got %d", len(payload))
+	}
+	return payload[0], payload[1] != 0, nil
+}
+
+// DecodeHouseholdSummary parses a 0x14 payload: [flags][online][doorsOpen][minTemp+50][maxTemp+50]
+func DecodeHouseholdSummary(payload []byte) (HouseholdSummary, error) {
+	if len(payload) != 5 {
+		return HouseholdSummary{}, fmt.Errorf("household summary payload must be 5 bytes, got %d", len(payload))
+	}
+	return HouseholdSummary{
+		HasTemps:      payload[0]&HOUSEHOLD_HAS_TEMPS != 0,
+		HasDoors:      payload[0]&HOUSEHOLD_HAS_DOORS != 0,
+		OnlineDevices: payload[1],
+		DoorsOpen:     payload[2],
+		MinIndoorTemp: int8(payload[3] - 50),
+		MaxIndoorTemp: int8(payload[4] - 50),
+	}, nil
+}
+
+// WeatherMood is a decoded 0x15 payload
+type WeatherMood struct {
+	R, G, B   uint8
+	Animation uint8
+	PeriodMs  int
+}
+
+// DecodeWeatherMood parses a 0x15 payload: [r][g][b][animation][period_ds]
+func DecodeWeatherMood(payload []byte) (WeatherMood, error) {
+	if len(payload) != 5 {
+		return WeatherMood{}, fmt.Errorf("weather mood payload must be 5 bytes, got %d", len(payload))
+	}
+	return WeatherMood{R: payload[0], G: payload[1], B: payload[2], Animation: payload[3], PeriodMs: int(payload[4]) * 100}, nil
+}
+
+// DecodeTime parses a 0x1A payload into the sent instant in the sent UTC offset
+func DecodeTime(payload []byte) (time.Time, error) {
+	if len(payload) != 6 {
+		return time.Time{}, fmt.Errorf("time payload must be 6 bytes, got %d", len(payload))
+	}
+	return decodeEpochOffset(payload), nil
+}
+
+// DecodeClockChange parses a 0x1C payload into the change instant in the new UTC offset
+func DecodeClockChange(payload []byte) (time.Time, error) {
+	if len(payload) != 6 {
+		return time.Time{}, fmt.Errorf("clock change payload must be 6 bytes, got %d", len(payload))
+	}
+	return decodeEpochOffset(payload), nil
+}
+
+// [epoch uint32 BE][utc_offset_minutes int16 BE]
+func decodeEpochOffset(payload []byte) time.Time {
+	epoch := int64(binary.BigEndian.Uint32(payload[0:4]))
+	offset := int(int16(binary.BigEndian.Uint16(payload[4:6]))) * 60
+	return time.Unix(epoch, 0).In(time.FixedZone("", offset))
+}
+
+// DecodeServerShutdown parses a 0x1E payload: [expected_downtime_seconds uint16 BE]
+func DecodeServerShutdown(payload []byte) (time.Duration, error) {
+	if len(payload) != 2 {
+		return 0, fmt.Errorf("server shutdown payload must be 2 bytes, got %d", len(payload))
+	}
+	return time.Duration(binary.BigEndian.Uint16(payload)) * time.Second, nil
+}
+
+// DecodeQuietHours parses a 0x2D payload: when quiet hours end, zero once they have ended
+func DecodeQuietHours(payload []byte) (time.Time, error) {
+	if len(payload) != 4 {
+		return time.Time{}, fmt.Errorf("quiet hours payload must be 4 bytes, got %d", len(payload))
+	}
+	epoch := binary.BigEndian.Uint32(payload)
+	if epoch == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(epoch), 0), nil
+}
+
+// DecodeConfigRead parses a 0x19 payload: [request_id hi][request_id lo]
+func DecodeConfigRead(payload []byte) (uint16, error) {
+	if len(payload) != 2 {
+		return 0, fmt.Errorf("config read payload must be 2 bytes, got %d", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload), nil
+}
+
+// Describe renders an encoded message as a one-line human-readable dump for logs
+func Describe(data []byte) string {
+	msgType, payload, err := DecodeMessage(data)
+	if err != nil {
+		return fmt.Sprintf("Decode error: %v", err)
+	}
+	detail, err := describePayload(msgType, payload)
+	if err != nil {
+		return fmt.Sprintf("Type: 0x%02X, PayloadLen: %d, Invalid: %v", msgType, len(payload), err)
+	}
+	if detail == "" {
+		return fmt.Sprintf("Type: 0x%02X, PayloadLen: %d", msgType, len(payload))
+	}
+	return fmt.Sprintf("Type: 0x%02X, %s", msgType, detail)
+}
+
+func describePayload(msgType uint8, payload []byte) (string, error) {
+	switch msgType {
+	case MSG_CURRENT_WEATHER:
+		temp, flags, err := DecodeCurrentWeather(payload)
+		return fmt.Sprintf("current weather %d°%s", temp, describeWeatherFlags(flags)), err
+	case MSG_CURRENT_WEATHER_V2:
+		w, flags, err := DecodeCurrentWeatherV2(payload)
+		humidity, wind := "humidity unknown", "wind unknown"
+		if w.Humidity != WEATHER_READING_UNKNOWN {
+			humidity = fmt.Sprintf("%d%% humidity", w.Humidity)
+		}
+		if w.WindSpeed != WEATHER_READING_UNKNOWN {
+			wind = fmt.Sprintf("wind %d mph %s", w.WindSpeed, CompassName(w.WindDir))
+		}
+		return fmt.Sprintf("current weather %d° %s, %s, %s%s", w.Temp, ConditionName(w.Condition), humidity, wind, describeWeatherFlags(flags)), err
+	case MSG_FORECAST_WEATHER:
+		days, flags, err := DecodeForecast(payload)
+		parts := make([]string, len(days))
+		for i, d := range days {
+			parts[i] = fmt.Sprintf("%d°/%d%%/moon %d", d.HighTemp, d.Precip, d.Moon)
+		}
+		return fmt.Sprintf("forecast [%s]%s", strings.Join(parts, ", "), describeWeatherFlags(flags)), err
+	case MSG_FORECAST_WEATHER_V2:
+		days, flags, err := DecodeForecastV2(payload)
+		parts := make([]string, len(days))
+		for i, d := range days {
+			parts[i] = fmt.Sprintf("%d°/%d°/%d%%/moon %d", d.HighTemp, d.LowTemp, d.Precip, d.Moon)
+		}
+		return fmt.Sprintf("forecast [%s]%s", strings.Join(parts, ", "), describeWeatherFlags(flags)), err
+	case MSG_DEVICE_CONFIG, MSG_CONFIG_DELTA:
+		strs, err := DecodeDeviceConfig(payload)
+		name := "config"
+		if msgType == MSG_CONFIG_DELTA {
+			name = "config delta"
+		}
+		// Keys only: configs carry secrets (Wi-Fi passwords, API keys) and this text ends up
+		// in logs, the traffic capture and the admin API
+		keys := make([]string, len(strs))
+		for i, str := range strs {
+			keys[i], _, _ = strings.Cut(str, "=")
+		}
+		return fmt.Sprintf("%s keys %q", name, keys), err
+	case MSG_VERSION:
+		version, err := DecodeVersion(payload)
+		return fmt.Sprintf("version %d", version), err
+	case MSG_INDICATOR:
+		id, on, err := DecodeIndicator(payload)
+		return fmt.Sprintf("indicator %d on=%v", id, on), err
+	case MSG_HOUSEHOLD_SUMMARY:
+		h, err := DecodeHouseholdSummary(payload)
+		return fmt.Sprintf("household summary %+v", h), err
+	case MSG_WEATHER_MOOD:
+		m, err := DecodeWeatherMood(payload)
+		return fmt.Sprintf("weather mood rgb(%d,%d,%d) animation %d period %dms", m.R, m.G, m.B, m.Animation, m.PeriodMs), err
+	case MSG_WEATHER_UNAVAILABLE:
+		weatherType, err := DecodeWeatherUnavailable(payload)
+		return fmt.Sprintf("weather 0x%02X unavailable", weatherType), err
+	case MSG_CONFIG_READ:
+		id, err := DecodeConfigRead(payload)
+		return fmt.Sprintf("config read id=%d", id), err
+	case MSG_REPLY:
+		r, err := DecodeReply(payload)
+		return fmt.Sprintf("reply to 0x%02X id=%d status=%d data=%d bytes", r.To, r.ID, r.Status, len(r.Data)), err
+	case MSG_TIME:
+		t, err := DecodeTime(payload)
+		return fmt.Sprintf("time %s", t.Format(time.RFC3339)), err
+	case MSG_CLOCK_CHANGE:
+		t, err := DecodeClockChange(payload)
+		return fmt.Sprintf("clock change at %s", t.Format(time.RFC3339)), err
+	case MSG_SERVER_SHUTDOWN:
+		downtime, err := DecodeServerShutdown(payload)
+		return fmt.Sprintf("server shutdown, back in %s", downtime), err
+	case MSG_QUIET_HOURS:
+		until, err := DecodeQuietHours(payload)
+		if until.IsZero() {
+			return "quiet hours ended", err
+		}
+		return fmt.Sprintf("quiet hours until %s", until.UTC().Format(time.RFC3339)), err
+	case MSG_ENCRYPTED:
+		return fmt.Sprintf("encrypted, %d bytes", len(payload)), nil
+	case MSG_SCREEN_CHUNK:
+		c, err := DecodeScreenChunk(payload)
+		return fmt.Sprintf("screen %d (%dx%d) chunk %d/%d, %d bytes", c.ScreenID, c.Width, c.Height, c.Index+1, c.Count, len(c.Data)), err
+	case MSG_NOTIFICATION:
+		priority, duration, text, err := DecodeNotification(payload)
+		return fmt.Sprintf("notification %q priority %d for %s", text, priority, duration), err
+	case MSG_TYPE_ETCH_PIXELS:
+		if len(payload) < 1 || len(payload) != 1+3*int(payload[0]) {
+			return fmt.Sprintf("pixel updates, %d bytes", len(payload)), fmt.Errorf("malformed pixel updates")
+		}
+		return fmt.Sprintf("pixel updates, %d", payload[0]), nil
+	case MSG_TYPE_ETCH_CLEAR:
+		return "canvas clear", nil
+	case MSG_TYPE_ETCH_UNDO:
+		return "canvas undo", nil
+	case MSG_TYPE_ETCH_SEQ_REPORT:
+		if len(payload) < 1 || len(payload) != 1+int(payload[0])+2 {
+			return fmt.Sprintf("sequence report, %d bytes", len(payload)), fmt.Errorf("malformed sequence report")
+		}
+		return fmt.Sprintf("sequence report from %s: seq=%d", payload[1:1+payload[0]], binary.BigEndian.Uint16(payload[1+payload[0]:])), nil
+	case MSG_TYPE_ETCH_PALETTE_FRAME:
+		if len(payload) != 130 {
+			return fmt.Sprintf("palette frame, %d bytes", len(payload)), fmt.Errorf("palette frame payload must be 130 bytes, got %d", len(payload))
+		}
+		return fmt.Sprintf("palette frame seq=%d", binary.BigEndian.Uint16(payload)), nil
+	case MSG_TYPE_ETCH_PALETTE_PIXELS:
+		if len(payload) < 1 || len(payload) != 1+3*int(payload[0]) {
+			return fmt.Sprintf("palette pixel updates, %d bytes", len(payload)), fmt.Errorf("malformed palette pixel updates")
+		}
+		return fmt.Sprintf("palette pixel updates, %d", payload[0]), nil
+	case MSG_TYPE_ETCH_FRAME_CHUNK:
+		if len(payload) < 6 {
+			return fmt.Sprintf("frame chunk, %d bytes", len(payload)), fmt.Errorf("frame chunk payload too short: %d bytes", len(payload))
+		}
+		return fmt.Sprintf("frame seq=%d (%dx%d) chunk %d/%d, %d bytes", binary.BigEndian.Uint16(payload), payload[2], payload[3], payload[4]+1, payload[5], len(payload)-6), nil
+	case MSG_TYPE_ETCH_RLE_FRAME:
+		if len(payload) < 5 {
+			return fmt.Sprintf("RLE frame, %d bytes", len(payload)), fmt.Errorf("RLE frame payload too short: %d bytes", len(payload))
+		}
+		return fmt.Sprintf("RLE frame seq=%d (%dx%d), %d runs", binary.BigEndian.Uint16(payload), payload[2], payload[3], len(payload)-4), nil
+	case MSG_GENERIC:
+		if len(payload) > 0 {
+			if c, found := channelByID(payload[0]); found {
+				values, err := c.decode(payload[1:])
+				return fmt.Sprintf("channel %s %v", c.Name, values), err
+			}
+		}
+		return fmt.Sprintf("generic, %d bytes", len(payload)), nil
+	}
+	return "", nil
+}
+
+func describeWeatherFlags(flags uint8) string {
+	var names []string
+	if flags&WEATHER_FLAG_STALE != 0 {
+		names = append(names, "stale")
+	}
+	if flags&WEATHER_FLAG_NEIGHBOR != 0 {
+		names = append(names, "neighbor")
+	}
+	if flags&WEATHER_FLAG_INTERPOLATED != 0 {
+		names = append(names, "interpolated")
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
@@ -0,0 +1,84 @@
+package messaging
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Golden vectors: exact bytes devices expect for known inputs
+var goldenVectors = []struct {
+	name string
+	got  []byte
+	want []byte
+}{
+	{"current weather", EncodeCurrentWeather(-5), []byte{0x01, 1, 45}},
+	{"current weather flagged", WithWeatherFlags(EncodeCurrentWeather(72), WEATHER_FLAG_STALE), []byte{0x01, 2, 122, 0x01}},
+	{"current weather v2", EncodeCurrentWeatherV2(CurrentWeatherV2{Temp: -5, Condition: WEATHER_COND_SNOW, Humidity: 85, WindSpeed: 12, WindDir: CompassPoint(315)}), []byte{0x2E, 5, 45, 0x07, 85, 12, 14}},
+	{"forecast", EncodeForecast([]ForecastDay{{80, 20, 3}, {75, 0, 4}}), []byte{0x02, 7, 2, 80, 20, 3, 75, 0, 4}},
+	{"forecast below zero", EncodeForecast([]ForecastDay{{-5, 10, 0}}), []byte{0x02, 4, 1, 0, 10, 0}},
+	{"forecast signed", EncodeForecastFor([]ForecastDay{{-5, 10, 0}, {80, 20, 3}}, WEATHER_FLAG_STALE, PROTOCOL_V4), []byte{0x02, 8, 2, 45, 10, 0, 130, 20, 3, 0x09}},
+	{"forecast v2", EncodeForecastV2([]ForecastDayV2{{-2, -15, 40, 0}, {28, 9, 0, 2}}), []byte{0x2F, 9, 2, 48, 35, 40, 0, 78, 59, 0, 2}},
+	{"version", EncodeVersion(0x0102), []byte{0x10, 2, 0x01, 0x02}},
+	{"indicator", EncodeIndicator(3, true), []byte{0x13, 2, 3, 1}},
+	{"weather unavailable", EncodeWeatherUnavailable(MSG_FORECAST_WEATHER), []byte{0x16, 1, 0x02}},
+	{"time", EncodeTime(time.Unix(1700000000, 0).In(time.FixedZone("", -6*3600))), []byte{0x1A, 6, 0x65, 0x53, 0xF1, 0x00, 0xFE, 0x98}},
+	{"server shutdown", EncodeServerShutdown(2 * time.Minute), []byte{0x1E, 2, 0, 120}},
+	{"quiet hours", EncodeQuietHours(time.Unix(1700000000, 0)), []byte{0x2D, 4, 0x65, 0x53, 0xF1, 0x00}},
+	{"quiet hours ended", EncodeQuietHours(time.Time{}), []byte{0x2D, 4, 0, 0, 0, 0}},
+}
+
+func TestGoldenVectors(t *testing.T) {
+	for _, v := range goldenVectors {
+		if !bytes.Equal(v.got, v.want) {
+			t.Errorf("%s: encoded % X, want % X", v.name, v.got, v.want)
+		}
+	}
+}
+
+// Every decoder reads back what its encoder wrote
+func TestRoundTrips(t *testing.T) {
+	_, payload, _ := DecodeMessage(EncodeCurrentWeather(-5))
+	if temp, flags, err := DecodeCurrentWeather(payload); err != nil || temp != -5 || flags != 0 {
+		t.Errorf("current weather round trip: got %d flags %d (%v)", temp, flags, err)
+	}
+	current := CurrentWeatherV2{Temp: 72, Condition: WEATHER_COND_PARTLY_CLOUDY, Humidity: WEATHER_READING_UNKNOWN, WindSpeed: 3, WindDir: CompassPoint(80)}
+	_, payload, _ = DecodeMessage(WithWeatherFlags(EncodeCurrentWeatherV2(current), WEATHER_FLAG_STALE))
+	if w, flags, err := DecodeCurrentWeatherV2(payload); err != nil || w != current || flags != WEATHER_FLAG_STALE {
+		t.Errorf("current weather v2 round trip: got %+v flags %d (%v)", w, flags, err)
+	}
+	forecast := []ForecastDay{{80, 20, 3}, {75, 0, 4}}
+	_, payload, _ = DecodeMessage(WithWeatherFlags(EncodeForecast(forecast), WEATHER_FLAG_NEIGHBOR))
+	if days, flags, err := DecodeForecast(payload); err != nil || len(days) != 2 || days[1] != forecast[1] || flags != WEATHER_FLAG_NEIGHBOR {
+		t.Errorf("forecast round trip: got %v flags %d (%v)", days, flags, err)
+	}
+	signed := []ForecastDay{{-12, 0, 1}, {3, 60, 2}}
+	_, payload, _ = DecodeMessage(EncodeForecastFor(signed, 0, PROTOCOL_V4))
+	if days, flags, err := DecodeForecast(payload); err != nil || len(days) != 2 || days[0] != signed[0] || flags != 0 {
+		t.Errorf("signed forecast round trip: got %v flags %d (%v)", days, flags, err)
+	}
+	forecastV2 := []ForecastDayV2{{-2, -15, 40, 0}, {28, 9, 0, 2}}
+	_, payload, _ = DecodeMessage(WithWeatherFlags(EncodeForecastV2(forecastV2), WEATHER_FLAG_STALE))
+	if days, flags, err := DecodeForecastV2(payload); err != nil || len(days) != 2 || days[0] != forecastV2[0] || flags != WEATHER_FLAG_STALE {
+		t.Errorf("forecast v2 round trip: got %v flags %d (%v)", days, flags, err)
+	}
+	_, payload, _ = DecodeMessage(EncodeVersion(513))
+	if version, err := DecodeVersion(payload); err != nil || version != 513 {
+		t.Errorf("version round trip: got %d (%v)", version, err)
+	}
+	summary := HouseholdSummary{OnlineDevices: 4, HasTemps: true, MinIndoorTemp: -3, MaxIndoorTemp: 24}
+	_, payload, _ = DecodeMessage(EncodeHouseholdSummary(summary))
+	if got, err := DecodeHouseholdSummary(payload); err != nil || got != summary {
+		t.Errorf("household summary round trip: got %+v (%v)", got, err)
+	}
+	at := time.Unix(1793512800, 0)
+	_, payload, _ = DecodeMessage(EncodeClockChange(at, -6*3600))
+	if got, err := DecodeClockChange(payload); err != nil || !got.Equal(at) {
+		t.Errorf("clock change round trip: got %v (%v)", got, err)
+	}
+	msg, _ := EncodeConfigPairs(map[string]string{"b": "2", "a": "1"})
+	_, payload, _ = DecodeMessage(msg)
+	if strs, err := DecodeDeviceConfig(payload); err != nil || len(strs) != 2 || strs[0] != "a=1" {
+		t.Errorf("config round trip: got %q (%v)", strs, err)
+	}
+}
@@ -0,0 +1,65 @@
+package messaging
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// AES-GCM envelope sizes
+const (
+	envelopeNonceSize = 12
+	envelopeTagSize   = 16
+	// Largest inner message (header included) that still fits in one envelope
+	MaxSealedMessage = MAX_PAYLOAD_SIZE - envelopeNonceSize - envelopeTagSize
+)
+
+// Seal wraps a complete message in an encrypted envelope for a device's pre-shared key:
+// [MSG_ENCRYPTED][len][nonce(12)][ciphertext][tag(16)]. The envelope type byte is
+// authenticated as associated data.
+func Seal(key []byte, msg []byte) ([]byte, error) {
+	if len(msg) > MaxSealedMessage {
+		return nil, fmt.Errorf("message too large to encrypt: %d bytes exceeds maximum of %d", len(msg), MaxSealedMessage)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, envelopeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	payload := gcm.Seal(nonce, nonce, msg, []byte{MSG_ENCRYPTED})
+
+	out := make([]byte, 2+len(payload))
+	out[0] = MSG_ENCRYPTED
+	out[1] = uint8(len(payload))
+	copy(out[2:], payload)
+	return out, nil
+}
+
+// Open decrypts a MSG_ENCRYPTED payload and returns the inner message
+func Open(key []byte, payload []byte) ([]byte, error) {
+	if len(payload) < envelopeNonceSize+envelopeTagSize {
+		return nil, fmt.Errorf("envelope too short: %d bytes", len(payload))
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := gcm.Open(nil, payload[:envelopeNonceSize], payload[envelopeNonceSize:], []byte{MSG_ENCRYPTED})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt envelope: %v", err)
+	}
+	return msg, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
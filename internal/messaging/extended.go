@@ -0,0 +1,77 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Extended header for payloads over 255 bytes (protocol v3):
+// [type | EXTENDED_FLAG][length hi][length lo][payload]
+// Message types stay below 0x80, so the flag bit never collides with a standard header.
+const (
+	EXTENDED_FLAG             = 0x80
+	MAX_EXTENDED_PAYLOAD_SIZE = 0xFFFF
+	standardHeaderLen         = 2
+	extendedHeaderLen         = 3
+)
+
+// EncodeFor frames a payload for a device speaking version: a standard header when it fits,
+// otherwise an extended header if the device supports protocol v3
+func EncodeFor(msgType uint8, payload []byte, version uint8) ([]byte, error) {
+	if len(payload) <= MAX_PAYLOAD_SIZE {
+		msg := make([]byte, standardHeaderLen+len(payload))
+		msg[0] = msgType
+		msg[1] = uint8(len(payload))
+		copy(msg[standardHeaderLen:], payload)
+		return msg, nil
+	}
+	if version < PROTOCOL_V3 {
+		return nil, fmt.Errorf("payload too large: %d bytes exceeds maximum of %d", len(payload), MAX_PAYLOAD_SIZE)
+	}
+	return EncodeExtended(msgType, payload)
+}
+
+// EncodeExtended frames a payload with the extended (2-byte length) header
+func EncodeExtended(msgType uint8, payload []byte) ([]byte, error) {
+	if msgType&EXTENDED_FLAG != 0 {
+		return nil, fmt.Errorf("message type 0x%02X collides with the extended flag", msgType)
+	}
+	if len(payload) > MAX_EXTENDED_PAYLOAD_SIZE {
+		return nil, fmt.Errorf("payload too large: %d bytes exceeds maximum of %d", len(payload), MAX_EXTENDED_PAYLOAD_SIZE)
+	}
+	msg := make([]byte, extendedHeaderLen+len(payload))
+	msg[0] = msgType | EXTENDED_FLAG
+	binary.BigEndian.PutUint16(msg[1:3], uint16(len(payload)))
+	copy(msg[extendedHeaderLen:], payload)
+	return msg, nil
+}
+
+// MaxPayloadFor returns the largest payload a device speaking version can receive
+func MaxPayloadFor(version uint8) int {
+	if version >= PROTOCOL_V3 {
+		return MAX_EXTENDED_PAYLOAD_SIZE
+	}
+	return MAX_PAYLOAD_SIZE
+}
+
+// decodeHeader returns the message type (flag cleared), payload length and header size
+func decodeHeader(data []byte) (msgType uint8, length int, headerLen int, err error) {
+	if len(data) < standardHeaderLen {
+		return 0, 0, 0, fmt.Errorf("message too short: got %d bytes, need at least %d", len(data), standardHeaderLen)
+	}
+	if data[0]&EXTENDED_FLAG == 0 {
+		return data[0], int(data[1]), standardHeaderLen, nil
+	}
+	if len(data) < extendedHeaderLen {
+		return 0, 0, 0, fmt.Errorf("extended message too short: got %d bytes, need at least %d", len(data), extendedHeaderLen)
+	}
+	return data[0] &^ EXTENDED_FLAG, int(binary.BigEndian.Uint16(data[1:3])), extendedHeaderLen, nil
+}
+
+// messageType returns the type of an encoded message whichever header it uses (0 if empty)
+func messageType(data []byte) uint8 {
+	if len(data) == 0 {
+		return 0
+	}
+	return data[0] &^ EXTENDED_FLAG
+}
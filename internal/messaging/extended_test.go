@@ -0,0 +1,50 @@
+package messaging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeFor(t *testing.T) {
+	short := bytes.Repeat([]byte{0xAB}, MAX_PAYLOAD_SIZE)
+	long := bytes.Repeat([]byte{0xCD}, 300)
+
+	msg, err := EncodeFor(MSG_GENERIC, short, PROTOCOL_V3)
+	if err != nil || msg[0] != MSG_GENERIC || msg[1] != MAX_PAYLOAD_SIZE || len(msg) != 2+len(short) {
+		t.Errorf("payload that fits: got header % X, %d bytes (%v)", msg[:2], len(msg), err)
+	}
+	if _, err := EncodeFor(MSG_GENERIC, long, PROTOCOL_V2); err == nil {
+		t.Error("300-byte payload encoded for a v2 device")
+	}
+	msg, err = EncodeFor(MSG_GENERIC, long, PROTOCOL_V3)
+	if err != nil || !bytes.Equal(msg[:3], []byte{MSG_GENERIC | EXTENDED_FLAG, 0x01, 0x2C}) || len(msg) != 3+len(long) {
+		t.Errorf("extended header: got % X, %d bytes (%v)", msg[:3], len(msg), err)
+	}
+}
+
+func TestExtendedRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte{1, 2, 3}, 200)
+	msg, err := EncodeExtended(MSG_GENERIC, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgType, got, err := DecodeMessage(msg)
+	if err != nil || msgType != MSG_GENERIC || !bytes.Equal(got, payload) {
+		t.Errorf("got type 0x%02X, %d bytes (%v)", msgType, len(got), err)
+	}
+	if _, _, err := DecodeMessageFrom(AppendCRC(msg), PROTOCOL_V3); err != nil {
+		t.Errorf("extended message with CRC trailer: %v", err)
+	}
+	if _, _, err := DecodeMessage(msg[:100]); err == nil {
+		t.Error("truncated extended message decoded")
+	}
+}
+
+func TestEncodeExtendedLimits(t *testing.T) {
+	if _, err := EncodeExtended(EXTENDED_FLAG|0x01, nil); err == nil {
+		t.Error("type with the extended flag set accepted")
+	}
+	if _, err := EncodeExtended(MSG_GENERIC, make([]byte, MAX_EXTENDED_PAYLOAD_SIZE+1)); err == nil {
+		t.Error("payload over the extended maximum accepted")
+	}
+}
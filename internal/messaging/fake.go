@@ -0,0 +1,180 @@
+package messaging
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// FakeMessage is a publish recorded by FakeClient
+type FakeMessage struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+}
+
+// FakeClient is an in-memory broker connection. Publishes are recorded and delivered back
+// to matching subscriptions (including retained messages for new subscribers), so the server
+// can run and be exercised without a live broker. Deliveries happen in order on a separate
+// goroutine, like a real broker's.
+type FakeClient struct {
+	mu        sync.Mutex
+	connected bool
+	subs      map[string]MessageHandler
+	retained  map[string][]byte
+	published []FakeMessage
+
+	// Unbounded delivery queue, so a handler that publishes can never block on a full buffer
+	pendingMu   sync.Mutex
+	pendingCond *sync.Cond
+	pending     []func()
+	closed      bool
+}
+
+// NewFakeClient creates a disconnected in-memory client
+func NewFakeClient() *FakeClient {
+	f := &FakeClient{
+		subs:     make(map[string]MessageHandler),
+		retained: make(map[string][]byte),
+	}
+	f.pendingCond = sync.NewCond(&f.pendingMu)
+	go f.deliverLoop()
+	return f
+}
+
+// Connect marks the client connected and runs the usual on-connect work
+func (f *FakeClient) Connect() error {
+	f.mu.Lock()
+	f.connected = true
+	f.mu.Unlock()
+	noteConnectAttempt(memScheme + "://local")
+	onConnected(f)
+	return nil
+}
+
+// Disconnect simulates losing the broker connection
+func (f *FakeClient) Disconnect() {
+	f.mu.Lock()
+	f.connected = false
+	f.mu.Unlock()
+	noteConnectionLost(errors.New("fake client disconnected"))
+}
+
+func (f *FakeClient) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *FakeClient) Publish(topic string, qos byte, retained bool, payload []byte, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.connected {
+		return ErrNotConnected
+	}
+	data := append([]byte(nil), payload...)
+	f.published = append(f.published, FakeMessage{Topic: topic, QoS: qos, Retained: retained, Payload: data})
+	if retained {
+		if len(data) == 0 {
+			delete(f.retained, topic)
+			return nil
+		}
+		f.retained[topic] = data
+	}
+	f.routeLocked(topic, data)
+	return nil
+}
+
+func (f *FakeClient) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.connected {
+		return ErrNotConnected
+	}
+	f.subs[filter] = handler
+	for topic, data := range f.retained {
+		if TopicMatches(filter, topic) {
+			topic, data := topic, data
+			f.enqueue(func() { handler(topic, data) })
+		}
+	}
+	return nil
+}
+
+func (f *FakeClient) Unsubscribe(filter string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, filter)
+	return nil
+}
+
+// Inject delivers a message as if a device had published it (not recorded as a publish)
+func (f *FakeClient) Inject(topic string, payload []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routeLocked(topic, append([]byte(nil), payload...))
+}
+
+// Published returns every publish recorded so far, oldest first
+func (f *FakeClient) Published() []FakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeMessage(nil), f.published...)
+}
+
+// Reset forgets recorded publishes and retained messages
+func (f *FakeClient) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = nil
+	f.retained = make(map[string][]byte)
+}
+
+// Close disconnects and stops the delivery goroutine; deliveries still queued are dropped
+func (f *FakeClient) Close() {
+	f.mu.Lock()
+	f.connected = false
+	f.mu.Unlock()
+	f.pendingMu.Lock()
+	f.closed = true
+	f.pending = nil
+	f.pendingMu.Unlock()
+	f.pendingCond.Broadcast()
+}
+
+// routeLocked queues delivery to every matching subscription. Caller holds f.mu.
+func (f *FakeClient) routeLocked(topic string, data []byte) {
+	for filter, handler := range f.subs {
+		if TopicMatches(filter, topic) {
+			handler := handler
+			f.enqueue(func() { handler(topic, data) })
+		}
+	}
+}
+
+func (f *FakeClient) enqueue(fn func()) {
+	f.pendingMu.Lock()
+	if !f.closed {
+		f.pending = append(f.pending, fn)
+	}
+	f.pendingMu.Unlock()
+	f.pendingCond.Signal()
+}
+
+func (f *FakeClient) deliverLoop() {
+	for {
+		f.pendingMu.Lock()
+		for len(f.pending) == 0 && !f.closed {
+			f.pendingCond.Wait()
+		}
+		if f.closed {
+			f.pendingMu.Unlock()
+			return
+		}
+		fn := f.pending[0]
+		f.pending = f.pending[1:]
+		f.pendingMu.Unlock()
+		fn()
+	}
+}
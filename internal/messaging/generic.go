@@ -0,0 +1,310 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Custom channels give MSG_GENERIC a structure declared in config.json, so firmware
+// extensions can receive their own data without changes to this package:
+//
+//	[channel_id][field values in schema order]
+//
+// Numbers are big-endian, optionally fixed point (value * scale); bools are one byte
+// (0/1); strings are [len][bytes].
+
+// Field types of a custom channel
+const (
+	FieldU8     = "u8"
+	FieldI8     = "i8"
+	FieldU16    = "u16"
+	FieldI16    = "i16"
+	FieldU32    = "u32"
+	FieldI32    = "i32"
+	FieldBool   = "bool"
+	FieldString = "string"
+)
+
+const defaultChannelStringLen = 32
+
+// ChannelField is one value of a custom channel message
+type ChannelField struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"`
+	Scale  float64 `json:"scale,omitempty"`  // Numbers: sent as round(value * scale), e.g. 10 for tenths
+	MaxLen int     `json:"maxLen,omitempty"` // Strings: longest accepted in bytes (default 32)
+}
+
+// Channel is a named custom data channel carried in MSG_GENERIC
+type Channel struct {
+	Name   string         `json:"name"`
+	ID     uint8          `json:"id"` // First payload byte; 1-255 (0 is left for unstructured data)
+	Fields []ChannelField `json:"fields"`
+}
+
+var (
+	channelsMu sync.RWMutex
+	channels   = make(map[string]Channel)
+)
+
+// size returns the most bytes a value of the field can take
+func (f ChannelField) size() int {
+	switch f.Type {
+	case FieldU8, FieldI8, FieldBool:
+		return 1
+	case FieldU16, FieldI16:
+		return 2
+	case FieldU32, FieldI32:
+		return 4
+	case FieldString:
+		return 1 + f.maxLen()
+	}
+	return 0
+}
+
+func (f ChannelField) maxLen() int {
+	if f.MaxLen > 0 {
+		return f.MaxLen
+	}
+	return defaultChannelStringLen
+}
+
+func (f ChannelField) scale() float64 {
+	if f.Scale > 0 {
+		return f.Scale
+	}
+	return 1
+}
+
+// numberRange returns the raw values a numeric field can hold
+func (f ChannelField) numberRange() (float64, float64) {
+	switch f.Type {
+	case FieldU8:
+		return 0, math.MaxUint8
+	case FieldI8:
+		return math.MinInt8, math.MaxInt8
+	case FieldU16:
+		return 0, math.MaxUint16
+	case FieldI16:
+		return math.MinInt16, math.MaxInt16
+	case FieldU32:
+		return 0, math.MaxUint32
+	}
+	return math.MinInt32, math.MaxInt32
+}
+
+// Validate checks a channel definition, including that its largest message fits a payload
+func (c Channel) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("channel requires a name")
+	}
+	if c.ID == 0 {
+		return fmt.Errorf("channel %s needs an id from 1 to 255", c.Name)
+	}
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("channel %s has no fields", c.Name)
+	}
+	names := make(map[string]bool)
+	size := 1
+	for _, f := range c.Fields {
+		if f.Name == "" || names[f.Name] {
+			return fmt.Errorf("channel %s: fields need unique names (%q)", c.Name, f.Name)
+		}
+		names[f.Name] = true
+		if f.size() == 0 {
+			return fmt.Errorf("channel %s field %s: unknown type %q", c.Name, f.Name, f.Type)
+		}
+		if f.Scale < 0 {
+			return fmt.Errorf("channel %s field %s: scale must be positive", c.Name, f.Name)
+		}
+		size += f.size()
+	}
+	if size > MAX_PAYLOAD_SIZE {
+		return fmt.Errorf("channel %s messages can reach %d bytes, maximum is %d", c.Name, size, MAX_PAYLOAD_SIZE)
+	}
+	return nil
+}
+
+// SetChannels replaces the custom channel definitions
+func SetChannels(list []Channel) error {
+	byName := make(map[string]Channel, len(list))
+	ids := make(map[uint8]string)
+	for _, c := range list {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if _, dup := byName[c.Name]; dup {
+			return fmt.Errorf("duplicate channel %s", c.Name)
+		}
+		if other, dup := ids[c.ID]; dup {
+			return fmt.Errorf("channels %s and %s share id %d", other, c.Name, c.ID)
+		}
+		byName[c.Name] = c
+		ids[c.ID] = c.Name
+	}
+
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+	channels = byName
+	return nil
+}
+
+// GetChannel returns a custom channel by name
+func GetChannel(name string) (Channel, bool) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	c, exists := channels[name]
+	return c, exists
+}
+
+// Channels returns all custom channels by name
+func Channels() []Channel {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	list := make([]Channel, 0, len(channels))
+	for _, c := range channels {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// EncodeChannel creates message: [0x00][len][channel_id][fields...] from values as decoded
+// from JSON (numbers as float64). Every field must be given, and nothing else.
+func EncodeChannel(c Channel, values map[string]interface{}) ([]byte, error) {
+	for name := range values {
+		known := false
+		for _, f := range c.Fields {
+			known = known || f.Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("channel %s has no field %s", c.Name, name)
+		}
+	}
+
+	payload := []byte{c.ID}
+	for _, f := range c.Fields {
+		v, given := values[f.Name]
+		if !given {
+			return nil, fmt.Errorf("channel %s: missing field %s", c.Name, f.Name)
+		}
+		var err error
+		if payload, err = appendField(payload, f, v); err != nil {
+			return nil, fmt.Errorf("channel %s field %s: %v", c.Name, f.Name, err)
+		}
+	}
+	return EncodeFor(MSG_GENERIC, payload, PROTOCOL_V1)
+}
+
+func appendField(b []byte, f ChannelField, v interface{}) ([]byte, error) {
+	switch f.Type {
+	case FieldBool:
+		on, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected true or false, got %v", v)
+		}
+		if on {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case FieldString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %v", v)
+		}
+		if len(s) > f.maxLen() {
+			return nil, fmt.Errorf("%d bytes, maximum is %d", len(s), f.maxLen())
+		}
+		return append(append(b, uint8(len(s))), s...), nil
+	}
+
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected a number, got %v", v)
+	}
+	raw := math.Round(n * f.scale())
+	lo, hi := f.numberRange()
+	if raw < lo || raw > hi || math.IsNaN(raw) {
+		return nil, fmt.Errorf("%v is out of range for %s (scale %v)", n, f.Type, f.scale())
+	}
+	switch f.size() {
+	case 1:
+		return append(b, uint8(int64(raw))), nil
+	case 2:
+		return binary.BigEndian.AppendUint16(b, uint16(int64(raw))), nil
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(int64(raw))), nil
+}
+
+// DecodeChannel parses a structured MSG_GENERIC payload; numbers come back scaled as float64
+func DecodeChannel(payload []byte) (Channel, map[string]interface{}, error) {
+	if len(payload) < 1 {
+		return Channel{}, nil, fmt.Errorf("generic payload is empty")
+	}
+	c, found := channelByID(payload[0])
+	if !found {
+		return Channel{}, nil, fmt.Errorf("unknown channel id %d", payload[0])
+	}
+	values, err := c.decode(payload[1:])
+	return c, values, err
+}
+
+// decode parses the field values following the channel id
+func (c Channel) decode(rest []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(c.Fields))
+	for _, f := range c.Fields {
+		size := f.size()
+		if f.Type == FieldString {
+			if len(rest) < 1 {
+				return values, fmt.Errorf("channel %s truncated at field %s", c.Name, f.Name)
+			}
+			size = 1 + int(rest[0])
+		}
+		if len(rest) < size {
+			return values, fmt.Errorf("channel %s truncated at field %s", c.Name, f.Name)
+		}
+		field := rest[:size]
+		rest = rest[size:]
+
+		var raw int64
+		switch f.Type {
+		case FieldBool:
+			values[f.Name] = field[0] != 0
+			continue
+		case FieldString:
+			values[f.Name] = string(field[1:])
+			continue
+		case FieldU8:
+			raw = int64(field[0])
+		case FieldI8:
+			raw = int64(int8(field[0]))
+		case FieldU16:
+			raw = int64(binary.BigEndian.Uint16(field))
+		case FieldI16:
+			raw = int64(int16(binary.BigEndian.Uint16(field)))
+		case FieldU32:
+			raw = int64(binary.BigEndian.Uint32(field))
+		case FieldI32:
+			raw = int64(int32(binary.BigEndian.Uint32(field)))
+		}
+		values[f.Name] = float64(raw) / f.scale()
+	}
+	if len(rest) > 0 {
+		return values, fmt.Errorf("channel %s has %d unexpected trailing bytes", c.Name, len(rest))
+	}
+	return values, nil
+}
+
+func channelByID(id uint8) (Channel, bool) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	for _, c := range channels {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return Channel{}, false
+}
@@ -0,0 +1,20 @@
+package messaging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelRoundTrip(t *testing.T) {
+	plant := Channel{Name: "plant", ID: 9, Fields: []ChannelField{
+		{Name: "moisture", Type: FieldU8}, {Name: "temp", Type: FieldI16, Scale: 10},
+		{Name: "pump", Type: FieldBool}, {Name: "label", Type: FieldString}}}
+	msg, err := EncodeChannel(plant, map[string]interface{}{"moisture": 41.0, "temp": -3.5, "pump": true, "label": "basil"})
+	if err != nil || !bytes.Equal(msg[:7], []byte{MSG_GENERIC, 11, 9, 41, 0xFF, 0xDD, 1}) {
+		t.Fatalf("channel encoding: got % X (%v)", msg, err)
+	}
+	_, payload, _ := DecodeMessage(msg)
+	if values, err := plant.decode(payload[1:]); err != nil || values["temp"] != -3.5 || values["pump"] != true || values["label"] != "basil" {
+		t.Errorf("channel round trip: got %v (%v)", values, err)
+	}
+}
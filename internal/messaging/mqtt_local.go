@@ -1,195 +1,134 @@
 package messaging
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"server_app/internal/faults"
 	"time"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
-var client MQTT.Client
-
-func Create_client(handler MQTT.MessageHandler, initialTopics []string, isDebug bool) {
-	fmt.Println("Starting create client")
-	// Use local broker on the same machine
-	broker := "ssl://localhost:8883"
-	fmt.Printf("Using MQTT broker: %s\n", broker)
-	// include host in clientID to avoid collisions that cause broker to drop connections
-	hostname, _ := os.Hostname()
-
-	// Build clientID based on debug build flag
-	var clientID string
-	if isDebug {
-		clientID = "go-server-debug-" + hostname
-	} else {
-		clientID = "go-server-" + hostname
-	}
-	fmt.Printf("MQTT client ID: %s\n", clientID)
-
-	caPath := "./certs/ca.crt"
-	certPath := "./certs/jbar_server.crt"
-	keyPath := "./certs/jbar_server.key"
-
-	// Load CA cert
-	caCert, err := os.ReadFile(caPath)
-	if err != nil {
-		log.Fatalf("Failed to read CA cert: %v", err)
-	}
-	caPool := x509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(caCert) {
-		log.Fatalf("Failed to append CA cert")
-	}
-
-	// Load client cert/key
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		log.Fatalf("Failed to load client certificate/key: %v", err)
-	}
-
-	tlsConfig := &tls.Config{
-		RootCAs:      caPool,
-		Certificates: []tls.Certificate{cert},
-		//InsecureSkipVerify: false, // enforce CN/SAN match
-		MinVersion: tls.VersionTLS12,
-	}
+// Called after every message handed to the broker (for usage accounting)
+var publishHook func(topic string, size int)
 
-	// set protocol, ip, and port of broker
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	// Use CleanSession=true to avoid queued message backlog on server restart
-	opts.SetCleanSession(true)
-	// tune keepalive/ping timeouts
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
-
-	opts.SetTLSConfig(tlsConfig)
-	opts.SetDefaultPublishHandler(handler)
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetConnectTimeout(5 * time.Second)
-
-	// OnConnect handler — subscribes to topics every time client connects
-	opts.OnConnect = func(c MQTT.Client) {
-		fmt.Println("Connected to MQTT broker, subscribing to topics...")
-		fmt.Printf("Session clean: %v, KeepAlive: %s\n", opts.CleanSession, opts.KeepAlive)
-
-		for _, topic := range initialTopics {
-			fmt.Printf("Attempting to subscribe to %s\n", topic)
-			if token := c.Subscribe(topic, 1, handler); token.Wait() && token.Error() != nil {
-				log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
-			} else {
-				fmt.Printf("Subscribed to %s\n", topic)
-			}
-		}
-	}
+// OnPublish registers a callback run after each successful publish
+func OnPublish(fn func(topic string, size int)) {
+	publishHook = fn
+}
 
-	client = MQTT.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("MQTT connect error: %v\n", token.Error())
-		return
+func notePublish(topic string, data []byte) {
+	if publishHook != nil {
+		publishHook(topic, len(data))
 	}
 }
 
 // PublishQoS0 publishes a message with QoS 0 (fire-and-forget)
 // Used for high-frequency messages like weather and shared view updates
 func PublishQoS0(topic string, data []byte) {
-	// Decode and log message details for debugging
-	msgType, payload, err := DecodeMessage(data)
-	if err == nil {
-		fmt.Printf("Publishing to %s (QoS 0) — Type: 0x%02X, PayloadLen: %d\n", topic, msgType, len(payload))
-	} else {
-		fmt.Printf("Publishing to %s (QoS 0) — Decode error: %v\n", topic, err)
-	}
-	if client == nil || !client.IsConnected() {
-		log.Printf("MQTT client not connected; skipping publish to %s", topic)
-		return
-	}
-	token := client.Publish(topic, 0, false, data)
-	if !token.WaitTimeout(5 * time.Second) {
-		log.Printf("Publish timeout to %s (QoS 0)", topic)
-	}
-	if token.Error() != nil {
-		log.Printf("Publish error: %v", token.Error())
-	}
+	publish(topic, 0, false, data, 5*time.Second)
 }
 
 // PublishQoS1 publishes a message with QoS 1 (at least once delivery)
 // Used for critical messages like version updates and device-specific messages
 func PublishQoS1(topic string, data []byte) {
+	publish(topic, 1, false, data, 15*time.Second)
+}
+
+// publish sends data through the active client and reports whether the broker accepted it
+func publish(topic string, qos byte, retained bool, data []byte, timeout time.Duration) bool {
+	return publishVia(client, topic, qos, retained, data, timeout)
+}
+
+// publishVia sends data through c and reports whether the broker accepted it
+func publishVia(c Client, topic string, qos byte, retained bool, data []byte, timeout time.Duration) bool {
 	// Decode and log message details for debugging
-	msgType, payload, err := DecodeMessage(data)
-	if err == nil {
-		fmt.Printf("Publishing to %s (QoS 1) — Type: 0x%02X, PayloadLen: %d\n", topic, msgType, len(payload))
+	if retained && len(data) == 0 {
+		fmt.Printf("Clearing retained message on %s\n", topic)
 	} else {
-		fmt.Printf("Publishing to %s (QoS 1) — Decode error: %v\n", topic, err)
+		fmt.Printf("Publishing to %s (QoS %d) — %s\n", topic, qos, Describe(data))
 	}
-	if client == nil || !client.IsConnected() {
-		log.Printf("MQTT client not connected; skipping publish to %s", topic)
-		return
+	if c == nil || !c.IsConnected() {
+		enqueue(QueuedMessage{Topic: topic, QoS: qos, Retained: retained, Data: data, Queued: time.Now()})
+		return false
 	}
-	token := client.Publish(topic, 1, false, data)
-	if !token.WaitTimeout(15 * time.Second) {
-		log.Printf("Publish timeout to %s (QoS 1)", topic)
+	if holdForReplay(QueuedMessage{Topic: topic, QoS: qos, Retained: retained, Data: data, Queued: time.Now()}) {
+		return false
 	}
-	if token.Error() != nil {
-		log.Printf("Publish error: %v", token.Error())
+	return send(c, topic, qos, retained, data, timeout)
+}
+
+// send hands data to the connected client c
+func send(c Client, topic string, qos byte, retained bool, data []byte, timeout time.Duration) bool {
+	if faults.DropPublish() {
+		log.Printf("Fault injection: dropping publish to %s (QoS %d)", topic, qos)
+		return false
+	}
+	if retained {
+		unlock := lockRetained(topic)
+		defer unlock()
+	}
+	// One namespace read for both copies, so a switch can't send them to a mix
+	current, previous, dual := TopicNamespace()
+	if dual && relayedTopic(topic) {
+		// Sent under both namespaces below, so the copies coming back are not relayed
+		noteRelayEcho(current+topic, data, true)
+		noteRelayEcho(previous+topic, data, true)
+	}
+	start := time.Now()
+	if err := c.Publish(current+topic, qos, retained, data, timeout); err != nil {
+		if errors.Is(err, ErrPublishTimeout) {
+			log.Printf("Publish timeout to %s (QoS %d)", topic, qos)
+		} else {
+			log.Printf("Publish error: %v", err)
+		}
+		return false
+	}
+	// QoS 0 returns once written, so only acknowledged publishes measure the broker round trip
+	if qos > 0 {
+		noteRTT(time.Since(start))
+	}
+	// Devices still on the previous namespace get a copy during a topic migration
+	if dual {
+		if err := c.Publish(previous+topic, qos, retained, data, timeout); err != nil {
+			log.Printf("Publish error (previous namespace %q): %v", previous, err)
+		}
 	}
+	if retained {
+		noteRetained(topic, data)
+	}
+	noteSent(topic, retained, data)
+	notePublish(topic, data)
+	return true
 }
 
-// Publish publishes a message with default QoS 1
-// Deprecated: use PublishQoS0 or PublishQoS1 instead
+// Publish publishes a message according to the topic policy table
+// Deprecated: use PublishWithPolicy instead
 func Publish(topic string, data []byte) {
-	PublishQoS1(topic, data)
+	PublishWithPolicy(topic, data)
 }
 
 // PublishRetained publishes a message with the retained flag set and QoS 1
 // Useful for last weather state so ESP32 devices get it immediately on connect
 func PublishRetained(topic string, data []byte) {
-	fmt.Printf("Publishing retained to %s (QoS 1)\n", topic)
-	if client == nil || !client.IsConnected() {
-		log.Printf("MQTT client not connected; skipping publish to %s", topic)
-		return
-	}
-	token := client.Publish(topic, 1, true, data)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Publish error: %v", token.Error())
-	}
+	publish(topic, 1, true, data, publishTimeout(1))
+}
+
+// PublishRaw publishes data as given, bypassing topic policies, and reports whether the
+// broker accepted it (it is queued while disconnected)
+func PublishRaw(topic string, qos byte, retained bool, data []byte) bool {
+	return publish(topic, qos, retained, data, publishTimeout(qos))
 }
 
 // DecodeAndLogMessage decodes binary protocol messages
 func DecodeAndLogMessage(data []byte) {
-	msgType, payload, err := DecodeMessage(data)
-	if err != nil {
+	if _, _, err := DecodeMessage(data); err != nil {
 		log.Printf("Error decoding message: %v", err)
 		return
 	}
-	fmt.Printf("Decoded message - Type: 0x%02X, Payload length: %d\n", msgType, len(payload))
-}
-
-func Subscribe(topic string, handler MQTT.MessageHandler) {
-	if client == nil || !client.IsConnected() {
-		log.Printf("MQTT client not connected; skipping subscribe to %s", topic)
-		return
-	}
-	fmt.Printf("Attempting to subscribe to %s\n", topic)
-	token := client.Subscribe(topic, 1, handler)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Subscribe error to %s: %v", topic, token.Error())
-	} else {
-		fmt.Printf("Subscribed to %s\n", topic)
-	}
+	fmt.Printf("Decoded message - %s\n", Describe(data))
 }
 
-// GetClient returns the MQTT client instance
-func GetClient() MQTT.Client {
+// GetClient returns the active client (nil before Connect)
+func GetClient() Client {
 	return client
 }
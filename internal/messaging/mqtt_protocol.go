@@ -3,6 +3,8 @@ package messaging
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
+	"time"
 )
 
 // Message Types
@@ -12,11 +14,93 @@ const (
 	MSG_FORECAST_WEATHER = 0x02
 	MSG_DEVICE_CONFIG    = 0x03
 	MSG_VERSION          = 0x10
+	MSG_HEARTBEAT        = 0x11
+	// Device telemetry: same string-list payload as MSG_DEVICE_CONFIG
+	// [numStrings][device_name]["metric=value"]...
+	MSG_TELEMETRY = 0x12
+	// Server turns a display indicator (icon) on or off: [indicator_id][state]
+	MSG_INDICATOR = 0x13
+	// Household summary for hub displays: [flags][online][doors_open][min_temp+50][max_temp+50]
+	MSG_HOUSEHOLD_SUMMARY = 0x14
+	// Ambient light suggestion for edge-lit devices: [r][g][b][animation][period in 100ms units]
+	MSG_WEATHER_MOOD = 0x15
+	// Weather of the given type (0x01 current, 0x02 forecast) is unavailable: [weather_type]
+	// Devices should show a dash instead of the last value.
+	MSG_WEATHER_UNAVAILABLE = 0x16
+	// Changed config keys only, same string-list payload as MSG_DEVICE_CONFIG
+	// "key=value" sets a key, "key=" deletes it; keys not listed are left alone
+	MSG_CONFIG_DELTA = 0x17
+	// Device reply on its outbox topic: [reply_to_type][request_id hi][request_id lo][status][data...]
+	// Messages without a request id (e.g. 0x03 config) are acknowledged with request_id 0
+	MSG_REPLY = 0x18
+	// Server asks a device for the config it holds: [request_id hi][request_id lo]
+	// Answered with MSG_REPLY carrying the MSG_DEVICE_CONFIG string-list payload as data
+	MSG_CONFIG_READ = 0x19
+	// Current time for devices without NTP access: [epoch uint32 BE][utc_offset_minutes int16 BE]
+	MSG_TIME = 0x1A
+	// Device asks for MSG_TIME on its topic: [name_len][name] (same payload as heartbeat)
+	MSG_TIME_REQUEST = 0x1B
+	// Upcoming UTC offset change (DST): [at epoch uint32 BE][new_utc_offset_minutes int16 BE]
+	MSG_CLOCK_CHANGE = 0x1C
+	// AES-GCM envelope around a complete message, keyed per device: [nonce(12)][ciphertext][tag(16)]
+	MSG_ENCRYPTED = 0x1D
+	// Server is going down for a planned restart: [expected_downtime_seconds uint16 BE]
+	// Devices should back off reconnecting and not report "server lost" within that window.
+	MSG_SERVER_SHUTDOWN = 0x1E
 	// Etch Sketch shared canvas messages
 	// Device requests the current full frame
 	MSG_TYPE_ETCH_GET_FRAME = 0x20
 	// Device publishes a full frame update
 	MSG_TYPE_ETCH_UPDATE_FRAME = 0x21
+	// Server sends a full frame corrected for the device's panel to its personal topic
+	// [seq][red[16]][green[16]][blue[16]][red_level][green_level][blue_level]
+	MSG_TYPE_ETCH_CALIBRATED_FRAME = 0x22
+	// Piece of a 1-bit screen image for e-paper displays (see EncodeScreenChunks)
+	// [screen_id uint16 BE][width uint16 BE][height uint16 BE][chunk_index][chunk_count][bitmap bytes]
+	MSG_SCREEN_CHUNK = 0x23
+	// Display notification chosen by the server's arbitration (see EncodeNotification)
+	// [priority][duration_seconds uint16 BE][text]
+	MSG_NOTIFICATION = 0x24
+	// Device edits single pixels on the shared canvas: [count]([x][y][op<<4 | color])*count
+	// op 0 = set, 1 = clear, 2 = toggle; color bits 1 = red, 2 = green, 4 = blue (see EncodePixelUpdates)
+	// The server applies them and broadcasts the resulting full frame
+	MSG_TYPE_ETCH_PIXELS = 0x25
+	// Device asks for the shared canvas to be cleared (empty payload); the server broadcasts a blank frame
+	MSG_TYPE_ETCH_CLEAR = 0x26
+	// 16-color canvas frame, two 4-bit palette indexes per byte (high nibble = even column)
+	// [seq][indexes[128]]; sent to devices with the palette16 capability on their own topic,
+	// and published by them on the shared topic (the server broadcasts the 1-bit reduction)
+	MSG_TYPE_ETCH_PALETTE_FRAME = 0x27
+	// Palette device sets single pixels to palette indexes: [count]([x][y][index])*count
+	MSG_TYPE_ETCH_PALETTE_PIXELS = 0x28
+	// Piece of a whole frame of a canvas larger than 16x16 (see EncodeFrameChunks), sent after
+	// the 16x16 frame on the shared topic: [seq uint16 BE][width][height][chunk_index][chunk_count][data]
+	// The data of all chunks is the red, green and blue bitsets in turn, pixel (x, y) at bit
+	// y*width+x, least significant bit first
+	MSG_TYPE_ETCH_FRAME_CHUNK = 0x29
+	// Device asks for the last canvas change to be undone (empty payload); the server
+	// broadcasts the restored frame
+	MSG_TYPE_ETCH_UNDO = 0x2A
+	// Device reports the sequence number of the frame it shows, after reconnecting or when
+	// the frames it gets skip a number: [name_len][name][seq uint16 BE]
+	// A device that is behind gets the current frame on its own topic
+	MSG_TYPE_ETCH_SEQ_REPORT = 0x2B
+	// Whole canvas frame as pixel runs in row-major order (see EncodeRLEFrame):
+	// [seq uint16 BE][width][height][runs], each run byte (count-1)<<3 | color bits
+	// Sent to devices with the rle capability on their own topic when it fits in one message
+	// (everyone else gets the raw frame and chunks); devices may publish it on the shared topic
+	MSG_TYPE_ETCH_RLE_FRAME = 0x2C
+	// Device's quiet hours began or ended: [until epoch uint32 BE], 0 = ended
+	// While quiet, ignore weather and canvas updates on shared topics; what changed is sent
+	// to the device's own topic when the window ends
+	MSG_QUIET_HOURS = 0x2D
+	// Current weather for devices with the weather_v2 capability, sent instead of 0x01:
+	// [temp+50][condition][humidity %][wind mph][wind direction][flags (optional)]
+	// (see WEATHER_COND_* and CompassPoint)
+	MSG_CURRENT_WEATHER_V2 = 0x2E
+	// Forecast for devices with the forecast_v2 capability, sent instead of 0x02:
+	// [numDays]([high+50][low+50][precip][moon])*numDays[flags (optional)]
+	MSG_FORECAST_WEATHER_V2 = 0x2F
 )
 
 // Protocol constraints for ESP32 compatibility
@@ -24,9 +108,75 @@ const (
 	MAX_PAYLOAD_SIZE = 255 // Maximum payload size (1-byte length field: 0-255)
 )
 
+// Weather quality flags, sent as an optional trailing payload byte on 0x01/0x02/0x2E/0x2F messages
+// (omitted for fresh data so older firmware sees an unchanged message)
+const (
+	WEATHER_FLAG_STALE        = 0x01 // Cached data older than its validity period
+	WEATHER_FLAG_NEIGHBOR     = 0x02 // Data from a nearby zipcode
+	WEATHER_FLAG_INTERPOLATED = 0x04 // Estimated between fetches from the forecast curve
+	// Not a quality flag: 0x02 temperatures carry the +50 offset (protocol v4), so
+	// sub-zero highs can be sent. Decoders apply and clear it.
+	WEATHER_FLAG_SIGNED_TEMPS = 0x08
+)
+
+// Weather condition codes in MSG_CURRENT_WEATHER_V2, for devices that show an icon
+const (
+	WEATHER_COND_UNKNOWN       = 0x00
+	WEATHER_COND_CLEAR         = 0x01
+	WEATHER_COND_PARTLY_CLOUDY = 0x02 // Few or scattered clouds
+	WEATHER_COND_CLOUDY        = 0x03 // Broken clouds or overcast
+	WEATHER_COND_DRIZZLE       = 0x04
+	WEATHER_COND_RAIN          = 0x05
+	WEATHER_COND_THUNDERSTORM  = 0x06
+	WEATHER_COND_SNOW          = 0x07 // Including sleet and freezing rain
+	WEATHER_COND_FOG           = 0x08 // Mist, haze, smoke, dust and other obscured sky
+)
+
+// Humidity or wind byte of MSG_CURRENT_WEATHER_V2 when the provider didn't report it
+const WEATHER_READING_UNKNOWN = 0xFF
+
+// Reply status codes
+const (
+	REPLY_OK          = 0x00
+	REPLY_ERROR       = 0x01
+	REPLY_UNSUPPORTED = 0x02 // Device firmware does not handle the request type
+)
+
+// Reply is a decoded MSG_REPLY payload
+type Reply struct {
+	To     uint8  // Message type being answered
+	ID     uint16 // Request id (0 for message types that carry none)
+	Status uint8
+	Data   []byte
+}
+
+// Household summary flags
+const (
+	HOUSEHOLD_HAS_TEMPS = 0x01 // min/max indoor temp bytes are valid
+	HOUSEHOLD_HAS_DOORS = 0x02 // doors_open byte is valid
+)
+
+// HouseholdSummary is the aggregate state shown on hub displays
+type HouseholdSummary struct {
+	OnlineDevices uint8
+	HasTemps      bool
+	MinIndoorTemp int8
+	MaxIndoorTemp int8
+	HasDoors      bool
+	DoorsOpen     uint8
+}
+
 // ForecastDay represents a single day forecast with weather data
 type ForecastDay struct {
-	HighTemp uint8
+	HighTemp int8
+	Precip   uint8
+	Moon     uint8
+}
+
+// ForecastDayV2 is one day of MSG_FORECAST_WEATHER_V2, with signed temperatures
+type ForecastDayV2 struct {
+	HighTemp int8
+	LowTemp  int8 // Overnight low
 	Precip   uint8
 	Moon     uint8
 }
@@ -40,8 +190,56 @@ func EncodeCurrentWeather(temp int8) []byte {
 	return msg
 }
 
+// CurrentWeatherV2 is the current weather carried in MSG_CURRENT_WEATHER_V2
+type CurrentWeatherV2 struct {
+	Temp      int8
+	Condition uint8 // WEATHER_COND_*
+	Humidity  uint8 // Percent, WEATHER_READING_UNKNOWN if not reported
+	WindSpeed uint8 // mph (at most 254), WEATHER_READING_UNKNOWN if not reported
+	WindDir   uint8 // Compass point the wind blows from, WEATHER_READING_UNKNOWN if not reported
+}
+
+// EncodeCurrentWeatherV2 creates message: [type][len][temp+50][condition][humidity][wind_mph][wind_dir]
+func EncodeCurrentWeatherV2(w CurrentWeatherV2) []byte {
+	return []byte{MSG_CURRENT_WEATHER_V2, 5, uint8(w.Temp + 50), w.Condition, w.Humidity, w.WindSpeed, w.WindDir}
+}
+
+// CompassPoint maps a direction in degrees clockwise from north to one of 16 compass
+// points: 0 = N, 1 = NNE, 2 = NE ... 4 = E ... 8 = S ... 12 = W ... 15 = NNW
+func CompassPoint(deg int) uint8 {
+	deg = (deg%360 + 360) % 360
+	return uint8((deg*16 + 180) / 360 % 16)
+}
+
+// WeatherConditionCode maps an OpenWeather condition ID (https://openweathermap.org/weather-conditions)
+// to a WEATHER_COND_* code
+func WeatherConditionCode(id int) uint8 {
+	switch {
+	case id >= 200 && id < 300:
+		return WEATHER_COND_THUNDERSTORM
+	case id >= 300 && id < 400:
+		return WEATHER_COND_DRIZZLE
+	case id == 511: // Freezing rain
+		return WEATHER_COND_SNOW
+	case id >= 500 && id < 600:
+		return WEATHER_COND_RAIN
+	case id >= 600 && id < 700:
+		return WEATHER_COND_SNOW
+	case id >= 700 && id < 800:
+		return WEATHER_COND_FOG
+	case id == 800:
+		return WEATHER_COND_CLEAR
+	case id == 801 || id == 802:
+		return WEATHER_COND_PARTLY_CLOUDY
+	case id == 803 || id == 804:
+		return WEATHER_COND_CLOUDY
+	}
+	return WEATHER_COND_UNKNOWN
+}
+
 // EncodeForecast creates message: [type][len][numDays][day1][day2]...
 // Each day: [highTemp uint8][precip uint8][moon uint8]
+// Temperatures are unsigned, so highs below zero are sent as 0 (see EncodeForecastFor).
 func EncodeForecast(days []ForecastDay) []byte {
 	payloadLen := 1 + (len(days) * 3) // 1 for numDays, 3 per day
 	msg := make([]byte, 2+payloadLen)
@@ -51,7 +249,9 @@ func EncodeForecast(days []ForecastDay) []byte {
 
 	offset := 3
 	for _, day := range days {
-		msg[offset] = day.HighTemp
+		if day.HighTemp > 0 {
+			msg[offset] = uint8(day.HighTemp)
+		}
 		msg[offset+1] = day.Precip
 		msg[offset+2] = day.Moon
 		offset += 3
@@ -59,6 +259,48 @@ func EncodeForecast(days []ForecastDay) []byte {
 	return msg
 }
 
+// EncodeForecastFor creates a forecast message with quality flags for devices speaking the
+// given protocol version. From v4 the highs carry the +50 offset, marked with
+// WEATHER_FLAG_SIGNED_TEMPS in the flags byte: [numDays][high+50][precip][moon]...[flags]
+func EncodeForecastFor(days []ForecastDay, flags uint8, version uint8) []byte {
+	if version < PROTOCOL_V4 {
+		return WithWeatherFlags(EncodeForecast(days), flags)
+	}
+	msg := EncodeForecast(days)
+	for i, day := range days {
+		msg[3+i*3] = uint8(day.HighTemp + 50)
+	}
+	return WithWeatherFlags(msg, flags|WEATHER_FLAG_SIGNED_TEMPS)
+}
+
+// EncodeForecastV2 creates message: [type][len][numDays][day1][day2]...
+// Each day: [high+50][low+50][precip][moon]
+func EncodeForecastV2(days []ForecastDayV2) []byte {
+	msg := make([]byte, 3, 3+len(days)*4)
+	msg[0] = MSG_FORECAST_WEATHER_V2
+	msg[1] = uint8(1 + len(days)*4)
+	msg[2] = uint8(len(days))
+	for _, day := range days {
+		msg = append(msg, uint8(day.HighTemp+50), uint8(day.LowTemp+50), day.Precip, day.Moon)
+	}
+	return msg
+}
+
+// WithWeatherFlags appends a quality flags byte to an encoded weather message
+func WithWeatherFlags(msg []byte, flags uint8) []byte {
+	if flags == 0 {
+		return msg
+	}
+	flagged := append(append([]byte{}, msg...), flags)
+	flagged[1]++
+	return flagged
+}
+
+// EncodeWeatherUnavailable creates message: [type][len][weather_type]
+func EncodeWeatherUnavailable(weatherType uint8) []byte {
+	return []byte{MSG_WEATHER_UNAVAILABLE, 1, weatherType}
+}
+
 // EncodeVersion creates a version message with proper header
 func EncodeVersion(version uint16) []byte {
 	// Version is uint16 big-endian per protocol; payload length = 2
@@ -69,9 +311,123 @@ func EncodeVersion(version uint16) []byte {
 	return msg
 }
 
+// EncodeIndicator creates a message turning display indicator id on or off
+func EncodeIndicator(id uint8, on bool) []byte {
+	msg := make([]byte, 4)
+	msg[0] = MSG_INDICATOR
+	msg[1] = 2 // payload length
+	msg[2] = id
+	if on {
+		msg[3] = 1
+	}
+	return msg
+}
+
+// EncodeTime creates message: [type][len][epoch(4)][utc_offset_minutes(2)]
+func EncodeTime(now time.Time) []byte {
+	_, offset := now.Zone()
+	msg := make([]byte, 8)
+	msg[0] = MSG_TIME
+	msg[1] = 6 // payload length
+	binary.BigEndian.PutUint32(msg[2:6], uint32(now.Unix()))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(int16(offset/60)))
+	return msg
+}
+
+// EncodeClockChange creates message: [type][len][at_epoch(4)][new_utc_offset_minutes(2)]
+func EncodeClockChange(at time.Time, offsetSeconds int) []byte {
+	msg := make([]byte, 8)
+	msg[0] = MSG_CLOCK_CHANGE
+	msg[1] = 6 // payload length
+	binary.BigEndian.PutUint32(msg[2:6], uint32(at.Unix()))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(int16(offsetSeconds/60)))
+	return msg
+}
+
+// EncodeServerShutdown creates message: [type][len][expected_downtime_seconds(2)]
+func EncodeServerShutdown(downtime time.Duration) []byte {
+	seconds := downtime / time.Second
+	if seconds > 0xFFFF {
+		seconds = 0xFFFF
+	}
+	msg := []byte{MSG_SERVER_SHUTDOWN, 2, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], uint16(seconds))
+	return msg
+}
+
+// EncodeQuietHours creates message: [type][len][until_epoch(4)]; zero until = quiet hours ended
+func EncodeQuietHours(until time.Time) []byte {
+	msg := []byte{MSG_QUIET_HOURS, 4, 0, 0, 0, 0}
+	if !until.IsZero() {
+		binary.BigEndian.PutUint32(msg[2:], uint32(until.Unix()))
+	}
+	return msg
+}
+
+// EncodeConfigRead creates message: [type][len][request_id hi][request_id lo]
+func EncodeConfigRead(id uint16) []byte {
+	msg := []byte{MSG_CONFIG_READ, 2, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], id)
+	return msg
+}
+
+// DecodeReply parses a MSG_REPLY payload
+func DecodeReply(payload []byte) (Reply, error) {
+	if len(payload) < 4 {
+		return Reply{}, fmt.Errorf("reply payload too short: %d bytes, need at least 4", len(payload))
+	}
+	return Reply{
+		To:     payload[0],
+		ID:     binary.BigEndian.Uint16(payload[1:3]),
+		Status: payload[3],
+		Data:   payload[4:],
+	}, nil
+}
+
+// Longest weather mood period MSG_WEATHER_MOOD can carry (one byte of tenths of a second)
+const MAX_MOOD_PERIOD_MS = 25500
+
+// EncodeWeatherMood creates message: [type][len][r][g][b][animation][period_ds]
+// Periods outside 0-MAX_MOOD_PERIOD_MS are clamped rather than wrapped.
+func EncodeWeatherMood(r uint8, g uint8, b uint8, animation uint8, periodMs int) []byte {
+	if periodMs < 0 {
+		periodMs = 0
+	} else if periodMs > MAX_MOOD_PERIOD_MS {
+		periodMs = MAX_MOOD_PERIOD_MS
+	}
+	return []byte{MSG_WEATHER_MOOD, 5, r, g, b, animation, uint8(periodMs / 100)}
+}
+
+// EncodeHouseholdSummary creates message: [type][len][flags][online][doorsOpen][minTemp+50][maxTemp+50]
+func EncodeHouseholdSummary(h HouseholdSummary) []byte {
+	msg := make([]byte, 7)
+	msg[0] = MSG_HOUSEHOLD_SUMMARY
+	msg[1] = 5 // payload length
+	if h.HasTemps {
+		msg[2] |= HOUSEHOLD_HAS_TEMPS
+	}
+	if h.HasDoors {
+		msg[2] |= HOUSEHOLD_HAS_DOORS
+	}
+	msg[3] = h.OnlineDevices
+	msg[4] = h.DoorsOpen
+	msg[5] = uint8(h.MinIndoorTemp + 50)
+	msg[6] = uint8(h.MaxIndoorTemp + 50)
+	return msg
+}
+
 // EncodeDeviceConfig creates a config message with variable number of strings
 // Format: [type][length][numStrings][len1][str1][len2][str2]...[lenN][strN]
 func EncodeDeviceConfig(strings ...string) ([]byte, error) {
+	payload, err := stringListPayload(strings)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeFor(MSG_DEVICE_CONFIG, payload, PROTOCOL_V1)
+}
+
+// stringListPayload builds [numStrings][len1][str1]...[lenN][strN]
+func stringListPayload(strings []string) ([]byte, error) {
 	// Validate string count
 	if len(strings) > 255 {
 		return nil, fmt.Errorf("too many strings: %d exceeds maximum of 255", len(strings))
@@ -90,24 +446,58 @@ func EncodeDeviceConfig(strings ...string) ([]byte, error) {
 		payloadLen += len(s)
 	}
 
-	if payloadLen > MAX_PAYLOAD_SIZE {
-		return nil, fmt.Errorf("payload too large: %d bytes exceeds maximum of %d", payloadLen, MAX_PAYLOAD_SIZE)
-	}
-
-	msg := make([]byte, 2+payloadLen)
-	msg[0] = MSG_DEVICE_CONFIG
-	msg[1] = uint8(payloadLen)
-	msg[2] = uint8(len(strings)) // First payload byte is string count
+	payload := make([]byte, payloadLen)
+	payload[0] = uint8(len(strings)) // First payload byte is string count
 
-	offset := 3
+	offset := 1
 	for _, s := range strings {
-		msg[offset] = uint8(len(s))
+		payload[offset] = uint8(len(s))
 		offset++
-		copy(msg[offset:offset+len(s)], s)
+		copy(payload[offset:offset+len(s)], s)
 		offset += len(s)
 	}
 
-	return msg, nil
+	return payload, nil
+}
+
+// EncodeConfigPairs encodes key/value settings as a device config message
+// Each pair becomes one "key=value" string, sorted by key so output is stable
+func EncodeConfigPairs(pairs map[string]string) ([]byte, error) {
+	return EncodeConfigPairsFor(pairs, PROTOCOL_V1)
+}
+
+// EncodeConfigPairsFor is EncodeConfigPairs for a device speaking the given protocol version
+// (v3 devices accept configs over 255 bytes with an extended header)
+func EncodeConfigPairsFor(pairs map[string]string, version uint8) ([]byte, error) {
+	return encodeConfigPairs(MSG_DEVICE_CONFIG, pairs, version)
+}
+
+// EncodeConfigDelta encodes changed keys as a config delta message (empty value = delete)
+func EncodeConfigDelta(changes map[string]string) ([]byte, error) {
+	return EncodeConfigDeltaFor(changes, PROTOCOL_V1)
+}
+
+// EncodeConfigDeltaFor is EncodeConfigDelta for a device speaking the given protocol version
+func EncodeConfigDeltaFor(changes map[string]string, version uint8) ([]byte, error) {
+	return encodeConfigPairs(MSG_CONFIG_DELTA, changes, version)
+}
+
+func encodeConfigPairs(msgType uint8, pairs map[string]string, version uint8) ([]byte, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	strs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		strs = append(strs, k+"="+pairs[k])
+	}
+	payload, err := stringListPayload(strs)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeFor(msgType, payload, version)
 }
 
 // DecodeDeviceConfig parses a device config message and returns all strings
@@ -148,25 +538,27 @@ func EncodeGeneric(payload []byte) []byte {
 	return msg
 }
 
-// DecodeMessage parses header and returns type, payload with bounds checking
+// DecodeMessage parses header (standard or extended) and returns type, payload with bounds checking
 func DecodeMessage(data []byte) (msgType uint8, payload []byte, err error) {
-	if len(data) < 2 {
-		return 0, nil, fmt.Errorf("message too short: got %d bytes, need at least 2", len(data))
+	msgType, length, headerLen, err := decodeHeader(data)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	msgType = data[0]
-	length := uint16(data[1])
-
 	// Validate length against actual data size
-	if int(length) > len(data)-2 {
-		return 0, nil, fmt.Errorf("invalid length field: claims %d bytes but only %d available", length, len(data)-2)
+	if length > len(data)-headerLen {
+		return 0, nil, fmt.Errorf("invalid length field: claims %d bytes but only %d available", length, len(data)-headerLen)
 	}
 
-	// Validate against maximum payload size for ESP32 safety
-	if length > MAX_PAYLOAD_SIZE {
-		return 0, nil, fmt.Errorf("payload too large: %d bytes exceeds maximum of %d", length, MAX_PAYLOAD_SIZE)
-	}
+	payload = data[headerLen : headerLen+length]
+	return msgType, payload, nil
+}
 
-	payload = data[2 : 2+length]
-	return
+// DecodeMessageFrom decodes a message like DecodeMessage, first checking its CRC trailer
+// when the sender speaks protocol v2 or later
+func DecodeMessageFrom(data []byte, protocol uint8) (msgType uint8, payload []byte, err error) {
+	if err := CheckCRC(data, protocol); err != nil {
+		return 0, nil, err
+	}
+	return DecodeMessage(data)
 }
@@ -0,0 +1,327 @@
+package messaging
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Topic namespaces: the server publishes and subscribes with logical topics
+// ("weather/60607"), and on the wire they carry the active namespace prefix
+// ("home1/weather/60607"). During a topic migration the previous namespace is served too,
+// so devices on either side of the move see every message.
+var (
+	namespaceMu  sync.RWMutex
+	currentNS    string // Prefix of the namespace in use ("" = unprefixed topics)
+	previousNS   string // Namespace being migrated away from
+	dualNS       bool   // Whether previousNS is still published to and subscribed
+	movedHook    func(topic string, payload []byte)
+	retainedSent = make(map[string][]byte) // Retained messages from this process, by logical topic
+
+	// Held while a retained topic is published under every namespace, so a namespace that
+	// starts being served gets each topic's latest state, never an older one
+	retainedLocks sync.Map // Logical topic -> *sync.Mutex
+
+	relayFilters []string             // Topics devices publish to each other (see RelayDuringMigration)
+	relayEchoes  map[string]relayEcho // Messages this process sent on relayed topics, by wire topic and payload hash
+	relayQueue   chan relayMessage
+	relayOnce    sync.Once
+)
+
+// relayEcho is a message this process published on a relayed topic, expected back from
+// the broker. It is not forwarded again; a forwarded copy is not delivered again either.
+type relayEcho struct {
+	at      time.Time
+	deliver bool // Published by the server itself, so its handlers and taps still see it
+}
+
+// Echoes not heard back within this long are forgotten
+const relayEchoWindow = 30 * time.Second
+
+type relayMessage struct {
+	topic   string // Wire topic
+	payload []byte
+}
+
+// SetTopicNamespace switches the wire prefix to current. With dual set, previous is served
+// as well until a later call drops it. Subscriptions are moved on the live connection, and
+// a change of the current namespace reconnects so the Last Will moves with it.
+func SetTopicNamespace(current string, previous string, dual bool) {
+	before := namespaces()
+
+	namespaceMu.Lock()
+	currentNS, previousNS = current, previous
+	dualNS = dual && previous != current
+	namespaceMu.Unlock()
+
+	after := namespaces()
+	if dualNS {
+		fmt.Printf("Topic namespace %q, still serving %q during migration\n", current, previous)
+	} else {
+		fmt.Printf("Topic namespace %q\n", current)
+	}
+	rewire(before, after)
+	for _, ns := range after {
+		if !containsString(before, ns) {
+			copyRetained(ns)
+		}
+	}
+	if p, ok := client.(*pahoClient); ok && presenceTopic != "" && before[0] != after[0] {
+		p.reopen("with the new Last Will topic")
+	}
+}
+
+// TopicNamespace returns the active namespace, the previous one and whether both are served
+func TopicNamespace() (current string, previous string, dual bool) {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+	return currentNS, previousNS, dualNS
+}
+
+// OnMovedMessage registers a callback for messages that arrive on the current namespace
+// while a migration is serving both, i.e. from devices that already moved
+func OnMovedMessage(fn func(topic string, payload []byte)) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+	movedHook = fn
+}
+
+// wireTopic returns topic under the current namespace
+func wireTopic(topic string) string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+	return currentNS + topic
+}
+
+// namespaces returns the prefixes in use, current first
+func namespaces() []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+	if dualNS {
+		return []string{currentNS, previousNS}
+	}
+	return []string{currentNS}
+}
+
+// noteRetained keeps the latest retained message of each logical topic
+func noteRetained(topic string, data []byte) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+	if len(data) == 0 {
+		delete(retainedSent, topic)
+	} else {
+		retainedSent[topic] = data
+	}
+}
+
+// lockRetained serializes publishing topic's retained state (see retainedLocks)
+func lockRetained(topic string) func() {
+	m, _ := retainedLocks.LoadOrStore(topic, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// copyRetained publishes this process's retained messages under namespace ns, so devices
+// moving to it find the same canvas, weather and status there as under the one they left
+// instead of a mix of old and new state
+func copyRetained(ns string) {
+	namespaceMu.RLock()
+	topics := make([]string, 0, len(retainedSent))
+	for topic := range retainedSent {
+		topics = append(topics, topic)
+	}
+	namespaceMu.RUnlock()
+	sort.Strings(topics)
+
+	copied := 0
+	for _, topic := range topics {
+		if client == nil || !client.IsConnected() {
+			break // Copied again on the next change; publishes resume under every namespace
+		}
+		unlock := lockRetained(topic)
+		namespaceMu.RLock()
+		data := retainedSent[topic]
+		namespaceMu.RUnlock()
+		if len(data) > 0 {
+			if err := client.Publish(ns+topic, 1, true, data, publishTimeout(1)); err != nil {
+				log.Printf("Failed to copy retained %s: %v", ns+topic, err)
+			} else {
+				copied++
+			}
+		}
+		unlock()
+	}
+	if copied > 0 {
+		fmt.Printf("Copied %d retained topic(s) to namespace %q\n", copied, ns)
+	}
+}
+
+// ClearPreviousNamespace removes retained messages under the previous namespace: every
+// retained topic published by this process plus extra (logical topics retained before it started)
+func ClearPreviousNamespace(extra []string) int {
+	namespaceMu.RLock()
+	previous, current := previousNS, currentNS
+	topics := make(map[string]bool, len(retainedSent)+len(extra))
+	for topic := range retainedSent {
+		topics[topic] = true
+	}
+	namespaceMu.RUnlock()
+	if previous == current {
+		return 0
+	}
+	for _, topic := range extra {
+		topics[topic] = true
+	}
+
+	sorted := make([]string, 0, len(topics))
+	for topic := range topics {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	cleared := 0
+	for _, topic := range sorted {
+		if client == nil || !client.IsConnected() {
+			break
+		}
+		if err := client.Publish(previous+topic, 1, true, nil, publishTimeout(1)); err != nil {
+			log.Printf("Failed to clear retained %s: %v", previous+topic, err)
+			continue
+		}
+		cleared++
+	}
+	fmt.Printf("Cleared %d retained topic(s) under namespace %q\n", cleared, previous)
+	return cleared
+}
+
+// rewire moves live subscriptions from the before namespaces to the after ones
+func rewire(before []string, after []string) {
+	if client == nil || !client.IsConnected() {
+		return // Subscribed with the new namespaces on connect
+	}
+	subscriptionsMu.Lock()
+	filters := make([]string, 0, len(subscriptions))
+	for filter := range subscriptions {
+		filters = append(filters, filter)
+	}
+	subscriptionsMu.Unlock()
+
+	for _, ns := range before {
+		if !containsString(after, ns) {
+			for _, filter := range filters {
+				client.Unsubscribe(ns + filter)
+			}
+		}
+	}
+	for _, ns := range after {
+		if !containsString(before, ns) {
+			for _, filter := range filters {
+				subscribeWire(client, filter, ns)
+			}
+		}
+	}
+}
+
+// RelayDuringMigration forwards messages on filter between the namespaces while a
+// migration serves both. Devices that publish to each other on such a topic (the shared
+// canvas) would otherwise split into two groups, each seeing only the devices on its side.
+func RelayDuringMigration(filter string) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+	relayFilters = append(relayFilters, filter)
+}
+
+// relay forwards a message received under namespace ns to the other namespace being
+// served. Returns false for a copy relay sent itself, which its handlers already saw.
+func relay(ns string, topic string, payload []byte) bool {
+	current, previous, dual := TopicNamespace()
+	if !dual || !relayedTopic(topic) {
+		return true
+	}
+	if echo, ok := takeRelayEcho(ns+topic, payload); ok {
+		return echo.deliver
+	}
+	other := current
+	if ns == current {
+		other = previous
+	}
+	noteRelayEcho(other+topic, payload, false)
+
+	// Published from one goroutine in arrival order; waiting on the broker inside a message
+	// handler could stall delivery
+	relayOnce.Do(func() {
+		relayQueue = make(chan relayMessage, 256)
+		go relayLoop()
+	})
+	select {
+	case relayQueue <- relayMessage{topic: other + topic, payload: payload}:
+	default:
+		log.Printf("Relay queue full; not forwarding %s to namespace %q", topic, other)
+	}
+	return true
+}
+
+// relayedTopic reports whether topic matches a filter passed to RelayDuringMigration
+func relayedTopic(topic string) bool {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+	for _, filter := range relayFilters {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func relayEchoKey(wireTopic string, payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return wireTopic + "\x00" + string(sum[:])
+}
+
+// noteRelayEcho expects payload back on wireTopic
+func noteRelayEcho(wireTopic string, payload []byte, deliver bool) {
+	now := time.Now()
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+	if relayEchoes == nil {
+		relayEchoes = make(map[string]relayEcho)
+	}
+	for k, echo := range relayEchoes {
+		if now.Sub(echo.at) > relayEchoWindow {
+			delete(relayEchoes, k)
+		}
+	}
+	relayEchoes[relayEchoKey(wireTopic, payload)] = relayEcho{at: now, deliver: deliver}
+}
+
+func takeRelayEcho(wireTopic string, payload []byte) (relayEcho, bool) {
+	key := relayEchoKey(wireTopic, payload)
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+	echo, ok := relayEchoes[key]
+	delete(relayEchoes, key)
+	return echo, ok
+}
+
+func relayLoop() {
+	for m := range relayQueue {
+		if client == nil || !client.IsConnected() {
+			continue
+		}
+		if err := client.Publish(m.topic, 1, false, m.payload, publishTimeout(1)); err != nil {
+			log.Printf("Failed to relay %s: %v", m.topic, err)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Notifications take over a device's display for a while (a text message, an alert). The
+// server decides which one a device shows (see internal/arbiter) and sends the next only
+// once the previous one's time is up or a more important one preempts it; the device goes
+// back to its normal display after the duration.
+
+const notificationHeaderLen = 3
+
+// EncodeNotification creates message: [type][len][priority][duration_seconds(2)][text]
+func EncodeNotification(priority uint8, duration time.Duration, text string) ([]byte, error) {
+	seconds := duration / time.Second
+	if seconds > 0xFFFF {
+		seconds = 0xFFFF
+	}
+	payload := make([]byte, notificationHeaderLen+len(text))
+	payload[0] = priority
+	binary.BigEndian.PutUint16(payload[1:3], uint16(seconds))
+	copy(payload[notificationHeaderLen:], text)
+	if len(payload) > MAX_PAYLOAD_SIZE {
+		return nil, fmt.Errorf("notification text is %d bytes, maximum is %d", len(text), MAX_PAYLOAD_SIZE-notificationHeaderLen)
+	}
+	return EncodeFor(MSG_NOTIFICATION, payload, PROTOCOL_V1)
+}
+
+// DecodeNotification parses a MSG_NOTIFICATION payload
+func DecodeNotification(payload []byte) (uint8, time.Duration, string, error) {
+	if len(payload) < notificationHeaderLen {
+		return 0, 0, "", fmt.Errorf("notification payload too short: %d bytes, need at least %d", len(payload), notificationHeaderLen)
+	}
+	seconds := binary.BigEndian.Uint16(payload[1:3])
+	return payload[0], time.Duration(seconds) * time.Second, string(payload[notificationHeaderLen:]), nil
+}
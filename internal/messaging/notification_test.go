@@ -0,0 +1,14 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotificationRoundTrip(t *testing.T) {
+	msg, _ := EncodeNotification(80, 30*time.Second, "Door open")
+	_, payload, _ := DecodeMessage(msg)
+	if priority, duration, text, err := DecodeNotification(payload); err != nil || priority != 80 || duration != 30*time.Second || text != "Door open" {
+		t.Errorf("notification round trip: got %d %s %q (%v)", priority, duration, text, err)
+	}
+}
@@ -0,0 +1,155 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy controls how messages on a topic are published
+type Policy struct {
+	QoS           byte `json:"qos"`
+	Retained      bool `json:"retained"`
+	ExpirySeconds int  `json:"expirySeconds"` // Clear a retained message from the broker after this long (0 = keep)
+}
+
+// TopicPolicy applies a Policy to topics matching an MQTT filter, optionally only for one message type
+type TopicPolicy struct {
+	Topic string `json:"topic"`
+	Type  *uint8 `json:"type,omitempty"`
+	Policy
+}
+
+// Used when no TopicPolicy matches (the historical Publish() behaviour)
+var defaultPolicy = Policy{QoS: 1}
+
+var (
+	policyMu sync.RWMutex
+	policies []TopicPolicy
+
+	expiryMu     sync.Mutex
+	expiryTimers = make(map[string]*time.Timer)
+)
+
+// Validate checks a single policy table entry
+func (p TopicPolicy) Validate() error {
+	if p.Topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+	if p.QoS > 2 {
+		return fmt.Errorf("%s: qos %d out of range", p.Topic, p.QoS)
+	}
+	if p.ExpirySeconds < 0 {
+		return fmt.Errorf("%s: negative expirySeconds", p.Topic)
+	}
+	if p.ExpirySeconds > 0 && !p.Retained {
+		return fmt.Errorf("%s: expirySeconds only applies to retained messages", p.Topic)
+	}
+	return nil
+}
+
+// SetPolicies replaces the policy table; the first matching entry wins
+func SetPolicies(table []TopicPolicy) error {
+	for i, p := range table {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("policy %d: %v", i, err)
+		}
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policies = append([]TopicPolicy(nil), table...)
+	return nil
+}
+
+// Policies returns a copy of the current policy table
+func Policies() []TopicPolicy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return append([]TopicPolicy(nil), policies...)
+}
+
+// PolicyFor returns the policy for a message of msgType published on topic
+func PolicyFor(topic string, msgType uint8) Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	for _, p := range policies {
+		if p.Type != nil && *p.Type != msgType {
+			continue
+		}
+		if TopicMatches(p.Topic, topic) {
+			return p.Policy
+		}
+	}
+	return defaultPolicy
+}
+
+// PublishWithPolicy publishes data with the QoS, retain flag and expiry configured for its topic and type,
+// adding a CRC trailer if the topic's devices support it. Returns true if the broker accepted the message.
+func PublishWithPolicy(topic string, data []byte) bool {
+	return publishWithPolicy(client, topic, data)
+}
+
+func publishWithPolicy(c Client, topic string, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	p := PolicyFor(topic, messageType(data))
+	if !publishVia(c, topic, p.QoS, p.Retained, withProtocol(topic, data), publishTimeout(p.QoS)) {
+		return false
+	}
+	if p.Retained {
+		scheduleExpiry(topic, p)
+	}
+	return true
+}
+
+// QoS 0 only waits for the local write; QoS 1/2 wait for the broker's acknowledgement
+func publishTimeout(qos byte) time.Duration {
+	if qos == 0 {
+		return 5 * time.Second
+	}
+	return 15 * time.Second
+}
+
+// MQTT 3.1.1 has no message expiry, so expired retained messages are cleared by publishing
+// an empty retained message; a newer publish on the topic restarts the clock
+func scheduleExpiry(topic string, p Policy) {
+	scheduleExpiryAfter(topic, time.Duration(p.ExpirySeconds)*time.Second)
+}
+
+// scheduleExpiryAfter clears the retained message on topic after d (0 = never)
+func scheduleExpiryAfter(topic string, d time.Duration) {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	if timer, exists := expiryTimers[topic]; exists {
+		timer.Stop()
+		delete(expiryTimers, topic)
+	}
+	if d <= 0 {
+		return
+	}
+	expiryTimers[topic] = time.AfterFunc(d, func() {
+		fmt.Printf("Retained message on %s expired, clearing\n", topic)
+		PublishRetained(topic, []byte{})
+	})
+}
+
+// TopicMatches applies MQTT wildcard rules ("+" one level, trailing "#" any remaining levels)
+func TopicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
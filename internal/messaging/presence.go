@@ -0,0 +1,46 @@
+package messaging
+
+import (
+	"fmt"
+	"log"
+)
+
+// Server presence: a retained "online" published on every connect, and "offline" left with
+// the broker as the Last Will, so subscribers can tell "broker up, server down" apart from
+// "everything fine"
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+var presenceTopic string // "" = presence disabled
+
+// SetPresenceTopic sets the topic carrying the server's presence. Call before NewClient;
+// the Last Will is registered with the broker when connecting.
+func SetPresenceTopic(topic string) {
+	presenceTopic = topic
+}
+
+// publishPresence sends the retained presence state straight to c, ahead of any queued
+// publishes, under every namespace being served
+func publishPresence(c Client, state string) {
+	if presenceTopic == "" {
+		return
+	}
+	for _, ns := range namespaces() {
+		if err := c.Publish(ns+presenceTopic, 1, true, []byte(state), publishTimeout(1)); err != nil {
+			log.Printf("Failed to publish presence %q to %s: %v", state, ns+presenceTopic, err)
+		}
+	}
+	noteRetained(presenceTopic, []byte(state))
+}
+
+// AnnounceOffline marks the server offline before a planned disconnect; the Last Will
+// only covers connections that drop without one
+func AnnounceOffline() {
+	if client == nil || !client.IsConnected() || presenceTopic == "" {
+		return
+	}
+	fmt.Printf("Publishing server presence %q\n", PresenceOffline)
+	publishPresence(client, PresenceOffline)
+}
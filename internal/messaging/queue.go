@@ -0,0 +1,213 @@
+package messaging
+
+import (
+	"fmt"
+	"server_app/internal/storage"
+	"sync"
+	"time"
+)
+
+// Publishes made while disconnected are held here and replayed on reconnect
+const (
+	queueMaxLen     = 256           // Oldest entries are dropped beyond this
+	queueMaxAge     = 6 * time.Hour // Entries older than this are not replayed
+	queueStorageKey = "queue"
+	queueSchema     = 1 // Version of the stored queue layout (see storage.Migrate)
+)
+
+// Message types where a newer message on the same topic makes older ones pointless,
+// so the queue keeps only the latest (e.g. the weather for a zipcode)
+var supersedingTypes = map[uint8]bool{
+	MSG_CURRENT_WEATHER:            true,
+	MSG_CURRENT_WEATHER_V2:         true,
+	MSG_FORECAST_WEATHER:           true,
+	MSG_FORECAST_WEATHER_V2:        true,
+	MSG_WEATHER_UNAVAILABLE:        true,
+	MSG_DEVICE_CONFIG:              true,
+	MSG_VERSION:                    true,
+	MSG_HOUSEHOLD_SUMMARY:          true,
+	MSG_WEATHER_MOOD:               true,
+	MSG_TYPE_ETCH_UPDATE_FRAME:     true,
+	MSG_TYPE_ETCH_CALIBRATED_FRAME: true,
+	MSG_QUIET_HOURS:                true,
+}
+
+// Message types that are wrong by the time a reconnect happens, so they are never queued
+var unqueuedTypes = map[uint8]bool{
+	MSG_TIME:            true,
+	MSG_SERVER_SHUTDOWN: true,
+	MSG_NOTIFICATION:    true, // Timed by the arbiter; replaying late would overlap the next one
+}
+
+// QueuedMessage is a publish waiting for the broker connection
+type QueuedMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Data     []byte    `json:"data"`
+	Queued   time.Time `json:"queued"`
+}
+
+// supersedes reports whether m makes an earlier queued message q redundant
+func (m QueuedMessage) supersedes(q QueuedMessage) bool {
+	if m.Topic != q.Topic || len(m.Data) == 0 {
+		// An empty message only clears a retained topic
+		return m.Topic == q.Topic && m.Retained && len(m.Data) == 0
+	}
+	return len(q.Data) > 0 && messageType(q.Data) == messageType(m.Data) && supersedingTypes[messageType(m.Data)]
+}
+
+var (
+	queueMu    sync.Mutex
+	queue      []QueuedMessage
+	queueStore *storage.Manager
+	// Set from a connection loss until the queue has been replayed on the next connection;
+	// live publishes meanwhile join the queue so nothing overtakes an older message
+	replayPending = true
+)
+
+// EnableQueuePersistence keeps the offline queue in a file so it survives a restart
+func EnableQueuePersistence(dataFilePath string) error {
+	store, err := storage.New(dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to initialize publish queue storage: %v", err)
+	}
+	if err := store.Migrate(queueSchema, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	var saved []QueuedMessage
+	if _, err := store.GetTyped(queueStorageKey, &saved); err != nil {
+		return fmt.Errorf("failed to load publish queue: %v", err)
+	}
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	queueStore = store
+	for _, m := range saved {
+		enqueueLocked(m)
+	}
+	if len(queue) > 0 {
+		fmt.Printf("Loaded %d queued publish(es)\n", len(queue))
+	}
+	return nil
+}
+
+// QueueLen returns the number of publishes waiting for the broker
+func QueueLen() int {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return len(queue)
+}
+
+func enqueue(m QueuedMessage) {
+	if len(m.Data) > 0 && unqueuedTypes[messageType(m.Data)] {
+		fmt.Printf("MQTT client not connected; dropping time-sensitive publish to %s\n", m.Topic)
+		return
+	}
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	enqueueLocked(m)
+	saveQueueLocked()
+	fmt.Printf("Queued publish to %s until reconnect (%d queued)\n", m.Topic, len(queue))
+}
+
+// holdForReplay queues m behind the messages still being replayed after a reconnect and
+// reports whether it did. Unlike enqueue it keeps time-sensitive types: they go out
+// moments later, once the replay is done.
+func holdForReplay(m QueuedMessage) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if !replayPending {
+		return false
+	}
+	enqueueLocked(m)
+	saveQueueLocked()
+	return true
+}
+
+// noteReplayPending holds live publishes until the queue is replayed on the next connection
+func noteReplayPending() {
+	queueMu.Lock()
+	replayPending = true
+	queueMu.Unlock()
+}
+
+func enqueueLocked(m QueuedMessage) {
+	kept := queue[:0]
+	for _, q := range queue {
+		if !m.supersedes(q) {
+			kept = append(kept, q)
+		}
+	}
+	queue = append(kept, m)
+	if len(queue) > queueMaxLen {
+		fmt.Printf("Publish queue full, dropping %d oldest\n", len(queue)-queueMaxLen)
+		queue = append([]QueuedMessage(nil), queue[len(queue)-queueMaxLen:]...)
+	}
+}
+
+func saveQueueLocked() {
+	if queueStore == nil {
+		return
+	}
+	if err := queueStore.Set(queueStorageKey, queue); err != nil {
+		fmt.Printf("Failed to save publish queue: %v\n", err)
+	}
+}
+
+// flushQueue replays queued publishes in order, including those held while it runs, then
+// lets live publishes through. If the connection drops again the rest stay queued.
+func flushQueue() {
+	for {
+		queueMu.Lock()
+		pending := queue
+		queue = nil
+		if len(pending) == 0 {
+			replayPending = false
+			queueMu.Unlock()
+			return
+		}
+		saveQueueLocked()
+		queueMu.Unlock()
+
+		fmt.Printf("Replaying %d queued publish(es)\n", len(pending))
+		for i, m := range pending {
+			age := time.Since(m.Queued)
+			if age > queueMaxAge {
+				fmt.Printf("Dropping queued publish to %s (queued %v ago)\n", m.Topic, age.Round(time.Minute))
+				continue
+			}
+			var p Policy
+			if m.Retained && len(m.Data) > 0 {
+				p = PolicyFor(m.Topic, messageType(m.Data))
+				if p.ExpirySeconds > 0 && age >= time.Duration(p.ExpirySeconds)*time.Second {
+					fmt.Printf("Dropping queued retained publish to %s (expired while queued)\n", m.Topic)
+					continue
+				}
+			}
+			c := client
+			if c == nil || !c.IsConnected() {
+				requeue(pending[i:])
+				return
+			}
+			if send(c, m.Topic, m.QoS, m.Retained, m.Data, publishTimeout(m.QoS)) && p.ExpirySeconds > 0 {
+				// The expiry counts from when the message was first published
+				scheduleExpiryAfter(m.Topic, time.Duration(p.ExpirySeconds)*time.Second-age)
+			}
+		}
+	}
+}
+
+// requeue puts messages that could not be replayed back in front of those queued since
+func requeue(unsent []QueuedMessage) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	since := queue
+	queue = nil
+	for _, m := range append(append([]QueuedMessage(nil), unsent...), since...) {
+		enqueueLocked(m)
+	}
+	saveQueueLocked()
+	fmt.Printf("Connection lost during replay, %d publish(es) stay queued\n", len(queue))
+}
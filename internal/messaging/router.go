@@ -0,0 +1,54 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message is an inbound message delivered to a route
+type Message struct {
+	Topic   string
+	Payload []byte
+	Params  []string // Topic levels matched by "+" wildcards in the route pattern, in order
+}
+
+// HandlerFunc handles messages for one route
+type HandlerFunc func(msg Message)
+
+// Router maps topic patterns to handlers. Each pattern becomes a subscription that is
+// restored on every (re)connect, so routes only need registering once.
+type Router struct{}
+
+// NewRouter creates an empty router
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle routes messages matching pattern (MQTT wildcards allowed, e.g. "devices/+/telemetry")
+// to fn, subscribing now if connected
+func (r *Router) Handle(pattern string, fn HandlerFunc) {
+	Subscribe(pattern, func(topic string, payload []byte) {
+		fn(Message{
+			Topic:   topic,
+			Payload: payload,
+			Params:  topicParams(pattern, topic),
+		})
+	})
+}
+
+// fallback handles messages the broker delivers without a matching route
+func (r *Router) fallback(topic string, payload []byte) {
+	fmt.Printf("No route for message on %s (bytes=%d)\n", topic, len(payload))
+}
+
+// topicParams returns the topic levels matched by "+" in pattern
+func topicParams(pattern string, topic string) []string {
+	var params []string
+	t := strings.Split(topic, "/")
+	for i, level := range strings.Split(pattern, "/") {
+		if level == "+" && i < len(t) {
+			params = append(params, t[i])
+		}
+	}
+	return params
+}
@@ -0,0 +1,84 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Screen images for e-paper displays travel as MSG_SCREEN_CHUNK messages. The bitmap is
+// 1 bit per pixel, rows top to bottom, each row padded to whole bytes, most significant
+// bit leftmost, 1 = black. Every chunk carries the screen id and size, so a device can
+// start a new buffer on any chunk and shows the screen once all chunk_count have arrived.
+
+const screenChunkHeaderLen = 8
+
+// ScreenChunk is one decoded MSG_SCREEN_CHUNK
+type ScreenChunk struct {
+	ScreenID uint16
+	Width    uint16
+	Height   uint16
+	Index    uint8
+	Count    uint8
+	Data     []byte
+}
+
+// ScreenBitmapSize returns the bytes of a packed width x height bitmap
+func ScreenBitmapSize(width int, height int) int {
+	return (width + 7) / 8 * height
+}
+
+// EncodeScreenChunks splits a packed bitmap into as few chunks as fit a device speaking version
+func EncodeScreenChunks(screenID uint16, width int, height int, bitmap []byte, version uint8) ([][]byte, error) {
+	if width <= 0 || height <= 0 || width > 0xFFFF || height > 0xFFFF {
+		return nil, fmt.Errorf("invalid screen size %dx%d", width, height)
+	}
+	if len(bitmap) != ScreenBitmapSize(width, height) {
+		return nil, fmt.Errorf("bitmap is %d bytes, %dx%d needs %d", len(bitmap), width, height, ScreenBitmapSize(width, height))
+	}
+	chunkSize := MaxPayloadFor(version) - screenChunkHeaderLen
+	count := (len(bitmap) + chunkSize - 1) / chunkSize
+	if count > 255 {
+		return nil, fmt.Errorf("%dx%d screen needs %d chunks, maximum is 255", width, height, count)
+	}
+
+	msgs := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(bitmap) {
+			end = len(bitmap)
+		}
+		data := bitmap[i*chunkSize : end]
+		payload := make([]byte, screenChunkHeaderLen+len(data))
+		binary.BigEndian.PutUint16(payload[0:2], screenID)
+		binary.BigEndian.PutUint16(payload[2:4], uint16(width))
+		binary.BigEndian.PutUint16(payload[4:6], uint16(height))
+		payload[6] = uint8(i)
+		payload[7] = uint8(count)
+		copy(payload[screenChunkHeaderLen:], data)
+		msg, err := EncodeFor(MSG_SCREEN_CHUNK, payload, version)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// DecodeScreenChunk parses a MSG_SCREEN_CHUNK payload
+func DecodeScreenChunk(payload []byte) (ScreenChunk, error) {
+	if len(payload) < screenChunkHeaderLen {
+		return ScreenChunk{}, fmt.Errorf("screen chunk too short: %d bytes", len(payload))
+	}
+	c := ScreenChunk{
+		ScreenID: binary.BigEndian.Uint16(payload[0:2]),
+		Width:    binary.BigEndian.Uint16(payload[2:4]),
+		Height:   binary.BigEndian.Uint16(payload[4:6]),
+		Index:    payload[6],
+		Count:    payload[7],
+		Data:     payload[screenChunkHeaderLen:],
+	}
+	if c.Index >= c.Count {
+		return c, fmt.Errorf("screen chunk %d of %d", c.Index, c.Count)
+	}
+	return c, nil
+}
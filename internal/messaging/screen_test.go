@@ -0,0 +1,16 @@
+package messaging
+
+import "testing"
+
+func TestScreenChunkRoundTrip(t *testing.T) {
+	bitmap := make([]byte, ScreenBitmapSize(300, 10))
+	bitmap[len(bitmap)-1] = 0xA5
+	chunks, err := EncodeScreenChunks(7, 300, 10, bitmap, PROTOCOL_V1)
+	if err != nil || len(chunks) != 2 {
+		t.Fatalf("screen chunks: got %d (%v)", len(chunks), err)
+	}
+	_, payload, _ := DecodeMessage(chunks[1])
+	if c, err := DecodeScreenChunk(payload); err != nil || c.ScreenID != 7 || c.Width != 300 || c.Index != 1 || c.Count != 2 || c.Data[len(c.Data)-1] != 0xA5 {
+		t.Errorf("screen chunk round trip: got %+v (%v)", c, err)
+	}
+}
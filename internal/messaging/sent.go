@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"sync"
+	"time"
+)
+
+// Recent messages delivered to the broker per topic, so the server can rebuild what a
+// device was sent (e.g. to emulate its display) without subscribing to its own output
+
+const sentHistoryPerTopic = 32
+
+// SentMessage is a message published by this process
+type SentMessage struct {
+	Topic    string
+	Data     []byte
+	Retained bool
+	At       time.Time
+}
+
+var (
+	sentMu  sync.Mutex
+	sentLog = make(map[string][]SentMessage)
+)
+
+func noteSent(topic string, retained bool, data []byte) {
+	sentMu.Lock()
+	defer sentMu.Unlock()
+	history := append(sentLog[topic], SentMessage{Topic: topic, Data: append([]byte(nil), data...), Retained: retained, At: time.Now()})
+	if len(history) > sentHistoryPerTopic {
+		history = history[len(history)-sentHistoryPerTopic:]
+	}
+	sentLog[topic] = history
+}
+
+// Sent returns the latest messages published on topic, oldest first
+func Sent(topic string) []SentMessage {
+	sentMu.Lock()
+	defer sentMu.Unlock()
+	return append([]SentMessage(nil), sentLog[topic]...)
+}
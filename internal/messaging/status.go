@@ -0,0 +1,76 @@
+package messaging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BrokerStatus reports which configured broker the client is using
+type BrokerStatus struct {
+	Brokers        []string  `json:"brokers"`         // Configured brokers in priority order
+	Active         string    `json:"active"`          // Broker of the current (or last) connection
+	Connected      bool      `json:"connected"`       // Whether the client is connected right now
+	ConnectedSince time.Time `json:"connected_since"` // Start of the current connection
+	Failovers      int       `json:"failovers"`       // Connections made to a different broker than the previous one
+	LastError      string    `json:"last_error,omitempty"`
+	Queued         int       `json:"queued"` // Publishes waiting for a connection
+
+	PublishRTTMs float64        `json:"publish_rtt_ms"` // Smoothed round trip of acknowledged publishes
+	Batching     []BatcherStats `json:"batching"`       // Auto-tuned publish batching windows
+}
+
+var (
+	statusMu   sync.Mutex
+	status     BrokerStatus
+	attempting string // Broker of the connection attempt in progress
+)
+
+// Status returns the current broker connection status
+func Status() BrokerStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	s := status
+	s.Brokers = append([]string(nil), status.Brokers...)
+	s.Queued = QueueLen()
+	s.PublishRTTMs = durationMs(PublishRTT())
+	s.Batching = BatcherStatsAll()
+	return s
+}
+
+func noteBrokers(brokers []string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.Brokers = append([]string(nil), brokers...)
+}
+
+func noteConnectAttempt(broker string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	attempting = broker
+}
+
+func noteConnected() {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if status.Active != "" && status.Active != attempting {
+		status.Failovers++
+		fmt.Printf("MQTT failover: now connected to %s (was %s)\n", attempting, status.Active)
+	}
+	status.Active = attempting
+	status.Connected = true
+	clearCache()
+	status.ConnectedSince = time.Now()
+	status.LastError = ""
+}
+
+func noteConnectionLost(err error) {
+	noteReplayPending()
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.Connected = false
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	fmt.Printf("MQTT connection to %s lost: %v\n", status.Active, err)
+}
@@ -0,0 +1,149 @@
+package messaging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// subscription is one topic filter with the server's handler plus any taps (e.g. WebSocket relay clients)
+// Paho keeps a single route per filter, so everything interested in a filter shares one dispatcher.
+type subscription struct {
+	primary MessageHandler
+	taps    map[uint64]func(topic string, payload []byte)
+}
+
+// Topics to (re)subscribe on every connect, so subscriptions survive reconnects and broker failover
+var (
+	subscriptionsMu sync.Mutex
+	subscriptions   = make(map[string]*subscription)
+	nextTapID       uint64
+)
+
+// dispatcher routes messages for filter, received under namespace ns, to the filter's
+// current primary handler and taps with the namespace prefix removed
+func dispatcher(filter string, ns string) MessageHandler {
+	return func(wireTopic string, payload []byte) {
+		topic := strings.TrimPrefix(wireTopic, ns)
+		logReceived(wireTopic, payload)
+		if !relay(ns, topic, payload) {
+			return // Our own forwarded copy
+		}
+
+		subscriptionsMu.Lock()
+		sub, exists := subscriptions[filter]
+		var primary MessageHandler
+		var taps []func(string, []byte)
+		if exists {
+			primary = sub.primary
+			for _, fn := range sub.taps {
+				taps = append(taps, fn)
+			}
+		}
+		subscriptionsMu.Unlock()
+
+		if current, _, dual := TopicNamespace(); dual && ns == current {
+			namespaceMu.RLock()
+			hook := movedHook
+			namespaceMu.RUnlock()
+			if hook != nil {
+				hook(topic, payload)
+			}
+		}
+		if primary != nil {
+			primary(topic, payload)
+		}
+		for _, fn := range taps {
+			fn(topic, payload)
+		}
+	}
+}
+
+// register records interest in filter; returns true if the filter is new. Caller holds subscriptionsMu.
+func register(filter string) (*subscription, bool) {
+	sub, exists := subscriptions[filter]
+	if !exists {
+		sub = &subscription{taps: make(map[uint64]func(string, []byte))}
+		subscriptions[filter] = sub
+	}
+	return sub, !exists
+}
+
+// subscribeNow subscribes filter on the live connection, if any
+func subscribeNow(filter string) {
+	if client == nil || !client.IsConnected() {
+		log.Printf("MQTT client not connected; %s will be subscribed on connect", filter)
+		return
+	}
+	for _, ns := range namespaces() {
+		subscribeWire(client, filter, ns)
+	}
+}
+
+// subscribeWire subscribes filter under namespace ns
+func subscribeWire(c Client, filter string, ns string) {
+	fmt.Printf("Attempting to subscribe to %s\n", ns+filter)
+	if err := c.Subscribe(ns+filter, 1, dispatcher(filter, ns)); err != nil {
+		log.Printf("Subscribe error to %s: %v", ns+filter, err)
+	} else {
+		fmt.Printf("Subscribed to %s\n", ns+filter)
+	}
+}
+
+// resubscribeAll restores every registered filter on a new connection
+func resubscribeAll(c Client) {
+	subscriptionsMu.Lock()
+	filters := make([]string, 0, len(subscriptions))
+	for filter := range subscriptions {
+		filters = append(filters, filter)
+	}
+	subscriptionsMu.Unlock()
+
+	for _, ns := range namespaces() {
+		for _, filter := range filters {
+			subscribeWire(c, filter, ns)
+		}
+	}
+}
+
+// Subscribe registers the server's handler for topic on every connection and subscribes now if connected
+func Subscribe(topic string, handler MessageHandler) {
+	subscriptionsMu.Lock()
+	sub, _ := register(topic)
+	sub.primary = handler
+	subscriptionsMu.Unlock()
+
+	subscribeNow(topic)
+}
+
+// Tap delivers messages matching filter to fn alongside any server handler for the same filter.
+// The returned cancel function removes the tap (unsubscribing if nothing else needs the filter).
+func Tap(filter string, fn func(topic string, payload []byte)) (cancel func()) {
+	subscriptionsMu.Lock()
+	sub, added := register(filter)
+	nextTapID++
+	id := nextTapID
+	sub.taps[id] = fn
+	subscriptionsMu.Unlock()
+
+	if added {
+		subscribeNow(filter)
+	}
+
+	return func() {
+		subscriptionsMu.Lock()
+		delete(sub.taps, id)
+		unused := sub.primary == nil && len(sub.taps) == 0
+		if unused {
+			delete(subscriptions, filter)
+		}
+		subscriptionsMu.Unlock()
+
+		if unused && client != nil && client.IsConnected() {
+			for _, ns := range namespaces() {
+				client.Unsubscribe(ns + filter)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package messaging
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Verbose logging adds a line for every message received, with its decoded contents.
+// Off by default; toggled at runtime (SIGUSR2) while chasing a protocol problem.
+var verbose atomic.Bool
+
+// SetVerbose turns verbose logging on or off
+func SetVerbose(on bool) {
+	verbose.Store(on)
+}
+
+// Verbose reports whether verbose logging is on
+func Verbose() bool {
+	return verbose.Load()
+}
+
+// logReceived logs an inbound message when verbose logging is on
+func logReceived(topic string, payload []byte) {
+	if !verbose.Load() {
+		return
+	}
+	fmt.Printf("Received on %s (bytes=%d) — %s\n", topic, len(payload), Describe(payload))
+}
@@ -0,0 +1,184 @@
+package migration
+
+import (
+	"fmt"
+	"server_app/internal/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fleet-wide topic namespace migration state. The orchestration (config pushes, waiting,
+// cleanup) runs as a job; this package remembers where the fleet is, so the server keeps
+// serving the right namespaces across restarts.
+
+// Migration phases
+const (
+	PhaseTransition = "transition" // Both namespaces served while devices move
+	PhaseComplete   = "complete"   // Only the new namespace is served
+)
+
+const storageKey = "migration"
+
+// Version of the stored layout (see storage.Migrate)
+const schemaVersion = 1
+
+// State is the latest topic migration
+type State struct {
+	From      string               `json:"from"` // Namespace prefix devices are moving from
+	To        string               `json:"to"`   // Namespace prefix devices are moving to
+	Phase     string               `json:"phase"`
+	Started   time.Time            `json:"started"`
+	Deadline  time.Time            `json:"deadline"` // End of the transition window
+	Devices   []string             `json:"devices"`  // Devices expected to move
+	Moved     map[string]time.Time `json:"moved"`    // First message from each device on the new namespace
+	Completed time.Time            `json:"completed,omitempty"`
+}
+
+var (
+	mu    sync.Mutex
+	state *State
+	store *storage.Manager
+)
+
+// InitStorage loads the migration state saved by previous runs
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.New(dataFilePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Migrate(schemaVersion, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var saved State
+	found, err := store.GetTyped(storageKey, &saved)
+	if err != nil {
+		return err
+	}
+	if found {
+		state = &saved
+	}
+	return nil
+}
+
+// Current returns the latest migration, if any
+func Current() (State, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if state == nil {
+		return State{}, false
+	}
+	return copyState(state), true
+}
+
+// Namespace returns the namespace the fleet is on (or moving to)
+func Namespace() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if state == nil {
+		return ""
+	}
+	return state.To
+}
+
+// Begin starts moving devices to namespace to within window. Beginning the migration
+// already in progress again (e.g. a resumed job) returns it unchanged.
+func Begin(to string, devices []string, window time.Duration) (State, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	from := ""
+	if state != nil {
+		if state.Phase == PhaseTransition {
+			if state.To != to {
+				return State{}, fmt.Errorf("migration to %q is still in progress", state.To)
+			}
+			return copyState(state), nil
+		}
+		from = state.To
+	}
+	if from == to {
+		return State{}, fmt.Errorf("fleet is already on namespace %q", to)
+	}
+
+	now := time.Now()
+	state = &State{
+		From:     from,
+		To:       to,
+		Phase:    PhaseTransition,
+		Started:  now,
+		Deadline: now.Add(window),
+		Devices:  append([]string(nil), devices...),
+		Moved:    make(map[string]time.Time),
+	}
+	saveLocked()
+	return copyState(state), nil
+}
+
+// NoteMoved records that device was heard on the new namespace; reports whether it is news
+func NoteMoved(device string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if state == nil || state.Phase != PhaseTransition {
+		return false
+	}
+	if _, seen := state.Moved[device]; seen {
+		return false
+	}
+	state.Moved[device] = time.Now()
+	saveLocked()
+	return true
+}
+
+// Pending returns the expected devices not yet heard on the new namespace
+func Pending() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if state == nil {
+		return nil
+	}
+	var pending []string
+	for _, device := range state.Devices {
+		if _, moved := state.Moved[device]; !moved {
+			pending = append(pending, device)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// Complete ends the transition; only the new namespace is served from now on
+func Complete() {
+	mu.Lock()
+	defer mu.Unlock()
+	if state == nil || state.Phase != PhaseTransition {
+		return
+	}
+	state.Phase = PhaseComplete
+	state.Completed = time.Now()
+	saveLocked()
+}
+
+// saveLocked persists the state. Caller holds mu.
+func saveLocked() {
+	if store == nil {
+		return
+	}
+	if err := store.Set(storageKey, *state); err != nil {
+		fmt.Printf("Warning: failed to save topic migration state: %v\n", err)
+	}
+}
+
+func copyState(s *State) State {
+	c := *s
+	c.Devices = append([]string(nil), s.Devices...)
+	c.Moved = make(map[string]time.Time, len(s.Moved))
+	for device, at := range s.Moved {
+		c.Moved[device] = at
+	}
+	return c
+}
@@ -0,0 +1,179 @@
+package mood
+
+import (
+	"fmt"
+	"server_app/internal/messaging"
+	"server_app/internal/storage"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Animations understood by edge-lighting firmware
+const (
+	AnimationSolid   = 0
+	AnimationPulse   = 1 // Slow fade in/out
+	AnimationBreathe = 2 // Smooth continuous dimming
+	AnimationFlash   = 3 // Short bright flashes
+)
+
+var animationNames = map[string]uint8{
+	"solid":   AnimationSolid,
+	"pulse":   AnimationPulse,
+	"breathe": AnimationBreathe,
+	"flash":   AnimationFlash,
+}
+
+// Mapping maps an OpenWeather condition ("rain", "clear", ...) to an ambient light suggestion
+// Condition "*" is the fallback for conditions without their own mapping.
+type Mapping struct {
+	Condition string `json:"condition"`
+	Color     string `json:"color"`     // "#RRGGBB"
+	Animation string `json:"animation"` // solid, pulse, breathe, flash
+	PeriodMs  int    `json:"period_ms"` // Animation cycle length (ignored for solid)
+}
+
+// Mood is a resolved ambient light suggestion
+type Mood struct {
+	Condition string
+	R, G, B   uint8
+	Animation uint8
+	PeriodMs  int
+}
+
+// Built-in table used until mappings are set through the API
+var defaultMappings = []Mapping{
+	{Condition: "clear", Color: "#FFB030", Animation: "solid"},
+	{Condition: "clouds", Color: "#8090A0", Animation: "breathe", PeriodMs: 8000},
+	{Condition: "rain", Color: "#2050FF", Animation: "pulse", PeriodMs: 4000},
+	{Condition: "drizzle", Color: "#4080FF", Animation: "pulse", PeriodMs: 6000},
+	{Condition: "thunderstorm", Color: "#8020FF", Animation: "flash", PeriodMs: 3000},
+	{Condition: "snow", Color: "#E0F0FF", Animation: "breathe", PeriodMs: 6000},
+	{Condition: "*", Color: "#606060", Animation: "solid"},
+}
+
+const storageKey = "mappings"
+
+// Version of the stored layout (see storage.Migrate)
+const schemaVersion = 1
+
+var (
+	mu       sync.RWMutex
+	mappings = defaultMappings
+	store    *storage.Manager
+)
+
+// InitStorage loads saved mappings (falling back to the built-in table)
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.New(dataFilePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Migrate(schemaVersion, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	var saved []Mapping
+	found, err := store.GetTyped(storageKey, &saved)
+	if err != nil {
+		return fmt.Errorf("failed to load weather mood mappings: %v", err)
+	}
+	if found && validateAll(saved) == nil {
+		mu.Lock()
+		mappings = saved
+		mu.Unlock()
+	}
+	return nil
+}
+
+// Validate checks a mapping's color and animation
+func (m Mapping) Validate() error {
+	if m.Condition == "" {
+		return fmt.Errorf("mapping requires a condition")
+	}
+	if _, _, _, err := parseColor(m.Color); err != nil {
+		return fmt.Errorf("mapping %s: %v", m.Condition, err)
+	}
+	if _, ok := animationNames[m.Animation]; !ok {
+		return fmt.Errorf("mapping %s: unknown animation %q", m.Condition, m.Animation)
+	}
+	if m.PeriodMs < 0 || m.PeriodMs > messaging.MAX_MOOD_PERIOD_MS {
+		return fmt.Errorf("mapping %s: period_ms must be 0-%d", m.Condition, messaging.MAX_MOOD_PERIOD_MS)
+	}
+	return nil
+}
+
+func validateAll(list []Mapping) error {
+	for _, m := range list {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mappings returns the current mapping table
+func Mappings() []Mapping {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Mapping(nil), mappings...)
+}
+
+// SetMappings replaces (and persists) the mapping table
+func SetMappings(list []Mapping) error {
+	if err := validateAll(list); err != nil {
+		return err
+	}
+	for i := range list {
+		list[i].Condition = strings.ToLower(list[i].Condition)
+	}
+
+	mu.Lock()
+	mappings = append([]Mapping(nil), list...)
+	mu.Unlock()
+
+	if store == nil {
+		return nil
+	}
+	return store.Set(storageKey, list)
+}
+
+// ForCondition resolves the mood for a weather condition, using the "*" fallback if needed
+func ForCondition(condition string) (Mood, bool) {
+	condition = strings.ToLower(condition)
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var fallback *Mapping
+	for i := range mappings {
+		if mappings[i].Condition == condition {
+			return resolve(mappings[i], condition), true
+		}
+		if mappings[i].Condition == "*" {
+			fallback = &mappings[i]
+		}
+	}
+	if fallback == nil {
+		return Mood{}, false
+	}
+	return resolve(*fallback, condition), true
+}
+
+func resolve(m Mapping, condition string) Mood {
+	r, g, b, _ := parseColor(m.Color)
+	return Mood{Condition: condition, R: r, G: g, B: b, Animation: animationNames[m.Animation], PeriodMs: m.PeriodMs}
+}
+
+func parseColor(s string) (uint8, uint8, uint8, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return 0, 0, 0, fmt.Errorf("color must be #RRGGBB, got %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("color must be #RRGGBB, got %q", s)
+	}
+	return uint8(v >> 16), uint8(v >> 8), uint8(v), nil
+}
@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig sends email through a mail server with STARTTLS when it offers it (e.g. port 587)
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // 0 = 587
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// TelegramConfig sends messages from a bot to a chat the bot is in
+type TelegramConfig struct {
+	BotToken string `json:"botToken"`
+	ChatID   string `json:"chatID"`
+}
+
+// SlackConfig posts to a Slack incoming webhook
+type SlackConfig struct {
+	WebhookURL string `json:"webhookURL"`
+}
+
+const (
+	defaultSMTPPort  = 587
+	telegramAPI      = "https://api.telegram.org"
+	sendAttempts     = 3
+	firstSendBackoff = 2 * time.Second
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+type channel interface {
+	name() string
+	send(m Message) error
+}
+
+// buildChannels creates the channels whose required fields are set
+func buildChannels(config Config) (map[string]channel, error) {
+	enabled := make(map[string]channel)
+	if s := config.SMTP; s.Host != "" {
+		if s.From == "" || len(s.To) == 0 {
+			return nil, fmt.Errorf("smtp notifications require from and to")
+		}
+		enabled[ChannelEmail] = emailChannel{config: s}
+	}
+	if t := config.Telegram; t.BotToken != "" {
+		if t.ChatID == "" {
+			return nil, fmt.Errorf("telegram notifications require chatID")
+		}
+		enabled[ChannelTelegram] = telegramChannel{config: t}
+	}
+	if s := config.Slack; s.WebhookURL != "" {
+		if _, err := url.ParseRequestURI(s.WebhookURL); err != nil {
+			return nil, fmt.Errorf("invalid slack webhookURL")
+		}
+		enabled[ChannelSlack] = slackChannel{config: s}
+	}
+	return enabled, nil
+}
+
+func subject(m Message) string {
+	if m.Resolved {
+		return "Resolved: " + m.Title
+	}
+	return m.Title
+}
+
+type emailChannel struct {
+	config SMTPConfig
+}
+
+func (c emailChannel) name() string { return ChannelEmail }
+
+func (c emailChannel) send(m Message) error {
+	port := c.config.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if c.config.Username != "" {
+		auth = smtp.PlainAuth("", c.config.Username, c.config.Password, c.config.Host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", c.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(c.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject(m))
+	fmt.Fprintf(&body, "Date: %s\r\n", m.Time.Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(m.Text, "\n", "\r\n"))
+	body.WriteString("\r\n")
+
+	addr := net.JoinHostPort(c.config.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, c.config.From, c.config.To, []byte(body.String()))
+}
+
+type telegramChannel struct {
+	config TelegramConfig
+}
+
+func (c telegramChannel) name() string { return ChannelTelegram }
+
+func (c telegramChannel) send(m Message) error {
+	return postJSON(telegramAPI+"/bot"+c.config.BotToken+"/sendMessage", map[string]string{
+		"chat_id": c.config.ChatID,
+		"text":    subject(m) + "\n" + m.Text,
+	})
+}
+
+type slackChannel struct {
+	config SlackConfig
+}
+
+func (c slackChannel) name() string { return ChannelSlack }
+
+func (c slackChannel) send(m Message) error {
+	return postJSON(c.config.WebhookURL, map[string]string{"text": "*" + subject(m) + "*\n" + m.Text})
+}
+
+// postJSON posts payload, retrying a few times. Errors leave out the URL, which holds the
+// bot token or webhook secret.
+func postJSON(target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	backoff := firstSendBackoff
+	for attempt := 1; ; attempt++ {
+		err = post(target, body)
+		if err == nil || attempt == sendAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func post(target string, body []byte) error {
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
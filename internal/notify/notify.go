@@ -0,0 +1,338 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"server_app/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifications to people about problems that need attention, sent over email, Telegram
+// and Slack. The server reports conditions (a device is offline, weather fetches are
+// failing) while they hold, and one-off events (an OTA rollout failed); rules decide how
+// long a condition must last before each channel hears about it. Channels that were told
+// about a condition are told again when it clears. Conditions are saved, so a restart
+// neither alerts again about a device already reported offline nor forgets to resolve it.
+
+// Events that rules can match
+const (
+	DeviceOffline  = "device_offline"  // Condition, keyed by device ID
+	WeatherFailing = "weather_failing" // Condition, no successful weather fetch while fetches fail
+	OTAFailed      = "ota_failed"      // Event, keyed by job ID
+)
+
+// Channel names used in rules
+const (
+	ChannelEmail    = "email"
+	ChannelTelegram = "telegram"
+	ChannelSlack    = "slack"
+)
+
+var knownEvents = map[string]bool{DeviceOffline: true, WeatherFailing: true, OTAFailed: true}
+
+// Config holds the channels and rules. A channel is enabled once its required fields are set.
+type Config struct {
+	SMTP     SMTPConfig     `json:"smtp"`
+	Telegram TelegramConfig `json:"telegram"`
+	Slack    SlackConfig    `json:"slack"`
+	Rules    []Rule         `json:"rules"`
+}
+
+// Rule sends an event to channels once it has lasted AfterMinutes. Several rules for the
+// same event escalate, e.g. Slack after 30 minutes and email after 4 hours.
+type Rule struct {
+	Event        string   `json:"event"`
+	AfterMinutes int      `json:"afterMinutes"` // Ignored for one-off events
+	Channels     []string `json:"channels"`     // Empty = every enabled channel
+}
+
+// Message is one notification
+type Message struct {
+	Event    string    `json:"event"`
+	Key      string    `json:"key,omitempty"`
+	Title    string    `json:"title"`
+	Text     string    `json:"text,omitempty"`
+	Resolved bool      `json:"resolved,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Active is a condition currently holding, as reported by Status
+type Active struct {
+	Event    string    `json:"event"`
+	Key      string    `json:"key,omitempty"`
+	Title    string    `json:"title"`
+	Since    time.Time `json:"since"`
+	Notified []string  `json:"notified"` // Channels told so far
+}
+
+type condition struct {
+	since    time.Time
+	title    string
+	notified map[string]bool
+}
+
+// storedCondition is a condition as saved to storage
+type storedCondition struct {
+	Since    time.Time `json:"since"`
+	Title    string    `json:"title"`
+	Notified []string  `json:"notified,omitempty"`
+}
+
+var (
+	mu         sync.Mutex
+	channels   = make(map[string]channel)
+	rules      []Rule
+	conditions = make(map[string]*condition) // event + "/" + key
+	store      *storage.TypedManager[storedCondition]
+)
+
+// InitStorage loads the conditions saved by previous runs
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.NewTyped[storedCondition](dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to initialize alert storage: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, saved := range store.GetAll() {
+		c := &condition{since: saved.Since, title: saved.Title, notified: make(map[string]bool)}
+		for _, name := range saved.Notified {
+			c.notified[name] = true
+		}
+		conditions[id] = c
+	}
+	return nil
+}
+
+// saveLocked persists a condition. Caller holds mu.
+func saveLocked(id string, c *condition) {
+	if store == nil {
+		return
+	}
+	saved := storedCondition{Since: c.since, Title: c.title}
+	for name := range c.notified {
+		saved.Notified = append(saved.Notified, name)
+	}
+	sort.Strings(saved.Notified)
+	if err := store.Set(id, saved); err != nil {
+		fmt.Printf("Warning: failed to save alert condition %s: %v\n", id, err)
+	}
+}
+
+// deleteLocked forgets a saved condition. Caller holds mu.
+func deleteLocked(id string) {
+	if store == nil {
+		return
+	}
+	if err := store.Delete(id); err != nil {
+		fmt.Printf("Warning: failed to delete alert condition %s: %v\n", id, err)
+	}
+}
+
+// SetConfig replaces the channels and rules; notified conditions are kept
+func SetConfig(config Config) error {
+	enabled, err := buildChannels(config)
+	if err != nil {
+		return err
+	}
+	for _, r := range config.Rules {
+		if !knownEvents[r.Event] {
+			return fmt.Errorf("notification rule has unknown event %q", r.Event)
+		}
+		if r.AfterMinutes < 0 {
+			return fmt.Errorf("notification rule for %s has negative afterMinutes", r.Event)
+		}
+		for _, name := range r.Channels {
+			if name != ChannelEmail && name != ChannelTelegram && name != ChannelSlack {
+				return fmt.Errorf("notification rule for %s has unknown channel %q", r.Event, name)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	channels = enabled
+	rules = config.Rules
+	return nil
+}
+
+// Condition reports that a condition holds and has since the given time. Call it every
+// time the condition is checked; channels are notified as their rules' delays pass.
+func Condition(event string, key string, since time.Time, title string, text string) {
+	mu.Lock()
+	id := event + "/" + key
+	c, exists := conditions[id]
+	if !exists {
+		c = &condition{since: since, notified: make(map[string]bool)}
+		conditions[id] = c
+	}
+	changed := !exists || c.title != title
+	c.title = title
+	var due []string
+	for _, r := range rules {
+		if r.Event != event || time.Since(c.since) < time.Duration(r.AfterMinutes)*time.Minute {
+			continue
+		}
+		for _, name := range ruleChannelsLocked(r) {
+			if !c.notified[name] {
+				c.notified[name] = true
+				due = append(due, name)
+			}
+		}
+	}
+	if changed || len(due) > 0 {
+		saveLocked(id, c)
+	}
+	mu.Unlock()
+
+	send(due, Message{Event: event, Key: key, Title: title, Text: text, Time: time.Now()})
+}
+
+// Clear reports that a condition no longer holds, telling the channels that were notified
+func Clear(event string, key string, title string, text string) {
+	mu.Lock()
+	id := event + "/" + key
+	c, exists := conditions[id]
+	if !exists {
+		mu.Unlock()
+		return
+	}
+	delete(conditions, id)
+	deleteLocked(id)
+	var told []string
+	for name := range c.notified {
+		if channels[name] != nil {
+			told = append(told, name)
+		}
+	}
+	mu.Unlock()
+
+	sort.Strings(told)
+	send(told, Message{Event: event, Key: key, Title: title, Text: text, Resolved: true, Time: time.Now()})
+}
+
+// Fire sends a one-off event to the channels of every rule matching it
+func Fire(event string, key string, title string, text string) {
+	mu.Lock()
+	seen := make(map[string]bool)
+	var due []string
+	for _, r := range rules {
+		if r.Event != event {
+			continue
+		}
+		for _, name := range ruleChannelsLocked(r) {
+			if !seen[name] {
+				seen[name] = true
+				due = append(due, name)
+			}
+		}
+	}
+	mu.Unlock()
+
+	send(due, Message{Event: event, Key: key, Title: title, Text: text, Time: time.Now()})
+}
+
+// Status returns the enabled channels and the conditions currently holding
+func Status() ([]string, []Active) {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	active := make([]Active, 0, len(conditions))
+	for id, c := range conditions {
+		event, key, _ := strings.Cut(id, "/")
+		a := Active{Event: event, Key: key, Title: c.title, Since: c.since, Notified: []string{}}
+		for name := range c.notified {
+			a.Notified = append(a.Notified, name)
+		}
+		sort.Strings(a.Notified)
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Since.Before(active[j].Since) })
+	return names, active
+}
+
+// Test sends a message to every enabled channel right away and returns each channel's
+// error, nil on success
+func Test() map[string]error {
+	mu.Lock()
+	targets := make(map[string]channel, len(channels))
+	for name, ch := range channels {
+		targets[name] = ch
+	}
+	mu.Unlock()
+
+	m := withServer(Message{Event: "test", Title: "Test notification", Text: "Notifications from this server reach this channel.", Time: time.Now()})
+	results := make(map[string]error, len(targets))
+	for name, ch := range targets {
+		results[name] = ch.send(m)
+	}
+	return results
+}
+
+// ruleChannelsLocked lists the enabled channels a rule sends to. Caller holds mu.
+func ruleChannelsLocked(r Rule) []string {
+	var names []string
+	if len(r.Channels) == 0 {
+		for name := range channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, name := range r.Channels {
+		if channels[name] != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// send delivers m to the named channels in the background
+func send(names []string, m Message) {
+	if len(names) == 0 {
+		return
+	}
+	m = withServer(m)
+	mu.Lock()
+	targets := make([]channel, 0, len(names))
+	for _, name := range names {
+		if ch := channels[name]; ch != nil {
+			targets = append(targets, ch)
+		}
+	}
+	mu.Unlock()
+
+	state := "notifying"
+	if m.Resolved {
+		state = "resolved"
+	}
+	fmt.Printf("Notify: %s %q via %v\n", state, m.Title, names)
+	for _, ch := range targets {
+		go func(ch channel) {
+			if err := ch.send(m); err != nil {
+				fmt.Printf("Warning: failed to send %s notification %q: %v\n", ch.name(), m.Title, err)
+			}
+		}(ch)
+	}
+}
+
+// withServer adds the server's hostname so notifications from several servers can be told apart
+func withServer(m Message) Message {
+	if hostname, err := os.Hostname(); err == nil {
+		if m.Text != "" {
+			m.Text += "\n"
+		}
+		m.Text += "Server: " + hostname
+	}
+	return m
+}
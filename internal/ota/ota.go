@@ -0,0 +1,138 @@
+package ota
+
+import (
+	"fmt"
+	"server_app/internal/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latest firmware version per hardware type. Devices report their hardware type at bootup
+// ("hw"); each is offered the release for its type, or the default version (deviceVersion
+// in config.json) when its type has none, so boards on different firmware lines don't get
+// each other's updates.
+
+// Release is the latest firmware version for one hardware type
+type Release struct {
+	HardwareType string    `json:"hw_type"`
+	Version      uint16    `json:"version"`
+	Notes        string    `json:"notes,omitempty"`
+	Updated      time.Time `json:"updated"`
+}
+
+const storageKey = "releases"
+
+// Version of the stored layout (see storage.Migrate)
+const schemaVersion = 1
+
+var (
+	mu             sync.Mutex
+	releases       = make(map[string]Release)
+	defaultVersion = uint16(1)
+	store          *storage.Manager
+)
+
+// InitStorage loads the releases saved by previous runs
+func InitStorage(dataFilePath string) error {
+	var err error
+	store, err = storage.New(dataFilePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Migrate(schemaVersion, nil); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	var saved []Release
+	found, err := store.GetTyped(storageKey, &saved)
+	if err != nil {
+		return fmt.Errorf("failed to load firmware releases: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if found {
+		for _, r := range saved {
+			releases[r.HardwareType] = r
+		}
+	}
+	return nil
+}
+
+// SetDefault sets the version offered to hardware types without a release of their own
+func SetDefault(version uint16) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultVersion = version
+}
+
+// Default returns the version offered to hardware types without a release
+func Default() uint16 {
+	mu.Lock()
+	defer mu.Unlock()
+	return defaultVersion
+}
+
+// Latest returns the version to offer a device of hardwareType ("" = not reported)
+func Latest(hardwareType string) uint16 {
+	mu.Lock()
+	defer mu.Unlock()
+	if r, exists := releases[hardwareType]; exists {
+		return r.Version
+	}
+	return defaultVersion
+}
+
+// Publish records version as the latest release for hardwareType
+func Publish(hardwareType string, version uint16, notes string) (Release, error) {
+	if hardwareType == "" {
+		return Release{}, fmt.Errorf("hardware type is required")
+	}
+	if version == 0 {
+		return Release{}, fmt.Errorf("version must be positive")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	r := Release{HardwareType: hardwareType, Version: version, Notes: notes, Updated: time.Now()}
+	releases[hardwareType] = r
+	saveLocked()
+	return r, nil
+}
+
+// Remove forgets a hardware type's release; its devices get the default version again
+func Remove(hardwareType string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := releases[hardwareType]; !exists {
+		return false
+	}
+	delete(releases, hardwareType)
+	saveLocked()
+	return true
+}
+
+// Releases returns every per-type release, by hardware type
+func Releases() []Release {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Release, 0, len(releases))
+	for _, r := range releases {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].HardwareType < list[j].HardwareType })
+	return list
+}
+
+func saveLocked() {
+	if store == nil {
+		return
+	}
+	list := make([]Release, 0, len(releases))
+	for _, r := range releases {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].HardwareType < list[j].HardwareType })
+	if err := store.Set(storageKey, list); err != nil {
+		fmt.Printf("Warning: failed to save firmware releases: %v\n", err)
+	}
+}
@@ -0,0 +1,186 @@
+package rules
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rule turns a device indicator on while a telemetry metric is past a threshold
+// Exactly one of Above or Below must be set. Hysteresis keeps the rule from flapping:
+// an "above 65, hysteresis 3" rule turns on above 65 and only turns off again below 62.
+type Rule struct {
+	Name       string   `json:"name"`
+	Device     string   `json:"device"` // Source device reporting the metric
+	Metric     string   `json:"metric"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	Hysteresis float64  `json:"hysteresis"`
+	Target     string   `json:"target"`           // Display device showing the indicator
+	Indicator  uint8    `json:"indicator"`        // Icon/indicator ID understood by the target firmware
+	Notify     string   `json:"notify,omitempty"` // Text shown on the target's display when the rule turns on
+}
+
+// Trigger describes a rule changing state
+type Trigger struct {
+	Rule   Rule      `json:"rule"`
+	Active bool      `json:"active"`
+	Value  float64   `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+// Validate checks a rule definition
+func (r Rule) Validate() error {
+	if r.Name == "" || r.Device == "" || r.Metric == "" || r.Target == "" {
+		return fmt.Errorf("rule requires name, device, metric and target")
+	}
+	if (r.Above == nil) == (r.Below == nil) {
+		return fmt.Errorf("rule %s must set exactly one of above or below", r.Name)
+	}
+	if r.Hysteresis < 0 {
+		return fmt.Errorf("rule %s hysteresis must not be negative", r.Name)
+	}
+	return nil
+}
+
+// next returns the rule state after observing value, given the current state
+func (r Rule) next(active bool, value float64) bool {
+	if r.Above != nil {
+		if active {
+			return value >= *r.Above-r.Hysteresis
+		}
+		return value > *r.Above
+	}
+	if active {
+		return value <= *r.Below+r.Hysteresis
+	}
+	return value < *r.Below
+}
+
+var (
+	mu      sync.Mutex
+	rules   []Rule
+	active  = make(map[string]bool) // rule name -> currently triggered
+	handler func(Trigger)
+)
+
+// SetRules replaces the rule set; state is kept for rules whose name, target and indicator
+// are unchanged. Active rules that are removed (or moved to another target or indicator)
+// are turned off, so their indicator does not stay lit. Names must be unique.
+func SetRules(newRules []Rule) error {
+	names := make(map[string]bool, len(newRules))
+	for _, r := range newRules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule name %s is used more than once", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	mu.Lock()
+	kept := make(map[string]bool)
+	var cleared []Trigger
+	now := time.Now()
+	for _, old := range rules {
+		if !active[old.Name] {
+			continue
+		}
+		if r, exists := findRule(newRules, old.Name); exists && r.Target == old.Target && r.Indicator == old.Indicator {
+			kept[old.Name] = true
+		} else {
+			cleared = append(cleared, Trigger{Rule: old, Active: false, Time: now})
+		}
+	}
+	rules = newRules
+	active = kept
+	h := handler
+	mu.Unlock()
+
+	for _, t := range cleared {
+		fmt.Printf("Rule %s cleared (removed or changed)\n", t.Rule.Name)
+		if h != nil {
+			h(t)
+		}
+	}
+	return nil
+}
+
+func findRule(list []Rule, name string) (Rule, bool) {
+	for _, r := range list {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// OnTrigger registers the callback invoked when a rule turns on or off
+func OnTrigger(h func(Trigger)) {
+	mu.Lock()
+	defer mu.Unlock()
+	handler = h
+}
+
+// Evaluate runs every rule watching device/metric against a new reading
+func Evaluate(device string, metric string, value float64) {
+	mu.Lock()
+	var fired []Trigger
+	for _, r := range rules {
+		if r.Device != device || r.Metric != metric {
+			continue
+		}
+		was := active[r.Name]
+		now := r.next(was, value)
+		if now != was {
+			active[r.Name] = now
+			fired = append(fired, Trigger{Rule: r, Active: now, Value: value, Time: time.Now()})
+		}
+	}
+	h := handler
+	mu.Unlock()
+
+	for _, t := range fired {
+		state := "cleared"
+		if t.Active {
+			state = "triggered"
+		}
+		fmt.Printf("Rule %s %s (%s %s=%.2f)\n", t.Rule.Name, state, t.Rule.Device, t.Rule.Metric, t.Value)
+		if h != nil {
+			h(t)
+		}
+	}
+}
+
+// ActiveForTarget returns the currently triggered rules displaying on a target device
+func ActiveForTarget(target string) []Rule {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var result []Rule
+	for _, r := range rules {
+		if r.Target == target && active[r.Name] {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// RuleStatus pairs a rule with its current state
+type RuleStatus struct {
+	Rule
+	Active bool `json:"active"`
+}
+
+// Status returns every configured rule and whether it is currently triggered
+func Status() []RuleStatus {
+	mu.Lock()
+	defer mu.Unlock()
+
+	result := make([]RuleStatus, 0, len(rules))
+	for _, r := range rules {
+		result = append(result, RuleStatus{Rule: r, Active: active[r.Name]})
+	}
+	return result
+}
@@ -0,0 +1,221 @@
+package scenes
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scene is a named set of device states applied together, e.g. "movie night" dims the
+// living room displays, pauses their tickers and puts preset art on the shared canvas.
+// Scenes are activated through the admin API or by their triggers.
+type Scene struct {
+	Name     string            `json:"name"`
+	Devices  []string          `json:"devices"`            // Target group
+	Config   map[string]string `json:"config"`             // Merged into each target's config ("" deletes a key)
+	Canvas   []string          `json:"canvas,omitempty"`   // Shared canvas art: up to 16 rows of color letters
+	Triggers []Trigger         `json:"triggers,omitempty"` // Automatic activation
+
+	// Scheduled triggers also fire while the server is idle (e.g. porch lights at a
+	// vacation house); other scheduled scenes are suspended then
+	WhileIdle bool `json:"whileIdle,omitempty"`
+}
+
+// Trigger activates a scene. Set exactly one of At, Metric or Presence:
+//   - At: daily at this server-local "HH:MM"
+//   - Metric: telemetry from Device reporting the metric (a button press), optionally only
+//     with Value
+//   - Presence: Device going "online" or "offline"
+type Trigger struct {
+	At       string   `json:"at,omitempty"`
+	Device   string   `json:"device,omitempty"`
+	Metric   string   `json:"metric,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+	Presence string   `json:"presence,omitempty"`
+}
+
+// Presence trigger states
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// Run is the outcome of one activation
+type Run struct {
+	Scene      string    `json:"scene"`
+	Trigger    string    `json:"trigger"` // "api", "schedule", "telemetry" or "presence"
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	Failed     []string  `json:"failed,omitempty"`      // Devices that did not take the scene
+	RolledBack bool      `json:"rolled_back,omitempty"` // Targets were restored after a partial failure
+}
+
+const maxRuns = 50
+
+// Validate checks a scene definition
+func (s Scene) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("scene requires a name")
+	}
+	if len(s.Devices) == 0 && len(s.Canvas) == 0 {
+		return fmt.Errorf("scene %s needs devices or canvas art", s.Name)
+	}
+	if len(s.Config) > 0 && len(s.Devices) == 0 {
+		return fmt.Errorf("scene %s sets config but has no devices", s.Name)
+	}
+	for i, t := range s.Triggers {
+		set := 0
+		if t.At != "" {
+			set++
+			if _, err := time.Parse("15:04", t.At); err != nil {
+				return fmt.Errorf("scene %s trigger %d: invalid time %q", s.Name, i, t.At)
+			}
+		}
+		if t.Metric != "" {
+			set++
+		}
+		if t.Presence != "" {
+			set++
+			if t.Presence != PresenceOnline && t.Presence != PresenceOffline {
+				return fmt.Errorf("scene %s trigger %d: presence must be online or offline", s.Name, i)
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("scene %s trigger %d must set exactly one of at, metric or presence", s.Name, i)
+		}
+		if (t.Metric != "" || t.Presence != "") && t.Device == "" {
+			return fmt.Errorf("scene %s trigger %d needs a device", s.Name, i)
+		}
+	}
+	return nil
+}
+
+var (
+	mu      sync.Mutex
+	scenes  []Scene
+	runs    []Run
+	lastDue string // Minute the schedule was last checked, so each minute fires once
+)
+
+// SetScenes replaces the scene definitions
+func SetScenes(newScenes []Scene) error {
+	names := make(map[string]bool)
+	for _, s := range newScenes {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate scene %s", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	scenes = newScenes
+	return nil
+}
+
+// Get returns a scene by name
+func Get(name string) (Scene, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range scenes {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Scene{}, false
+}
+
+// List returns all scenes by name
+func List() []Scene {
+	mu.Lock()
+	defer mu.Unlock()
+	result := append([]Scene(nil), scenes...)
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Due returns scenes scheduled for the minute of now; while idle, only those marked
+// WhileIdle. Each minute is reported once.
+func Due(now time.Time, idle bool) []string {
+	minute := now.Format("15:04")
+	mu.Lock()
+	defer mu.Unlock()
+	if minute == lastDue {
+		return nil
+	}
+	lastDue = minute
+	names := matching(func(t Trigger) bool { return t.At == minute })
+	if !idle {
+		return names
+	}
+	var essential []string
+	for _, name := range names {
+		for _, s := range scenes {
+			if s.Name == name && s.WhileIdle {
+				essential = append(essential, name)
+			}
+		}
+	}
+	return essential
+}
+
+// ForReading returns scenes triggered by a telemetry reading
+func ForReading(device string, metric string, value float64) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return matching(func(t Trigger) bool {
+		return t.Device == device && t.Metric == metric && (t.Value == nil || *t.Value == value)
+	})
+}
+
+// ForPresence returns scenes triggered by a device going online or offline
+func ForPresence(device string, online bool) []string {
+	state := PresenceOffline
+	if online {
+		state = PresenceOnline
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return matching(func(t Trigger) bool { return t.Device == device && t.Presence == state })
+}
+
+// matching returns scenes with a trigger for which match is true. Caller holds mu.
+func matching(match func(Trigger) bool) []string {
+	var names []string
+	for _, s := range scenes {
+		for _, t := range s.Triggers {
+			if match(t) {
+				names = append(names, s.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Record keeps the outcome of an activation
+func Record(run Run) {
+	mu.Lock()
+	defer mu.Unlock()
+	runs = append(runs, run)
+	if len(runs) > maxRuns {
+		runs = runs[len(runs)-maxRuns:]
+	}
+}
+
+// Runs returns recent activations, newest first
+func Runs() []Run {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make([]Run, len(runs))
+	for i, run := range runs {
+		result[len(runs)-1-i] = run
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"server_app/internal/faults"
+)
+
+// backend persists a Manager's data. Each write passes the complete data set as well as
+// the keys that changed, so whole-file backends can rewrite everything and row-based ones
+// can touch only those keys.
+type backend interface {
+	load() (map[string]interface{}, error)
+	set(all map[string]interface{}, key string) error
+	delete(all map[string]interface{}, key string) error
+	batch(all map[string]interface{}, keys []string) error // Keys set or deleted (absent from all)
+	replace(all map[string]interface{}) error
+}
+
+// fileBackend stores everything as one JSON file, rewritten on every change
+type fileBackend struct {
+	path   string
+	locked error // Set when the file could not be decrypted; it is never written then
+}
+
+func (f *fileBackend) set(all map[string]interface{}, key string) error {
+	return f.replace(all)
+}
+
+func (f *fileBackend) delete(all map[string]interface{}, key string) error {
+	return f.replace(all)
+}
+
+func (f *fileBackend) batch(all map[string]interface{}, keys []string) error {
+	return f.replace(all)
+}
+
+func (f *fileBackend) replace(all map[string]interface{}) error {
+	if f.locked != nil {
+		return f.locked
+	}
+	faults.DelayStorageWrite()
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+	if data, err = encryptFile(data); err != nil {
+		return err
+	}
+	return f.writeFile(data)
+}
+
+// writeFile replaces the file's contents atomically
+func (f *fileBackend) writeFile(data []byte) error {
+	// Write to temp file first, then rename (atomic operation)
+	tmpFile := f.path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	if err := os.Rename(tmpFile, f.path); err != nil {
+		os.Remove(tmpFile) // cleanup
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+
+	return nil
+}
+
+func (f *fileBackend) load() (map[string]interface{}, error) {
+	data, err := readJSONFile(f.path)
+	if errors.Is(err, errCorrupt) {
+		return recoverFile(f, err)
+	}
+	if errors.Is(err, ErrKey) {
+		f.locked = fmt.Errorf("%s is %v; not overwriting it", f.path, err)
+		noteLocked(f.path)
+		fmt.Printf("ERROR: storage file %s is %v; its data is unavailable and it will not be written until the right key is set\n", f.path, err)
+	}
+	if err == nil && Encrypting() && staleFile(f.path) {
+		// Encrypt files written before the key was set (or in the first encrypted format)
+		// rather than waiting for a change
+		if err := f.replace(data); err != nil {
+			fmt.Printf("Warning: failed to encrypt %s: %v\n", f.path, err)
+		} else {
+			fmt.Printf("Storage: encrypted %s\n", f.path)
+		}
+	}
+	return data, err
+}
+
+// readJSONFile reads a storage file; a missing file is an empty data set
+func readJSONFile(path string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil // file doesn't exist yet, that's ok
+		}
+		return data, err
+	}
+	if raw, err = decryptFile(raw); err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return make(map[string]interface{}), fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return data, nil
+}
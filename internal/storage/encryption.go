@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encryption at rest: with a key set (SetEncryptionKey) storage files are written as
+// AES-256-GCM ciphertext behind a short header, so data on a pulled SD card is unreadable
+// without the key:
+//
+//	[header "CDSENC2\n"][salt (16)][key id (8)][nonce (12)][ciphertext + tag]
+//
+// The AES key is derived from the secret with scrypt and the salt. Each file carries its
+// salt, so backups and quarantined copies open with the secret alone. The key id tells a
+// missing or different key apart from a damaged file. Plaintext files and files from the
+// first format (SHA-256 key, header "CDSENC1\n") still load and are rewritten.
+
+const encryptedHeader = "CDSENC2\n"
+
+// Header of files encrypted before the key was derived with scrypt
+const legacyHeader = "CDSENC1\n"
+
+// Prefix of an encrypted line in a JSON-lines file (base64 of salt, key id, nonce and
+// ciphertext), and of lines from the first format
+const (
+	encryptedLinePrefix = "enc2:"
+	legacyLinePrefix    = "enc1:"
+)
+
+const (
+	keyIDSize = 8
+	saltSize  = 16
+)
+
+// scrypt cost: about 32 MiB and a fraction of a second on a Pi, paid once per salt
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrKey is returned for data encrypted with a key that is not set
+var ErrKey = errors.New("encrypted with a different key")
+
+// errNoKey is ErrKey when no key is set at all
+var errNoKey error = noKeyError{}
+
+type noKeyError struct{}
+
+func (noKeyError) Error() string        { return "encrypted and no storage key is set" }
+func (noKeyError) Is(target error) bool { return target == ErrKey }
+
+// sealKey is the cipher for one salt
+type sealKey struct {
+	aead cipher.AEAD
+	id   []byte
+}
+
+var (
+	encryptionMu     sync.RWMutex
+	encryptionSecret []byte
+	encryptionSalt   []byte              // Salt of files written from now on
+	derivedKeys      map[string]*sealKey // By salt
+	legacyKey        *sealKey
+
+	lockedMu    sync.Mutex
+	lockedFiles []string
+)
+
+// SetEncryptionKey encrypts storage files written from now on with a key derived from
+// secret (scrypt), and lets encrypted files be read. The salt is kept in saltFile, created
+// on first use; with saltFile "" a new salt is used for this process only. An empty secret
+// turns encryption off; files already encrypted then stay unreadable.
+func SetEncryptionKey(secret []byte, saltFile string) error {
+	if len(secret) == 0 {
+		encryptionMu.Lock()
+		defer encryptionMu.Unlock()
+		encryptionSecret, encryptionSalt, derivedKeys, legacyKey = nil, nil, nil, nil
+		return nil
+	}
+	salt, err := loadSalt(saltFile)
+	if err != nil {
+		return err
+	}
+	current, err := deriveKey(secret, salt)
+	if err != nil {
+		return err
+	}
+	legacy := sha256.Sum256(secret)
+	old, err := newSealKey(legacy[:])
+	if err != nil {
+		return err
+	}
+
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	encryptionSecret = append([]byte(nil), secret...)
+	encryptionSalt = salt
+	derivedKeys = map[string]*sealKey{string(salt): current}
+	legacyKey = old
+	return nil
+}
+
+// loadSalt reads the salt from path, creating the file with a random salt if it is missing
+func loadSalt(path string) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			salt, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(salt) != saltSize {
+				return nil, fmt.Errorf("storage salt file %s is invalid", path)
+			}
+			return salt, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read storage salt: %v", err)
+		}
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	if path == "" {
+		return salt, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage salt: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(salt)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write storage salt: %v", err)
+	}
+	return salt, nil
+}
+
+// deriveKey runs scrypt over secret and salt
+func deriveKey(secret []byte, salt []byte) (*sealKey, error) {
+	key, err := scrypt.Key(secret, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive storage key: %v", err)
+	}
+	return newSealKey(key)
+}
+
+func newSealKey(key []byte) (*sealKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(append([]byte("cds-storage-key-id:"), key...))
+	return &sealKey{aead: aead, id: id[:keyIDSize]}, nil
+}
+
+// keyForSalt returns the cipher for data sealed with salt, deriving it on first use
+func keyForSalt(salt []byte) (*sealKey, error) {
+	encryptionMu.RLock()
+	k, secret := derivedKeys[string(salt)], encryptionSecret
+	encryptionMu.RUnlock()
+	if k != nil {
+		return k, nil
+	}
+	if secret == nil {
+		return nil, errNoKey
+	}
+	k, err := deriveKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	if derivedKeys == nil {
+		return nil, errNoKey // Key removed meanwhile
+	}
+	derivedKeys[string(salt)] = k
+	return k, nil
+}
+
+// Encrypting reports whether a key is set
+func Encrypting() bool {
+	encryptionMu.RLock()
+	defer encryptionMu.RUnlock()
+	return encryptionSecret != nil
+}
+
+// LockedFiles returns the storage files that could not be decrypted since startup. Their
+// stores start empty and refuse writes, so the files are never overwritten.
+func LockedFiles() []string {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	return append([]string(nil), lockedFiles...)
+}
+
+func noteLocked(path string) {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	lockedFiles = append(lockedFiles, path)
+}
+
+// seal encrypts data when a key is set; the result starts with the salt and key id
+func seal(data []byte) ([]byte, bool, error) {
+	encryptionMu.RLock()
+	salt := encryptionSalt
+	k := derivedKeys[string(salt)]
+	encryptionMu.RUnlock()
+	if k == nil {
+		return data, false, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, false, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	out := append(append(append([]byte(nil), salt...), k.id...), nonce...)
+	return k.aead.Seal(out, nonce, data, out[:saltSize+keyIDSize]), true, nil
+}
+
+// open decrypts the output of seal; a different key gives ErrKey, damage errCorrupt
+func open(sealed []byte) ([]byte, error) {
+	if len(sealed) < saltSize {
+		return nil, fmt.Errorf("%w: encrypted data is truncated", errCorrupt)
+	}
+	k, err := keyForSalt(sealed[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return openWith(k, sealed[saltSize:], sealed[:saltSize+keyIDSize])
+}
+
+// openLegacy decrypts data sealed with the SHA-256 key of the first format
+func openLegacy(sealed []byte) ([]byte, error) {
+	encryptionMu.RLock()
+	k := legacyKey
+	encryptionMu.RUnlock()
+	if k == nil {
+		return nil, errNoKey
+	}
+	if len(sealed) < keyIDSize {
+		return nil, fmt.Errorf("%w: encrypted data is truncated", errCorrupt)
+	}
+	return openWith(k, sealed, sealed[:keyIDSize])
+}
+
+// openWith opens [key id][nonce][ciphertext + tag] with k
+func openWith(k *sealKey, sealed []byte, additional []byte) ([]byte, error) {
+	aead := k.aead
+	if len(sealed) < keyIDSize+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: encrypted data is truncated", errCorrupt)
+	}
+	if !bytes.Equal(sealed[:keyIDSize], k.id) {
+		return nil, ErrKey
+	}
+	nonce := sealed[keyIDSize : keyIDSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[keyIDSize+aead.NonceSize():], additional)
+	if err != nil {
+		return nil, fmt.Errorf("%w: encrypted data does not authenticate", errCorrupt)
+	}
+	return plain, nil
+}
+
+// encryptFile wraps a file's contents for writing
+func encryptFile(data []byte) ([]byte, error) {
+	sealed, encrypted, err := seal(data)
+	if err != nil || !encrypted {
+		return sealed, err
+	}
+	return append([]byte(encryptedHeader), sealed...), nil
+}
+
+// decryptFile unwraps a file's contents; plaintext passes through
+func decryptFile(raw []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(raw, []byte(encryptedHeader)):
+		return open(raw[len(encryptedHeader):])
+	case bytes.HasPrefix(raw, []byte(legacyHeader)):
+		return openLegacy(raw[len(legacyHeader):])
+	}
+	return raw, nil
+}
+
+// staleFile reports whether path exists and is plaintext or in the first encrypted format
+func staleFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(encryptedHeader))
+	n, _ := io.ReadFull(f, header)
+	return n > 0 && string(header[:n]) != encryptedHeader
+}
+
+// encryptCopy rewrites a copy of a storage file (a backup or quarantined file) encrypted
+// with the current key, if it is not already. Its contents are sealed as they are, so
+// copies that do not parse are kept byte for byte.
+func encryptCopy(path string) (bool, error) {
+	if !Encrypting() || !staleFile(path) {
+		return false, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if raw, err = decryptFile(raw); err != nil {
+		return false, err
+	}
+	if raw, err = encryptFile(raw); err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// CopyFile copies a storage file to dst, encrypted when a key is set (a file written before
+// the key was set is encrypted in the copy). A missing src copies nothing.
+func CopyFile(src string, dst string) error {
+	raw, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		return nil // Storage not created yet, nothing to copy
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", src, err)
+	}
+	if Encrypting() && staleFile(src) {
+		if raw, err = decryptFile(raw); err != nil {
+			return fmt.Errorf("failed to read %s: %v", src, err)
+		}
+		if raw, err = encryptFile(raw); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(dst, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", dst, err)
+	}
+	return nil
+}
+
+// EncryptCopies encrypts the backups and quarantined (.corrupt) copies of the given
+// storage files that are plaintext or in the first encrypted format, and returns how many
+// were rewritten. Copies that cannot be decrypted are left alone.
+func EncryptCopies(files []string) int {
+	if !Encrypting() {
+		return 0
+	}
+	recoveryMu.Lock()
+	dir := backupDir
+	recoveryMu.Unlock()
+
+	encrypted := 0
+	for _, file := range files {
+		copies, _ := filepath.Glob(file + ".corrupt-*")
+		if dir != "" {
+			backups, _ := filepath.Glob(filepath.Join(dir, "*", filepath.Base(file)))
+			copies = append(copies, backups...)
+		}
+		for _, path := range copies {
+			done, err := encryptCopy(path)
+			if err != nil {
+				fmt.Printf("Warning: failed to encrypt %s: %v\n", path, err)
+				continue
+			}
+			if done {
+				encrypted++
+			}
+		}
+	}
+	if encrypted > 0 {
+		fmt.Printf("Storage: encrypted %d backup or quarantined file(s)\n", encrypted)
+	}
+	return encrypted
+}
+
+// EncryptLine encrypts one line of a JSON-lines file when a key is set (without the
+// newline; the result has none either)
+func EncryptLine(line []byte) ([]byte, error) {
+	sealed, encrypted, err := seal(line)
+	if err != nil || !encrypted {
+		return sealed, err
+	}
+	out := make([]byte, len(encryptedLinePrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(out, encryptedLinePrefix)
+	base64.StdEncoding.Encode(out[len(encryptedLinePrefix):], sealed)
+	return out, nil
+}
+
+// IsEncryptedLine reports whether a line was written by EncryptLine with a key set, in the
+// current format (lines of the first format should be rewritten)
+func IsEncryptedLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(encryptedLinePrefix))
+}
+
+// DecryptLine reverses EncryptLine; plaintext lines pass through. Errors wrap ErrKey when
+// the line was encrypted with a key that is not set.
+func DecryptLine(line []byte) ([]byte, error) {
+	prefix, opener := encryptedLinePrefix, open
+	if bytes.HasPrefix(line, []byte(legacyLinePrefix)) {
+		prefix, opener = legacyLinePrefix, openLegacy
+	} else if !IsEncryptedLine(line) {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return opener(sealed)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptionEnvelope(t *testing.T) {
+	dir := t.TempDir()
+	saltFile := filepath.Join(dir, "salt")
+	if err := SetEncryptionKey([]byte("correct horse"), saltFile); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEncryptionKey(nil, "")
+
+	plain := []byte(`{"lamp":{"approved":true}}`)
+	raw, err := encryptFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(encryptedHeader)) || bytes.Contains(raw, []byte("lamp")) {
+		t.Fatalf("file not encrypted: %q", raw)
+	}
+	path := filepath.Join(dir, "devices.json")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := readJSONFile(path)
+	if err != nil || data["lamp"] == nil {
+		t.Fatalf("round trip: got %v (%v)", data, err)
+	}
+
+	line, err := EncryptLine([]byte(`{"event":"boot"}`))
+	if err != nil || !IsEncryptedLine(line) || bytes.ContainsRune(line, '\n') {
+		t.Fatalf("EncryptLine: got %q (%v)", line, err)
+	}
+	if got, err := DecryptLine(line); err != nil || string(got) != `{"event":"boot"}` {
+		t.Errorf("DecryptLine: got %q (%v)", got, err)
+	}
+
+	// The salt file keeps the key the same across restarts
+	if err := SetEncryptionKey([]byte("correct horse"), saltFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readJSONFile(path); err != nil {
+		t.Errorf("same secret after a restart: %v", err)
+	}
+
+	if err := SetEncryptionKey([]byte("wrong"), filepath.Join(dir, "other-salt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readJSONFile(path); !errors.Is(err, ErrKey) {
+		t.Errorf("wrong key: got %v, want ErrKey", err)
+	}
+	if _, err := DecryptLine(line); !errors.Is(err, ErrKey) {
+		t.Errorf("wrong key for a line: got %v, want ErrKey", err)
+	}
+
+	SetEncryptionKey(nil, "")
+	if _, err := readJSONFile(path); !errors.Is(err, ErrKey) {
+		t.Errorf("no key: got %v, want ErrKey", err)
+	}
+	if got, err := EncryptLine(plain); err != nil || !bytes.Equal(got, plain) || IsEncryptedLine(got) {
+		t.Errorf("line without a key: got %q (%v)", got, err)
+	}
+}
+
+// Damage is told apart from a different key
+func TestEncryptionCorrupt(t *testing.T) {
+	if err := SetEncryptionKey([]byte("correct horse"), ""); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEncryptionKey(nil, "")
+
+	raw, err := encryptFile([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xFF
+	if _, err := decryptFile(raw); !errors.Is(err, errCorrupt) {
+		t.Errorf("damaged file: got %v, want errCorrupt", err)
+	}
+	if _, err := decryptFile(raw[:len(encryptedHeader)+4]); !errors.Is(err, errCorrupt) {
+		t.Errorf("truncated file: got %v, want errCorrupt", err)
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Exports carry the contents of several stores in one file, for moving a server's data to
+// another machine. The format is versioned; a newer server keeps reading older versions.
+const (
+	ExportFormat  = "connected-devices-storage"
+	ExportVersion = 1
+)
+
+// Export is the contents of a set of stores by name
+type Export struct {
+	Format  string                                `json:"format"`
+	Version int                                   `json:"version"`
+	Created time.Time                             `json:"created"`
+	Build   string                                `json:"build,omitempty"` // "debug" or "production"
+	Stores  map[string]map[string]json.RawMessage `json:"stores"`
+}
+
+// Dump returns every stored key, including the expiry times of TTL keys and the schema
+// version; keys that have already expired are left out
+func (m *Manager) Dump() (map[string]json.RawMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]json.RawMessage, len(m.data))
+	for k, v := range m.data {
+		if !reserved(k) && !m.live(k, now) {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %v", k, err)
+		}
+		result[k] = raw
+	}
+	return result, nil
+}
+
+// Restore replaces the stored data with a dump and writes it out immediately. A dump
+// without a schema version predates versioning and is migrated from version 1 at startup.
+func (m *Manager) Restore(dump map[string]json.RawMessage) error {
+	data := make(map[string]interface{}, len(dump)+1)
+	for k, v := range dump {
+		data[k] = v
+	}
+	if _, exists := data[schemaKey]; !exists {
+		data[schemaKey] = unversioned
+	}
+	if err := m.Replace(data); err != nil {
+		return err
+	}
+	return m.Flush()
+}
+
+// WriteExport writes an export file atomically
+func WriteExport(path string, e Export) error {
+	e.Format, e.Version = ExportFormat, ExportVersion
+	if e.Created.IsZero() {
+		e.Created = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(e, "", "  ") // Keys come out sorted, so exports diff cleanly
+	if err != nil {
+		return fmt.Errorf("failed to marshal export: %v", err)
+	}
+	return (&fileBackend{path: path}).writeFile(data)
+}
+
+// ReadExport reads and checks an export file
+func ReadExport(path string) (Export, error) {
+	var e Export
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return e, fmt.Errorf("%s is not a storage export: %v", path, err)
+	}
+	if e.Format != ExportFormat {
+		return e, fmt.Errorf("%s is not a storage export (format %q)", path, e.Format)
+	}
+	if e.Version < 1 || e.Version > ExportVersion {
+		return e, fmt.Errorf("%s has export version %d, this server reads up to %d", path, e.Version, ExportVersion)
+	}
+	return e, nil
+}
@@ -2,17 +2,100 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
-// Manager handles generic JSON file storage with atomic writes
+// Manager keeps a key/value data set in memory and persists every change, either to a
+// JSON file with atomic writes or, after UseSQLite, to a store in the shared database
+// (after UseMemory, not at all).
+// With write coalescing (SetWriteCoalescing) changes are collected and written together.
+// Keys stored with SetWithTTL are removed in the background once they expire. Watch
+// reports every change as it happens.
 type Manager struct {
 	mu       sync.RWMutex
 	dataFile string
 	data     map[string]interface{}
+	backend  backend
+	expires  map[string]time.Time // Expiry of keys stored with a TTL, persisted under expiresKey
+	frozen   error                // Set for data of a newer schema version; it is never written then
+
+	// Values decoded by a TypedManager; entries are dropped when their key changes
+	cacheMu sync.Mutex
+	cache   map[string]interface{}
+
+	// Change watchers (Watch) and the changes waiting to be delivered to them
+	watchMu    sync.Mutex
+	watchers   []watcher
+	nextWatch  uint64
+	outbox     []Change
+	delivering bool
+	unwritten  []Change // Changes not yet written, held back until they are (guarded by mu)
+
+	// Changes not yet written (coalescing only)
+	changed  map[string]bool // Keys set or deleted since the last write
+	replaced bool            // The whole data set was replaced
+	changes  int
+	timer    *time.Timer
+}
+
+// Changes written at once when SetWriteCoalescing is not given a limit
+const defaultFlushMaxChanges = 100
+
+// Reserved key holding the expiry times of TTL keys; hidden from Get and GetAll
+const expiresKey = "_expires"
+
+// How often expired keys are removed
+const expirySweepInterval = time.Minute
+
+var expirySweep sync.Once
+
+// Write coalescing settings shared by all managers
+var (
+	coalesceMu      sync.Mutex
+	flushInterval   time.Duration // 0 = write every change synchronously
+	flushMaxChanges = defaultFlushMaxChanges
+	managers        []*Manager
+)
+
+// SetWriteCoalescing makes changes wait up to interval (or until maxChanges pile up) and
+// then go out in one write. An interval of 0 writes every change synchronously, as before.
+// Pending changes are written by Flush/FlushAll; call FlushAll before exiting.
+func SetWriteCoalescing(interval time.Duration, maxChanges int) {
+	if maxChanges <= 0 {
+		maxChanges = defaultFlushMaxChanges
+	}
+	coalesceMu.Lock()
+	flushInterval, flushMaxChanges = interval, maxChanges
+	coalesceMu.Unlock()
+	if interval <= 0 {
+		FlushAll()
+	}
+}
+
+func coalescing() (time.Duration, int) {
+	coalesceMu.Lock()
+	defer coalesceMu.Unlock()
+	return flushInterval, flushMaxChanges
+}
+
+// FlushAll writes the pending changes of every manager
+func FlushAll() error {
+	coalesceMu.Lock()
+	all := append([]*Manager(nil), managers...)
+	coalesceMu.Unlock()
+
+	var firstErr error
+	for _, m := range all {
+		if err := m.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // New creates a new storage manager for a given file
@@ -20,28 +103,87 @@ func New(dataFilePath string) (*Manager, error) {
 	m := &Manager{
 		dataFile: dataFilePath,
 		data:     make(map[string]interface{}),
+		backend:  &fileBackend{path: dataFilePath},
+		expires:  make(map[string]time.Time),
+		changed:  make(map[string]bool),
+		cache:    make(map[string]interface{}),
+	}
+	if conn := SQLiteDB(); conn != nil {
+		m.backend = newSQLiteBackend(conn, dataFilePath)
 	}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(dataFilePath), 0755); err != nil {
+	if InMemory() {
+		m.backend = &memoryBackend{path: dataFilePath}
+	} else if err := os.MkdirAll(filepath.Dir(dataFilePath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
 	// Load existing data
-	if err := m.load(); err != nil {
+	if err := m.load(); err != nil && !errors.Is(err, ErrKey) {
 		fmt.Printf("Note: creating new storage file at %s\n", dataFilePath)
 	}
 
+	coalesceMu.Lock()
+	managers = append(managers, m)
+	coalesceMu.Unlock()
+	if len(m.expires) > 0 {
+		startExpirySweep()
+	}
 	return m, nil
 }
 
 // Set stores a key-value pair
 func (m *Manager) Set(key string, value interface{}) error {
+	// Keep a snapshot, so a write made later does not see the caller's later edits
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := m.data[key]
+	m.data[key] = json.RawMessage(raw)
+	m.queueChange(key, before)
+	if _, hadTTL := m.expires[key]; hadTTL {
+		delete(m.expires, key)
+		return m.noteChange(key, m.storeExpiries())
+	}
+	return m.noteChange(key)
+}
+
+// SetWithTTL stores a key-value pair that is removed once ttl passes without it being set
+// again. A ttl of 0 or less stores it without expiry, like Set.
+func (m *Manager) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return m.Set(key, value)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+	startExpirySweep()
+
+	defer m.deliver() // After unlocking
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.data[key] = value
-	return m.save()
+	before := m.data[key]
+	m.data[key] = json.RawMessage(raw)
+	m.queueChange(key, before)
+	m.expires[key] = time.Now().Add(ttl)
+	return m.noteChange(key, m.storeExpiries())
+}
+
+// Expires returns when a key stored with a TTL expires; false if it has no expiry
+func (m *Manager) Expires(key string) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	at, exists := m.expires[key]
+	return at, exists
 }
 
 // Get retrieves a value by key
@@ -49,6 +191,9 @@ func (m *Manager) Get(key string) (interface{}, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	if !m.live(key, time.Now()) {
+		return nil, false
+	}
 	val, exists := m.data[key]
 	return val, exists
 }
@@ -59,7 +204,7 @@ func (m *Manager) GetTyped(key string, v interface{}) (bool, error) {
 	defer m.mu.RUnlock()
 
 	val, exists := m.data[key]
-	if !exists {
+	if !exists || !m.live(key, time.Now()) {
 		return false, nil
 	}
 
@@ -82,66 +227,287 @@ func (m *Manager) GetAll() map[string]interface{} {
 	defer m.mu.RUnlock()
 
 	// Return a copy
+	now := time.Now()
 	result := make(map[string]interface{})
 	for k, v := range m.data {
-		result[k] = v
+		if m.live(k, now) {
+			result[k] = v
+		}
 	}
 	return result
 }
 
 // Delete removes a key
 func (m *Manager) Delete(key string) error {
+	defer m.deliver() // After unlocking
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	before := m.data[key]
 	delete(m.data, key)
-	return m.save()
+	m.queueChange(key, before)
+	if _, hadTTL := m.expires[key]; hadTTL {
+		delete(m.expires, key)
+		return m.noteChange(key, m.storeExpiries())
+	}
+	return m.noteChange(key)
+}
+
+// Replace swaps in a complete data set with a single file write. The schema version is
+// kept unless data sets one.
+func (m *Manager) Replace(data map[string]interface{}) error {
+	snapshot := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal data: %v", err)
+		}
+		snapshot[k] = json.RawMessage(raw)
+	}
+
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := snapshot[schemaKey]; !exists {
+		if version, stamped := m.data[schemaKey]; stamped {
+			snapshot[schemaKey] = version
+		}
+	}
+	before := m.data
+	m.data = snapshot
+	m.queueDiff(before)
+	m.loadExpiries()
+	return m.noteReplace()
 }
 
-// Clear removes all data
+// Clear removes all data but the schema version
 func (m *Manager) Clear() error {
+	defer m.deliver() // After unlocking
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	before := m.data
+	version, stamped := m.data[schemaKey]
 	m.data = make(map[string]interface{})
-	return m.save()
+	if stamped {
+		m.data[schemaKey] = version
+	}
+	m.queueDiff(before)
+	m.expires = make(map[string]time.Time)
+	return m.noteReplace()
+}
+
+// Flush writes pending changes now
+func (m *Manager) Flush() error {
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushLocked()
 }
 
 // Private methods
 
-func (m *Manager) save() error {
-	data, err := json.MarshalIndent(m.data, "", "  ")
+func (m *Manager) load() error {
+	data, err := m.backend.load()
+	m.data = data
+	m.loadExpiries()
+	return err
+}
+
+// live reports whether key is visible: not a reserved key and not expired. Caller holds mu.
+func (m *Manager) live(key string, now time.Time) bool {
+	if reserved(key) {
+		return false
+	}
+	at, hasTTL := m.expires[key]
+	return !hasTTL || now.Before(at)
+}
+
+// loadExpiries reads the expiry times stored with the data. Caller holds mu.
+func (m *Manager) loadExpiries() {
+	m.expires = make(map[string]time.Time)
+	val, exists := m.data[expiresKey]
+	if !exists {
+		return
+	}
+	raw, err := json.Marshal(val)
+	if err == nil {
+		err = json.Unmarshal(raw, &m.expires)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal data: %v", err)
+		fmt.Printf("Warning: ignoring unreadable expiry times in %s: %v\n", m.dataFile, err)
+		m.expires = make(map[string]time.Time)
 	}
+}
 
-	// Write to temp file first, then rename (atomic operation)
-	tmpFile := m.dataFile + ".tmp"
-	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+// storeExpiries puts the expiry times into the data set and returns their key. Caller holds mu.
+func (m *Manager) storeExpiries() string {
+	if len(m.expires) == 0 {
+		delete(m.data, expiresKey)
+		return expiresKey
 	}
+	raw, _ := json.Marshal(m.expires) // A map of times always marshals
+	m.data[expiresKey] = json.RawMessage(raw)
+	return expiresKey
+}
 
-	if err := os.Rename(tmpFile, m.dataFile); err != nil {
-		os.Remove(tmpFile) // cleanup
-		return fmt.Errorf("failed to rename file: %v", err)
+// expire removes keys whose TTL has passed
+func (m *Manager) expire(now time.Time) error {
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key, at := range m.expires {
+		if !now.Before(at) {
+			before := m.data[key]
+			delete(m.data, key)
+			m.queueChange(key, before)
+			delete(m.expires, key)
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
 	}
+	fmt.Printf("Storage: expired %d key(s) from %s\n", len(keys), m.dataFile)
+	return m.noteChange(append(keys, m.storeExpiries())...)
+}
 
-	return nil
+// startExpirySweep starts removing expired keys from every manager, once
+func startExpirySweep() {
+	expirySweep.Do(func() {
+		go func() {
+			ticker := time.NewTicker(expirySweepInterval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				coalesceMu.Lock()
+				all := append([]*Manager(nil), managers...)
+				coalesceMu.Unlock()
+				for _, m := range all {
+					if err := m.expire(now); err != nil {
+						fmt.Printf("Warning: failed to remove expired keys from %s: %v\n", m.dataFile, err)
+					}
+				}
+			}
+		}()
+	})
 }
 
-func (m *Manager) load() error {
-	data, err := os.ReadFile(m.dataFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // file doesn't exist yet, that's ok
+// noteChange writes keys now, or records them for the next coalesced write. Caller holds mu.
+func (m *Manager) noteChange(keys ...string) error {
+	m.cacheMu.Lock()
+	for _, key := range keys {
+		delete(m.cache, key)
+	}
+	m.cacheMu.Unlock()
+	if m.frozen != nil {
+		m.unwritten = nil // Never written, so never reported
+		return m.frozen
+	}
+	interval, _ := coalescing()
+	if interval <= 0 && m.changes == 0 {
+		var err error
+		if len(keys) > 1 {
+			err = m.backend.batch(m.data, keys)
+		} else if _, exists := m.data[keys[0]]; exists {
+			err = m.backend.set(m.data, keys[0])
+		} else {
+			err = m.backend.delete(m.data, keys[0])
+		}
+		if err != nil {
+			// Retried with the next write (or Flush), like a coalesced change
+			for _, key := range keys {
+				m.changed[key] = true
+			}
+			m.changes++
 		}
-		return err
+		return m.written(err)
 	}
+	for _, key := range keys {
+		m.changed[key] = true
+	}
+	return m.pending(interval)
+}
 
-	m.data = make(map[string]interface{})
-	if err := json.Unmarshal(data, &m.data); err != nil {
-		return fmt.Errorf("failed to unmarshal data: %v", err)
+// noteReplace writes the data set now, or records it for the next coalesced write. Caller holds mu.
+func (m *Manager) noteReplace() error {
+	m.cacheMu.Lock()
+	m.cache = make(map[string]interface{})
+	m.cacheMu.Unlock()
+	if m.frozen != nil {
+		m.unwritten = nil // Never written, so never reported
+		return m.frozen
 	}
+	interval, _ := coalescing()
+	if interval <= 0 && m.changes == 0 {
+		err := m.backend.replace(m.data)
+		if err != nil {
+			// Retried with the next write (or Flush), like a coalesced change
+			m.replaced = true
+			m.changed = make(map[string]bool)
+			m.changes++
+		}
+		return m.written(err)
+	}
+	m.replaced = true
+	m.changed = make(map[string]bool)
+	return m.pending(interval)
+}
 
+// pending counts a recorded change, writing once enough piled up and otherwise making
+// sure a write is scheduled. Caller holds mu.
+func (m *Manager) pending(interval time.Duration) error {
+	_, maxChanges := coalescing()
+	m.changes++
+	if interval <= 0 || m.changes >= maxChanges {
+		return m.flushLocked()
+	}
+	if m.timer == nil {
+		m.timer = time.AfterFunc(interval, m.flushScheduled)
+	}
 	return nil
 }
+
+func (m *Manager) flushScheduled() {
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timer = nil
+	if err := m.flushLocked(); err != nil {
+		fmt.Printf("Warning: failed to write %s: %v\n", m.dataFile, err)
+		if interval, _ := coalescing(); interval > 0 {
+			m.timer = time.AfterFunc(interval, m.flushScheduled) // Retry; changes stay pending
+		}
+	}
+}
+
+// flushLocked writes the recorded changes. Caller holds mu.
+func (m *Manager) flushLocked() error {
+	if m.changes == 0 {
+		return nil
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	var err error
+	if m.replaced {
+		err = m.backend.replace(m.data)
+	} else {
+		keys := make([]string, 0, len(m.changed))
+		for key := range m.changed {
+			keys = append(keys, key)
+		}
+		err = m.backend.batch(m.data, keys)
+	}
+	if err != nil {
+		return err // Changes stay pending, and so do their watcher calls
+	}
+	m.changed = make(map[string]bool)
+	m.replaced = false
+	m.changes = 0
+	return m.written(nil)
+}
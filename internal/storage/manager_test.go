@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reopen loads what a manager wrote to path, as a restart would
+func reopen(t *testing.T, path string) *Manager {
+	t.Helper()
+	m, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coalesce.json")
+	m := reopen(t, path)
+	SetWriteCoalescing(time.Hour, 3)
+	defer SetWriteCoalescing(0, 0)
+
+	m.Set("a", 1)
+	m.Set("b", 2)
+	if _, written := reopen(t, path).Get("a"); written {
+		t.Fatal("change written before the interval passed")
+	}
+	m.Set("c", 3) // Third change reaches maxChanges
+	if _, written := reopen(t, path).Get("c"); !written {
+		t.Fatal("changes not written once maxChanges piled up")
+	}
+
+	m.Delete("a")
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := reopen(t, path).Get("a"); exists {
+		t.Error("delete not written by Flush")
+	}
+}
+
+// Turning coalescing off writes what is pending
+func TestWriteCoalescingOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coalesce.json")
+	m := reopen(t, path)
+	SetWriteCoalescing(time.Hour, 0)
+	m.Set("a", 1)
+	SetWriteCoalescing(0, 0)
+	if _, written := reopen(t, path).Get("a"); !written {
+		t.Error("pending change not written when coalescing was turned off")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ttl.json")
+	m := reopen(t, path)
+
+	if err := m.SetWithTTL("short", 1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	m.SetWithTTL("long", 2, time.Hour)
+	m.SetWithTTL("kept", 3, time.Hour)
+	m.Set("kept", 3) // Set again without a TTL: no longer expires
+	time.Sleep(5 * time.Millisecond)
+
+	if _, exists := m.Get("short"); exists {
+		t.Error("expired key still visible")
+	}
+	if _, exists := m.Expires("kept"); exists {
+		t.Error("key set again without a TTL still expires")
+	}
+	if _, reserved := m.GetAll()[expiresKey]; reserved {
+		t.Error("expiry times listed by GetAll")
+	}
+
+	if err := m.expire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	m = reopen(t, path)
+	if _, stored := m.data["short"]; stored {
+		t.Error("expired key still stored")
+	}
+	if at, exists := m.Expires("long"); !exists || time.Until(at) < 59*time.Minute {
+		t.Errorf("expiry of long not kept across a restart: %v %v", at, exists)
+	}
+}
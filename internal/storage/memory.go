@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Memory-only storage for dry runs and tests: stores start from their JSON file when there
+// is one (read only) and keep every change in memory, so nothing under ./data is written.
+
+var memoryOnly atomic.Bool
+
+// UseMemory keeps stores created from now on in memory only
+func UseMemory() {
+	memoryOnly.Store(true)
+	fmt.Println("Storage: in memory only, nothing will be written")
+}
+
+// InMemory reports whether storage is kept in memory only
+func InMemory() bool {
+	return memoryOnly.Load()
+}
+
+// memoryBackend loads a JSON file once and never writes
+type memoryBackend struct {
+	path string
+}
+
+func (b *memoryBackend) load() (map[string]interface{}, error) {
+	data, err := readJSONFile(b.path)
+	if err != nil {
+		// Leave the file as it is; recovery would move it aside
+		fmt.Printf("Warning: storage file %s not loaded: %v (starting empty in memory)\n", b.path, err)
+	}
+	return data, nil
+}
+
+func (b *memoryBackend) set(all map[string]interface{}, key string) error      { return nil }
+func (b *memoryBackend) delete(all map[string]interface{}, key string) error   { return nil }
+func (b *memoryBackend) batch(all map[string]interface{}, keys []string) error { return nil }
+func (b *memoryBackend) replace(all map[string]interface{}) error              { return nil }
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recovery of JSON storage files that no longer parse (a write cut short by power loss).
+// Instead of starting empty and overwriting the evidence, the corrupt file is moved aside
+// with a timestamp suffix and the data comes from the leftover .tmp file of an interrupted
+// write or, failing that, the newest backup.
+
+// errCorrupt marks a storage file that exists but is not valid JSON
+var errCorrupt = errors.New("corrupt storage file")
+
+// Recovery describes one corrupt storage file found at startup
+type Recovery struct {
+	File        string    `json:"file"`
+	Error       string    `json:"error"`            // Why the file could not be read
+	Quarantined string    `json:"quarantined"`      // Where the corrupt file was moved
+	Source      string    `json:"source,omitempty"` // Copy the data was recovered from ("" = none, started empty)
+	Keys        int       `json:"keys"`             // Keys recovered
+	At          time.Time `json:"at"`
+}
+
+var (
+	recoveryMu sync.Mutex
+	recoveries []Recovery
+	backupDir  string
+)
+
+// SetBackupDir sets where backups are kept (one directory per backup holding copies of the
+// storage files), searched when a storage file is corrupt
+func SetBackupDir(dir string) {
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	backupDir = dir
+}
+
+// Recoveries returns the corrupt storage files found since startup
+func Recoveries() []Recovery {
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	return append([]Recovery(nil), recoveries...)
+}
+
+// recoverFile quarantines the corrupt file of f and loads the best intact copy, written
+// back to f's path. With no intact copy the data set starts empty.
+func recoverFile(f *fileBackend, cause error) (map[string]interface{}, error) {
+	now := time.Now()
+	rec := Recovery{File: f.path, Error: cause.Error(), At: now}
+	rec.Quarantined = fmt.Sprintf("%s.corrupt-%s", f.path, now.Format("20060102-150405"))
+	if err := os.Rename(f.path, rec.Quarantined); err != nil {
+		// Leave the file alone; the data set starts empty but the next write would replace it
+		return make(map[string]interface{}), fmt.Errorf("%v; failed to quarantine it: %v", cause, err)
+	}
+	if _, err := encryptCopy(rec.Quarantined); err != nil {
+		fmt.Printf("Warning: failed to encrypt %s: %v\n", rec.Quarantined, err)
+	}
+
+	data := make(map[string]interface{})
+	for _, candidate := range recoveryCandidates(f.path) {
+		if _, err := os.Stat(candidate); err != nil {
+			continue
+		}
+		recovered, err := readJSONFile(candidate)
+		if err != nil {
+			fmt.Printf("Storage: %s is not usable for recovery: %v\n", candidate, err)
+			continue
+		}
+		data, rec.Source, rec.Keys = recovered, candidate, len(recovered)
+		break
+	}
+	if rec.Source != "" {
+		if err := f.replace(data); err != nil {
+			fmt.Printf("Warning: failed to rewrite %s after recovery: %v\n", f.path, err)
+		}
+		fmt.Printf("ERROR: storage file %s was corrupt (%v); moved to %s and recovered %d key(s) from %s\n",
+			f.path, cause, rec.Quarantined, rec.Keys, rec.Source)
+	} else {
+		fmt.Printf("ERROR: storage file %s was corrupt (%v); moved to %s and NO intact copy was found, starting empty\n",
+			f.path, cause, rec.Quarantined)
+	}
+
+	recoveryMu.Lock()
+	recoveries = append(recoveries, rec)
+	recoveryMu.Unlock()
+	return data, nil
+}
+
+// recoveryCandidates lists copies of path to recover from, best first: the .tmp file of an
+// interrupted write, then backups from newest to oldest
+func recoveryCandidates(path string) []string {
+	candidates := []string{path + ".tmp"}
+
+	recoveryMu.Lock()
+	dir := backupDir
+	recoveryMu.Unlock()
+	if dir == "" {
+		return candidates
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", filepath.Base(path)))
+	modified := make(map[string]time.Time, len(matches))
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil {
+			modified[m] = info.ModTime()
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return modified[matches[i]].After(modified[matches[j]]) })
+	return append(candidates, matches...)
+}
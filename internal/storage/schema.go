@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Schema versions: every data set records the version of its layout under a reserved key.
+// When a package changes the shape of what it stores it bumps its version and adds a
+// Migration, and Migrate upgrades older data in place at startup instead of dropping the
+// fields the new structs no longer decode. Data written by a newer server is left alone.
+
+// Reserved key holding the schema version; hidden from Get and GetAll
+const schemaKey = "_schema_version"
+
+// Version of data stored before versioning existed
+const unversioned = 1
+
+// ErrNewerSchema is returned for data written by a newer server, which this one would
+// lose fields of if it wrote it
+var ErrNewerSchema = errors.New("written by a newer server version")
+
+// Migration upgrades a data set from version From to From+1. Apply gets every stored key
+// (including reserved ones such as the TTL expiry times) and changes the map in place.
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(data map[string]json.RawMessage) error
+}
+
+// SchemaStatus describes the schema version of one storage file
+type SchemaStatus struct {
+	File     string `json:"file"`
+	Version  int    `json:"version"`            // Version of the stored data
+	Current  int    `json:"current"`            // Version this server writes
+	Migrated []int  `json:"migrated,omitempty"` // Versions migrated from at startup
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	schemaMu sync.Mutex
+	schemas  = make(map[string]SchemaStatus)
+)
+
+// Schemas returns the schema status of every data set checked by Migrate, by file
+func Schemas() []SchemaStatus {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	result := make([]SchemaStatus, 0, len(schemas))
+	for _, s := range schemas {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].File < result[j].File })
+	return result
+}
+
+// SchemaVersion returns the version of the stored data (unversioned data is version 1)
+func (m *Manager) SchemaVersion() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.schemaVersionLocked()
+}
+
+func (m *Manager) schemaVersionLocked() int {
+	val, exists := m.data[schemaKey]
+	if !exists {
+		return unversioned
+	}
+	var version int
+	raw, err := json.Marshal(val)
+	if err == nil {
+		err = json.Unmarshal(raw, &version)
+	}
+	if err != nil || version < 1 {
+		fmt.Printf("Warning: ignoring unreadable schema version in %s: %v\n", m.dataFile, val)
+		return unversioned
+	}
+	return version
+}
+
+// Migrate brings the stored data up to version current by applying migrations in order,
+// and writes it with the new version. A new, empty data set just takes the version. The
+// file as it was is kept next to it (<file>.schema-v<N>) before a migration rewrites it.
+//
+// Data of a newer version (ErrNewerSchema) or that fails to migrate is not changed, and the
+// manager refuses to write it from then on, so a downgrade or a broken migration never
+// drops what is stored. Readers still get the data as it is.
+func (m *Manager) Migrate(current int, migrations []Migration) error {
+	defer m.deliver() // After unlocking
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := SchemaStatus{File: m.dataFile, Current: current}
+	defer func() {
+		schemaMu.Lock()
+		schemas[m.dataFile] = status
+		schemaMu.Unlock()
+	}()
+
+	if f, isFile := m.backend.(*fileBackend); isFile && f.locked != nil {
+		return nil // Undecryptable; nothing loaded to migrate
+	}
+	_, stamped := m.data[schemaKey]
+	version := m.schemaVersionLocked()
+	if !stamped && len(m.data) == 0 {
+		version = current
+	}
+	status.Version = version
+
+	// Leave the data as it is and never write it
+	freeze := func(err error) error {
+		m.frozen = fmt.Errorf("%s: %w; not overwriting it", m.dataFile, err)
+		status.Error = err.Error()
+		return m.frozen
+	}
+
+	switch {
+	case version > current:
+		return freeze(fmt.Errorf("schema version %d was %w (this one writes %d)", version, ErrNewerSchema, current))
+	case version == current:
+		if stamped {
+			return nil
+		}
+		m.data[schemaKey] = current
+		return m.noteChange(schemaKey)
+	}
+
+	steps := make(map[int]Migration, len(migrations))
+	for _, mig := range migrations {
+		steps[mig.From] = mig
+	}
+	data := make(map[string]json.RawMessage, len(m.data))
+	for k, v := range m.data {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return freeze(fmt.Errorf("failed to marshal %s: %v", k, err))
+		}
+		data[k] = raw
+	}
+	// Migrations work on a copy, so a failure leaves the loaded data untouched
+	for v := version; v < current; v++ {
+		mig, exists := steps[v]
+		if !exists {
+			return freeze(fmt.Errorf("no migration from schema version %d", v))
+		}
+		if err := mig.Apply(data); err != nil {
+			return freeze(fmt.Errorf("migration from schema version %d (%s) failed: %v", v, mig.Description, err))
+		}
+		status.Migrated = append(status.Migrated, v)
+	}
+
+	m.keepPreMigration(version)
+	migrated := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		migrated[k] = v
+	}
+	migrated[schemaKey] = current
+	before := m.data
+	m.data = migrated
+	m.queueDiff(before)
+	m.loadExpiries()
+	if err := m.noteReplace(); err != nil {
+		return err
+	}
+	if err := m.flushLocked(); err != nil {
+		return err
+	}
+	fmt.Printf("Storage: migrated %s from schema version %d to %d\n", m.dataFile, version, current)
+	return nil
+}
+
+// keepPreMigration copies a JSON storage file aside before a migration rewrites it. Caller holds mu.
+func (m *Manager) keepPreMigration(version int) {
+	if _, isFile := m.backend.(*fileBackend); !isFile {
+		return
+	}
+	raw, err := os.ReadFile(m.dataFile)
+	if err != nil {
+		return
+	}
+	aside := fmt.Sprintf("%s.schema-v%d", m.dataFile, version)
+	if err := os.WriteFile(aside, raw, 0644); err != nil {
+		fmt.Printf("Warning: failed to keep %s before migrating it: %v\n", m.dataFile, err)
+	}
+}
+
+// MigrateObjects builds a Migration.Apply that rewrites every JSON object value (reserved
+// keys excepted) with fn, e.g. to rename or convert a field
+func MigrateObjects(fn func(key string, obj map[string]interface{}) error) func(map[string]json.RawMessage) error {
+	return func(data map[string]json.RawMessage) error {
+		for key, raw := range data {
+			if reserved(key) {
+				continue
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+				continue // Not an object
+			}
+			if err := fn(key, obj); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			updated, err := json.Marshal(obj)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			data[key] = updated
+		}
+		return nil
+	}
+}
+
+// reserved reports whether key holds the storage package's own bookkeeping
+func reserved(key string) bool {
+	return key == expiresKey || key == schemaKey
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server_app/internal/faults"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go driver, so cross-compiled builds need no cgo
+)
+
+// SQLite backend: every Manager becomes a "store" in one shared database, one row per key,
+// so a Set writes a single row instead of the whole file. WAL mode with synchronous=NORMAL
+// keeps writes sequential and fsyncs to checkpoints, which is far gentler on SD cards.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS kv (
+	store   TEXT    NOT NULL,
+	key     TEXT    NOT NULL,
+	value   TEXT    NOT NULL,
+	updated INTEGER NOT NULL, -- Unix seconds
+	PRIMARY KEY (store, key)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS kv_store_updated ON kv (store, updated);
+CREATE TABLE IF NOT EXISTS imported (
+	store TEXT    NOT NULL PRIMARY KEY,
+	at    INTEGER NOT NULL -- Unix seconds
+) WITHOUT ROWID;
+`
+
+var (
+	dbMu sync.Mutex
+	db   *sql.DB // nil = JSON files
+)
+
+// UseSQLite makes Managers created from now on keep their data in the SQLite database at
+// path instead of individual JSON files. Each store is imported from its JSON file the first
+// time it is loaded (recorded in the imported table, so a store emptied later stays empty);
+// the file is left in place.
+func UseSQLite(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)"
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	conn.SetMaxOpenConns(1) // One writer; also keeps the pragmas on a single connection
+	if _, err := conn.Exec(sqliteSchema); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create schema in %s: %v", path, err)
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	db = conn
+	fmt.Printf("Storage: using SQLite database %s\n", path)
+	return nil
+}
+
+// SQLiteDB returns the shared database, or nil when storage uses JSON files
+func SQLiteDB() *sql.DB {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	return db
+}
+
+// BackupSQLite writes a consistent copy of the database (including WAL contents) to path
+func BackupSQLite(path string) error {
+	conn := SQLiteDB()
+	if conn == nil {
+		return fmt.Errorf("storage is not using SQLite")
+	}
+	os.Remove(path) // VACUUM INTO refuses to overwrite
+	if _, err := conn.Exec("VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to back up database: %v", err)
+	}
+	return nil
+}
+
+// sqliteBackend is one store in the shared database
+type sqliteBackend struct {
+	db       *sql.DB
+	store    string
+	jsonPath string // Imported on first load
+}
+
+func newSQLiteBackend(conn *sql.DB, dataFilePath string) *sqliteBackend {
+	store := strings.TrimSuffix(filepath.Base(dataFilePath), filepath.Ext(dataFilePath))
+	return &sqliteBackend{db: conn, store: store, jsonPath: dataFilePath}
+}
+
+func (s *sqliteBackend) load() (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	rows, err := s.db.Query("SELECT key, value FROM kv WHERE store = ?", s.store)
+	if err != nil {
+		return data, fmt.Errorf("failed to read store %s: %v", s.store, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return data, fmt.Errorf("failed to read store %s: %v", s.store, err)
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			fmt.Printf("Warning: skipping unreadable %s/%s: %v\n", s.store, key, err)
+			continue
+		}
+		data[key] = v
+	}
+	if err := rows.Err(); err != nil {
+		return data, fmt.Errorf("failed to read store %s: %v", s.store, err)
+	}
+
+	var marked int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM imported WHERE store = ?", s.store).Scan(&marked); err != nil {
+		return data, fmt.Errorf("failed to read store %s: %v", s.store, err)
+	}
+	if marked > 0 {
+		return data, nil
+	}
+	if len(data) > 0 {
+		// Filled before import markers were kept
+		return data, s.markImported()
+	}
+
+	// First load: carry over the JSON file from before the switch
+	imported, err := readJSONFile(s.jsonPath)
+	if err != nil {
+		return data, err
+	}
+	if len(imported) > 0 {
+		if err := s.replace(imported); err != nil {
+			return data, err
+		}
+		fmt.Printf("Storage: imported %d key(s) from %s into SQLite\n", len(imported), s.jsonPath)
+		data = imported
+	}
+	return data, s.markImported()
+}
+
+// markImported records that the store's JSON file was carried over, so it never is again
+func (s *sqliteBackend) markImported() error {
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO imported (store, at) VALUES (?, ?)", s.store, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to mark store %s imported: %v", s.store, err)
+	}
+	return nil
+}
+
+func (s *sqliteBackend) set(all map[string]interface{}, key string) error {
+	faults.DelayStorageWrite()
+	value, err := json.Marshal(all[key])
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO kv (store, key, value, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (store, key) DO UPDATE SET value = excluded.value, updated = excluded.updated`,
+		s.store, key, string(value), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to write %s/%s: %v", s.store, key, err)
+	}
+	return nil
+}
+
+func (s *sqliteBackend) delete(all map[string]interface{}, key string) error {
+	faults.DelayStorageWrite()
+	if _, err := s.db.Exec("DELETE FROM kv WHERE store = ? AND key = ?", s.store, key); err != nil {
+		return fmt.Errorf("failed to delete %s/%s: %v", s.store, key, err)
+	}
+	return nil
+}
+
+func (s *sqliteBackend) batch(all map[string]interface{}, keys []string) error {
+	faults.DelayStorageWrite()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to write store %s: %v", s.store, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, key := range keys {
+		v, exists := all[key]
+		if !exists {
+			if _, err := tx.Exec("DELETE FROM kv WHERE store = ? AND key = ?", s.store, key); err != nil {
+				return fmt.Errorf("failed to delete %s/%s: %v", s.store, key, err)
+			}
+			continue
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal data: %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO kv (store, key, value, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT (store, key) DO UPDATE SET value = excluded.value, updated = excluded.updated`,
+			s.store, key, string(value), now)
+		if err != nil {
+			return fmt.Errorf("failed to write %s/%s: %v", s.store, key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write store %s: %v", s.store, err)
+	}
+	return nil
+}
+
+func (s *sqliteBackend) replace(all map[string]interface{}) error {
+	faults.DelayStorageWrite()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to replace store %s: %v", s.store, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM kv WHERE store = ?", s.store); err != nil {
+		return fmt.Errorf("failed to replace store %s: %v", s.store, err)
+	}
+	now := time.Now().Unix()
+	for key, v := range all {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal data: %v", err)
+		}
+		if _, err := tx.Exec("INSERT INTO kv (store, key, value, updated) VALUES (?, ?, ?, ?)", s.store, key, string(value), now); err != nil {
+			return fmt.Errorf("failed to replace store %s: %v", s.store, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to replace store %s: %v", s.store, err)
+	}
+	return nil
+}
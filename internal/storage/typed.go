@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TypedManager is a Manager whose values are all of type T. Values are decoded once and
+// kept, so reads return them without marshaling through interface{} every time. The
+// Manager's other methods (Migrate, Expires, Flush, ...) work as usual.
+//
+// Values returned by Get/GetAll are shared between readers: treat maps and slices inside
+// them as read-only.
+type TypedManager[T any] struct {
+	*Manager
+}
+
+// NewTyped creates a typed storage manager for a given file
+func NewTyped[T any](dataFilePath string) (*TypedManager[T], error) {
+	m, err := New(dataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedManager[T]{m}, nil
+}
+
+// Get retrieves a value by key; a value that does not decode as T counts as missing
+func (t *TypedManager[T]) Get(key string) (T, bool) {
+	var zero T
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.live(key, time.Now()) {
+		return zero, false
+	}
+	val, exists := t.data[key]
+	if !exists {
+		return zero, false
+	}
+	v, err := t.decode(key, val)
+	if err != nil {
+		fmt.Printf("Warning: failed to decode %s from %s: %v\n", key, t.dataFile, err)
+		return zero, false
+	}
+	return v, true
+}
+
+// GetAll returns all values; ones that do not decode as T are left out
+func (t *TypedManager[T]) GetAll() map[string]T {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]T, len(t.data))
+	for k, val := range t.data {
+		if !t.live(k, now) {
+			continue
+		}
+		v, err := t.decode(k, val)
+		if err != nil {
+			fmt.Printf("Warning: failed to decode %s from %s: %v\n", k, t.dataFile, err)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// Set stores a value
+func (t *TypedManager[T]) Set(key string, value T) error {
+	return t.Manager.Set(key, value)
+}
+
+// SetWithTTL stores a value that is removed once ttl passes without it being set again
+func (t *TypedManager[T]) SetWithTTL(key string, value T, ttl time.Duration) error {
+	return t.Manager.SetWithTTL(key, value, ttl)
+}
+
+// decode returns the cached value of key or decodes val into it. Caller holds mu (read), so
+// no write can drop the entry before it is cached.
+func (t *TypedManager[T]) decode(key string, val interface{}) (T, error) {
+	t.cacheMu.Lock()
+	cached, exists := t.cache[key]
+	t.cacheMu.Unlock()
+	if v, isT := cached.(T); exists && isT {
+		return v, nil
+	}
+
+	var v T
+	raw, isRaw := val.(json.RawMessage)
+	if !isRaw {
+		// Loaded from the file as generic JSON values
+		var err error
+		if raw, err = json.Marshal(val); err != nil {
+			return v, err
+		}
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return v, err
+	}
+	t.cacheMu.Lock()
+	t.cache[key] = v
+	t.cacheMu.Unlock()
+	return v, nil
+}
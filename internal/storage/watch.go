@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// Change is one key of a store changing value. Keys the storage package keeps for itself
+// (expiry times, schema version) are not reported.
+type Change struct {
+	File string          `json:"file"`
+	Key  string          `json:"key"`
+	Old  json.RawMessage `json:"old,omitempty"` // nil when the key was added
+	New  json.RawMessage `json:"new,omitempty"` // nil when the key was deleted or expired
+}
+
+type watcher struct {
+	id uint64
+	fn func(Change)
+}
+
+// Watch calls fn for every change to the store: sets, deletes, expiries, and each key that
+// differs after a Replace or Clear. A change is reported once it is written (with write
+// coalescing, when its batch is). A change whose write fails stays pending and is reported
+// once the next write or Flush succeeds; changes to a store frozen by Migrate are never
+// written, so they are not reported. Calls happen outside the store's lock, one at a time,
+// in the order the changes were made, so fn may read or write the store (its own writes
+// are reported after it returns). Keep fn quick; it delays the delivery of later changes.
+// The returned function stops the calls.
+func (m *Manager) Watch(fn func(Change)) (stop func()) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	m.nextWatch++
+	id := m.nextWatch
+	m.watchers = append(m.watchers, watcher{id: id, fn: fn})
+
+	return func() {
+		m.watchMu.Lock()
+		defer m.watchMu.Unlock()
+		for i, w := range m.watchers {
+			if w.id == id {
+				m.watchers = append(m.watchers[:i:i], m.watchers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (m *Manager) watched() bool {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	return len(m.watchers) > 0
+}
+
+// queueChange records that key went from before (nil = absent) to its current value, if
+// it differs. Caller holds mu.
+func (m *Manager) queueChange(key string, before interface{}) {
+	if reserved(key) || !m.watched() {
+		return
+	}
+	old, err := rawValue(before)
+	if err != nil {
+		return
+	}
+	current, err := rawValue(m.data[key])
+	if err != nil || sameJSON(old, current) {
+		return
+	}
+	m.unwritten = append(m.unwritten, Change{File: m.dataFile, Key: key, Old: old, New: current})
+}
+
+// written passes the changes held back until now on for delivery once err reports a
+// successful write. After a failed write they stay held back until a later write of the
+// same changes succeeds. Returns err. Caller holds mu.
+func (m *Manager) written(err error) error {
+	if err != nil || len(m.unwritten) == 0 {
+		return err
+	}
+	m.watchMu.Lock()
+	m.outbox = append(m.outbox, m.unwritten...)
+	m.watchMu.Unlock()
+	m.unwritten = nil
+	return nil
+}
+
+// queueDiff records the keys that differ between before and the current data set. Caller holds mu.
+func (m *Manager) queueDiff(before map[string]interface{}) {
+	if !m.watched() {
+		return
+	}
+	for key, val := range before {
+		m.queueChange(key, val)
+	}
+	for key := range m.data {
+		if _, existed := before[key]; !existed {
+			m.queueChange(key, nil)
+		}
+	}
+}
+
+// deliver passes queued changes to the watchers. Call it without holding mu (deferred
+// before locking). Whoever is delivering already takes any changes queued meanwhile.
+func (m *Manager) deliver() {
+	m.watchMu.Lock()
+	if m.delivering {
+		m.watchMu.Unlock()
+		return
+	}
+	m.delivering = true
+	for len(m.outbox) > 0 {
+		changes := m.outbox
+		m.outbox = nil
+		watchers := append([]watcher(nil), m.watchers...)
+		m.watchMu.Unlock()
+		for _, c := range changes {
+			for _, w := range watchers {
+				w.fn(c)
+			}
+		}
+		m.watchMu.Lock()
+	}
+	m.delivering = false
+	m.watchMu.Unlock()
+}
+
+// sameJSON compares two encodings by value, so field order (struct vs. map) does not matter
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func rawValue(val interface{}) (json.RawMessage, error) {
+	if val == nil {
+		return nil, nil
+	}
+	if raw, isRaw := val.(json.RawMessage); isRaw {
+		return raw, nil
+	}
+	return json.Marshal(val)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingBackend fails every write while fail is set
+type failingBackend struct {
+	fail bool
+}
+
+func (b *failingBackend) load() (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+func (b *failingBackend) set(all map[string]interface{}, key string) error { return b.write() }
+
+func (b *failingBackend) delete(all map[string]interface{}, key string) error { return b.write() }
+
+func (b *failingBackend) batch(all map[string]interface{}, keys []string) error { return b.write() }
+
+func (b *failingBackend) replace(all map[string]interface{}) error { return b.write() }
+
+func (b *failingBackend) write() error {
+	if b.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func watchChanges(m *Manager) *[]Change {
+	var changes []Change
+	m.Watch(func(c Change) { changes = append(changes, c) })
+	return &changes
+}
+
+func TestWatchReportsWrittenChanges(t *testing.T) {
+	m, err := New(filepath.Join(t.TempDir(), "watch.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := watchChanges(m)
+
+	m.Set("a", 1)
+	m.Set("a", 1) // Unchanged, not reported
+	m.Set("a", 2)
+	m.Delete("a")
+	if len(*changes) != 3 {
+		t.Fatalf("got %d changes, want 3: %+v", len(*changes), *changes)
+	}
+	if c := (*changes)[0]; c.Key != "a" || c.Old != nil || string(c.New) != "1" {
+		t.Errorf("add: got %+v", c)
+	}
+	if c := (*changes)[2]; string(c.Old) != "2" || c.New != nil {
+		t.Errorf("delete: got %+v", c)
+	}
+}
+
+// A change whose write fails is reported once a later write succeeds, not dropped
+func TestWatchRetriesFailedWrites(t *testing.T) {
+	m, err := New(filepath.Join(t.TempDir(), "watch.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &failingBackend{fail: true}
+	m.backend = backend
+	changes := watchChanges(m)
+
+	if err := m.Set("a", 1); err == nil {
+		t.Fatal("Set succeeded with a failing backend")
+	}
+	if len(*changes) != 0 {
+		t.Fatalf("unwritten change reported: %+v", *changes)
+	}
+
+	backend.fail = false
+	if err := m.Set("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(*changes) != 2 || (*changes)[0].Key != "a" || (*changes)[1].Key != "b" {
+		t.Fatalf("got %+v, want a then b", *changes)
+	}
+}
+
+func TestWatchCoalescedChangesWaitForFlush(t *testing.T) {
+	m, err := New(filepath.Join(t.TempDir(), "watch.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetWriteCoalescing(time.Hour, 0)
+	defer SetWriteCoalescing(0, 0)
+	changes := watchChanges(m)
+
+	m.Set("a", 1)
+	m.Set("b", 2)
+	if len(*changes) != 0 {
+		t.Fatalf("reported before the batch was written: %+v", *changes)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*changes) != 2 {
+		t.Fatalf("got %d changes after Flush, want 2", len(*changes))
+	}
+}
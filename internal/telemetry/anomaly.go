@@ -0,0 +1,104 @@
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Anomaly detection tuning
+const (
+	ewmaAlpha     = 0.01 // Weight of each new sample in the running mean/variance
+	bandWidth     = 4.0  // Alert when a reading is this many standard deviations from the mean
+	warmupSamples = 30   // Samples needed before a metric's band is trusted
+	minStdDev     = 0.1  // Floor so perfectly flat metrics don't alert on tiny changes
+	maxAnomalies  = 100  // Recent anomalies kept for the admin interface
+	alertCooldown = 30 * time.Minute
+)
+
+// Anomaly describes a reading outside the learned range for its device metric
+type Anomaly struct {
+	Reading
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+	ZScore float64 `json:"z_score"`
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s %s=%.2f outside learned range %.2f±%.2f (z=%.1f)",
+		a.Device, a.Metric, a.Value, a.Mean, bandWidth*a.StdDev, a.ZScore)
+}
+
+// ewmaBand tracks an exponentially weighted mean and variance for one metric
+type ewmaBand struct {
+	mean      float64
+	variance  float64
+	samples   int
+	lastAlert time.Time
+}
+
+type anomalyDetector struct {
+	mu      sync.Mutex
+	bands   map[string]*ewmaBand // "device/metric" -> band
+	recent  []Anomaly
+	handler func(Anomaly)
+}
+
+var detector = &anomalyDetector{bands: make(map[string]*ewmaBand)}
+
+// OnAnomaly registers a callback invoked (outside any locks) for each raised anomaly
+func OnAnomaly(handler func(Anomaly)) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+	detector.handler = handler
+}
+
+// RecentAnomalies returns the most recently raised anomalies, newest last
+func RecentAnomalies() []Anomaly {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	result := make([]Anomaly, len(detector.recent))
+	copy(result, detector.recent)
+	return result
+}
+
+func (d *anomalyDetector) observe(r Reading) {
+	d.mu.Lock()
+	key := r.Device + "/" + r.Metric
+	band, exists := d.bands[key]
+	if !exists {
+		band = &ewmaBand{mean: r.Value}
+		d.bands[key] = band
+	}
+
+	var raised *Anomaly
+	stdDev := math.Max(math.Sqrt(band.variance), minStdDev)
+	z := (r.Value - band.mean) / stdDev
+	if band.samples >= warmupSamples && math.Abs(z) > bandWidth && r.Time.Sub(band.lastAlert) >= alertCooldown {
+		band.lastAlert = r.Time
+		raised = &Anomaly{Reading: r, Mean: band.mean, StdDev: stdDev, ZScore: z}
+		d.recent = append(d.recent, *raised)
+		if len(d.recent) > maxAnomalies {
+			d.recent = d.recent[len(d.recent)-maxAnomalies:]
+		}
+	}
+
+	// Update the band after testing so an outlier doesn't widen its own band first
+	diff := r.Value - band.mean
+	incr := ewmaAlpha * diff
+	band.mean += incr
+	band.variance = (1 - ewmaAlpha) * (band.variance + diff*incr)
+	band.samples++
+
+	handler := d.handler
+	d.mu.Unlock()
+
+	if raised != nil {
+		fmt.Printf("Telemetry anomaly: %s\n", raised)
+		if handler != nil {
+			handler(*raised)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package telemetry
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reading history, kept only when storage uses SQLite (a JSON file per reading would
+// defeat the point). Indexed by device, metric and time for range queries.
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS telemetry (
+	device TEXT    NOT NULL,
+	metric TEXT    NOT NULL,
+	value  REAL    NOT NULL,
+	at     INTEGER NOT NULL -- Unix milliseconds
+);
+CREATE INDEX IF NOT EXISTS telemetry_device_metric_at ON telemetry (device, metric, at);
+CREATE INDEX IF NOT EXISTS telemetry_at ON telemetry (at);
+`
+
+// Readings older than this are pruned, at most once per pruneInterval
+const (
+	historyRetention = 30 * 24 * time.Hour
+	pruneInterval    = time.Hour
+)
+
+var ErrNoHistory = errors.New("telemetry history requires the SQLite storage backend")
+
+var (
+	historyMu sync.Mutex
+	historyDB *sql.DB
+	lastPrune time.Time
+)
+
+// EnableHistory starts recording every reading in db
+func EnableHistory(db *sql.DB) error {
+	if _, err := db.Exec(historySchema); err != nil {
+		return fmt.Errorf("failed to create telemetry table: %v", err)
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	historyDB = db
+	return nil
+}
+
+func recordHistory(readings []Reading) {
+	historyMu.Lock()
+	db := historyDB
+	prune := db != nil && time.Since(lastPrune) > pruneInterval
+	if prune {
+		lastPrune = time.Now()
+	}
+	historyMu.Unlock()
+	if db == nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Printf("Warning: failed to record telemetry: %v\n", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, r := range readings {
+		if _, err := tx.Exec("INSERT INTO telemetry (device, metric, value, at) VALUES (?, ?, ?, ?)",
+			r.Device, r.Metric, r.Value, r.Time.UnixMilli()); err != nil {
+			fmt.Printf("Warning: failed to record telemetry: %v\n", err)
+			return
+		}
+	}
+	if prune {
+		cutoff := time.Now().Add(-historyRetention).UnixMilli()
+		if _, err := tx.Exec("DELETE FROM telemetry WHERE at < ?", cutoff); err != nil {
+			fmt.Printf("Warning: failed to prune telemetry: %v\n", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Printf("Warning: failed to record telemetry: %v\n", err)
+	}
+}
+
+// History returns a device metric's readings since the given time, oldest first
+func History(device string, metric string, since time.Time) ([]Reading, error) {
+	historyMu.Lock()
+	db := historyDB
+	historyMu.Unlock()
+	if db == nil {
+		return nil, ErrNoHistory
+	}
+
+	rows, err := db.Query("SELECT value, at FROM telemetry WHERE device = ? AND metric = ? AND at >= ? ORDER BY at",
+		device, metric, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	readings := []Reading{}
+	for rows.Next() {
+		var value float64
+		var at int64
+		if err := rows.Scan(&value, &at); err != nil {
+			return nil, err
+		}
+		readings = append(readings, Reading{Device: device, Metric: metric, Value: value, Time: time.UnixMilli(at)})
+	}
+	return readings, rows.Err()
+}
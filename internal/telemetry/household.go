@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"math"
+	"time"
+)
+
+// Metric names aggregated into the household summary
+const (
+	MetricIndoorTemp = "indoor_temp" // Degrees F
+	MetricDoorOpen   = "door_open"   // 1 = open, 0 = closed
+)
+
+// Household aggregates recent readings across all nodes
+type Household struct {
+	HasTemps       bool    `json:"has_temps"`
+	MinIndoorTemp  float64 `json:"min_indoor_temp"`
+	MaxIndoorTemp  float64 `json:"max_indoor_temp"`
+	DoorsReporting int     `json:"doors_reporting"`
+	DoorsOpen      int     `json:"doors_open"`
+}
+
+// Summarize aggregates readings no older than maxAge
+func Summarize(maxAge time.Duration) Household {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	h := Household{MinIndoorTemp: math.Inf(1), MaxIndoorTemp: math.Inf(-1)}
+	for _, metrics := range latest {
+		if r, ok := metrics[MetricIndoorTemp]; ok && time.Since(r.Time) <= maxAge {
+			h.HasTemps = true
+			h.MinIndoorTemp = math.Min(h.MinIndoorTemp, r.Value)
+			h.MaxIndoorTemp = math.Max(h.MaxIndoorTemp, r.Value)
+		}
+		if r, ok := metrics[MetricDoorOpen]; ok && time.Since(r.Time) <= maxAge {
+			h.DoorsReporting++
+			if r.Value != 0 {
+				h.DoorsOpen++
+			}
+		}
+	}
+
+	if !h.HasTemps {
+		h.MinIndoorTemp, h.MaxIndoorTemp = 0, 0
+	}
+	return h
+}
@@ -0,0 +1,107 @@
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reading is a single metric value reported by a device
+type Reading struct {
+	Device string    `json:"device"`
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	mu        sync.RWMutex
+	latest    = make(map[string]map[string]Reading) // device -> metric -> last reading
+	onReading func(Reading)
+)
+
+// OnReading registers a callback invoked for every ingested reading (e.g. the rules engine)
+func OnReading(handler func(Reading)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onReading = handler
+}
+
+// ParseReadings parses telemetry strings of the form "metric=value"
+func ParseReadings(fields []string) (map[string]float64, error) {
+	readings := make(map[string]float64, len(fields))
+	for _, field := range fields {
+		metric, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found || metric == "" {
+			return nil, fmt.Errorf("expected metric=value, got %q", field)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid value for metric %s: %q", metric, value)
+		}
+		readings[metric] = v
+	}
+	return readings, nil
+}
+
+// Ingest records readings from a device and runs anomaly detection on each metric
+func Ingest(device string, readings map[string]float64) {
+	now := time.Now()
+
+	mu.Lock()
+	metrics, exists := latest[device]
+	if !exists {
+		metrics = make(map[string]Reading)
+		latest[device] = metrics
+	}
+	for metric, value := range readings {
+		metrics[metric] = Reading{Device: device, Metric: metric, Value: value, Time: now}
+	}
+	handler := onReading
+	mu.Unlock()
+
+	batch := make([]Reading, 0, len(readings))
+	for metric, value := range readings {
+		r := Reading{Device: device, Metric: metric, Value: value, Time: now}
+		batch = append(batch, r)
+		detector.observe(r)
+		if handler != nil {
+			handler(r)
+		}
+	}
+	recordHistory(batch)
+}
+
+// Latest returns the most recent reading for a device metric
+func Latest(device string, metric string) (Reading, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	r, exists := latest[device][metric]
+	return r, exists
+}
+
+// LatestAll returns the most recent reading of every metric from every device,
+// sorted by device then metric
+func LatestAll() []Reading {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	all := []Reading{}
+	for _, metrics := range latest {
+		for _, r := range metrics {
+			all = append(all, r)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Device != all[j].Device {
+			return all[i].Device < all[j].Device
+		}
+		return all[i].Metric < all[j].Metric
+	})
+	return all
+}
@@ -0,0 +1,333 @@
+package timeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server_app/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeline: one queryable history of the things that used to only reach stdout (alerts,
+// device transitions, firmware updates, rule firings, canvas clears, ...). Events are
+// appended to a JSON-lines file (encrypted like the other storage files when a key is set)
+// and kept in memory for the retention period.
+
+// Event types
+const (
+	TypeAlert    = "alert"    // Webhook alerts sent (device offline/online)
+	TypeDevice   = "device"   // Device registered, went offline, came back, approved, removed, reconfigured
+	TypeFirmware = "firmware" // Device reported new firmware (an OTA update landed), or a release changed
+	TypeRule     = "rule"     // Telemetry rule turned on or off
+	TypeScene    = "scene"    // Scene activated
+	TypeCanvas   = "canvas"   // Canvas cleared, frames blocked or quarantined
+	TypeHealth   = "health"   // Server health changed
+	TypeServer   = "server"   // Server started or stopped
+)
+
+// Event is one timeline entry
+type Event struct {
+	ID      uint64                 `json:"id"`
+	Time    time.Time              `json:"time"`
+	Type    string                 `json:"type"`
+	Device  string                 `json:"device,omitempty"`
+	Summary string                 `json:"summary"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Filter selects events; zero fields match everything
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Types  []string
+	Device string
+	Limit  int // Newest events kept when more match (0 = DefaultLimit)
+}
+
+const (
+	DefaultLimit = 200
+	MaxLimit     = 5000
+)
+
+// Most events kept in memory whatever the retention
+const maxEvents = 50000
+
+// How often old events are dropped from the file
+const compactInterval = 24 * time.Hour
+
+var (
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	events      []Event // Oldest first
+	nextID      uint64  = 1
+	retention           = 90 * 24 * time.Hour
+	lastCompact time.Time
+)
+
+// Open loads the events within retention from the file at p and appends new ones to it.
+// Until Open, Record keeps events in memory only.
+func Open(p string, keep time.Duration) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if keep > 0 {
+		retention = keep
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create timeline directory: %v", err)
+	}
+	loaded, plaintext, err := readFile(p)
+	if err != nil {
+		return err
+	}
+	// Events recorded before Open (startup) follow the loaded ones
+	early := events
+	nextID = 1
+	for _, e := range loaded {
+		if e.ID >= nextID {
+			nextID = e.ID + 1
+		}
+	}
+	for i := range early {
+		early[i].ID = nextID
+		nextID++
+	}
+	events = loaded
+	path = p
+	// Rewrite plaintext events once a storage key is set, like the other storage files
+	if err := compactLocked(time.Now(), plaintext && storage.Encrypting()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open timeline: %v", err)
+	}
+	file = f
+	for _, e := range early {
+		events = append(events, e)
+		if err := appendLine(file, e); err != nil {
+			return fmt.Errorf("failed to record timeline event: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close stops writing to the file
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+}
+
+// Record adds an event
+func Record(eventType string, device string, summary string, details map[string]interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e := Event{ID: nextID, Time: time.Now().UTC(), Type: eventType, Device: device, Summary: summary, Details: details}
+	nextID++
+	events = append(events, e)
+	if len(events) > maxEvents {
+		events = append([]Event(nil), events[len(events)-maxEvents:]...)
+	}
+	if file == nil {
+		return
+	}
+	if err := appendLine(file, e); err != nil {
+		fmt.Printf("Warning: failed to record timeline event: %v\n", err)
+	}
+	if time.Since(lastCompact) > compactInterval {
+		if err := compactLocked(time.Now(), false); err != nil {
+			fmt.Printf("Warning: failed to compact timeline: %v\n", err)
+		}
+	}
+}
+
+// Recordf adds an event with a formatted summary and no details
+func Recordf(eventType string, device string, format string, args ...interface{}) {
+	Record(eventType, device, fmt.Sprintf(format, args...), nil)
+}
+
+// Query returns the matching events, newest first, and whether more matched than the limit
+func Query(f Filter) ([]Event, bool) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	types := make(map[string]bool, len(f.Types))
+	for _, t := range f.Types {
+		types[t] = true
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var result []Event
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if (!f.From.IsZero() && e.Time.Before(f.From)) || (!f.To.IsZero() && e.Time.After(f.To)) {
+			continue
+		}
+		if (len(types) > 0 && !types[e.Type]) || (f.Device != "" && e.Device != f.Device) {
+			continue
+		}
+		if len(result) == limit {
+			return result, true
+		}
+		result = append(result, e)
+	}
+	return result, false
+}
+
+// Counts returns how many events of each type are kept
+func Counts() map[string]int {
+	mu.Lock()
+	defer mu.Unlock()
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.Type]++
+	}
+	return counts
+}
+
+// Types lists the known event types
+func Types() []string {
+	types := []string{TypeAlert, TypeDevice, TypeFirmware, TypeRule, TypeScene, TypeCanvas, TypeHealth, TypeServer}
+	sort.Strings(types)
+	return types
+}
+
+// ParseTypes splits a comma-separated type list, rejecting unknown types
+func ParseTypes(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, t := range Types() {
+		known[t] = true
+	}
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if !known[t] {
+			return nil, fmt.Errorf("unknown event type %q (types: %s)", t, strings.Join(Types(), ", "))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// compactLocked drops events older than the retention, rewriting the file when any were
+// dropped (or always with rewrite). Caller holds mu.
+func compactLocked(now time.Time, rewrite bool) error {
+	lastCompact = now
+	cutoff := now.Add(-retention)
+	keep := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(cutoff) })
+	if (keep == 0 && !rewrite) || path == "" {
+		return nil
+	}
+	events = append([]Event(nil), events[keep:]...)
+
+	var buf bytes.Buffer
+	for _, e := range events {
+		line, err := encodeLine(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if file != nil {
+		// The open handle points at the replaced file
+		file.Close()
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			file = nil
+			return err
+		}
+		file = f
+	}
+	if keep > 0 {
+		fmt.Printf("Timeline: dropped %d event(s) older than %v\n", keep, retention)
+	}
+	return nil
+}
+
+func encodeLine(e Event) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if line, err = storage.EncryptLine(line); err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func appendLine(f *os.File, e Event) error {
+	line, err := encodeLine(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	return err
+}
+
+// readFile loads the events in a timeline file, oldest first, and reports whether any
+// were stored in plaintext or the first encrypted format
+func readFile(p string) ([]Event, bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var loaded []Event
+	plaintext := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		plaintext = plaintext || !storage.IsEncryptedLine(scanner.Bytes())
+		line, err := storage.DecryptLine(scanner.Bytes())
+		if errors.Is(err, storage.ErrKey) {
+			return nil, false, fmt.Errorf("timeline line %d is %v", lineNum, err)
+		}
+		var e Event
+		if err == nil {
+			err = json.Unmarshal(line, &e)
+		}
+		if err != nil {
+			fmt.Printf("Warning: skipping corrupt timeline event at line %d: %v\n", lineNum, err)
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	sort.SliceStable(loaded, func(i, j int) bool { return loaded[i].Time.Before(loaded[j].Time) })
+	return loaded, plaintext, scanner.Err()
+}
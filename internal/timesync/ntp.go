@@ -0,0 +1,85 @@
+package timesync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Minimal SNTP (RFC 4330) client: one request, one response, no clock adjustment
+
+// Seconds between the NTP epoch (1900) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// Result of an NTP query
+type Result struct {
+	Offset  time.Duration // Server time minus local time
+	RTT     time.Duration // Network round trip
+	Stratum uint8
+}
+
+// Query asks server (host or host:port) for the time
+func Query(server string, timeout time.Duration) (Result, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // Leap indicator 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	putTimestamp(req[40:], t1) // Echoed back as the origin timestamp
+	if _, err := conn.Write(req); err != nil {
+		return Result{}, err
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return Result{}, err
+	}
+	if n < 48 {
+		return Result{}, fmt.Errorf("short NTP response (%d bytes)", n)
+	}
+	if mode := resp[0] & 0x07; mode != 4 {
+		return Result{}, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	stratum := resp[1]
+	if stratum == 0 {
+		return Result{}, fmt.Errorf("NTP server refused: %q", string(resp[12:16])) // Kiss-o'-Death code
+	}
+	if stratum > 15 || resp[0]>>6 == 3 {
+		return Result{}, fmt.Errorf("NTP server is not synchronized")
+	}
+	if binary.BigEndian.Uint64(resp[24:32]) != binary.BigEndian.Uint64(req[40:48]) {
+		return Result{}, fmt.Errorf("NTP response does not match the request")
+	}
+
+	t2 := timestamp(resp[32:40]) // Server receive
+	t3 := timestamp(resp[40:48]) // Server transmit
+	return Result{
+		Offset:  (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RTT:     t4.Sub(t1) - t3.Sub(t2),
+		Stratum: stratum,
+	}, nil
+}
+
+func putTimestamp(b []byte, t time.Time) {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(b, secs<<32|frac)
+}
+
+func timestamp(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xFFFFFFFF) * uint64(time.Second) >> 32)
+	return time.Unix(secs, nanos)
+}
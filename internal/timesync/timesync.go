@@ -0,0 +1,254 @@
+package timesync
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Whether the server's clock can be trusted. Boards without a real-time clock boot with a
+// stale time until NTP catches up; weather ages and device clocks computed from it then are
+// wrong. Startup waits a bounded time for a trusted clock and otherwise starts degraded,
+// and a monitor keeps checking: against an NTP server when one is configured, and for
+// jumps of the wall clock against the monotonic clock.
+
+// Config for clock checks
+type Config struct {
+	NTPServer             string `json:"ntpServer"`             // Queried directly, e.g. "pool.ntp.org" ("" = trust any plausible system clock)
+	StartupTimeoutSeconds int    `json:"startupTimeoutSeconds"` // Wait this long at startup before starting degraded (0 = 60)
+	MaxOffsetSeconds      int    `json:"maxOffsetSeconds"`      // Larger NTP offsets and clock jumps make the clock untrusted (0 = 5)
+	CheckMinutes          int    `json:"checkMinutes"`          // Between NTP checks while trusted (0 = 15)
+}
+
+// Status of the clock
+type Status struct {
+	Trusted    bool      `json:"trusted"`
+	Source     string    `json:"source,omitempty"`     // "ntp" or "system" (plausible, no NTP server configured)
+	Server     string    `json:"ntp_server,omitempty"` // NTP server checked against
+	OffsetMs   int64     `json:"offset_ms"`            // From the last NTP check
+	LastCheck  time.Time `json:"last_check,omitempty"` // Last successful NTP check
+	LastError  string    `json:"last_error,omitempty"` // From the last failed NTP check
+	Reason     string    `json:"reason,omitempty"`     // Why the clock is not trusted
+	Unverified bool      `json:"unverified,omitempty"` // Not trusted only because the NTP server could not be reached
+	Jumps      int       `json:"jumps"`                // Wall clock jumps seen since startup
+	LastJumpMs int64     `json:"last_jump_ms,omitempty"`
+	LastJumpAt time.Time `json:"last_jump_at,omitempty"`
+}
+
+// Clocks before this are certainly wrong (an unset clock starts in 1970 or at the build date)
+var minPlausible = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	defaultStartupTimeout = 60 * time.Second
+	defaultMaxOffset      = 5 * time.Second
+	defaultCheckInterval  = 15 * time.Minute
+	monitorInterval       = 30 * time.Second // Jump checks, and NTP checks while untrusted
+	queryTimeout          = 5 * time.Second
+)
+
+var (
+	mu          sync.Mutex
+	config      Config
+	status      Status
+	onChange    func(Status)
+	startupDone bool // Wait returned, trusted or not
+)
+
+// Configure sets the config used by Wait and Monitor
+func Configure(c Config) error {
+	if c.StartupTimeoutSeconds < 0 || c.MaxOffsetSeconds < 0 || c.CheckMinutes < 0 {
+		return fmt.Errorf("timeSync values must not be negative")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	status.Server = c.NTPServer
+	return nil
+}
+
+// OnChange registers a callback invoked when the clock becomes trusted or untrusted, and
+// after each jump once the clock has been checked again
+func OnChange(fn func(Status)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onChange = fn
+}
+
+// Trusted reports whether the clock is known to be right
+func Trusted() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return status.Trusted
+}
+
+// Usable reports whether the clock is good enough to hand out, e.g. to devices: trusted,
+// or, once the startup wait is over, plausible with the NTP server merely unreachable
+// (UDP 123 blocked while the system clock is kept right some other way)
+func Usable() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return status.Trusted || (startupDone && status.Unverified)
+}
+
+// GetStatus returns the clock status
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	return status
+}
+
+// Wait blocks until the clock is trusted or the startup timeout passes, and reports
+// whether it is trusted
+func Wait() bool {
+	mu.Lock()
+	timeout := time.Duration(config.StartupTimeoutSeconds) * time.Second
+	mu.Unlock()
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	defer func() {
+		mu.Lock()
+		startupDone = true
+		mu.Unlock()
+	}()
+	for {
+		if check(false) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			s := GetStatus()
+			fmt.Printf("Clock not trusted after %v (%s), starting in degraded mode\n", timeout, s.Reason)
+			return false
+		}
+		fmt.Printf("Waiting for a trusted clock: %s\n", GetStatus().Reason)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Monitor re-checks the clock and watches for jumps; beat is called every round (health)
+func Monitor(beat func()) {
+	last := time.Now()
+	lastNTP := time.Now()
+	for {
+		time.Sleep(monitorInterval)
+		if beat != nil {
+			beat()
+		}
+
+		now := time.Now()
+		// Sub uses the monotonic clock; Round(0) strips it to compare wall clock times
+		jump := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if abs(jump) > maxOffset() {
+			noteJump(jump)
+			check(true)
+			lastNTP = now
+			continue
+		}
+
+		mu.Lock()
+		every := time.Duration(config.CheckMinutes) * time.Minute
+		trusted := status.Trusted
+		mu.Unlock()
+		if every == 0 {
+			every = defaultCheckInterval
+		}
+		if !trusted || now.Sub(lastNTP) >= every {
+			check(false)
+			lastNTP = now
+		}
+	}
+}
+
+// check evaluates the clock, updates the status and reports whether it is trusted. The
+// OnChange callback runs if trust changed, or always with notify (after a jump).
+func check(notify bool) bool {
+	mu.Lock()
+	server := config.NTPServer
+	mu.Unlock()
+
+	now := time.Now()
+	var next Status
+	switch {
+	case now.Before(minPlausible):
+		next.Reason = fmt.Sprintf("system clock reads %s", now.UTC().Format(time.RFC3339))
+	case server == "":
+		next.Trusted, next.Source = true, "system"
+	default:
+		result, err := Query(server, queryTimeout)
+		if err != nil {
+			next.LastError = err.Error()
+			mu.Lock()
+			wasTrusted := status.Trusted && status.Source == "ntp"
+			mu.Unlock()
+			if wasTrusted {
+				// Already verified; an unreachable server doesn't make the clock wrong (jumps are still caught)
+				next.Trusted, next.Source = true, "ntp"
+			} else {
+				next.Reason = "NTP server unreachable: " + err.Error()
+				next.Unverified = true
+			}
+			break
+		}
+		next.OffsetMs = result.Offset.Milliseconds()
+		next.LastCheck = now
+		if abs(result.Offset) > maxOffset() {
+			next.Reason = fmt.Sprintf("clock is off by %v according to %s", result.Offset.Round(time.Millisecond), server)
+		} else {
+			next.Trusted, next.Source = true, "ntp"
+		}
+	}
+
+	mu.Lock()
+	next.Server = server
+	next.Jumps, next.LastJumpMs, next.LastJumpAt = status.Jumps, status.LastJumpMs, status.LastJumpAt
+	if next.LastCheck.IsZero() {
+		next.LastCheck, next.OffsetMs = status.LastCheck, status.OffsetMs
+	}
+	changed := next.Trusted != status.Trusted
+	status = next
+	hook := onChange
+	mu.Unlock()
+
+	if changed {
+		if next.Trusted {
+			fmt.Printf("Clock trusted (%s, offset %dms)\n", next.Source, next.OffsetMs)
+		} else {
+			fmt.Printf("Clock not trusted: %s\n", next.Reason)
+		}
+	}
+	if (changed || notify) && hook != nil {
+		hook(next)
+	}
+	return next.Trusted
+}
+
+// noteJump records a wall clock jump; the clock is checked again right after, and must be
+// confirmed by the NTP server again to stay trusted
+func noteJump(jump time.Duration) {
+	mu.Lock()
+	status.Source = ""
+	status.Jumps++
+	status.LastJumpMs = jump.Milliseconds()
+	status.LastJumpAt = time.Now()
+	mu.Unlock()
+	fmt.Printf("Clock jumped by %v\n", jump.Round(time.Millisecond))
+}
+
+func maxOffset() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	if config.MaxOffsetSeconds == 0 {
+		return defaultMaxOffset
+	}
+	return time.Duration(config.MaxOffsetSeconds) * time.Second
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
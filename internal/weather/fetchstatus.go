@@ -0,0 +1,37 @@
+package weather
+
+import (
+	"sync"
+	"time"
+)
+
+// FetchStatus summarizes recent weather API calls
+type FetchStatus struct {
+	LastSuccess         time.Time `json:"last_success"` // Zero until a fetch succeeds
+	LastFailure         time.Time `json:"last_failure"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+var (
+	fetchMu     sync.Mutex
+	fetchStatus FetchStatus
+)
+
+func noteFetch(ok bool) {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	if ok {
+		fetchStatus.LastSuccess = time.Now()
+		fetchStatus.ConsecutiveFailures = 0
+	} else {
+		fetchStatus.LastFailure = time.Now()
+		fetchStatus.ConsecutiveFailures++
+	}
+}
+
+// GetFetchStatus returns the outcome of recent weather API calls
+func GetFetchStatus() FetchStatus {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	return fetchStatus
+}
@@ -0,0 +1,87 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Local hour at which the daily high is assumed to occur
+const dailyHighHour = 15
+
+type curvePoint struct {
+	t    time.Time
+	temp float64
+}
+
+// InterpolatedTemp estimates the temperature at now from the last observation and the
+// daily forecast curve: lows at sunrise and highs mid-afternoon, joined by cosine ramps.
+// The observation is shifted along the curve, so it stays the anchor between fetches.
+func InterpolatedTemp(zipcode string, now time.Time) (int8, error) {
+	data, exists := GetStoredWeatherData(zipcode)
+	if !exists || len(data.CurrentWeather) == 0 || len(data.ForecastWeather) == 0 {
+		return 0, fmt.Errorf("need current weather and forecast for zipcode: %s", zipcode)
+	}
+
+	var current_data Current_weather
+	if err := json.Unmarshal(data.CurrentWeather, &current_data); err != nil {
+		return 0, fmt.Errorf("JSON unmarshal error: %v", err)
+	}
+	var forecast_data Forecast_weather
+	if err := json.Unmarshal(data.ForecastWeather, &forecast_data); err != nil {
+		return 0, fmt.Errorf("JSON unmarshal error: %v", err)
+	}
+
+	curve := forecastCurve(forecast_data, time.FixedZone("local", current_data.Timezone))
+	observedAt := time.Unix(int64(current_data.Dt), 0)
+	atObservation, ok := curveAt(curve, observedAt)
+	if !ok {
+		return 0, fmt.Errorf("no usable forecast days for zipcode: %s", zipcode)
+	}
+	atNow, _ := curveAt(curve, now)
+
+	return int8(math.Round(current_data.Main.Temp + atNow - atObservation)), nil
+}
+
+// forecastCurve builds the low/high anchor points of each forecast day, in time order
+func forecastCurve(forecast Forecast_weather, loc *time.Location) []curvePoint {
+	var curve []curvePoint
+	for _, day := range forecast.Data {
+		date, err := time.ParseInLocation("2006-01-02", day.ValidDate, loc)
+		if err != nil {
+			continue
+		}
+		sunrise := date.Add(6 * time.Hour)
+		if day.SunriseTs != 0 {
+			sunrise = time.Unix(int64(day.SunriseTs), 0)
+		}
+		curve = append(curve,
+			curvePoint{sunrise, day.MinTemp},
+			curvePoint{date.Add(dailyHighHour * time.Hour), day.MaxTemp})
+	}
+	sort.Slice(curve, func(i, j int) bool { return curve[i].t.Before(curve[j].t) })
+	return curve
+}
+
+// curveAt evaluates the curve with cosine easing between neighboring anchors
+// Times outside the forecast are held at the nearest end, which leaves the observation unshifted.
+func curveAt(curve []curvePoint, t time.Time) (float64, bool) {
+	if len(curve) == 0 {
+		return 0, false
+	}
+	if t.Before(curve[0].t) {
+		return curve[0].temp, true
+	}
+	for i := 1; i < len(curve); i++ {
+		a, b := curve[i-1], curve[i]
+		if t.Before(a.t) || t.After(b.t) {
+			continue
+		}
+		frac := float64(t.Sub(a.t)) / float64(b.t.Sub(a.t))
+		ease := (1 - math.Cos(math.Pi*frac)) / 2
+		return a.temp + (b.temp-a.temp)*ease, true
+	}
+	return curve[len(curve)-1].temp, true
+}
@@ -24,9 +24,9 @@ type Current_weather struct {
 	} `json:"main"`
 	Visibility int `json:"visibility"`
 	Wind       struct {
-		Speed float64 `json:"speed"`
-		Deg   int     `json:"deg"`
-		Gust  float64 `json:"gust"`
+		Speed *float64 `json:"speed"` // nil if not reported
+		Deg   *int     `json:"deg"`
+		Gust  float64  `json:"gust"`
 	} `json:"wind"`
 	Clouds struct {
 		All int `json:"all"`
@@ -0,0 +1,69 @@
+package weather
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+const earthRadiusKm = 6371.0
+
+// Coordinates returns the location reported with the zipcode's stored current weather
+func Coordinates(zipcode string) (float64, float64, bool) {
+	data, exists := GetStoredWeatherData(zipcode)
+	if !exists || len(data.CurrentWeather) == 0 {
+		return 0, 0, false
+	}
+	var current_data Current_weather
+	if err := json.Unmarshal(data.CurrentWeather, &current_data); err != nil {
+		return 0, 0, false
+	}
+	if current_data.Coord.Lat == 0 && current_data.Coord.Lon == 0 {
+		return 0, 0, false
+	}
+	return current_data.Coord.Lat, current_data.Coord.Lon, true
+}
+
+// NearestZipcodes returns other stored zipcodes within maxKm of zipcode, nearest first
+// Requires that both zipcodes have had current weather stored at some point.
+func NearestZipcodes(zipcode string, maxKm float64) []string {
+	lat, lon, ok := Coordinates(zipcode)
+	if !ok || store == nil {
+		return nil
+	}
+
+	type candidate struct {
+		zip string
+		km  float64
+	}
+	var candidates []candidate
+	for other := range store.GetAll() {
+		if other == zipcode {
+			continue
+		}
+		oLat, oLon, ok := Coordinates(other)
+		if !ok {
+			continue
+		}
+		if km := distanceKm(lat, lon, oLat, oLon); km <= maxKm {
+			candidates = append(candidates, candidate{other, km})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].km < candidates[j].km })
+
+	result := make([]string, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.zip
+	}
+	return result
+}
+
+// distanceKm is the haversine great-circle distance
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,67 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Location returns the time zone of a zipcode from stored weather data: the forecast's
+// IANA zone (which knows about DST) if available, else the fixed UTC offset of the last
+// current-weather observation
+func Location(zipcode string) (*time.Location, error) {
+	data, exists := GetStoredWeatherData(zipcode)
+	if !exists {
+		return nil, fmt.Errorf("no weather data found for zipcode: %s", zipcode)
+	}
+
+	if len(data.ForecastWeather) > 0 {
+		var forecast_data Forecast_weather
+		if err := json.Unmarshal(data.ForecastWeather, &forecast_data); err == nil && forecast_data.Timezone != "" {
+			if loc, err := time.LoadLocation(forecast_data.Timezone); err == nil {
+				return loc, nil
+			}
+		}
+	}
+
+	if len(data.CurrentWeather) > 0 {
+		var current_data Current_weather
+		if err := json.Unmarshal(data.CurrentWeather, &current_data); err != nil {
+			return nil, fmt.Errorf("JSON unmarshal error: %v", err)
+		}
+		return time.FixedZone(zipcode, current_data.Timezone), nil
+	}
+	return nil, fmt.Errorf("no time zone in weather data for zipcode: %s", zipcode)
+}
+
+// NextOffsetChange finds the first UTC offset change in loc within the window after from
+// Returns the instant of the change and the offset (seconds) that takes effect then.
+func NextOffsetChange(loc *time.Location, from time.Time, window time.Duration) (time.Time, int, bool) {
+	_, startOffset := from.In(loc).Zone()
+	end := from.Add(window)
+
+	// Transitions are hours apart at most once a few months, so step hourly then bisect
+	prev := from
+	for t := from.Add(time.Hour); ; t = t.Add(time.Hour) {
+		if t.After(end) {
+			t = end
+		}
+		if _, offset := t.In(loc).Zone(); offset != startOffset {
+			lo, hi := prev, t
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, o := mid.In(loc).Zone(); o == startOffset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			_, newOffset := hi.In(loc).Zone()
+			return hi.Truncate(time.Second), newOffset, true
+		}
+		if !t.Before(end) {
+			return time.Time{}, 0, false
+		}
+		prev = t
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"math"
 	"net/http"
+	"server_app/internal/faults"
 	"server_app/internal/storage"
+	"sort"
 	"sync"
 	"time"
 )
@@ -19,17 +21,65 @@ type WeatherData struct {
 	ForecastWeather        json.RawMessage `json:"forecast_weather"`
 	CurrentWeatherUpdated  string          `json:"current_weather_updated"`
 	ForecastWeatherUpdated string          `json:"forecast_weather_updated"`
+
+	// Set when stored while the server clock was not trusted, so the timestamp may be wrong
+	CurrentWeatherUntrusted  bool `json:"current_weather_untrusted,omitempty"`
+	ForecastWeatherUntrusted bool `json:"forecast_weather_untrusted,omitempty"`
 }
 
-var store *storage.Manager
+var store *storage.TypedManager[WeatherData]
 var mu sync.RWMutex
 
+// Version of the stored WeatherData layout; bump it and add a migration when it changes
+const schemaVersion = 1
+
+// Upgrades of stored weather from older layouts
+var migrations []storage.Migration
+
+// Stored weather for a zipcode is dropped once it goes this long without a fetch, i.e.
+// after its devices are gone (0 = keep forever)
+var retention time.Duration
+
+// Whether the server clock is trusted; weather stored otherwise is flagged
+var clockTrusted = true
+
+// SetClockTrusted marks the timestamps of weather stored from now on as trusted or not
+func SetClockTrusted(trusted bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	clockTrusted = trusted
+}
+
+// SetRetention sets how long weather is kept for a zipcode no longer fetched. Applies from
+// the next fetch of each zipcode.
+func SetRetention(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	retention = d
+}
+
 func InitWeatherStorage(dataFilePath string) error {
 	var err error
-	store, err = storage.New(dataFilePath)
+	store, err = storage.NewTyped[WeatherData](dataFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to initialize weather storage: %v", err)
 	}
+	if err := store.Migrate(schemaVersion, migrations); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+
+	// Entries stored before retention was set start their countdown now
+	mu.Lock()
+	defer mu.Unlock()
+	if retention > 0 {
+		for zipcode, val := range store.GetAll() {
+			if _, hasTTL := store.Expires(zipcode); !hasTTL {
+				if err := store.SetWithTTL(zipcode, val, retention); err != nil {
+					fmt.Printf("Warning: failed to set retention of weather for %s: %v\n", zipcode, err)
+				}
+			}
+		}
+	}
 	fmt.Printf("Initialized weather storage\n")
 	return nil
 }
@@ -52,6 +102,12 @@ func buildWeatherUrls(zipcode string) (string, string) {
 
 // FetchWeatherFromAPI retrieves weather data from the API
 func FetchWeatherFromAPI(data_type string, zipcode string) []byte {
+	body := fetchWeatherFromAPI(data_type, zipcode)
+	noteFetch(len(body) > 0)
+	return body
+}
+
+func fetchWeatherFromAPI(data_type string, zipcode string) []byte {
 	url_current, url_forecast := buildWeatherUrls(zipcode)
 	var url string
 	if data_type == "current_weather" {
@@ -65,6 +121,11 @@ func FetchWeatherFromAPI(data_type string, zipcode string) []byte {
 		return nil
 	}
 
+	if faults.FailWeatherFetch() {
+		fmt.Println("Get_weather: non-2xx status:", http.StatusInternalServerError, "(fault injection)")
+		return nil
+	}
+
 	resp, err := http.Get(url)
 	if err != nil {
 		fmt.Println("Get_weather: http.Get error:", err)
@@ -104,22 +165,20 @@ func Store_weather(data_type string, weather_data []byte, zipcode string) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	var data WeatherData
-	if val, exists := store.Get(zipcode); exists {
-		jsonBytes, _ := json.Marshal(val)
-		json.Unmarshal(jsonBytes, &data)
-	}
+	data, _ := store.Get(zipcode)
 
 	data.Zipcode = zipcode
 	if data_type == "current_weather" {
 		data.CurrentWeather = json.RawMessage(weather_data)
 		data.CurrentWeatherUpdated = time.Now().Format(time.RFC3339)
+		data.CurrentWeatherUntrusted = !clockTrusted
 	} else if data_type == "forecast_weather" {
 		data.ForecastWeather = json.RawMessage(weather_data)
 		data.ForecastWeatherUpdated = time.Now().Format(time.RFC3339)
+		data.ForecastWeatherUntrusted = !clockTrusted
 	}
 
-	if err := store.Set(zipcode, data); err != nil {
+	if err := store.SetWithTTL(zipcode, data, retention); err != nil {
 		fmt.Println("Store_weather: error storing weather:", err)
 	}
 }
@@ -133,15 +192,11 @@ func GetCurrentWeatherTemp(zipcode string) (int8, error) {
 	mu.RLock()
 	defer mu.RUnlock()
 
-	val, exists := store.Get(zipcode)
+	data, exists := store.Get(zipcode)
 	if !exists {
 		return 0, fmt.Errorf("no weather data found for zipcode: %s", zipcode)
 	}
 
-	var data WeatherData
-	jsonBytes, _ := json.Marshal(val)
-	json.Unmarshal(jsonBytes, &data)
-
 	if len(data.CurrentWeather) == 0 {
 		return 0, fmt.Errorf("no current weather data for zipcode: %s", zipcode)
 	}
@@ -155,9 +210,69 @@ func GetCurrentWeatherTemp(zipcode string) (int8, error) {
 	return temp, nil
 }
 
+// GetCurrentCondition returns the current OpenWeather condition group (e.g. "Rain", "Clear")
+func GetCurrentCondition(zipcode string) (string, error) {
+	current_data, err := storedCurrentWeather(zipcode)
+	if err != nil {
+		return "", err
+	}
+	if len(current_data.Weather) == 0 {
+		return "", fmt.Errorf("no condition in current weather for zipcode: %s", zipcode)
+	}
+	return current_data.Weather[0].Main, nil
+}
+
+// CurrentConditions are the readings of the stored current weather beyond the temperature
+type CurrentConditions struct {
+	Temp        int8     `json:"temp"`                // °F, rounded
+	FeelsLike   int8     `json:"feels_like"`          // °F, rounded; accounts for wind chill and humidity
+	Condition   string   `json:"condition,omitempty"` // OpenWeather condition group (e.g. "Rain")
+	ConditionID int      `json:"condition_id,omitempty"`
+	Humidity    uint8    `json:"humidity,omitempty"`   // Percent, 0 if not reported
+	WindSpeed   *float64 `json:"wind_speed,omitempty"` // mph, nil if not reported
+	WindGust    float64  `json:"wind_gust,omitempty"`
+	WindDeg     *int     `json:"wind_deg,omitempty"` // Direction the wind blows from, degrees clockwise from north; nil if not reported
+}
+
+// GetCurrentConditions returns temperature, feels-like, condition, humidity and wind of the stored current weather
+func GetCurrentConditions(zipcode string) (CurrentConditions, error) {
+	current_data, err := storedCurrentWeather(zipcode)
+	if err != nil {
+		return CurrentConditions{}, err
+	}
+	c := CurrentConditions{
+		Temp:      int8(math.Round(current_data.Main.Temp)),
+		FeelsLike: int8(math.Round(current_data.Main.FeelsLike)),
+		WindSpeed: current_data.Wind.Speed,
+		WindGust:  current_data.Wind.Gust,
+		WindDeg:   current_data.Wind.Deg,
+	}
+	if len(current_data.Weather) > 0 {
+		c.Condition, c.ConditionID = current_data.Weather[0].Main, current_data.Weather[0].ID
+	}
+	if h := current_data.Main.Humidity; h > 0 && h <= 100 {
+		c.Humidity = uint8(h)
+	}
+	return c, nil
+}
+
+// Stored current weather for a zipcode, parsed
+func storedCurrentWeather(zipcode string) (Current_weather, error) {
+	var current_data Current_weather
+	data, exists := GetStoredWeatherData(zipcode)
+	if !exists || len(data.CurrentWeather) == 0 {
+		return current_data, fmt.Errorf("no current weather data for zipcode: %s", zipcode)
+	}
+	if err := json.Unmarshal(data.CurrentWeather, &current_data); err != nil {
+		return current_data, fmt.Errorf("JSON unmarshal error: %v", err)
+	}
+	return current_data, nil
+}
+
 // ForecastDay represents a single day forecast for the protocol
 type ForecastDay struct {
-	HighTemp uint8
+	HighTemp int8 // Daytime high (7am to 7pm local), °F rounded
+	LowTemp  int8 // Overnight low (7pm to 7am local), °F rounded
 	Precip   uint8
 	Moon     uint8
 }
@@ -171,15 +286,11 @@ func GetForecastDays(zipcode string, numDays int) ([]ForecastDay, error) {
 	mu.RLock()
 	defer mu.RUnlock()
 
-	val, exists := store.Get(zipcode)
+	data, exists := store.Get(zipcode)
 	if !exists {
 		return nil, fmt.Errorf("no weather data found for zipcode: %s", zipcode)
 	}
 
-	var data WeatherData
-	jsonBytes, _ := json.Marshal(val)
-	json.Unmarshal(jsonBytes, &data)
-
 	if len(data.ForecastWeather) == 0 {
 		return nil, fmt.Errorf("no forecast data for zipcode: %s", zipcode)
 	}
@@ -197,9 +308,6 @@ func GetForecastDays(zipcode string, numDays int) ([]ForecastDay, error) {
 	for i := 0; i < numDays; i++ {
 		forecastDay := forecast_data.Data[i]
 
-		// HighTemp: convert to uint8, taking absolute value
-		highTemp := uint8(math.Round(math.Abs(forecastDay.HighTemp)))
-
 		// Precip: already int, just convert to uint8
 		precip := uint8(forecastDay.Pop)
 
@@ -214,7 +322,8 @@ func GetForecastDays(zipcode string, numDays int) ([]ForecastDay, error) {
 		}
 
 		days[i] = ForecastDay{
-			HighTemp: highTemp,
+			HighTemp: int8(math.Round(forecastDay.HighTemp)),
+			LowTemp:  int8(math.Round(forecastDay.LowTemp)),
 			Precip:   precip,
 			Moon:     moon,
 		}
@@ -223,6 +332,23 @@ func GetForecastDays(zipcode string, numDays int) ([]ForecastDay, error) {
 	return days, nil
 }
 
+// StoredZipcodes returns the zipcodes with stored weather, sorted
+func StoredZipcodes() []string {
+	if store == nil {
+		return nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var zipcodes []string
+	for zipcode := range store.GetAll() {
+		zipcodes = append(zipcodes, zipcode)
+	}
+	sort.Strings(zipcodes)
+	return zipcodes
+}
+
 // GetStoredWeatherData retrieves the full weather data struct for a zipcode from storage
 func GetStoredWeatherData(zipcode string) (WeatherData, bool) {
 	if store == nil {
@@ -232,12 +358,5 @@ func GetStoredWeatherData(zipcode string) (WeatherData, bool) {
 	mu.RLock()
 	defer mu.RUnlock()
 
-	if val, exists := store.Get(zipcode); exists {
-		var data WeatherData
-		jsonBytes, _ := json.Marshal(val)
-		json.Unmarshal(jsonBytes, &data)
-		return data, true
-	}
-
-	return WeatherData{}, false
+	return store.Get(zipcode)
 }
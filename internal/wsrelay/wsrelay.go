@@ -0,0 +1,194 @@
+package wsrelay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"server_app/internal/messaging"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Browser clients (dashboard, etchsketch web client) reach MQTT topics through this relay
+// using JSON text frames over the admin interface:
+//
+//	-> {"op":"subscribe","topic":"etch_sketch"}
+//	-> {"op":"unsubscribe","topic":"etch_sketch"}
+//	-> {"op":"publish","topic":"etch_sketch","payload":"<base64>","qos":0,"retain":false}
+//	<- {"op":"message","topic":"etch_sketch","payload":"<base64>"}
+//	<- {"op":"error","error":"..."}
+//
+// Only topics matching the configured allow list can be used.
+
+// Frame is one relay protocol message
+type Frame struct {
+	Op      string `json:"op"`
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"` // base64
+	QoS     int    `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Outbound frames buffered per client before it is considered too slow and dropped
+const sendBuffer = 64
+
+var upgrader = websocket.Upgrader{}
+
+// Handler upgrades requests to the relay; allowed lists MQTT filters clients may use
+func Handler(allowed []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Printf("WS relay: upgrade failed: %v\n", err)
+			return
+		}
+		c := &client{conn: conn, allowed: allowed, send: make(chan Frame, sendBuffer), taps: make(map[string]func())}
+		fmt.Printf("WS relay: client connected from %s\n", r.RemoteAddr)
+		go c.writeLoop()
+		c.readLoop()
+		c.close()
+		fmt.Printf("WS relay: client %s disconnected\n", r.RemoteAddr)
+	}
+}
+
+type client struct {
+	conn    *websocket.Conn
+	allowed []string
+	send    chan Frame
+
+	mu     sync.Mutex
+	taps   map[string]func() // filter -> cancel
+	closed bool
+}
+
+func (c *client) readLoop() {
+	for {
+		var f Frame
+		if err := c.conn.ReadJSON(&f); err != nil {
+			return
+		}
+		if err := c.handle(f); err != nil {
+			c.enqueue(Frame{Op: "error", Error: err.Error()})
+		}
+	}
+}
+
+func (c *client) writeLoop() {
+	for f := range c.send {
+		if err := c.conn.WriteJSON(f); err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *client) handle(f Frame) error {
+	switch f.Op {
+	case "subscribe":
+		if !filterAllowed(c.allowed, f.Topic) {
+			return fmt.Errorf("topic %q not allowed", f.Topic)
+		}
+		c.mu.Lock()
+		_, exists := c.taps[f.Topic]
+		c.mu.Unlock()
+		if exists {
+			return nil
+		}
+		// Subscribing waits on the broker, so don't hold mu (message delivery needs it)
+		cancel := messaging.Tap(f.Topic, func(topic string, payload []byte) {
+			c.enqueue(Frame{Op: "message", Topic: topic, Payload: base64.StdEncoding.EncodeToString(payload)})
+		})
+		c.mu.Lock()
+		c.taps[f.Topic] = cancel
+		c.mu.Unlock()
+		return nil
+
+	case "unsubscribe":
+		c.mu.Lock()
+		cancel, exists := c.taps[f.Topic]
+		delete(c.taps, f.Topic)
+		c.mu.Unlock()
+		if exists {
+			cancel()
+		}
+		return nil
+
+	case "publish":
+		if !topicAllowed(c.allowed, f.Topic) {
+			return fmt.Errorf("topic %q not allowed", f.Topic)
+		}
+		payload, err := base64.StdEncoding.DecodeString(f.Payload)
+		if err != nil {
+			return fmt.Errorf("payload must be base64: %v", err)
+		}
+		switch {
+		case f.Retain:
+			messaging.PublishRetained(f.Topic, payload)
+		case f.QoS == 0:
+			messaging.PublishQoS0(f.Topic, payload)
+		default:
+			messaging.PublishQoS1(f.Topic, payload)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown op %q", f.Op)
+	}
+}
+
+// enqueue drops frames for clients that stop reading rather than blocking MQTT delivery
+func (c *client) enqueue(f Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- f:
+	default:
+	}
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	c.closed = true
+	taps := c.taps
+	c.taps = nil
+	close(c.send)
+	c.mu.Unlock()
+
+	for _, cancel := range taps {
+		cancel()
+	}
+	c.conn.Close()
+}
+
+// filterAllowed reports whether a subscription filter is in the allow list
+// Wildcard filters must match an allowed entry exactly; concrete topics may match a wildcard entry.
+func filterAllowed(allowed []string, filter string) bool {
+	if strings.ContainsAny(filter, "+#") {
+		for _, a := range allowed {
+			if a == filter {
+				return true
+			}
+		}
+		return false
+	}
+	return topicAllowed(allowed, filter)
+}
+
+// topicAllowed reports whether a concrete topic matches any allowed filter
+func topicAllowed(allowed []string, topic string) bool {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	for _, a := range allowed {
+		if messaging.TopicMatches(a, topic) {
+			return true
+		}
+	}
+	return false
+}
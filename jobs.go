@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server_app/internal/devices"
+	"server_app/internal/jobs"
+	"server_app/internal/messaging"
+	"server_app/internal/migration"
+	"server_app/internal/storage"
+	"strings"
+	"time"
+)
+
+// Pause between devices in an OTA rollout unless the job sets "interval"
+const defaultRolloutInterval = 10 * time.Second
+
+// Topic migration defaults: how long devices get to move, and how often the job checks on them
+const (
+	defaultMigrationWindow = 24 * time.Hour
+	migrationPollInterval  = 30 * time.Second
+)
+
+// Storage files copied by backup jobs, and where the copies go (set in main)
+var (
+	backupFiles []string
+	backupDir   string
+)
+
+// Register the long-running operations available through the job queue
+func register_job_handlers() {
+	jobs.Register("config_push", job_config_push)
+	jobs.Register("ota_rollout", job_ota_rollout)
+	jobs.Register("backup", job_backup)
+	jobs.Register("topic_migration", job_topic_migration)
+}
+
+// Job param holding the target devices resolved on the first attempt
+const jobParamTargets = "targets"
+
+// Devices a job targets: the comma-separated "devices" param, or every active device;
+// narrowed to one hardware type by the "hw_type" param. Resolved once and saved with the
+// job, so a resumed job continues over the same devices even if the fleet changed.
+func job_target_devices(run *jobs.Run) []string {
+	if saved, ok := run.LookupParam(jobParamTargets); ok {
+		if saved == "" {
+			return nil
+		}
+		return strings.Split(saved, ",")
+	}
+	targets := resolve_job_targets(run)
+	run.SetParam(jobParamTargets, strings.Join(targets, ","))
+	return targets
+}
+
+func resolve_job_targets(run *jobs.Run) []string {
+	var names []string
+	if list := run.Param("devices"); list != "" {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for _, device := range devices.GetActiveDevices() {
+			names = append(names, device.Name)
+		}
+	}
+
+	hardwareType := run.Param("hw_type")
+	if hardwareType == "" {
+		return names
+	}
+	var matching []string
+	for _, name := range names {
+		if device, exists := devices.GetDevice(name); exists && device.Metadata.HardwareType == hardwareType {
+			matching = append(matching, name)
+		}
+	}
+	return matching
+}
+
+// Resend the full config to each target device
+// Params: devices (optional, comma-separated), hw_type (optional)
+func job_config_push(ctx context.Context, run *jobs.Run) error {
+	targets := job_target_devices(run)
+	for i := run.Done(); i < len(targets); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		publish_full_device_config(targets[i])
+		run.Progress(i+1, len(targets))
+	}
+	run.Progress(len(targets), len(targets))
+	return nil
+}
+
+// Announce the latest firmware version for its hardware type to each target device, one at
+// a time, spaced out so they don't all download the update at once
+// Params: devices (optional, comma-separated), hw_type (optional), interval (optional
+// duration, default 10s)
+func job_ota_rollout(ctx context.Context, run *jobs.Run) error {
+	interval := defaultRolloutInterval
+	if s := run.Param("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %v", s, err)
+		}
+		interval = d
+	}
+
+	targets := job_target_devices(run)
+	// Devices an earlier attempt failed to reach get another try first
+	var failed []string
+	if earlier := run.Param(jobParamFailed); earlier != "" {
+		for _, name := range strings.Split(earlier, ",") {
+			if !announce_rollout_version(name) {
+				failed = append(failed, name)
+			}
+		}
+		run.SetParam(jobParamFailed, strings.Join(failed, ","))
+	}
+	for i := run.Done(); i < len(targets); i++ {
+		if i > run.Done() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		if !announce_rollout_version(targets[i]) {
+			failed = append(failed, targets[i])
+			run.SetParam(jobParamFailed, strings.Join(failed, ","))
+		}
+		run.Progress(i+1, len(targets))
+	}
+	run.Progress(len(targets), len(targets))
+	if len(failed) > 0 {
+		return fmt.Errorf("could not announce firmware to %d of %d devices: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Job param listing the devices an OTA rollout could not reach
+const jobParamFailed = "failed"
+
+// Announce the latest firmware to one device of a rollout; false if the device is gone or
+// the broker didn't take the message
+func announce_rollout_version(deviceName string) bool {
+	if _, exists := devices.GetDevice(deviceName); !exists {
+		fmt.Printf("OTA rollout: device %s no longer exists\n", deviceName)
+		return false
+	}
+	return publish_version_notification(deviceName)
+}
+
+// Copy the storage files into a directory under backupDir
+// Params: name (optional directory name, default "job-<id>")
+func job_backup(ctx context.Context, run *jobs.Run) error {
+	name := run.Param("name")
+	if name == "" {
+		name = "job-" + run.ID() // Stable across attempts, so a resumed backup stays in one place
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid backup name %q", name)
+	}
+	if storage.InMemory() {
+		return fmt.Errorf("storage is in memory only, there are no files to back up")
+	}
+	dir := filepath.Join(backupDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	if err := storage.FlushAll(); err != nil { // Back up what is in memory, not an older file
+		return err
+	}
+	for i := run.Done(); i < len(backupFiles); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := storage.CopyFile(backupFiles[i], filepath.Join(dir, filepath.Base(backupFiles[i]))); err != nil {
+			return err
+		}
+		run.Progress(i+1, len(backupFiles))
+	}
+	if storage.SQLiteDB() != nil {
+		if err := storage.BackupSQLite(filepath.Join(dir, "storage.db")); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Backup written to %s\n", dir)
+	return nil
+}
+
+// Move the fleet to a new topic namespace: serve old and new namespaces side by side, push
+// the new topic_prefix config to each device, wait until every device is heard on the new
+// namespace (or the transition window ends), then stop serving the old namespace and clear
+// its retained messages. Devices that have not moved keep the old namespace served and
+// fail the job, unless force is set.
+// Params: prefix (new namespace, e.g. "home1/"), transition (optional duration, default 24h),
+// devices (optional, comma-separated), force (optional, "true" to finish despite laggards)
+func job_topic_migration(ctx context.Context, run *jobs.Run) error {
+	prefix := run.Param("prefix")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return fmt.Errorf("invalid prefix %q", prefix)
+	}
+	window := defaultMigrationWindow
+	if s := run.Param("transition"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid transition %q: %v", s, err)
+		}
+		window = d
+	}
+
+	targets := job_target_devices(run)
+	total := len(targets) + 2 // Begin, one config push per device, cleanup
+	state, err := migration.Begin(prefix, targets, window)
+	if err != nil {
+		return err
+	}
+	messaging.SetTopicNamespace(state.To, state.From, true)
+	if run.Done() == 0 {
+		run.Progress(1, total)
+	}
+
+	for i := run.Done() - 1; i < len(targets); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		publish_full_device_config(targets[i])
+		run.Progress(i+2, total)
+	}
+
+	for len(migration.Pending()) > 0 && time.Now().Before(state.Deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationPollInterval):
+		}
+	}
+	if pending := migration.Pending(); len(pending) > 0 {
+		if run.Param("force") != "true" {
+			return fmt.Errorf("devices still on namespace %q: %s", state.From, strings.Join(pending, ", "))
+		}
+		fmt.Printf("Finishing topic migration without %s\n", strings.Join(pending, ", "))
+	}
+
+	// Retained topics published before this process started are cleared by name too
+	retained := []string{TopicServerStatus}
+	if etchsketchTopic != "" {
+		retained = append(retained, etchsketchTopic)
+	}
+	for _, zip := range devices.GetActiveZipcodes() {
+		retained = append(retained, TopicWeatherPrefix+"/"+zip)
+	}
+	messaging.SetTopicNamespace(state.To, state.From, false)
+	messaging.ClearPreviousNamespace(retained)
+	migration.Complete()
+	run.Progress(total, total)
+	fmt.Printf("Topic migration to namespace %q complete\n", state.To)
+	return nil
+}
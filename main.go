@@ -2,26 +2,175 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"server_app/internal/accounting"
+	"server_app/internal/admin"
+	"server_app/internal/arbiter"
+	"server_app/internal/auth"
+	"server_app/internal/bridge"
+	"server_app/internal/buildinfo"
+	"server_app/internal/capture"
+	"server_app/internal/conformance"
+	"server_app/internal/deadletter"
 	"server_app/internal/devices"
 	"server_app/internal/etchsketch"
+	"server_app/internal/events"
+	"server_app/internal/federation"
+	"server_app/internal/health"
+	"server_app/internal/holiday"
+	"server_app/internal/inbox"
+	"server_app/internal/influx"
+	"server_app/internal/jobs"
+	"server_app/internal/logfile"
 	"server_app/internal/messaging"
+	"server_app/internal/migration"
+	"server_app/internal/mood"
+	"server_app/internal/notify"
+	"server_app/internal/ota"
+	"server_app/internal/rules"
+	"server_app/internal/scenes"
+	"server_app/internal/storage"
+	"server_app/internal/telemetry"
+	"server_app/internal/timeline"
+	"server_app/internal/timesync"
 	"server_app/internal/weather"
+	"server_app/internal/webhook"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 // Runtime configuration
 type RuntimeConfig struct {
-	DeviceVersion string `json:"deviceVersion"`
+	DeviceVersion   string              `json:"deviceVersion"`
+	AdminAddr       string              `json:"adminAddr"`       // Local admin HTTP listen address (read at startup only)
+	MQTT            messaging.Config    `json:"mqtt"`            // Broker URL(s), credentials and TLS paths (read at startup only)
+	WSRelayTopics   []string            `json:"wsRelayTopics"`   // MQTT filters browsers may use via /mqtt/ws (read at startup only; empty = relay disabled)
+	RequireApproval bool                `json:"requireApproval"` // New devices must be approved via admin interface
+	Rules           []rules.Rule        `json:"rules"`           // Telemetry threshold rules driving display indicators
+	HubDevices      []string            `json:"hubDevices"`      // Displays receiving the household summary
+	Tenants         map[string][]string `json:"tenants"`         // Tenant (household) -> device IDs for usage accounting
+
+	// Persistent log file under ./data/logs (read at startup only)
+	LogToFile    bool `json:"logToFile"`    // Also write stdout to a rotating log file
+	LogMaxSizeMB int  `json:"logMaxSizeMB"` // Rotate once the file reaches this size
+	LogMaxFiles  int  `json:"logMaxFiles"`  // Rotated files to keep
+
+	// Log every received message with its decoded contents (read at startup only; SIGUSR2
+	// toggles it at runtime)
+	VerboseLogging bool `json:"verboseLogging"`
+
+	// Offline alerting
+	HeartbeatTimeoutMinutes int    `json:"heartbeatTimeoutMinutes"` // Mark device inactive after this much silence (0 = LWT only)
+	OfflineGraceMinutes     int    `json:"offlineGraceMinutes"`     // Alert once a device has been offline this long
+	OfflineWebhookURL       string `json:"offlineWebhookURL"`       // POST target for offline/online alerts ("" = disabled)
+
+	// Shared canvas guest drawing
+	GuestModeration           bool `json:"guestModeration"`           // Hold guest frames until approved via admin interface
+	GuestSubmissionTTLMinutes int  `json:"guestSubmissionTTLMinutes"` // Drop unreviewed guest frames after this long
+
+	// Holiday theming: built-in US holidays and household dates switch display themes
+	Holidays HolidayConfig `json:"holidays"`
+
+	// Shared canvas content filter
+	CanvasBlocklist       []etchsketch.Stencil `json:"canvasBlocklist"`       // Blocked shapes matched against incoming frames
+	CanvasBlocklistAction string               `json:"canvasBlocklistAction"` // "reject" (default) or "quarantine" into the moderation queue
+
+	// Shared canvas size, 16-64 per side (read at startup only; 0 = 16). Devices on the
+	// original protocol see the top-left 16x16.
+	CanvasWidth  int `json:"canvasWidth"`
+	CanvasHeight int `json:"canvasHeight"`
+
+	// Directory watched for images to push to the shared canvas; pushed files move to
+	// done/ or failed/ below it (read at startup only; "" = disabled)
+	DisplayDropDir string `json:"displayDropDir"`
+
+	// Listen address of the gRPC admin API (cds.admin.v1), which uses the admin interface's
+	// API keys (read at startup only; "" = disabled)
+	GRPCAddr string `json:"grpcAddr"`
+
+	// Current weather push: every update, or only meaningful changes (e-paper displays)
+	WeatherPush WeatherPushConfig `json:"weatherPush"`
+
+	// Drop stored weather for zipcodes not fetched this long, e.g. after their devices are removed (0 = keep forever)
+	WeatherRetentionHours int `json:"weatherRetentionHours"`
+
+	// Email/Telegram/Slack alerts about offline devices, failing weather fetches and failed
+	// OTA rollouts
+	Notify notify.Config `json:"notify"`
+
+	// Weather, device uptime and telemetry metrics in InfluxDB line protocol (read at startup
+	// only; no url = disabled)
+	Influx influx.Config `json:"influx"`
+
+	// healthchecks.io ping URL, e.g. https://hc-ping.com/<uuid> ("" = disabled)
+	HealthcheckURL string `json:"healthcheckURL"`
+
+	// Shared canvas with other servers (read at startup only)
+	Federation federation.Config `json:"federation"`
+
+	// Topics mirrored to and from a cloud MQTT broker (read at startup only; no brokers = disabled)
+	Bridge bridge.Config `json:"bridge"`
+
+	// NTP server and startup timeout for trusting the server clock (read at startup only)
+	TimeSync timesync.Config `json:"timeSync"`
+
+	// Hex-dumped capture of MQTT traffic under ./data/logs; toggled at runtime via
+	// /mqtt/capture or the "capture" control command (read at startup only)
+	Capture capture.Config `json:"capture"`
+
+	// Admin API/dashboard sign-in: API keys and OIDC providers (read at startup only; none = open)
+	Auth auth.Config `json:"auth"`
+
+	// Named device states applied together via the admin API or triggers
+	Scenes []scenes.Scene `json:"scenes"`
+
+	// Custom MSG_GENERIC channels: field schemas for data sent to extension firmware
+	CustomChannels []messaging.Channel `json:"customChannels"`
+
+	// Display priority per notification source ("text", "rule"), overriding the defaults
+	NotificationPriorities map[string]int `json:"notificationPriorities"`
+
+	// Downtime hint sent to devices on shutdown (0 = default 120s, negative = don't announce)
+	ShutdownDowntimeSeconds int `json:"shutdownDowntimeSeconds"`
+
+	// Storage backend for ./data: "json" (default), "sqlite", or "memory" (start from the JSON
+	// files and write nothing, for tests and dry runs) (read at startup only)
+	StorageBackend string `json:"storageBackend"`
+
+	// Storage write coalescing (read at startup only)
+	StorageFlushSeconds int `json:"storageFlushSeconds"` // Collect changes this long before writing (0 = write every change immediately)
+	StorageFlushChanges int `json:"storageFlushChanges"` // Write sooner once this many changes are pending (0 = 100)
+
+	// Days of history kept in the event timeline (read at startup only; 0 = 90)
+	TimelineRetentionDays int `json:"timelineRetentionDays"`
+
+	// Encrypt storage files at rest with the key in the CDS_STORAGE_KEY environment variable
+	// or, without it, in this file (read at startup only; neither = plaintext)
+	StorageKeyFile string `json:"storageKeyFile"`
+
+	// Hold publishes made while disconnected in ./data (read at startup only)
+	PersistPublishQueue bool `json:"persistPublishQueue"`
+
+	// Suspend weather fetches and periodic device updates once no device has been active this long (0 = never)
+	IdleAfterMinutes int `json:"idleAfterMinutes"`
+
+	// Publish QoS/retain/expiry overrides, checked before the built-in defaults
+	TopicPolicies []messaging.TopicPolicy `json:"topicPolicies"`
+}
+
+// Holiday calendar and per-theme canvas art
+type HolidayConfig struct {
+	Builtin   bool                `json:"builtin"`   // Include built-in US holidays
+	Custom    []holiday.Custom    `json:"custom"`    // Household dates ("MM-DD" or "YYYY-MM-DD")
+	CanvasArt map[string][]string `json:"canvasArt"` // Theme -> 16 rows of color letters drawn on the shared canvas
 }
 
 var (
@@ -33,6 +182,10 @@ var (
 var etchsketchManager *etchsketch.Manager
 var etchsketchTopic string
 
+// Broker connection weather and canvas messages are published through (set with the
+// client in start_mqtt_process, so the in-memory client stands in for paho there too)
+var mqttPublisher messaging.Publisher
+
 // Load runtime config from config.json
 func loadRuntimeConfig() error {
 	data, err := os.ReadFile("config.json")
@@ -44,270 +197,1304 @@ func loadRuntimeConfig() error {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return fmt.Errorf("failed to parse config.json: %w", err)
 	}
+	if dryRun {
+		config = dry_run_config(config)
+	}
 
 	configMutex.Lock()
 	runtimeConfig = config
 	configMutex.Unlock()
 
+	devices.SetApprovalRequired(config.RequireApproval)
+	weather.SetRetention(time.Duration(config.WeatherRetentionHours) * time.Hour)
+	if err := rules.SetRules(config.Rules); err != nil {
+		fmt.Printf("Warning: invalid rules in config.json, keeping previous rules: %v\n", err)
+	}
+	if err := scenes.SetScenes(config.Scenes); err != nil {
+		fmt.Printf("Warning: invalid scenes in config.json, keeping previous scenes: %v\n", err)
+	}
+	if err := messaging.SetChannels(config.CustomChannels); err != nil {
+		fmt.Printf("Warning: invalid custom channels in config.json, keeping previous channels: %v\n", err)
+	}
+	if err := holiday.SetCalendar(config.Holidays.Builtin, config.Holidays.Custom); err != nil {
+		fmt.Printf("Warning: invalid holidays in config.json, keeping previous calendar: %v\n", err)
+	}
+	if err := etchsketch.SetBlocklist(config.CanvasBlocklist); err != nil {
+		fmt.Printf("Warning: invalid canvas blocklist in config.json, keeping previous blocklist: %v\n", err)
+	}
+	if err := notify.SetConfig(config.Notify); err != nil {
+		fmt.Printf("Warning: invalid notify config in config.json, keeping previous channels and rules: %v\n", err)
+	}
+	// A bad entry is skipped on its own; the rest, and the built-in defaults, still apply
+	var topicPolicies []messaging.TopicPolicy
+	for i, p := range config.TopicPolicies {
+		if err := p.Validate(); err != nil {
+			fmt.Printf("Warning: skipping invalid topic policy %d in config.json: %v\n", i, err)
+			continue
+		}
+		topicPolicies = append(topicPolicies, p)
+	}
+	if err := messaging.SetPolicies(append(topicPolicies, default_topic_policies()...)); err != nil {
+		fmt.Printf("Warning: invalid topic policies, keeping previous policies: %v\n", err)
+	}
+
+	version, err := strconv.ParseUint(config.DeviceVersion, 10, 16)
+	if err != nil || version == 0 {
+		fmt.Printf("Warning: invalid version format '%s', using default 1\n", config.DeviceVersion)
+		version = 1
+	}
+	ota.SetDefault(uint16(version))
+
 	fmt.Printf("Loaded runtime config: deviceVersion=%s\n", config.DeviceVersion)
 	return nil
 }
 
-// Get current device version from runtime config as uint16
-func getDeviceVersion() uint16 {
-	configMutex.RLock()
-	defer configMutex.RUnlock()
+// Built-in publish policies per protocol specification; anything unmatched is QoS 1
+func default_topic_policies() []messaging.TopicPolicy {
+	qos0 := func(topic string, msgType uint8, retained bool) messaging.TopicPolicy {
+		return messaging.TopicPolicy{Topic: topic, Type: &msgType, Policy: messaging.Policy{QoS: 0, Retained: retained}}
+	}
+	return []messaging.TopicPolicy{
+		// Shared view frames are QoS 0 but retained so devices get the canvas on subscribe
+		qos0(TopicEtchSketch, messaging.MSG_TYPE_ETCH_UPDATE_FRAME, true),
+		// Periodic messages that are superseded by the next one
+		qos0("#", messaging.MSG_CURRENT_WEATHER, false),
+		qos0("#", messaging.MSG_CURRENT_WEATHER_V2, false),
+		qos0("#", messaging.MSG_FORECAST_WEATHER, false),
+		qos0("#", messaging.MSG_FORECAST_WEATHER_V2, false),
+		qos0("#", messaging.MSG_WEATHER_UNAVAILABLE, false),
+		qos0("#", messaging.MSG_HOUSEHOLD_SUMMARY, false),
+		qos0("#", messaging.MSG_WEATHER_MOOD, false),
+		qos0("#", messaging.MSG_TYPE_ETCH_CALIBRATED_FRAME, false),
+		// A late clock message is worse than none; devices can ask again
+		qos0("#", messaging.MSG_TIME, false),
+	}
+}
 
-	version, err := strconv.ParseUint(runtimeConfig.DeviceVersion, 10, 16)
-	if err != nil {
-		fmt.Printf("Warning: invalid version format '%s', using default 1\n", runtimeConfig.DeviceVersion)
-		return 1
+// Latest firmware version for a device's hardware type (deviceVersion when its type has no release)
+func device_firmware_version(deviceName string) uint16 {
+	hardwareType := ""
+	if device, exists := devices.GetDevice(deviceName); exists {
+		hardwareType = device.Metadata.HardwareType
 	}
-	return uint16(version)
+	return ota.Latest(hardwareType)
 }
 
 // Periodically reload runtime config
 func task_reload_config() {
+	health.Register("config_reload", 15*time.Minute)
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
+		health.Beat("config_reload")
 		if err := loadRuntimeConfig(); err != nil {
 			fmt.Printf("Warning: failed to reload config: %v\n", err)
 		}
 	}
 }
 
-// Monitor current time set by ntpd at bootup. Only continue when time is updated
-func wait_for_current_time() {
-	t := time.Now()
-	num_tries := 0
-	// While current time shows before 2020, wait till ntpd gets current time
-	for t.Before(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
-		fmt.Println("Wait 5 more seconds for ntpd to get time...")
-		// Try every 5 seconds for 30 seconds, then wait a minute
-		if num_tries < 6 {
-			time.Sleep(5 * time.Second)
-			num_tries++
+// Periodically summarize heartbeats into the device event log and snapshot device state
+func task_device_checkpoint() {
+	health.Register("device_checkpoint", time.Duration(DeviceCheckpointInterval)*time.Minute)
+	ticker := time.NewTicker(time.Duration(DeviceCheckpointInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("device_checkpoint")
+		if err := devices.Checkpoint(); err != nil {
+			fmt.Printf("Warning: device checkpoint failed: %v\n", err)
+			health.Set("devices", health.StateDegraded, "checkpoint failed: "+err.Error())
 		} else {
-			time.Sleep(60 * time.Second)
-			num_tries = 0
+			health.Set("devices", health.StateOK, "")
 		}
-		t = time.Now()
 	}
 }
 
+// Config for --dry-run: nothing that reaches outside the process. The in-memory broker
+// stands in for the configured ones; alerts, metrics export, federation, the cloud bridge
+// and healthcheck pings are off.
+func dry_run_config(config RuntimeConfig) RuntimeConfig {
+	config.MQTT.Brokers = []string{"mem://local"}
+	config.MQTT.PerBroker = nil
+	config.Notify = notify.Config{}
+	config.OfflineWebhookURL = ""
+	config.Influx = influx.Config{}
+	config.HealthcheckURL = ""
+	config.Federation = federation.Config{}
+	config.Bridge = bridge.Config{}
+	return config
+}
+
 // Fetch and store weather data
 func fetch_weather(data_type string, zip string) {
+	if dryRun {
+		// The weather API is billed per call; devices get the weather already stored
+		fmt.Printf("Dry run: not fetching %s for %s\n", data_type, zip)
+		return
+	}
+	accounting.NoteWeatherCall(devices_in_zipcode(zip))
 	weather_data := weather.FetchWeatherFromAPI(data_type, zip)
 	if len(weather_data) > 0 {
 		weather.Store_weather(data_type, weather_data, zip)
 		fmt.Printf("Fetched and stored %s for %s\n", data_type, zip)
+		events.Publish(events.Event{Type: events.WeatherFetched, Data: map[string]string{"kind": data_type, "zipcode": zip}})
+		if data_type == "current_weather" {
+			export_weather(zip, weather_data)
+		}
+	}
+}
+
+// Count a message from a device. Unknown and pending devices get no accounting records,
+// so bootups from any name can't grow the accounting store.
+func account_message_in(deviceName string, size int) {
+	if device, exists := devices.GetDevice(deviceName); exists && !device.Pending {
+		accounting.NoteMessageIn(deviceName, size)
+	}
+}
+
+// Active devices associated with a zipcode
+func devices_in_zipcode(zip string) []string {
+	var ids []string
+	for _, device := range devices.GetActiveDevices() {
+		if device.Zipcode == zip {
+			ids = append(ids, device.ID)
+		}
+	}
+	return ids
+}
+
+// Attribute a published message to the (approved) devices that receive it
+func account_publish(topic string, size int) {
+	if zip := strings.TrimPrefix(topic, TopicWeatherPrefix+"/"); zip != topic {
+		for _, id := range devices_in_zipcode(zip) {
+			if !devices.IsPending(id) {
+				accounting.NoteMessageOut(id, size)
+			}
+		}
+		return
+	}
+	for _, device := range devices.GetAllDevices() {
+		if deviceTopic(device.Name) == topic {
+			if !device.Pending {
+				accounting.NoteMessageOut(device.ID, size)
+			}
+			return
+		}
+	}
+}
+
+// Device config key opting a device into interpolated temperature updates
+const configKeyInterpolateTemp = "interpolate_temp"
+
+// Between weather fetches, send opted-in devices a temperature estimated from the forecast curve
+// Topic: <device_name>, Message Type: 0x01 with WEATHER_FLAG_INTERPOLATED, QoS: 0
+func task_interpolated_temp() {
+	ticker := time.NewTicker(time.Duration(InterpolatedTempInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if server_idle() {
+			continue
+		}
+		for _, device := range devices.GetActiveDevices() {
+			// The estimate is of the actual temperature, which feels-like devices don't show
+			if device.Pending || device.Config[configKeyInterpolateTemp] != "true" || device.Config[configKeyFeelsLike] == "true" {
+				continue
+			}
+			// Only refine fresh observations; degraded data is handled by publish_weather
+			if !is_weather_valid("current_weather", device.Zipcode) {
+				continue
+			}
+			temp, err := weather.InterpolatedTemp(device.Zipcode, time.Now())
+			if err != nil {
+				fmt.Printf("Skipping interpolated temp for %s: %v\n", device.Name, err)
+				continue
+			}
+			msg := messaging.WithWeatherFlags(messaging.EncodeCurrentWeather(temp), messaging.WEATHER_FLAG_INTERPOLATED)
+			if device.Metadata.HasCapability(capabilityWeatherV2) {
+				msg = messaging.WithWeatherFlags(messaging.EncodeCurrentWeatherV2(current_weather_v2(device.Zipcode, temp)), messaging.WEATHER_FLAG_INTERPOLATED)
+			}
+			if !hold_if_quiet(device.Name, msg) {
+				mqttPublisher.PublishIfChanged(deviceTopic(device.Name), msg)
+			}
+		}
+	}
+}
+
+// Persist usage accounting periodically
+func task_accounting_flush() {
+	health.Register("accounting_flush", time.Duration(DeviceCheckpointInterval)*time.Minute)
+	ticker := time.NewTicker(time.Duration(DeviceCheckpointInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("accounting_flush")
+		if err := accounting.Flush(); err != nil {
+			fmt.Printf("Warning: failed to save usage accounting: %v\n", err)
+		}
 	}
 }
 
 // Check if weather data is valid (recently updated)
 func is_weather_valid(data_type string, zip string) bool {
-	val, exists := weather.GetStoredWeatherData(zip)
-	if !exists {
+	age, ok := weather_age(data_type, zip)
+	if !ok {
 		return false
 	}
+	if data_type == "current_weather" {
+		return age <= time.Duration(WeatherValidityPeriod)*time.Minute
+	}
+	return age <= time.Duration(ForecastValidityPeriod)*time.Minute
+}
 
-	// Parse last updated time and set validity period based on data type
-	var lastUpdated time.Time
-	var validityPeriod time.Duration
-	var err error
+// How long ago weather of data_type was stored for zip
+func weather_age(data_type string, zip string) (time.Duration, bool) {
+	val, exists := weather.GetStoredWeatherData(zip)
+	if !exists {
+		return 0, false
+	}
 
+	var updated string
+	var untrusted bool
 	if data_type == "current_weather" {
-		if val.CurrentWeatherUpdated == "" {
-			return false // No valid timestamp, treat as invalid
-		}
-		lastUpdated, err = time.Parse(time.RFC3339, val.CurrentWeatherUpdated)
-		validityPeriod = time.Duration(WeatherValidityPeriod) * time.Minute
+		updated, untrusted = val.CurrentWeatherUpdated, val.CurrentWeatherUntrusted
 	} else if data_type == "forecast_weather" {
-		if val.ForecastWeatherUpdated == "" {
-			return false // No valid timestamp, treat as invalid
-		}
-		lastUpdated, err = time.Parse(time.RFC3339, val.ForecastWeatherUpdated)
-		validityPeriod = time.Duration(ForecastValidityPeriod) * time.Minute
-	} else {
-		return false
+		updated, untrusted = val.ForecastWeatherUpdated, val.ForecastWeatherUntrusted
+	}
+	if updated == "" {
+		return 0, false // No valid timestamp, treat as invalid
+	}
+	if untrusted && timesync.Trusted() {
+		return 0, false // Stamped by a wrong clock that has since been corrected
 	}
 
+	lastUpdated, err := time.Parse(time.RFC3339, updated)
 	if err != nil {
 		fmt.Printf("Warning: could not parse weather timestamp: %v\n", err)
-		return false
+		return 0, false
+	}
+	age := time.Since(lastUpdated)
+	if age < 0 {
+		return 0, false // Stamped in the future: the clock was wrong then or is now
+	}
+	return age, true
+}
+
+// Degradation chain when fresh weather is unavailable for zip:
+// stale cached data (flagged) -> fresh data from a nearby zipcode (flagged) -> unavailable.
+// Returns the zipcode whose data to publish and the quality flags.
+func resolve_weather_source(data_type string, zip string) (string, uint8, bool) {
+	if is_weather_valid(data_type, zip) {
+		return zip, 0, true
+	}
+
+	staleLimit := time.Duration(WeatherStaleLimit) * time.Minute
+	if data_type == "forecast_weather" {
+		staleLimit = time.Duration(ForecastStaleLimit) * time.Minute
+	}
+	if age, ok := weather_age(data_type, zip); ok && age <= staleLimit {
+		fmt.Printf("Serving stale %s for %s (age %s)\n", data_type, zip, age.Round(time.Minute))
+		return zip, messaging.WEATHER_FLAG_STALE, true
 	}
 
-	return time.Since(lastUpdated) <= validityPeriod
+	for _, neighbor := range weather.NearestZipcodes(zip, WeatherNeighborRadiusKm) {
+		if is_weather_valid(data_type, neighbor) {
+			fmt.Printf("Serving %s for %s from nearby zipcode %s\n", data_type, zip, neighbor)
+			return neighbor, messaging.WEATHER_FLAG_NEIGHBOR, true
+		}
+	}
+	return "", 0, false
 }
 
 // Publish weather via MQTT
 func publish_weather(data_type string, zip string) {
-	if !is_weather_valid(data_type, zip) {
-		fmt.Printf("Skipping publish: %s for %s not valid (too old)\n", data_type, zip)
+	msg_topic := (TopicWeatherPrefix + "/" + zip)
+
+	source, flags, ok := resolve_weather_source(data_type, zip)
+	if !ok {
+		fmt.Printf("No usable %s for %s, publishing unavailable\n", data_type, zip)
+		weatherType := uint8(messaging.MSG_CURRENT_WEATHER)
+		if data_type == "forecast_weather" {
+			weatherType = messaging.MSG_FORECAST_WEATHER
+		}
+		mqttPublisher.PublishIfChanged(msg_topic, messaging.EncodeWeatherUnavailable(weatherType))
+		if data_type == "current_weather" {
+			// Devices now show a dash; the weather must go out when it's back, even if unchanged
+			forget_weather_push(zip)
+		}
 		return
 	}
 
-	msg_topic := (TopicWeatherPrefix + "/" + zip)
-
 	if data_type == "current_weather" {
-		temp, err := weather.GetCurrentWeatherTemp(zip)
+		temp, err := weather.GetCurrentWeatherTemp(source)
 		if err != nil {
 			fmt.Printf("Error getting current weather: %v\n", err)
 			return
 		}
-		// Weather updates use QoS 0 per protocol specification
-		messaging.PublishQoS0(msg_topic, messaging.EncodeCurrentWeather(temp))
+		condition := weather_condition(source)
+		feelsLike := weather_feels_like(source, temp)
+		due, reason := weather_push_due(zip, temp, feelsLike, condition, flags)
+		if !due {
+			fmt.Printf("Skipping current weather for %s (no meaningful change)\n", zip)
+			return
+		}
+		if reason != "" {
+			fmt.Printf("Pushing current weather for %s: %s\n", zip, reason)
+		}
+		publish_current_weather(zip, source, temp, flags, reason != "")
+		note_weather_push(zip, temp, feelsLike, condition, flags)
+		publish_weather_mood(zip, source)
 	} else if data_type == "forecast_weather" {
-		days, err := weather.GetForecastDays(zip, 3)
+		days, err := weather.GetForecastDays(source, 3)
 		if err != nil {
 			fmt.Printf("Error getting forecast: %v\n", err)
 			return
 		}
-		// Convert weather.ForecastDay to messaging.ForecastDay
-		msgDays := make([]messaging.ForecastDay, len(days))
-		for i, day := range days {
-			msgDays[i] = messaging.ForecastDay{
-				HighTemp: day.HighTemp,
-				Precip:   day.Precip,
-				Moon:     day.Moon,
-			}
-		}
 		// Weather updates use QoS 0 per protocol specification
-		messaging.PublishQoS0(msg_topic, messaging.EncodeForecast(msgDays))
+		publish_forecast(zip, days, flags)
 	}
 }
 
-// Publish version notification to device
-// Topic: <device_name> (e.g., "dev0" or "debug_dev0")
-// Message Type: 0x10 (MSG_TYPE_VERSION)
-// QoS: 1 (at-least-once delivery for critical message)
-func publish_version_notification(deviceName string) {
-	version := getDeviceVersion()
-	msg := messaging.EncodeVersion(version)
-	topicName := deviceName
-	if IsDebugBuild {
-		topicName = "debug_" + deviceName
+// Capability advertised (JSON bootup "caps") by devices that decode MSG_CURRENT_WEATHER_V2
+const capabilityWeatherV2 = "weather_v2"
+
+// Capability advertised by devices that decode MSG_FORECAST_WEATHER_V2
+const capabilityForecastV2 = "forecast_v2"
+
+// Devices receiving zip's weather topic, and whether they all have capability (so the
+// topic can carry the newer message in place of the original)
+func weather_audience(zip string, capability string) ([]devices.Device, bool) {
+	var audience []devices.Device
+	all := true
+	for _, device := range devices.GetActiveDevices() {
+		if device.Zipcode != zip || device.Pending {
+			continue
+		}
+		audience = append(audience, device)
+		if !device.Metadata.HasCapability(capability) {
+			all = false
+		}
 	}
-	fmt.Printf("Publishing version %d to topic %s\n", version, topicName)
-	messaging.PublishQoS1(topicName, msg)
+	return audience, all && len(audience) > 0
 }
 
-// Parse heartbeat message (binary format: [type][length][name_len][name_data])
-// Returns device name or error
-func parseHeartbeatMessage(payload []byte) (string, error) {
-	if len(payload) < 3 {
-		return "", fmt.Errorf("heartbeat message too short (need at least 3 bytes, got %d)", len(payload))
+// Publish the forecast for zip. As with current weather, the zipcode's topic carries v2
+// (with overnight lows and signed temperatures) once every device on it decodes it;
+// until then v2 devices get it on their own topic after the original. The original
+// carries signed highs when every device on the topic speaks protocol v4, otherwise
+// v4 devices get a signed copy on their own topic too.
+func publish_forecast(zip string, days []weather.ForecastDay, flags uint8) {
+	msg_topic := TopicWeatherPrefix + "/" + zip
+	v1Days := make([]messaging.ForecastDay, len(days))
+	v2Days := make([]messaging.ForecastDayV2, len(days))
+	for i, day := range days {
+		v1Days[i] = messaging.ForecastDay{HighTemp: day.HighTemp, Precip: day.Precip, Moon: day.Moon}
+		v2Days[i] = messaging.ForecastDayV2{HighTemp: day.HighTemp, LowTemp: day.LowTemp, Precip: day.Precip, Moon: day.Moon}
 	}
+	v2 := messaging.WithWeatherFlags(messaging.EncodeForecastV2(v2Days), flags)
 
-	msgType := payload[0]
-	msgLen := payload[1]
-
-	// Check message type
-	if msgType != 0x11 {
-		return "", fmt.Errorf("invalid heartbeat message type: expected 0x11, got 0x%02X", msgType)
+	audience, sharedV2 := weather_audience(zip, capabilityForecastV2)
+	if sharedV2 {
+		mqttPublisher.PublishIfChanged(msg_topic, v2)
+		return
 	}
-
-	// Verify payload length matches header
-	if len(payload) < 2+int(msgLen) {
-		return "", fmt.Errorf("heartbeat payload length mismatch: header says %d, got %d", msgLen, len(payload)-2)
+	version := uint8(messaging.PROTOCOL_V4)
+	for _, device := range audience {
+		if device.Metadata.Protocol < version {
+			version = device.Metadata.Protocol
+		}
 	}
-
-	msgPayload := payload[2 : 2+msgLen]
-
-	// Parse payload: [device_name_len][device_name_data]
-	if len(msgPayload) < 1 {
-		return "", fmt.Errorf("heartbeat payload missing device name length")
+	sharedSigned := len(audience) > 0 && version >= messaging.PROTOCOL_V4
+	sent := mqttPublisher.PublishIfChanged(msg_topic, messaging.EncodeForecastFor(v1Days, flags, version))
+	signed := messaging.EncodeForecastFor(v1Days, flags, messaging.PROTOCOL_V4)
+	for _, device := range audience {
+		var msg []byte
+		switch {
+		case device.Metadata.HasCapability(capabilityForecastV2):
+			msg = v2
+		case !sharedSigned && device.Metadata.Protocol >= messaging.PROTOCOL_V4:
+			msg = signed
+		default:
+			continue
+		}
+		if hold_if_quiet(device.Name, msg) {
+			continue
+		}
+		if sent {
+			// The shared message just replaced what the device shows, even if this one is unchanged
+			mqttPublisher.PublishWithPolicy(deviceTopic(device.Name), msg)
+		} else {
+			mqttPublisher.PublishIfChanged(deviceTopic(device.Name), msg)
+		}
 	}
+}
 
-	nameLen := msgPayload[0]
-	if len(msgPayload) < 1+int(nameLen) {
-		return "", fmt.Errorf("heartbeat device name length mismatch: expected %d bytes, got %d", nameLen, len(msgPayload)-1)
+// Device config key choosing the feels-like temperature over the actual one
+const configKeyFeelsLike = "feels_like_temp"
+
+// Publish current weather for zip (conditions taken from source, see resolve_weather_source).
+// The zipcode's topic carries v2 once every device on it decodes it, and the actual
+// temperature. Devices the shared message doesn't suit (v2 devices while it carries 0x01,
+// devices set to feels-like) get their own version on their own topic right after it.
+// resend publishes even if the bytes match the last message (staleness override).
+// Weather updates use QoS 0 per protocol specification
+func publish_current_weather(zip string, source string, temp int8, flags uint8, resend bool) {
+	msg_topic := TopicWeatherPrefix + "/" + zip
+	current := current_weather_v2(source, temp)
+	feelsLike := temp
+	if conditions, err := weather.GetCurrentConditions(source); err == nil {
+		feelsLike = conditions.FeelsLike
+	}
+	encode := func(v2 bool, temp int8) []byte {
+		if !v2 {
+			return messaging.WithWeatherFlags(messaging.EncodeCurrentWeather(temp), flags)
+		}
+		c := current
+		c.Temp = temp
+		return messaging.WithWeatherFlags(messaging.EncodeCurrentWeatherV2(c), flags)
 	}
 
-	deviceName := string(msgPayload[1 : 1+nameLen])
-	return deviceName, nil
+	audience, sharedV2 := weather_audience(zip, capabilityWeatherV2)
+	if resend {
+		messaging.InvalidateCache(msg_topic)
+	}
+	sent := mqttPublisher.PublishIfChanged(msg_topic, encode(sharedV2, temp))
+	for _, device := range audience {
+		v2 := device.Metadata.HasCapability(capabilityWeatherV2)
+		feels := device.Config[configKeyFeelsLike] == "true"
+		if v2 == sharedV2 && !feels {
+			continue
+		}
+		msg := encode(v2, temp)
+		if feels {
+			msg = encode(v2, feelsLike)
+		}
+		if hold_if_quiet(device.Name, msg) {
+			continue
+		}
+		if sent || resend {
+			// The shared message just replaced what the device shows, even if this one is unchanged
+			mqttPublisher.PublishWithPolicy(deviceTopic(device.Name), msg)
+		} else {
+			mqttPublisher.PublishIfChanged(deviceTopic(device.Name), msg)
+		}
+	}
 }
 
-// Handle device bootup: register device, fetch/publish weather, send version
-func handle_device_bootup(payload []byte) {
-	// Extract message payload from binary protocol
-	msgType, msgPayload, err := messaging.DecodeMessage(payload)
+// Current weather in the v2 form; source is the zipcode the conditions are taken from and
+// temp the temperature to send. Missing readings are sent as unknown.
+func current_weather_v2(source string, temp int8) messaging.CurrentWeatherV2 {
+	current := messaging.CurrentWeatherV2{
+		Temp:      temp,
+		Condition: messaging.WEATHER_COND_UNKNOWN,
+		Humidity:  messaging.WEATHER_READING_UNKNOWN,
+		WindSpeed: messaging.WEATHER_READING_UNKNOWN,
+		WindDir:   messaging.WEATHER_READING_UNKNOWN,
+	}
+	conditions, err := weather.GetCurrentConditions(source)
 	if err != nil {
-		fmt.Printf("Error decoding message: %v\n", err)
-		return
+		return current
 	}
-
-	if msgType != messaging.MSG_DEVICE_CONFIG {
-		fmt.Printf("Error: expected MSG_DEVICE_CONFIG (0x03), got 0x%02X\n", msgType)
-		return
+	if conditions.ConditionID != 0 {
+		current.Condition = messaging.WeatherConditionCode(conditions.ConditionID)
+	}
+	if conditions.Humidity > 0 {
+		current.Humidity = conditions.Humidity
+	}
+	if conditions.WindSpeed != nil {
+		current.WindSpeed = uint8(math.Min(math.Round(*conditions.WindSpeed), messaging.WEATHER_READING_UNKNOWN-1))
 	}
+	if conditions.WindDeg != nil {
+		current.WindDir = messaging.CompassPoint(*conditions.WindDeg)
+	}
+	return current
+}
 
-	// Parse binary device config format using DecodeDeviceConfig
-	strs, err := messaging.DecodeDeviceConfig(msgPayload)
+// Capability advertised (JSON bootup "caps") by devices with ambient edge lighting
+const capabilityEdgeLight = "edge_light"
+
+// Send the ambient light suggestion for a zipcode's current conditions to its edge-lit devices
+// (source is the zipcode the conditions were taken from, see resolve_weather_source)
+func publish_weather_mood(zip string, source string) {
+	condition, err := weather.GetCurrentCondition(source)
 	if err != nil {
-		fmt.Printf("Error decoding device config: %v\n", err)
+		fmt.Printf("Skipping weather mood for %s: %v\n", zip, err)
 		return
 	}
-
-	if len(strs) < 2 {
-		fmt.Printf("Error: device config requires at least 2 strings, got %d\n", len(strs))
+	m, ok := mood.ForCondition(condition)
+	if !ok {
 		return
 	}
 
-	deviceName := strings.TrimSpace(strs[0])
-	zipcode := strings.TrimSpace(strs[1])
-
-	fmt.Printf("Bootup parsed: device=%s, zipcode=%s\n", deviceName, zipcode)
-	if deviceName == "" || zipcode == "" {
-		fmt.Println("Error: device config has empty device name or zipcode")
-		return
+	msg := messaging.EncodeWeatherMood(m.R, m.G, m.B, m.Animation, m.PeriodMs)
+	for _, device := range devices.GetActiveDevices() {
+		if device.Zipcode != zip || device.Pending || !device.Metadata.HasCapability(capabilityEdgeLight) {
+			continue
+		}
+		if !hold_if_quiet(device.Name, msg) {
+			mqttPublisher.PublishIfChanged(deviceTopic(device.Name), msg)
+		}
 	}
+}
 
-	// Register device as active
-	devices.RegisterDevice(deviceName, zipcode)
+// Publish version notification to device
+// Topic: <device_name> (e.g., "dev0" or "debug_dev0")
+// Message Type: 0x10 (MSG_TYPE_VERSION)
+// QoS: 1 (at-least-once delivery for critical message)
+// Returns whether the broker accepted it.
+func publish_version_notification(deviceName string) bool {
+	version := device_firmware_version(deviceName)
+	msg := messaging.EncodeVersion(version)
+	topicName := deviceTopic(deviceName)
+	fmt.Printf("Publishing version %d to topic %s\n", version, topicName)
+	return messaging.PublishWithPolicy(topicName, msg)
+}
 
-	// Fetch weather only if not already valid
-	if !is_weather_valid("current_weather", zipcode) {
-		fetch_weather("current_weather", zipcode)
-	} else {
-		fmt.Printf("Current weather for %s is already valid, skipping fetch\n", zipcode)
-	}
+// Capability advertised (JSON bootup "caps") by devices that apply MSG_CONFIG_DELTA
+const capabilityConfigDelta = "config_delta"
 
-	if !is_weather_valid("forecast_weather", zipcode) {
-		fetch_weather("forecast_weather", zipcode)
-	} else {
-		fmt.Printf("Forecast for %s is already valid, skipping fetch\n", zipcode)
-	}
+// Capability advertised by devices that answer requests with MSG_REPLY on their outbox topic
+const capabilityReplies = "replies"
 
-	time.Sleep(1 * time.Second)
+// Config last pushed to each device, the base the next delta is computed against
+var (
+	sentConfigMu sync.Mutex
+	sentConfigs  = make(map[string]map[string]string)
+)
 
-	// Publish weather to device
-	publish_weather("current_weather", zipcode)
-	publish_weather("forecast_weather", zipcode)
+// Stored config plus anything the server adds on top of it
+func desired_device_config(deviceName string) (map[string]string, error) {
+	config, err := devices.GetConfig(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	// Holiday theme rides along with the stored config while the calendar is enabled
+	if holiday.Enabled() {
+		config["theme"] = current_theme()
+	}
+	// Once a topic migration starts, devices are told which namespace to use
+	if state, exists := migration.Current(); exists {
+		config["topic_prefix"] = state.To
+	}
+	return config, nil
+}
 
-	// Publish version notification to device (QoS 1 per protocol specification)
-	publish_version_notification(deviceName)
+// Largest config payload a device can be sent in one message
+func config_payload_limit(deviceName string) int {
+	if devices.HasKey(deviceName) {
+		return messaging.MaxSealedMessage - 2 // Header is encrypted along with the payload
+	}
+	return messaging.MaxPayloadFor(device_protocol_version(deviceName))
 }
 
-// Handle etchsketch shared view messages
-func handle_etchsketch_message(payload []byte) {
-	if len(payload) < 2 {
-		fmt.Println("Error: etchsketch message too short")
+// Publish config changes to device
+// Devices with the config_delta capability get only the keys that changed since the last push
+// Topic: <device_name>, Message Type: 0x17 (MSG_CONFIG_DELTA), QoS: 1
+func publish_device_config(deviceName string) {
+	device, exists := devices.GetDevice(deviceName)
+	if !exists || !device.Metadata.HasCapability(capabilityConfigDelta) {
+		publish_full_device_config(deviceName)
 		return
 	}
 
-	msgType := payload[0]
-	msgLen := payload[1]
-
-	if len(payload) < 2+int(msgLen) {
-		fmt.Printf("Error: etchsketch message length mismatch (expected %d, got %d)\n", msgLen, len(payload)-2)
+	sentConfigMu.Lock()
+	sent, known := sentConfigs[deviceName]
+	sentConfigMu.Unlock()
+	if !known {
+		publish_full_device_config(deviceName)
+		return
+	}
+
+	config, err := desired_device_config(deviceName)
+	if err != nil {
+		fmt.Printf("Error getting config for %s: %v\n", deviceName, err)
+		return
+	}
+	changes := devices.DiffConfig(sent, config)
+	if len(changes) == 0 {
+		return
+	}
+
+	msg, err := messaging.EncodeConfigDeltaFor(changes, device_protocol_version(deviceName))
+	if err != nil {
+		fmt.Printf("Error encoding config delta for %s: %v\n", deviceName, err)
+		return
+	}
+	fmt.Printf("Publishing config delta (%d of %d keys) to topic %s\n", len(changes), len(config), deviceTopic(deviceName))
+	send_device_config(deviceName, msg, config, nil)
+}
+
+// Publish the complete stored key/value config to device, replacing whatever it holds
+// Topic: <device_name>, Message Type: 0x03 (MSG_DEVICE_CONFIG), QoS: 1
+func publish_full_device_config(deviceName string) {
+	send_full_device_config(deviceName, nil)
+}
+
+// Publish the complete config and call done (if set) once it is delivered: acknowledged
+// by devices that send replies, published for the rest
+func send_full_device_config(deviceName string, done func(error)) {
+	finish := func(err error) {
+		if done != nil {
+			done(err)
+		}
+	}
+	config, err := desired_device_config(deviceName)
+	if err != nil {
+		fmt.Printf("Error getting config for %s: %v\n", deviceName, err)
+		finish(err)
+		return
+	}
+	sentConfigMu.Lock()
+	sent := sentConfigs[deviceName]
+	sentConfigMu.Unlock()
+	// An empty config only needs sending to clear keys pushed earlier
+	if len(config) == 0 && len(sent) == 0 {
+		finish(nil)
+		return
+	}
+
+	msg, err := messaging.EncodeConfigPairsFor(config, device_protocol_version(deviceName))
+	if err != nil {
+		fmt.Printf("Error encoding config for %s: %v\n", deviceName, err)
+		finish(err)
+		return
+	}
+	fmt.Printf("Publishing config (%d keys) to topic %s\n", len(config), deviceTopic(deviceName))
+	send_device_config(deviceName, msg, config, done)
+}
+
+// Deliver an encoded config message; devices that send replies must acknowledge it,
+// and one that never does gets a full config on the next push. done (if set) gets the
+// outcome.
+func send_device_config(deviceName string, msg []byte, config map[string]string, done func(error)) {
+	finish := func(err error) {
+		if done != nil {
+			done(err)
+		}
+	}
+	// Config strings may carry secrets, so they are encrypted for devices with a key
+	sealed, err := devices.EncryptFor(deviceName, msg)
+	if err != nil {
+		fmt.Printf("Error encrypting config for %s: %v\n", deviceName, err)
+		finish(err)
+		return
+	}
+
+	sentConfigMu.Lock()
+	sentConfigs[deviceName] = config
+	sentConfigMu.Unlock()
+
+	device, exists := devices.GetDevice(deviceName)
+	if !exists || !device.Metadata.HasCapability(capabilityReplies) {
+		messaging.PublishWithPolicy(deviceTopic(deviceName), sealed)
+		finish(nil)
+		return
+	}
+	// The ack names the message type without the extended header flag of long (v3) configs
+	inbox.Send(deviceName, deviceTopic(deviceName), sealed, msg[0]&^messaging.EXTENDED_FLAG, 0, inbox.DefaultOptions, func(reply messaging.Reply, err error) {
+		if err != nil {
+			fmt.Printf("Config for %s not acknowledged: %v\n", deviceName, err)
+			sentConfigMu.Lock()
+			delete(sentConfigs, deviceName)
+			sentConfigMu.Unlock()
+		}
+		finish(err)
+	})
+}
+
+// Resend the full config to every device so any lost delta is corrected
+func task_config_reconcile() {
+	health.Register("config_reconcile", time.Duration(ConfigReconcileInterval)*time.Minute)
+	ticker := time.NewTicker(time.Duration(ConfigReconcileInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("config_reconcile")
+		if server_idle() {
+			continue
+		}
+		for _, device := range devices.GetActiveDevices() {
+			if !device.Pending {
+				publish_full_device_config(device.Name)
+			}
+		}
+	}
+}
+
+// Publish a rule-driven indicator change to the rule's target display
+// Topic: <device_name>, Message Type: 0x13 (MSG_INDICATOR), QoS: 1
+func publish_indicator(t rules.Trigger) {
+	record_rule_trigger(t)
+	if devices.IsPending(t.Rule.Target) {
+		return
+	}
+	messaging.PublishWithPolicy(deviceTopic(t.Rule.Target), messaging.EncodeIndicator(t.Rule.Indicator, t.Active))
+	notify_rule(t)
+}
+
+// Send each calibrated device a copy of the frame corrected for its LED panel
+func publish_calibrated_frames(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
+	for _, device := range devices.GetAllDevices() {
+		if device.Calibration == nil || !device.Active || device.Pending || device.Metadata.HasCapability(capabilityPalette) || device_quiet(device.Name) {
+			continue
+		}
+		frame := etchsketch.EncodeCalibratedFrame(seq, red, green, blue, device.Calibration.ChannelLevels())
+		calibratedFrameBatcher.Publish(deviceTopic(device.Name), frame)
+	}
+}
+
+// Capability advertised by RGB matrices that draw the canvas with the 16-color palette
+const capabilityPalette = "palette16"
+
+// Send each palette device the canvas as palette indexes on its own topic
+func publish_palette_frames() {
+	frame, seq := etchsketchManager.GetPaletteState()
+	for _, device := range devices.GetAllDevices() {
+		if !device.Active || device.Pending || !device.Metadata.HasCapability(capabilityPalette) || device_quiet(device.Name) {
+			continue
+		}
+		paletteFrameBatcher.Publish(deviceTopic(device.Name), etchsketch.EncodePaletteFrame(seq, frame))
+	}
+}
+
+// Capability advertised by devices that decode run-length encoded frames (0x2C)
+const capabilityRLE = "rle"
+
+// Send each RLE device the whole canvas as one run-length encoded frame on its own topic.
+// A 16x16 canvas has no chunks to replace, so nothing is sent. Frames too busy to fit in one
+// message are skipped; those devices use the raw frame and chunks on the shared topic like
+// everyone else.
+func publish_rle_frames() {
+	frame, seq := etchsketchManager.GetFrame()
+	if frame.Width <= 16 && frame.Height <= 16 {
+		return
+	}
+	msg, err := etchsketch.EncodeRLEFrame(seq, frame)
+	if err != nil {
+		return
+	}
+	for _, device := range devices.GetAllDevices() {
+		if !device.Active || device.Pending || !device.Metadata.HasCapability(capabilityRLE) || device_quiet(device.Name) {
+			continue
+		}
+		rleFrameBatcher.Publish(deviceTopic(device.Name), msg)
+	}
+}
+
+// Whether a whole frame's chunks must go out on topic: not when every canvas device
+// receiving it gets the frame as RLE instead (see publish_rle_frames)
+func etchsketch_chunks_needed(topic string, frame etchsketch.Frame, seq uint16) bool {
+	if _, err := etchsketch.EncodeRLEFrame(seq, frame); err != nil {
+		return true
+	}
+	for _, device := range devices.GetActiveDevices() {
+		if device.Pending || !is_etchsketch_device(device) {
+			continue
+		}
+		if topic != etchsketchTopic && topic != deviceTopic(device.Name) {
+			continue
+		}
+		if !device.Metadata.HasCapability(capabilityRLE) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds for the auto-tuned etch sketch batching windows (see messaging.Batcher)
+const (
+	etchBatchMinWindow = 20 * time.Millisecond
+	etchBatchMaxWindow = 1 * time.Second
+)
+
+// Publish a canvas message through the MQTT client; the batchers below are created before it
+func publish_canvas_copy(topic string, data []byte) bool {
+	return mqttPublisher.PublishWithPolicy(topic, data)
+}
+
+// Per-device calibrated copies of every canvas frame, coalesced per device topic
+var calibratedFrameBatcher = messaging.NewBatcher("calibrated_frames", publish_canvas_copy, etchBatchMinWindow, etchBatchMaxWindow)
+
+// Per-device palette frames, coalesced per device topic
+var paletteFrameBatcher = messaging.NewBatcher("palette_frames", publish_canvas_copy, etchBatchMinWindow, etchBatchMaxWindow)
+
+// Per-device run-length encoded frames, coalesced per device topic
+var rleFrameBatcher = messaging.NewBatcher("rle_frames", publish_canvas_copy, etchBatchMinWindow, etchBatchMaxWindow)
+
+// Device-specific topic is the device name (prefixed with "debug_" in debug builds)
+func deviceTopic(deviceName string) string {
+	if IsDebugBuild {
+		return "debug_" + deviceName
+	}
+	return deviceName
+}
+
+// Parse heartbeat message (binary format: [type][length][name_len][name_data])
+// Returns device name or error
+func parseHeartbeatMessage(payload []byte) (string, error) {
+	if len(payload) < 3 {
+		return "", fmt.Errorf("heartbeat message too short (need at least 3 bytes, got %d)", len(payload))
+	}
+
+	msgType := payload[0]
+	msgLen := payload[1]
+
+	// Check message type
+	if msgType != 0x11 {
+		return "", fmt.Errorf("invalid heartbeat message type: expected 0x11, got 0x%02X", msgType)
+	}
+	// Verify payload length matches header
+	if len(payload) < 2+int(msgLen) {
+		return "", fmt.Errorf("heartbeat payload length mismatch: header says %d, got %d", msgLen, len(payload)-2)
+	}
+
+	msgPayload := payload[2 : 2+msgLen]
+
+	// Parse payload: [device_name_len][device_name_data]
+	if len(msgPayload) < 1 {
+		return "", fmt.Errorf("heartbeat payload missing device name length")
+	}
+
+	nameLen := msgPayload[0]
+	if len(msgPayload) < 1+int(nameLen) {
+		return "", fmt.Errorf("heartbeat device name length mismatch: expected %d bytes, got %d", nameLen, len(msgPayload)-1)
+	}
+
+	deviceName := string(msgPayload[1 : 1+nameLen])
+	if err := messaging.CheckCRC(payload, device_protocol_version(deviceName)); err != nil {
+		return "", fmt.Errorf("heartbeat %v", err)
+	}
+	return deviceName, nil
+}
+
+// Handle device bootup: register device, fetch/publish weather, send version
+func handle_device_bootup(payload []byte) {
+	var deviceName, zipcode string
+	var metadata devices.Metadata
+
+	var err error
+	if devices.IsJSONBootup(payload) {
+		deviceName, zipcode, metadata, err = devices.ParseBootupJSON(payload)
+	} else {
+		deviceName, zipcode, metadata, err = parse_legacy_bootup(payload)
+	}
+	if err != nil {
+		fmt.Printf("Error decoding bootup: %v\n", err)
+		deadletter.Record(TopicBootup, "", payload, err)
+		return
+	}
+
+	fmt.Printf("Bootup parsed: device=%s, zipcode=%s, metadata=%+v\n", deviceName, zipcode, metadata)
+	if deviceName == "" || zipcode == "" {
+		fmt.Println("Error: device config has empty device name or zipcode")
+		deadletter.Record(TopicBootup, deviceName, payload, errors.New("empty device name or zipcode"))
+		return
+	}
+
+	// Register device as active
+	if err := devices.RegisterDevice(deviceName, zipcode, metadata); err != nil {
+		fmt.Printf("Ignoring bootup from %s: %v\n", deviceName, err)
+		return
+	}
+	account_message_in(deviceName, len(payload))
+	wake_from_idle(deviceName)
+	track_etchsketch_presence(deviceName)
+
+	// Unapproved devices get nothing that costs weather API calls
+	if devices.IsPending(deviceName) {
+		fmt.Printf("Device %s awaiting approval, not serving bootup\n", deviceName)
+		return
+	}
+
+	serve_device(deviceName, zipcode)
+}
+
+// Parse the legacy binary bootup: MSG_DEVICE_CONFIG with "device_name", "zipcode", then "key=value" metadata
+func parse_legacy_bootup(payload []byte) (string, string, devices.Metadata, error) {
+	// Extract message payload from binary protocol
+	msgType, msgPayload, err := messaging.DecodeMessage(payload)
+	if err != nil {
+		return "", "", devices.Metadata{}, err
+	}
+
+	if msgType != messaging.MSG_DEVICE_CONFIG {
+		return "", "", devices.Metadata{}, fmt.Errorf("expected MSG_DEVICE_CONFIG (0x03), got 0x%02X", msgType)
+	}
+
+	// Parse binary device config format using DecodeDeviceConfig
+	strs, err := messaging.DecodeDeviceConfig(msgPayload)
+	if err != nil {
+		return "", "", devices.Metadata{}, fmt.Errorf("device config: %v", err)
+	}
+
+	if len(strs) < 2 {
+		return "", "", devices.Metadata{}, fmt.Errorf("device config requires at least 2 strings, got %d", len(strs))
+	}
+
+	// Optional hardware metadata follows as "key=value" strings
+	return strings.TrimSpace(strs[0]), strings.TrimSpace(strs[1]), devices.ParseMetadata(strs[2:]), nil
+}
+
+// Lowest binary protocol version among the devices that receive a topic
+// Shared topics only get CRC trailers once every device on them supports protocol v2.
+func topic_protocol_version(topic string) uint8 {
+	var audience []devices.Device
+	for _, device := range devices.GetActiveDevices() {
+		switch {
+		case topic == deviceTopic(device.Name),
+			topic == TopicWeatherPrefix+"/"+device.Zipcode,
+			topic == etchsketchTopic:
+			audience = append(audience, device)
+		}
+	}
+	if len(audience) == 0 {
+		return messaging.PROTOCOL_V1
+	}
+
+	version := uint8(messaging.PROTOCOL_V2)
+	for _, device := range audience {
+		if device.Metadata.Protocol < version {
+			version = device.Metadata.Protocol
+		}
+	}
+	if version < messaging.PROTOCOL_V1 {
+		version = messaging.PROTOCOL_V1
+	}
+	return version
+}
+
+// Binary protocol version a single device reported at bootup
+// Messages on its own topic can use the extended header once it supports protocol v3.
+func device_protocol_version(deviceName string) uint8 {
+	device, ok := devices.GetDevice(deviceName)
+	if !ok || device.Metadata.Protocol < messaging.PROTOCOL_V1 {
+		return messaging.PROTOCOL_V1
+	}
+	return device.Metadata.Protocol
+}
+
+// Send everything a freshly registered device needs: time, weather, config, version
+func serve_device(deviceName string, zipcode string) {
+	// Fetch weather only if not already valid
+	if !is_weather_valid("current_weather", zipcode) {
+		fetch_weather("current_weather", zipcode)
+	} else {
+		fmt.Printf("Current weather for %s is already valid, skipping fetch\n", zipcode)
+	}
+
+	if !is_weather_valid("forecast_weather", zipcode) {
+		fetch_weather("forecast_weather", zipcode)
+	} else {
+		fmt.Printf("Forecast for %s is already valid, skipping fetch\n", zipcode)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	// The device has nothing yet, so bypass the unchanged-bytes publish cache
+	messaging.InvalidateCache(TopicWeatherPrefix + "/" + zipcode)
+	messaging.InvalidateCache(deviceTopic(deviceName))
+	forget_weather_push(zipcode)
+
+	// Clock first (time zone comes from the weather just fetched), so the device can show local time
+	publish_time(deviceName)
+	// A rebooted device has forgotten any pending DST notice
+	clockNoticesMu.Lock()
+	delete(clockNotices, deviceName)
+	clockNoticesMu.Unlock()
+
+	// Publish weather to device
+	publish_weather("current_weather", zipcode)
+	publish_weather("forecast_weather", zipcode)
+
+	// Push the full stored config; later changes go out as deltas
+	publish_full_device_config(deviceName)
+
+	// E-paper displays boot blank, so send the current screen even if unchanged
+	if device, exists := devices.GetDevice(deviceName); exists && device.Metadata.HasCapability(capabilityEPaper) {
+		publish_epaper_screen(deviceName, true)
+	}
+
+	// Restore indicators for rules currently triggered on this display
+	for _, rule := range rules.ActiveForTarget(deviceName) {
+		messaging.PublishWithPolicy(deviceTopic(deviceName), messaging.EncodeIndicator(rule.Indicator, true))
+	}
+
+	// Publish version notification to device (QoS 1 per protocol specification)
+	publish_version_notification(deviceName)
+
+	// A rebooted device has forgotten its quiet hours were on; tell it again if they are
+	reset_quiet_hours(deviceName)
+	if device, exists := devices.GetDevice(deviceName); exists {
+		check_quiet_hours(*device)
+	}
+}
+
+// Handle a device reply: [0x18][len][reply_to_type][request_id(2)][status][data...]
+func handle_device_reply(deviceName string, payload []byte) {
+	msgType, body, err := messaging.DecodeMessageFrom(payload, device_protocol_version(deviceName))
+	if err == nil && msgType == messaging.MSG_ENCRYPTED {
+		var inner []byte
+		if inner, err = devices.DecryptFrom(deviceName, body); err == nil {
+			msgType, body, err = messaging.DecodeMessage(inner)
+		}
+	}
+	if err == nil && msgType != messaging.MSG_REPLY {
+		err = fmt.Errorf("expected MSG_REPLY (0x18), got 0x%02X", msgType)
+	}
+	if err != nil {
+		fmt.Printf("Ignoring malformed reply from %s: %v\n", deviceName, err)
+		deadletter.Record(TopicReplyPrefix+"/"+deviceName, deviceName, payload, err)
+		return
+	}
+	reply, err := messaging.DecodeReply(body)
+	if err != nil {
+		fmt.Printf("Error parsing reply from %s: %v\n", deviceName, err)
+		deadletter.Record(TopicReplyPrefix+"/"+deviceName, deviceName, payload, err)
+		return
+	}
+	account_message_in(deviceName, len(payload))
+	if !inbox.HandleReply(deviceName, reply) {
+		fmt.Printf("Unexpected reply from %s to 0x%02X (id %d)\n", deviceName, reply.To, reply.ID)
+	}
+}
+
+// Handle device telemetry: [0x12][len][numStrings][device_name]["metric=value"]...
+func handle_telemetry_message(payload []byte) {
+	msgType, msgPayload, err := messaging.DecodeMessage(payload)
+	if err == nil && msgType != messaging.MSG_TELEMETRY {
+		err = fmt.Errorf("expected MSG_TELEMETRY (0x12), got 0x%02X", msgType)
+	}
+	var strs []string
+	if err == nil {
+		strs, err = messaging.DecodeDeviceConfig(msgPayload)
+	}
+	if err == nil && len(strs) < 2 {
+		err = fmt.Errorf("telemetry requires device name and at least one reading, got %d strings", len(strs))
+	}
+	if err != nil {
+		fmt.Printf("Error decoding telemetry: %v\n", err)
+		deadletter.Record(TopicTelemetry, "", payload, err)
+		return
+	}
+
+	deviceName := strings.TrimSpace(strs[0])
+	if _, exists := devices.GetDevice(deviceName); !exists || devices.IsPending(deviceName) {
+		fmt.Printf("Ignoring telemetry from unregistered or pending device %s\n", deviceName)
+		return
+	}
+	if err := messaging.CheckCRC(payload, device_protocol_version(deviceName)); err != nil {
+		fmt.Printf("Error decoding telemetry from %s: %v\n", deviceName, err)
+		deadletter.Record(TopicTelemetry, deviceName, payload, err)
+		return
+	}
+
+	account_message_in(deviceName, len(payload))
+
+	readings, err := telemetry.ParseReadings(strs[1:])
+	if err != nil {
+		fmt.Printf("Error parsing telemetry from %s: %v\n", deviceName, err)
+		deadletter.Record(TopicTelemetry, deviceName, payload, err)
+		return
+	}
+	telemetry.Ingest(deviceName, readings)
+}
+
+// Default lifetime of an unreviewed guest submission
+const defaultGuestSubmissionTTL = 60 * time.Minute
+
+// How long queued guest/quarantined frames wait for review
+func guest_submission_ttl() time.Duration {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	if runtimeConfig.GuestSubmissionTTLMinutes <= 0 {
+		return defaultGuestSubmissionTTL
+	}
+	return time.Duration(runtimeConfig.GuestSubmissionTTLMinutes) * time.Minute
+}
+
+// Handle a frame matching the canvas blocklist: dropped, or held for moderation when
+// canvasBlocklistAction is "quarantine". Returns true if the frame was quarantined.
+func quarantine_blocked_frame(source string, stencil string, red [16]uint16, green [16]uint16, blue [16]uint16) bool {
+	configMutex.RLock()
+	action := runtimeConfig.CanvasBlocklistAction
+	configMutex.RUnlock()
+
+	if action != "quarantine" {
+		fmt.Printf("EtchSketch: rejected frame from %s matching blocked stencil %s\n", source, stencil)
+		timeline.Recordf(timeline.TypeCanvas, "", "rejected frame from %s (blocked: %s)", source, stencil)
+		return false
+	}
+	timeline.Recordf(timeline.TypeCanvas, "", "quarantined frame from %s (blocked: %s)", source, stencil)
+	etchsketchManager.QueueSubmission(fmt.Sprintf("%s (blocked: %s)", source, stencil), red, green, blue, guest_submission_ttl())
+	return true
+}
+
+// Apply pixel updates to the shared canvas and broadcast the resulting frame. Edits that
+// would produce a frame matching the canvas blocklist are dropped or quarantined like a
+// blocked full frame; returns whether the canvas changed.
+func apply_pixel_updates(source string, updates []etchsketch.PixelUpdate) (bool, error) {
+	applied, err := etchsketchManager.EditFrame(func(frame etchsketch.Frame) (bool, error) {
+		return apply_canvas_frame(source, frame.Apply(updates))
+	})
+	if applied {
+		fmt.Printf("EtchSketch: applied %d pixel update(s) from %s\n", len(updates), source)
+	}
+	return applied, err
+}
+
+// Apply a whole frame (the canvas's size) to the shared canvas and broadcast it, unless it
+// matches the canvas blocklist anywhere; returns whether the canvas changed
+func apply_canvas_frame(source string, frame etchsketch.Frame) (bool, error) {
+	if stencil, blocked := etchsketch.MatchBlocklistFrame(frame); blocked {
+		red, green, blue := frame.Window()
+		quarantine_blocked_frame(source, stencil, red, green, blue)
+		return false, nil
+	}
+	if err := etchsketchManager.PublishCanvasFrame(frame); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Apply palette pixel updates to the shared canvas like apply_palette_frame; returns whether
+// the canvas changed
+func apply_palette_updates(source string, updates []etchsketch.PaletteUpdate) (bool, error) {
+	return etchsketchManager.EditPalette(func(frame etchsketch.PaletteFrame) (bool, error) {
+		return apply_palette_frame(source, etchsketch.ApplyPaletteUpdates(frame, updates))
+	})
+}
+
+// Apply a palette frame to the shared canvas and broadcast it. Blocked frames are handled
+// like blocked pixel edits (the canvas is republished so palette devices drop the edit);
+// returns whether the canvas changed.
+func apply_palette_frame(source string, frame etchsketch.PaletteFrame) (bool, error) {
+	red, green, blue := frame.Channels()
+	if stencil, blocked := match_blocklist_window(red, green, blue); blocked {
+		quarantine_blocked_frame(source, stencil, red, green, blue)
+		publish_palette_frames()
+		return false, nil
+	}
+	if err := etchsketchManager.PublishPaletteFrame(frame); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Apply a whole frame a device published (chunked or RLE): blocked frames are undone on the
+// devices, frames drawn on an older canvas are rejected (see reject_stale_frame)
+func apply_device_canvas_frame(seq uint16, frame etchsketch.Frame, kind string) {
+	if stencil, blocked := etchsketch.MatchBlocklistFrame(frame); blocked {
+		red, green, blue := frame.Window()
+		quarantine_blocked_frame("device", stencil, red, green, blue)
+		if err := etchsketchManager.HandleSyncRequest("devices (blocked frame)"); err != nil {
+			fmt.Printf("Error restoring canvas after blocked frame: %v\n", err)
+		}
+		return
+	}
+	if etchsketchManager.IsStale(seq) {
+		reject_stale_frame(kind, seq)
+		return
+	}
+	if err := etchsketchManager.HandleCanvasFrameUpdate(seq, frame); err != nil {
+		fmt.Printf("Error applying %s frame: %v\n", kind, err)
+	}
+}
+
+// Match the blocklist against the canvas with its 16x16 window replaced, so a stencil drawn
+// across the window's edge on a larger canvas is caught too
+func match_blocklist_window(red [16]uint16, green [16]uint16, blue [16]uint16) (string, bool) {
+	frame, _ := etchsketchManager.GetFrame()
+	return etchsketch.MatchBlocklistFrame(frame.WithWindow(red, green, blue))
+}
+
+// Reject a whole frame a device drew on an older canvas: applying it would wipe the strokes
+// drawn since. Frames carry no sender, so the current canvas is republished on the shared
+// topic to bring the sending device back in line.
+func reject_stale_frame(kind string, seq uint16) {
+	fmt.Printf("Rejected stale %s frame (seq=%d); resyncing devices\n", kind, seq)
+	if err := etchsketchManager.HandleSyncRequest("devices (stale frame)"); err != nil {
+		fmt.Printf("Error resyncing after stale frame: %v\n", err)
+	}
+	publish_palette_frames()
+	publish_rle_frames()
+}
+
+// Tell event stream clients a device came online or went offline
+func publish_presence_event(deviceName string, online bool) {
+	e := events.Event{Type: events.DeviceOffline, Device: deviceName}
+	if online {
+		e.Type = events.DeviceOnline
+	}
+	events.Publish(e)
+}
+
+// Capability advertised by devices that draw on the shared canvas (palette16 and rle imply it)
+const capabilityEtchSketch = "etchsketch"
+
+// Whether a device takes part in the shared canvas
+func is_etchsketch_device(device devices.Device) bool {
+	return device.Metadata.HasCapability(capabilityEtchSketch) ||
+		device.Metadata.HasCapability(capabilityPalette) ||
+		device.Metadata.HasCapability(capabilityRLE)
+}
+
+// Keep the etchsketch manager's connected devices in step with bootups, heartbeats and
+// LWT/heartbeat-timeout disconnects (devices awaiting approval don't join the canvas).
+// The device's current state decides, not the edge that triggered the call, so calls
+// running out of order while a device flaps still settle on the right answer.
+func track_etchsketch_presence(deviceName string) {
+	if etchsketchManager == nil {
+		return
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if exists && device.Active && !device.Pending && is_etchsketch_device(*device) {
+		etchsketchManager.RegisterDevice(deviceName)
+	} else {
+		etchsketchManager.UnregisterDevice(deviceName)
+	}
+}
+
+// Send a device that fell behind the current canvas on its own topic (calibrated, palette
+// and RLE devices also get their own frame formats)
+func resync_etchsketch_device(deviceName string) {
+	if err := etchsketchManager.ResyncDevice(deviceName, deviceTopic(deviceName)); err != nil {
+		fmt.Printf("Error resyncing %s: %v\n", deviceName, err)
+		return
+	}
+	device, exists := devices.GetDevice(deviceName)
+	if !exists {
+		return
+	}
+	if device.Calibration != nil && !device.Metadata.HasCapability(capabilityPalette) {
+		red, green, blue, seq := etchsketchManager.GetCanvasState()
+		frame := etchsketch.EncodeCalibratedFrame(seq, red, green, blue, device.Calibration.ChannelLevels())
+		calibratedFrameBatcher.Publish(deviceTopic(deviceName), frame)
+	}
+	if device.Metadata.HasCapability(capabilityPalette) {
+		frame, seq := etchsketchManager.GetPaletteState()
+		paletteFrameBatcher.Publish(deviceTopic(deviceName), etchsketch.EncodePaletteFrame(seq, frame))
+	}
+	if device.Metadata.HasCapability(capabilityRLE) {
+		frame, seq := etchsketchManager.GetFrame()
+		if frame.Width > 16 || frame.Height > 16 {
+			if msg, err := etchsketch.EncodeRLEFrame(seq, frame); err == nil {
+				rleFrameBatcher.Publish(deviceTopic(deviceName), msg)
+			}
+		}
+	}
+}
+
+// Handle etchsketch shared view messages
+func handle_etchsketch_message(payload []byte) {
+	// Standard or extended header, CRC checked once every device on the topic speaks v2
+	msgType, msgPayload, err := messaging.DecodeMessageFrom(payload, topic_protocol_version(etchsketchTopic))
+	if err != nil {
+		fmt.Printf("Error: discarding etchsketch message: %v\n", err)
+		deadletter.Record(etchsketchTopic, "", payload, err)
 		return
 	}
 
-	msgPayload := payload[2 : 2+msgLen]
-
 	switch msgType {
 	case messaging.MSG_TYPE_ETCH_GET_FRAME:
 		// Device requesting full canvas state
@@ -315,197 +1502,953 @@ func handle_etchsketch_message(payload []byte) {
 		if err := etchsketchManager.HandleSyncRequest("device"); err != nil {
 			fmt.Printf("Error handling sync request: %v\n", err)
 		}
+		publish_palette_frames()
+		publish_rle_frames()
 
 	case messaging.MSG_TYPE_ETCH_UPDATE_FRAME:
 		// Device publishes updated full frame; server updates local state only
 		if len(msgPayload) != 98 {
 			fmt.Printf("Invalid etch_update_frame payload length: %d (expected 98)\n", len(msgPayload))
+			deadletter.Record(etchsketchTopic, "", payload, fmt.Errorf("etch_update_frame payload length %d, expected 98", len(msgPayload)))
 			return
 		}
 		seq, red, green, blue, err := etchsketch.DecodeFullFrame(msgPayload)
 		if err != nil {
 			fmt.Printf("Failed to decode full frame: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		if etchsketchManager.IsEcho(seq, red, green, blue) {
+			return // Our own broadcast
+		}
+		if stencil, blocked := match_blocklist_window(red, green, blue); blocked {
+			quarantine_blocked_frame("device", stencil, red, green, blue)
+			// Devices already show the frame; republish the last accepted one to undo it
+			if err := etchsketchManager.HandleSyncRequest("devices (blocked frame)"); err != nil {
+				fmt.Printf("Error restoring canvas after blocked frame: %v\n", err)
+			}
+			return
+		}
+		if etchsketchManager.IsStale(seq) {
+			reject_stale_frame("etch_update_frame", seq)
+			return
+		}
+		etchsketchManager.HandleFullFrameUpdate(seq, red, green, blue)
+		fmt.Printf("Applied etch_update_frame (seq=%d)\n", seq)
+
+	case messaging.MSG_TYPE_ETCH_SEQ_REPORT:
+		// Device tells which frame it shows, e.g. after a reconnect or a skipped sequence number
+		deviceName, seq, err := etchsketch.DecodeSeqReport(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode sequence report: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		if etchsketchManager.NoteDeviceSeq(deviceName, seq) {
+			resync_etchsketch_device(deviceName)
+		}
+
+	case messaging.MSG_TYPE_ETCH_PIXELS:
+		updates, err := etchsketch.DecodePixelUpdates(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode pixel updates: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		applied, err := apply_pixel_updates("device", updates)
+		if err != nil {
+			fmt.Printf("Error applying pixel updates: %v\n", err)
+		} else if !applied {
+			// The sending device may already show its edit; republish the canvas to undo it
+			if err := etchsketchManager.HandleSyncRequest("devices (blocked edit)"); err != nil {
+				fmt.Printf("Error restoring canvas after blocked edit: %v\n", err)
+			}
+		}
+
+	case messaging.MSG_TYPE_ETCH_PALETTE_FRAME:
+		// Palette device publishes a full 16-color frame; RGB devices need its 1-bit reduction
+		_, frame, err := etchsketch.DecodePaletteFrame(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode palette frame: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		if _, err := apply_palette_frame("device", frame); err != nil {
+			fmt.Printf("Error applying palette frame: %v\n", err)
+		}
+
+	case messaging.MSG_TYPE_ETCH_PALETTE_PIXELS:
+		updates, err := etchsketch.DecodePaletteUpdates(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode palette pixel updates: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		if _, err := apply_palette_updates("device", updates); err != nil {
+			fmt.Printf("Error applying palette pixel updates: %v\n", err)
+		}
+
+	case messaging.MSG_TYPE_ETCH_FRAME_CHUNK:
+		// Device publishes a whole frame of a canvas larger than 16x16, in chunks
+		chunk, err := etchsketch.DecodeFrameChunk(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode frame chunk: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		frame, complete := etchsketchManager.HandleFrameChunk(chunk)
+		if !complete {
 			return
 		}
-		etchsketchManager.HandleFullFrameUpdate(seq, red, green, blue)
-		fmt.Printf("Applied etch_update_frame (seq=%d)\n", seq)
+		apply_device_canvas_frame(chunk.Seq, frame, "chunked")
+
+	case messaging.MSG_TYPE_ETCH_RLE_FRAME:
+		// Device publishes a whole frame as pixel runs
+		seq, frame, err := etchsketch.DecodeRLEFrame(msgPayload)
+		if err != nil {
+			fmt.Printf("Failed to decode RLE frame: %v\n", err)
+			deadletter.Record(etchsketchTopic, "", payload, err)
+			return
+		}
+		if etchsketchManager.HandleRLEFrame(seq, frame) {
+			apply_device_canvas_frame(seq, frame, "RLE")
+		}
+
+	case messaging.MSG_TYPE_ETCH_UNDO:
+		fmt.Println("Received etchsketch undo request")
+		if err := etchsketchManager.Undo(); err != nil {
+			fmt.Printf("Error undoing canvas change: %v\n", err)
+		}
+
+	case messaging.MSG_TYPE_ETCH_CLEAR:
+		fmt.Println("Received etchsketch clear request")
+		if err := etchsketchManager.Clear(); err != nil {
+			fmt.Printf("Error clearing canvas: %v\n", err)
+		}
+
+	default:
+		fmt.Printf("Unknown etchsketch message type: 0x%02X\n", msgType)
+		deadletter.Record(etchsketchTopic, "", payload, fmt.Errorf("unknown etchsketch message type 0x%02X", msgType))
+	}
+}
+
+// Handle a device clock request: [0x1B][len][name_len][name]
+func handle_time_request(payload []byte) {
+	msgType, body, err := messaging.DecodeMessage(payload)
+	if err != nil || msgType != messaging.MSG_TIME_REQUEST || len(body) < 1 || len(body) < 1+int(body[0]) {
+		fmt.Printf("Ignoring malformed time request (bytes=%d)\n", len(payload))
+		if err == nil {
+			err = fmt.Errorf("expected MSG_TIME_REQUEST (0x1B) with device name, got type 0x%02X, %d payload bytes", msgType, len(body))
+		}
+		deadletter.Record(TopicTimeRequest, "", payload, err)
+		return
+	}
+	deviceName := string(body[1 : 1+body[0]])
+	if _, exists := devices.GetDevice(deviceName); !exists {
+		fmt.Printf("Ignoring time request from unknown device %s\n", deviceName)
+		return
+	}
+	if err := messaging.CheckCRC(payload, device_protocol_version(deviceName)); err != nil {
+		fmt.Printf("Ignoring time request from %s: %v\n", deviceName, err)
+		deadletter.Record(TopicTimeRequest, deviceName, payload, err)
+		return
+	}
+	account_message_in(deviceName, len(payload))
+	publish_time(deviceName)
+}
+
+// Publish current time and the UTC offset of the device's zipcode
+// Topic: <device_name>, Message Type: 0x1A (MSG_TIME), QoS: 0
+func publish_time(deviceName string) {
+	if !timesync.Usable() {
+		fmt.Printf("Not sending time to %s: server clock not trusted\n", deviceName)
+		return // Sent to every active device once the clock is usable
+	}
+	loc := time.Local
+	if device, exists := devices.GetDevice(deviceName); exists {
+		if zoneLoc, err := weather.Location(device.Zipcode); err == nil {
+			loc = zoneLoc
+		} else {
+			fmt.Printf("Using server time zone for %s: %v\n", deviceName, err)
+		}
+	}
+	messaging.PublishWithPolicy(deviceTopic(deviceName), messaging.EncodeTime(time.Now().In(loc)))
+}
+
+// Pause between conformance messages so firmware under test can log each one
+const conformanceMessageGap = 250 * time.Millisecond
+
+// Send a conformance session's scripted messages in order to its topic
+// Topic: <device_name> unless overridden, QoS and CRC per the topic policy
+func publish_conformance_sequence(session conformance.Session) {
+	fmt.Printf("Conformance session %s: sending %d messages to %s\n", session.ID, len(session.Cases), session.Topic)
+	for i, c := range session.Cases {
+		if i > 0 {
+			time.Sleep(conformanceMessageGap)
+		}
+		messaging.PublishWithPolicy(session.Topic, c.Message)
+	}
+}
+
+// Put a device back in its normal state after a conformance run replaced its config and clock
+func restore_device_after_conformance(deviceName string) {
+	if _, exists := devices.GetDevice(deviceName); !exists {
+		return
+	}
+	sentConfigMu.Lock()
+	delete(sentConfigs, deviceName)
+	sentConfigMu.Unlock()
+	publish_time(deviceName)
+	publish_version_notification(deviceName)
+	publish_full_device_config(deviceName)
+}
+
+// Offset change each device was last told about (Unix seconds), so each is sent once
+var (
+	clockNoticesMu sync.Mutex
+	clockNotices   = make(map[string]int64)
+)
+
+// Warn devices ahead of a DST change in their zipcode's time zone so clocks switch on time
+// Topic: <device_name>, Message Type: 0x1C (MSG_CLOCK_CHANGE), QoS: 1
+func task_dst_notices() {
+	ticker := time.NewTicker(time.Duration(DSTCheckInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if server_idle() {
+			continue
+		}
+		now := time.Now()
+		for _, device := range devices.GetActiveDevices() {
+			if device.Pending {
+				continue
+			}
+			loc, err := weather.Location(device.Zipcode)
+			if err != nil {
+				continue
+			}
+			at, offset, ok := weather.NextOffsetChange(loc, now, DSTNoticeLookahead*time.Hour)
+			if !ok {
+				continue
+			}
+
+			clockNoticesMu.Lock()
+			sent := clockNotices[device.Name] == at.Unix()
+			clockNotices[device.Name] = at.Unix()
+			clockNoticesMu.Unlock()
+			if sent {
+				continue
+			}
+			fmt.Printf("Notifying %s of UTC offset change to %+d min at %s\n", device.Name, offset/60, at.Format(time.RFC3339))
+			messaging.PublishWithPolicy(deviceTopic(device.Name), messaging.EncodeClockChange(at, offset))
+		}
+	}
+}
+
+// Device heartbeat - keep device marked as active
+func handle_device_heartbeat(payload []byte) {
+	deviceName, err := parseHeartbeatMessage(payload)
+	if err != nil {
+		fmt.Printf("Error parsing heartbeat message: %v\n", err)
+		deadletter.Record(TopicHeartbeat, "", payload, err)
+		return
+	}
+	if deviceName == "" {
+		return
+	}
+	account_message_in(deviceName, len(payload))
+	devices.Heartbeat(deviceName)
+	fmt.Printf("Heartbeat received from %s\n", deviceName)
+	// Respond with version notification on every heartbeat (approved devices only)
+	if !devices.IsPending(deviceName) {
+		publish_version_notification(deviceName)
+	}
+}
+
+// Device Last Will Testament - triggered on ungraceful disconnect (network/power loss)
+func handle_device_offline(payload []byte) {
+	deviceName := string(payload)
+	if deviceName != "" {
+		devices.SetInactive(deviceName)
+	}
+}
+
+// Message heard on the new namespace during a topic migration - that device has moved
+func handle_moved_message(topic string, payload []byte) {
+	var deviceName string
+	switch {
+	case topic == TopicHeartbeat:
+		deviceName, _ = parseHeartbeatMessage(payload)
+	case topic == TopicTimeRequest:
+		if msgType, body, err := messaging.DecodeMessage(payload); err == nil && msgType == messaging.MSG_TIME_REQUEST && len(body) >= 1 && len(body) >= 1+int(body[0]) {
+			deviceName = string(body[1 : 1+body[0]])
+		}
+	case strings.HasPrefix(topic, TopicReplyPrefix+"/"):
+		deviceName = strings.TrimPrefix(topic, TopicReplyPrefix+"/")
+	}
+	if deviceName != "" && migration.NoteMoved(deviceName) {
+		fmt.Printf("%s moved to topic namespace %q\n", deviceName, migration.Namespace())
+	}
+}
+
+// Inbound topics and their handlers, subscribed on every (re)connect
+// Routes that must not see stale retained messages are added after start_mqtt_process clears them.
+func register_mqtt_routes(router *messaging.Router) {
+	router.Handle(TopicOffline, func(m messaging.Message) { handle_device_offline(m.Payload) })
+	router.Handle(TopicHeartbeat, func(m messaging.Message) { handle_device_heartbeat(m.Payload) })
+	router.Handle(TopicTelemetry, func(m messaging.Message) { handle_telemetry_message(m.Payload) })
+	router.Handle(TopicTimeRequest, func(m messaging.Message) { handle_time_request(m.Payload) })
+	// Device outbox topics: <prefix>/<device_name>
+	router.Handle(TopicReplyPrefix+"/+", func(m messaging.Message) { handle_device_reply(m.Params[0], m.Payload) })
+	router.Handle(TopicControl, func(m messaging.Message) { handle_control_message(m.Payload) })
+	router.Handle(TopicDeviceQuery, func(m messaging.Message) { handle_device_query(m.Payload) })
+	router.Handle(etchsketchTopic, func(m messaging.Message) {
+		if etchsketchManager != nil {
+			handle_etchsketch_message(m.Payload)
+		}
+	})
+}
+
+// Update weather every x minutes
+func task_weather() {
+	health.Register("weather", time.Duration(WeatherUpdateInterval)*time.Minute)
+	ticker := time.NewTicker(time.Duration(WeatherUpdateInterval) * time.Minute)
+	forecastTicker := time.NewTicker(time.Duration(ForecastUpdateInterval) * time.Minute)
+	defer ticker.Stop()
+	defer forecastTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			health.Beat("weather")
+			if server_idle() {
+				continue
+			}
+			// Fetch current weather for all active device zipcodes
+			activeZipcodes := devices.GetActiveZipcodes()
+			if len(activeZipcodes) == 0 {
+				fmt.Println("No active devices, skipping weather fetch")
+			} else {
+				fmt.Printf("Fetching current weather for %d zipcode(s)\n", len(activeZipcodes))
+				for _, zip := range activeZipcodes {
+					fetch_weather("current_weather", zip)
+					// Publish immediately so devices receive refreshed data without waiting for reboot
+					publish_weather("current_weather", zip)
+					time.Sleep(1 * time.Second)
+				}
+			}
+
+		case <-forecastTicker.C:
+			if server_idle() {
+				continue
+			}
+			// Fetch forecast for all active device zipcodes
+			activeZipcodes := devices.GetActiveZipcodes()
+			if len(activeZipcodes) == 0 {
+				fmt.Println("No active devices, skipping forecast fetch")
+			} else {
+				fmt.Printf("Fetching forecast for %d zipcode(s)\n", len(activeZipcodes))
+				for _, zip := range activeZipcodes {
+					fetch_weather("forecast_weather", zip)
+					publish_weather("forecast_weather", zip)
+					time.Sleep(1 * time.Second)
+				}
+			}
+		}
+	}
+}
+
+// On startup, refresh expired cached weather for recently seen devices right away
+// instead of leaving their displays stale until the first scheduled tick
+func task_weather_warmup() {
+	since := time.Now().Add(-time.Duration(WeatherWarmupWindow) * time.Minute)
+	zipcodes := devices.RecentZipcodes(since)
+	fmt.Printf("Weather warm-up: checking %d zipcode(s)\n", len(zipcodes))
+
+	for _, zip := range zipcodes {
+		for _, data_type := range []string{"current_weather", "forecast_weather"} {
+			if is_weather_valid(data_type, zip) {
+				continue
+			}
+			fmt.Printf("Weather warm-up: %s for %s expired, refreshing\n", data_type, zip)
+			fetch_weather(data_type, zip)
+			publish_weather(data_type, zip)
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+// Theme sent to displays when no holiday falls on today
+const noTheme = "none"
+
+// Theme for today's holiday, or noTheme
+func current_theme() string {
+	if h, ok := holiday.On(time.Now()); ok {
+		return h.Theme
+	}
+	return noTheme
+}
+
+// Switch displays (and optionally the shared canvas) to the holiday theme when the day changes
+func task_holiday_theme() {
+	ticker := time.NewTicker(time.Duration(HolidayCheckInterval) * time.Minute)
+	defer ticker.Stop()
+
+	lastTheme := current_theme()
+	for range ticker.C {
+		if !holiday.Enabled() || server_idle() {
+			continue
+		}
+		theme := current_theme()
+		if theme == lastTheme {
+			continue
+		}
+		lastTheme = theme
+		apply_holiday_theme(theme)
+	}
+}
+
+func apply_holiday_theme(theme string) {
+	fmt.Printf("Holiday theme changed to %s\n", theme)
+	for _, device := range devices.GetActiveDevices() {
+		if !device.Pending {
+			publish_device_config(device.Name)
+		}
+	}
 
-	default:
-		fmt.Printf("Unknown etchsketch message type: 0x%02X\n", msgType)
+	configMutex.RLock()
+	art, hasArt := runtimeConfig.Holidays.CanvasArt[theme]
+	configMutex.RUnlock()
+	if !hasArt || etchsketchManager == nil {
+		return
+	}
+	red, green, blue, err := etchsketch.ParseArt(art)
+	if err != nil {
+		fmt.Printf("Warning: invalid canvas art for theme %s: %v\n", theme, err)
+		return
+	}
+	if err := etchsketchManager.PublishFrame(red, green, blue); err != nil {
+		fmt.Printf("Error publishing holiday canvas art: %v\n", err)
 	}
 }
 
-// Handler responds to mqtt messages for following topics
-var msg_handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-	topic := string(msg.Topic())
-	payload := msg.Payload()
+// Publish household aggregates (indoor temps, devices online, doors open) to hub displays
+func task_household_summary() {
+	ticker := time.NewTicker(time.Duration(HouseholdSummaryInterval) * time.Minute)
+	defer ticker.Stop()
 
-	if topic == TopicBootup {
-		fmt.Printf("Received bootup message on %s (bytes=%d)\n", TopicBootup, len(payload))
-		handle_device_bootup(payload)
-	}
+	for range ticker.C {
+		configMutex.RLock()
+		hubs := runtimeConfig.HubDevices
+		configMutex.RUnlock()
+		if len(hubs) == 0 || server_idle() {
+			continue
+		}
 
-	// Device heartbeat - keep device marked as active
-	if topic == TopicHeartbeat {
-		deviceName, err := parseHeartbeatMessage(payload)
-		if err != nil {
-			fmt.Printf("Error parsing heartbeat message: %v\n", err)
-		} else if deviceName != "" {
-			devices.Heartbeat(deviceName)
-			fmt.Printf("Heartbeat received from %s\n", deviceName)
-			// Respond with version notification on every heartbeat
-			publish_version_notification(deviceName)
+		msg := messaging.EncodeHouseholdSummary(build_household_summary())
+		for _, hub := range hubs {
+			if devices.IsPending(hub) {
+				continue
+			}
+			// Summaries are periodic and superseded by the next one
+			if !hold_if_quiet(hub, msg) {
+				messaging.PublishIfChanged(deviceTopic(hub), msg)
+			}
 		}
 	}
+}
 
-	// Device Last Will Testament - triggered on ungraceful disconnect (network/power loss)
-	if topic == TopicOffline {
-		deviceName := string(payload)
-		if deviceName != "" {
-			devices.SetInactive(deviceName)
+func build_household_summary() messaging.HouseholdSummary {
+	h := telemetry.Summarize(time.Duration(HouseholdReadingMaxAge) * time.Minute)
+
+	online := 0
+	for _, device := range devices.GetActiveDevices() {
+		if !device.Pending {
+			online++
 		}
 	}
 
-	// Etchsketch shared view messages
-	if topic == etchsketchTopic && etchsketchManager != nil {
-		handle_etchsketch_message(payload)
+	return messaging.HouseholdSummary{
+		OnlineDevices: uint8(clamp(online, 0, 255)),
+		HasTemps:      h.HasTemps,
+		MinIndoorTemp: int8(clamp(int(math.Round(h.MinIndoorTemp)), -50, 127)),
+		MaxIndoorTemp: int8(clamp(int(math.Round(h.MaxIndoorTemp)), -50, 127)),
+		HasDoors:      h.DoorsReporting > 0,
+		DoorsOpen:     uint8(clamp(h.DoorsOpen, 0, 255)),
 	}
 }
 
-// Update weather every x minutes
-func task_weather() {
-	ticker := time.NewTicker(time.Duration(WeatherUpdateInterval) * time.Minute)
-	forecastTicker := time.NewTicker(time.Duration(ForecastUpdateInterval) * time.Minute)
+func clamp(v int, lo int, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// Offline alert webhook body
+type OfflineAlert struct {
+	Event          string `json:"event"` // "device_offline" or "device_online"
+	Device         string `json:"device"`
+	Zipcode        string `json:"zipcode"`
+	OfflineSince   string `json:"offline_since,omitempty"`
+	OfflineMinutes int    `json:"offline_minutes,omitempty"`
+	Server         string `json:"server"`
+}
+
+// Expire silent devices and alert the webhook about devices offline past the grace period
+func task_offline_monitor() {
+	health.Register("offline_monitor", 1*time.Minute)
+	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
-	defer forecastTicker.Stop()
 
-	for {
-		select {
-		case <-ticker.C:
-			// Fetch current weather for all active device zipcodes
-			activeZipcodes := devices.GetActiveZipcodes()
-			if len(activeZipcodes) == 0 {
-				fmt.Println("No active devices, skipping weather fetch")
-			} else {
-				fmt.Printf("Fetching current weather for %d zipcode(s)\n", len(activeZipcodes))
-				for _, zip := range activeZipcodes {
-					fetch_weather("current_weather", zip)
-					// Publish immediately so devices receive refreshed data without waiting for reboot
-					publish_weather("current_weather", zip)
-					time.Sleep(1 * time.Second)
-				}
-			}
+	for range ticker.C {
+		health.Beat("offline_monitor")
+		configMutex.RLock()
+		timeout := time.Duration(runtimeConfig.HeartbeatTimeoutMinutes) * time.Minute
+		grace := time.Duration(runtimeConfig.OfflineGraceMinutes) * time.Minute
+		url := runtimeConfig.OfflineWebhookURL
+		configMutex.RUnlock()
+
+		if timeout > 0 {
+			devices.ExpireStale(timeout)
+		}
+		if url == "" {
+			continue
+		}
 
-		case <-forecastTicker.C:
-			// Fetch forecast for all active device zipcodes
-			activeZipcodes := devices.GetActiveZipcodes()
-			if len(activeZipcodes) == 0 {
-				fmt.Println("No active devices, skipping forecast fetch")
-			} else {
-				fmt.Printf("Fetching forecast for %d zipcode(s)\n", len(activeZipcodes))
-				for _, zip := range activeZipcodes {
-					fetch_weather("forecast_weather", zip)
-					publish_weather("forecast_weather", zip)
-					time.Sleep(1 * time.Second)
-				}
+		known := make(map[string]bool)
+		for _, device := range devices.GetAllDevices() {
+			known[device.ID] = true
+			if device.Pending {
+				continue
+			}
+			offline := !device.Active && !device.OfflineSince.IsZero()
+			alerted := offline_alert_sent(device.ID)
+
+			if offline && !alerted && time.Since(device.OfflineSince) >= grace {
+				note_offline_alert(device.ID, true)
+				go send_offline_alert(url, OfflineAlert{
+					Event:          "device_offline",
+					Device:         device.ID,
+					Zipcode:        device.Zipcode,
+					OfflineSince:   device.OfflineSince.Format(time.RFC3339),
+					OfflineMinutes: int(time.Since(device.OfflineSince) / time.Minute),
+				})
+			} else if !offline && alerted {
+				note_offline_alert(device.ID, false)
+				go send_offline_alert(url, OfflineAlert{Event: "device_online", Device: device.ID, Zipcode: device.Zipcode})
 			}
 		}
+		forget_offline_alerts(known)
 	}
 }
 
-// Ping healthcheck.io: monitor will email if it does not receive ping in x minutes
-func task_healthcheck(url string) {
+// Devices with an outstanding offline alert, kept so a restart doesn't alert them again
+var offlineAlertStore *storage.Manager
+
+func init_offline_alert_storage(path string) error {
+	store, err := storage.New(path)
+	if err != nil {
+		return err
+	}
+	offlineAlertStore = store
+	return nil
+}
+
+func offline_alert_sent(deviceID string) bool {
+	if offlineAlertStore == nil {
+		return false
+	}
+	_, sent := offlineAlertStore.Get(deviceID)
+	return sent
+}
+
+// Record that the offline alert for deviceID was sent, or that it was resolved
+func note_offline_alert(deviceID string, sent bool) {
+	if offlineAlertStore == nil {
+		return
+	}
+	var err error
+	if sent {
+		err = offlineAlertStore.Set(deviceID, true)
+	} else {
+		err = offlineAlertStore.Delete(deviceID)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save offline alert for %s: %v\n", deviceID, err)
+	}
+}
+
+// Drop outstanding alerts of devices that were removed
+func forget_offline_alerts(known map[string]bool) {
+	if offlineAlertStore == nil {
+		return
+	}
+	for deviceID := range offlineAlertStore.GetAll() {
+		if !known[deviceID] {
+			note_offline_alert(deviceID, false)
+		}
+	}
+}
+
+func send_offline_alert(url string, alert OfflineAlert) {
+	hostname, _ := os.Hostname()
+	alert.Server = hostname
+	fmt.Printf("Sending %s alert for %s\n", alert.Event, alert.Device)
+	timeline.Record(timeline.TypeAlert, alert.Device, "sent "+alert.Event+" alert",
+		map[string]interface{}{"event": alert.Event, "offline_minutes": alert.OfflineMinutes})
+	if err := webhook.Post(url, alert); err != nil {
+		fmt.Printf("Warning: failed to send %s alert for %s: %v\n", alert.Event, alert.Device, err)
+	}
+}
+
+// Ping healthchecks.io: monitor will email if it does not receive ping in x minutes.
+// While a subsystem has failed (e.g. MQTT down, weather fetches failing) the ping goes to
+// <url>/fail with a diagnostic body instead, so the monitor alerts right away.
+func task_healthcheck() {
 	client := &http.Client{Timeout: 10 * time.Second}
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for {
-		err := pingHealthcheck(client, url)
-		if err != nil {
-			// Ping failed, retry a few times before next scheduled check
-			backoff := time.Second * 30
-			for i := 0; i < 5; i++ {
-				time.Sleep(backoff)
-				if err = pingHealthcheck(client, url); err == nil {
-					// Ping successful
-					break
+		if url := healthcheck_url(); url != "" {
+			err := pingHealthcheck(client, url)
+			if err != nil {
+				// Ping failed, retry a few times before next scheduled check
+				backoff := time.Second * 30
+				for i := 0; i < 5; i++ {
+					time.Sleep(backoff)
+					if err = pingHealthcheck(client, url); err == nil {
+						// Ping successful
+						break
+					}
+					backoff *= 2 // exponential backoff
 				}
-				backoff *= 2 // exponential backoff
 			}
 		}
 		<-ticker.C
 	}
 }
 
+// Configured ping URL without a trailing slash ("" = disabled)
+func healthcheck_url() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return strings.TrimSuffix(runtimeConfig.HealthcheckURL, "/")
+}
+
+// Ping the check (or its /fail endpoint) with the current health as the body
 func pingHealthcheck(client *http.Client, url string) error {
-	resp, err := client.Get(url)
+	status := health.Status()
+	if status.State == health.StateFailed {
+		url += "/fail"
+	}
+	return postHealthcheck(client, url, health_diagnostics(status))
+}
+
+// Record a composite status change in the check's event log without affecting its state
+// Endpoint: <url>/log
+func log_health_change(status health.Composite) {
+	url := healthcheck_url()
+	if url == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if err := postHealthcheck(client, url+"/log", "status changed: "+health_diagnostics(status)); err != nil {
+		fmt.Printf("Warning: failed to log health change: %v\n", err)
+	}
+}
+
+func postHealthcheck(client *http.Client, url string, body string) error {
+	resp, err := client.Post(url, "text/plain", strings.NewReader(body))
 	if err != nil {
 		return err
 	}
 	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("healthcheck ping returned %s", resp.Status)
+	}
 	return nil
 }
 
-func start_mqtt_process() {
-	messaging.Create_client(msg_handler, []string{TopicBootup, TopicTest}, IsDebugBuild)
+// Reload the MQTT client certificate on SIGHUP, and whenever its files change
+func task_cert_reload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go messaging.WatchCertificates(time.Duration(CertWatchInterval) * time.Minute)
+
+	for range hup {
+		fmt.Println("SIGHUP received, reloading client certificate")
+		if err := messaging.ReloadCertificates(); err != nil {
+			fmt.Printf("Warning: client certificate reload failed: %v\n", err)
+		}
+	}
+}
+
+func start_mqtt_process() error {
+	configMutex.RLock()
+	mqttConfig := runtimeConfig.MQTT.WithDefaults(IsDebugBuild)
+	persistQueue := runtimeConfig.PersistPublishQueue
+	configMutex.RUnlock()
+
+	// Keep publishes made while disconnected across restarts (separate files for debug/prod)
+	if persistQueue {
+		if err := messaging.EnableQueuePersistence(get_storage_paths().PublishQueue); err != nil {
+			fmt.Printf("Warning: failed to persist publish queue: %v\n", err)
+		}
+	}
+
+	router := messaging.NewRouter()
+	router.Handle(TopicBootup, func(m messaging.Message) {
+		fmt.Printf("Received bootup message on %s (bytes=%d)\n", TopicBootup, len(m.Payload))
+		handle_device_bootup(m.Payload)
+	})
+	router.Handle(TopicTest, func(m messaging.Message) {
+		fmt.Printf("Received test message on %s (bytes=%d)\n", m.Topic, len(m.Payload))
+	})
+
+	// Paho for network brokers, the in-memory client for mem://local
+	// Devices and dashboards watch this to tell a down server from a down broker
+	messaging.SetPresenceTopic(TopicServerPresence)
+	client, err := messaging.NewClient(router, mqttConfig)
+	if err != nil {
+		return err
+	}
+	mqttPublisher = messaging.NewPublisher(client)
+	if err := messaging.Connect(client); err != nil {
+		return err
+	}
 
 	// Initialize etchsketch manager on configured topic
 	etchsketchTopic = TopicEtchSketch
-	etchsketchManager = etchsketch.NewManager(messaging.GetClient(), etchsketchTopic)
+	// Devices draw to each other on the canvas topic, so keep both sides of a migration on one canvas
+	messaging.RelayDuringMigration(etchsketchTopic)
+	// Frames drawn in quick succession are coalesced, more so when the broker is slow
+	etchsketchBatcher := messaging.NewBatcher("etchsketch", mqttPublisher.PublishWithPolicy, etchBatchMinWindow, etchBatchMaxWindow)
+	etchsketchManager = etchsketch.NewManager(etchsketchBatcher.Publish, etchsketchTopic)
+	configMutex.RLock()
+	width, height := runtimeConfig.CanvasWidth, runtimeConfig.CanvasHeight
+	configMutex.RUnlock()
+	if width != 0 || height != 0 {
+		if width == 0 {
+			width = 16
+		}
+		if height == 0 {
+			height = 16
+		}
+		// Chunks of one frame are published in order, without coalescing
+		if err := etchsketchManager.SetSize(width, height, mqttPublisher.PublishWithPolicy); err != nil {
+			fmt.Printf("Warning: %v; using 16x16\n", err)
+		}
+		etchsketchManager.SetChunksNeeded(etchsketch_chunks_needed)
+	}
+
+	// Record applied frames for time-lapse export (separate files for debug/prod)
+	// and pixel edit batches for replay
+	recordingPath, strokesPath := "./data/etchsketch_frames.jsonl", "./data/etchsketch_strokes.jsonl"
+	if IsDebugBuild {
+		recordingPath, strokesPath = "./data/etchsketch_frames_debug.jsonl", "./data/etchsketch_strokes_debug.jsonl"
+	}
+	if storage.InMemory() {
+		fmt.Println("EtchSketch: not recording frames (storage in memory only)")
+	} else {
+		if err := etchsketchManager.EnableRecording(recordingPath); err != nil {
+			fmt.Printf("Warning: failed to enable etchsketch recording: %v\n", err)
+		}
+		if err := etchsketchManager.EnableStrokeRecording(strokesPath); err != nil {
+			fmt.Printf("Warning: failed to enable etchsketch stroke recording: %v\n", err)
+		}
+	}
+	etchsketchManager.OnFrameApplied(func(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
+		record_canvas_frame(seq, red, green, blue)
+		publish_calibrated_frames(seq, red, green, blue)
+		publish_palette_frames()
+		publish_rle_frames()
+		events.Publish(events.Event{Type: events.CanvasUpdated, Data: map[string]uint16{"seq": seq}})
+		federation.NoteLocalFrame(federation.Frame{Red: red, Green: green, Blue: blue})
+	})
+	start_canvas_federation()
+
+	// Devices restored as active from storage are on the canvas without a fresh bootup
+	for _, device := range devices.GetActiveDevices() {
+		track_etchsketch_presence(device.Name)
+	}
 
 	// Clear retained shared view frames so devices don't receive unsolicited frames on boot
 	messaging.PublishRetained(etchsketchTopic, []byte{})
 
-	// Subscribe to device offline topic (Last Will Testament from devices)
-	messaging.Subscribe(TopicOffline, msg_handler)
-	// Subscribe to heartbeat topic for device keepalives
-	messaging.Subscribe(TopicHeartbeat, msg_handler)
-	// Subscribe to etchsketch shared view topic
-	messaging.Subscribe(etchsketchTopic, msg_handler)
+	// Subscribe to device, canvas and admin topics
+	register_mqtt_routes(router)
+	return nil
 }
 
 func main() {
+	// Subcommands (export/import, admin CLI) run instead of the server; --dry-run is read
+	// first, since it changes the config
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "--dry-run" || args[0] == "-dry-run") {
+		dryRun, args = true, args[1:]
+		if len(args) > 0 {
+			fmt.Println("--dry-run runs the server; it takes no command")
+			os.Exit(2)
+		}
+	}
+
+	// Load runtime config
+	if err := loadRuntimeConfig(); err != nil {
+		fmt.Printf("Warning: failed to load runtime config: %v (using defaults)\n", err)
+		// Set default version
+		configMutex.Lock()
+		runtimeConfig.DeviceVersion = "1.0.0"
+		runtimeConfig.AdminAddr = "127.0.0.1:8080"
+		if dryRun {
+			runtimeConfig = dry_run_config(runtimeConfig)
+		}
+		configMutex.Unlock()
+	}
+
+	if len(args) > 0 {
+		os.Exit(run_command(args))
+	}
+
+	// Mirror output to a log file before anything else is printed
+	var logTee *logfile.Tee
+	if !dryRun {
+		logTee = start_log_file()
+	}
+
 	if IsDebugBuild {
-		fmt.Println("Starting up... [DEBUG BUILD]")
+		fmt.Printf("Starting up %s... [DEBUG BUILD]\n", buildinfo.Get())
 	} else {
-		fmt.Println("Starting up... [PRODUCTION BUILD]")
+		fmt.Printf("Starting up %s... [PRODUCTION BUILD]\n", buildinfo.Get())
 	}
+	configMutex.RLock()
+	messaging.SetVerbose(runtimeConfig.VerboseLogging)
+	configMutex.RUnlock()
 
 	// Initialize persistent device storage (separate files for debug/prod)
-	var deviceStoragePath string
-	var weatherStoragePath string
-	if IsDebugBuild {
-		deviceStoragePath = "./data/devices_debug.json"
-		weatherStoragePath = "./data/weather_debug.json"
-	} else {
-		deviceStoragePath = "./data/devices.json"
-		weatherStoragePath = "./data/weather.json"
+	paths := get_storage_paths()
+	if !dryRun {
+		// One server per data directory; export/import wait for it to stop (the lock is
+		// released when the process exits)
+		release, err := lock_data_dir(paths.Lock)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		dataDirUnlock = release
 	}
+	backupDir = paths.Backups
+	backupFiles = []string{paths.Devices, paths.Weather, paths.Mood, paths.Accounting, paths.Firmware}
+	if open_storage_backend(paths) {
+		telemetry.EnableHistory(storage.SQLiteDB())
+	}
+	open_timeline(paths)
+	devices.OnEvent(record_device_event)
 
-	if err := devices.InitStorage(deviceStoragePath); err != nil {
+	if err := devices.InitStorage(paths.Devices); err != nil {
 		fmt.Printf("Warning: failed to initialize device storage: %v\n", err)
+		health.Set("devices", health.StateDegraded, "storage not loaded: "+err.Error())
+	} else {
+		health.Set("devices", health.StateOK, "")
 	}
 
 	// Initialize weather storage
-	if err := weather.InitWeatherStorage(weatherStoragePath); err != nil {
+	if err := weather.InitWeatherStorage(paths.Weather); err != nil {
 		fmt.Printf("Warning: failed to initialize weather storage: %v\n", err)
 	}
 
-	// Load runtime config
-	if err := loadRuntimeConfig(); err != nil {
-		fmt.Printf("Warning: failed to load runtime config: %v (using defaults)\n", err)
-		// Set default version
-		configMutex.Lock()
-		runtimeConfig.DeviceVersion = "1.0.0"
-		configMutex.Unlock()
+	// Initialize per-device usage accounting
+	if err := accounting.InitStorage(paths.Accounting); err != nil {
+		fmt.Printf("Warning: failed to initialize usage accounting: %v\n", err)
+	}
+	messaging.OnPublish(func(topic string, size int) {
+		account_publish(topic, size)
+		if events.Subscribers() > 0 {
+			events.Publish(events.Event{Type: events.MessagePublished, Data: map[string]interface{}{"topic": topic, "bytes": size}})
+		}
+	})
+	messaging.SetProtocolResolver(topic_protocol_version)
+
+	// Initialize weather mood mapping table
+	if err := mood.InitStorage(paths.Mood); err != nil {
+		fmt.Printf("Warning: failed to initialize weather mood storage: %v\n", err)
+	}
+
+	// Latest firmware per hardware type
+	if err := ota.InitStorage(paths.Firmware); err != nil {
+		fmt.Printf("Warning: failed to initialize firmware release storage: %v\n", err)
+	}
+
+	// Serve the topic namespace(s) a migration left the fleet on
+	if err := migration.InitStorage(paths.Migration); err != nil {
+		fmt.Printf("Warning: failed to initialize topic migration storage: %v\n", err)
+	}
+	if state, exists := migration.Current(); exists {
+		messaging.SetTopicNamespace(state.To, state.From, state.Phase == migration.PhaseTransition)
+	}
+	messaging.OnMovedMessage(handle_moved_message)
+
+	// Alert conditions already reported, so a restart doesn't report them again
+	if err := notify.InitStorage(paths.Alerts); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	if err := init_offline_alert_storage(paths.OfflineAlert); err != nil {
+		fmt.Printf("Warning: failed to initialize offline alert storage: %v\n", err)
+	}
+
+	// Long-running jobs; any interrupted by the last shutdown resume once MQTT is up
+	register_job_handlers()
+	if err := jobs.InitStorage(paths.Jobs); err != nil {
+		fmt.Printf("Warning: failed to initialize job storage: %v\n", err)
+	}
+
+	// Feed telemetry into the rules engine; rule changes drive display indicators
+	telemetry.OnReading(func(r telemetry.Reading) {
+		rules.Evaluate(r.Device, r.Metric, r.Value)
+		export_reading(r)
+		trigger_scenes(scenes.ForReading(r.Device, r.Metric, r.Value), "telemetry")
+	})
+	rules.OnTrigger(publish_indicator)
+	arbiter.OnShow(show_notification)
+	devices.OnPresenceChange(func(name string, online bool) {
+		if online {
+			wake_from_idle(name)
+		}
+		track_etchsketch_presence(name)
+		publish_presence_event(name, online)
+		export_presence(name, online)
+		trigger_scenes(scenes.ForPresence(name, online), "presence")
+	})
+
+	// Start local admin interface
+	register_admin_routes()
+	configMutex.RLock()
+	adminAddr := runtimeConfig.AdminAddr
+	grpcAddr := runtimeConfig.GRPCAddr
+	authConfig := runtimeConfig.Auth
+	configMutex.RUnlock()
+	if err := configure_admin_auth(authConfig); err != nil {
+		// Never fall back to an open admin interface
+		fmt.Printf("Warning: invalid auth config, admin interface disabled: %v\n", err)
+	} else {
+		admin.Start(adminAddr)
+		start_grpc_admin(grpcAddr)
 	}
 
-	wait_for_current_time() // Channel to signal when to stop process
+	// Wait (bounded) for a trusted clock; devices are served either way
+	start_clock_sync()
+
+	// Channel to signal when to stop process
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Post request every x minutes to healthcheck.io
-	go task_healthcheck("https://hc-ping.com/5b729be7-9787-405a-b26f-76ad7aad6ca4")
+	go task_healthcheck()
 
 	// Get weather every x minutes
 	go task_weather()
@@ -513,11 +2456,214 @@ func main() {
 	// Reload runtime config every 15 minutes
 	go task_reload_config()
 
-	start_mqtt_process()
+	// Snapshot device state every few minutes
+	go task_device_checkpoint()
+
+	// Publish household summary to hub displays every few minutes
+	go task_household_summary()
+
+	// Watch for devices going silent and alert on long outages
+	go task_offline_monitor()
+
+	// Switch display themes on holidays
+	go task_holiday_theme()
+
+	// Save usage accounting every few minutes
+	go task_accounting_flush()
+
+	// Refine temperature between fetches for devices that opt in
+	go task_interpolated_temp()
+
+	// Resend full device configs to correct any lost deltas
+	go task_config_reconcile()
+
+	// Warn device clocks ahead of DST changes
+	go task_dst_notices()
+
+	// Start and end device quiet hours
+	go task_quiet_hours()
+
+	// Re-render e-paper screens and push the ones that changed
+	go task_epaper()
+
+	// Activate scheduled scenes
+	go task_scenes()
+
+	// Suspend periodic device work while no device is active
+	go task_idle_monitor()
+
+	if err := start_mqtt_process(); err != nil {
+		fmt.Printf("Fatal: failed to start MQTT client: %v\n", err)
+		storage.FlushAll()
+		if logTee != nil {
+			logTee.Stop()
+		}
+		os.Exit(1)
+	}
+
+	// Mirror selected topics to the cloud broker
+	start_cloud_bridge()
+
+	// Capture MQTT traffic from startup if configured
+	start_traffic_capture()
+
+	// Pick up a rotated client certificate on SIGHUP or when its files change
+	go task_cert_reload()
+
+	// Status dump on SIGUSR1, verbose logging toggle on SIGUSR2
+	go task_debug_signals()
+
+	// Refresh expired weather now rather than at the first tick
+	go task_weather_warmup()
+
+	// Track subsystem health and publish the composite status
+	go task_health()
+
+	// Push images dropped into the display directory to the canvas
+	configMutex.RLock()
+	displayDropDir := runtimeConfig.DisplayDropDir
+	configMutex.RUnlock()
+	if displayDropDir != "" && storage.InMemory() {
+		// Pushed files are moved into done/ or failed/, which --dry-run must not do
+		fmt.Println("Display: not watching the drop directory (storage in memory only)")
+	} else if displayDropDir != "" {
+		go task_display_drop(displayDropDir)
+	}
+
+	// Export metrics to InfluxDB
+	configMutex.RLock()
+	influxConfig := runtimeConfig.Influx
+	configMutex.RUnlock()
+	if err := influx.Configure(influxConfig); err != nil {
+		fmt.Printf("Warning: influx export disabled: %v\n", err)
+	} else if influx.Enabled() {
+		go task_metrics_export()
+	}
+
+	// Alert people about offline devices, weather failures and failed OTA rollouts
+	jobs.OnFinish(alert_job_finished)
+	go task_alerts()
+
+	// Run queued jobs
+	jobs.Start()
 
 	fmt.Println("Finished process initializing")
+	timeline.Recordf(timeline.TypeServer, "", "server started (%s build)", build_name())
 
 	<-c // Block until signal received
+	timeline.Recordf(timeline.TypeServer, "", "server stopping")
 
+	announce_shutdown()
+	messaging.AnnounceOffline()
+
+	if err := devices.Checkpoint(); err != nil {
+		fmt.Printf("Warning: final device checkpoint failed: %v\n", err)
+	}
+	if err := accounting.Flush(); err != nil {
+		fmt.Printf("Warning: failed to save usage accounting: %v\n", err)
+	}
+	if err := storage.FlushAll(); err != nil {
+		fmt.Printf("Warning: failed to write pending storage changes: %v\n", err)
+	}
+	capture.Stop()
+	if fake, ok := messaging.GetClient().(*messaging.FakeClient); ok {
+		fake.Close() // Stops its delivery goroutine
+	}
+	timeline.Close()
 	fmt.Println("Exiting server application")
+	if logTee != nil {
+		logTee.Stop()
+	}
+}
+
+// Expected downtime announced to devices on shutdown when not set in config.json
+const defaultShutdownDowntimeSeconds = 120
+
+// Tell devices the server is going down on purpose and for how long, so they back off
+// reconnecting and don't flag the outage
+// Topic: server_status, Message Type: 0x1E (MSG_SERVER_SHUTDOWN), QoS: 1
+func announce_shutdown() {
+	configMutex.RLock()
+	seconds := runtimeConfig.ShutdownDowntimeSeconds
+	configMutex.RUnlock()
+	if seconds == 0 {
+		seconds = defaultShutdownDowntimeSeconds
+	}
+	if seconds < 0 {
+		return
+	}
+
+	downtime := time.Duration(seconds) * time.Second
+	fmt.Printf("Announcing shutdown to devices (expected downtime %v)\n", downtime)
+	messaging.PublishWithPolicy(TopicServerStatus, messaging.EncodeServerShutdown(downtime))
+}
+
+// Log file defaults (overridable in config.json)
+const (
+	defaultLogMaxSizeMB = 5
+	defaultLogMaxFiles  = 5
+)
+
+// Start mirroring stdout into ./data/logs when logToFile is set; returns nil if disabled
+func start_log_file() *logfile.Tee {
+	configMutex.RLock()
+	enabled := runtimeConfig.LogToFile
+	maxSizeMB := runtimeConfig.LogMaxSizeMB
+	maxFiles := runtimeConfig.LogMaxFiles
+	configMutex.RUnlock()
+
+	if !enabled {
+		return nil
+	}
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultLogMaxSizeMB
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultLogMaxFiles
+	}
+
+	name := "server.log"
+	if IsDebugBuild {
+		name = "server_debug.log"
+	}
+	writer, err := logfile.Open("./data/logs", name, int64(maxSizeMB)<<20, maxFiles)
+	if err != nil {
+		fmt.Printf("Warning: file logging disabled: %v\n", err)
+		return nil
+	}
+	tee, err := logfile.TeeStdout(writer)
+	if err != nil {
+		fmt.Printf("Warning: file logging disabled: %v\n", err)
+		writer.Close()
+		return nil
+	}
+	fmt.Printf("Logging to ./data/logs/%s (rotate at %d MB, keep %d)\n", name, maxSizeMB, maxFiles)
+	return tee
+}
+
+// Set up MQTT traffic capture next to the log files, and start it if enabled in config.json
+func start_traffic_capture() {
+	configMutex.RLock()
+	cfg := runtimeConfig.Capture
+	configMutex.RUnlock()
+
+	name := "mqtt_capture.log"
+	if IsDebugBuild {
+		name = "mqtt_capture_debug.log"
+	}
+	if storage.InMemory() {
+		// --dry-run writes nothing to ./data; runtime toggles fail too
+		capture.Configure("", name, cfg)
+		if cfg.Enabled {
+			fmt.Println("Note: MQTT capture is off while storage is in memory")
+		}
+		return
+	}
+	capture.Configure("./data/logs", name, cfg)
+	if !cfg.Enabled {
+		return
+	}
+	if err := capture.Start(""); err != nil {
+		fmt.Printf("Warning: MQTT capture disabled: %v\n", err)
+	}
 }
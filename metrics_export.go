@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/health"
+	"server_app/internal/influx"
+	"server_app/internal/telemetry"
+	"server_app/internal/weather"
+	"time"
+)
+
+// Measurements written to the influx export:
+//
+//	weather,zipcode=97201 temp=51.3,feels_like=49.8,humidity=81i,pressure=1016i,wind_speed=4.6,condition="Rain"
+//	device,device=kitchen online=1i,last_seen_seconds=42i      (every flush, and on each transition)
+//	telemetry,device=porch,metric=temp value=63.5
+
+// Write buffered metrics to the influx endpoint, adding a device uptime snapshot each time
+func task_metrics_export() {
+	interval := influx.Interval()
+	health.Register("metrics_export", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("metrics_export")
+		export_device_snapshot()
+		n, err := influx.Flush()
+		if err != nil {
+			fmt.Printf("Warning: influx export failed after %d point(s), retrying next flush: %v\n", n, err)
+		}
+	}
+}
+
+func export_device_snapshot() {
+	now := time.Now()
+	var points []influx.Point
+	for _, device := range devices.GetAllDevices() {
+		if device.Pending {
+			continue
+		}
+		fields := map[string]interface{}{"online": online_value(device.Active)}
+		if !device.LastSeen.IsZero() {
+			fields["last_seen_seconds"] = int(now.Sub(device.LastSeen) / time.Second)
+		}
+		points = append(points, influx.Point{Measurement: "device", Tags: map[string]string{"device": device.ID}, Fields: fields, Time: now})
+	}
+	influx.Add(points...)
+}
+
+// Record an online/offline transition at the moment it happened
+func export_presence(name string, online bool) {
+	influx.Add(influx.Point{Measurement: "device", Tags: map[string]string{"device": name},
+		Fields: map[string]interface{}{"online": online_value(online)}})
+}
+
+// 1/0 rather than a boolean, so uptime can be averaged in Grafana
+func online_value(online bool) int {
+	if online {
+		return 1
+	}
+	return 0
+}
+
+func export_reading(r telemetry.Reading) {
+	influx.Add(influx.Point{Measurement: "telemetry", Tags: map[string]string{"device": r.Device, "metric": r.Metric},
+		Fields: map[string]interface{}{"value": r.Value}, Time: r.Time})
+}
+
+// Record a freshly fetched current weather observation at the provider's observation time
+func export_weather(zip string, raw []byte) {
+	if !influx.Enabled() {
+		return
+	}
+	var current weather.Current_weather
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return // Already reported by the weather code
+	}
+	fields := map[string]interface{}{
+		"temp":       current.Main.Temp,
+		"feels_like": current.Main.FeelsLike,
+		"humidity":   current.Main.Humidity,
+		"pressure":   current.Main.Pressure,
+		"clouds":     current.Clouds.All,
+	}
+	if current.Wind.Speed != nil {
+		fields["wind_speed"] = *current.Wind.Speed
+	}
+	if len(current.Weather) > 0 {
+		fields["condition"] = current.Weather[0].Main
+	}
+	observed := time.Now()
+	if current.Dt > 0 {
+		observed = time.Unix(int64(current.Dt), 0)
+	}
+	influx.Add(influx.Point{Measurement: "weather", Tags: map[string]string{"zipcode": zip}, Fields: fields, Time: observed})
+}
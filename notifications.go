@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/arbiter"
+	"server_app/internal/devices"
+	"server_app/internal/messaging"
+	"server_app/internal/rules"
+	"time"
+)
+
+// Capability advertised by displays that show MSG_NOTIFICATION text
+const capabilityNotifications = "notifications"
+
+// Notification sources, each with a default display priority (notificationPriorities in
+// config.json overrides them)
+const (
+	notificationSourceText = "text" // Messages sent through the admin API
+	notificationSourceRule = "rule" // Telemetry rules with notify text
+)
+
+var defaultNotificationPriorities = map[string]int{
+	notificationSourceText: arbiter.PriorityNormal,
+	notificationSourceRule: arbiter.PriorityHigh,
+}
+
+// Display time for rule notifications
+const ruleNotificationDuration = 30 * time.Second
+
+// Priority for a source's notifications
+func notification_priority(source string) int {
+	configMutex.RLock()
+	priority, exists := runtimeConfig.NotificationPriorities[source]
+	configMutex.RUnlock()
+	if exists {
+		return priority
+	}
+	if priority, exists := defaultNotificationPriorities[source]; exists {
+		return priority
+	}
+	return arbiter.PriorityNormal
+}
+
+// Queue a text notification for a device's display. priority 0 uses the source's priority;
+// ttl 0 keeps it waiting as long as it takes; a pending notification with the same key
+// ("" = none) is replaced.
+func submit_text_notification(deviceName string, source string, key string, text string, priority int, duration time.Duration, ttl time.Duration) (arbiter.Notification, error) {
+	if priority <= 0 {
+		priority = notification_priority(source)
+	}
+	wire := uint8(clamp(priority, 0, 255))
+	if _, err := messaging.EncodeNotification(wire, duration, text); err != nil {
+		return arbiter.Notification{}, err
+	}
+	n := arbiter.Notification{
+		Device:   deviceName,
+		Source:   source,
+		Key:      key,
+		Priority: priority,
+		Duration: duration,
+		Summary:  text,
+		Message: func(held time.Duration) ([]byte, error) {
+			return messaging.EncodeNotification(wire, held, text)
+		},
+	}
+	if ttl > 0 {
+		n.Expires = time.Now().Add(ttl)
+	}
+	return arbiter.Submit(n)
+}
+
+// Send the notification that won a device's display
+// Topic: <device_name>, Message Type: 0x24 (MSG_NOTIFICATION), QoS: 1
+func show_notification(deviceName string, msg []byte) {
+	if devices.IsPending(deviceName) {
+		return
+	}
+	messaging.PublishWithPolicy(deviceTopic(deviceName), msg)
+}
+
+// Show a rule's notify text on its target when the rule turns on
+func notify_rule(t rules.Trigger) {
+	if !t.Active || t.Rule.Notify == "" {
+		return
+	}
+	device, exists := devices.GetDevice(t.Rule.Target)
+	if !exists || !device.Metadata.HasCapability(capabilityNotifications) {
+		return
+	}
+	if _, err := submit_text_notification(t.Rule.Target, notificationSourceRule, "rule:"+t.Rule.Name, t.Rule.Notify, 0, ruleNotificationDuration, 0); err != nil {
+		fmt.Printf("Warning: rule %s notification for %s failed: %v\n", t.Rule.Name, t.Rule.Target, err)
+	}
+}
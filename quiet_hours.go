@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/health"
+	"server_app/internal/messaging"
+	"server_app/internal/timeline"
+	"server_app/internal/weather"
+	"sync"
+	"time"
+)
+
+// Quiet hours: during a device's nightly window the server holds back non-critical updates
+// to it. Messages for its own topic (weather mood, interpolated temperature, household
+// summary) are held, latest per type; canvas frames and e-paper screens are skipped.
+// Updates on shared topics can't be held per device, so a device advertising the
+// quiet_hours capability is told with MSG_QUIET_HOURS to ignore them. Older firmware
+// doesn't know that message and keeps showing shared weather and canvas frames; only its
+// own-topic updates are held. When the window ends the device gets the held messages, the
+// latest weather and the current canvas on its own topic.
+// Time, config, version, indicators and notifications are always sent.
+
+// Capability advertised by devices that honor MSG_QUIET_HOURS
+const capabilityQuietHours = "quiet_hours"
+
+// How often devices are checked for entering or leaving quiet hours
+const quietHoursCheckInterval = 1 * time.Minute
+
+var (
+	quietMu sync.Mutex
+	// End of the window each device is in (absent = not quiet)
+	quietUntil = make(map[string]time.Time)
+	// Latest message held per type for each quiet device
+	quietHeld = make(map[string]map[uint8][]byte)
+)
+
+func task_quiet_hours() {
+	health.Register("quiet_hours", quietHoursCheckInterval)
+	ticker := time.NewTicker(quietHoursCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("quiet_hours")
+		for _, device := range devices.GetAllDevices() {
+			check_quiet_hours(device)
+		}
+	}
+}
+
+// Start or end a device's quiet hours as its window opens or closes
+func check_quiet_hours(device devices.Device) {
+	quiet, until := false, time.Time{}
+	if device.QuietHours != nil && device.Active && !device.Pending {
+		now := time.Now().In(device_location(device))
+		quiet = device.QuietHours.Contains(now)
+		until = device.QuietHours.NextEnd(now)
+	}
+
+	quietMu.Lock()
+	_, was := quietUntil[device.Name]
+	if quiet {
+		quietUntil[device.Name] = until
+	} else {
+		delete(quietUntil, device.Name)
+	}
+	quietMu.Unlock()
+
+	switch {
+	case quiet && !was:
+		fmt.Printf("Quiet hours for %s until %s\n", device.Name, until.Format("15:04"))
+		if device.Metadata.HasCapability(capabilityQuietHours) {
+			messaging.PublishWithPolicy(deviceTopic(device.Name), messaging.EncodeQuietHours(until))
+		} else {
+			fmt.Printf("%s does not support quiet hours; shared weather and canvas updates still reach it\n", device.Name)
+		}
+		timeline.Record(timeline.TypeDevice, device.Name, "quiet hours started", nil)
+	case !quiet && was:
+		end_quiet_hours(device)
+	}
+}
+
+// Tell a device its quiet hours ended and catch it up on what it missed
+func end_quiet_hours(device devices.Device) {
+	quietMu.Lock()
+	held := quietHeld[device.Name]
+	delete(quietHeld, device.Name)
+	quietMu.Unlock()
+
+	if !device.Active || device.Pending {
+		return // Served from scratch on its next bootup
+	}
+	fmt.Printf("Quiet hours for %s ended, sending %d held message(s)\n", device.Name, len(held))
+	topic := deviceTopic(device.Name)
+	if device.Metadata.HasCapability(capabilityQuietHours) {
+		messaging.PublishWithPolicy(topic, messaging.EncodeQuietHours(time.Time{}))
+	}
+	timeline.Record(timeline.TypeDevice, device.Name, "quiet hours ended",
+		map[string]interface{}{"held_messages": len(held)})
+
+	// Weather the device ignored on its zipcode's topic
+	weatherTopic := TopicWeatherPrefix + "/" + device.Zipcode
+	for _, msgType := range []uint8{messaging.MSG_CURRENT_WEATHER, messaging.MSG_CURRENT_WEATHER_V2, messaging.MSG_FORECAST_WEATHER, messaging.MSG_FORECAST_WEATHER_V2} {
+		if msg, ok := messaging.LastPublished(weatherTopic, msgType); ok {
+			messaging.PublishWithPolicy(topic, msg)
+		}
+	}
+	// Not PublishIfChanged: the weather just sent replaced what the device shows, so a held
+	// message matching the last one published must still go out
+	for _, msg := range held {
+		messaging.PublishWithPolicy(topic, msg)
+	}
+	if etchsketchManager != nil {
+		resync_etchsketch_device(device.Name)
+	}
+	if device.Metadata.HasCapability(capabilityEPaper) {
+		publish_epaper_screen(device.Name, false)
+	}
+}
+
+// Whether a device is in its quiet hours
+func device_quiet(deviceName string) bool {
+	quietMu.Lock()
+	defer quietMu.Unlock()
+	_, quiet := quietUntil[deviceName]
+	return quiet
+}
+
+// Hold a non-critical message for a device's own topic if it is in its quiet hours; reports
+// whether it was held (otherwise the caller sends it)
+func hold_if_quiet(deviceName string, msg []byte) bool {
+	if len(msg) == 0 {
+		return false
+	}
+	quietMu.Lock()
+	defer quietMu.Unlock()
+	if _, quiet := quietUntil[deviceName]; !quiet {
+		return false
+	}
+	if quietHeld[deviceName] == nil {
+		quietHeld[deviceName] = make(map[uint8][]byte)
+	}
+	quietHeld[deviceName][msg[0]] = append([]byte(nil), msg...)
+	return true
+}
+
+// A device that reboots (or goes away) has forgotten it was told to be quiet
+func reset_quiet_hours(deviceName string) {
+	quietMu.Lock()
+	delete(quietUntil, deviceName)
+	delete(quietHeld, deviceName)
+	quietMu.Unlock()
+}
+
+// Time zone of a device's zipcode, or the server's
+func device_location(device devices.Device) *time.Location {
+	if loc, err := weather.Location(device.Zipcode); err == nil {
+		return loc
+	}
+	return time.Local
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/etchsketch"
+	"server_app/internal/health"
+	"server_app/internal/messaging"
+	"server_app/internal/scenes"
+	"server_app/internal/timeline"
+	"sync"
+	"time"
+)
+
+var errUnknownScene = errors.New("unknown scene")
+
+// Scene activations run one at a time, so two scenes never interleave their changes
+var sceneMu sync.Mutex
+
+// Apply a scene to its whole target group: every target takes the scene's config (devices
+// that send replies must acknowledge it) before the canvas gets the scene's art. If any
+// target fails, all targets are put back the way they were.
+func activate_scene(name string, trigger string) (scenes.Run, error) {
+	scene, exists := scenes.Get(name)
+	if !exists {
+		return scenes.Run{}, fmt.Errorf("%w: %s", errUnknownScene, name)
+	}
+
+	sceneMu.Lock()
+	defer sceneMu.Unlock()
+
+	run := scenes.Run{Scene: name, Trigger: trigger, Started: time.Now()}
+	err := apply_scene(scene, &run)
+	run.Finished = time.Now()
+	run.OK = err == nil
+	if err != nil {
+		run.Error = err.Error()
+		fmt.Printf("Scene %s (%s) failed: %v\n", name, trigger, err)
+	} else {
+		fmt.Printf("Scene %s activated (%s)\n", name, trigger)
+	}
+	timeline.Record(timeline.TypeScene, "", fmt.Sprintf("scene %s activated (%s)", name, trigger),
+		map[string]interface{}{"scene": name, "trigger": trigger, "ok": run.OK, "error": run.Error})
+	scenes.Record(run)
+	return run, err
+}
+
+func apply_scene(scene scenes.Scene, run *scenes.Run) error {
+	// Check everything before changing anything
+	var red, green, blue [16]uint16
+	if len(scene.Canvas) > 0 {
+		if etchsketchManager == nil {
+			return fmt.Errorf("shared canvas is not running")
+		}
+		var err error
+		if red, green, blue, err = etchsketch.ParseArt(scene.Canvas); err != nil {
+			return err
+		}
+	}
+	previous := make(map[string]map[string]string, len(scene.Devices))
+	for _, name := range scene.Devices {
+		current, err := devices.GetConfig(name)
+		if err != nil {
+			return fmt.Errorf("device %s: %v", name, err)
+		}
+		if devices.IsPending(name) {
+			return fmt.Errorf("device %s is pending approval", name)
+		}
+		if n, limit := messaging.ConfigPairsPayloadLen(devices.MergeConfig(current, scene.Config)), config_payload_limit(name); n > limit {
+			return fmt.Errorf("device %s: config payload would be %d bytes, exceeds maximum of %d", name, n, limit)
+		}
+		previous[name] = current
+	}
+
+	if len(scene.Config) > 0 {
+		for _, name := range scene.Devices {
+			if _, err := devices.UpdateConfig(name, scene.Config); err != nil {
+				run.Failed = append(run.Failed, name)
+			}
+		}
+		if len(run.Failed) == 0 {
+			run.Failed = deliver_scene_config(scene.Devices)
+		}
+		if len(run.Failed) > 0 {
+			restore_scene_targets(previous)
+			run.RolledBack = true
+			return fmt.Errorf("%d of %d devices did not take the scene", len(run.Failed), len(scene.Devices))
+		}
+	}
+
+	if len(scene.Canvas) > 0 {
+		if err := etchsketchManager.PublishFrame(red, green, blue); err != nil {
+			restore_scene_targets(previous)
+			run.RolledBack = true
+			return fmt.Errorf("failed to publish canvas art: %v", err)
+		}
+	}
+	return nil
+}
+
+// Push the full config to every online target at once and wait for each to be delivered;
+// returns the devices that failed. Offline targets get the stored config at their next bootup.
+func deliver_scene_config(names []string) []string {
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(names))
+	waiting := 0
+	for _, name := range names {
+		device, exists := devices.GetDevice(name)
+		if !exists || !device.Active {
+			continue
+		}
+		waiting++
+		name := name
+		send_full_device_config(name, func(err error) { results <- result{name, err} })
+	}
+
+	var failed []string
+	for i := 0; i < waiting; i++ {
+		if r := <-results; r.err != nil {
+			failed = append(failed, r.name)
+		}
+	}
+	return failed
+}
+
+// Put the targets' configs back as they were before the scene
+func restore_scene_targets(previous map[string]map[string]string) {
+	for name, config := range previous {
+		changed, err := devices.SetConfig(name, config)
+		if err != nil {
+			fmt.Printf("Warning: failed to restore config of %s after scene: %v\n", name, err)
+			continue
+		}
+		if changed {
+			publish_full_device_config(name)
+		}
+	}
+}
+
+// Activate scenes in the background (from telemetry or presence, which must not wait)
+func trigger_scenes(names []string, trigger string) {
+	for _, name := range names {
+		go activate_scene(name, trigger)
+	}
+}
+
+// Activate scheduled scenes
+func task_scenes() {
+	health.Register("scenes", time.Minute)
+	ticker := time.NewTicker(15 * time.Second) // Several checks per minute; each minute fires once
+	defer ticker.Stop()
+
+	for range ticker.C {
+		health.Beat("scenes")
+		// While idle only scenes marked whileIdle fire on schedule
+		trigger_scenes(scenes.Due(time.Now(), server_idle()), "schedule")
+	}
+}
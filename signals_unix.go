@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGUSR1 dumps server status to the log; SIGUSR2 toggles verbose logging
+func task_debug_signals() {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range usr {
+		if sig == syscall.SIGUSR1 {
+			dump_status()
+		} else {
+			toggle_verbose_logging()
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build windows
+// +build windows
+
+package main
+
+// Windows has no SIGUSR1/SIGUSR2; the status dump and verbose toggle are unavailable
+func task_debug_signals() {}
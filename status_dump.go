@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"server_app/internal/buildinfo"
+	"server_app/internal/devices"
+	"server_app/internal/messaging"
+	"server_app/internal/weather"
+	"strings"
+	"time"
+)
+
+// Status dump for looking into a live server without the admin API (SIGUSR1): device
+// status, weather cache ages, the MQTT connection and every goroutine's stack, printed
+// to stdout and so to the log file.
+
+func dump_status() {
+	fmt.Printf("\n=== Status Dump (%s) ===\n", time.Now().Format(time.RFC3339))
+	fmt.Printf("Server %s, %d goroutines, verbose logging %s\n", buildinfo.Get(), runtime.NumGoroutine(), on_off(messaging.Verbose()))
+
+	devices.PrintStatus()
+
+	fmt.Println("\n=== Weather Cache ===")
+	zipcodes := weather.StoredZipcodes()
+	if len(zipcodes) == 0 {
+		fmt.Println("No weather stored")
+	}
+	for _, zip := range zipcodes {
+		fmt.Printf("%s | Current: %s | Forecast: %s\n", zip, weather_age_text("current_weather", zip), weather_age_text("forecast_weather", zip))
+	}
+
+	fmt.Println("\n=== MQTT ===")
+	status := messaging.Status()
+	if status.Connected {
+		fmt.Printf("Connected to %s for %v\n", status.Active, time.Since(status.ConnectedSince).Round(time.Second))
+	} else {
+		fmt.Printf("Not connected (brokers: %s, last error: %s)\n", strings.Join(status.Brokers, ", "), status.LastError)
+	}
+	fmt.Printf("Failovers: %d | Queued publishes: %d | Publish RTT: %.1fms\n", status.Failovers, status.Queued, status.PublishRTTMs)
+
+	fmt.Println("\n=== Goroutines ===")
+	if err := pprof.Lookup("goroutine").WriteTo(os.Stdout, 2); err != nil {
+		fmt.Printf("Failed to dump goroutines: %v\n", err)
+	}
+	fmt.Println("=== End of Status Dump ===")
+}
+
+// Toggle logging of every received message (SIGUSR2)
+func toggle_verbose_logging() {
+	on := !messaging.Verbose()
+	messaging.SetVerbose(on)
+	fmt.Printf("Verbose logging %s\n", on_off(on))
+}
+
+// Age of stored weather for the dump, e.g. "12m (valid)"
+func weather_age_text(data_type string, zip string) string {
+	age, ok := weather_age(data_type, zip)
+	if !ok {
+		return "none"
+	}
+	state := "stale"
+	if is_weather_valid(data_type, zip) {
+		state = "valid"
+	}
+	return fmt.Sprintf("%v (%s)", age.Round(time.Minute), state)
+}
+
+func on_off(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"server_app/internal/devices"
+	"server_app/internal/rules"
+	"server_app/internal/storage"
+	"server_app/internal/timeline"
+	"sync/atomic"
+	"time"
+)
+
+// Default days of history kept in the timeline
+const DefaultTimelineRetentionDays = 90
+
+// Load the event timeline; events recorded before this (startup) are kept in memory and
+// written once it is open
+func open_timeline(paths storagePaths) {
+	configMutex.RLock()
+	days := runtimeConfig.TimelineRetentionDays
+	configMutex.RUnlock()
+	if days <= 0 {
+		days = DefaultTimelineRetentionDays
+	}
+	if storage.InMemory() {
+		fmt.Println("Timeline: keeping events in memory only")
+		return
+	}
+	if err := timeline.Open(paths.Timeline, time.Duration(days)*24*time.Hour); err != nil {
+		fmt.Printf("Warning: failed to open event timeline: %v (keeping events in memory only)\n", err)
+	}
+}
+
+// Put device event log entries on the timeline; heartbeat bookkeeping is left out
+func record_device_event(e devices.Event) {
+	var summary string
+	details := make(map[string]interface{})
+	switch e.Type {
+	case devices.EventRegistered:
+		summary = "booted up"
+		if e.Pending {
+			summary = "booted up, awaiting approval"
+		}
+		if e.Zipcode != "" {
+			details["zipcode"] = e.Zipcode
+		}
+	case devices.EventOffline:
+		summary = "went offline"
+		if e.Reason != "" {
+			summary += " (" + e.Reason + ")"
+		}
+	case devices.EventReactivated:
+		summary = "came back online"
+	case devices.EventHeartbeatGap:
+		summary = fmt.Sprintf("heartbeat after %v of silence", time.Duration(e.GapSeconds)*time.Second)
+	case devices.EventApproved:
+		summary = "approved"
+	case devices.EventRemoved:
+		summary = "removed"
+	case devices.EventConfigChanged:
+		// Key names only: config values may be secrets, and the timeline is viewer-readable
+		summary = "config changed"
+		details["changed_keys"] = e.ChangedKeys
+	case devices.EventCalibrationChanged:
+		summary = "display calibration set"
+		if e.Calibration == nil {
+			summary = "display calibration cleared"
+		}
+	case devices.EventQuietHoursChanged:
+		summary = "quiet hours cleared"
+		if e.QuietHours != nil {
+			summary = fmt.Sprintf("quiet hours set to %s-%s", e.QuietHours.Start, e.QuietHours.End)
+		}
+	case devices.EventKeyChanged:
+		summary = "encryption key set"
+		if len(e.Key) == 0 {
+			summary = "encryption key cleared"
+		}
+	case devices.EventFirmwareUpdated:
+		timeline.Record(timeline.TypeFirmware, e.DeviceID,
+			fmt.Sprintf("firmware updated from %s to %s", e.PreviousFirmware, e.Firmware),
+			map[string]interface{}{"firmware": e.Firmware, "previous_firmware": e.PreviousFirmware})
+		return
+	default:
+		return
+	}
+	if len(details) == 0 {
+		details = nil
+	}
+	timeline.Record(timeline.TypeDevice, e.DeviceID, summary, details)
+}
+
+func record_rule_trigger(t rules.Trigger) {
+	state := "off"
+	if t.Active {
+		state = "on"
+	}
+	timeline.Record(timeline.TypeRule, t.Rule.Device,
+		fmt.Sprintf("rule %s turned %s (%s = %g)", t.Rule.Name, state, t.Rule.Metric, t.Value),
+		map[string]interface{}{"rule": t.Rule.Name, "active": t.Active, "value": t.Value, "target": t.Rule.Target})
+}
+
+// Whether the last applied canvas frame was blank
+var canvasBlank atomic.Bool
+
+// Note a canvas clear (a blank frame following a drawing) on the timeline
+func record_canvas_frame(seq uint16, red [16]uint16, green [16]uint16, blue [16]uint16) {
+	blank := blank_frame(red, green, blue)
+	if wasBlank := canvasBlank.Swap(blank); blank && !wasBlank {
+		timeline.Recordf(timeline.TypeCanvas, "", "canvas cleared (seq %d)", seq)
+	}
+}
+
+// A frame with no lit pixels clears the canvas
+func blank_frame(red [16]uint16, green [16]uint16, blue [16]uint16) bool {
+	for y := 0; y < 16; y++ {
+		if red[y]|green[y]|blue[y] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"server_app/internal/devices"
+	"server_app/internal/weather"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Weather push modes (weatherPush.mode in config.json)
+const (
+	weatherPushAlways = "always" // Every fetch is published (unchanged bytes are still skipped)
+	weatherPushChange = "change" // Only meaningful changes, for displays whose refresh is costly
+)
+
+// Change-threshold defaults when not set in config.json
+const (
+	defaultWeatherMinTempChange   = 1   // Degrees
+	defaultWeatherMaxStalenessMin = 180 // Push unchanged weather after this long anyway
+)
+
+// Current weather push settings
+type WeatherPushConfig struct {
+	Mode                string `json:"mode"`                // "always" (default) or "change"
+	MinTempChange       int    `json:"minTempChange"`       // Change mode: degrees that count as a change (0 = 1)
+	MaxStalenessMinutes int    `json:"maxStalenessMinutes"` // Change mode: republish after this long regardless (0 = 180)
+}
+
+// Current weather last pushed per zipcode, the baseline for change mode
+type weatherPush struct {
+	temp      int8
+	feelsLike int8
+	feelsFor  string // Devices on the zipcode set to feels-like (see feels_like_devices)
+	condition string
+	flags     uint8
+	at        time.Time
+}
+
+var (
+	weatherPushMu   sync.Mutex
+	weatherPushLast = make(map[string]weatherPush)
+)
+
+// Whether current weather for zip differs enough from the last push to publish it.
+// The feels-like temperature counts while a device on zip shows it. In "always" mode every
+// update qualifies.
+func weather_push_due(zip string, temp int8, feelsLike int8, condition string, flags uint8) (bool, string) {
+	configMutex.RLock()
+	cfg := runtimeConfig.WeatherPush
+	configMutex.RUnlock()
+	if cfg.Mode != weatherPushChange {
+		return true, ""
+	}
+	minChange := cfg.MinTempChange
+	if minChange <= 0 {
+		minChange = defaultWeatherMinTempChange
+	}
+	maxStaleness := time.Duration(cfg.MaxStalenessMinutes) * time.Minute
+	if maxStaleness <= 0 {
+		maxStaleness = defaultWeatherMaxStalenessMin * time.Minute
+	}
+
+	feelsFor := feels_like_devices(zip)
+	weatherPushMu.Lock()
+	last, pushed := weatherPushLast[zip]
+	weatherPushMu.Unlock()
+	switch {
+	case !pushed:
+		return true, "first push"
+	case math.Abs(float64(temp)-float64(last.temp)) >= float64(minChange):
+		return true, fmt.Sprintf("temperature %d -> %d", last.temp, temp)
+	case feelsFor != last.feelsFor:
+		return true, "feels-like devices changed"
+	case feelsFor != "" && math.Abs(float64(feelsLike)-float64(last.feelsLike)) >= float64(minChange):
+		return true, fmt.Sprintf("feels-like %d -> %d", last.feelsLike, feelsLike)
+	case condition != last.condition:
+		return true, fmt.Sprintf("condition %s -> %s", last.condition, condition)
+	case flags != last.flags:
+		return true, "data quality changed"
+	case time.Since(last.at) >= maxStaleness:
+		return true, fmt.Sprintf("unchanged for %v", maxStaleness)
+	}
+	return false, ""
+}
+
+// Remember what was pushed for zip
+func note_weather_push(zip string, temp int8, feelsLike int8, condition string, flags uint8) {
+	feelsFor := feels_like_devices(zip)
+	weatherPushMu.Lock()
+	defer weatherPushMu.Unlock()
+	weatherPushLast[zip] = weatherPush{temp: temp, feelsLike: feelsLike, feelsFor: feelsFor, condition: condition, flags: flags, at: time.Now()}
+}
+
+// IDs of the devices on zip showing the feels-like temperature, sorted and comma separated
+func feels_like_devices(zip string) string {
+	var ids []string
+	for _, device := range devices.GetActiveDevices() {
+		if device.Zipcode == zip && !device.Pending && device.Config[configKeyFeelsLike] == "true" {
+			ids = append(ids, device.ID)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// Forget the baseline so the next update for zip is pushed (e.g. a device just booted)
+func forget_weather_push(zip string) {
+	weatherPushMu.Lock()
+	defer weatherPushMu.Unlock()
+	delete(weatherPushLast, zip)
+}
+
+// Condition for change detection; missing data only disables that part of the comparison
+func weather_condition(source string) string {
+	condition, _ := weather.GetCurrentCondition(source)
+	return condition
+}
+
+// Feels-like temperature for change detection, temp if not reported
+func weather_feels_like(source string, temp int8) int8 {
+	if conditions, err := weather.GetCurrentConditions(source); err == nil {
+		return conditions.FeelsLike
+	}
+	return temp
+}